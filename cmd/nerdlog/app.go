@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"time"
@@ -41,10 +43,21 @@ type nerdlogApp struct {
 	// navigated on the query edit form.
 	queryCLHistory *clhistory.CLHistory
 
+	// savedQueries manages the named queries saved with the :save command.
+	savedQueries *SavedQueries
+
 	lastQueryFull QueryFull
 
 	// lastLogResp contains the last response from LStreamsManager.
 	lastLogResp *core.LogRespTotal
+
+	// columns are the columns from the logstreams config, which define the
+	// layout of the logs table; see core.Columns.
+	columns core.Columns
+
+	// resumeToken is set if the last query has failed on some logstreams, and
+	// can be resumed with the :resume command.
+	resumeToken *core.QueryResumeToken
 }
 
 type nerdlogAppParams struct {
@@ -55,14 +68,54 @@ type nerdlogAppParams struct {
 	initialQueryData  QueryFull
 	connectRightAway  bool
 	clipboardInitErr  error
-	logLevel          log.LogLevel
+	logger            *log.Logger
 	sshConfigPath     string
 	sshKeys           []string
+	sshCert           string
+	sshPKCS11         *core.SSHPKCS11
+	hostKeys          *core.HostKeys
+	capabilitiesCache *core.CapabilitiesCache
+	queryCache        *core.QueryCache
+
+	coalesceConnections bool
+
+	// allowAdHocCmds enables the :run command; see
+	// core.LStreamsManager.RunAdHoc.
+	allowAdHocCmds bool
+
+	// metrics, if not nil, receives the metrics of the logstreams; see
+	// --metrics-addr.
+	metrics core.Metrics
+
+	// maxQueriesInFlight and queryDebounce throttle the queries; see
+	// core.LStreamsManagerParams.
+	maxQueriesInFlight int
+	queryDebounce      time.Duration
+
+	// maxOpenStreams limits the number of logstreams; see --max-open-streams.
+	maxOpenStreams int
+
+	// maxConcurrentConnects limits the number of logstreams connecting at the
+	// same time; see --max-concurrent-connects.
+	maxConcurrentConnects int
+
+	// selector restricts the logstreams to connect to; see --hosts.
+	selector core.LStreamSelector
 
 	logstreamsConfigPath string
-	cmdHistoryFile       string
+	// logstreamsConfigStdin is the config read from stdin if the
+	// logstreamsConfigPath is StdinConfigPath; see readLogstreamsConfigStdin.
+	logstreamsConfigStdin []byte
+	logstreamsConfigCmds  bool
+	cmdHistoryFile        string
+	savedQueriesFile      string
 
 	noJournalctlAccessWarn bool
+
+	// selectQueryGiven is true if the select query in the initialQueryData is
+	// given with --selquery, so it takes precedence over the columns from the
+	// config.
+	selectQueryGiven bool
 }
 
 type cmdWithOpts struct {
@@ -73,7 +126,7 @@ type cmdWithOpts struct {
 func newNerdlogApp(
 	params nerdlogAppParams, queryCLHistory *clhistory.CLHistory,
 ) (*nerdlogApp, error) {
-	logger := log.NewLogger(params.logLevel)
+	logger := params.logger
 
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -94,6 +147,8 @@ func newNerdlogApp(
 			Timezone:             time.Local,
 			MaxNumLines:          250,
 			DefaultTransportMode: core.NewTransportModeSSHLib(),
+			QueryLang:            core.QueryLangAWK,
+			Sanitize:             true,
 		}),
 
 		tviewApp: tview.NewApplication(),
@@ -101,6 +156,8 @@ func newNerdlogApp(
 		cmdLineHistory: cmdLineHistory,
 		queryBLHistory: blhistory.New(),
 		queryCLHistory: queryCLHistory,
+
+		savedQueries: NewSavedQueries(params.savedQueriesFile),
 	}
 
 	cmdCh := make(chan cmdWithOpts, 8)
@@ -110,6 +167,11 @@ func newNerdlogApp(
 		Options: app.options,
 		OnLogQuery: func(params core.QueryLogsParams) {
 			params.MaxNumLines = app.options.GetMaxNumLines()
+			params.QueryLang = app.options.GetQueryLang()
+			params.FilterIgnoreCase = app.options.GetIgnoreCase()
+			params.FilterWholeWord = app.options.GetWholeWord()
+			params.SampleRate = app.options.GetSampleRate()
+			params.Pin = app.options.GetPin()
 
 			// Get the current QueryFull and marshal it to a shell command.
 			qf := app.mainView.getQueryFull()
@@ -142,6 +204,9 @@ func newNerdlogApp(
 		OnReconnectRequest: func() {
 			app.lsman.Reconnect()
 		},
+		OnStopQueryRequest: func() {
+			app.lsman.StopQuery()
+		},
 		OnCmd: func(cmd string, opts CmdOpts) {
 			cmdCh <- cmdWithOpts{
 				cmd:  cmd,
@@ -160,6 +225,12 @@ func newNerdlogApp(
 		return nil, errors.Trace(err)
 	}
 
+	// The columns from the config define the initial layout of the table,
+	// unless the select query is given explicitly.
+	if len(app.columns) > 0 && !params.selectQueryGiven {
+		params.initialQueryData.SelectQuery = selectQueryFromColumns(app.columns)
+	}
+
 	// Set all the initial options from command line.
 	// NOTE: it has to be done after the LStreamsManager is initialized, but before
 	// we call the applyQueryEditData below, so that if some options affect how
@@ -248,6 +319,20 @@ func (app *nerdlogApp) initLStreamsManager(
 					)
 				}
 
+				if skew := upd.BootstrapIssue.WarnClockSkew; skew != 0 {
+					bootstrapWarnings = append(
+						bootstrapWarnings,
+						errors.Errorf("%s, so its logs might be misplaced on the timeline.", core.FormatClockSkew(upd.BootstrapIssue.LStreamName, skew)),
+					)
+				}
+
+				if warn := upd.BootstrapIssue.WarnWireCompression; warn != "" {
+					bootstrapWarnings = append(
+						bootstrapWarnings,
+						errors.Errorf("%s: %s.", upd.BootstrapIssue.LStreamName, warn),
+					)
+				}
+
 			case upd.DataRequest != nil:
 				dataRequests = append(dataRequests, upd.DataRequest)
 
@@ -281,12 +366,34 @@ func (app *nerdlogApp) initLStreamsManager(
 
 						for _, logResp := range logResps {
 							if len(logResp.Errs) > 0 {
-								app.mainView.handleQueryError(combineErrors(logResp.Errs))
+								err := combineErrors(logResp.Errs)
+								if errors.Cause(err) == core.ErrQuerySuperseded {
+									// The response to the newer query will follow.
+									continue
+								}
+
+								if errors.Cause(err) == core.ErrQueryStopped {
+									// It's what the user asked for, so no need for the error
+									// dialog.
+									app.printMsg("Query stopped")
+									continue
+								}
+
+								app.resumeToken = logResp.ResumeToken
+								if app.resumeToken != nil {
+									err = errors.Errorf(
+										"%s\n\nThe logs from the other %d logstream(s) were delivered; use :resume to query the failed ones again",
+										err.Error(), len(app.resumeToken.Delivered),
+									)
+								}
+
+								app.mainView.handleQueryError(err)
 								return
 							}
 
 							app.mainView.applyLogs(logResp)
 							app.lastLogResp = logResp
+							app.resumeToken = nil
 						}
 
 						if len(bootstrapErrors) > 0 {
@@ -320,70 +427,46 @@ func (app *nerdlogApp) initLStreamsManager(
 
 	envUser := os.Getenv("USER")
 
-	var logstreamsCfg core.ConfigLogStreams
-	if params.logstreamsConfigPath != "" {
-		appLogstreamsCfg, err := LoadLogstreamsConfigFromFile(params.logstreamsConfigPath)
-		if err != nil {
-			if !os.IsNotExist(errors.Cause(err)) {
-				return errors.Annotatef(
-					err,
-					"reading logstreams config from %s (path is configurable via --lstreams-config)",
-					params.logstreamsConfigPath,
-				)
-			}
-		} else {
-			logstreamsCfg = appLogstreamsCfg.LogStreams
-		}
+	logstreamsCfg, err := loadLogstreamsConfig(
+		params.logstreamsConfigPath, params.logstreamsConfigStdin, params.logstreamsConfigCmds,
+	)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	var sshConfig *ssh_config.Config
-	if params.sshConfigPath != "" {
-		sshConfigFile, err := os.Open(params.sshConfigPath)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return errors.Annotatef(
-					err,
-					"reading ssh config from %s (path is configurable via --ssh-config)",
-					params.sshConfigPath,
-				)
-			}
-		} else {
-			defer sshConfigFile.Close()
-			var err error
-			sshConfig, err = ssh_config.Decode(sshConfigFile, false)
-			if err != nil {
-				// Try again but ignoring Match
-				sshConfigFile, _ := os.Open(params.sshConfigPath)
-				defer sshConfigFile.Close()
-				var err error
-				sshConfig, err = ssh_config.Decode(sshConfigFile, true)
-				if err != nil {
-					return errors.Annotatef(
-						err,
-						"parsing ssh config from %s (path is configurable via --ssh-config)",
-						params.sshConfigPath,
-					)
-				}
-
-				if os.Getenv("NERDLOG_NO_WARN_SSH_MATCH") == "" {
-					// Apparently there is a Match directive. Let's warn the user about it,
-					// but still continue.
-					fmt.Printf("Your SSH config %s has a Match directive, fyi it'll be ignored, since Nerdlog can't parse this directive yet (see https://github.com/kevinburke/ssh_config/issues/6).\n", params.sshConfigPath)
-					fmt.Printf("Fyi you can provide a different ssh config with the --ssh-config flag.\n")
-					fmt.Printf("To disable this warning, set NERDLOG_NO_WARN_SSH_MATCH environment variable to 1.\n")
-					fmt.Printf("Press Enter to continue.\n")
-					bufio.NewReader(os.Stdin).ReadBytes('\n')
-				}
-			}
-		}
+	sshConfig, err := loadSSHConfig(params.sshConfigPath)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
+	app.columns = logstreamsCfg.Columns
+	app.mainView.setColumns(app.columns)
+
 	app.lsman = core.NewLStreamsManager(core.LStreamsManagerParams{
 		Logger: logger,
 
-		ConfigLogStreams: logstreamsCfg,
+		ConfigLogStreams: logstreamsCfg.LogStreams,
 		SSHConfig:        sshConfig,
 		SSHKeys:          params.sshKeys,
+		SSHCert:          params.sshCert,
+		SSHPKCS11:        params.sshPKCS11,
+		HostKeys:         params.hostKeys,
+
+		CapabilitiesCache:   params.capabilitiesCache,
+		QueryCache:          params.queryCache,
+		CoalesceConnections: params.coalesceConnections,
+
+		AllowAdHocCmds: params.allowAdHocCmds,
+
+		Metrics: params.metrics,
+
+		MaxQueriesInFlight: params.maxQueriesInFlight,
+		QueryDebounce:      params.queryDebounce,
+		MaxOpenStreams:     params.maxOpenStreams,
+
+		MaxConcurrentConnects: params.maxConcurrentConnects,
+
+		Selector: params.selector,
 
 		InitialLStreams:             initialLStreams,
 		InitialDefaultTransportMode: defaultTransportMode,
@@ -398,6 +481,125 @@ func (app *nerdlogApp) initLStreamsManager(
 	return nil
 }
 
+// loadLogstreamsConfig reads the nerdlog logstreams config from the given
+// path. If the path is empty or the file doesn't exist, it's not an error, and
+// an empty config is returned. If allowCmds is true, the "$(command)"
+// substitution is enabled in the config.
+//
+// If the path is StdinConfigPath, the config is parsed from the stdinData
+// instead, which was read by readLogstreamsConfigStdin; stdin can only be
+// read once, so reloading the config parses the same data again.
+func loadLogstreamsConfig(
+	logstreamsConfigPath string, stdinData []byte, allowCmds bool,
+) (*ConfigLogStreams, error) {
+	if logstreamsConfigPath == "" {
+		return &ConfigLogStreams{}, nil
+	}
+
+	loadParams := LoadLogstreamsConfigParams{
+		AllowCmds: allowCmds,
+	}
+
+	if logstreamsConfigPath == StdinConfigPath {
+		appLogstreamsCfg, err := LoadLogstreamsConfigFromReader(bytes.NewReader(stdinData), loadParams)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading logstreams config from stdin")
+		}
+
+		return appLogstreamsCfg, nil
+	}
+
+	appLogstreamsCfg, err := LoadLogstreamsConfigFromFile(logstreamsConfigPath, loadParams)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return &ConfigLogStreams{}, nil
+		}
+
+		return nil, errors.Annotatef(
+			err,
+			"reading logstreams config from %s (path is configurable via --lstreams-config)",
+			logstreamsConfigPath,
+		)
+	}
+
+	return appLogstreamsCfg, nil
+}
+
+// readLogstreamsConfigStdin reads the whole logstreams config from the given
+// stdin, for --lstreams-config=-. It refuses to read from a terminal, since
+// it would then just hang waiting for the input: the config has to be piped
+// or redirected.
+func readLogstreamsConfigStdin(stdin *os.File) ([]byte, error) {
+	fi, err := stdin.Stat()
+	if err != nil {
+		return nil, errors.Annotatef(err, "checking stdin")
+	}
+
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, errors.Errorf(
+			"--lstreams-config is %q, but stdin is a terminal; pipe the config to nerdlog, like: cat logstreams.yaml | nerdlog --lstreams-config %s ...",
+			StdinConfigPath, StdinConfigPath,
+		)
+	}
+
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading logstreams config from stdin")
+	}
+
+	return data, nil
+}
+
+// loadSSHConfig reads the ssh config from the given path. If the path is empty
+// or the file doesn't exist, it's not an error, and nil config is returned.
+func loadSSHConfig(sshConfigPath string) (*ssh_config.Config, error) {
+	if sshConfigPath == "" {
+		return nil, nil
+	}
+
+	sshConfigFile, err := os.Open(sshConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Annotatef(
+			err,
+			"reading ssh config from %s (path is configurable via --ssh-config)",
+			sshConfigPath,
+		)
+	}
+	defer sshConfigFile.Close()
+
+	sshConfig, err := ssh_config.Decode(sshConfigFile, false)
+	if err != nil {
+		// Try again but ignoring Match
+		sshConfigFile, _ := os.Open(sshConfigPath)
+		defer sshConfigFile.Close()
+		var err error
+		sshConfig, err = ssh_config.Decode(sshConfigFile, true)
+		if err != nil {
+			return nil, errors.Annotatef(
+				err,
+				"parsing ssh config from %s (path is configurable via --ssh-config)",
+				sshConfigPath,
+			)
+		}
+
+		if os.Getenv("NERDLOG_NO_WARN_SSH_MATCH") == "" {
+			// Apparently there is a Match directive. Let's warn the user about it,
+			// but still continue.
+			fmt.Printf("Your SSH config %s has a Match directive, fyi it'll be ignored, since Nerdlog can't parse this directive yet (see https://github.com/kevinburke/ssh_config/issues/6).\n", sshConfigPath)
+			fmt.Printf("Fyi you can provide a different ssh config with the --ssh-config flag.\n")
+			fmt.Printf("To disable this warning, set NERDLOG_NO_WARN_SSH_MATCH environment variable to 1.\n")
+			fmt.Printf("Press Enter to continue.\n")
+			bufio.NewReader(os.Stdin).ReadBytes('\n')
+		}
+	}
+
+	return sshConfig, nil
+}
+
 func (app *nerdlogApp) handleCmdLine(cmdCh <-chan cmdWithOpts) {
 	for {
 		cwo := <-cmdCh
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -8,9 +9,11 @@ import (
 	"unicode/utf8"
 
 	"github.com/dimonomid/nerdlog/clipboard"
+	"github.com/dimonomid/nerdlog/core"
 	"github.com/dimonomid/nerdlog/version"
 	"github.com/gdamore/tcell/v2"
 	"github.com/juju/errors"
+	"github.com/rivo/tview"
 )
 
 // NOTE: handleCmd is always called from the tview's event loop, so it's safe
@@ -117,6 +120,77 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 			return
 		}
 
+	case "save":
+		if len(parts) != 2 {
+			app.printError("save requires exactly one argument: the name of the query")
+			return
+		}
+
+		sq := NewSavedQuery(parts[1], app.mainView.getQueryFull())
+		if err := app.savedQueries.SaveQuery(sq); err != nil {
+			app.printError(fmt.Sprintf("Failed to save query: %s", err))
+			return
+		}
+
+		app.printMsg(fmt.Sprintf("Saved query %q", sq.Name))
+
+	case "load":
+		if len(parts) != 2 {
+			app.printError("load requires exactly one argument: the name of the query")
+			return
+		}
+
+		sq, err := app.savedQueries.LoadQuery(parts[1])
+		if err != nil {
+			app.printError(fmt.Sprintf("Failed to load query: %s", err))
+			return
+		}
+
+		if err := app.mainView.applyQueryEditData(sq.QueryFull(), doQueryParams{}); err != nil {
+			app.printError(err.Error())
+			return
+		}
+
+	case "delquery":
+		if len(parts) != 2 {
+			app.printError("delquery requires exactly one argument: the name of the query")
+			return
+		}
+
+		if err := app.savedQueries.DeleteQuery(parts[1]); err != nil {
+			app.printError(fmt.Sprintf("Failed to delete query: %s", err))
+			return
+		}
+
+		app.printMsg(fmt.Sprintf("Deleted query %q", parts[1]))
+
+	case "queries":
+		queries, err := app.savedQueries.ListQueries()
+		if err != nil {
+			app.printError(fmt.Sprintf("Failed to list queries: %s", err))
+			return
+		}
+
+		if len(queries) == 0 {
+			app.printMsg("No saved queries yet, use :save <name> to save the current one")
+			return
+		}
+
+		var sb strings.Builder
+		for i, sq := range queries {
+			if i > 0 {
+				sb.WriteString("\n")
+			}
+
+			qf := sq.QueryFull()
+			fmt.Fprintf(&sb, "%s:\n    %s\n", sq.Name, qf.MarshalShellCmd())
+		}
+
+		app.mainView.showMessagebox("queries", "Saved queries", sb.String(), &MessageboxParams{
+			BackgroundColor: tcell.ColorDarkBlue,
+			CopyButton:      true,
+		})
+
 	case "prev", "bac", "bck", "back":
 		item := app.queryBLHistory.Prev()
 		if item == nil {
@@ -163,14 +237,53 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 	case "disconnect":
 		app.mainView.disconnect()
 
+	case "stop":
+		app.mainView.stopQuery()
+
+	case "reload":
+		go app.reloadLogstreamsConfig()
+
 	case "refresh":
 		app.mainView.doQuery(doQueryParams{})
 
+	case "older", "more":
+		app.mainView.loadOlder()
+
+	case "newer":
+		app.mainView.loadNewer()
+
+	case "resume":
+		if app.resumeToken == nil {
+			app.printError("Nothing to resume, the last query hasn't failed partially")
+			return
+		}
+
+		app.mainView.resumeQuery(app.resumeToken)
+
 	case "refresh!":
 		app.mainView.doQuery(doQueryParams{
 			refreshIndex: true,
 		})
 
+	case "run":
+		if !app.params.allowAdHocCmds {
+			app.printError("Ad hoc commands are disabled, restart nerdlog with --allow-adhoc-cmds to enable them")
+			return
+		}
+
+		if len(parts) < 3 {
+			app.printError("run requires two arguments: the logstream and the command to run")
+			return
+		}
+
+		// The command is everything after the logstream, as is.
+		lstream := parts[1]
+		remaining := strings.TrimSpace(cmd)[len(parts[0]):]
+		command := strings.TrimSpace(strings.TrimSpace(remaining)[len(lstream):])
+
+		app.printMsg(fmt.Sprintf("Running on %s: %s", lstream, command))
+		go app.runAdHoc(lstream, command)
+
 	case "conndebug", "cdebug":
 		app.mainView.showConnDebugInfo()
 
@@ -188,6 +301,57 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 	}
 }
 
+// runAdHoc runs the command on the logstream, and shows the output once it's
+// done. It blocks, so it must not be called from the tview's event loop.
+func (app *nerdlogApp) runAdHoc(lstream, command string) {
+	output, err := app.lsman.RunAdHoc(context.Background(), lstream, command)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("$ %s\n", command))
+	sb.WriteString(output)
+	if err != nil {
+		sb.WriteString(fmt.Sprintf("\nError: %s", err.Error()))
+	}
+
+	app.tviewApp.QueueUpdateDraw(func() {
+		app.mainView.showMessagebox("adhoc", lstream, tview.Escape(sb.String()), &MessageboxParams{
+			BackgroundColor: tcell.ColorDarkBlue,
+			CopyButton:      true,
+		})
+	})
+}
+
+// reloadLogstreamsConfig re-reads the logstreams config and applies it,
+// reconnecting only the logstreams which have changed. It blocks, so it must
+// not be called from the tview's event loop.
+func (app *nerdlogApp) reloadLogstreamsConfig() {
+	var diff *core.LStreamsDiff
+
+	cfg, err := loadLogstreamsConfig(
+		app.params.logstreamsConfigPath, app.params.logstreamsConfigStdin, app.params.logstreamsConfigCmds,
+	)
+	if err == nil {
+		diff, err = app.lsman.Reload(context.Background(), cfg.LogStreams)
+	}
+
+	app.tviewApp.QueueUpdateDraw(func() {
+		if err != nil {
+			app.printError(fmt.Sprintf("Failed to reload logstreams config: %s", err))
+			return
+		}
+
+		if diff.IsEmpty() {
+			app.printMsg("Logstreams config reloaded, no changes")
+			return
+		}
+
+		app.printMsg(fmt.Sprintf(
+			"Logstreams config reloaded: %d added, %d removed, %d changed",
+			len(diff.Added), len(diff.Removed), len(diff.Changed),
+		))
+	})
+}
+
 func (app *nerdlogApp) unmarshalAndApplyQuery(cmd string, dqp doQueryParams) error {
 	var qf QueryFull
 	if err := qf.UnmarshalShellCmd(cmd); err != nil {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/mattn/go-runewidth"
+)
+
+// columnsLayout is the layout of the logs table defined by the columns from
+// the config (see core.Columns): the widths and the truncation of the
+// columns, by the field name as in the select query.
+type columnsLayout map[string]core.Column
+
+func newColumnsLayout(cols core.Columns) columnsLayout {
+	ret := make(columnsLayout, len(cols))
+	for _, col := range cols {
+		ret[columnFieldName(col.Field)] = col
+	}
+
+	return ret
+}
+
+// columnFieldName returns the name of the field in the select query for the
+// given core.Column.Field: they're the same, except the message.
+func columnFieldName(field string) string {
+	if field == core.ColumnFieldMsg {
+		return FieldNameMessage
+	}
+
+	return field
+}
+
+// selectQueryFromColumns returns the select query showing the given columns,
+// in the given order, with their titles.
+func selectQueryFromColumns(cols core.Columns) SelectQuery {
+	sqp := &SelectQueryParsed{}
+	for _, col := range cols {
+		name := columnFieldName(col.Field)
+		sqp.Fields = append(sqp.Fields, SelectQueryField{
+			Name:        name,
+			DisplayName: columnDisplayName(col, name),
+		})
+	}
+
+	return sqp.Marshal()
+}
+
+// columnDisplayName returns the column title to use in the select query; the
+// select query can't have whitespace or commas in the names, so such titles
+// are replaced with the field name.
+func columnDisplayName(col core.Column, name string) string {
+	if col.Title == "" || strings.ContainsAny(col.Title, ", \t") {
+		return name
+	}
+
+	return col.Title
+}
+
+// formatValue applies the truncation and the width of the column to the value
+// of the given field, which must not be escaped yet. If the field has no
+// column configured, the value is returned as is.
+func (cl columnsLayout) formatValue(field, value string) string {
+	col, ok := cl[field]
+	if !ok {
+		return value
+	}
+
+	return fitColumnWidth(core.TruncateColumnValue(value, col.Truncate), col.Width)
+}
+
+// formatHeader applies the width of the column to the header of the given
+// field; the header is never truncated otherwise.
+func (cl columnsLayout) formatHeader(field, header string) string {
+	col, ok := cl[field]
+	if !ok {
+		return header
+	}
+
+	return fitColumnWidth(header, col.Width)
+}
+
+// fitColumnWidth makes the text exactly width cells wide on the screen:
+// pads it with spaces, or cuts it ending with "…". If width is zero, the text
+// is returned as is.
+func fitColumnWidth(text string, width int) string {
+	if width <= 0 {
+		return text
+	}
+
+	return runewidth.FillRight(runewidth.Truncate(text, width, "…"), width)
+}
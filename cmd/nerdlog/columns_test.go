@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/stretchr/testify/assert"
+)
+
+// renderTable draws the table on a simulated screen of the given size, and
+// returns its lines, with the trailing spaces trimmed.
+func renderTable(t *testing.T, table *tview.Table, width, height int) []string {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Fini()
+
+	screen.SetSize(width, height)
+	table.SetRect(0, 0, width, height)
+	table.Draw(screen)
+	screen.Show()
+
+	cells, w, h := screen.GetContents()
+	lines := make([]string, 0, h)
+	for y := 0; y < h; y++ {
+		var sb strings.Builder
+		for x := 0; x < w; x++ {
+			cell := cells[y*w+x]
+			if len(cell.Runes) == 0 {
+				sb.WriteRune(' ')
+				continue
+			}
+
+			sb.WriteString(string(cell.Runes))
+		}
+
+		lines = append(lines, strings.TrimRight(sb.String(), " "))
+	}
+
+	return lines
+}
+
+func TestColumnsLayout(t *testing.T) {
+	cols := core.Columns{
+		{Field: "lstream", Title: "host", Width: 8},
+		{Field: "msg", Title: "the message", Truncate: 12},
+		{Field: "time", Width: 4},
+	}
+
+	// The order and the titles go to the select query; the titles which the
+	// select query can't have are replaced with the field name.
+	assert.Equal(t, SelectQuery("lstream AS host, message, time"), selectQueryFromColumns(cols))
+
+	sqp, err := ParseSelectQuery(selectQueryFromColumns(cols))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	layout := newColumnsLayout(cols)
+
+	rows := []map[string]string{
+		{"lstream": "web-01", "message": "connection refused while talking to the upstream", "time": "10:00:01"},
+		{"lstream": "a-very-long-hostname", "message": "ok", "time": "10:00:02"},
+	}
+
+	table := tview.NewTable()
+	table.SetBorders(false)
+	for i, fld := range sqp.Fields {
+		table.SetCell(0, i, newTableCellHeader(layout.formatHeader(fld.Name, fld.DisplayName)))
+
+		for j, row := range rows {
+			table.SetCell(j+1, i, newTableCellLogmsg(layout.formatValue(fld.Name, row[fld.Name])))
+		}
+	}
+
+	lines := renderTable(t, table, 60, 3)
+	assert.Equal(t, []string{
+		"host     message      time",
+		"web-01   connection … 10:…",
+		"a-very-… ok           10:…",
+	}, lines)
+
+	// The fields without a configured column are not affected.
+	assert.Equal(t, "foo bar", layout.formatValue("program", "foo bar"))
+	assert.Equal(t, "program", layout.formatHeader("program", "program"))
+}
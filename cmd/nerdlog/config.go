@@ -1,9 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 
 	"github.com/dimonomid/nerdlog/core"
 	"github.com/juju/errors"
@@ -11,28 +16,130 @@ import (
 )
 
 type ConfigLogStreams struct {
+	// Include is a list of glob patterns of other config files to read the
+	// logstreams from; relative patterns are relative to the directory of the
+	// file which includes them. A pattern can also match a directory, in which
+	// case all *.yaml and *.yml files in it are read.
+	Include []string `yaml:"include,omitempty"`
+
+	// DefaultTransport, if not empty, is used as the options.transport of all
+	// the logstreams which don't have it; the syntax is the same as for the
+	// transport option. If multiple config files set it, the values must be
+	// the same.
+	DefaultTransport string `yaml:"default_transport,omitempty"`
+
 	LogStreams core.ConfigLogStreams `yaml:"log_streams"`
+
+	// HostsCommands generate logstreams from the host lists returned by local
+	// commands; see ConfigHostsCommand.
+	HostsCommands []ConfigHostsCommand `yaml:"hosts_commands,omitempty"`
+
+	// Columns, if not empty, define the layout of the logs table and the CSV
+	// export; see core.Columns. If multiple config files set them, they must
+	// be the same.
+	Columns core.Columns `yaml:"columns,omitempty"`
+}
+
+// StdinConfigPath is the config path which means reading the config from
+// stdin instead of a file; see LoadLogstreamsConfigFromReader.
+const StdinConfigPath = "-"
+
+// stdinConfigSource is how the config read from stdin is referred to in the
+// errors.
+const stdinConfigSource = "<stdin>"
+
+type LoadLogstreamsConfigParams struct {
+	// AllowCmds enables the "$(command)" substitution in the config values;
+	// see configExpander.
+	AllowCmds bool
 }
 
-func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
-	file, err := os.Open(path)
+// LoadLogstreamsConfigFromFile reads the logstreams config from the given
+// path, which can be either a file or a directory with *.yaml files, and
+// follows all the includes. The logstreams from all files are merged into a
+// single config; if the same logstream is defined in more than one file, it's
+// an error, since silently overriding it would be confusing.
+//
+// The hosts commands are executed, and their logstreams are added to the
+// config as well; if some command fails, the whole config fails to load.
+//
+// The env vars like "${VAR}" in the values are expanded; see configExpander
+// for details. The templated entries like "web-[01-50]" are expanded too; see
+// core.ExpandConfigLogStreams.
+func LoadLogstreamsConfigFromFile(
+	path string, params LoadLogstreamsConfigParams,
+) (*ConfigLogStreams, error) {
+	loader := newLogstreamsConfigLoader(params)
+
+	if err := loader.load(path, nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return loader.finish()
+}
+
+// LoadLogstreamsConfigFromReader is like LoadLogstreamsConfigFromFile, but
+// reads the top-level config from the given reader, typically stdin, e.g. for
+// "cat fleet.yaml | nerdlog --headless --lstreams-config - ...". Since there
+// is no config file, the relative include patterns are relative to the
+// current directory, and the hosts commands are executed in it as well.
+func LoadLogstreamsConfigFromReader(
+	r io.Reader, params LoadLogstreamsConfigParams,
+) (*ConfigLogStreams, error) {
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil, errors.Annotatef(err, "opening config file: %s", path)
+		return nil, errors.Annotatef(err, "reading config from %s", stdinConfigSource)
 	}
-	defer file.Close()
 
-	data, err := ioutil.ReadAll(file)
+	dir, err := os.Getwd()
 	if err != nil {
-		return nil, errors.Annotatef(err, "reading config file %s", path)
+		return nil, errors.Annotatef(err, "getting current directory")
 	}
 
-	var cfg ConfigLogStreams
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, errors.Annotatef(err, "unmarshaling yaml from %s", path)
+	loader := newLogstreamsConfigLoader(params)
+
+	if err := loader.loadData(data, stdinConfigSource, stdinConfigSource, dir, nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return loader.finish()
+}
+
+func newLogstreamsConfigLoader(params LoadLogstreamsConfigParams) *logstreamsConfigLoader {
+	return &logstreamsConfigLoader{
+		cfg: &ConfigLogStreams{
+			LogStreams: core.ConfigLogStreams{},
+		},
+		sources:  map[string]string{},
+		loaded:   map[string]struct{}{},
+		expander: newConfigExpander(params.AllowCmds),
+	}
+}
+
+// finish expands the templated entries in the config loaded so far, and
+// validates it.
+func (l *logstreamsConfigLoader) finish() (*ConfigLogStreams, error) {
+	cfg := l.cfg
+
+	expanded, err := core.ExpandConfigLogStreams(cfg.LogStreams)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cfg.LogStreams = expanded
+
+	if cfg.DefaultTransport != "" {
+		for k, cls := range cfg.LogStreams {
+			if cls.Options.Transport == "" {
+				cls.Options.Transport = cfg.DefaultTransport
+				cfg.LogStreams[k] = cls
+			}
+		}
 	}
 
 	// Make sure the logstreams configuration is not obviously invalid.
-	for k, cls := range cfg.LogStreams {
+	for _, k := range cfg.LogStreams.Keys() {
+		cls := cfg.LogStreams[k]
+
 		_, ok := core.ValidSudoModes[cls.Options.SudoMode]
 		if cls.Options.SudoMode != "" && !ok {
 			validModes := make([]string, 0, len(core.ValidSudoModes))
@@ -48,6 +155,43 @@ func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
 			)
 		}
 
+		_, ok = core.ValidWireCompressions[cls.Options.WireCompression]
+		if cls.Options.WireCompression != "" && !ok {
+			validCompressions := make([]string, 0, len(core.ValidWireCompressions))
+			for wc := range core.ValidWireCompressions {
+				validCompressions = append(validCompressions, string(wc))
+			}
+
+			sort.Strings(validCompressions)
+
+			return nil, errors.Errorf(
+				"%s: invalid wire_compression %q; valid options are: %s",
+				k, cls.Options.WireCompression, validCompressions,
+			)
+		}
+
+		if cls.Options.CPULimitSeconds < 0 || cls.Options.MemoryLimitKB < 0 {
+			return nil, errors.Errorf(
+				"%s: cpu_limit_seconds and memory_limit_kb can't be negative", k,
+			)
+		}
+
+		if cls.Options.StdinChunkSize < 0 || cls.Options.StdinChunkDelay < 0 {
+			return nil, errors.Errorf(
+				"%s: stdin_chunk_size and stdin_chunk_delay can't be negative", k,
+			)
+		}
+
+		if cls.Options.ShellStartTimeout < 0 || cls.Options.MarkerTimeout < 0 {
+			return nil, errors.Errorf(
+				"%s: shell_start_timeout and marker_timeout can't be negative", k,
+			)
+		}
+
+		if cls.Options.ProbeTimeout < 0 {
+			return nil, errors.Errorf("%s: probe_timeout can't be negative", k)
+		}
+
 		if cls.Options.SudoMode != "" && cls.Options.Sudo {
 			return nil, errors.Errorf(
 				"%s: both sudo and sudo_mode are set; please only use one of them", k,
@@ -55,5 +199,230 @@ func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
 		}
 	}
 
-	return &cfg, nil
+	return cfg, nil
+}
+
+// logstreamsConfigLoader accumulates the logstreams from all the config files
+// being loaded.
+type logstreamsConfigLoader struct {
+	cfg *ConfigLogStreams
+
+	// sources maps logstream key to the file where it's defined.
+	sources map[string]string
+
+	// defaultTransportSource is the file where the default_transport is set,
+	// if any.
+	defaultTransportSource string
+
+	// columnsSource is the file where the columns are set, if any.
+	columnsSource string
+
+	// loaded contains absolute paths of all files and directories which were
+	// already loaded, so that the same file included twice (not in a cycle) is
+	// only loaded once.
+	loaded map[string]struct{}
+
+	expander *configExpander
+}
+
+// load reads the config file or directory at the given path; stack contains
+// the absolute paths of the files which are currently being loaded, to
+// detect include cycles.
+func (l *logstreamsConfigLoader) load(path string, stack []string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Annotatef(err, "getting absolute path of %s", path)
+	}
+
+	fi, err := os.Stat(absPath)
+	if err != nil {
+		return errors.Annotatef(err, "opening config file: %s", path)
+	}
+
+	for _, p := range stack {
+		if p == absPath {
+			return errors.Errorf(
+				"include cycle: %s", strings.Join(append(stack, absPath), " -> "),
+			)
+		}
+	}
+
+	if _, ok := l.loaded[absPath]; ok {
+		return nil
+	}
+	l.loaded[absPath] = struct{}{}
+
+	stack = append(stack[:len(stack):len(stack)], absPath)
+
+	if fi.IsDir() {
+		return errors.Trace(l.loadDir(absPath, stack))
+	}
+
+	data, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return errors.Annotatef(err, "reading config file %s", path)
+	}
+
+	return errors.Trace(l.loadData(data, path, absPath, filepath.Dir(absPath), stack))
+}
+
+// loadData parses the config data and loads everything from it, including the
+// includes. The path is used in the errors, the source is what's remembered
+// as the source of the logstreams, and the relative includes and the hosts
+// commands are relative to the dir.
+func (l *logstreamsConfigLoader) loadData(
+	data []byte, path, source, dir string, stack []string,
+) error {
+	var cfg ConfigLogStreams
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return errors.Annotatef(err, "unmarshaling yaml from %s", path)
+	}
+
+	if cfg.DefaultTransport != "" {
+		if err := l.setDefaultTransport(cfg.DefaultTransport, path, source); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if len(cfg.Columns) > 0 {
+		if err := l.setColumns(cfg.Columns, path, source); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for _, k := range cfg.LogStreams.Keys() {
+		cls := cfg.LogStreams[k]
+		if err := l.expander.expandLogStream(&cls); err != nil {
+			return errors.Annotatef(err, "%s: %s", path, k)
+		}
+
+		if err := l.addLogStream(k, cls, source); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for i, hc := range cfg.HostsCommands {
+		if err := l.expander.expandLogStream(&hc.Template); err != nil {
+			return errors.Annotatef(err, "%s: hosts_commands[%d]: template", path, i)
+		}
+
+		generated, err := hc.generate(dir)
+		if err != nil {
+			return errors.Annotatef(err, "%s: hosts_commands[%d]", path, i)
+		}
+
+		hcSource := fmt.Sprintf("%s (hosts_commands[%d])", source, i)
+		for _, k := range generated.Keys() {
+			if err := l.addLogStream(k, generated[k], hcSource); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	for _, pattern := range cfg.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Annotatef(err, "%s: invalid include pattern %q", path, pattern)
+		}
+
+		// A pattern without wildcards is a specific file, so it must exist;
+		// otherwise it's probably a typo.
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return errors.Errorf("%s: included file %s doesn't exist", path, pattern)
+		}
+
+		for _, m := range matches {
+			if err := l.load(m, stack); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addLogStream adds the logstream defined in the given source to the config,
+// making sure it's not defined anywhere else.
+func (l *logstreamsConfigLoader) addLogStream(
+	key string, cls core.ConfigLogStream, source string,
+) error {
+	if src, ok := l.sources[key]; ok {
+		return errors.Errorf(
+			"logstream %q is defined in both %s and %s", key, src, source,
+		)
+	}
+
+	l.sources[key] = source
+	l.cfg.LogStreams[key] = cls
+
+	return nil
+}
+
+// setDefaultTransport validates and sets the default transport defined in the
+// given source, making sure it doesn't conflict with the one defined anywhere
+// else.
+func (l *logstreamsConfigLoader) setDefaultTransport(transport, path, source string) error {
+	// Same as options.transport, it might be a custom command.
+	transport, err := l.expander.expand(transport, true)
+	if err != nil {
+		return errors.Annotatef(err, "%s: default_transport", path)
+	}
+
+	if _, err := core.ParseTransportMode(transport); err != nil {
+		return errors.Annotatef(err, "%s: default_transport", path)
+	}
+
+	if src := l.defaultTransportSource; src != "" && l.cfg.DefaultTransport != transport {
+		return errors.Errorf(
+			"default_transport is set to different values in %s and %s", src, source,
+		)
+	}
+
+	l.defaultTransportSource = source
+	l.cfg.DefaultTransport = transport
+
+	return nil
+}
+
+func (l *logstreamsConfigLoader) setColumns(columns core.Columns, path, source string) error {
+	if err := columns.Validate(); err != nil {
+		return errors.Annotatef(err, "%s: columns", path)
+	}
+
+	if src := l.columnsSource; src != "" && !reflect.DeepEqual(l.cfg.Columns, columns) {
+		return errors.Errorf(
+			"columns are set to different values in %s and %s", src, source,
+		)
+	}
+
+	l.columnsSource = source
+	l.cfg.Columns = columns
+
+	return nil
+}
+
+// loadDir loads all *.yaml and *.yml files from the given directory, in
+// lexical order.
+func (l *logstreamsConfigLoader) loadDir(dir string, stack []string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Annotatef(err, "reading config dir %s", dir)
+	}
+
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		if err := l.load(filepath.Join(dir, e.Name()), stack); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+// DefaultHostsCommandTimeout is the default for ConfigHostsCommand.Timeout.
+const DefaultHostsCommandTimeout = 30 * time.Second
+
+// hostPlaceholder is replaced with the host in the ConfigHostsCommand.Name
+// and in the Hostname of the ConfigHostsCommand.Template.
+const hostPlaceholder = "{host}"
+
+// ConfigHostsCommand generates logstreams for dynamic fleets: it runs a local
+// command which returns the list of hosts (like the cloud CLI listing the
+// instances), and creates a logstream per host, using the template.
+type ConfigHostsCommand struct {
+	// Command is executed with the local shell, in the directory of the config
+	// file. Its stdout should contain either one host per line (empty lines
+	// and lines starting with # are ignored), or a JSON array of strings.
+	Command string `yaml:"command"`
+
+	// Name is the template of the logstream name, where "{host}" is replaced
+	// with the host. If empty, the host itself is used as a name.
+	Name string `yaml:"name,omitempty"`
+
+	// Template contains the settings for every generated logstream. If its
+	// Hostname is empty, it's set to the host; otherwise, "{host}" in it is
+	// replaced with the host.
+	Template core.ConfigLogStream `yaml:"template,omitempty"`
+
+	// Timeout for the command; by default, it's DefaultHostsCommandTimeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// generate runs the command in the given dir, and returns the logstreams
+// generated from its output.
+func (hc *ConfigHostsCommand) generate(dir string) (core.ConfigLogStreams, error) {
+	if strings.TrimSpace(hc.Command) == "" {
+		return nil, errors.Errorf("command is empty")
+	}
+
+	if hc.Name != "" && !strings.Contains(hc.Name, hostPlaceholder) {
+		return nil, errors.Errorf("name %q doesn't contain %s", hc.Name, hostPlaceholder)
+	}
+
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHostsCommandTimeout
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", hc.Command)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Annotatef(err, "starting %q", hc.Command)
+	}
+
+	// NOTE: we don't use exec.CommandContext, since if the command has started
+	// some children which keep the stdout open, Wait would still wait for them
+	// after the command is killed.
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, errors.Annotatef(err, "running %q: %s", hc.Command, msg)
+			}
+
+			return nil, errors.Annotatef(err, "running %q", hc.Command)
+		}
+
+	case <-timer.C:
+		cmd.Process.Kill()
+		return nil, errors.Errorf("running %q: timed out after %s", hc.Command, timeout)
+	}
+
+	out := stdout.Bytes()
+
+	hosts, err := parseHostsCommandOutput(out)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing output of %q", hc.Command)
+	}
+
+	ret := make(core.ConfigLogStreams, len(hosts))
+	for _, host := range hosts {
+		name := host
+		if hc.Name != "" {
+			name = strings.Replace(hc.Name, hostPlaceholder, host, -1)
+		}
+
+		cls := hc.Template
+		if cls.Hostname == "" {
+			cls.Hostname = host
+		} else {
+			cls.Hostname = strings.Replace(cls.Hostname, hostPlaceholder, host, -1)
+		}
+
+		// The same host returned twice is most likely harmless, so just ignore
+		// the duplicates.
+		ret[name] = cls
+	}
+
+	return ret, nil
+}
+
+// parseHostsCommandOutput parses the list of hosts, either as a JSON array of
+// strings, or as one host per line.
+func parseHostsCommandOutput(out []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(out)
+
+	var hosts []string
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &hosts); err != nil {
+			return nil, errors.Annotatef(err, "expected a JSON array of strings")
+		}
+	} else {
+		for _, line := range strings.Split(string(trimmed), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			hosts = append(hosts, line)
+		}
+	}
+
+	for _, host := range hosts {
+		if host == "" || strings.ContainsAny(host, " \t,") {
+			return nil, errors.Errorf("invalid host %q", host)
+		}
+	}
+
+	return hosts, nil
+}
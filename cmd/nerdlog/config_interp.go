@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+)
+
+var envVarNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// configExpander expands the env vars (and optionally commands) in the
+// logstreams config values. Supported syntax is:
+//
+//   - "${VAR}": value of the env var VAR; it's an error if it's not set;
+//   - "${VAR:-default}": value of VAR, or the default if VAR is unset or empty;
+//     the default can contain further ${...} expressions;
+//   - "$${": a literal "${";
+//   - "$(command)": output of the command, with the trailing newlines removed;
+//     only if allowCmds is true, otherwise it's an error.
+//
+// Anything else, including "$VAR" without braces, is left as is.
+type configExpander struct {
+	allowCmds bool
+
+	lookupEnv func(name string) (string, bool)
+	runCmd    func(command string) (string, error)
+}
+
+func newConfigExpander(allowCmds bool) *configExpander {
+	return &configExpander{
+		allowCmds: allowCmds,
+		lookupEnv: os.LookupEnv,
+		runCmd:    runConfigCmd,
+	}
+}
+
+// expandLogStream expands all the string values of the given logstream
+// which make sense to be machine-specific. The ShellInit commands are not
+// touched, since they're executed on the remote host by its own shell.
+func (e *configExpander) expandLogStream(cls *core.ConfigLogStream) error {
+	type field struct {
+		name string
+		ptr  *string
+	}
+
+	fields := []field{
+		{"hostname", &cls.Hostname},
+		{"port", &cls.Port},
+		{"user", &cls.User},
+		{"jump", &cls.Jump},
+		{"bind_address", &cls.BindAddress},
+		{"proxy_url", &cls.ProxyURL},
+	}
+
+	for i := range cls.LogFiles {
+		fields = append(fields, field{fmt.Sprintf("log_files[%d]", i), &cls.LogFiles[i]})
+	}
+
+	for i := range cls.LogSources {
+		src := &cls.LogSources[i]
+		for j := range src.LogFiles {
+			fields = append(fields, field{
+				fmt.Sprintf("log_sources[%d].log_files[%d]", i, j), &src.LogFiles[j],
+			})
+		}
+	}
+
+	if cls.LogArchive != nil {
+		// The archive config is a pointer, so copy it before modifying.
+		archive := *cls.LogArchive
+		cls.LogArchive = &archive
+
+		fields = append(fields, field{"log_archive.path", &archive.Path})
+	}
+
+	if cls.SSH != nil {
+		// Same as with the archive, copy the ssh block before modifying.
+		sshBlock := *cls.SSH
+		cls.SSH = &sshBlock
+
+		fields = append(fields,
+			field{"ssh.host", &sshBlock.Host},
+			field{"ssh.port", &sshBlock.Port},
+			field{"ssh.user", &sshBlock.User},
+			field{"ssh.jump", &sshBlock.Jump},
+			field{"ssh.identity_file", &sshBlock.IdentityFile},
+		)
+
+		if sshBlock.Options != nil {
+			options := make(map[string]string, len(sshBlock.Options))
+			for k, v := range sshBlock.Options {
+				v, err := e.expand(v, false)
+				if err != nil {
+					return errors.Annotatef(err, "ssh.options.%s", k)
+				}
+
+				options[k] = v
+			}
+			sshBlock.Options = options
+		}
+	}
+
+	for _, f := range fields {
+		v, err := e.expand(*f.ptr, false)
+		if err != nil {
+			return errors.Annotatef(err, "%s", f.name)
+		}
+
+		*f.ptr = v
+	}
+
+	// The custom transport command is executed by the local shell, which
+	// expands the NL* env vars and $(...) on its own; see expand.
+	v, err := e.expand(cls.Options.Transport, true)
+	if err != nil {
+		return errors.Annotatef(err, "options.transport")
+	}
+	cls.Options.Transport = v
+
+	v, err = e.expand(cls.ProxyCommand, true)
+	if err != nil {
+		return errors.Annotatef(err, "proxy_command")
+	}
+	cls.ProxyCommand = v
+
+	return nil
+}
+
+// expand expands the given string value. If shellCmd is true, the value is a
+// shell command: then, the NL* env vars (which are set by the custom
+// transport for its command) and "$(...)" are left for the shell to expand.
+func (e *configExpander) expand(s string, shellCmd bool) (string, error) {
+	var sb strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(s[i+1:], "${"):
+			sb.WriteString("${")
+			i += 2
+
+		case s[i+1] == '{':
+			end := findClosing(s, i+1, '{', '}')
+			if end < 0 {
+				return "", errors.Errorf("unterminated %q", s[i:])
+			}
+
+			expr := s[i : end+1]
+			name, op, arg := expr[2:len(expr)-1], "", ""
+			if idx := strings.IndexRune(name, ':'); idx >= 0 {
+				name, op = name[:idx], name[idx:]
+				if len(op) >= 2 {
+					op, arg = op[:2], op[2:]
+				}
+			}
+
+			if shellCmd && strings.HasPrefix(name, "NL") {
+				sb.WriteString(expr)
+				i = end
+				continue
+			}
+
+			if !envVarNameRegex.MatchString(name) {
+				return "", errors.Errorf("invalid env var name in %q", expr)
+			}
+
+			val, ok := e.lookupEnv(name)
+			switch op {
+			case "":
+				if !ok {
+					return "", errors.Errorf("env var %s is not set", name)
+				}
+
+			case ":-":
+				if val == "" {
+					var err error
+					val, err = e.expand(arg, shellCmd)
+					if err != nil {
+						return "", errors.Trace(err)
+					}
+				}
+
+			default:
+				return "", errors.Errorf(
+					"unsupported syntax %q; only ${VAR} and ${VAR:-default} are supported", expr,
+				)
+			}
+
+			sb.WriteString(val)
+			i = end
+
+		case s[i+1] == '(' && !shellCmd:
+			end := findClosing(s, i+1, '(', ')')
+			if end < 0 {
+				return "", errors.Errorf("unterminated %q", s[i:])
+			}
+
+			command := s[i+2 : end]
+			if !e.allowCmds {
+				return "", errors.Errorf(
+					"command substitution $(%s) is disabled; use --lstreams-config-cmds to enable it", command,
+				)
+			}
+
+			out, err := e.runCmd(command)
+			if err != nil {
+				return "", errors.Annotatef(err, "running %q", command)
+			}
+
+			sb.WriteString(out)
+			i = end
+
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// findClosing returns the index of the closing bracket matching the opening
+// one at s[start], or -1 if there's none.
+func findClosing(s string, start int, open, close byte) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// runConfigCmd runs the command from the config with the local shell, and
+// returns its stdout without the trailing newlines. The stdin is inherited,
+// so that e.g. a password manager can ask for the passphrase.
+func runConfigCmd(command string) (string, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", errors.Annotatef(err, "%s", msg)
+		}
+
+		return "", errors.Trace(err)
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
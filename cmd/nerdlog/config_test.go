@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLogstreamsConfigIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		return path
+	}
+
+	mainPath := writeFile("main.yaml", `
+include:
+  - teams/*.yaml
+  - shared.yaml
+log_streams:
+  main-01:
+    hostname: main.example.com
+`)
+	writeFile("teams/a.yaml", `
+include:
+  - ../shared.yaml
+log_streams:
+  a-01:
+    hostname: a.example.com
+`)
+	writeFile("teams/b.yaml", `
+log_streams:
+  b-01:
+    log_files:
+      - /var/log/b.log
+`)
+	writeFile("teams/ignored.txt", `not yaml`)
+	writeFile("shared.yaml", `
+log_streams:
+  shared-01:
+    port: 2222
+`)
+
+	// shared.yaml is included twice, but it's not a cycle, so it's fine.
+	cfg, err := LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a-01", "b-01", "main-01", "shared-01"}, cfg.LogStreams.Keys())
+		assert.Equal(t, "a.example.com", cfg.LogStreams["a-01"].Hostname)
+		assert.Equal(t, []string{"/var/log/b.log"}, cfg.LogStreams["b-01"].LogFiles)
+		assert.Equal(t, "2222", cfg.LogStreams["shared-01"].Port)
+	}
+
+	// Loading a directory.
+	cfg, err = LoadLogstreamsConfigFromFile(filepath.Join(dir, "teams"), LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a-01", "b-01", "shared-01"}, cfg.LogStreams.Keys())
+	}
+
+	// Duplicate logstream.
+	writeFile("teams/c.yaml", `
+log_streams:
+  b-01:
+    hostname: c.example.com
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `logstream "b-01" is defined in both`)
+		assert.Contains(t, err.Error(), filepath.Join("teams", "b.yaml"))
+		assert.Contains(t, err.Error(), filepath.Join("teams", "c.yaml"))
+	}
+	assert.NoError(t, os.Remove(filepath.Join(dir, "teams", "c.yaml")))
+
+	// Include cycle.
+	writeFile("shared.yaml", `
+include:
+  - teams/a.yaml
+log_streams:
+  shared-01:
+    port: 2222
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "include cycle: ")
+		assert.True(t, strings.HasSuffix(err.Error(), filepath.Join(dir, "teams", "a.yaml")), err.Error())
+	}
+
+	// Missing specific file.
+	writeFile("shared.yaml", `
+include:
+  - nonexistent.yaml
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "nonexistent.yaml doesn't exist")
+	}
+
+	// Missing top-level file is still recognizable.
+	_, err = LoadLogstreamsConfigFromFile(filepath.Join(dir, "nonexistent.yaml"), LoadLogstreamsConfigParams{})
+	assert.True(t, os.IsNotExist(errors.Cause(err)))
+}
+
+func TestLoadLogstreamsConfigInterpolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("NERDLOG_TEST_USER", "alice")
+	os.Setenv("NERDLOG_TEST_PORT", "2222")
+	os.Setenv("NERDLOG_TEST_EMPTY", "")
+	os.Unsetenv("NERDLOG_TEST_UNSET")
+	defer func() {
+		os.Unsetenv("NERDLOG_TEST_USER")
+		os.Unsetenv("NERDLOG_TEST_PORT")
+		os.Unsetenv("NERDLOG_TEST_EMPTY")
+	}()
+
+	path := filepath.Join(dir, "logstreams.yaml")
+	load := func(data string, params LoadLogstreamsConfigParams) (*ConfigLogStreams, error) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		return LoadLogstreamsConfigFromFile(path, params)
+	}
+
+	cfg, err := load(`
+log_streams:
+  myhost:
+    hostname: ${NERDLOG_TEST_UNSET:-${NERDLOG_TEST_USER}.example.com}
+    port: ${NERDLOG_TEST_PORT}
+    user: ${NERDLOG_TEST_EMPTY:-bob}
+    jump: $NERDLOG_TEST_USER@bastion
+    log_files:
+      - /var/log/${NERDLOG_TEST_USER}.log
+      - /var/log/$${literal}
+    log_sources:
+      - tag: foo
+        log_files:
+          - /var/log/${NERDLOG_TEST_USER:-x}/foo.log
+    options:
+      transport: custom:ssh ${NLPORT:+-p ${NLPORT}} -l ${NERDLOG_TEST_USER} ${NLHOST} $(echo sh)
+      shell_init:
+        - export FOO=${HOME}
+  bundle:
+    log_archive:
+      path: /backups/${NERDLOG_TEST_USER}.tar.gz
+`, LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		cls := cfg.LogStreams["myhost"]
+		assert.Equal(t, "alice.example.com", cls.Hostname)
+		assert.Equal(t, "2222", cls.Port)
+		assert.Equal(t, "bob", cls.User)
+		assert.Equal(t, "$NERDLOG_TEST_USER@bastion", cls.Jump)
+		assert.Equal(t, []string{"/var/log/alice.log", "/var/log/${literal}"}, cls.LogFiles)
+		assert.Equal(t, []string{"/var/log/alice/foo.log"}, cls.LogSources[0].LogFiles)
+		assert.Equal(t, "custom:ssh ${NLPORT:+-p ${NLPORT}} -l alice ${NLHOST} $(echo sh)", cls.Options.Transport)
+		assert.Equal(t, []string{"export FOO=${HOME}"}, cls.Options.ShellInit)
+
+		assert.Equal(t, "/backups/alice.tar.gz", cfg.LogStreams["bundle"].LogArchive.Path)
+	}
+
+	_, err = load(`
+log_streams:
+  myhost:
+    user: ${NERDLOG_TEST_UNSET}
+`, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "myhost: user: env var NERDLOG_TEST_UNSET is not set")
+	}
+
+	_, err = load(`
+log_streams:
+  myhost:
+    log_files:
+      - /var/log/${NERDLOG_TEST_UNSET:?required}
+`, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "log_files[0]: unsupported syntax")
+	}
+
+	_, err = load(`
+log_streams:
+  myhost:
+    hostname: ${NERDLOG_TEST_USER
+`, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "hostname: unterminated")
+	}
+
+	// Command substitution is only allowed when enabled explicitly.
+	data := `
+log_streams:
+  myhost:
+    user: $(printf '%s\n' "secret-$NERDLOG_TEST_USER")
+`
+	_, err = load(data, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is disabled; use --lstreams-config-cmds")
+	}
+
+	cfg, err = load(data, LoadLogstreamsConfigParams{AllowCmds: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "secret-alice", cfg.LogStreams["myhost"].User)
+	}
+
+	_, err = load(`
+log_streams:
+  myhost:
+    user: $(echo oops >&2; exit 1)
+`, LoadLogstreamsConfigParams{AllowCmds: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "oops")
+	}
+}
+
+func TestLoadLogstreamsConfigTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logstreams.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+log_streams:
+  web-[01-02]:
+    hostname: '{name}.example.com'
+  db-{a,b}:
+    options:
+      sudo_mode: foo
+`), 0644))
+
+	// Every expanded logstream is validated.
+	_, err = LoadLogstreamsConfigFromFile(path, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `db-a: invalid sudo_mode "foo"`)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+log_streams:
+  web-[01-02]:
+    hostname: '{name}.example.com'
+  db-{a,b}:
+    user: postgres
+`), 0644))
+
+	cfg, err := LoadLogstreamsConfigFromFile(path, LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"db-a", "db-b", "web-01", "web-02"}, cfg.LogStreams.Keys())
+		assert.Equal(t, "web-02.example.com", cfg.LogStreams["web-02"].Hostname)
+		assert.Equal(t, "postgres", cfg.LogStreams["db-b"].User)
+	}
+}
+
+func TestLoadLogstreamsConfigDefaultTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		return path
+	}
+
+	mainPath := writeFile("main.yaml", `
+default_transport: 'custom:tsh ssh ${NLHOST} /bin/sh'
+include:
+  - shared.yaml
+log_streams:
+  web-[01-02]:
+    hostname: '{name}.example.com'
+  db-01:
+    options:
+      transport: ssh-bin
+`)
+	writeFile("shared.yaml", `
+log_streams:
+  shared-01:
+    port: 2222
+`)
+
+	cfg, err := LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "custom:tsh ssh ${NLHOST} /bin/sh", cfg.DefaultTransport)
+
+		// The logstreams without the transport inherit the default, including
+		// the templated ones and the ones from the included files; the
+		// explicit transport wins.
+		for _, k := range []string{"web-01", "web-02", "shared-01"} {
+			assert.Equal(t, "custom:tsh ssh ${NLHOST} /bin/sh", cfg.LogStreams[k].Options.Transport, k)
+		}
+		assert.Equal(t, "ssh-bin", cfg.LogStreams["db-01"].Options.Transport)
+	}
+
+	// The included file can set the same default, but not a different one.
+	writeFile("shared.yaml", `
+default_transport: 'custom:tsh ssh ${NLHOST} /bin/sh'
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	assert.NoError(t, err)
+
+	writeFile("shared.yaml", `
+default_transport: ssh-lib
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "default_transport is set to different values in")
+	}
+
+	// The default is validated even if no logstream uses it.
+	invalidPath := writeFile("invalid.yaml", `
+default_transport: ssh-foo
+log_streams:
+  db-01:
+    options:
+      transport: ssh-bin
+`)
+	_, err = LoadLogstreamsConfigFromFile(invalidPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `default_transport: invalid transport mode "ssh-foo"`)
+	}
+}
+
+func TestLoadLogstreamsConfigColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		return path
+	}
+
+	mainPath := writeFile("main.yaml", `
+columns:
+  - field: lstream
+    title: host
+    width: 12
+  - field: time
+  - field: msg
+    truncate: 80
+include:
+  - shared.yaml
+log_streams:
+  web-01:
+    hostname: web-01.example.com
+`)
+	writeFile("shared.yaml", `
+log_streams:
+  shared-01:
+    port: 2222
+`)
+
+	cfg, err := LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, core.Columns{
+			{Field: "lstream", Title: "host", Width: 12},
+			{Field: "time"},
+			{Field: "msg", Truncate: 80},
+		}, cfg.Columns)
+	}
+
+	// The included file can set the same columns, but not different ones.
+	writeFile("shared.yaml", `
+columns:
+  - field: lstream
+    title: host
+    width: 12
+  - field: time
+  - field: msg
+    truncate: 80
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	assert.NoError(t, err)
+
+	writeFile("shared.yaml", `
+columns:
+  - field: time
+`)
+	_, err = LoadLogstreamsConfigFromFile(mainPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "columns are set to different values in")
+	}
+
+	// The columns are validated.
+	invalidPath := writeFile("invalid.yaml", `
+columns:
+  - field: msg
+    truncate: -1
+`)
+	_, err = LoadLogstreamsConfigFromFile(invalidPath, LoadLogstreamsConfigParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "columns: column msg: width and truncate can't be negative")
+	}
+}
+
+func TestLoadLogstreamsConfigHostsCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake cloud CLI, executed in the dir of the config file.
+	assert.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, "hosts.txt"), []byte("# instances\nweb-1.internal\n\nweb-2.internal\n"), 0644,
+	))
+
+	path := filepath.Join(dir, "logstreams.yaml")
+	load := func(data string) (*ConfigLogStreams, error) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		return LoadLogstreamsConfigFromFile(path, LoadLogstreamsConfigParams{})
+	}
+
+	cfg, err := load(`
+log_streams:
+  static-01:
+    hostname: static.example.com
+hosts_commands:
+  - command: cat hosts.txt
+    template:
+      user: ec2-user
+      log_files:
+        - /var/log/app.log
+  - command: echo '["db-1", "db-2"]'
+    name: 'aws-{host}'
+    template:
+      hostname: '{host}.example.com'
+`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"aws-db-1", "aws-db-2", "static-01", "web-1.internal", "web-2.internal",
+		}, cfg.LogStreams.Keys())
+
+		assert.Equal(t, core.ConfigLogStream{
+			Hostname: "web-2.internal",
+			User:     "ec2-user",
+			LogFiles: []string{"/var/log/app.log"},
+		}, cfg.LogStreams["web-2.internal"])
+		assert.Equal(t, "db-1.example.com", cfg.LogStreams["aws-db-1"].Hostname)
+	}
+
+	// Failures are reported with the command's stderr.
+	_, err = load(`
+hosts_commands:
+  - command: echo 'credentials expired' >&2; exit 3
+`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "hosts_commands[0]")
+		assert.Contains(t, err.Error(), "credentials expired")
+	}
+
+	_, err = load(`
+hosts_commands:
+  - command: sleep 5
+    timeout: 100ms
+`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 100ms")
+	}
+
+	_, err = load(`
+hosts_commands:
+  - command: echo '["db-1", 2]'
+`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "expected a JSON array of strings")
+	}
+
+	// Generated logstreams can't override the static ones.
+	_, err = load(`
+log_streams:
+  web-1.internal:
+    user: root
+hosts_commands:
+  - command: cat hosts.txt
+`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `logstream "web-1.internal" is defined in both`)
+	}
+}
+
+func TestLoadLogstreamsConfigFromReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lstreams_config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Without the config file, the includes and the hosts commands are
+	// relative to the current directory.
+	wd, err := os.Getwd()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	assert.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, "hosts.txt"), []byte("web-1.internal\nweb-2.internal\n"), 0644,
+	))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "shared.yaml"), []byte(`
+log_streams:
+  shared-01:
+    port: 2222
+`), 0644))
+
+	stdinData := []byte(`
+include:
+  - shared.yaml
+log_streams:
+  web-[01-02]:
+    hostname: '{name}.example.com'
+hosts_commands:
+  - command: cat hosts.txt
+`)
+
+	cfg, err := LoadLogstreamsConfigFromReader(bytes.NewReader(stdinData), LoadLogstreamsConfigParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"shared-01", "web-01", "web-02", "web-1.internal", "web-2.internal",
+		}, cfg.LogStreams.Keys())
+		assert.Equal(t, "web-02.example.com", cfg.LogStreams["web-02"].Hostname)
+		assert.Equal(t, "2222", cfg.LogStreams["shared-01"].Port)
+	}
+
+	// The same via loadLogstreamsConfig, which is what main does with the data
+	// read from stdin.
+	loaded, err := loadLogstreamsConfig(StdinConfigPath, stdinData, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, cfg.LogStreams, loaded.LogStreams)
+	}
+
+	// Errors refer to stdin.
+	_, err = loadLogstreamsConfig(StdinConfigPath, []byte(`
+log_streams:
+  shared-01:
+    hostname: foo
+include:
+  - shared.yaml
+`), false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "from stdin")
+		assert.Contains(t, err.Error(), `logstream "shared-01" is defined in both <stdin> and `)
+	}
+
+	// Reading the actual stdin, which is a pipe.
+	r, w, err := os.Pipe()
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		w.Write(stdinData)
+		w.Close()
+	}()
+
+	data, err := readLogstreamsConfigStdin(r)
+	r.Close()
+	if assert.NoError(t, err) {
+		assert.Equal(t, stdinData, data)
+	}
+
+	// It refuses to read from a terminal (or any other character device, like
+	// /dev/null here), instead of hanging.
+	devNull, err := os.Open(os.DevNull)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer devNull.Close()
+
+	_, err = readLogstreamsConfigStdin(devNull)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "stdin is a terminal")
+	}
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// Exit codes of the headless mode.
+const (
+	// headlessExitOK means that all logstreams were queried successfully.
+	headlessExitOK = 0
+	// headlessExitFailure means that we weren't able to get any logs at all.
+	headlessExitFailure = 1
+	// headlessExitPartial means that some of the logstreams have failed, but
+	// the logs from the rest of them were printed.
+	headlessExitPartial = 2
+	// headlessExitInterrupted means that we were interrupted, e.g. with
+	// Ctrl-C; same as the shells report for SIGINT.
+	headlessExitInterrupted = 130
+)
+
+// headlessShutdownTimeout is how long we wait for the LStreamsManager to
+// shut down before exiting regardless.
+const headlessShutdownTimeout = 2 * core.DefaultShutdownGracePeriod
+
+// headlessLStreamsManager is the subset of the *core.LStreamsManager
+// functionality used by the headless mode. It's an interface only to make it
+// possible to use fakes in tests.
+type headlessLStreamsManager interface {
+	SetLStreams(logStreamsSpec string) error
+	QueryLogs(params core.QueryLogsParams)
+	FleetStatus() core.FleetSummary
+	VerifyLStreams(ctx context.Context) map[string]core.LStreamVerifyResult
+	Shutdown(ctx context.Context) error
+}
+
+var _ headlessLStreamsManager = &core.LStreamsManager{}
+
+type headlessParams struct {
+	// timeRange is the time range in the same format as accepted by the UI,
+	// e.g. "-1h" or "Mar27 12:00 to 13:00".
+	timeRange string
+	query     string
+	queryLang core.QueryLang
+
+	// filterIgnoreCase and filterWholeWord, see the corresponding fields in
+	// core.QueryLogsParams.
+	filterIgnoreCase bool
+	filterWholeWord  bool
+
+	// selectSpec is the projection, see core.QueryLogsParams.Select.
+	selectSpec string
+
+	maxNumLines int
+
+	// connectTimeout is how long we wait for all logstreams to connect. Once
+	// it's expired, the query is performed on whatever logstreams are
+	// connected, and the rest are reported as failed.
+	connectTimeout time.Duration
+
+	format core.ExportFormat
+
+	// columns, if not empty, define the CSV columns; see core.Columns.
+	columns core.Columns
+
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// headlessRunner drives the LStreamsManager without the TUI: connects, runs a
+// single query, prints results to stdout and errors to stderr.
+type headlessRunner struct {
+	params headlessParams
+
+	// ctx is done once we're interrupted.
+	ctx context.Context
+
+	lsman     headlessLStreamsManager
+	updatesCh <-chan core.LStreamsManagerUpdate
+
+	lastState *core.LStreamsManagerState
+
+	// bootstrapErrs contains bootstrap errors by logstream name.
+	bootstrapErrs map[string]string
+}
+
+// runHeadless connects to the logstreams, runs a single query, prints the
+// results to params.stdout, and returns the exit code for the process. The
+// updatesCh must be the same channel that was given to the LStreamsManager as
+// the UpdatesCh. Once the ctx is done (e.g. on Ctrl-C), whatever is in
+// progress is abandoned, and headlessExitInterrupted is returned. Before
+// returning, the LStreamsManager is shut down.
+func runHeadless(
+	ctx context.Context,
+	params headlessParams,
+	lsman headlessLStreamsManager,
+	updatesCh <-chan core.LStreamsManagerUpdate,
+) int {
+	hr := &headlessRunner{
+		params:        params,
+		ctx:           ctx,
+		lsman:         lsman,
+		updatesCh:     updatesCh,
+		bootstrapErrs: map[string]string{},
+	}
+
+	defer hr.shutdown()
+
+	return hr.run()
+}
+
+func (hr *headlessRunner) run() int {
+	ftr, err := ParseFromToRange(time.Local, hr.params.timeRange)
+	if err != nil {
+		hr.printErr(errors.Annotatef(err, "parsing time range"))
+		return headlessExitFailure
+	}
+
+	from, to := headlessTimeRange(ftr, time.Now())
+
+	failedLStreams, err := hr.waitConnected()
+	if hr.ctx.Err() != nil {
+		return hr.interrupted()
+	}
+	if err != nil {
+		hr.printErr(err)
+		return headlessExitFailure
+	}
+
+	for _, name := range failedLStreams {
+		hr.printErr(errors.Errorf("%s: %s", name, hr.lstreamFailureReason(name)))
+	}
+
+	// Being connected doesn't mean that the logs are readable, so check it
+	// explicitly, and treat the unreadable logstreams as failed too.
+	readyLStreams, unreadableLStreams := hr.verifyLStreams()
+	if hr.ctx.Err() != nil {
+		return hr.interrupted()
+	}
+	if len(readyLStreams) == 0 {
+		hr.printErr(errors.Errorf("no logstreams with readable logs"))
+		return headlessExitFailure
+	}
+
+	failedLStreams = append(failedLStreams, unreadableLStreams...)
+
+	if len(failedLStreams) > 0 {
+		// Only keep the ready logstreams, so that the LStreamsManager lets us
+		// query them.
+		err := hr.setLStreams(strings.Join(readyLStreams, ","))
+		if hr.ctx.Err() != nil {
+			return hr.interrupted()
+		}
+		if err != nil {
+			hr.printErr(errors.Annotatef(err, "excluding failed logstreams"))
+			return headlessExitFailure
+		}
+	}
+
+	queryParams := core.QueryLogsParams{
+		MaxNumLines: hr.params.maxNumLines,
+		From:        from,
+		To:          to,
+		Query:       hr.params.query,
+		QueryLang:   hr.params.queryLang,
+		Select:      hr.params.selectSpec,
+
+		FilterIgnoreCase: hr.params.filterIgnoreCase,
+		FilterWholeWord:  hr.params.filterWholeWord,
+	}
+
+	logResp := hr.queryLogs(queryParams)
+	if logResp == nil {
+		return hr.interrupted()
+	}
+
+	if len(logResp.Errs) > 0 {
+		for _, err := range logResp.Errs {
+			hr.printErr(err)
+		}
+
+		// If any of the logstreams fails, the LStreamsManager doesn't return the
+		// logs from the rest of them; but if there are some which did deliver
+		// their logs (then there is the resume token), we can still get them by
+		// excluding the failed ones and querying again.
+		token := logResp.ResumeToken
+		if token == nil {
+			return headlessExitFailure
+		}
+
+		deliveredLStreams := make([]string, 0, len(token.Delivered))
+		for name := range token.Delivered {
+			deliveredLStreams = append(deliveredLStreams, name)
+		}
+		sort.Strings(deliveredLStreams)
+
+		failedLStreams = append(failedLStreams, token.Pending...)
+
+		err := hr.setLStreams(strings.Join(deliveredLStreams, ","))
+		if hr.ctx.Err() != nil {
+			return hr.interrupted()
+		}
+		if err != nil {
+			hr.printErr(errors.Annotatef(err, "excluding failed logstreams"))
+			return headlessExitFailure
+		}
+
+		logResp = hr.queryLogs(queryParams)
+		if logResp == nil {
+			return hr.interrupted()
+		}
+
+		if len(logResp.Errs) > 0 {
+			for _, err := range logResp.Errs {
+				hr.printErr(err)
+			}
+
+			return headlessExitFailure
+		}
+	}
+
+	// Warnings don't fail the query, but the results might be incomplete, so
+	// let the user know.
+	for _, w := range logResp.Warnings {
+		fmt.Fprintf(hr.params.stderr, "Warning: %s\n", w)
+	}
+
+	if err := hr.writeLogs(logResp.Logs); err != nil {
+		hr.printErr(errors.Annotatef(err, "writing logs"))
+		return headlessExitFailure
+	}
+
+	if len(failedLStreams) > 0 {
+		return headlessExitPartial
+	}
+
+	return headlessExitOK
+}
+
+// queryLogs runs the query and waits for the response, while applying the
+// other updates. If interrupted, it returns nil.
+func (hr *headlessRunner) queryLogs(params core.QueryLogsParams) *core.LogRespTotal {
+	hr.lsman.QueryLogs(params)
+
+	for {
+		select {
+		case upd := <-hr.updatesCh:
+			hr.applyUpdate(upd)
+
+			if upd.LogResp != nil {
+				return upd.LogResp
+			}
+
+		case <-hr.ctx.Done():
+			// The query is stopped on the hosts by the shutdown.
+			return nil
+		}
+	}
+}
+
+// writeLogs streams the logs to stdout in the configured format. If the
+// downstream is gone (e.g. nerdlog is piped to "head", which has exited
+// already), it stops writing and returns nil: that's not an error, the
+// downstream just doesn't need any more logs.
+func (hr *headlessRunner) writeLogs(logs []core.LogMsg) error {
+	r := core.NewLogsReaderColumns(
+		context.Background(), hr.params.format, hr.params.columns,
+		func(ctx context.Context, emit func(logs []core.LogMsg) error) error {
+			return emit(logs)
+		},
+	)
+	defer r.Close()
+
+	if _, err := io.Copy(hr.params.stdout, r); err != nil {
+		if errors.Is(err, syscall.EPIPE) {
+			return nil
+		}
+
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// waitConnected waits until either all logstreams are connected, or the
+// connect timeout expires. In the latter case, it returns the names of the
+// logstreams which failed to connect. If none of the logstreams are connected,
+// an error is returned.
+func (hr *headlessRunner) waitConnected() ([]string, error) {
+	timeout := time.After(hr.params.connectTimeout)
+
+	for {
+		if st := hr.lastState; st != nil {
+			if st.NoMatchingLStreams {
+				return nil, errors.Errorf("no matching lstreams")
+			}
+
+			// NOTE: Connected also becomes true when the logstreams are busy
+			// bootstrapping, and queries are queued until bootstrap is done, so we
+			// don't need to wait for Busy to become false.
+			if st.Connected {
+				return nil, nil
+			}
+		}
+
+		select {
+		case upd := <-hr.updatesCh:
+			hr.applyUpdate(upd)
+
+		case <-timeout:
+			connected := hr.connectedLStreams()
+			failed := hr.notConnectedLStreams()
+
+			fmt.Fprintf(hr.params.stderr, "Logstreams: %s\n", hr.lsman.FleetStatus())
+
+			if len(connected) == 0 {
+				var sb strings.Builder
+				sb.WriteString(fmt.Sprintf("failed to connect within %s", hr.params.connectTimeout))
+				for _, name := range failed {
+					sb.WriteString(fmt.Sprintf("\n%s: %s", name, hr.lstreamFailureReason(name)))
+				}
+
+				return nil, errors.New(sb.String())
+			}
+
+			return failed, nil
+
+		case <-hr.ctx.Done():
+			return nil, errors.Trace(hr.ctx.Err())
+		}
+	}
+}
+
+// setLStreams calls SetLStreams on the LStreamsManager, while keeping
+// consuming the updates, so that the LStreamsManager doesn't get stuck.
+func (hr *headlessRunner) setLStreams(spec string) error {
+	resCh := make(chan error, 1)
+	go func() {
+		resCh <- hr.lsman.SetLStreams(spec)
+	}()
+
+	for {
+		select {
+		case upd := <-hr.updatesCh:
+			hr.applyUpdate(upd)
+		case err := <-resCh:
+			return errors.Trace(err)
+		case <-hr.ctx.Done():
+			return errors.Trace(hr.ctx.Err())
+		}
+	}
+}
+
+// verifyLStreams checks that the logs of the connected logstreams are
+// readable, prints errors for those which aren't, and returns the names of
+// the ready and unreadable logstreams. If interrupted, it returns nothing.
+func (hr *headlessRunner) verifyLStreams() (ready, unreadable []string) {
+	ctx, cancel := context.WithTimeout(hr.ctx, hr.params.connectTimeout)
+	defer cancel()
+
+	resCh := make(chan map[string]core.LStreamVerifyResult, 1)
+	go func() {
+		resCh <- hr.lsman.VerifyLStreams(ctx)
+	}()
+
+	var results map[string]core.LStreamVerifyResult
+	for results == nil {
+		select {
+		case upd := <-hr.updatesCh:
+			hr.applyUpdate(upd)
+		case results = <-resCh:
+		case <-hr.ctx.Done():
+			return nil, nil
+		}
+	}
+
+	for _, name := range hr.connectedLStreams() {
+		res, ok := results[name]
+		if ok && !res.Ready() {
+			hr.printErr(errors.Errorf("%s: connected, but can't read logs: %s", name, res))
+			unreadable = append(unreadable, name)
+			continue
+		}
+
+		ready = append(ready, name)
+	}
+
+	return ready, unreadable
+}
+
+func (hr *headlessRunner) applyUpdate(upd core.LStreamsManagerUpdate) {
+	switch {
+	case upd.State != nil:
+		hr.lastState = upd.State
+
+	case upd.BootstrapIssue != nil:
+		if upd.BootstrapIssue.Err != "" {
+			hr.bootstrapErrs[upd.BootstrapIssue.LStreamName] = upd.BootstrapIssue.Err
+		}
+
+	case upd.DataRequest != nil:
+		// We can't ask the user for anything in headless mode, so the connection
+		// will eventually time out; but let the user know why.
+		hr.printErr(errors.Errorf(
+			"%s: %s (can't ask for data in headless mode; use ssh-agent instead)",
+			upd.DataRequest.Title, upd.DataRequest.Message,
+		))
+	}
+}
+
+func (hr *headlessRunner) connectedLStreams() []string {
+	return hr.lstreamsWhere(func(state core.LStreamClientState) bool {
+		return state == core.LStreamClientStateConnectedIdle ||
+			state == core.LStreamClientStateConnectedBusy
+	})
+}
+
+func (hr *headlessRunner) notConnectedLStreams() []string {
+	return hr.lstreamsWhere(func(state core.LStreamClientState) bool {
+		return state != core.LStreamClientStateConnectedIdle &&
+			state != core.LStreamClientStateConnectedBusy
+	})
+}
+
+func (hr *headlessRunner) lstreamsWhere(pred func(state core.LStreamClientState) bool) []string {
+	if hr.lastState == nil {
+		return nil
+	}
+
+	var ret []string
+	for state, names := range hr.lastState.LStreamsByState {
+		if !pred(state) {
+			continue
+		}
+
+		for name := range names {
+			ret = append(ret, name)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// lstreamFailureReason returns a human-readable reason why the logstream
+// failed to connect.
+func (hr *headlessRunner) lstreamFailureReason(name string) string {
+	if errMsg, ok := hr.bootstrapErrs[name]; ok {
+		return fmt.Sprintf("bootstrap failed: %s", errMsg)
+	}
+
+	if hr.lastState != nil {
+		if cd, ok := hr.lastState.ConnDetailsByLStream[name]; ok && cd.Err != "" {
+			return cd.Err
+		}
+	}
+
+	return "failed to connect in time"
+}
+
+func (hr *headlessRunner) printErr(err error) {
+	fmt.Fprintf(hr.params.stderr, "Error: %s\n", err.Error())
+}
+
+// interrupted prints the error and returns the exit code for when the ctx is
+// done.
+func (hr *headlessRunner) interrupted() int {
+	hr.printErr(errors.Errorf("interrupted"))
+	return headlessExitInterrupted
+}
+
+// shutdown shuts the LStreamsManager down (stopping the query in progress,
+// if any) and waits for it, up to the headlessShutdownTimeout, while
+// consuming all the updates it sends meanwhile.
+func (hr *headlessRunner) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), headlessShutdownTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- hr.lsman.Shutdown(ctx)
+	}()
+
+	for {
+		select {
+		case <-hr.updatesCh:
+		case err := <-errCh:
+			if err != nil {
+				hr.printErr(err)
+			}
+			return
+		}
+	}
+}
+
+// headlessTimeRange converts the FromToRange to the actual from and to times
+// for the query, in the same way the UI does it. The resulting to might be
+// zero, meaning "until now".
+func headlessTimeRange(ftr FromToRange, now time.Time) (from, to time.Time) {
+	fromTD, toTD := ftr.From, ftr.To
+
+	if !fromTD.IsAbsolute() && fromTD.Dur > 0 {
+		fromTD.Dur = -fromTD.Dur
+	}
+
+	if !toTD.IsAbsolute() && toTD.Dur > 0 {
+		toTD.Dur = -toTD.Dur
+	}
+
+	from = truncateCeil(fromTD.AbsoluteTime(now), 1*time.Minute)
+
+	if !toTD.IsZero() {
+		to = truncateCeil(toTD.AbsoluteTime(now), 1*time.Minute)
+
+		if from.After(to) {
+			from, to = to, from
+		}
+	}
+
+	return from, to
+}
+
+type mainHeadlessParams struct {
+	// optionSets contains strings like "option=value", same as for the
+	// nerdlogAppParams.initialOptionSets.
+	optionSets []string
+	queryData  QueryFull
+
+	outputFormat   string
+	connectTimeout time.Duration
+	selectSpec     string
+
+	logger                *log.Logger
+	sshConfigPath         string
+	logstreamsConfigPath  string
+	logstreamsConfigStdin []byte
+	logstreamsConfigCmds  bool
+	sshKeys               []string
+	sshCert               string
+	sshPKCS11             *core.SSHPKCS11
+	hostKeys              *core.HostKeys
+	capabilitiesCache     *core.CapabilitiesCache
+	queryCache            *core.QueryCache
+	coalesceConnections   bool
+	maxQueriesInFlight    int
+	maxOpenStreams        int
+	maxConcurrentConnects int
+	selector              core.LStreamSelector
+}
+
+// mainHeadless is called from main when --headless is given; it sets up the
+// LStreamsManager and runs the headless query. Returns the process exit code.
+func mainHeadless(params mainHeadlessParams) int {
+	printErr := func(err error) int {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return headlessExitFailure
+	}
+
+	format, err := core.ParseExportFormat(params.outputFormat)
+	if err != nil {
+		return printErr(errors.Annotatef(err, "parsing --output-format"))
+	}
+
+	// By default, writing to a closed stdout pipe kills the process with
+	// SIGPIPE; having the signal delivered to a channel instead makes the write
+	// just fail with EPIPE, so we can stop the query and exit cleanly.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+
+	// On Ctrl-C, stop whatever is in progress and shut down cleanly; if it
+	// takes too long for the user's taste, the second Ctrl-C kills the
+	// process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	options := Options{
+		Timezone:             time.Local,
+		MaxNumLines:          core.MaxNumLinesDefault,
+		DefaultTransportMode: core.NewTransportModeSSHLib(),
+		QueryLang:            core.QueryLangAWK,
+	}
+
+	for _, expr := range params.optionSets {
+		setParts := strings.SplitN(expr, "=", 2)
+		if len(setParts) != 2 {
+			return printErr(errors.Errorf("invalid --set value %q, expected option=value", expr))
+		}
+
+		opt := OptionMetaByName(setParts[0])
+		if opt == nil {
+			return printErr(errors.Errorf("unknown option: %s", setParts[0]))
+		}
+
+		if err := opt.Set(&options, setParts[1]); err != nil {
+			return printErr(errors.Annotatef(err, "setting '%s' to '%s'", setParts[0], setParts[1]))
+		}
+	}
+
+	logstreamsCfg, err := loadLogstreamsConfig(
+		params.logstreamsConfigPath, params.logstreamsConfigStdin, params.logstreamsConfigCmds,
+	)
+	if err != nil {
+		return printErr(err)
+	}
+
+	sshConfig, err := loadSSHConfig(params.sshConfigPath)
+	if err != nil {
+		return printErr(err)
+	}
+
+	updatesCh := make(chan core.LStreamsManagerUpdate, 128)
+
+	lsmanParams := core.LStreamsManagerParams{
+		Logger: params.logger,
+
+		ConfigLogStreams: logstreamsCfg.LogStreams,
+		SSHConfig:        sshConfig,
+		SSHKeys:          params.sshKeys,
+		SSHCert:          params.sshCert,
+		SSHPKCS11:        params.sshPKCS11,
+		HostKeys:         params.hostKeys,
+
+		CapabilitiesCache:   params.capabilitiesCache,
+		QueryCache:          params.queryCache,
+		CoalesceConnections: params.coalesceConnections,
+		MaxQueriesInFlight:  params.maxQueriesInFlight,
+		MaxOpenStreams:      params.maxOpenStreams,
+		Selector:            params.selector,
+
+		MaxConcurrentConnects: params.maxConcurrentConnects,
+
+		InitialLStreams:             params.queryData.LStreams,
+		InitialDefaultTransportMode: options.DefaultTransportMode,
+
+		ClientID: os.Getenv("USER"),
+
+		UpdatesCh: updatesCh,
+
+		Clock: clock.New(),
+	}
+
+	// NewLStreamsManager panics on an invalid initial spec, so check it first.
+	if err := core.ValidateLStreams(lsmanParams); err != nil {
+		return printErr(err)
+	}
+
+	lsman := core.NewLStreamsManager(lsmanParams)
+
+	return runHeadless(ctx, headlessParams{
+		timeRange:      params.queryData.Time,
+		query:          params.queryData.Query,
+		queryLang:      options.QueryLang,
+		selectSpec:     params.selectSpec,
+		maxNumLines:    options.MaxNumLines,
+		connectTimeout: params.connectTimeout,
+		format:         format,
+		columns:        logstreamsCfg.Columns,
+		stdout:         os.Stdout,
+		stderr:         os.Stderr,
+
+		filterIgnoreCase: options.IgnoreCase,
+		filterWholeWord:  options.WholeWord,
+	}, lsman, updatesCh)
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHeadlessLStreamsManager implements headlessLStreamsManager; it sends
+// the preconfigured updates to the updates channel.
+type fakeHeadlessLStreamsManager struct {
+	updatesCh chan core.LStreamsManagerUpdate
+
+	// queryResps are sent as LogResp updates in response to QueryLogs, one
+	// per query; once they're exhausted, nothing is sent, like if the query
+	// takes forever.
+	queryResps []*core.LogRespTotal
+
+	fleet core.FleetSummary
+
+	// verifyResults is returned from VerifyLStreams; the logstreams which are
+	// not there are considered readable.
+	verifyResults map[string]core.LStreamVerifyResult
+
+	setLStreamsSpecs []string
+	queries          []core.QueryLogsParams
+	closed           bool
+}
+
+func (m *fakeHeadlessLStreamsManager) SetLStreams(logStreamsSpec string) error {
+	m.setLStreamsSpecs = append(m.setLStreamsSpecs, logStreamsSpec)
+	return nil
+}
+
+func (m *fakeHeadlessLStreamsManager) QueryLogs(params core.QueryLogsParams) {
+	m.queries = append(m.queries, params)
+	if len(m.queries) <= len(m.queryResps) {
+		m.updatesCh <- core.LStreamsManagerUpdate{LogResp: m.queryResps[len(m.queries)-1]}
+	}
+}
+
+func (m *fakeHeadlessLStreamsManager) FleetStatus() core.FleetSummary {
+	return m.fleet
+}
+
+func (m *fakeHeadlessLStreamsManager) VerifyLStreams(ctx context.Context) map[string]core.LStreamVerifyResult {
+	ret := map[string]core.LStreamVerifyResult{}
+	for name, res := range m.verifyResults {
+		ret[name] = res
+	}
+
+	return ret
+}
+
+func (m *fakeHeadlessLStreamsManager) Shutdown(ctx context.Context) error {
+	m.closed = true
+	return nil
+}
+
+func makeHeadlessState(connected, connecting []string) *core.LStreamsManagerState {
+	st := &core.LStreamsManagerState{
+		NumLStreams:     len(connected) + len(connecting),
+		NumConnected:    len(connected),
+		Connected:       len(connecting) == 0 && len(connected) > 0,
+		LStreamsByState: map[core.LStreamClientState]map[string]struct{}{},
+	}
+
+	add := func(state core.LStreamClientState, names []string) {
+		if len(names) == 0 {
+			return
+		}
+
+		st.LStreamsByState[state] = map[string]struct{}{}
+		for _, name := range names {
+			st.LStreamsByState[state][name] = struct{}{}
+		}
+	}
+
+	add(core.LStreamClientStateConnectedIdle, connected)
+	add(core.LStreamClientStateConnecting, connecting)
+
+	return st
+}
+
+func makeHeadlessLogMsg(lstream, line string) core.LogMsg {
+	return core.LogMsg{
+		Time:     time.Date(2025, 3, 27, 10, 0, 0, 0, time.UTC),
+		Msg:      line,
+		OrigLine: line,
+		Context:  map[string]string{"lstream": lstream},
+	}
+}
+
+func TestRunHeadless(t *testing.T) {
+	type testCase struct {
+		name string
+
+		updates   []core.LStreamsManagerUpdate
+		queryResp *core.LogRespTotal
+		// retryResp, if not nil, is the response to the second query.
+		retryResp *core.LogRespTotal
+		fleet     core.FleetSummary
+		format    core.ExportFormat
+
+		verifyResults map[string]core.LStreamVerifyResult
+
+		wantExitCode    int
+		wantStdout      string
+		wantStderr      []string
+		wantSetLStreams []string
+		wantNumQueries  int
+	}
+
+	testCases := []testCase{
+		{
+			name: "all connected",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState(nil, []string{"host1", "host2"})},
+				{State: makeHeadlessState([]string{"host1", "host2"}, nil)},
+			},
+			queryResp: &core.LogRespTotal{
+				Logs: []core.LogMsg{
+					makeHeadlessLogMsg("host1", "line 1"),
+					makeHeadlessLogMsg("host2", "line 2"),
+				},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode:   headlessExitOK,
+			wantStdout:     "line 1\nline 2\n",
+			wantNumQueries: 1,
+		},
+
+		{
+			name: "warnings",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1"}, nil)},
+			},
+			queryResp: &core.LogRespTotal{
+				Logs: []core.LogMsg{
+					makeHeadlessLogMsg("host1", "line 1"),
+				},
+				Warnings: []string{"host1: cat: /var/log/syslog.1: Permission denied"},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode:   headlessExitOK,
+			wantStdout:     "line 1\n",
+			wantStderr:     []string{"Warning: host1: cat: /var/log/syslog.1: Permission denied"},
+			wantNumQueries: 1,
+		},
+
+		{
+			name: "json output",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1"}, nil)},
+			},
+			queryResp: &core.LogRespTotal{
+				Logs: []core.LogMsg{
+					makeHeadlessLogMsg("host1", "line 1"),
+				},
+			},
+			format: core.ExportFormatJSON,
+
+			wantExitCode:   headlessExitOK,
+			wantStdout:     `{"time":"2025-03-27T10:00:00Z","lstream":"host1","msg":"line 1","orig_line":"line 1"}` + "\n",
+			wantNumQueries: 1,
+		},
+
+		{
+			name: "partial failure",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1"}, []string{"host2"})},
+				{BootstrapIssue: &core.BootstrapIssue{LStreamName: "host2", Err: "no gawk"}},
+			},
+			queryResp: &core.LogRespTotal{
+				Logs: []core.LogMsg{
+					makeHeadlessLogMsg("host1", "line 1"),
+				},
+			},
+			fleet: core.FleetSummary{
+				NumLStreams:  2,
+				NumConnected: 1,
+				NumFailed:    1,
+				FailedByCategory: map[core.ConnErrCategory][]string{
+					core.ConnErrCategoryBootstrap: {"host2"},
+				},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode: headlessExitPartial,
+			wantStdout:   "line 1\n",
+			wantStderr: []string{
+				"Logstreams: 1 connected, 1 failed (bootstrap: 1)",
+				"Error: host2: bootstrap failed: no gawk",
+			},
+			wantSetLStreams: []string{"host1"},
+			wantNumQueries:  1,
+		},
+
+		{
+			name: "connected but unreadable",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1", "host2"}, nil)},
+			},
+			queryResp: &core.LogRespTotal{
+				Logs: []core.LogMsg{
+					makeHeadlessLogMsg("host1", "line 1"),
+				},
+			},
+			verifyResults: map[string]core.LStreamVerifyResult{
+				"host1": {Status: core.LStreamVerifyReadable, Filename: "/var/log/syslog"},
+				"host2": {Status: core.LStreamVerifyPermissionDenied, Filename: "/var/log/syslog"},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode:    headlessExitPartial,
+			wantStdout:      "line 1\n",
+			wantStderr:      []string{"Error: host2: connected, but can't read logs: permission denied: /var/log/syslog"},
+			wantSetLStreams: []string{"host1"},
+			wantNumQueries:  1,
+		},
+
+		{
+			name: "nothing readable",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1"}, nil)},
+			},
+			verifyResults: map[string]core.LStreamVerifyResult{
+				"host1": {Status: core.LStreamVerifyNotFound, Filename: "/var/log/messages"},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode: headlessExitFailure,
+			wantStderr: []string{
+				"Error: host1: connected, but can't read logs: not found: /var/log/messages",
+				"Error: no logstreams with readable logs",
+			},
+		},
+
+		{
+			name: "nothing connected",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState(nil, []string{"host1"})},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode: headlessExitFailure,
+			wantStderr:   []string{"failed to connect within", "host1: failed to connect in time"},
+		},
+
+		{
+			name: "query error",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1"}, nil)},
+			},
+			queryResp: &core.LogRespTotal{
+				Errs: []error{errors.New("host1: query failed")},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode:   headlessExitFailure,
+			wantStderr:     []string{"Error: host1: query failed"},
+			wantNumQueries: 1,
+		},
+
+		{
+			name: "partial query error",
+			updates: []core.LStreamsManagerUpdate{
+				{State: makeHeadlessState([]string{"host1", "host2"}, nil)},
+			},
+			queryResp: &core.LogRespTotal{
+				Errs: []error{errors.New("host2: query failed")},
+				ResumeToken: &core.QueryResumeToken{
+					Delivered: map[string]core.LStreamResumePos{"host1": {}},
+					Pending:   []string{"host2"},
+				},
+			},
+			retryResp: &core.LogRespTotal{
+				Logs: []core.LogMsg{
+					makeHeadlessLogMsg("host1", "line 1"),
+				},
+			},
+			format: core.ExportFormatRaw,
+
+			wantExitCode:    headlessExitPartial,
+			wantStdout:      "line 1\n",
+			wantStderr:      []string{"Error: host2: query failed"},
+			wantSetLStreams: []string{"host1"},
+			wantNumQueries:  2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			updatesCh := make(chan core.LStreamsManagerUpdate, 32)
+			for _, upd := range tc.updates {
+				updatesCh <- upd
+			}
+
+			lsman := &fakeHeadlessLStreamsManager{
+				updatesCh: updatesCh,
+				fleet:     tc.fleet,
+
+				verifyResults: tc.verifyResults,
+			}
+
+			if tc.queryResp != nil {
+				lsman.queryResps = append(lsman.queryResps, tc.queryResp)
+			}
+			if tc.retryResp != nil {
+				lsman.queryResps = append(lsman.queryResps, tc.retryResp)
+			}
+
+			var stdout, stderr bytes.Buffer
+			exitCode := runHeadless(context.Background(), headlessParams{
+				timeRange:      "-1h",
+				maxNumLines:    100,
+				connectTimeout: 50 * time.Millisecond,
+				format:         tc.format,
+				stdout:         &stdout,
+				stderr:         &stderr,
+			}, lsman, updatesCh)
+
+			assert.Equal(t, tc.wantExitCode, exitCode)
+			assert.Equal(t, tc.wantStdout, stdout.String())
+			for _, s := range tc.wantStderr {
+				assert.Contains(t, stderr.String(), s)
+			}
+			if len(tc.wantStderr) == 0 {
+				assert.Equal(t, "", stderr.String())
+			}
+			assert.Equal(t, tc.wantSetLStreams, lsman.setLStreamsSpecs)
+			assert.Equal(t, tc.wantNumQueries, len(lsman.queries))
+			assert.True(t, lsman.closed)
+		})
+	}
+}
+
+// brokenPipeWriter fails all writes with EPIPE, like a stdout piped to
+// "head" which has exited already.
+type brokenPipeWriter struct {
+	writes int
+}
+
+func (w *brokenPipeWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, &os.PathError{Op: "write", Path: "/dev/stdout", Err: syscall.EPIPE}
+}
+
+func TestRunHeadlessBrokenPipe(t *testing.T) {
+	updatesCh := make(chan core.LStreamsManagerUpdate, 32)
+	updatesCh <- core.LStreamsManagerUpdate{State: makeHeadlessState([]string{"host1"}, nil)}
+
+	var logs []core.LogMsg
+	for i := 0; i < 10000; i++ {
+		logs = append(logs, makeHeadlessLogMsg("host1", fmt.Sprintf("line %d", i)))
+	}
+
+	lsman := &fakeHeadlessLStreamsManager{
+		updatesCh:  updatesCh,
+		queryResps: []*core.LogRespTotal{{Logs: logs}},
+	}
+
+	stdout := &brokenPipeWriter{}
+	var stderr bytes.Buffer
+	exitCode := runHeadless(context.Background(), headlessParams{
+		timeRange:      "-1h",
+		maxNumLines:    100,
+		connectTimeout: 50 * time.Millisecond,
+		format:         core.ExportFormatRaw,
+		stdout:         stdout,
+		stderr:         &stderr,
+	}, lsman, updatesCh)
+
+	// The closed downstream is not an error, and we stop writing right away
+	// instead of trying to write all the remaining logs.
+	assert.Equal(t, headlessExitOK, exitCode)
+	assert.Equal(t, "", stderr.String())
+	assert.Equal(t, 1, stdout.writes)
+	assert.True(t, lsman.closed)
+}
+
+func TestRunHeadlessInterrupted(t *testing.T) {
+	updatesCh := make(chan core.LStreamsManagerUpdate, 32)
+	updatesCh <- core.LStreamsManagerUpdate{State: makeHeadlessState([]string{"host1"}, nil)}
+
+	// The query never completes, so we only return once interrupted.
+	lsman := &fakeHeadlessLStreamsManager{
+		updatesCh: updatesCh,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	exitCode := runHeadless(ctx, headlessParams{
+		timeRange:      "-1h",
+		maxNumLines:    100,
+		connectTimeout: 5 * time.Second,
+		format:         core.ExportFormatRaw,
+		stdout:         &stdout,
+		stderr:         &stderr,
+	}, lsman, updatesCh)
+
+	assert.Equal(t, headlessExitInterrupted, exitCode)
+	assert.Equal(t, "", stdout.String())
+	assert.Equal(t, "Error: interrupted\n", stderr.String())
+	assert.Equal(t, 1, len(lsman.queries))
+	assert.True(t, lsman.closed)
+}
+
+// headlessShellTransport implements core.ShellTransport by running a local
+// /bin/sh instead of connecting anywhere, so that the headless mode can be
+// tested with the real LStreamsManager; what the fake hosts return is defined
+// by the custom agents of the logstreams.
+type headlessShellTransport struct{}
+
+func (t *headlessShellTransport) Connect(ctx context.Context, resCh chan<- core.ShellConnUpdate) {
+	go func() {
+		conn, err := newHeadlessShellConn()
+		resCh <- core.ShellConnUpdate{
+			Result: &core.ShellConnResult{Conn: conn, Err: err},
+		}
+	}()
+}
+
+type headlessShellConn struct {
+	cmd *exec.Cmd
+
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
+}
+
+func newHeadlessShellConn() (*headlessShellConn, error) {
+	cmd := exec.Command("/bin/sh")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &headlessShellConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}, nil
+}
+
+func (c *headlessShellConn) Stdin() io.Writer  { return c.stdin }
+func (c *headlessShellConn) Stdout() io.Reader { return c.stdout }
+func (c *headlessShellConn) Stderr() io.Reader { return c.stderr }
+
+func (c *headlessShellConn) Close() {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
+
+func TestRunHeadlessLStreamsManager(t *testing.T) {
+	updatesCh := make(chan core.LStreamsManagerUpdate, 128)
+	lsman := core.NewLStreamsManager(core.LStreamsManagerParams{
+		// Both fake hosts share the local /tmp, and the agent is uploaded there
+		// under the name derived from the log file, so the log files (which
+		// aren't read anyway, since there are custom agents) must differ.
+		ConfigLogStreams: core.ConfigLogStreams{
+			"host1": {
+				LogFiles: []string{"/var/log/headless_test_host1"},
+				Options: core.ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					CustomAgent: `echo "m:1:2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo"
+`,
+				},
+			},
+			"host2": {
+				LogFiles: []string{"/var/log/headless_test_host2"},
+				Options: core.ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					// Works on connect, but fails every query.
+					CustomAgent: `if [ -n "$NLFROM" ]; then echo "error: disk on fire" 1>&2; exit 1; fi
+echo "m:1:2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: bar"
+`,
+				},
+			},
+		},
+		InitialLStreams: "host1,host2",
+		NewTransport: func(ls core.LogStream) core.ShellTransport {
+			return &headlessShellTransport{}
+		},
+		ClientID:  "headless_test",
+		UpdatesCh: updatesCh,
+		Clock:     clock.New(),
+
+		InitialDefaultTransportMode: core.NewTransportModeSSHLib(),
+	})
+
+	var stdout, stderr bytes.Buffer
+	exitCode := runHeadless(context.Background(), headlessParams{
+		timeRange:      "-20000h",
+		maxNumLines:    100,
+		connectTimeout: 20 * time.Second,
+		format:         core.ExportFormatRaw,
+		stdout:         &stdout,
+		stderr:         &stderr,
+	}, lsman, updatesCh)
+
+	// The logs from host1 are printed regardless of host2 failing.
+	assert.Equal(t, headlessExitPartial, exitCode)
+	assert.Equal(t, "2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo\n", stdout.String())
+	assert.Contains(t, stderr.String(), "Error: host2")
+	assert.Contains(t, stderr.String(), "disk on fire")
+}
+
+func TestHeadlessTimeRange(t *testing.T) {
+	now := time.Date(2025, 3, 27, 10, 30, 15, 0, time.UTC)
+
+	ftr, err := ParseFromToRange(time.UTC, "-1h")
+	assert.NoError(t, err)
+
+	from, to := headlessTimeRange(ftr, now)
+	assert.Equal(t, time.Date(2025, 3, 27, 9, 31, 0, 0, time.UTC), from)
+	assert.True(t, to.IsZero())
+
+	ftr, err = ParseFromToRange(time.UTC, "1h to 2h")
+	assert.NoError(t, err)
+
+	from, to = headlessTimeRange(ftr, now)
+	assert.Equal(t, time.Date(2025, 3, 27, 8, 31, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2025, 3, 27, 9, 31, 0, 0, time.UTC), to)
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
+	"github.com/dimonomid/clock"
 	"github.com/dimonomid/nerdlog/clhistory"
 	"github.com/dimonomid/nerdlog/clipboard"
+	"github.com/dimonomid/nerdlog/core"
 	"github.com/dimonomid/nerdlog/log"
+	"github.com/dimonomid/nerdlog/prommetrics"
 	"github.com/dimonomid/nerdlog/version"
+	"github.com/juju/errors"
 	"github.com/spf13/pflag"
 )
 
@@ -34,22 +41,59 @@ func main() {
 		flagVersion = pflag.BoolP("version", "v", false, "Print version info and exit")
 
 		flagTime             = pflag.StringP("time", "t", "", "Time range in the same format as accepted by the UI. Examples: '1h', 'Mar27 12:00'")
-		flagLStreamsConfig   = pflag.String("lstreams-config", filepath.Join(homeDir, ".config", "nerdlog", "logstreams.yaml"), "logstreams config file to use; set to an empty string to disable reading logstreams config")
+		flagLStreamsConfig   = pflag.String("lstreams-config", filepath.Join(homeDir, ".config", "nerdlog", "logstreams.yaml"), "logstreams config file to use; set to an empty string to disable reading logstreams config, or to '-' to read it from stdin")
 		flagCmdHistoryFile   = pflag.String("cmdhistory-file", filepath.Join(homeDir, ".nerdlog_history"), "Command-line history file")
 		flagQueryHistoryFile = pflag.String("queryhistory-file", filepath.Join(homeDir, ".nerdlog_query_history"), "Query history file")
+		flagSavedQueriesFile = pflag.String("saved-queries-file", filepath.Join(homeDir, ".config", "nerdlog", "queries.yaml"), "File with the named queries saved using the :save command")
 		flagLStreams         = pflag.StringP("lstreams", "h", "", "Logstreams to connect to, as comma-separated glob patterns, e.g. 'foo-*,bar-*'")
+		flagHosts            = pflag.String("hosts", "", "Only connect to the logstreams matching the given comma-separated name globs or tags for this session, without editing the config, e.g. 'web-*,db-01,tag:prod'; the items prefixed with '!' exclude the matching logstreams, e.g. '!tag:canary'")
 		flagQuery            = pflag.StringP("pattern", "p", "", "Initial awk pattern to use")
 		flagSelectQuery      = pflag.StringP("selquery", "s", "", "SELECT-like query to specify which fields to show, like 'time STICKY, message, lstream, level_name AS level, *'")
 		flagLogLevel         = pflag.String("loglevel", "error", "This is NOT about the logs that nerdlog fetches from the remote servers, it's rather about nerdlog's own log. Valid values are: error, warning, info, verbose1, verbose2 or verbose3")
+		flagLogFormat        = pflag.String("log-format", os.Getenv("NERDLOG_LOG_FORMAT"), "Format of nerdlog's own log: text (the default) or json, with one JSON object per line; defaults to the NERDLOG_LOG_FORMAT env var")
+		flagLogOutput        = pflag.String("log-output", os.Getenv("NERDLOG_LOG_OUTPUT"), "Where to write nerdlog's own log: a file path, stdout, stderr or syslog; empty means ~/.nerdlog.log. Defaults to the NERDLOG_LOG_OUTPUT env var")
 		flagSSHConfig        = pflag.String("ssh-config", filepath.Join(homeDir, ".ssh", "config"), "ssh config file to use; set to an empty string to disable reading ssh config")
 		flagSSHKeys          = pflag.StringSlice("ssh-key", defaultSSHKeys, "ssh keys to use; only the first existing file will be used")
+		flagSSHCert          = pflag.String("ssh-cert", "", "OpenSSH certificate for the ssh key; by default, the certificate next to the key is used if it exists, like ~/.ssh/id_ed25519-cert.pub")
+		flagSSHPKCS11        = pflag.String("ssh-pkcs11-provider", "", "PKCS#11 module to authenticate with a hardware token (like a YubiKey or an HSM) when using the internal ssh library, like /usr/lib/x86_64-linux-gnu/opensc-pkcs11.so; the PIN is asked for on connect. If set, neither ssh-agent nor --ssh-key are used")
+		flagSSHPKCS11Slot    = pflag.Uint("ssh-pkcs11-slot", 0, "Slot of the token to use with --ssh-pkcs11-provider")
+
+		flagSSHHostKeyPolicy    = pflag.String("ssh-host-key-policy", string(core.HostKeyPolicyInsecure), "How to verify ssh host keys when using the internal ssh library: insecure (don't verify), strict (host must be in the known_hosts file), or accept-new (accept keys of new hosts and add them to the known_hosts file, but fail if the key of a known host has changed)")
+		flagSSHKnownHosts       = pflag.String("ssh-known-hosts", filepath.Join(homeDir, ".ssh", "known_hosts"), "known_hosts file to verify ssh host keys against, and to add new keys to when using --ssh-host-key-policy=accept-new")
+		flagSSHAcceptedInMemory = pflag.Bool("ssh-accepted-keys-in-memory", false, "With --ssh-host-key-policy=accept-new, only remember the accepted keys until nerdlog exits, instead of adding them to the --ssh-known-hosts file")
 
 		// NOTE: we specifically use StringArray and not StringSlice here, because we
 		// don't want it to interpret commas in the values, like "--set foo=123,bar=234", since
 		// it messes with more complicated option syntax like 'transport=custom:some "arbitrary command"'
 		flagSet = pflag.StringArray("set", []string{}, "Initial option values in the form option=value, in the same way you'd specify them for the :set command. This flag can be given multiple times")
 
+		flagCapabilitiesCache    = pflag.String("capabilities-cache", filepath.Join(homeDir, ".cache", "nerdlog", "capabilities.json"), "File to cache the results of probing the hosts in, so that the next time they connect faster; set to an empty string to disable caching")
+		flagCapabilitiesCacheTTL = pflag.Duration("capabilities-cache-ttl", core.DefaultCapabilitiesCacheTTL, "How long the cached results of probing the hosts are used before probing them again")
+
+		flagQueryCache     = pflag.String("query-cache", "", fmt.Sprintf("Directory to cache the query results in, like ~/.cache/nerdlog/queries, so that re-running a query over a time range which ended at least %s ago doesn't query the hosts again; empty (the default) disables caching", core.QueryCacheMinAge))
+		flagQueryCacheSize = pflag.Int64("query-cache-size", core.DefaultQueryCacheMaxSize, "Max total size of the cached query results, in bytes; the oldest results are removed once it's exceeded")
+		flagQueryCacheTTL  = pflag.Duration("query-cache-ttl", core.DefaultQueryCacheTTL, "How long the cached query results are used before querying the hosts again")
+
+		flagCoalesceConnections = pflag.Bool("coalesce-connections", false, "When multiple logstreams resolve to the same user, host and port (e.g. different aliases of the same host in the ssh config), use a single ssh connection for all of them; only supported by the ssh-lib transport")
+
+		flagLStreamsConfigCmds = pflag.Bool("lstreams-config-cmds", false, "Allow the $(command) substitution in the logstreams config values, e.g. to get secrets from a password manager; the commands are executed locally when the config is loaded")
+
+		flagMaxQueriesInFlight = pflag.Int("max-queries-in-flight", 0, "Max number of logstreams to query at the same time, to avoid hammering a large fleet; the rest are queried as the in-flight ones respond. Zero means no limit")
+		flagMaxOpenStreams     = pflag.Int("max-open-streams", 0, "Max number of logstreams to have open at the same time; selecting more of them fails right away, instead of running out of file descriptors while connecting. Zero (the default) derives it from the open files limit (ulimit -n), negative means no limit")
+		flagQueryDebounce      = pflag.Duration("query-debounce", 0, "If not zero, wait for this long before starting every query; a newer query coming in meanwhile supersedes it, as well as the one in progress, so that only the latest one runs; not used in the --headless mode")
+
+		flagMaxConcurrentConnects = pflag.Int("max-concurrent-connects", 0, "Max number of logstreams to connect at the same time; the rest wait for their turn, the ones with the higher priority option going first. Zero means no limit")
+
+		flagAllowAdHocCmds = pflag.Bool("allow-adhoc-cmds", false, "Allow running arbitrary shell commands on the hosts with the :run command, for debugging the host setup")
+
 		flagNoJournalctlAccessWarn = pflag.Bool("no-journalctl-access-warning", false, "Suppress the warning when journalctl is being used by the user who can't read all system logs")
+
+		flagMetricsAddr = pflag.String("metrics-addr", "", "If not empty, serve the metrics like the number of connections and queries in the Prometheus format at http://<addr>/metrics, e.g. with --metrics-addr=127.0.0.1:9090; not used in the --headless mode")
+
+		flagHeadless       = pflag.Bool("headless", false, "Don't start the UI; instead, run a single query given by --lstreams, --time and --pattern, print the results to stdout and exit. Exit code is 0 on success, 1 on failure, 2 if only some of the logstreams have failed")
+		flagOutputFormat   = pflag.String("output-format", string(core.ExportFormatRaw), "Output format for the --headless mode: raw, json or csv")
+		flagConnectTimeout = pflag.Duration("connect-timeout", 30*time.Second, "For the --headless mode: how long to wait for logstreams to connect; after that, the ones which didn't connect are reported as failed")
+		flagSelect         = pflag.String("select", "", "For the --headless mode: only get the given comma-separated fields from the hosts instead of the full log lines, e.g. \"timestamp,host,program,pid,field:status\"")
 	)
 
 	pflag.Parse()
@@ -105,7 +149,7 @@ func main() {
 		SelectQuery: initialSelectQuery,
 	}
 
-	if !connectRightAway {
+	if !connectRightAway && !*flagHeadless {
 		// No query params were given, try to get the last one from the history.
 		item, _ := queryCLHistory.Prev("")
 		if item.Str != "" {
@@ -119,7 +163,7 @@ func main() {
 		}
 	}
 
-	if clipboard.InitErr != nil {
+	if clipboard.InitErr != nil && !*flagHeadless {
 		fmt.Printf("NOTE: X Clipboard is not available: %s\n", clipboard.InitErr.Error())
 	}
 
@@ -141,17 +185,145 @@ func main() {
 		os.Exit(1)
 	}
 
+	logFormat, err := log.ParseFormat(*flagLogFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --log-format: %s\n", err)
+		os.Exit(1)
+	}
+
+	logOutput, err := log.OpenOutput(*flagLogOutput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --log-output: %s\n", err)
+		os.Exit(1)
+	}
+
+	logger := log.NewLogger(logLevel).WithFormat(logFormat).WithOutput(logOutput)
+
+	selector, err := core.ParseLStreamSelector(*flagHosts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --hosts: %s\n", err)
+		os.Exit(1)
+	}
+
+	hostKeyPolicy, err := core.ParseHostKeyPolicy(*flagSSHHostKeyPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --ssh-host-key-policy: %s\n", err)
+		os.Exit(1)
+	}
+
+	hostKeysParams := core.HostKeysParams{
+		Policy:           hostKeyPolicy,
+		KnownHostsFiles:  []string{*flagSSHKnownHosts},
+		AcceptedKeysFile: *flagSSHKnownHosts,
+	}
+	if *flagSSHAcceptedInMemory {
+		hostKeysParams.AcceptedKeysFile = ""
+	}
+	hostKeys := core.NewHostKeys(hostKeysParams)
+
+	var sshPKCS11 *core.SSHPKCS11
+	if *flagSSHPKCS11 != "" {
+		sshPKCS11 = &core.SSHPKCS11{
+			Provider: *flagSSHPKCS11,
+			Slot:     *flagSSHPKCS11Slot,
+		}
+	}
+
+	var capabilitiesCache *core.CapabilitiesCache
+	if *flagCapabilitiesCache != "" {
+		capabilitiesCache = core.NewCapabilitiesCache(core.CapabilitiesCacheParams{
+			Path:  *flagCapabilitiesCache,
+			TTL:   *flagCapabilitiesCacheTTL,
+			Clock: clock.New(),
+		})
+	}
+
+	var queryCache *core.QueryCache
+	if *flagQueryCache != "" {
+		queryCache = core.NewQueryCache(core.QueryCacheParams{
+			Dir:     *flagQueryCache,
+			MaxSize: *flagQueryCacheSize,
+			TTL:     *flagQueryCacheTTL,
+			Clock:   clock.New(),
+		})
+	}
+
+	// The config is read from stdin right away, since stdin can only be read
+	// once, while the config can be reloaded later.
+	var lstreamsConfigStdin []byte
+	if *flagLStreamsConfig == StdinConfigPath {
+		lstreamsConfigStdin, err = readLogstreamsConfigStdin(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagHeadless {
+		os.Exit(mainHeadless(mainHeadlessParams{
+			optionSets:            *flagSet,
+			queryData:             initialQueryData,
+			outputFormat:          *flagOutputFormat,
+			connectTimeout:        *flagConnectTimeout,
+			selectSpec:            *flagSelect,
+			logger:                logger,
+			sshConfigPath:         *flagSSHConfig,
+			logstreamsConfigPath:  *flagLStreamsConfig,
+			logstreamsConfigStdin: lstreamsConfigStdin,
+			logstreamsConfigCmds:  *flagLStreamsConfigCmds,
+			sshKeys:               *flagSSHKeys,
+			sshCert:               *flagSSHCert,
+			sshPKCS11:             sshPKCS11,
+			hostKeys:              hostKeys,
+			capabilitiesCache:     capabilitiesCache,
+			queryCache:            queryCache,
+			coalesceConnections:   *flagCoalesceConnections,
+			maxQueriesInFlight:    *flagMaxQueriesInFlight,
+			maxOpenStreams:        *flagMaxOpenStreams,
+			maxConcurrentConnects: *flagMaxConcurrentConnects,
+			selector:              selector,
+		}))
+	}
+
+	var metrics core.Metrics
+	if *flagMetricsAddr != "" {
+		registry := prommetrics.NewRegistry(prommetrics.RegistryParams{})
+		if err := serveMetrics(*flagMetricsAddr, registry); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		metrics = registry
+	}
+
 	app, err := newNerdlogApp(
 		nerdlogAppParams{
-			initialOptionSets:    *flagSet,
-			initialQueryData:     initialQueryData,
-			connectRightAway:     connectRightAway,
-			clipboardInitErr:     clipboard.InitErr,
-			logLevel:             logLevel,
-			sshConfigPath:        *flagSSHConfig,
-			logstreamsConfigPath: *flagLStreamsConfig,
-			cmdHistoryFile:       *flagCmdHistoryFile,
-			sshKeys:              *flagSSHKeys,
+			initialOptionSets:     *flagSet,
+			initialQueryData:      initialQueryData,
+			selectQueryGiven:      *flagSelectQuery != "",
+			connectRightAway:      connectRightAway,
+			clipboardInitErr:      clipboard.InitErr,
+			logger:                logger,
+			sshConfigPath:         *flagSSHConfig,
+			logstreamsConfigPath:  *flagLStreamsConfig,
+			logstreamsConfigStdin: lstreamsConfigStdin,
+			logstreamsConfigCmds:  *flagLStreamsConfigCmds,
+			cmdHistoryFile:        *flagCmdHistoryFile,
+			savedQueriesFile:      *flagSavedQueriesFile,
+			sshKeys:               *flagSSHKeys,
+			sshCert:               *flagSSHCert,
+			sshPKCS11:             sshPKCS11,
+			hostKeys:              hostKeys,
+			capabilitiesCache:     capabilitiesCache,
+			queryCache:            queryCache,
+			coalesceConnections:   *flagCoalesceConnections,
+			allowAdHocCmds:        *flagAllowAdHocCmds,
+			metrics:               metrics,
+			maxQueriesInFlight:    *flagMaxQueriesInFlight,
+			maxOpenStreams:        *flagMaxOpenStreams,
+			maxConcurrentConnects: *flagMaxConcurrentConnects,
+			queryDebounce:         *flagQueryDebounce,
+			selector:              selector,
 
 			noJournalctlAccessWarn: *flagNoJournalctlAccessWarn,
 		},
@@ -178,3 +350,20 @@ func main() {
 
 	fmt.Println("Have a nice day.")
 }
+
+// serveMetrics starts serving the metrics from the registry at
+// http://<addr>/metrics in the background. The listening errors are returned
+// right away.
+func serveMetrics(addr string, registry *prommetrics.Registry) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Annotatef(err, "listening for metrics at %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	go http.Serve(ln, mux)
+
+	return nil
+}
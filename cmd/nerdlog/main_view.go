@@ -47,6 +47,7 @@ type MainViewParams struct {
 
 	OnDisconnectRequest OnDisconnectRequest
 	OnReconnectRequest  OnReconnectRequest
+	OnStopQueryRequest  OnStopQueryRequest
 
 	// TODO: support command history
 	OnCmd OnCmdCallback
@@ -114,6 +115,10 @@ type MainView struct {
 	// selectQuery is the effective SelectQuery
 	selectQuery *SelectQueryParsed
 
+	// columns are the widths and the truncation of the columns from the
+	// config; see setColumns.
+	columns columnsLayout
+
 	// actualToForQuery is similar to actualTo, but if the "to" was at zero
 	// value, then actualToForQuery will be zero value too. It's suitable for the
 	// use in queries (QueryLogsParams); and it must be used instead of actualTo,
@@ -170,12 +175,20 @@ type OnLogQueryCallback func(params core.QueryLogsParams)
 type OnLStreamsChange func(lstreamsSpec string) error
 type OnDisconnectRequest func()
 type OnReconnectRequest func()
+type OnStopQueryRequest func()
 type OnCmdCallback func(cmd string, opts CmdOpts)
 
 var (
 	queryLabelMatch    = "awk pattern:"
 	queryLabelMismatch = "awk pattern[yellow::b]*[-::-]"
 
+	// Same as above, but when the query language is set to filter.
+	queryLabelFilterMatch    = "filter:"
+	queryLabelFilterMismatch = "filter[yellow::b]*[-::-]"
+
+	// queryLabelFilterInvalid is used when the edited filter doesn't compile.
+	queryLabelFilterInvalid = "filter[red::b]![-::-]"
+
 	queryInputStateMatch = tcell.Style{}.
 				Background(tcell.ColorBlue).
 				Foreground(tcell.ColorWhite).
@@ -663,22 +676,7 @@ func NewMainView(params *MainViewParams) *MainView {
 		}
 	}).SetSelectedFunc(func(row int, column int) {
 		if row == rowIdxLoadOlder {
-			// Request to load more (older) logs
-
-			// Do the query to core
-			mv.params.OnLogQuery(core.QueryLogsParams{
-				From:  mv.actualFrom,
-				To:    mv.actualToForQuery,
-				Query: mv.query,
-
-				LoadEarlier: true,
-			})
-
-			// Update the cell text
-			mv.logsTable.SetCell(
-				rowIdxLoadOlder, 0,
-				newTableCellButton("... loading ..."),
-			)
+			mv.loadOlder()
 			return
 		}
 
@@ -970,11 +968,28 @@ func (mv *MainView) bumpOverlay() {
 }
 
 func (mv *MainView) queryInputApplyStyle() {
+	labelMatch, labelMismatch := queryLabelMatch, queryLabelMismatch
+	if mv.params.Options.GetQueryLang() == core.QueryLangFilter {
+		labelMatch, labelMismatch = queryLabelFilterMatch, queryLabelFilterMismatch
+	}
+
 	style := queryInputStateMatch
-	text := queryLabelMatch
+	text := labelMatch
 	if mv.queryInput.GetText() != mv.query {
 		style = queryInputStateMismatch
-		text = queryLabelMismatch
+		text = labelMismatch
+
+		// Validate the edited filter as it's being typed; the actual error
+		// will be shown if the query is applied.
+		if mv.params.Options.GetQueryLang() == core.QueryLangFilter {
+			err := core.ValidateQuery(core.QueryLogsParams{
+				Query:     mv.queryInput.GetText(),
+				QueryLang: core.QueryLangFilter,
+			}, core.QueryCapabilities{})
+			if err != nil {
+				text = queryLabelFilterInvalid
+			}
+		}
 	}
 
 	mv.queryInput.SetFieldStyle(style)
@@ -1037,6 +1052,14 @@ func (mv *MainView) applyHMState(lsmanState *core.LStreamsManagerState) {
 
 		sb.WriteString("Connecting to hosts...")
 
+		// If some of them are failing, show the summary, so that with many
+		// logstreams it's easy to see at a glance what's going on.
+		if lsmanState.Fleet.NumFailed > 0 {
+			sb.WriteString("\n")
+			sb.WriteString(lsmanState.Fleet.String())
+			sb.WriteString("\n")
+		}
+
 		logstreams := make([]string, 0, len(lsmanState.ConnDetailsByLStream))
 		for logstream := range lsmanState.ConnDetailsByLStream {
 			logstreams = append(logstreams, logstream)
@@ -1099,6 +1122,17 @@ func (mv *MainView) applyHMState(lsmanState *core.LStreamsManagerState) {
 			if slowest.stage.ExtraInfo != "" {
 				sb.WriteString(fmt.Sprintf("\n%s", slowest.stage.ExtraInfo))
 			}
+
+			// Also show per-logstream progress bars, slowest first.
+			sb.WriteString("\n")
+			for i, v := range vs {
+				if i >= maxProgressLStreams {
+					sb.WriteString(fmt.Sprintf("\n... and %d more", len(vs)-i))
+					break
+				}
+
+				sb.WriteString("\n" + tview.Escape(formatLStreamProgress(v.logstream, v.stage)))
+			}
 			sb.WriteString("[-]")
 		}
 
@@ -1261,7 +1295,7 @@ func (mv *MainView) updateTableHeader(msgs []core.LogMsg) (colNames []string) {
 			displayName = fmt.Sprintf("time (%s)", mv.timezoneStr(time.Now()))
 		}
 
-		cell := newTableCellHeader(displayName)
+		cell := newTableCellHeader(mv.columns.formatHeader(fld.Name, displayName))
 		if _, ok := existingTags[fld.Name]; !ok {
 			cell.SetTextColor(tcell.ColorRed)
 		}
@@ -1289,7 +1323,7 @@ func (mv *MainView) applyLogs(resp *core.LogRespTotal) {
 	mv.formatLogs()
 
 	if !resp.LoadedEarlier {
-		// Replaced all logs
+		// Replaced all logs, or loaded newer ones
 		mv.logsTable.Select(len(resp.Logs)+1, 0)
 		mv.logsTable.ScrollToEnd()
 		mv.bumpTimeRange(true)
@@ -1301,6 +1335,10 @@ func (mv *MainView) applyLogs(resp *core.LogRespTotal) {
 	}
 
 	mv.printMsg(fmt.Sprintf("Query took: %s", resp.QueryDur.Round(1*time.Millisecond)), nlMsgLevelInfo)
+
+	if len(resp.Warnings) > 0 {
+		mv.handleQueryWarnings(resp.Warnings)
+	}
 }
 
 func (mv *MainView) getLastQueryDebugInfo() string {
@@ -1451,6 +1489,7 @@ func (mv *MainView) formatLogs() {
 	)
 
 	tz := mv.params.Options.GetTimezone()
+	sanitize := mv.params.Options.GetSanitize()
 
 	// Add all available logs
 	for i, rowIdx := 0, 2; i < len(resp.Logs); i, rowIdx = i+1, rowIdx+1 {
@@ -1479,11 +1518,20 @@ func (mv *MainView) formatLogs() {
 
 			switch colName {
 			case FieldNameTime:
-				cell = newTableCellLogmsg(timeStr).SetTextColor(tcell.ColorLightBlue)
+				cell = newTableCellLogmsg(mv.columns.formatValue(colName, timeStr)).SetTextColor(tcell.ColorLightBlue)
 			case FieldNameMessage:
-				cell = newTableCellLogmsg(tview.Escape(msg.Msg)).SetTextColor(msgColor)
+				text := mv.columns.formatValue(colName, displayStr(firstLineOfMsg(msg.Msg), sanitize))
+				cell = newTableCellLogmsg(tview.Escape(text)).SetTextColor(msgColor)
 			default:
-				cell = newTableCellLogmsg(msg.Context[colName]).SetTextColor(msgColor)
+				value, ok := msg.Context[colName]
+				if !ok {
+					// Might be one of the fields which are not in the context, like
+					// level or labels.
+					value = core.Column{Field: colName}.Value(msg)
+				}
+
+				text := mv.columns.formatValue(colName, displayStr(value, sanitize))
+				cell = newTableCellLogmsg(text).SetTextColor(msgColor)
 			}
 
 			mv.logsTable.SetCell(rowIdx, i, cell)
@@ -1540,9 +1588,15 @@ func (mv *MainView) bumpStatusLineRight() {
 	}
 
 	if mv.curLogResp != nil {
+		// With sampling, the total is only an estimate, so make it clear.
+		totalStr := strconv.Itoa(mv.curLogResp.NumMsgsTotal)
+		if mv.curLogResp.Approximate {
+			totalStr = fmt.Sprintf("~%s (sampled 1/%d)", totalStr, mv.curLogResp.SampleRate)
+		}
+
 		mv.statusLineRight.SetText(fmt.Sprintf(
-			"%s / %d / %d",
-			selectedRowStr, len(mv.curLogResp.Logs), mv.curLogResp.NumMsgsTotal,
+			"%s / %d / %s",
+			selectedRowStr, len(mv.curLogResp.Logs), totalStr,
 		))
 	} else {
 		mv.statusLineRight.SetText("-")
@@ -1594,6 +1648,12 @@ func (mv *MainView) setSelectQuery(sqp *SelectQueryParsed) {
 	mv.selectQuery = sqp
 }
 
+// setColumns sets the widths and the truncation of the columns; the order of
+// the columns is defined by the select query, see selectQueryFromColumns.
+func (mv *MainView) setColumns(cols core.Columns) {
+	mv.columns = newColumnsLayout(cols)
+}
+
 func (mv *MainView) setTimeRange(from, to TimeOrDur) {
 	if from.IsZero() {
 		// TODO: maybe better error handling
@@ -1720,6 +1780,49 @@ func (mv *MainView) doQuery(params doQueryParams) {
 	})
 }
 
+// loadOlder requests more logs before the ones we already have.
+func (mv *MainView) loadOlder() {
+	// Do the query to core
+	mv.params.OnLogQuery(core.QueryLogsParams{
+		From:  mv.actualFrom,
+		To:    mv.actualToForQuery,
+		Query: mv.query,
+
+		LoadEarlier: true,
+	})
+
+	// Update the cell text
+	mv.logsTable.SetCell(
+		rowIdxLoadOlder, 0,
+		newTableCellButton("... loading ..."),
+	)
+}
+
+// loadNewer requests the logs after the ones we already have, which is
+// useful when the time range ends at the current time: unlike the refresh,
+// it only queries the new logs, and keeps the older ones we've loaded.
+func (mv *MainView) loadNewer() {
+	mv.params.OnLogQuery(core.QueryLogsParams{
+		From:  mv.actualFrom,
+		To:    mv.actualToForQuery,
+		Query: mv.query,
+
+		LoadNewer: true,
+	})
+}
+
+// resumeQuery resumes the query which has failed on some logstreams: only
+// those are queried again, and the logs from the rest are reused.
+func (mv *MainView) resumeQuery(token *core.QueryResumeToken) {
+	mv.params.OnLogQuery(core.QueryLogsParams{
+		From:  mv.actualFrom,
+		To:    mv.actualToForQuery,
+		Query: mv.query,
+
+		ResumeToken: token,
+	})
+}
+
 func (mv *MainView) DoQuery(dqp doQueryParams) {
 	mv.params.App.QueueUpdateDraw(func() {
 		mv.doQuery(dqp)
@@ -1872,20 +1975,47 @@ func (mv *MainView) showOriginalMsg(msg core.LogMsg) {
 
 	sb := strings.Builder{}
 
-	if msg.LogFilename != core.SpecialFilenameJournalctl {
+	if !core.IsTimestampAddressed(msg.LogFilename) {
 		sb.WriteString(fmt.Sprintf(
 			"ssh -t %s 'vim +\"set ft=messages\" +%d <(tail -n +%d %s | head -n %d)'\n\n",
 			msg.Context["lstream"], lnOffsetUp+1, lnBegin, msg.LogFilename, lnOffsetUp+lnOffsetDown,
 		))
 	}
 
-	sb.WriteString(tview.Escape(msg.OrigLine))
+	// The multi-line messages are sanitized line by line, to keep the newlines.
+	origLines := strings.Split(msg.OrigLine, "\n")
+	for i, line := range origLines {
+		origLines[i] = displayStr(line, mv.params.Options.GetSanitize())
+	}
+	sb.WriteString(tview.Escape(strings.Join(origLines, "\n")))
 
 	mv.showMessagebox("msg", "Message", sb.String(), &MessageboxParams{
 		CopyButton: true,
 	})
 }
 
+// firstLineOfMsg returns the first line of the multi-line message (see
+// core.Multiline) together with the number of the other lines, so that it
+// fits in a single table row; single-line messages are returned as is.
+func firstLineOfMsg(s string) string {
+	idx := strings.IndexByte(s, '\n')
+	if idx < 0 {
+		return s
+	}
+
+	return fmt.Sprintf("%s [+%d lines]", s[:idx], strings.Count(s[idx:], "\n"))
+}
+
+// displayStr returns the string to show on the UI: if sanitize is true
+// (which comes from the "sanitize" option), it's the sanitized string.
+func displayStr(s string, sanitize bool) string {
+	if !sanitize {
+		return s
+	}
+
+	return core.SanitizeForDisplay(s)
+}
+
 func (mv *MainView) showModal(pageName string, primitive tview.Primitive, width, height int, focus bool) {
 	modalGrid := tview.NewGrid().
 		SetColumns(0, width, 0).
@@ -2007,6 +2137,11 @@ func (mv *MainView) disconnect() {
 	mv.params.OnDisconnectRequest()
 }
 
+// stopQuery stops the query in progress, if any, without disconnecting.
+func (mv *MainView) stopQuery() {
+	mv.params.OnStopQueryRequest()
+}
+
 // handleQueryError shows the right messagebox based on the error cause.
 func (mv *MainView) handleQueryError(err error) {
 	if errors.Cause(err) == core.ErrBusyWithAnotherQuery ||
@@ -2080,6 +2215,26 @@ func (mv *MainView) handleBootstrapWarning(err error) {
 	})
 }
 
+// handleQueryWarnings shows the warnings printed by the agent during the
+// query; unlike errors, they don't fail the query, but the results might be
+// incomplete.
+func (mv *MainView) handleQueryWarnings(warnings []string) {
+	mv.printMsg(
+		fmt.Sprintf("Query took: %s, but there were warnings; results might be incomplete", mv.curLogResp.QueryDur.Round(1*time.Millisecond)),
+		nlMsgLevelWarn,
+	)
+
+	msg := fmt.Sprintf(
+		"Some logstreams printed warnings, so the results might be incomplete:\n\n%s",
+		strings.Join(warnings, "\n"),
+	)
+
+	mv.showMessagebox("queryWarnings", "Query warnings", msg, &MessageboxParams{
+		BackgroundColor: tcell.ColorDarkGoldenrod,
+		CopyButton:      true,
+	})
+}
+
 func (mv *MainView) handleDataRequest(dataReq *core.ShellConnDataRequest) {
 	msgID := "dataRequest"
 	title := dataReq.Title
@@ -30,6 +30,12 @@ var mainMenu = []menuItem{
 			mv.params.OnCmd("refresh!", CmdOpts{Internal: true})
 		},
 	},
+	{
+		Title: "Load newer logs       :newer     ",
+		Handler: func(mv *MainView) {
+			mv.params.OnCmd("newer", CmdOpts{Internal: true})
+		},
+	},
 	{
 		Title: "Copy query command    :xclip     ",
 		Handler: func(mv *MainView) {
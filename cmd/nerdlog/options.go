@@ -18,6 +18,27 @@ type Options struct {
 	MaxNumLines int
 
 	DefaultTransportMode *core.TransportMode
+
+	// QueryLang specifies how the query is interpreted: either as a raw awk
+	// pattern, or in the filter language.
+	QueryLang core.QueryLang
+
+	// IgnoreCase and WholeWord affect how the plain search terms (without a
+	// field) are matched in the filter language.
+	IgnoreCase bool
+	WholeWord  bool
+
+	// Sanitize makes the UI replace the non-printable characters and invalid
+	// UTF-8 in the logs with a placeholder; see core.SanitizeForDisplay.
+	Sanitize bool
+
+	// SampleRate, if more than 1, makes the queries only read every Nth log
+	// line, for the approximate results; see core.QueryLogsParams.SampleRate.
+	SampleRate int
+
+	// Pin makes the queries read the logs pinned at the first pinned query,
+	// for the reproducible results; see core.QueryLogsParams.Pin.
+	Pin bool
 }
 
 type OptionsShared struct {
@@ -50,6 +71,42 @@ func (o *OptionsShared) GetTransportMode() *core.TransportMode {
 	return o.options.DefaultTransportMode
 }
 
+func (o *OptionsShared) GetQueryLang() core.QueryLang {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.QueryLang
+}
+
+func (o *OptionsShared) GetIgnoreCase() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.IgnoreCase
+}
+
+func (o *OptionsShared) GetWholeWord() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.WholeWord
+}
+
+func (o *OptionsShared) GetSanitize() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.Sanitize
+}
+
+func (o *OptionsShared) GetSampleRate() int {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.SampleRate
+}
+
+func (o *OptionsShared) GetPin() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.Pin
+}
+
 func (o *OptionsShared) GetAll() Options {
 	o.mtx.Lock()
 	defer o.mtx.Unlock()
@@ -124,6 +181,103 @@ var AllOptions = map[string]*OptionMeta{
 		},
 		Help: "How to connect to remote hosts",
 	}, // }}}
+	"querylang": { // {{{
+		Get: func(o *Options) string {
+			return string(o.QueryLang)
+		},
+		Set: func(o *Options, value string) error {
+			ql, err := core.ParseQueryLang(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.QueryLang = ql
+			return nil
+		},
+		Help: "Query language: either awk (raw awk pattern) or filter (like 'level:error AND NOT program:cron')",
+	}, // }}}
+	"ignorecase": { // {{{
+		Get: func(o *Options) string {
+			return strconv.FormatBool(o.IgnoreCase)
+		},
+		Set: func(o *Options, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.IgnoreCase = v
+			return nil
+		},
+		Help: "Whether the search terms in the filter query are matched case-insensitively",
+	},
+	"ic": {
+		AliasOf: "ignorecase",
+	}, // }}}
+	"wholeword": { // {{{
+		Get: func(o *Options) string {
+			return strconv.FormatBool(o.WholeWord)
+		},
+		Set: func(o *Options, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.WholeWord = v
+			return nil
+		},
+		Help: "Whether the search terms in the filter query only match whole words",
+	}, // }}}
+	"sanitize": { // {{{
+		Get: func(o *Options) string {
+			return strconv.FormatBool(o.Sanitize)
+		},
+		Set: func(o *Options, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.Sanitize = v
+			return nil
+		},
+		Help: "Whether to show non-printable characters and invalid UTF-8 in the logs as a placeholder; it only affects the UI, not the exported logs",
+	}, // }}}
+	"samplerate": { // {{{
+		Get: func(o *Options) string {
+			return fmt.Sprint(o.SampleRate)
+		},
+		Set: func(o *Options, value string) error {
+			sampleRate, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if sampleRate < 0 {
+				return errors.Errorf("samplerate can't be negative")
+			}
+
+			o.SampleRate = sampleRate
+			return nil
+		},
+		Help: "If more than 1, only read every Nth log line, to get the approximate results faster on huge logs; 0 or 1 means exact",
+	}, // }}}
+	"pin": { // {{{
+		Get: func(o *Options) string {
+			return strconv.FormatBool(o.Pin)
+		},
+		Set: func(o *Options, value string) error {
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.Pin = v
+			return nil
+		},
+		Help: "Whether to pin the logs at their current size, so that the next queries read exactly the same logs even though they keep growing",
+	}, // }}}
 }
 
 func OptionMetaByName(name string) *OptionMeta {
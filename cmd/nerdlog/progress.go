@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/core"
+)
+
+// progressBarWidth is the number of cells in the per-logstream progress bar
+// shown while a query is in progress.
+const progressBarWidth = 20
+
+// maxProgressLStreams is the max number of logstreams to show the progress
+// bars for; the slowest ones are shown, and the rest are summarized.
+const maxProgressLStreams = 10
+
+// formatProgressBar returns a progress bar like "[#####---------------]" for
+// the given percentage.
+func formatProgressBar(percentage int, width int) string {
+	if percentage < 0 {
+		percentage = 0
+	} else if percentage > 100 {
+		percentage = 100
+	}
+
+	numFilled := percentage * width / 100
+
+	return "[" + strings.Repeat("#", numFilled) + strings.Repeat("-", width-numFilled) + "]"
+}
+
+// formatBytes returns a human-readable size like "12.3 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatLStreamProgress returns a single line with the progress bar for the
+// given logstream, like:
+//
+//	"[#########-----------]  45% web-01 (12.3 MiB / 27.0 MiB)"
+func formatLStreamProgress(logstream string, stage core.BusyStage) string {
+	var sb strings.Builder
+
+	sb.WriteString(formatProgressBar(stage.Percentage, progressBarWidth))
+	sb.WriteString(fmt.Sprintf(" %3d%% %s", stage.Percentage, logstream))
+
+	if stage.BytesTotal > 0 {
+		processed := stage.BytesProcessed
+		if processed > stage.BytesTotal {
+			processed = stage.BytesTotal
+		}
+
+		sb.WriteString(fmt.Sprintf(
+			" (%s / %s)", formatBytes(processed), formatBytes(stage.BytesTotal),
+		))
+	}
+
+	return sb.String()
+}
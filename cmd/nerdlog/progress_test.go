@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatProgressBar(t *testing.T) {
+	assert.Equal(t, "[----------]", formatProgressBar(0, 10))
+	assert.Equal(t, "[####------]", formatProgressBar(45, 10))
+	assert.Equal(t, "[##########]", formatProgressBar(100, 10))
+	assert.Equal(t, "[##########]", formatProgressBar(120, 10))
+	assert.Equal(t, "[----------]", formatProgressBar(-5, 10))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", formatBytes(0))
+	assert.Equal(t, "1023 B", formatBytes(1023))
+	assert.Equal(t, "1.0 KiB", formatBytes(1024))
+	assert.Equal(t, "12.3 MiB", formatBytes(12897485))
+	assert.Equal(t, "2.0 GiB", formatBytes(2*1024*1024*1024))
+}
+
+func TestFormatLStreamProgress(t *testing.T) {
+	assert.Equal(t,
+		"[#########-----------]  45% web-01 (12.3 MiB / 27.0 MiB)",
+		formatLStreamProgress("web-01", core.BusyStage{
+			Percentage:     45,
+			BytesProcessed: 12897485,
+			BytesTotal:     27 * 1024 * 1024,
+		}),
+	)
+
+	// Journalctl: no bytes
+	assert.Equal(t,
+		"[##------------------]  10% web-02",
+		formatLStreamProgress("web-02", core.BusyStage{Percentage: 10}),
+	)
+}
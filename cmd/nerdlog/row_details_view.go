@@ -757,7 +757,7 @@ func (rdv *RowDetailsView) updateUI() {
 		}
 		rdv.tbl.SetCell(nRow, rdvColIdxName, nameCell)
 
-		valStr := tview.Escape(val)
+		valStr := tview.Escape(displayStr(val, rdv.mainView.params.Options.GetSanitize()))
 		if filteredByValue {
 			valStr = "🔍 " + valStr
 		}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// SavedQuery is a named query which the user can save and recall later: the
+// logstreams, time range, query and the column layout (select query).
+type SavedQuery struct {
+	Name string `yaml:"name"`
+
+	LStreams string `yaml:"lstreams"`
+
+	// Time is the time range in the same format as for the --time flag or the
+	// :time command, e.g. "-1h", or "Mar27 12:00 to 13:00". Relative time
+	// ranges are stored as is, so when the query is recalled later, they are
+	// re-anchored to the current time.
+	Time string `yaml:"time"`
+
+	Query       string      `yaml:"query"`
+	SelectQuery SelectQuery `yaml:"selquery,omitempty"`
+}
+
+// NewSavedQuery creates a SavedQuery from the given QueryFull.
+func NewSavedQuery(name string, qf QueryFull) SavedQuery {
+	return SavedQuery{
+		Name:        name,
+		LStreams:    qf.LStreams,
+		Time:        qf.Time,
+		Query:       qf.Query,
+		SelectQuery: qf.SelectQuery,
+	}
+}
+
+// QueryFull returns the QueryFull which can be applied to the main view.
+func (sq *SavedQuery) QueryFull() QueryFull {
+	selectQuery := sq.SelectQuery
+	if selectQuery == "" {
+		selectQuery = DefaultSelectQuery
+	}
+
+	return QueryFull{
+		LStreams:    sq.LStreams,
+		Time:        sq.Time,
+		Query:       sq.Query,
+		SelectQuery: selectQuery,
+	}
+}
+
+// TimeRange resolves the time range of the saved query to the exact points
+// in time: relative ranges are anchored to the given now. If the range is
+// open-ended (like "-1h"), the returned "to" is zero.
+func (sq *SavedQuery) TimeRange(timezone *time.Location, now time.Time) (from, to time.Time, err error) {
+	ftr, err := ParseFromToRange(timezone, sq.Time)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Annotatef(err, "parsing time range %q", sq.Time)
+	}
+
+	from, to = headlessTimeRange(ftr, now)
+	return from, to, nil
+}
+
+func (sq *SavedQuery) validate() error {
+	if sq.Name == "" {
+		return errors.Errorf("name can't be empty")
+	}
+
+	if strings.ContainsAny(sq.Name, " \t\r\n") {
+		return errors.Errorf("name can't contain whitespace: %q", sq.Name)
+	}
+
+	if _, err := ParseFromToRange(time.UTC, sq.Time); err != nil {
+		return errors.Annotatef(err, "time range %q", sq.Time)
+	}
+
+	if sq.SelectQuery != "" {
+		if _, err := ParseSelectQuery(sq.SelectQuery); err != nil {
+			return errors.Annotatef(err, "select query")
+		}
+	}
+
+	return nil
+}
+
+// savedQueriesFile is the format of the saved queries yaml file.
+type savedQueriesFile struct {
+	Queries []SavedQuery `yaml:"queries"`
+}
+
+// SavedQueries manages the saved queries persisted in a yaml file, normally
+// ~/.config/nerdlog/queries.yaml. The file is read on every call, so that
+// multiple nerdlog instances don't overwrite each other's changes (unless
+// they save at the very same time).
+type SavedQueries struct {
+	path string
+}
+
+func NewSavedQueries(path string) *SavedQueries {
+	return &SavedQueries{
+		path: path,
+	}
+}
+
+// SaveQuery saves the given query; if a query with the same name already
+// exists, it's overwritten.
+func (s *SavedQueries) SaveQuery(sq SavedQuery) error {
+	if err := sq.validate(); err != nil {
+		return errors.Trace(err)
+	}
+
+	queries, err := s.load()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	replaced := false
+	for i := range queries {
+		if queries[i].Name == sq.Name {
+			queries[i] = sq
+			replaced = true
+			break
+		}
+	}
+
+	if !replaced {
+		queries = append(queries, sq)
+	}
+
+	return errors.Trace(s.store(queries))
+}
+
+// ListQueries returns all saved queries, in the order they were saved.
+func (s *SavedQueries) ListQueries() ([]SavedQuery, error) {
+	queries, err := s.load()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return queries, nil
+}
+
+// LoadQuery returns the saved query with the given name; if there is no such
+// query, the returned error satisfies errors.IsNotFound.
+func (s *SavedQueries) LoadQuery(name string) (*SavedQuery, error) {
+	queries, err := s.load()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for i := range queries {
+		if queries[i].Name == name {
+			return &queries[i], nil
+		}
+	}
+
+	return nil, errors.NotFoundf("saved query %q", name)
+}
+
+// DeleteQuery deletes the saved query with the given name; if there is no
+// such query, the returned error satisfies errors.IsNotFound.
+func (s *SavedQueries) DeleteQuery(name string) error {
+	queries, err := s.load()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for i := range queries {
+		if queries[i].Name == name {
+			queries = append(queries[:i], queries[i+1:]...)
+			return errors.Trace(s.store(queries))
+		}
+	}
+
+	return errors.NotFoundf("saved query %q", name)
+}
+
+// load reads all queries from the file; if the file doesn't exist, it's not
+// an error, and there are just no saved queries.
+func (s *SavedQueries) load() ([]SavedQuery, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Annotatef(err, "reading saved queries from %s", s.path)
+	}
+
+	var sqf savedQueriesFile
+	if err := yaml.Unmarshal(data, &sqf); err != nil {
+		return nil, errors.Annotatef(err, "unmarshaling yaml from %s", s.path)
+	}
+
+	return sqf.Queries, nil
+}
+
+// store writes the queries to the file atomically: first to a temporary file
+// in the same directory, and then renames it.
+func (s *SavedQueries) store(queries []SavedQuery) error {
+	data, err := yaml.Marshal(savedQueriesFile{Queries: queries})
+	if err != nil {
+		return errors.Annotatef(err, "marshaling saved queries")
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Annotatef(err, "creating dir %s", dir)
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return errors.Annotatef(err, "creating temp file in %s", dir)
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return errors.Annotatef(err, "writing %s", tmpPath)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return errors.Annotatef(err, "closing %s", tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return errors.Annotatef(err, "renaming %s to %s", tmpPath, s.path)
+	}
+
+	return nil
+}
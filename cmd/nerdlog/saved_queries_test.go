@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavedQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_saved_queries")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// The dir doesn't exist yet, it should be created on the first save.
+	sqs := NewSavedQueries(filepath.Join(dir, "nerdlog", "queries.yaml"))
+
+	queries, err := sqs.ListQueries()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(queries))
+
+	relative := NewSavedQuery("errors", QueryFull{
+		LStreams:    "web-*",
+		Time:        "-1h",
+		Query:       "/error/",
+		SelectQuery: "time STICKY, message, *",
+	})
+	absolute := NewSavedQuery("incident", QueryFull{
+		LStreams:    "db-01",
+		Time:        "Mar27 12:00 to Mar27 13:30",
+		Query:       "",
+		SelectQuery: DefaultSelectQuery,
+	})
+
+	assert.NoError(t, sqs.SaveQuery(relative))
+	assert.NoError(t, sqs.SaveQuery(absolute))
+
+	// Invalid ones are not saved.
+	assert.Error(t, sqs.SaveQuery(NewSavedQuery("", relative.QueryFull())))
+	assert.Error(t, sqs.SaveQuery(NewSavedQuery("foo bar", relative.QueryFull())))
+	assert.Error(t, sqs.SaveQuery(SavedQuery{Name: "badtime", Time: "foo"}))
+
+	// Use a new instance to make sure it's actually read from the file.
+	sqs = NewSavedQueries(filepath.Join(dir, "nerdlog", "queries.yaml"))
+
+	queries, err = sqs.ListQueries()
+	assert.NoError(t, err)
+	assert.Equal(t, []SavedQuery{relative, absolute}, queries)
+
+	// Relative time range gets re-anchored to the current time.
+	sq, err := sqs.LoadQuery("errors")
+	if assert.NoError(t, err) {
+		assert.Equal(t, relative.QueryFull(), sq.QueryFull())
+
+		now1 := time.Date(2025, 3, 27, 10, 30, 0, 0, time.UTC)
+		from, to, err := sq.TimeRange(time.UTC, now1)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Date(2025, 3, 27, 9, 30, 0, 0, time.UTC), from)
+		assert.True(t, to.IsZero())
+
+		now2 := time.Date(2025, 4, 2, 18, 0, 0, 0, time.UTC)
+		from, to, err = sq.TimeRange(time.UTC, now2)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Date(2025, 4, 2, 17, 0, 0, 0, time.UTC), from)
+		assert.True(t, to.IsZero())
+	}
+
+	// Absolute one stays the same regardless of the current time.
+	sq, err = sqs.LoadQuery("incident")
+	if assert.NoError(t, err) {
+		for _, now := range []time.Time{
+			time.Date(2025, 3, 27, 14, 0, 0, 0, time.UTC),
+			time.Date(2025, 4, 2, 18, 0, 0, 0, time.UTC),
+		} {
+			from, to, err := sq.TimeRange(time.UTC, now)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, int(from.Month()))
+			assert.Equal(t, 27, from.Day())
+			assert.Equal(t, 12, from.Hour())
+			assert.Equal(t, 90*time.Minute, to.Sub(from))
+		}
+	}
+
+	// Overwrite an existing query.
+	relative.Time = "-3h"
+	assert.NoError(t, sqs.SaveQuery(relative))
+
+	sq, err = sqs.LoadQuery("errors")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "-3h", sq.Time)
+	}
+
+	queries, err = sqs.ListQueries()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(queries))
+
+	// Delete.
+	assert.NoError(t, sqs.DeleteQuery("errors"))
+	assert.True(t, errors.IsNotFound(sqs.DeleteQuery("errors")))
+
+	_, err = sqs.LoadQuery("errors")
+	assert.True(t, errors.IsNotFound(err))
+
+	queries, err = sqs.ListQueries()
+	assert.NoError(t, err)
+	assert.Equal(t, []SavedQuery{absolute}, queries)
+
+	// No temp files are left behind.
+	files, err := ioutil.ReadDir(filepath.Join(dir, "nerdlog"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
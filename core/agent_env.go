@@ -0,0 +1,55 @@
+package core
+
+import (
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// AgentEnvPrefix is prepended to the names of the env vars from
+// QueryLogsParams.AgentEnv, so that they can't clobber the NL* vars which
+// nerdlog itself passes to the agents (like NLFROM for the custom agents), nor
+// the other env vars like PATH.
+const AgentEnvPrefix = "NLENV_"
+
+// validateAgentEnv checks that all the names in the given AgentEnv are valid
+// env var names (without the AgentEnvPrefix).
+func validateAgentEnv(env map[string]string) error {
+	for name := range env {
+		if name == "" {
+			return errors.Errorf("empty env var name")
+		}
+
+		for i := 0; i < len(name); i++ {
+			c := name[i]
+			isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+			isDigit := c >= '0' && c <= '9'
+
+			if !isLetter && !(isDigit && i > 0) {
+				return errors.Errorf(
+					"invalid env var name %q: only letters, digits and _ are allowed, and it can't start with a digit",
+					name,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// agentEnvCmdParts returns the shell-quoted env var assignments for the
+// given AgentEnv, sorted by name, to put before the agent command.
+func agentEnvCmdParts(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, AgentEnvPrefix+name+"="+shellQuote(env[name]))
+	}
+
+	return parts
+}
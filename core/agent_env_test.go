@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAgentEnv(t *testing.T) {
+	assert.NoError(t, validateAgentEnv(nil))
+	assert.NoError(t, validateAgentEnv(map[string]string{"DB": "", "_min_level2": "warn"}))
+
+	for _, name := range []string{"", "2DB", "DB-NAME", "DB NAME", "DB=x", "$DB"} {
+		assert.Error(t, validateAgentEnv(map[string]string{name: "foo"}), name)
+	}
+}
+
+func TestAgentEnvCmdParts(t *testing.T) {
+	env := map[string]string{
+		"DB":    "orders",
+		"QUERY": `it's "$HOME" and $(id); rm -rf /`,
+		"EMPTY": "",
+		"MULTI": "line1\nline2",
+	}
+
+	parts := agentEnvCmdParts(env)
+	assert.Equal(t, []string{
+		"NLENV_DB=orders",
+		"NLENV_EMPTY=''",
+		"NLENV_MULTI='line1\nline2'",
+		`NLENV_QUERY='it'"'"'s "$HOME" and $(id); rm -rf /'`,
+	}, parts)
+
+	// The values get to the command as is.
+	cmd := exec.Command("/bin/sh", "-c", strings.Join(parts, " ")+
+		` sh -c 'printf "%s|" "$NLENV_DB" "$NLENV_EMPTY" "$NLENV_MULTI" "$NLENV_QUERY"'`)
+	out, err := cmd.Output()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "orders||line1\nline2|"+env["QUERY"]+"|", string(out))
+}
+
+func TestAgentEnvCustomAgent(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "env")
+
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					CustomAgent: fmt.Sprintf(`echo "$NLMAXNUMLINES|$NLENV_DB|$NLENV_LEVEL" >> %s
+echo "m:1:2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo"
+`, envFile),
+				},
+			},
+		},
+		ClientID: "agent_env_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = n.Query(ctx, QueryLogsParams{
+		From:        time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+		AgentEnv: map[string]string{
+			"DB":    "orders",
+			"LEVEL": `it's "warn"`,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		// The bootstrap, which doesn't have the agent env.
+		"2||",
+		`10|orders|it's "warn"`,
+	}, strings.Split(strings.TrimSpace(string(env)), "\n"))
+
+	// The names are validated.
+	_, err = n.Query(ctx, QueryLogsParams{
+		MaxNumLines: 10,
+		AgentEnv:    map[string]string{"DB-NAME": "orders"},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `invalid env var name "DB-NAME"`)
+	}
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// validateAgentWrapper checks the agent wrapper like "firejail --quiet
+// --net=none"; see ConfigLogStreamOptions.AgentWrapper. The wrapper is a
+// piece of the shell command, so it can't span multiple lines.
+func validateAgentWrapper(wrapper string) error {
+	if wrapper == "" {
+		return nil
+	}
+
+	if strings.TrimSpace(wrapper) == "" {
+		return errors.Errorf("agent wrapper is empty")
+	}
+
+	if strings.ContainsAny(wrapper, "\r\n") {
+		return errors.Errorf("agent wrapper %q can't contain newlines", wrapper)
+	}
+
+	return nil
+}
+
+// agentWrapperCmdParts returns the command parts to prepend to the agent
+// invocation right before "bash <agent>", so that the agent runs through the
+// wrapper, like "firejail --quiet --net=none bash ...".
+//
+// Unlike the low priority wrappers (see lowPriorityCmdParts), the agent
+// wrapper is required: if it's missing on the host, the agent fails to run,
+// instead of running unconfined.
+func agentWrapperCmdParts(wrapper string) []string {
+	if wrapper == "" {
+		return nil
+	}
+
+	return []string{wrapper}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAgentWrapper(t *testing.T) {
+	for _, wrapper := range []string{
+		"",
+		"firejail --quiet --net=none",
+		"nsenter -t 1 -m",
+		`"$HOME/bin/confine" --profile 'nerdlog'`,
+	} {
+		assert.NoError(t, validateAgentWrapper(wrapper), wrapper)
+	}
+
+	for _, wrapper := range []string{
+		"  ",
+		"firejail\nrm -rf /",
+	} {
+		assert.Error(t, validateAgentWrapper(wrapper), wrapper)
+	}
+}
+
+func TestAgentWrapperCmdParts(t *testing.T) {
+	assert.Nil(t, agentWrapperCmdParts(""))
+	assert.Equal(t, []string{"nsenter -t 1 -m"}, agentWrapperCmdParts("nsenter -t 1 -m"))
+}
+
+func TestAgentWrapperQuery(t *testing.T) {
+	dir := t.TempDir()
+
+	logPath := filepath.Join(dir, "app.log")
+	logData := "2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo\n"
+	if err := ioutil.WriteFile(logPath, []byte(logData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The wrapper checks its own flag, records the commands it runs, and runs
+	// them as is.
+	wrapperLogPath := filepath.Join(dir, "wrapper.log")
+	wrapperPath := filepath.Join(dir, "wrapper.sh")
+	wrapperScript := strings.Join([]string{
+		"#!/bin/sh",
+		`[ "$1" = "--confined" ] || exit 1`,
+		"shift",
+		`echo "$*" >> ` + shellQuote(wrapperLogPath),
+		`exec "$@"`,
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(wrapperPath, []byte(wrapperScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				LogFiles: []string{logPath},
+				Options: ConfigLogStreamOptions{
+					ShellInit:    []string{"export TZ=UTC"},
+					AgentWrapper: shellQuote(wrapperPath) + " --confined",
+				},
+			},
+		},
+		ClientID: "agent_wrapper_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+	})
+	if assert.NoError(t, err) && assert.Len(t, resp.Logs, 1) {
+		assert.Equal(t, "foo", resp.Logs[0].Msg)
+	}
+
+	wrapperLog, err := ioutil.ReadFile(wrapperLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the bootstrap and the query ran through the wrapper.
+	var cmds []string
+	for _, line := range strings.Split(strings.TrimSpace(string(wrapperLog)), "\n") {
+		assert.True(t, strings.HasPrefix(line, "bash "), line)
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			cmds = append(cmds, fields[2])
+		}
+	}
+	assert.Equal(t, []string{"logstream_info", "query"}, cmds)
+}
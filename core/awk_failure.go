@@ -0,0 +1,118 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ErrAWKFailed is the sentinel error for AWKError, so that the client code
+// can check whether the awk script has failed on any of the logstreams like:
+// errors.Is(err, ErrAWKFailed).
+var ErrAWKFailed = errors.New("awk failed")
+
+// AWKError is returned when the awk script run by the agent has failed on
+// the host, e.g. with a runtime error on some unexpected line, or crashed: the
+// output stops abruptly then, so the results would be truncated.
+type AWKError struct {
+	LStreamName string
+
+	// ExitCode is the exit code of awk.
+	ExitCode int
+
+	// Line is the approximate number of the line on which awk has failed (in
+	// the same numbering as LogMsg.CombinedLinenumber), or 0 if unknown.
+	Line int
+
+	// Stderr is what awk (or the agent) has printed to stderr, joined into a
+	// single line; it's usually the awk's error message.
+	Stderr string
+}
+
+func (e *AWKError) Error() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s on host %s", ErrAWKFailed.Error(), e.LStreamName)
+	if e.Line > 0 {
+		fmt.Fprintf(&sb, " at ~line %d", e.Line)
+	}
+
+	if e.Stderr != "" {
+		fmt.Fprintf(&sb, ": %s", e.Stderr)
+	} else {
+		fmt.Fprintf(&sb, ": exit code %d", e.ExitCode)
+	}
+
+	return sb.String()
+}
+
+func (e *AWKError) Is(target error) bool {
+	return target == ErrAWKFailed
+}
+
+// awkFailure is what the agent reports with the "awk_failed:" line; see
+// check_query_pipeline in nerdlog_agent.sh.
+type awkFailure struct {
+	exitCode int
+
+	// firstLinenr is the number of the first line fed to awk, or 0 if the
+	// lines aren't numbered (like with journalctl).
+	firstLinenr int
+}
+
+// parseAWKFailedLine parses the part of the "awk_failed:" line after the
+// prefix, like "2:1".
+func parseAWKFailedLine(s string) (*awkFailure, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("expected 2 parts, got %d", len(parts))
+	}
+
+	exitCode, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing exit code")
+	}
+
+	ret := &awkFailure{exitCode: exitCode}
+	if parts[1] != "" {
+		ret.firstLinenr, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.Annotatef(err, "parsing first line number")
+		}
+	}
+
+	return ret, nil
+}
+
+// awkErrLineNumRegex matches the input line number in the awk's runtime error
+// messages: gawk prints like "(FILENAME=- FNR=3) fatal: ...", and mawk like
+// "FILENAME="-" FNR=3 NR=3". Since awk reads from stdin, FNR and NR are the
+// same.
+var awkErrLineNumRegex = regexp.MustCompile(`\bF?NR=([0-9]+)`)
+
+// newAWKError creates the AWKError from the failure reported by the agent
+// and the agent's stderr (without the lines handled by the LStreamClient).
+func newAWKError(lstreamName string, failure *awkFailure, stderr []string) *AWKError {
+	awkStderr := getAgentWarnings(stderr)
+
+	ret := &AWKError{
+		LStreamName: lstreamName,
+		ExitCode:    failure.exitCode,
+		Stderr:      strings.Join(awkStderr, " "),
+	}
+
+	if failure.firstLinenr > 0 {
+		for _, line := range awkStderr {
+			if m := awkErrLineNumRegex.FindStringSubmatch(line); m != nil {
+				nr, _ := strconv.Atoi(m[1])
+				ret.Line = failure.firstLinenr + nr - 1
+				break
+			}
+		}
+	}
+
+	return ret
+}
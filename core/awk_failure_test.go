@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAWKError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		line    string
+		stderr  []string
+		wantErr string
+	}{
+		{
+			name: "gawk",
+			line: "2:101",
+			stderr: []string{
+				"debug:Command to filter logs by time range:",
+				"gawk: cmd. line:12: (FILENAME=- FNR=3) fatal: division by zero attempted",
+			},
+			wantErr: "awk failed on host myhost at ~line 103: gawk: cmd. line:12: (FILENAME=- FNR=3) fatal: division by zero attempted",
+		},
+		{
+			name: "mawk",
+			line: "2:1",
+			stderr: []string{
+				"mawk: run time error: regular expression compile failed (missing ')')",
+				"(",
+				`	FILENAME="-" FNR=7 NR=7`,
+			},
+			wantErr: `awk failed on host myhost at ~line 7: mawk: run time error: regular expression compile failed (missing ')') ( FILENAME="-" FNR=7 NR=7`,
+		},
+		{
+			name:    "journalctl",
+			line:    "2:",
+			stderr:  []string{"gawk: cmd. line:12: (FILENAME=- FNR=3) fatal: division by zero attempted"},
+			wantErr: "awk failed on host myhost: gawk: cmd. line:12: (FILENAME=- FNR=3) fatal: division by zero attempted",
+		},
+		{
+			name:    "crashed",
+			line:    "139:1",
+			wantErr: "awk failed on host myhost: exit code 139",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failure, err := parseAWKFailedLine(tc.line)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			awkErr := newAWKError("myhost", failure, tc.stderr)
+			assert.Equal(t, tc.wantErr, awkErr.Error())
+			assert.True(t, errors.Is(awkErr, ErrAWKFailed))
+		})
+	}
+
+	for _, line := range []string{"", "2", "x:1", "2:x", "2:1:3"} {
+		_, err := parseAWKFailedLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+// TestAWKFailedOnHost checks that if the actual awk fails in the middle of
+// the logs, the query fails with the awk error instead of returning the
+// truncated results.
+func TestAWKFailedOnHost(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	from := localhostTestFrom()
+
+	for i := 1; i <= 5; i++ {
+		appendLocalhostTestLog(t, logPath, localhostTestLogLine(
+			from.Add(time.Duration(i)*time.Minute), fmt.Sprintf("myhost app[1]: msg %d", i),
+		))
+	}
+
+	n := newLocalhostTestNerdlog(t, "awk_failure_test", ConfigLogStreams{
+		"myhost": localhostTestLogStream(logPath),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The dynamic regex is only compiled on the 3rd line, and it's invalid,
+	// which is a runtime error in any awk.
+	_, err := n.Query(ctx, QueryLogsParams{
+		From:        from,
+		To:          from.Add(time.Hour),
+		MaxNumLines: 100,
+		Query:       `!/msg 3/ || $0 ~ ("(" "")`,
+	})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrAWKFailed))
+		assert.Contains(t, err.Error(), "awk failed on host myhost at ~line 3: ")
+	}
+}
@@ -0,0 +1,399 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// AWKDialect is the awk implementation which is going to run the generated
+// awk code; it matters for regexes, since different implementations support
+// different regex features.
+type AWKDialect string
+
+const (
+	AWKDialectGawk    AWKDialect = "gawk"
+	AWKDialectMawk    AWKDialect = "mawk"
+	AWKDialectBusybox AWKDialect = "busybox"
+
+	// AWKDialectPOSIX means that only the features from the POSIX extended
+	// regular expressions can be used.
+	AWKDialectPOSIX AWKDialect = "posix"
+)
+
+// AWKDialectDefault is the dialect that we assume for a logstream until its
+// actual dialect is probed during bootstrap. It's also the most permissive
+// one, so the regexes from the config are validated against it, and the
+// dialect-specific issues are only reported when connecting to the hosts.
+//
+// NOTE: nerdlog_agent.sh always runs gawk (it relies on its -b option), so
+// the other dialects are only possible with the custom agents, which run the
+// filter with the default awk on the host.
+const AWKDialectDefault = AWKDialectGawk
+
+// awkDialectPrefix is printed by the agent's logstream_info, followed by the
+// AWKDialect of the host.
+const awkDialectPrefix = "awk_dialect:"
+
+// RegexTranslateError is returned by TranslateRegexToAWK when the regex uses
+// a feature which can't be translated to the target awk dialect.
+type RegexTranslateError struct {
+	// Pos is the 0-based byte offset in the regex.
+	Pos int
+
+	// Feature is a human-readable name of the unsupported feature, like
+	// "lookahead".
+	Feature string
+
+	Dialect AWKDialect
+}
+
+func (e *RegexTranslateError) Error() string {
+	if e.Dialect == AWKDialectGawk {
+		return fmt.Sprintf("%s is not supported by awk regexes", e.Feature)
+	}
+
+	if regexFeatureSupportedByGawk(e.Feature) {
+		return fmt.Sprintf("%s is not supported by %s; it is supported by gawk, so consider installing it", e.Feature, e.Dialect)
+	}
+
+	return fmt.Sprintf("%s is not supported by %s, and by awk regexes in general", e.Feature, e.Dialect)
+}
+
+// Names of the features which can't always be translated.
+const (
+	regexFeatureLookaround      = "lookahead or lookbehind"
+	regexFeatureInlineFlags     = "inline flags like (?i)"
+	regexFeatureBackreference   = "backreference"
+	regexFeaturePossessive      = "possessive quantifier"
+	regexFeatureWordBoundary    = `word boundary \b`
+	regexFeatureNonWordBoundary = `non-word-boundary \B`
+	regexFeatureGawkOperator    = "gawk-specific regex operator"
+	regexFeatureInterval        = "interval expression like {2,3}"
+	regexFeatureNegatedClass    = "negated class shorthand (like \\D) inside brackets"
+	regexFeatureUnknownEscape   = "escape sequence"
+	regexFeatureTrailingEscape  = "trailing backslash"
+)
+
+func regexFeatureSupportedByGawk(feature string) bool {
+	switch feature {
+	case regexFeatureWordBoundary, regexFeatureNonWordBoundary,
+		regexFeatureGawkOperator, regexFeatureInterval:
+		return true
+	}
+
+	return false
+}
+
+// Replacements for the PCRE-style class shorthands, outside and inside the
+// bracket expressions. Negated ones can't be used inside brackets.
+var (
+	regexClassShorthands = map[byte]string{
+		'd': "[0-9]",
+		'D': "[^0-9]",
+		'w': "[A-Za-z0-9_]",
+		'W': "[^A-Za-z0-9_]",
+		's': `[ \t\r\n\f\v]`,
+		'S': `[^ \t\r\n\f\v]`,
+	}
+
+	regexClassShorthandsInBrackets = map[byte]string{
+		'd': "0-9",
+		'w': "A-Za-z0-9_",
+		's': ` \t\r\n\f\v`,
+	}
+)
+
+// TranslateRegexToAWK takes a regex which might use PCRE features (as users
+// are used to them), and translates it to the regex which will work in the
+// given awk dialect. Simple cases are rewritten, like \d to [0-9], or
+// (?:foo) to (foo), and lazy quantifiers like *? are replaced with the greedy
+// ones (which doesn't change whether the line matches or not). If some
+// feature can't be translated, a *RegexTranslateError is returned.
+func TranslateRegexToAWK(re string, dialect AWKDialect) (string, error) {
+	translated, _, err := TranslateRegexToAWKWithGroups(re, dialect)
+	return translated, err
+}
+
+// RegexNamedGroup describes a named capture group like (?P<status>\d{3}).
+type RegexNamedGroup struct {
+	Name string
+
+	// Index is the 1-based index of the group in the translated regex, as
+	// used by the gawk's 3-arg match() function.
+	Index int
+}
+
+// TranslateRegexToAWKWithGroups is like TranslateRegexToAWK, but also returns
+// the named capture groups from the original regex. Awk regexes don't
+// support named groups, so in the translated regex they become normal groups,
+// and the returned RegexNamedGroup-s contain their indices.
+func TranslateRegexToAWKWithGroups(re string, dialect AWKDialect) (string, []RegexNamedGroup, error) {
+	var sb strings.Builder
+	var namedGroups []RegexNamedGroup
+
+	// numGroups is the number of groups in the translated regex so far.
+	numGroups := 0
+
+	unsupported := func(pos int, feature string) (string, []RegexNamedGroup, error) {
+		return "", nil, &RegexTranslateError{Pos: pos, Feature: feature, Dialect: dialect}
+	}
+
+	// afterQuantifier is true if the last thing written was a quantifier; used
+	// to detect lazy and possessive quantifiers.
+	afterQuantifier := false
+
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+		wasAfterQuantifier := afterQuantifier
+		afterQuantifier = false
+
+		switch c {
+		case '\\':
+			if i+1 >= len(re) {
+				// It'd escape the closing slash of the awk regex literal.
+				return unsupported(i, regexFeatureTrailingEscape)
+			}
+
+			i++
+			e := re[i]
+
+			if repl, ok := regexClassShorthands[e]; ok {
+				sb.WriteString(repl)
+				continue
+			}
+
+			switch {
+			case e == 'A':
+				sb.WriteByte('^')
+
+			case e == 'z' || e == 'Z':
+				sb.WriteByte('$')
+
+			case e == 'b':
+				if dialect != AWKDialectGawk {
+					return unsupported(i-1, regexFeatureWordBoundary)
+				}
+				// In gawk, \b is a backspace, and the word boundary is \y.
+				sb.WriteString(`\y`)
+
+			case e == 'B':
+				if dialect != AWKDialectGawk {
+					return unsupported(i-1, regexFeatureNonWordBoundary)
+				}
+				sb.WriteString(`\B`)
+
+			case e == 'y' || e == '<' || e == '>' || e == '`' || e == '\'':
+				if dialect != AWKDialectGawk {
+					return unsupported(i-1, regexFeatureGawkOperator)
+				}
+				sb.WriteByte('\\')
+				sb.WriteByte(e)
+
+			case e >= '1' && e <= '9':
+				return unsupported(i-1, regexFeatureBackreference)
+
+			case e == 'x':
+				// Hex escape like \x41: replace it with the literal char.
+				if i+2 < len(re) && isHexDigit(re[i+1]) && isHexDigit(re[i+2]) {
+					v, _ := strconv.ParseUint(re[i+1:i+3], 16, 8)
+					sb.WriteString(regexQuoteMeta(string([]byte{byte(v)})))
+					i += 2
+					continue
+				}
+				return unsupported(i-1, regexFeatureUnknownEscape+` \x`)
+
+			case e == 't' || e == 'n' || e == 'r' || e == 'f' || e == 'v':
+				sb.WriteByte('\\')
+				sb.WriteByte(e)
+
+			case (e >= 'a' && e <= 'z') || (e >= 'A' && e <= 'Z') || (e >= '0' && e <= '9'):
+				return unsupported(i-1, regexFeatureUnknownEscape+` \`+string(e))
+
+			default:
+				// Escaped punctuation, like \. or \/
+				sb.WriteByte('\\')
+				sb.WriteByte(e)
+			}
+
+		case '[':
+			end, bracket, err := translateRegexBracket(re, i, dialect)
+			if err != nil {
+				return "", nil, errors.Trace(err)
+			}
+
+			sb.WriteString(bracket)
+			i = end
+
+		case '(':
+			if strings.HasPrefix(re[i:], "(?") {
+				rest := re[i+2:]
+				switch {
+				case strings.HasPrefix(rest, ":"):
+					// Non-capturing group; awk doesn't have those, but it doesn't
+					// hurt to capture.
+					sb.WriteByte('(')
+					numGroups++
+					i += 2
+
+				case strings.HasPrefix(rest, "P<") || (strings.HasPrefix(rest, "<") && !strings.HasPrefix(rest, "<=") && !strings.HasPrefix(rest, "<!")):
+					// Named group.
+					end := strings.IndexByte(rest, '>')
+					if end < 0 {
+						return unsupported(i, regexFeatureInlineFlags)
+					}
+
+					name := strings.TrimPrefix(rest[:end], "P")
+					name = strings.TrimPrefix(name, "<")
+
+					sb.WriteByte('(')
+					numGroups++
+					namedGroups = append(namedGroups, RegexNamedGroup{
+						Name:  name,
+						Index: numGroups,
+					})
+					i += 2 + end
+
+				case strings.HasPrefix(rest, "=") || strings.HasPrefix(rest, "!") ||
+					strings.HasPrefix(rest, "<=") || strings.HasPrefix(rest, "<!"):
+					return unsupported(i, regexFeatureLookaround)
+
+				default:
+					return unsupported(i, regexFeatureInlineFlags)
+				}
+
+				continue
+			}
+
+			sb.WriteByte(c)
+			numGroups++
+
+		case '*', '+', '?', '}':
+			if c == '}' {
+				sb.WriteByte(c)
+				afterQuantifier = true
+				continue
+			}
+
+			if wasAfterQuantifier {
+				switch c {
+				case '?':
+					// Lazy quantifier; whether the line matches doesn't depend on
+					// laziness, so just drop it.
+					continue
+				case '+':
+					return unsupported(i, regexFeaturePossessive)
+				}
+			}
+
+			sb.WriteByte(c)
+			afterQuantifier = true
+
+		case '{':
+			if dialect == AWKDialectMawk && isRegexInterval(re[i:]) {
+				return unsupported(i, regexFeatureInterval)
+			}
+
+			sb.WriteByte(c)
+
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String(), namedGroups, nil
+}
+
+// translateRegexBracket translates the bracket expression starting at the
+// position start (which must be '['), and returns the position of the closing
+// ']' and the translated bracket expression. If there is no closing bracket,
+// the rest of the regex is returned as is, and awk will complain about it.
+func translateRegexBracket(re string, start int, dialect AWKDialect) (int, string, error) {
+	var sb strings.Builder
+	sb.WriteByte('[')
+
+	i := start + 1
+	if i < len(re) && re[i] == '^' {
+		sb.WriteByte('^')
+		i++
+	}
+
+	// A closing bracket right after the opening one (or after the negation)
+	// is a literal.
+	if i < len(re) && re[i] == ']' {
+		sb.WriteByte(']')
+		i++
+	}
+
+	for ; i < len(re); i++ {
+		c := re[i]
+
+		switch c {
+		case ']':
+			sb.WriteByte(']')
+			return i, sb.String(), nil
+
+		case '[':
+			// Character classes like [:alpha:] are copied as is.
+			if i+1 < len(re) && (re[i+1] == ':' || re[i+1] == '.' || re[i+1] == '=') {
+				closing := string(re[i+1]) + "]"
+				end := strings.Index(re[i+2:], closing)
+				if end >= 0 {
+					sb.WriteString(re[i : i+2+end+2])
+					i += 2 + end + 1
+					continue
+				}
+			}
+			sb.WriteByte(c)
+
+		case '\\':
+			if i+1 >= len(re) {
+				sb.WriteByte(c)
+				continue
+			}
+
+			i++
+			e := re[i]
+
+			if repl, ok := regexClassShorthandsInBrackets[e]; ok {
+				sb.WriteString(repl)
+				continue
+			}
+
+			if _, ok := regexClassShorthands[e]; ok {
+				return 0, "", &RegexTranslateError{Pos: i - 1, Feature: regexFeatureNegatedClass, Dialect: dialect}
+			}
+
+			sb.WriteByte('\\')
+			sb.WriteByte(e)
+
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return len(re) - 1, re[start:], nil
+}
+
+// isRegexInterval returns whether the string starts with an interval
+// expression like {2}, {2,} or {2,3}.
+func isRegexInterval(s string) bool {
+	end := strings.IndexByte(s, '}')
+	if end < 2 {
+		return false
+	}
+
+	for _, c := range s[1:end] {
+		if !(c >= '0' && c <= '9') && c != ',' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type translateRegexTestCase struct {
+	re string
+
+	// wantByDialect contains the expected translated regexes; for dialects
+	// which aren't in the map, wantDefault is expected.
+	wantDefault   string
+	wantByDialect map[AWKDialect]string
+
+	// If wantErrFeature is not empty, an error is expected for the dialects
+	// which aren't in okDialects.
+	wantErrFeature string
+	wantErrPos     int
+	okDialects     []AWKDialect
+}
+
+var allAWKDialects = []AWKDialect{
+	AWKDialectGawk, AWKDialectMawk, AWKDialectBusybox, AWKDialectPOSIX,
+}
+
+func TestTranslateRegexToAWK(t *testing.T) {
+	testCases := []translateRegexTestCase{
+		{re: "foo.*bar", wantDefault: "foo.*bar"},
+		{re: `\d+\.\d+`, wantDefault: `[0-9]+\.[0-9]+`},
+		{re: `\D\w\W`, wantDefault: `[^0-9][A-Za-z0-9_][^A-Za-z0-9_]`},
+		{re: `a\sb\S`, wantDefault: `a[ \t\r\n\f\v]b[^ \t\r\n\f\v]`},
+		{re: `[\d\w.-]`, wantDefault: `[0-9A-Za-z0-9_.-]`},
+		{re: `[^\s]`, wantDefault: `[^ \t\r\n\f\v]`},
+		{re: `[]\d]`, wantDefault: `[]0-9]`},
+		{re: `[[:alpha:]\d]`, wantDefault: `[[:alpha:]0-9]`},
+		{re: `\Afoo\z`, wantDefault: `^foo$`},
+		{re: `(?:foo|bar)+`, wantDefault: `(foo|bar)+`},
+		{re: `(?P<name>foo)(?<other>bar)`, wantDefault: `(foo)(bar)`},
+		{re: `a.*?b+?c??`, wantDefault: `a.*b+c?`},
+		{re: `a{2,3}?`, wantDefault: `a{2,3}`, okDialects: []AWKDialect{AWKDialectGawk, AWKDialectBusybox, AWKDialectPOSIX}, wantErrFeature: regexFeatureInterval, wantErrPos: 1},
+		{re: `\x41\x2e`, wantDefault: `A\.`},
+		{re: `\/api\/`, wantDefault: `\/api\/`},
+		{re: `a\tb`, wantDefault: `a\tb`},
+
+		{re: `\bfoo\b`, wantByDialect: map[AWKDialect]string{AWKDialectGawk: `\yfoo\y`}, okDialects: []AWKDialect{AWKDialectGawk}, wantErrFeature: regexFeatureWordBoundary, wantErrPos: 0},
+		{re: `\<foo\>`, wantByDialect: map[AWKDialect]string{AWKDialectGawk: `\<foo\>`}, okDialects: []AWKDialect{AWKDialectGawk}, wantErrFeature: regexFeatureGawkOperator, wantErrPos: 0},
+
+		{re: `foo(?=bar)`, wantErrFeature: regexFeatureLookaround, wantErrPos: 3},
+		{re: `foo(?!bar)`, wantErrFeature: regexFeatureLookaround, wantErrPos: 3},
+		{re: `(?<=foo)bar`, wantErrFeature: regexFeatureLookaround, wantErrPos: 0},
+		{re: `(?<!foo)bar`, wantErrFeature: regexFeatureLookaround, wantErrPos: 0},
+		{re: `(?i)foo`, wantErrFeature: regexFeatureInlineFlags, wantErrPos: 0},
+		{re: `(a)\1`, wantErrFeature: regexFeatureBackreference, wantErrPos: 3},
+		{re: `a++`, wantErrFeature: regexFeaturePossessive, wantErrPos: 2},
+		{re: `[\D]`, wantErrFeature: regexFeatureNegatedClass, wantErrPos: 1},
+		{re: `\Qfoo\E`, wantErrFeature: regexFeatureUnknownEscape + ` \Q`, wantErrPos: 0},
+		{re: `foo\`, wantErrFeature: regexFeatureTrailingEscape, wantErrPos: 3},
+	}
+
+	for _, tc := range testCases {
+		for _, dialect := range allAWKDialects {
+			got, err := TranslateRegexToAWK(tc.re, dialect)
+
+			expectErr := tc.wantErrFeature != ""
+			for _, d := range tc.okDialects {
+				if d == dialect {
+					expectErr = false
+				}
+			}
+
+			if expectErr {
+				var rtErr *RegexTranslateError
+				if assert.True(t, errors.As(err, &rtErr), "re %q, dialect %s: expected error, got %q", tc.re, dialect, got) {
+					assert.Equal(t, tc.wantErrFeature, rtErr.Feature, "re %q, dialect %s", tc.re, dialect)
+					assert.Equal(t, tc.wantErrPos, rtErr.Pos, "re %q, dialect %s", tc.re, dialect)
+				}
+				continue
+			}
+
+			if !assert.NoError(t, err, "re %q, dialect %s", tc.re, dialect) {
+				continue
+			}
+
+			want := tc.wantDefault
+			if w, ok := tc.wantByDialect[dialect]; ok {
+				want = w
+			}
+
+			assert.Equal(t, want, got, "re %q, dialect %s", tc.re, dialect)
+		}
+	}
+}
+
+func TestRegexTranslateErrorMessage(t *testing.T) {
+	_, err := TranslateRegexToAWK(`\bfoo`, AWKDialectMawk)
+	assert.EqualError(t, err, `word boundary \b is not supported by mawk; it is supported by gawk, so consider installing it`)
+
+	_, err = TranslateRegexToAWK(`foo(?=bar)`, AWKDialectMawk)
+	assert.EqualError(t, err, `lookahead or lookbehind is not supported by mawk, and by awk regexes in general`)
+
+	_, err = TranslateRegexToAWK(`foo(?=bar)`, AWKDialectGawk)
+	assert.EqualError(t, err, `lookahead or lookbehind is not supported by awk regexes`)
+}
+
+// TestTranslateRegexToAWKWithMawk checks that the translated regexes actually
+// work in mawk, if it's available.
+func TestTranslateRegexToAWKWithMawk(t *testing.T) {
+	if _, err := exec.LookPath("mawk"); err != nil {
+		t.Skip("mawk is not available")
+	}
+
+	type testCase struct {
+		re      string
+		line    string
+		isMatch bool
+	}
+
+	testCases := []testCase{
+		{re: `id=\d+`, line: "foo id=123 bar", isMatch: true},
+		{re: `id=\d+`, line: "foo id=abc bar", isMatch: false},
+		{re: `\w+@\w+\.com`, line: "mail me@example.com", isMatch: true},
+		{re: `a\sb`, line: "a\tb", isMatch: true},
+		{re: `(?:GET|POST) \/api`, line: "POST /api/foo", isMatch: true},
+		{re: `[\d.]+ms`, line: "took 12.5ms", isMatch: true},
+		{re: `\Afoo.*?bar\z`, line: "foo 1 bar", isMatch: true},
+		{re: `\Afoo.*?bar\z`, line: "foo 1 bar 2", isMatch: false},
+	}
+
+	for _, tc := range testCases {
+		translated, err := TranslateRegexToAWK(tc.re, AWKDialectMawk)
+		if !assert.NoError(t, err, "re %q", tc.re) {
+			continue
+		}
+
+		cmd := exec.Command("mawk", awkRegexLiteral(translated)+` { print "match" }`)
+		cmd.Stdin = strings.NewReader(tc.line + "\n")
+		out, err := cmd.CombinedOutput()
+		if !assert.NoError(t, err, "re %q, translated %q: %s", tc.re, translated, string(out)) {
+			continue
+		}
+
+		assert.Equal(t, tc.isMatch, strings.TrimSpace(string(out)) == "match", "re %q, translated %q", tc.re, translated)
+	}
+}
+
+func TestTranslateRegexToAWKWithGroups(t *testing.T) {
+	translated, groups, err := TranslateRegexToAWKWithGroups(
+		`(\w+) (?P<method>GET|POST) (?:\/api)? status=(?<status>\d{3}) [(]`, AWKDialectGawk,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, `([A-Za-z0-9_]+) (GET|POST) (\/api)? status=([0-9]{3}) [(]`, translated)
+	assert.Equal(t, []RegexNamedGroup{
+		{Name: "method", Index: 2},
+		{Name: "status", Index: 4},
+	}, groups)
+}
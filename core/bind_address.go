@@ -0,0 +1,76 @@
+package core
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// validateBindAddress checks that the given bind address (see
+// ConfigLogStream.BindAddress) is an IP address assigned to one of the local
+// network interfaces.
+func validateBindAddress(bindAddr string) error {
+	ip := net.ParseIP(bindAddr)
+	if ip == nil {
+		return errors.Errorf("bind address %q is not a valid IP address", bindAddr)
+	}
+
+	isLocal, err := isLocalIP(ip)
+	if err != nil {
+		return errors.Annotatef(err, "checking bind address %s", bindAddr)
+	}
+
+	if !isLocal {
+		return errors.Errorf("bind address %s is not assigned to any local network interface", bindAddr)
+	}
+
+	return nil
+}
+
+// isLocalIP returns whether the given IP is assigned to one of the local
+// network interfaces.
+func isLocalIP(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// newDialer returns a dialer with the given timeout, which dials from the
+// given bind address (if it's not empty).
+func newDialer(timeout time.Duration, bindAddr string) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if bindAddr != "" {
+		ip := net.ParseIP(bindAddr)
+		if ip == nil {
+			return nil, errors.Errorf("bind address %q is not a valid IP address", bindAddr)
+		}
+
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	return dialer, nil
+}
+
+// annotateDialErr annotates the error returned by the dialer created with
+// newDialer, so that it's clear whether it failed to bind to the local
+// address, or to connect to the remote one.
+func annotateDialErr(err error, addr, bindAddr string) error {
+	if bindAddr != "" && errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return errors.Annotatef(err, "binding to local address %s", bindAddr)
+	}
+
+	return errors.Annotatef(err, "connecting to %s", addr)
+}
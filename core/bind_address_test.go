@@ -0,0 +1,36 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBindAddress(t *testing.T) {
+	assert.NoError(t, validateBindAddress("127.0.0.1"))
+
+	err := validateBindAddress("foo")
+	assert.EqualError(t, err, `bind address "foo" is not a valid IP address`)
+
+	err = validateBindAddress("127.0.0.1:22")
+	assert.EqualError(t, err, `bind address "127.0.0.1:22" is not a valid IP address`)
+
+	err = validateBindAddress("192.0.2.1")
+	assert.EqualError(t, err, "bind address 192.0.2.1 is not assigned to any local network interface")
+}
+
+func TestNewDialer(t *testing.T) {
+	dialer, err := newDialer(5*time.Second, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, dialer.Timeout)
+	assert.Nil(t, dialer.LocalAddr)
+
+	dialer, err = newDialer(5*time.Second, "10.1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, dialer.LocalAddr)
+
+	_, err = newDialer(5*time.Second, "foo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package core
+
+const (
+	// busyboxMarker is printed by the bootstrap script if the host is
+	// busybox-based, like Alpine and many embedded systems.
+	busyboxMarker = "busybox_detected"
+
+	// busyboxShellVar is set to 1 by busyboxProbeCmd on the busybox-based
+	// hosts, so that the rest of the bootstrap script can check it.
+	busyboxShellVar = "nlbusybox"
+
+	// busyboxBashRequiredError is printed by the bootstrap script if the host
+	// is busybox-based and has no bash, which the agent requires; unlike the
+	// regular distros, Alpine doesn't have it by default.
+	busyboxBashRequiredError = "error:bash is required, but not found on this busybox-based host; on Alpine, install it with: apk add bash gawk"
+)
+
+// busyboxProbeCmd is the part of the bootstrap script which detects whether
+// the host is busybox-based: either ls is a busybox applet, or /bin/sh is a
+// link to busybox (then ls might come from coreutils, but the shell is still
+// the busybox ash, with its own echo). If so, it prints the busyboxMarker
+// and sets the busyboxShellVar.
+//
+// Just having the busybox binary somewhere isn't enough, since plenty of
+// regular distros have it installed as a rescue tool.
+const busyboxProbeCmd = busyboxShellVar + "=; " +
+	"if ls --help 2>&1 | grep -q BusyBox || readlink /bin/sh 2>/dev/null | grep -q busybox; " +
+	"then " + busyboxShellVar + "=1; printf '%s\\n' '" + busyboxMarker + "'; fi"
+
+// busyboxBashCheckCmd is the part of the bootstrap script which fails the
+// bootstrap with a clear error if the busyboxProbeCmd has detected busybox,
+// and there's no bash.
+const busyboxBashCheckCmd = "if [ -n \"$" + busyboxShellVar + "\" ] && ! command -v bash >/dev/null 2>&1; " +
+	"then echo '" + busyboxBashRequiredError + "'; echo 'bootstrap failed'; exit 1; fi"
+
+// markerCmd returns the shell command which prints the given marker line;
+// the marker must already be a single shell word, quoted if needed.
+//
+// On the busybox-based hosts, echo is an applet whose handling of escapes and
+// options varies between builds, so printf is used there; elsewhere, it's the
+// plain echo.
+func markerCmd(marker string, busybox bool) string {
+	if busybox {
+		return "printf '%s\\n' " + marker
+	}
+
+	return "echo " + marker
+}
+
+// agentBusyboxArgs returns the args to pass to nerdlog_agent.sh so that it
+// takes the busybox quirks into account; see the --busybox option there.
+func agentBusyboxArgs(busybox bool) []string {
+	if !busybox {
+		return nil
+	}
+
+	return []string{"--busybox"}
+}
+
+// cachedBusybox returns whether the host of the logstream is busybox-based,
+// as per the capabilities cache; false if there's no cache or no entry.
+func cachedBusybox(cache *CapabilitiesCache, ls LogStream) bool {
+	if cache == nil {
+		return false
+	}
+
+	caps, ok := cache.Get(capabilitiesCacheKey(ls))
+	return ok && caps.Busybox
+}
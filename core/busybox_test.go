@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// runSh runs the script with sh, with the given dir prepended to the PATH,
+// and returns its stdout.
+func runSh(t *testing.T, pathDir, script string) string {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+pathDir+":"+os.Getenv("PATH"))
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running %q: %s", script, err)
+	}
+
+	return string(out)
+}
+
+func TestBusyboxProbeCmd(t *testing.T) {
+	script := busyboxProbeCmd + "; echo \"var:$" + busyboxShellVar + "\""
+
+	// The regular host: the real ls, and /bin/sh is not busybox (at least
+	// not on the machines running the tests).
+	assert.Equal(t, "var:\n", runSh(t, t.TempDir(), script))
+
+	// The busybox-based host, where ls is an applet.
+	dir := t.TempDir()
+	fakeLs := "#!/bin/sh\necho 'BusyBox v1.36.1 (2024-06-10 07:11:47 UTC) multi-call binary.' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "ls"), []byte(fakeLs), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, busyboxMarker+"\nvar:1\n", runSh(t, dir, script))
+}
+
+func TestMarkerCmd(t *testing.T) {
+	assert.Equal(t, "echo 'command_done:3'", markerCmd("'command_done:3'", false))
+	assert.Equal(t, `printf '%s\n' 'command_done:3'`, markerCmd("'command_done:3'", true))
+
+	// Both forms print the very same line.
+	for _, busybox := range []bool{false, true} {
+		assert.Equal(t, "__CONNECTED__\n", runSh(t, t.TempDir(), markerCmd(echoMarkerConnected, busybox)))
+		assert.Equal(t, "command_done:3\ncommand_done:3\n", runSh(t, t.TempDir(), "{\n"+commandDoneCmds(3, busybox)+"} 2>&1"))
+	}
+}
+
+func TestNerdlogBusybox(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	cache := NewCapabilitiesCache(CapabilitiesCacheParams{
+		Path:  filepath.Join(t.TempDir(), "capabilities.json"),
+		Clock: clock.New(),
+	})
+
+	agentCmds := &fakeLogs{}
+	markerCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "fake-01",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{
+				logs: logs, agentCmds: agentCmds, markerCmds: markerCmds,
+				hostVersion: "Linux 6.6.0 x86_64", busybox: true,
+			}
+		},
+		CapabilitiesCache: cache,
+		ClientID:          "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(resp.Logs)) {
+		assert.Equal(t, "foo", resp.Logs[0].Msg)
+	}
+
+	// During bootstrap, we don't know yet, so the shell decides whether to
+	// pass the --busybox; after that, it's always passed.
+	cmds := agentCmds.get()
+	if assert.Equal(t, 2, len(cmds)) {
+		assert.Contains(t, cmds[0], " logstream_info ")
+		assert.Contains(t, cmds[0], " ${nlbusybox:+--busybox}")
+
+		assert.Contains(t, cmds[1], " query ")
+		assert.Contains(t, cmds[1], " --busybox ")
+	}
+
+	// The bootstrap's own markers are printed with echo, and the ones after it
+	// with printf.
+	markers := markerCmds.get()
+	if assert.True(t, len(markers) >= 4) {
+		assert.Equal(t, "echo 'command_done:0'", markers[0])
+		for _, m := range markers[2:] {
+			assert.True(t, strings.HasPrefix(m, `printf '%s\n' 'command_done:`), m)
+		}
+	}
+
+	// It's cached, so on the next run, the transport uses the printf-based
+	// handshake right away.
+	cache.mtx.Lock()
+	assert.Equal(t, 1, len(cache.entries))
+	for _, caps := range cache.entries {
+		assert.True(t, caps.Busybox)
+	}
+	cache.mtx.Unlock()
+
+	ls := LogStream{
+		Name: "localhost",
+		Transport: ConfigLogStreamShellTransport{
+			Localhost: &ConfigLogStreamShellTransportLocalhost{},
+		},
+		LogFiles: []string{"/var/log/syslog"},
+	}
+
+	newTransport := func() *ShellTransportCustomCmd {
+		return createTransport(
+			ls.Transport, nil, "", nil, nil, nil, nil, nil, ShellConnTimeouts{}, ConnStderrPatterns{},
+			cachedBusybox(cache, ls), log.NewLogger(log.Error),
+		).(*ShellTransportCustomCmd)
+	}
+
+	assert.False(t, newTransport().params.PrintfMarker)
+
+	err = cache.Set(capabilitiesCacheKey(ls), HostCapabilities{
+		HostVersion: "Linux 6.6.0 x86_64",
+		Busybox:     true,
+		ProbedAt:    time.Now(),
+	})
+	if assert.NoError(t, err) {
+		assert.True(t, newTransport().params.PrintfMarker)
+	}
+}
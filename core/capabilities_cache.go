@@ -0,0 +1,307 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+)
+
+// DefaultCapabilitiesCacheTTL is how long the cached capabilities of a host
+// are used before probing the host again.
+const DefaultCapabilitiesCacheTTL = 24 * time.Hour
+
+// hostVersionPrefix is printed by the bootstrap script, followed by the
+// output of hostVersionCmd; the cached capabilities are only used if it
+// hasn't changed.
+const hostVersionPrefix = "host_version:"
+
+// hostVersionCmd prints the OS and its version; if it changes (e.g. the
+// host was upgraded), we re-probe the host instead of using the cached
+// capabilities.
+const hostVersionCmd = "uname -srm"
+
+// capabilitiesCachedMarker is printed by the bootstrap script instead of
+// running the probes, if the host version matches the cached one.
+const capabilitiesCachedMarker = "capabilities_cached"
+
+// HostCapabilities contains the results of probing a logstream during
+// bootstrap, which can be cached across nerdlog runs: see CapabilitiesCache.
+type HostCapabilities struct {
+	// HostVersion is the output of "uname -srm" on the host.
+	HostVersion string `json:"host_version"`
+
+	// Timezone is the host's timezone, like "UTC" or "Europe/Berlin".
+	Timezone string `json:"timezone"`
+
+	// ExampleLogLines are the lines used to detect the time format of the
+	// logs.
+	ExampleLogLines []string `json:"example_log_lines"`
+
+	// WarnJournalctlNoAdminAccess is the same as in BootstrapDetails.
+	WarnJournalctlNoAdminAccess bool `json:"warn_journalctl_no_admin_access,omitempty"`
+
+	// Busybox is true if the host is busybox-based, like Alpine. Unlike the
+	// rest, it's probed on every bootstrap anyway, but it's cached so that the
+	// next connection can use the busybox-safe handshake right away.
+	Busybox bool `json:"busybox,omitempty"`
+
+	// AWKDialect is the awk dialect of the host; it's empty in the entries
+	// cached by the older versions, which means AWKDialectDefault.
+	AWKDialect AWKDialect `json:"awk_dialect,omitempty"`
+
+	// ProbedAt is when the capabilities were probed; used for the TTL.
+	ProbedAt time.Time `json:"probed_at"`
+}
+
+// CapabilitiesCache stores the HostCapabilities in a JSON file, typically
+// ~/.cache/nerdlog/capabilities.json, so that on the next launch we don't
+// have to probe the hosts again. It's shared between all the LStreamClients,
+// and is safe for concurrent use.
+type CapabilitiesCache struct {
+	params CapabilitiesCacheParams
+
+	mtx sync.Mutex
+
+	// entries is nil until the file is loaded.
+	entries map[string]HostCapabilities
+}
+
+type CapabilitiesCacheParams struct {
+	// Path is the JSON file to store the cache in. The file and its directory
+	// are created as needed.
+	Path string
+
+	// TTL is how long the cached capabilities are valid. If zero,
+	// DefaultCapabilitiesCacheTTL is used.
+	TTL time.Duration
+
+	Clock clock.Clock
+}
+
+func NewCapabilitiesCache(params CapabilitiesCacheParams) *CapabilitiesCache {
+	if params.Clock == nil {
+		panic("Clock is nil")
+	}
+
+	if params.TTL == 0 {
+		params.TTL = DefaultCapabilitiesCacheTTL
+	}
+
+	return &CapabilitiesCache{
+		params: params,
+	}
+}
+
+// Get returns the cached capabilities for the given key, if any, and if they
+// haven't expired yet.
+func (cc *CapabilitiesCache) Get(key string) (HostCapabilities, bool) {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+
+	if cc.entries == nil {
+		entries, err := cc.load()
+		if err != nil {
+			// A broken cache is not a big deal: we'll just probe the hosts and
+			// overwrite it.
+			entries = map[string]HostCapabilities{}
+		}
+		cc.entries = entries
+	}
+
+	caps, ok := cc.entries[key]
+	if !ok {
+		return HostCapabilities{}, false
+	}
+
+	age := cc.params.Clock.Now().Sub(caps.ProbedAt)
+	if age < 0 || age >= cc.params.TTL {
+		return HostCapabilities{}, false
+	}
+
+	return caps, true
+}
+
+// Set stores the capabilities for the given key, and saves the cache file.
+// The file is re-read before saving it, under the file lock (see
+// withFileLock), so that the entries written by other nerdlog instances in
+// the meantime are not lost.
+func (cc *CapabilitiesCache) Set(key string, caps HostCapabilities) error {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+
+	return errors.Trace(withFileLock(cc.params.Path, func() error {
+		entries, err := cc.load()
+		if err != nil {
+			entries = map[string]HostCapabilities{}
+		}
+
+		for k, v := range cc.entries {
+			if _, ok := entries[k]; !ok {
+				entries[k] = v
+			}
+		}
+
+		entries[key] = caps
+		cc.entries = entries
+
+		return errors.Trace(cc.save(entries))
+	}))
+}
+
+// load reads the cache file. If it doesn't exist, an empty map is returned.
+func (cc *CapabilitiesCache) load() (map[string]HostCapabilities, error) {
+	entries := map[string]HostCapabilities{}
+
+	data, err := ioutil.ReadFile(cc.params.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+
+		return nil, errors.Trace(err)
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", cc.params.Path)
+	}
+
+	return entries, nil
+}
+
+// save writes the cache file; see writeFileAtomic.
+func (cc *CapabilitiesCache) save(entries map[string]HostCapabilities) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(writeFileAtomic(cc.params.Path, data))
+}
+
+// writeFileAtomic writes the file atomically: first to a temp file, which is
+// then renamed, so that concurrent readers never see a partially written
+// file. The directory is created if needed.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Annotatef(err, "creating %s", dir)
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Annotatef(err, "writing %s", tmpFile.Name())
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return errors.Annotatef(err, "renaming %s to %s", tmpFile.Name(), path)
+	}
+
+	return nil
+}
+
+// withFileLock calls f while holding the lock (see lockFile) on the lock file
+// next to the given path, so that the read-modify-write cycles of the file
+// by multiple nerdlog instances don't interleave. The lock is taken on a
+// separate file, since the file itself is replaced by writeFileAtomic.
+func withFileLock(path string, f func() error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Annotatef(err, "creating %s", dir)
+	}
+
+	lockPath := path + ".lock"
+	lockFd, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Annotatef(err, "opening %s", lockPath)
+	}
+	defer lockFd.Close()
+
+	if err := lockFile(lockFd); err != nil {
+		return errors.Annotatef(err, "locking %s", lockPath)
+	}
+
+	return f()
+}
+
+// capabilitiesCacheKey returns the key for the capabilities of the given
+// logstream. Besides the host itself, it includes everything which affects
+// the probing results: the log files, sudo mode, locale, shell init
+// commands and the custom agent.
+func capabilitiesCacheKey(ls LogStream) string {
+	var host string
+	switch {
+	case ls.Transport.SSHLib != nil:
+		host = ls.Transport.SSHLib.Host.User + "@" + ls.Transport.SSHLib.Host.Addr
+
+	case ls.Transport.CustomCmd != nil:
+		envKeys := make([]string, 0, len(ls.Transport.CustomCmd.EnvOverride))
+		for k := range ls.Transport.CustomCmd.EnvOverride {
+			envKeys = append(envKeys, k)
+		}
+		sort.Strings(envKeys)
+
+		parts := []string{"custom", ls.Transport.CustomCmd.ShellCommand}
+		for _, k := range envKeys {
+			parts = append(parts, k+"="+ls.Transport.CustomCmd.EnvOverride[k])
+		}
+		host = strings.Join(parts, ":")
+
+	case ls.Transport.Localhost != nil:
+		host = "localhost"
+
+	case ls.Transport.HTTPNDJSON != nil:
+		host = "http-ndjson:" + ls.Transport.HTTPNDJSON.URLTemplate + ":" + ls.Transport.HTTPNDJSON.Host
+
+	case ls.Transport.WinEvent != nil:
+		host = "winevent:" + strings.Join(ls.Transport.WinEvent.LogNames, ",") + ":" + ls.Transport.WinEvent.Host
+
+	case ls.Transport.Console != nil:
+		target := ls.Transport.Console.TelnetAddr
+		if target == "" {
+			target = ls.Transport.Console.SerialDevice
+		}
+		host = "console:" + ls.Transport.Console.User + "@" + target
+	}
+
+	key := host + ":" + strings.Join(ls.LogFiles, ":")
+
+	if ls.Options.SudoMode != "" && ls.Options.SudoMode != SudoModeNone {
+		key += ":sudo=" + string(ls.Options.SudoMode)
+	}
+
+	if ls.Options.Locale != "" && ls.Options.Locale != DefaultLocale {
+		key += ":locale=" + ls.Options.Locale
+	}
+
+	if len(ls.Options.ShellInit) > 0 {
+		sum := sha256.Sum256([]byte(strings.Join(ls.Options.ShellInit, "\n")))
+		key += fmt.Sprintf(":init=%x", sum[:8])
+	}
+
+	if ls.Options.CustomAgent != "" {
+		sum := sha256.Sum256([]byte(ls.Options.CustomAgent))
+		key += fmt.Sprintf(":custom_agent=%x", sum[:8])
+	}
+
+	return key
+}
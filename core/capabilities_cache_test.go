@@ -0,0 +1,199 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCapabilitiesCache(path string, clockMock *clock.Mock) *CapabilitiesCache {
+	return NewCapabilitiesCache(CapabilitiesCacheParams{
+		Path:  path,
+		TTL:   time.Hour,
+		Clock: clockMock,
+	})
+}
+
+func TestCapabilitiesCacheHitMiss(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nerdlog", "capabilities.json")
+	clockMock := clock.NewMock()
+	clockMock.Set(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	cc := newTestCapabilitiesCache(path, clockMock)
+
+	// Missing file is just a miss.
+	_, ok := cc.Get("user@web-01:22:auto")
+	assert.False(t, ok)
+
+	caps := HostCapabilities{
+		HostVersion:     "Linux 6.1.0 x86_64",
+		Timezone:        "Europe/Berlin",
+		ExampleLogLines: []string{"Mar  1 11:59:00 web-01 foo: bar"},
+		ProbedAt:        clockMock.Now(),
+	}
+	assert.NoError(t, cc.Set("user@web-01:22:auto", caps))
+
+	got, ok := cc.Get("user@web-01:22:auto")
+	assert.True(t, ok)
+	assert.Equal(t, caps.HostVersion, got.HostVersion)
+	assert.Equal(t, caps.Timezone, got.Timezone)
+	assert.Equal(t, caps.ExampleLogLines, got.ExampleLogLines)
+
+	_, ok = cc.Get("user@web-02:22:auto")
+	assert.False(t, ok)
+
+	// Another instance (like the next nerdlog run) reads it from the file.
+	cc2 := newTestCapabilitiesCache(path, clockMock)
+	got, ok = cc2.Get("user@web-01:22:auto")
+	assert.True(t, ok)
+	assert.Equal(t, caps.Timezone, got.Timezone)
+}
+
+func TestCapabilitiesCacheTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capabilities.json")
+	clockMock := clock.NewMock()
+	clockMock.Set(time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	cc := newTestCapabilitiesCache(path, clockMock)
+	assert.NoError(t, cc.Set("web-01", HostCapabilities{
+		HostVersion: "Linux 6.1.0 x86_64",
+		ProbedAt:    clockMock.Now(),
+	}))
+
+	clockMock.Add(59 * time.Minute)
+	_, ok := cc.Get("web-01")
+	assert.True(t, ok)
+
+	clockMock.Add(time.Minute)
+	_, ok = cc.Get("web-01")
+	assert.False(t, ok)
+
+	// Entries from the future (e.g. the local clock was adjusted) aren't
+	// trusted either.
+	assert.NoError(t, cc.Set("web-01", HostCapabilities{
+		HostVersion: "Linux 6.1.0 x86_64",
+		ProbedAt:    clockMock.Now().Add(time.Minute),
+	}))
+	_, ok = cc.Get("web-01")
+	assert.False(t, ok)
+}
+
+func TestCapabilitiesCacheBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capabilities.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{not json"), 0644))
+
+	clockMock := clock.NewMock()
+	cc := newTestCapabilitiesCache(path, clockMock)
+
+	_, ok := cc.Get("web-01")
+	assert.False(t, ok)
+
+	// And it gets overwritten.
+	assert.NoError(t, cc.Set("web-01", HostCapabilities{ProbedAt: clockMock.Now()}))
+	_, ok = newTestCapabilitiesCache(path, clockMock).Get("web-01")
+	assert.True(t, ok)
+}
+
+func TestCapabilitiesCacheConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capabilities.json")
+	clockMock := clock.NewMock()
+
+	// Two instances sharing the same file, like two nerdlog processes.
+	caches := []*CapabilitiesCache{
+		newTestCapabilitiesCache(path, clockMock),
+		newTestCapabilitiesCache(path, clockMock),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			cc := caches[i%2]
+			key := fmt.Sprintf("web-%02d", i)
+			assert.NoError(t, cc.Set(key, HostCapabilities{
+				HostVersion: "Linux",
+				ProbedAt:    clockMock.Now(),
+			}))
+			_, ok := cc.Get(key)
+			assert.True(t, ok, key)
+		}(i)
+	}
+	wg.Wait()
+
+	// The file is locked while it's re-read and written, so nothing gets
+	// lost.
+	cc := newTestCapabilitiesCache(path, clockMock)
+	for i := 0; i < 20; i++ {
+		_, ok := cc.Get(fmt.Sprintf("web-%02d", i))
+		assert.True(t, ok, i)
+	}
+}
+
+func TestCapabilitiesCacheMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capabilities.json")
+	clockMock := clock.NewMock()
+
+	// Two instances sharing the same file, like two nerdlog processes: the
+	// file is re-read before writing, so entries of one aren't overwritten by
+	// the other.
+	cc1 := newTestCapabilitiesCache(path, clockMock)
+	cc2 := newTestCapabilitiesCache(path, clockMock)
+
+	_, ok := cc2.Get("web-01")
+	assert.False(t, ok)
+
+	assert.NoError(t, cc1.Set("web-01", HostCapabilities{ProbedAt: clockMock.Now()}))
+	assert.NoError(t, cc2.Set("web-02", HostCapabilities{ProbedAt: clockMock.Now()}))
+
+	cc3 := newTestCapabilitiesCache(path, clockMock)
+	_, ok = cc3.Get("web-01")
+	assert.True(t, ok)
+	_, ok = cc3.Get("web-02")
+	assert.True(t, ok)
+}
+
+func TestCapabilitiesCacheKey(t *testing.T) {
+	ls := LogStream{
+		Transport: ConfigLogStreamShellTransport{
+			SSHLib: &ConfigLogStreamShellTransportSSHLib{
+				Host: ConfigHost{Addr: "web-01:22", User: "user"},
+			},
+		},
+		LogFiles: []string{"/var/log/syslog", "/var/log/syslog.1"},
+	}
+
+	assert.Equal(t, "user@web-01:22:/var/log/syslog:/var/log/syslog.1", capabilitiesCacheKey(ls))
+
+	// Everything which affects the probes results in a different key.
+	lsSudo := ls
+	lsSudo.Options.SudoMode = SudoModeFull
+	assert.Equal(t, "user@web-01:22:/var/log/syslog:/var/log/syslog.1:sudo=full", capabilitiesCacheKey(lsSudo))
+
+	lsInit := ls
+	lsInit.Options.ShellInit = []string{"export TZ=UTC"}
+	assert.NotEqual(t, capabilitiesCacheKey(ls), capabilitiesCacheKey(lsInit))
+
+	// The default locale is the same as not specifying it.
+	lsLocale := ls
+	lsLocale.Options.Locale = DefaultLocale
+	assert.Equal(t, capabilitiesCacheKey(ls), capabilitiesCacheKey(lsLocale))
+	lsLocale.Options.Locale = LocaleNone
+	assert.Equal(t, "user@web-01:22:/var/log/syslog:/var/log/syslog.1:locale=none", capabilitiesCacheKey(lsLocale))
+
+	lsCustom := ls
+	lsCustom.Transport = ConfigLogStreamShellTransport{
+		CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+			ShellCommand: "/bin/sh",
+			EnvOverride:  map[string]string{"NLPORT": "22", "NLHOST": "web-01"},
+		},
+	}
+	assert.Equal(t, "custom:/bin/sh:NLHOST=web-01:NLPORT=22:/var/log/syslog:/var/log/syslog.1", capabilitiesCacheKey(lsCustom))
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ClockSkewWarnThreshold is the max difference between the remote host's
+// clock and the local one which doesn't cause a warning. Since the remote
+// time is only printed with the 1s precision, and it takes some time to
+// deliver it, small differences are expected anyway.
+const ClockSkewWarnThreshold = 30 * time.Second
+
+// hostTimePrefix is the prefix of the line printed during bootstrap, with
+// the remote host's unix timestamp: "host_time:1700000000".
+const hostTimePrefix = "host_time:"
+
+// parseHostTime parses the line like "host_time:1700000000" and returns the
+// remote time.
+func parseHostTime(line string) (time.Time, error) {
+	if !strings.HasPrefix(line, hostTimePrefix) {
+		return time.Time{}, errors.Errorf("no %q prefix", hostTimePrefix)
+	}
+
+	tsStr := strings.TrimPrefix(line, hostTimePrefix)
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Annotatef(err, "parsing host time %q", tsStr)
+	}
+
+	return time.Unix(ts, 0), nil
+}
+
+// calcClockSkew returns how much the remote clock is ahead of the local one
+// (negative if it's behind). Since the remote time only has the 1s precision,
+// the local time is truncated to seconds as well.
+func calcClockSkew(remoteTime, localTime time.Time) time.Duration {
+	return remoteTime.Sub(localTime.Truncate(time.Second))
+}
+
+// isClockSkewTooLarge returns whether the skew exceeds ClockSkewWarnThreshold
+// in either direction.
+func isClockSkewTooLarge(skew time.Duration) bool {
+	return skew > ClockSkewWarnThreshold || skew < -ClockSkewWarnThreshold
+}
+
+// FormatClockSkew returns a human-readable message like
+// "web-03 clock is +47s vs local".
+func FormatClockSkew(lstreamName string, skew time.Duration) string {
+	sign := "+"
+	if skew < 0 {
+		sign = "-"
+		skew = -skew
+	}
+
+	return fmt.Sprintf("%s clock is %s%s vs local", lstreamName, sign, skew.Round(time.Second))
+}
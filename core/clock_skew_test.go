@@ -0,0 +1,54 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostTime(t *testing.T) {
+	hostTime, err := parseHostTime("host_time:1700000047")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000047), hostTime.Unix())
+
+	_, err = parseHostTime("host_time:")
+	assert.Error(t, err)
+
+	_, err = parseHostTime("host_time:abc")
+	assert.Error(t, err)
+
+	_, err = parseHostTime("host_timezone:UTC")
+	assert.Error(t, err)
+}
+
+func TestCalcClockSkew(t *testing.T) {
+	clockMock := clock.NewMock()
+	clockMock.Set(time.Unix(1700000000, 600*int64(time.Millisecond)))
+
+	testCases := []struct {
+		line      string
+		wantSkew  time.Duration
+		wantLarge bool
+		wantMsg   string
+	}{
+		{"host_time:1700000047", 47 * time.Second, true, "web-03 clock is +47s vs local"},
+		{"host_time:1699999835", -165 * time.Second, true, "web-03 clock is -2m45s vs local"},
+		{"host_time:1700000000", 0, false, "web-03 clock is +0s vs local"},
+		{"host_time:1700000001", time.Second, false, "web-03 clock is +1s vs local"},
+		{"host_time:1699999970", -30 * time.Second, false, "web-03 clock is -30s vs local"},
+	}
+
+	for i, tc := range testCases {
+		hostTime, err := parseHostTime(tc.line)
+		if !assert.NoError(t, err, "test case %d", i) {
+			continue
+		}
+
+		skew := calcClockSkew(hostTime, clockMock.Now())
+		assert.Equal(t, tc.wantSkew, skew, "test case %d", i)
+		assert.Equal(t, tc.wantLarge, isClockSkewTooLarge(skew), "test case %d", i)
+		assert.Equal(t, tc.wantMsg, FormatClockSkew("web-03", skew), "test case %d", i)
+	}
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+)
+
+const (
+	ColumnFieldTime    = "time"
+	ColumnFieldLStream = "lstream"
+	ColumnFieldLevel   = "level"
+	ColumnFieldMsg     = "msg"
+	ColumnFieldLabels  = "labels"
+
+	// ColumnFieldMessage is an alias of ColumnFieldMsg, since that's how the
+	// column is called in the UI.
+	ColumnFieldMessage = "message"
+)
+
+// columnEllipsis is appended to the truncated column values.
+const columnEllipsis = "…"
+
+// Column is a single column of the logs layout; see Columns.
+type Column struct {
+	// Field is what the column shows: one of the ColumnField* constants, or
+	// any other field of the log message, e.g. the one extracted by the
+	// field extractors, or a logstream label.
+	Field string `yaml:"field"`
+
+	// Title, if not empty, is shown in the header instead of the Field.
+	Title string `yaml:"title,omitempty"`
+
+	// Width, if not zero, is the fixed width of the column in the UI table:
+	// the shorter values are padded, and the longer ones are cut. It doesn't
+	// affect the CSV export, which has no notion of width.
+	Width int `yaml:"width,omitempty"`
+
+	// Truncate, if not zero, is the max number of characters of the values;
+	// the longer ones are cut, ending with "…". Unlike Width, it affects the
+	// CSV export as well.
+	Truncate int `yaml:"truncate,omitempty"`
+}
+
+// Columns is the ordered list of columns, typically coming from the
+// "columns" section of the config, which defines the layout of both the UI
+// table and the CSV export, e.g. to have the logstream first and the message
+// truncated. If empty, the default layout is used.
+type Columns []Column
+
+// Validate returns an error if some of the columns are invalid.
+func (cols Columns) Validate() error {
+	seen := make(map[string]struct{}, len(cols))
+
+	for i, col := range cols {
+		if col.Field == "" {
+			return errors.Errorf("column #%d: field is required", i)
+		}
+
+		if col.Width < 0 || col.Truncate < 0 {
+			return errors.Errorf("column %s: width and truncate can't be negative", col.Field)
+		}
+
+		field := col.normalizedField()
+		if _, ok := seen[field]; ok {
+			return errors.Errorf("column %s is specified more than once", col.Field)
+		}
+		seen[field] = struct{}{}
+	}
+
+	return nil
+}
+
+// Header returns the titles of the columns.
+func (cols Columns) Header() []string {
+	ret := make([]string, 0, len(cols))
+	for _, col := range cols {
+		ret = append(ret, col.GetTitle())
+	}
+
+	return ret
+}
+
+// Row returns the values of the columns for the given message, truncated as
+// per the Truncate; the time is formatted like in the JSON export.
+func (cols Columns) Row(msg LogMsg) []string {
+	ret := make([]string, 0, len(cols))
+	for _, col := range cols {
+		ret = append(ret, TruncateColumnValue(col.Value(msg), col.Truncate))
+	}
+
+	return ret
+}
+
+// GetTitle returns the Title, or the Field if the Title is empty.
+func (col Column) GetTitle() string {
+	if col.Title != "" {
+		return col.Title
+	}
+
+	return col.Field
+}
+
+// Value returns the full value of the column for the given message, not
+// truncated yet; empty if the message doesn't have the field.
+func (col Column) Value(msg LogMsg) string {
+	switch col.normalizedField() {
+	case ColumnFieldTime:
+		return msg.Time.Format(exportTimeLayout)
+	case ColumnFieldLevel:
+		return string(msg.Level)
+	case ColumnFieldMsg:
+		return msg.Msg
+	case ColumnFieldLabels:
+		return formatLStreamLabels(msg.Labels)
+	default:
+		// The lstream and the labels are in the context too.
+		return msg.Context[col.Field]
+	}
+}
+
+func (col Column) normalizedField() string {
+	if col.Field == ColumnFieldMessage {
+		return ColumnFieldMsg
+	}
+
+	return col.Field
+}
+
+// TruncateColumnValue returns the value cut to at most maxLen characters,
+// ending with "…" if it was cut; if maxLen is zero, the value is returned
+// as is.
+func TruncateColumnValue(s string, maxLen int) string {
+	if maxLen <= 0 || utf8.RuneCountInString(s) <= maxLen {
+		return s
+	}
+
+	var sb strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == maxLen-1 {
+			break
+		}
+
+		sb.WriteRune(r)
+		n++
+	}
+	sb.WriteString(columnEllipsis)
+
+	return sb.String()
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateColumnValue(t *testing.T) {
+	assert.Equal(t, "hello world", TruncateColumnValue("hello world", 0))
+	assert.Equal(t, "hello world", TruncateColumnValue("hello world", 11))
+	assert.Equal(t, "hello wor…", TruncateColumnValue("hello world", 10))
+	assert.Equal(t, "…", TruncateColumnValue("hello world", 1))
+
+	// The length is in characters, not bytes.
+	assert.Equal(t, "привет", TruncateColumnValue("привет", 6))
+	assert.Equal(t, "при…", TruncateColumnValue("привет", 4))
+}
+
+func TestColumnsValidate(t *testing.T) {
+	assert.NoError(t, Columns{{Field: "time"}, {Field: "msg", Truncate: 80}, {Field: "region"}}.Validate())
+
+	for _, tc := range []struct {
+		cols    Columns
+		wantErr string
+	}{
+		{Columns{{Title: "foo"}}, "column #0: field is required"},
+		{Columns{{Field: "msg", Width: -1}}, "column msg: width and truncate can't be negative"},
+		{Columns{{Field: "time"}, {Field: "time"}}, "column time is specified more than once"},
+		{Columns{{Field: "msg"}, {Field: "message"}}, "column message is specified more than once"},
+	} {
+		err := tc.cols.Validate()
+		if assert.Error(t, err) {
+			assert.Equal(t, tc.wantErr, err.Error())
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// maxExpandedLogStreams is the max number of logstreams a single pattern in
+// the config can expand to; it's here to catch typos like [1-100000].
+const maxExpandedLogStreams = 10000
+
+var numericRangeRegex = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+// hostnameNamePlaceholder can be used in the Hostname of a templated
+// logstream entry, and is replaced with the expanded logstream name.
+const hostnameNamePlaceholder = "{name}"
+
+// ExpandConfigLogStreams expands the templated logstream entries, i.e. the
+// ones whose keys contain patterns, into multiple concrete entries. Supported
+// patterns are:
+//
+//   - Numeric ranges like "web-[1-50]"; if the first number has leading zeros,
+//     all numbers are zero-padded to the same width: "web-[01-50]" expands to
+//     "web-01", ..., "web-50";
+//   - Brace alternation like "web-{a,b,c}"; alternatives can contain further
+//     patterns, like "{web-[1-3],db}".
+//
+// Multiple patterns in a key expand to all the combinations. Every expanded
+// entry is a copy of the template; if the template's Hostname (or the host in
+// its ssh block) contains "{name}", it's replaced with the expanded name.
+//
+// If some name is produced by more than one entry, it's an error.
+func ExpandConfigLogStreams(cfg ConfigLogStreams) (ConfigLogStreams, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	ret := make(ConfigLogStreams, len(cfg))
+	sources := make(map[string]string, len(cfg))
+
+	for _, key := range cfg.Keys() {
+		cls := cfg[key]
+
+		names, err := expandLogStreamPattern(key)
+		if err != nil {
+			return nil, errors.Annotatef(err, "expanding %q", key)
+		}
+
+		for _, name := range names {
+			if src, ok := sources[name]; ok {
+				return nil, errors.Errorf(
+					"logstream %q is defined by both %q and %q", name, src, key,
+				)
+			}
+			sources[name] = key
+
+			expanded := cls
+			expanded.Hostname = strings.Replace(cls.Hostname, hostnameNamePlaceholder, name, -1)
+			if cls.SSH != nil {
+				sshBlock := *cls.SSH
+				sshBlock.Host = strings.Replace(sshBlock.Host, hostnameNamePlaceholder, name, -1)
+				expanded.SSH = &sshBlock
+			}
+			ret[name] = expanded
+		}
+	}
+
+	return ret, nil
+}
+
+// expandLogStreamPattern expands the given pattern into the list of names;
+// see ExpandConfigLogStreams for the syntax. Brackets which don't contain a
+// numeric range (like in IPv6 addresses) and braces without commas are left
+// as is; if there are no patterns, the only returned name is the pattern
+// itself.
+func expandLogStreamPattern(pattern string) ([]string, error) {
+	for i := 0; i < len(pattern); i++ {
+		var (
+			variants []string
+			end      int
+		)
+
+		switch pattern[i] {
+		case '[':
+			end = strings.IndexRune(pattern[i:], ']')
+			if end < 0 || !numericRangeRegex.MatchString(pattern[i+1:i+end]) {
+				continue
+			}
+			end += i
+
+			var err error
+			variants, err = expandNumericRange(pattern[i+1 : end])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+		case '{':
+			end = findClosingBrace(pattern, i)
+			if end < 0 {
+				continue
+			}
+
+			alts := splitAlternatives(pattern[i+1 : end])
+			if len(alts) < 2 {
+				continue
+			}
+
+			for _, alt := range alts {
+				altVariants, err := expandLogStreamPattern(alt)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+
+				variants = append(variants, altVariants...)
+			}
+
+		default:
+			continue
+		}
+
+		restVariants, err := expandLogStreamPattern(pattern[end+1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if len(variants)*len(restVariants) > maxExpandedLogStreams {
+			return nil, errors.Errorf("too many combinations, max is %d", maxExpandedLogStreams)
+		}
+
+		prefix := pattern[:i]
+		ret := make([]string, 0, len(variants)*len(restVariants))
+		for _, v := range variants {
+			for _, r := range restVariants {
+				ret = append(ret, prefix+v+r)
+			}
+		}
+
+		return ret, nil
+	}
+
+	return []string{pattern}, nil
+}
+
+// expandNumericRange expands the range like "01-50" (without the brackets).
+func expandNumericRange(rng string) ([]string, error) {
+	parts := strings.Split(rng, "-")
+
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid range [%s]", rng)
+	}
+
+	to, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid range [%s]", rng)
+	}
+
+	if from > to {
+		return nil, errors.Errorf("invalid range [%s]: %d is greater than %d", rng, from, to)
+	}
+
+	if to-from >= maxExpandedLogStreams {
+		return nil, errors.Errorf("range [%s] is too large, max is %d items", rng, maxExpandedLogStreams)
+	}
+
+	width := 0
+	if len(parts[0]) > 1 && parts[0][0] == '0' {
+		width = len(parts[0])
+	}
+
+	ret := make([]string, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		s := strconv.Itoa(i)
+		if len(s) < width {
+			s = strings.Repeat("0", width-len(s)) + s
+		}
+
+		ret = append(ret, s)
+	}
+
+	return ret, nil
+}
+
+// findClosingBrace returns the index of the "}" matching the "{" at
+// s[start], or -1 if there's none.
+func findClosingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// splitAlternatives splits the contents of the brace alternation by the
+// top-level commas.
+func splitAlternatives(s string) []string {
+	var ret []string
+
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				ret = append(ret, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(ret, s[start:])
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandLogStreamPattern(t *testing.T) {
+	type testCase struct {
+		pattern string
+		want    []string
+		wantErr string
+	}
+
+	testCases := []testCase{
+		{
+			pattern: "web-01",
+			want:    []string{"web-01"},
+		},
+		{
+			pattern: "web-[1-3]",
+			want:    []string{"web-1", "web-2", "web-3"},
+		},
+		{
+			// Zero-padding to the width of the first number.
+			pattern: "web-[08-11]",
+			want:    []string{"web-08", "web-09", "web-10", "web-11"},
+		},
+		{
+			pattern: "web-[098-100].example",
+			want:    []string{"web-098.example", "web-099.example", "web-100.example"},
+		},
+		{
+			// No padding if the first number has no leading zeros.
+			pattern: "web-[9-10]",
+			want:    []string{"web-9", "web-10"},
+		},
+		{
+			pattern: "{web,db}-{a,b}",
+			want:    []string{"web-a", "web-b", "db-a", "db-b"},
+		},
+		{
+			// Nested patterns.
+			pattern: "{web-[1-2],db-{x,y},cache}-eu",
+			want:    []string{"web-1-eu", "web-2-eu", "db-x-eu", "db-y-eu", "cache-eu"},
+		},
+		{
+			pattern: "host[1-2]-[01-02]",
+			want:    []string{"host1-01", "host1-02", "host2-01", "host2-02"},
+		},
+		{
+			// Not patterns, left as is.
+			pattern: "user@[::1]:22",
+			want:    []string{"user@[::1]:22"},
+		},
+		{
+			pattern: "foo{bar}[1-",
+			want:    []string{"foo{bar}[1-"},
+		},
+		{
+			pattern: "web-[5-1]",
+			wantErr: "invalid range [5-1]: 5 is greater than 1",
+		},
+		{
+			pattern: "web-[1-100000]",
+			wantErr: "range [1-100000] is too large, max is 10000 items",
+		},
+		{
+			pattern: "web-[1-1000]-[1-1000]",
+			wantErr: "too many combinations, max is 10000",
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := expandLogStreamPattern(tc.pattern)
+		if tc.wantErr != "" {
+			if assert.Error(t, err, tc.pattern) {
+				assert.Equal(t, tc.wantErr, err.Error(), tc.pattern)
+			}
+			continue
+		}
+
+		if assert.NoError(t, err, tc.pattern) {
+			assert.Equal(t, tc.want, got, tc.pattern)
+		}
+	}
+}
+
+func TestExpandConfigLogStreams(t *testing.T) {
+	cfg, err := ExpandConfigLogStreams(ConfigLogStreams{
+		"web-[01-03]": {
+			Hostname: "{name}.example.com",
+			LogFiles: []string{"/var/log/nginx/access.log"},
+			Options:  ConfigLogStreamOptions{Transport: "ssh-bin"},
+		},
+		"db-{a,b}": {
+			User: "postgres",
+		},
+		"other": {
+			Hostname: "other.example.com",
+		},
+		"cache-[1-2]": {
+			SSH: &ConfigLogStreamSSH{Host: "{name}.internal", User: "redis"},
+		},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"cache-1", "cache-2", "db-a", "db-b", "other", "web-01", "web-02", "web-03",
+		}, cfg.Keys())
+
+		assert.Equal(t, ConfigLogStream{
+			Hostname: "web-02.example.com",
+			LogFiles: []string{"/var/log/nginx/access.log"},
+			Options:  ConfigLogStreamOptions{Transport: "ssh-bin"},
+		}, cfg["web-02"])
+		assert.Equal(t, ConfigLogStream{User: "postgres"}, cfg["db-b"])
+		assert.Equal(t, "other.example.com", cfg["other"].Hostname)
+
+		// Every entry has its own copy of the ssh block.
+		assert.Equal(t, &ConfigLogStreamSSH{Host: "cache-1.internal", User: "redis"}, cfg["cache-1"].SSH)
+		assert.Equal(t, &ConfigLogStreamSSH{Host: "cache-2.internal", User: "redis"}, cfg["cache-2"].SSH)
+	}
+
+	_, err = ExpandConfigLogStreams(ConfigLogStreams{
+		"web-[01-03]": {},
+		"web-02":      {},
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, `logstream "web-02" is defined by both "web-02" and "web-[01-03]"`, err.Error())
+	}
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/shellescape"
+	"github.com/juju/errors"
+)
+
+// sshOptionsWithFields are the lowercased ssh options which have dedicated
+// fields in ConfigLogStreamSSH (or ConfigLogStream), so they can't be set in
+// ConfigLogStreamSSH.Options.
+var sshOptionsWithFields = map[string]string{
+	"hostname":     "host",
+	"port":         "port",
+	"user":         "user",
+	"proxyjump":    "jump",
+	"identityfile": "identity_file",
+	"batchmode":    "batch_mode",
+}
+
+// applySSHBlock moves the connection details from the ssh block of the
+// logstream config (if any) to the respective top-level fields, so that the
+// rest of the resolver doesn't have to care where they came from, and
+// validates the rest of the block. The key is only used in the error messages.
+func applySSHBlock(key string, cls *ConfigLogStream) error {
+	if cls.SSH == nil {
+		return nil
+	}
+
+	for _, f := range []struct {
+		name     string
+		topName  string
+		blockVal string
+		topVal   *string
+	}{
+		{"host", "hostname", cls.SSH.Host, &cls.Hostname},
+		{"port", "port", cls.SSH.Port, &cls.Port},
+		{"user", "user", cls.SSH.User, &cls.User},
+		{"jump", "jump", cls.SSH.Jump, &cls.Jump},
+	} {
+		if f.blockVal == "" {
+			continue
+		}
+
+		if *f.topVal != "" {
+			return errors.Errorf("%s: ssh.%s and %s can't be used together", key, f.name, f.topName)
+		}
+
+		*f.topVal = f.blockVal
+	}
+
+	if err := validateSSHOptions(cls.SSH.Options); err != nil {
+		return errors.Annotatef(err, "%s", key)
+	}
+
+	return nil
+}
+
+// validateSSHOptions checks that the options are valid ssh options (see
+// ConfigLogStreamSSH.Options).
+func validateSSHOptions(options map[string]string) error {
+	for _, k := range sortedSSHOptionKeys(options) {
+		v := options[k]
+		if k == "" {
+			return errors.Errorf("empty ssh option name")
+		}
+
+		for _, r := range k {
+			if !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+				return errors.Errorf("invalid ssh option name %q", k)
+			}
+		}
+
+		if field, ok := sshOptionsWithFields[strings.ToLower(k)]; ok {
+			return errors.Errorf("ssh option %s can't be set in ssh.options, use ssh.%s instead", k, field)
+		}
+
+		if v == "" || strings.ContainsAny(v, "\r\n") {
+			return errors.Errorf("invalid value %q of ssh option %s", v, k)
+		}
+	}
+
+	return nil
+}
+
+// needsSSHBin returns whether the ssh block has any options which only the
+// ssh binary understands.
+func (s *ConfigLogStreamSSH) needsSSHBin() bool {
+	return s != nil && (len(s.Options) > 0 || s.BatchMode != nil)
+}
+
+// checkSSHBlockTransport returns an error if the ssh block has some fields
+// which the given transport doesn't support. The name is only used in the
+// error messages.
+func checkSSHBlockTransport(name string, s *ConfigLogStreamSSH, kind TransportModeKind) error {
+	if s == nil {
+		return nil
+	}
+
+	switch kind {
+	case TransportModeKindSSHBin:
+		return nil
+
+	case TransportModeKindAuto:
+		// Falls back to ssh-bin if needed; see the resolver.
+		return nil
+
+	case TransportModeKindSSHLib:
+		if s.needsSSHBin() {
+			return errors.Errorf(
+				"%s: ssh.options and ssh.batch_mode are only supported by the ssh-bin transport", name,
+			)
+		}
+
+		return nil
+	}
+
+	if s.IdentityFile != "" || s.needsSSHBin() {
+		return errors.Errorf(
+			"%s: ssh.identity_file, ssh.options and ssh.batch_mode are not supported by the %s transport",
+			name, kind,
+		)
+	}
+
+	return nil
+}
+
+// sshBinShellCommand returns the ssh-bin shell command (in the same format as
+// DefaultSSHShellCommand) with the options from the ssh block.
+func sshBinShellCommand(s *ConfigLogStreamSSH) string {
+	batchMode := "yes"
+	if s.BatchMode != nil && !*s.BatchMode {
+		batchMode = "no"
+	}
+
+	parts := []string{"ssh", "-o", "BatchMode=" + batchMode}
+
+	if s.IdentityFile != "" {
+		parts = append(parts, "-i", expandHomeDir(s.IdentityFile))
+	}
+
+	for _, k := range sortedSSHOptionKeys(s.Options) {
+		parts = append(parts, "-o", k+"="+s.Options[k])
+	}
+
+	return shellescape.Escape(parts) + " " + sshBinDestArgs
+}
+
+func sortedSSHOptionKeys(options map[string]string) []string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// expandHomeDir replaces the leading "~/" in the path with the home dir of the
+// current user. If the home dir is unknown, the path is returned as is.
+func expandHomeDir(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(homeDir, path[2:])
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Sentinel errors for the common failure modes, so that the client code can
+// react to them without matching the error messages, like:
+// errors.Is(err, ErrAuthFailed). The errors returned by the transports and
+// the bootstrap are wrapped into these, and the connection errors in the
+// FleetSummary (see FleetSummary.Err) match them too.
+var (
+	ErrConnectTimeout  = errors.New("connection timed out")
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrHostUnreachable = errors.New("host is unreachable")
+
+	// ErrShellNotFound means that the shell couldn't be started, e.g. because
+	// the ssh binary (or the custom shell command) doesn't exist.
+	ErrShellNotFound = errors.New("shell not found")
+
+	// ErrMarkerNotReceived means that the shell has started, but the
+	// connection marker never showed up in its output, which typically means
+	// that the shell is misconfigured.
+	ErrMarkerNotReceived = errors.New("connection marker not received")
+
+	// ErrAgentMissing means that the nerdlog_agent.sh couldn't be uploaded to
+	// the host, or it has disappeared after the bootstrap (e.g. /tmp was
+	// cleaned up).
+	ErrAgentMissing = errors.New("agent script is missing")
+)
+
+// Sentinel errors for the rest of the connection error categories. ErrDNS
+// and ErrRefused are the more specific versions of ErrHostUnreachable, so
+// the errors matching them match ErrHostUnreachable as well.
+var (
+	ErrDNS       = errors.New("failed to resolve host")
+	ErrRefused   = errors.New("connection refused")
+	ErrBootstrap = errors.New("bootstrap failed")
+)
+
+// connErrCategorySentinels contains the sentinel errors matched by the errors
+// of every category.
+var connErrCategorySentinels = map[ConnErrCategory][]error{
+	ConnErrCategoryAuth:          {ErrAuthFailed},
+	ConnErrCategoryDNS:           {ErrDNS, ErrHostUnreachable},
+	ConnErrCategoryUnreachable:   {ErrHostUnreachable},
+	ConnErrCategoryTimeout:       {ErrConnectTimeout},
+	ConnErrCategoryRefused:       {ErrRefused, ErrHostUnreachable},
+	ConnErrCategoryShellNotFound: {ErrShellNotFound},
+	ConnErrCategoryNoMarker:      {ErrMarkerNotReceived},
+	ConnErrCategoryBootstrap:     {ErrBootstrap},
+	ConnErrCategoryAgentMissing:  {ErrAgentMissing, ErrBootstrap},
+}
+
+// isConnErrCategorySentinel returns true if the target is one of the sentinel
+// errors matched by the errors of the given category.
+func isConnErrCategorySentinel(category ConnErrCategory, target error) bool {
+	for _, sentinel := range connErrCategorySentinels[category] {
+		if target == sentinel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// classifiedError is an error of a known category; the message and the
+// wrapped error are the same as of the original error, but errors.Is also
+// matches the sentinel errors of the category (see connErrCategorySentinels).
+type classifiedError struct {
+	category ConnErrCategory
+	err      error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return isConnErrCategorySentinel(e.category, target)
+}
+
+// classifyErr wraps the error into a classifiedError of the given category.
+// If err is nil, returns nil.
+func classifyErr(category ConnErrCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &classifiedError{category: category, err: err}
+}
+
+// classifyConnErr is like classifyErr, but the category is determined from
+// the error message (see CategorizeConnErr). If the error is already
+// classified, or the category is unknown, the error is returned as is.
+func classifyConnErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	category := CategorizeConnErr(err.Error())
+	if category == ConnErrCategoryOther {
+		return err
+	}
+
+	return classifyErr(category, err)
+}
+
+// connErrCategoryOf returns the category of the given error: if it was
+// classified by the transport, then this category, otherwise it's
+// determined from the error message.
+func connErrCategoryOf(err error) ConnErrCategory {
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.category
+	}
+
+	return CategorizeConnErr(err.Error())
+}
+
+// LStreamConnError is a connection (or bootstrap) error of a single
+// logstream.
+type LStreamConnError struct {
+	LStreamName string
+	Category    ConnErrCategory
+	Err         error
+}
+
+func (e *LStreamConnError) Error() string {
+	return fmt.Sprintf("%s: %s", e.LStreamName, e.Err.Error())
+}
+
+func (e *LStreamConnError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if the target is one of the sentinel errors for the
+// category of this error, e.g. ErrAuthFailed for ConnErrCategoryAuth.
+func (e *LStreamConnError) Is(target error) bool {
+	return isConnErrCategorySentinel(e.Category, target)
+}
+
+// MultiConnError contains connection errors of multiple logstreams, sorted by
+// the logstream name, so that the error message is deterministic.
+type MultiConnError struct {
+	Errs []*LStreamConnError
+}
+
+// NewMultiConnError creates a MultiConnError from the given errors; it sorts
+// them by the logstream name. If errs is empty, returns nil.
+func NewMultiConnError(errs []*LStreamConnError) *MultiConnError {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	sorted := make([]*LStreamConnError, len(errs))
+	copy(sorted, errs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LStreamName < sorted[j].LStreamName
+	})
+
+	return &MultiConnError{Errs: sorted}
+}
+
+// Error returns a multi-line message like this:
+//
+//	2 logstreams failed to connect:
+//	  host1: ssh: unable to authenticate
+//	  host2: dial tcp: i/o timeout
+func (e *MultiConnError) Error() string {
+	var sb strings.Builder
+
+	noun := "logstreams"
+	if len(e.Errs) == 1 {
+		noun = "logstream"
+	}
+
+	fmt.Fprintf(&sb, "%d %s failed to connect:", len(e.Errs), noun)
+	for _, lsErr := range e.Errs {
+		sb.WriteString("\n  ")
+		sb.WriteString(lsErr.Error())
+	}
+
+	return sb.String()
+}
+
+// Unwrap returns all the logstream errors; it's used by errors.Is and
+// errors.As on Go 1.20+.
+func (e *MultiConnError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errs))
+	for _, lsErr := range e.Errs {
+		errs = append(errs, lsErr)
+	}
+
+	return errs
+}
+
+// Is returns true if any of the logstream errors matches the target; so e.g.
+// errors.Is(err, ErrAuthFailed) returns true if at least one logstream has
+// failed to authenticate.
+func (e *MultiConnError) Is(target error) bool {
+	for _, lsErr := range e.Errs {
+		if errors.Is(lsErr, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Err returns the *MultiConnError with the errors of all the failed
+// logstreams, or nil if there are none.
+func (fs FleetSummary) Err() error {
+	var errs []*LStreamConnError
+	for category, names := range fs.FailedByCategory {
+		for _, name := range names {
+			errs = append(errs, &LStreamConnError{
+				LStreamName: name,
+				Category:    category,
+				Err:         errors.New(fs.ErrByLStream[name]),
+			})
+		}
+	}
+
+	// Avoid returning a typed nil.
+	if multiErr := NewMultiConnError(errs); multiErr != nil {
+		return multiErr
+	}
+
+	return nil
+}
+
+// agentUploadFailedMarker is printed by the bootstrap script if the
+// nerdlog_agent.sh couldn't be written on the host.
+const agentUploadFailedMarker = "agent_upload_failed"
+
+// isAgentMissingExit returns true if the agent couldn't be run because the
+// script at agentPath doesn't exist: in this case, bash exits with the code
+// 127 and prints an error like "bash: /path/to/agent.sh: No such file or
+// directory". The same code is used when some command invoked by the agent
+// isn't found, so the message is checked too.
+func isAgentMissingExit(agentPath, exitCode string, stderr []string) bool {
+	if exitCode != "127" {
+		return false
+	}
+
+	for _, line := range stderr {
+		if strings.Contains(line, agentPath+": No such file or directory") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiConnErrorOrdering(t *testing.T) {
+	errs := []*LStreamConnError{
+		{LStreamName: "host-c", Category: ConnErrCategoryTimeout, Err: errors.New("i/o timeout")},
+		{LStreamName: "host-a", Category: ConnErrCategoryAuth, Err: errors.New("permission denied")},
+		{LStreamName: "host-b", Category: ConnErrCategoryRefused, Err: errors.New("connection refused")},
+	}
+
+	want := "3 logstreams failed to connect:\n" +
+		"  host-a: permission denied\n" +
+		"  host-b: connection refused\n" +
+		"  host-c: i/o timeout"
+
+	assert.Equal(t, want, NewMultiConnError(errs).Error())
+
+	// Reversing the input doesn't change anything.
+	reversed := []*LStreamConnError{errs[2], errs[1], errs[0]}
+	assert.Equal(t, want, NewMultiConnError(reversed).Error())
+
+	// The input slice is left intact.
+	assert.Equal(t, "host-c", errs[0].LStreamName)
+
+	assert.Nil(t, NewMultiConnError(nil))
+}
+
+func TestMultiConnErrorIs(t *testing.T) {
+	err := error(NewMultiConnError([]*LStreamConnError{
+		{LStreamName: "host-a", Category: ConnErrCategoryOther, Err: errors.New("something")},
+		{LStreamName: "host-b", Category: ConnErrCategoryAuth, Err: errors.New("unable to authenticate")},
+	}))
+
+	assert.True(t, errors.Is(err, ErrAuthFailed))
+	assert.False(t, errors.Is(err, ErrConnectTimeout))
+	assert.False(t, errors.Is(err, ErrDNS))
+
+	// Still works after annotating.
+	annotated := errors.Annotatef(err, "connecting")
+	assert.True(t, errors.Is(annotated, ErrAuthFailed))
+	assert.False(t, errors.Is(annotated, ErrConnectTimeout))
+
+	var multiErr *MultiConnError
+	if assert.True(t, errors.As(annotated, &multiErr)) {
+		assert.Equal(t, 2, len(multiErr.Errs))
+	}
+}
+
+func TestFleetSummaryErr(t *testing.T) {
+	fs := newFleetSummary(
+		map[string]LStreamClientState{
+			"host-d": LStreamClientStateConnectedIdle,
+			"host-c": LStreamClientStateDisconnected,
+			"host-b": LStreamClientStateConnecting,
+			"host-a": LStreamClientStateDisconnected,
+		},
+		map[string]lstreamConnErr{
+			"host-c": {err: "attempt 1: dial tcp 10.0.0.1:22: i/o timeout"},
+			"host-a": {err: "attempt 1: bootstrap failed", bootstrap: true},
+		},
+	)
+
+	err := fs.Err()
+	if !assert.Error(t, err) {
+		return
+	}
+
+	assert.Equal(t, "2 logstreams failed to connect:\n"+
+		"  host-a: attempt 1: bootstrap failed\n"+
+		"  host-c: attempt 1: dial tcp 10.0.0.1:22: i/o timeout",
+		err.Error(),
+	)
+
+	assert.True(t, errors.Is(err, ErrConnectTimeout))
+	assert.True(t, errors.Is(err, ErrBootstrap))
+	assert.False(t, errors.Is(err, ErrAuthFailed))
+
+	// No failures: no error.
+	fs = newFleetSummary(
+		map[string]LStreamClientState{"host-a": LStreamClientStateConnectedIdle},
+		nil,
+	)
+	assert.NoError(t, fs.Err())
+}
+
+func TestClassifiedErrorIs(t *testing.T) {
+	type testCase struct {
+		category ConnErrCategory
+		want     []error
+	}
+
+	allSentinels := []error{
+		ErrConnectTimeout, ErrAuthFailed, ErrHostUnreachable, ErrShellNotFound,
+		ErrMarkerNotReceived, ErrAgentMissing, ErrDNS, ErrRefused, ErrBootstrap,
+	}
+
+	testCases := []testCase{
+		{category: ConnErrCategoryAuth, want: []error{ErrAuthFailed}},
+		{category: ConnErrCategoryDNS, want: []error{ErrHostUnreachable, ErrDNS}},
+		{category: ConnErrCategoryUnreachable, want: []error{ErrHostUnreachable}},
+		{category: ConnErrCategoryTimeout, want: []error{ErrConnectTimeout}},
+		{category: ConnErrCategoryRefused, want: []error{ErrHostUnreachable, ErrRefused}},
+		{category: ConnErrCategoryShellNotFound, want: []error{ErrShellNotFound}},
+		{category: ConnErrCategoryNoMarker, want: []error{ErrMarkerNotReceived}},
+		{category: ConnErrCategoryBootstrap, want: []error{ErrBootstrap}},
+		{category: ConnErrCategoryAgentMissing, want: []error{ErrAgentMissing, ErrBootstrap}},
+		{category: ConnErrCategoryOther, want: nil},
+	}
+
+	underlying := errors.New("underlying detail")
+
+	for _, tc := range testCases {
+		err := errors.Annotatef(classifyErr(tc.category, underlying), "connecting")
+
+		// The message and the underlying error are preserved.
+		assert.Equal(t, "connecting: underlying detail", err.Error())
+		assert.True(t, errors.Is(err, underlying))
+		assert.Equal(t, tc.category, connErrCategoryOf(err))
+
+		for _, sentinel := range allSentinels {
+			want := false
+			for _, w := range tc.want {
+				if w == sentinel {
+					want = true
+				}
+			}
+
+			assert.Equal(t, want, errors.Is(err, sentinel), "category %s, sentinel %q", tc.category, sentinel)
+		}
+	}
+
+	// The old names are still matched.
+	assert.True(t, errors.Is(classifyErr(ConnErrCategoryAuth, underlying), ErrAuthFailed))
+	assert.True(t, errors.Is(classifyErr(ConnErrCategoryTimeout, underlying), ErrConnectTimeout))
+}
+
+func TestClassifyConnErr(t *testing.T) {
+	err := classifyConnErr(errors.New("dial tcp 10.0.0.1:22: connect: no route to host"))
+	assert.True(t, errors.Is(err, ErrHostUnreachable))
+	assert.Equal(t, "dial tcp 10.0.0.1:22: connect: no route to host", err.Error())
+
+	// Already classified errors are left alone, even though the message
+	// suggests another category.
+	err = classifyConnErr(classifyErr(ConnErrCategoryNoMarker, errors.New("timeout waiting for the marker")))
+	assert.True(t, errors.Is(err, ErrMarkerNotReceived))
+	assert.False(t, errors.Is(err, ErrConnectTimeout))
+
+	// Unknown errors aren't wrapped.
+	orig := errors.New("something weird")
+	assert.Equal(t, orig, classifyConnErr(orig))
+
+	assert.Nil(t, classifyConnErr(nil))
+}
+
+func TestFleetSummaryErrClassified(t *testing.T) {
+	fs := newFleetSummary(
+		map[string]LStreamClientState{
+			"host-a": LStreamClientStateDisconnected,
+			"host-b": LStreamClientStateDisconnected,
+		},
+		map[string]lstreamConnErr{
+			// The message looks like a timeout, but it was classified by the
+			// transport.
+			"host-a": {err: "attempt 1: timeout waiting for the connection marker", category: ConnErrCategoryNoMarker},
+			"host-b": {err: "bootstrap failed", bootstrap: true, category: ConnErrCategoryAgentMissing},
+		},
+	)
+
+	assert.Equal(t, map[ConnErrCategory][]string{
+		ConnErrCategoryNoMarker:     {"host-a"},
+		ConnErrCategoryAgentMissing: {"host-b"},
+	}, fs.FailedByCategory)
+
+	err := fs.Err()
+	assert.True(t, errors.Is(err, ErrMarkerNotReceived))
+	assert.True(t, errors.Is(err, ErrAgentMissing))
+	assert.True(t, errors.Is(err, ErrBootstrap))
+	assert.False(t, errors.Is(err, ErrConnectTimeout))
+}
+
+func TestIsAgentMissingExit(t *testing.T) {
+	agentPath := "/tmp/nerdlog_agent_myhost.sh"
+
+	assert.True(t, isAgentMissingExit(agentPath, "127", []string{
+		"bash: /tmp/nerdlog_agent_myhost.sh: No such file or directory",
+	}))
+
+	// Some command invoked by the agent wasn't found.
+	assert.False(t, isAgentMissingExit(agentPath, "127", []string{
+		"/tmp/nerdlog_agent_myhost.sh: line 10: gawk: command not found",
+	}))
+
+	assert.False(t, isAgentMissingExit(agentPath, "1", []string{
+		"bash: /tmp/nerdlog_agent_myhost.sh: No such file or directory",
+	}))
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnEvent is a single ShellConnUpdate from the transport of some logstream,
+// as delivered to the subscribers; see LStreamsManager.Subscribe.
+type ConnEvent struct {
+	LStreamName string
+	Time        time.Time
+
+	Update ShellConnUpdate
+
+	// NumDropped is how many DebugInfo events were dropped for this
+	// subscriber since the previous delivered event, because the subscriber
+	// didn't keep up with them.
+	NumDropped int
+}
+
+// droppable returns whether the event can be dropped if the subscriber is too
+// slow: only the debug info can, while the connection results and data
+// requests are always delivered.
+func (ev *ConnEvent) droppable() bool {
+	return ev.Update.DebugInfo != nil
+}
+
+// connEventsMaxPending is how many pending events a subscriber can have before
+// we start dropping the droppable ones.
+const connEventsMaxPending = 256
+
+// connEventsHub fans out the ConnEvent-s to the subscribers. Publishing never
+// blocks: every subscriber has its own queue and goroutine delivering events
+// from that queue, so slow subscribers only affect themselves.
+type connEventsHub struct {
+	mtx    sync.Mutex
+	subs   map[*connEventsSub]struct{}
+	closed bool
+}
+
+func newConnEventsHub() *connEventsHub {
+	return &connEventsHub{
+		subs: map[*connEventsSub]struct{}{},
+	}
+}
+
+// subscribe adds a new subscriber; see LStreamsManager.Subscribe.
+func (hub *connEventsHub) subscribe() (<-chan ConnEvent, func()) {
+	sub := newConnEventsSub(connEventsMaxPending)
+
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+
+	if hub.closed {
+		sub.finish()
+		return sub.outCh, func() {}
+	}
+
+	hub.subs[sub] = struct{}{}
+
+	unsubscribe := func() {
+		hub.mtx.Lock()
+		delete(hub.subs, sub)
+		hub.mtx.Unlock()
+
+		sub.stop()
+	}
+
+	return sub.outCh, unsubscribe
+}
+
+// publish queues the event for all the subscribers. It never blocks. It's
+// safe to call it on a nil hub, it's a no-op then.
+func (hub *connEventsHub) publish(ev ConnEvent) {
+	if hub == nil {
+		return
+	}
+
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+
+	for sub := range hub.subs {
+		sub.push(ev)
+	}
+}
+
+// close makes all the subscribers' channels close once the pending events are
+// delivered; no more subscribers can be added after that.
+func (hub *connEventsHub) close() {
+	hub.mtx.Lock()
+	defer hub.mtx.Unlock()
+
+	hub.closed = true
+	for sub := range hub.subs {
+		sub.finish()
+	}
+	hub.subs = map[*connEventsSub]struct{}{}
+}
+
+type connEventsSub struct {
+	maxPending int
+
+	mtx        sync.Mutex
+	pending    []ConnEvent
+	numDropped int
+	// finished is true once no more events will be pushed; after delivering
+	// the pending ones, outCh gets closed.
+	finished bool
+
+	// notifyCh is written to (without blocking) whenever pending or finished
+	// is updated.
+	notifyCh chan struct{}
+	// stopCh is closed when the subscriber unsubscribes; then the pending
+	// events are not delivered.
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	outCh chan ConnEvent
+}
+
+func newConnEventsSub(maxPending int) *connEventsSub {
+	sub := &connEventsSub{
+		maxPending: maxPending,
+		notifyCh:   make(chan struct{}, 1),
+		stopCh:     make(chan struct{}),
+		outCh:      make(chan ConnEvent),
+	}
+
+	go sub.run()
+
+	return sub
+}
+
+func (sub *connEventsSub) push(ev ConnEvent) {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	if len(sub.pending) >= sub.maxPending {
+		// The subscriber doesn't keep up, so drop the oldest droppable event,
+		// or the new one if there's nothing else to drop.
+		idx := -1
+		for i := range sub.pending {
+			if sub.pending[i].droppable() {
+				idx = i
+				break
+			}
+		}
+
+		if idx >= 0 {
+			sub.pending = append(sub.pending[:idx], sub.pending[idx+1:]...)
+			sub.numDropped++
+		} else if ev.droppable() {
+			sub.numDropped++
+			return
+		}
+	}
+
+	sub.pending = append(sub.pending, ev)
+	sub.notify()
+}
+
+func (sub *connEventsSub) finish() {
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+
+	sub.finished = true
+	sub.notify()
+}
+
+func (sub *connEventsSub) stop() {
+	sub.stopOnce.Do(func() {
+		close(sub.stopCh)
+	})
+}
+
+// notify must be called with mtx locked.
+func (sub *connEventsSub) notify() {
+	select {
+	case sub.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *connEventsSub) run() {
+	defer close(sub.outCh)
+
+	for {
+		sub.mtx.Lock()
+		if len(sub.pending) == 0 {
+			finished := sub.finished
+			sub.mtx.Unlock()
+
+			if finished {
+				return
+			}
+
+			select {
+			case <-sub.notifyCh:
+				continue
+			case <-sub.stopCh:
+				return
+			}
+		}
+
+		ev := sub.pending[0]
+		sub.pending = sub.pending[1:]
+		ev.NumDropped = sub.numDropped
+		sub.numDropped = 0
+		sub.mtx.Unlock()
+
+		select {
+		case sub.outCh <- ev:
+		case <-sub.stopCh:
+			return
+		}
+	}
+}
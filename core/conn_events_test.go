@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// chattyTransport sends a lot of debug info before connecting with the
+// fakeShellTransport, once startCh is closed; sentCh is closed once all
+// updates are sent.
+type chattyTransport struct {
+	fakeShellTransport
+
+	numDebugInfos int
+	startCh       chan struct{}
+	sentCh        chan struct{}
+}
+
+func (t *chattyTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		<-t.startCh
+
+		for i := 0; i < t.numDebugInfos; i++ {
+			resCh <- ShellConnUpdate{
+				DebugInfo: &ShellConnDebugInfo{Message: fmt.Sprintf("msg %d", i)},
+			}
+		}
+
+		t.fakeShellTransport.Connect(ctx, resCh)
+		close(t.sentCh)
+	}()
+}
+
+// connEventsStats is what a subscriber has received.
+type connEventsStats struct {
+	numDebugInfos int
+	numDropped    int
+	results       []string
+}
+
+func readConnEvents(ch <-chan ConnEvent, delay time.Duration) *connEventsStats {
+	stats := &connEventsStats{}
+	for ev := range ch {
+		time.Sleep(delay)
+
+		stats.numDropped += ev.NumDropped
+		if ev.Update.DebugInfo != nil {
+			stats.numDebugInfos++
+		}
+		if ev.Update.Result != nil {
+			stats.results = append(stats.results, ev.LStreamName)
+		}
+	}
+
+	return stats
+}
+
+func TestConnEventsHub(t *testing.T) {
+	hub := newConnEventsHub()
+
+	numSubs := 3
+	chs := make([]<-chan ConnEvent, numSubs)
+	unsubs := make([]func(), numSubs)
+	for i := range chs {
+		chs[i], unsubs[i] = hub.subscribe()
+	}
+
+	// Nobody reads yet, but publishing doesn't block.
+	numResults := 10
+	numDebugInfos := 0
+	for i := 0; i < numResults; i++ {
+		for j := 0; j < 100; j++ {
+			hub.publish(ConnEvent{
+				Update: ShellConnUpdate{DebugInfo: &ShellConnDebugInfo{Message: "foo"}},
+			})
+			numDebugInfos++
+		}
+
+		hub.publish(ConnEvent{
+			LStreamName: fmt.Sprintf("host-%d", i),
+			Update:      ShellConnUpdate{Result: &ShellConnResult{}},
+		})
+	}
+
+	// Unsubscribing closes the channel without delivering the rest.
+	unsubs[0]()
+	stats := readConnEvents(chs[0], 0)
+	assert.True(t, len(stats.results) <= 1)
+
+	// After the hub is closed, the rest of subscribers get all the pending
+	// events, and then their channels are closed.
+	hub.close()
+
+	for i := 1; i < numSubs; i++ {
+		stats := readConnEvents(chs[i], 0)
+
+		assert.Equal(t, numResults, len(stats.results))
+		assert.Equal(t, "host-0", stats.results[0])
+		assert.Equal(t, "host-9", stats.results[numResults-1])
+
+		// One more event might be already taken from the queue by the time we
+		// start reading.
+		assert.True(t, stats.numDebugInfos <= connEventsMaxPending-numResults+1)
+		assert.Equal(t, numDebugInfos, stats.numDebugInfos+stats.numDropped)
+
+		unsubs[i]()
+	}
+
+	// Subscribing to the closed hub returns the closed channel.
+	ch, unsub := hub.subscribe()
+	_, ok := <-ch
+	assert.False(t, ok)
+	unsub()
+}
+
+func TestLStreamsManagerSubscribe(t *testing.T) {
+	numLStreams := 4
+	numDebugInfos := 3 * connEventsMaxPending
+
+	logs := &fakeLogs{}
+	startCh := make(chan struct{})
+	transportsCh := make(chan *chattyTransport, numLStreams)
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	go func() {
+		for range updatesCh {
+		}
+	}()
+
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		NewTransport: func(ls LogStream) ShellTransport {
+			tr := &chattyTransport{
+				fakeShellTransport: fakeShellTransport{logs: logs},
+				numDebugInfos:      numDebugInfos,
+				startCh:            startCh,
+				sentCh:             make(chan struct{}),
+			}
+			transportsCh <- tr
+
+			return tr
+		},
+		InitialLStreams: "chatty-0,chatty-1,chatty-2,chatty-3",
+		ClientID:        "test",
+		UpdatesCh:       updatesCh,
+		Clock:           clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+
+	numSubs := 3
+	chs := make([]<-chan ConnEvent, numSubs)
+	for i := range chs {
+		chs[i], _ = lsman.Subscribe()
+	}
+
+	// Nobody reads the events yet, but the transports are not blocked.
+	close(startCh)
+	for i := 0; i < numLStreams; i++ {
+		tr := <-transportsCh
+
+		select {
+		case <-tr.sentCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transport is blocked")
+		}
+	}
+
+	// Now, slowly read the events; all the connection results are there.
+	var wg sync.WaitGroup
+	allStats := make([]*connEventsStats, numSubs)
+	for i := range chs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			allStats[i] = readConnEvents(chs[i], 100*time.Microsecond)
+		}(i)
+	}
+
+	lsman.Close()
+	lsman.Wait()
+	wg.Wait()
+	close(updatesCh)
+
+	for _, stats := range allStats {
+		assert.ElementsMatch(t, []string{
+			"chatty-0", "chatty-1", "chatty-2", "chatty-3",
+		}, stats.results)
+		assert.Equal(t, numLStreams*numDebugInfos, stats.numDebugInfos+stats.numDropped)
+		assert.True(t, stats.numDropped > 0)
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// probeTarget returns the TCP address which the transport is going to connect
+// to, and the local address to dial it from (if any), so that it can be
+// probed before connecting; see ConfigLogStreamOptions.ProbeTimeout. If the
+// target isn't a simple host:port (like the custom commands, or connecting
+// through jumphosts or a proxy), ok is false.
+func probeTarget(config ConfigLogStreamShellTransport) (addr, bindAddr string, ok bool) {
+	switch {
+	case config.SSHLib != nil:
+		if len(config.SSHLib.Jumphosts) > 0 || config.SSHLib.ProxyCommand != "" || config.SSHLib.ProxyURL != "" {
+			return "", "", false
+		}
+
+		return config.SSHLib.Host.Addr, config.SSHLib.BindAddress, true
+
+	case config.CustomCmd != nil:
+		// Only the ssh-bin transport has a known target.
+		if config.CustomCmd.ShellCommand != DefaultSSHShellCommand {
+			return "", "", false
+		}
+
+		env := config.CustomCmd.EnvOverride
+		if env["NLJUMP"] != "" || env["NLPROXYCOMMAND"] != "" || env["NLHOST"] == "" {
+			return "", "", false
+		}
+
+		port := env["NLPORT"]
+		if port == "" {
+			port = "22"
+		}
+
+		return net.JoinHostPort(env["NLHOST"], port), env["NLBIND"], true
+
+	case config.Console != nil && config.Console.TelnetAddr != "":
+		return config.Console.TelnetAddr, config.Console.BindAddress, true
+	}
+
+	return "", "", false
+}
+
+// probeTransport wraps another transport, and before connecting, checks that
+// the target TCP address accepts connections at all, with a short timeout:
+// this way, the hosts which are obviously down fail fast, instead of after
+// the full connection timeout.
+type probeTransport struct {
+	inner    ShellTransport
+	addr     string
+	bindAddr string
+	timeout  time.Duration
+	logger   *log.Logger
+}
+
+var _ ShellTransport = &probeTransport{}
+
+// newProbeTransport returns the transport which probes the target of the
+// given transport config before connecting with the inner transport. If the
+// target can't be probed, the inner transport is returned as is.
+func newProbeTransport(
+	inner ShellTransport, config ConfigLogStreamShellTransport, timeout time.Duration, logger *log.Logger,
+) ShellTransport {
+	addr, bindAddr, ok := probeTarget(config)
+	if !ok {
+		return inner
+	}
+
+	return &probeTransport{
+		inner:    inner,
+		addr:     addr,
+		bindAddr: bindAddr,
+		timeout:  timeout,
+		logger:   logger,
+	}
+}
+
+func (t *probeTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		resCh <- ShellConnUpdate{
+			DebugInfo: &ShellConnDebugInfo{
+				Message: fmt.Sprintf("Probing %s", t.addr),
+			},
+		}
+
+		if err := probeTCP(ctx, t.addr, t.bindAddr, t.timeout); err != nil {
+			t.logger.Errorf("Probe failed: %s", err)
+			resCh <- ShellConnUpdate{
+				Result: &ShellConnResult{
+					Err: classifyConnErr(err),
+				},
+			}
+			return
+		}
+
+		t.inner.Connect(ctx, resCh)
+	}()
+}
+
+// probeTCP dials the given address and closes the connection right away.
+func probeTCP(ctx context.Context, addr, bindAddr string, timeout time.Duration) error {
+	dialer, err := newDialer(timeout, bindAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Annotatef(annotateDialErr(err, addr, bindAddr), "probe")
+	}
+
+	conn.Close()
+
+	return nil
+}
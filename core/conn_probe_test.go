@@ -0,0 +1,221 @@
+package core
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// errInnerConnect is returned by the probeInnerTransport.
+var errInnerConnect = errors.New("inner transport connected")
+
+// probeInnerTransport counts the connection attempts, and fails every one of
+// them with errInnerConnect.
+type probeInnerTransport struct {
+	numConnects int32
+}
+
+func (t *probeInnerTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	atomic.AddInt32(&t.numConnects, 1)
+
+	go func() {
+		resCh <- ShellConnUpdate{
+			Result: &ShellConnResult{Err: errInnerConnect},
+		}
+	}()
+}
+
+// connectResult connects using the given transport, and returns the result.
+func connectResult(t *testing.T, transport ShellTransport) *ShellConnResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resCh := make(chan ShellConnUpdate, 1)
+	transport.Connect(ctx, resCh)
+
+	for {
+		select {
+		case upd := <-resCh:
+			if upd.Result != nil {
+				return upd.Result
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for the connection result")
+		}
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	for _, tc := range []struct {
+		descr        string
+		config       ConfigLogStreamShellTransport
+		wantAddr     string
+		wantBindAddr string
+		wantOK       bool
+	}{
+		{
+			descr: "ssh-lib",
+			config: ConfigLogStreamShellTransport{
+				SSHLib: &ConfigLogStreamShellTransportSSHLib{
+					Host:        ConfigHost{Addr: "myhost:2222"},
+					BindAddress: "10.0.0.5",
+				},
+			},
+			wantAddr:     "myhost:2222",
+			wantBindAddr: "10.0.0.5",
+			wantOK:       true,
+		},
+		{
+			descr: "ssh-lib with jumphosts",
+			config: ConfigLogStreamShellTransport{
+				SSHLib: &ConfigLogStreamShellTransportSSHLib{
+					Host:      ConfigHost{Addr: "myhost:22"},
+					Jumphosts: []ConfigHost{{Addr: "bastion:22"}},
+				},
+			},
+		},
+		{
+			descr: "ssh-lib with proxy command",
+			config: ConfigLogStreamShellTransport{
+				SSHLib: &ConfigLogStreamShellTransportSSHLib{
+					Host:         ConfigHost{Addr: "myhost:22"},
+					ProxyCommand: "nc %h %p",
+				},
+			},
+		},
+		{
+			descr: "ssh-bin",
+			config: ConfigLogStreamShellTransport{
+				CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+					ShellCommand: DefaultSSHShellCommand,
+					EnvOverride:  map[string]string{"NLHOST": "myhost", "NLUSER": "me"},
+				},
+			},
+			wantAddr: "myhost:22",
+			wantOK:   true,
+		},
+		{
+			descr: "ssh-bin with port",
+			config: ConfigLogStreamShellTransport{
+				CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+					ShellCommand: DefaultSSHShellCommand,
+					EnvOverride:  map[string]string{"NLHOST": "::1", "NLPORT": "2222"},
+				},
+			},
+			wantAddr: "[::1]:2222",
+			wantOK:   true,
+		},
+		{
+			descr: "ssh-bin with jumphosts",
+			config: ConfigLogStreamShellTransport{
+				CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+					ShellCommand: DefaultSSHShellCommand,
+					EnvOverride:  map[string]string{"NLHOST": "myhost", "NLJUMP": "bastion"},
+				},
+			},
+		},
+		{
+			descr: "custom command",
+			config: ConfigLogStreamShellTransport{
+				CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+					ShellCommand: "kubectl exec -i ${NLHOST} -- /bin/sh",
+					EnvOverride:  map[string]string{"NLHOST": "mypod"},
+				},
+			},
+		},
+		{
+			descr: "localhost",
+			config: ConfigLogStreamShellTransport{
+				Localhost: &ConfigLogStreamShellTransportLocalhost{},
+			},
+		},
+		{
+			descr: "http-ndjson",
+			config: ConfigLogStreamShellTransport{
+				HTTPNDJSON: &ConfigLogStreamShellTransportHTTPNDJSON{
+					URLTemplate: "http://logs.local/", Host: "myhost",
+				},
+			},
+		},
+	} {
+		addr, bindAddr, ok := probeTarget(tc.config)
+		assert.Equal(t, tc.wantOK, ok, tc.descr)
+		assert.Equal(t, tc.wantAddr, addr, tc.descr)
+		assert.Equal(t, tc.wantBindAddr, bindAddr, tc.descr)
+	}
+}
+
+func TestProbeTransportClosedPort(t *testing.T) {
+	// Get a port which nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	inner := &probeInnerTransport{}
+	transport := newProbeTransport(inner, ConfigLogStreamShellTransport{
+		SSHLib: &ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{Addr: addr.String()},
+		},
+	}, time.Second, log.NewLogger(log.Error))
+
+	res := connectResult(t, transport)
+	if assert.Error(t, res.Err) {
+		assert.True(t, errors.Is(res.Err, ErrRefused), res.Err.Error())
+		assert.True(t, errors.Is(res.Err, ErrHostUnreachable), res.Err.Error())
+	}
+
+	// The inner transport wasn't even tried.
+	assert.Equal(t, int32(0), atomic.LoadInt32(&inner.numConnects))
+}
+
+func TestProbeTransportOpenPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	addr := l.Addr().(*net.TCPAddr)
+
+	inner := &probeInnerTransport{}
+	transport := newProbeTransport(inner, ConfigLogStreamShellTransport{
+		CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+			ShellCommand: DefaultSSHShellCommand,
+			EnvOverride: map[string]string{
+				"NLHOST": addr.IP.String(),
+				"NLPORT": strconv.Itoa(addr.Port),
+			},
+		},
+	}, time.Second, log.NewLogger(log.Error))
+
+	res := connectResult(t, transport)
+	assert.Equal(t, errInnerConnect, res.Err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&inner.numConnects))
+}
+
+func TestProbeTransportSkipped(t *testing.T) {
+	inner := &probeInnerTransport{}
+
+	for _, config := range []ConfigLogStreamShellTransport{
+		{
+			CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+				ShellCommand: "kubectl exec -i ${NLHOST} -- /bin/sh",
+				EnvOverride:  map[string]string{"NLHOST": "mypod"},
+			},
+		},
+		{Localhost: &ConfigLogStreamShellTransportLocalhost{}},
+	} {
+		transport := newProbeTransport(inner, config, time.Second, log.NewLogger(log.Error))
+		assert.Equal(t, ShellTransport(inner), transport)
+	}
+}
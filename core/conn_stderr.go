@@ -0,0 +1,108 @@
+package core
+
+import (
+	"regexp"
+
+	"github.com/juju/errors"
+)
+
+// ConnStderrPatterns configures how the transports using an external command
+// (ssh-bin, custom and localhost) treat the stderr lines which the command
+// prints before the connection marker. All the patterns are regexes (in Go
+// syntax), matched against every line.
+type ConnStderrPatterns struct {
+	// Benign are the patterns of the harmless noise, like banner warnings,
+	// which some hosts print even on successful connections: the matching
+	// lines are only logged, and they don't end up in the connection error,
+	// nor in the stderr read by the client after connecting.
+	Benign []string
+
+	// Fatal are the patterns which mean that the connection has definitely
+	// failed: once a matching line is printed, connecting fails right away,
+	// without waiting for the command to exit or for the timeouts. If a line
+	// matches both the benign and the fatal patterns, it's fatal.
+	Fatal []string
+}
+
+// DefaultConnStderrPatterns are always used, in addition to the ones
+// configured for the logstream.
+var DefaultConnStderrPatterns = ConnStderrPatterns{
+	Benign: []string{
+		`^Warning: Permanently added .* to the list of known hosts`,
+		`^X11 forwarding request failed`,
+		`^Pseudo-terminal will not be allocated`,
+		`^\*\* (WARNING: connection is not using a post-quantum|This session may be vulnerable|The server may need to be upgraded)`,
+	},
+	Fatal: []string{
+		`Permission denied \(`,
+		`^Host key verification failed`,
+		`^ssh: Could not resolve hostname`,
+	},
+}
+
+// connStderrKind is the result of classifying a stderr line with the
+// connStderrClassifier.
+type connStderrKind int
+
+const (
+	connStderrOther connStderrKind = iota
+	connStderrBenign
+	connStderrFatal
+)
+
+// connStderrClassifier classifies the stderr lines using the compiled
+// ConnStderrPatterns.
+type connStderrClassifier struct {
+	benign []*regexp.Regexp
+	fatal  []*regexp.Regexp
+}
+
+// newConnStderrClassifier compiles the given patterns together with the
+// DefaultConnStderrPatterns.
+func newConnStderrClassifier(patterns ConnStderrPatterns) (*connStderrClassifier, error) {
+	compile := func(kind string, defaults, extra []string) ([]*regexp.Regexp, error) {
+		ret := make([]*regexp.Regexp, 0, len(defaults)+len(extra))
+		for _, pattern := range append(append([]string{}, defaults...), extra...) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid %s stderr pattern %q", kind, pattern)
+			}
+
+			ret = append(ret, re)
+		}
+
+		return ret, nil
+	}
+
+	benign, err := compile("benign", DefaultConnStderrPatterns.Benign, patterns.Benign)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	fatal, err := compile("fatal", DefaultConnStderrPatterns.Fatal, patterns.Fatal)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &connStderrClassifier{
+		benign: benign,
+		fatal:  fatal,
+	}, nil
+}
+
+// classify returns the kind of the given stderr line.
+func (c *connStderrClassifier) classify(line string) connStderrKind {
+	for _, re := range c.fatal {
+		if re.MatchString(line) {
+			return connStderrFatal
+		}
+	}
+
+	for _, re := range c.benign {
+		if re.MatchString(line) {
+			return connStderrBenign
+		}
+	}
+
+	return connStderrOther
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnStderrClassifier(t *testing.T) {
+	c, err := newConnStderrClassifier(ConnStderrPatterns{
+		Benign: []string{`^Welcome to`},
+		Fatal:  []string{`^Account locked`, `^Welcome to the locked host`},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	type testCase struct {
+		line string
+		want connStderrKind
+	}
+
+	testCases := []testCase{
+		{"Welcome to myhost", connStderrBenign},
+		{"Warning: Permanently added 'myhost' (ED25519) to the list of known hosts.", connStderrBenign},
+		{"Account locked for user me", connStderrFatal},
+		{"me@myhost: Permission denied (publickey).", connStderrFatal},
+		// Fatal wins over benign.
+		{"Welcome to the locked host", connStderrFatal},
+		{"bash: warning: setlocale: LC_ALL: cannot change locale", connStderrOther},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, c.classify(tc.line), tc.line)
+	}
+
+	_, err = newConnStderrClassifier(ConnStderrPatterns{Fatal: []string{"("}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingTransport fails every connection attempt: it either takes
+// attemptDur on the mock clock and fails, or, if the clock is nil, hangs
+// until the attempt is aborted.
+type failingTransport struct {
+	clock      *clock.Mock
+	attemptDur time.Duration
+
+	mtx         sync.Mutex
+	numAttempts int
+}
+
+func (t *failingTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	t.mtx.Lock()
+	t.numAttempts++
+	t.mtx.Unlock()
+
+	go func() {
+		var err error
+		if t.clock != nil {
+			t.clock.Add(t.attemptDur)
+			err = errors.New("dial tcp 10.0.0.1:22: i/o timeout")
+		} else {
+			<-ctx.Done()
+			err = errors.Annotatef(ctx.Err(), "connecting")
+		}
+
+		resCh <- ShellConnUpdate{
+			Result: &ShellConnResult{Err: err},
+		}
+	}()
+}
+
+func (t *failingTransport) getNumAttempts() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.numAttempts
+}
+
+func newConnectBudgetTestNerdlog(
+	t *testing.T, budget time.Duration, tr *failingTransport, clk clock.Clock,
+) *Nerdlog {
+	n, err := New(Options{
+		LStreams: "fake-01",
+		ConfigLogStreams: ConfigLogStreams{
+			"fake-01": {
+				Options: ConfigLogStreamOptions{
+					ConnectBudget: budget,
+				},
+			},
+		},
+		NewTransport: func(ls LogStream) ShellTransport {
+			return tr
+		},
+		ClientID: "test",
+		Clock:    clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+// waitGaveUp waits until the logstream gives up connecting, and returns the
+// error.
+func waitGaveUp(t *testing.T, n *Nerdlog) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		lastErr := n.FleetStatus().ErrByLStream["fake-01"]
+		if strings.HasPrefix(lastErr, "gave up ") {
+			return lastErr
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("the logstream hasn't given up connecting")
+	return ""
+}
+
+func TestConnectBudgetStopsRetrying(t *testing.T) {
+	clockMock := clock.NewMock()
+	tr := &failingTransport{clock: clockMock, attemptDur: 10 * time.Second}
+
+	n := newConnectBudgetTestNerdlog(t, 30*time.Second, tr, clockMock)
+	defer n.Close()
+
+	// Every attempt takes 10s, so after the third one, there's no time left
+	// for the next one.
+	lastErr := waitGaveUp(t, n)
+	assert.True(t, strings.HasPrefix(lastErr, "gave up after 30s and 3 attempts: "), lastErr)
+	assert.Equal(t, ConnErrCategoryTimeout, CategorizeConnErr(lastErr))
+
+	// The retries would happen every second, but there are none anymore.
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, 3, tr.getNumAttempts())
+}
+
+func TestConnectBudgetAbortsAttempt(t *testing.T) {
+	tr := &failingTransport{}
+
+	n := newConnectBudgetTestNerdlog(t, 300*time.Millisecond, tr, nil)
+	defer n.Close()
+
+	// The attempt hangs, so the budget aborts it.
+	lastErr := waitGaveUp(t, n)
+	assert.Equal(t, "gave up after 300ms and 1 attempt: connection timed out", lastErr)
+	assert.Equal(t, 1, tr.getNumAttempts())
+
+	// Reconnecting explicitly starts over, with the new budget.
+	n.lsman.Reconnect()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for tr.getNumAttempts() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, tr.getNumAttempts())
+
+	// And it gives up again, instead of retrying.
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, 2, tr.getNumAttempts())
+	assert.Equal(t, "gave up after 300ms and 1 attempt: connection timed out", waitGaveUp(t, n))
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"context"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// connectLimiter limits the number of logstreams connecting at the same time
+// (see LStreamsManagerParams.MaxConcurrentConnects); the ones which don't fit
+// wait in the queue, where the higher priority goes first, and the same
+// priority goes in the config order (see ConfigLogStreamOptions.Priority).
+type connectLimiter struct {
+	max int
+
+	mtx       sync.Mutex
+	numActive int
+	waiters   []*connectWaiter
+}
+
+// connectWaiter is a logstream waiting in the connectLimiter queue; grantCh
+// is closed once it's allowed to connect.
+type connectWaiter struct {
+	priority int
+	order    int
+
+	grantCh chan struct{}
+	granted bool
+}
+
+// newConnectLimiter returns the limiter which allows at most max logstreams
+// to connect at the same time; if max is not positive, there is no limit,
+// and it returns nil.
+func newConnectLimiter(max int) *connectLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &connectLimiter{max: max}
+}
+
+// enqueue adds a waiter with the given priority and the config order to the
+// queue, and grants it right away if there is room; granted tells whether
+// it was.
+func (l *connectLimiter) enqueue(priority, order int) (w *connectWaiter, granted bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	w = &connectWaiter{
+		priority: priority,
+		order:    order,
+		grantCh:  make(chan struct{}),
+	}
+
+	l.waiters = append(l.waiters, w)
+	l.grantNext()
+
+	return w, w.granted
+}
+
+// wait waits until the waiter is granted, or until the context is done; in
+// the latter case, the waiter is removed from the queue (or, if it happened
+// to be granted meanwhile, the slot is released), and the error is returned.
+func (l *connectLimiter) wait(ctx context.Context, w *connectWaiter) error {
+	select {
+	case <-w.grantCh:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if w.granted {
+		l.numActive--
+	} else {
+		for i, cur := range l.waiters {
+			if cur == w {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+
+	l.grantNext()
+
+	return errors.Trace(ctx.Err())
+}
+
+// release frees the slot of the granted waiter, letting the next one in the
+// queue connect.
+func (l *connectLimiter) release() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.numActive--
+	l.grantNext()
+}
+
+// grantNext grants as many waiters as there is room for, in the order of the
+// queue. Must be called with mtx locked.
+func (l *connectLimiter) grantNext() {
+	for l.numActive < l.max && len(l.waiters) > 0 {
+		next := 0
+		for i, w := range l.waiters[1:] {
+			if w.before(l.waiters[next]) {
+				next = i + 1
+			}
+		}
+
+		w := l.waiters[next]
+		l.waiters = append(l.waiters[:next], l.waiters[next+1:]...)
+
+		w.granted = true
+		close(w.grantCh)
+		l.numActive++
+	}
+}
+
+// before returns whether w goes before other in the queue.
+func (w *connectWaiter) before(other *connectWaiter) bool {
+	if w.priority != other.priority {
+		return w.priority > other.priority
+	}
+
+	return w.order < other.order
+}
+
+// connectLimitedTransport wraps another transport, and only lets it connect
+// once the connectLimiter allows it; the slot is held until the inner
+// transport delivers the result.
+type connectLimitedTransport struct {
+	inner    ShellTransport
+	limiter  *connectLimiter
+	priority int
+	order    int
+}
+
+var _ ShellTransport = &connectLimitedTransport{}
+
+func newConnectLimitedTransport(
+	inner ShellTransport, limiter *connectLimiter, priority, order int,
+) *connectLimitedTransport {
+	return &connectLimitedTransport{
+		inner:    inner,
+		limiter:  limiter,
+		priority: priority,
+		order:    order,
+	}
+}
+
+func (t *connectLimitedTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	// Get in the queue right away, so that the logstreams which start
+	// connecting together are ordered by the queue, not by the goroutines.
+	w, granted := t.limiter.enqueue(t.priority, t.order)
+
+	go func() {
+		if !granted {
+			resCh <- ShellConnUpdate{
+				DebugInfo: &ShellConnDebugInfo{
+					Message: "Waiting for the other logstreams to connect",
+				},
+			}
+		}
+
+		if err := t.limiter.wait(ctx, w); err != nil {
+			resCh <- ShellConnUpdate{
+				Result: &ShellConnResult{Err: err},
+			}
+			return
+		}
+
+		innerResCh := make(chan ShellConnUpdate, 1)
+		t.inner.Connect(ctx, innerResCh)
+
+		for upd := range innerResCh {
+			if upd.Result != nil {
+				t.limiter.release()
+				resCh <- upd
+				return
+			}
+
+			resCh <- upd
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func isGranted(w *connectWaiter) bool {
+	select {
+	case <-w.grantCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestConnectLimiter(t *testing.T) {
+	assert.Nil(t, newConnectLimiter(0))
+
+	l := newConnectLimiter(2)
+
+	w1, granted := l.enqueue(0, 0)
+	assert.True(t, granted)
+	w2, granted := l.enqueue(0, 1)
+	assert.True(t, granted)
+
+	// No room anymore, so the rest are queued.
+	low, granted := l.enqueue(-1, 2)
+	assert.False(t, granted)
+	sameLater, _ := l.enqueue(5, 4)
+	sameEarlier, _ := l.enqueue(5, 3)
+	high, _ := l.enqueue(10, 5)
+
+	ctx := context.Background()
+	assert.NoError(t, l.wait(ctx, w1))
+	assert.NoError(t, l.wait(ctx, w2))
+
+	// The higher priority goes first, regardless of the queueing order.
+	l.release()
+	assert.True(t, isGranted(high))
+	assert.False(t, isGranted(sameEarlier))
+
+	// The same priority goes in the config order.
+	l.release()
+	assert.True(t, isGranted(sameEarlier))
+	assert.False(t, isGranted(sameLater))
+
+	// Giving up on waiting leaves the queue, so the next one is the last.
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, errors.Cause(l.wait(cancelledCtx, sameLater)))
+
+	l.release()
+	assert.True(t, isGranted(low))
+	assert.Equal(t, 0, len(l.waiters))
+	assert.Equal(t, 2, l.numActive)
+}
@@ -17,10 +17,119 @@ type QueryLogsParams struct {
 
 	Query string
 
+	// QueryLang specifies how to interpret the Query. If empty, QueryLangAWK
+	// is assumed.
+	QueryLang QueryLang
+
+	// FilterIgnoreCase and FilterWholeWord only matter for QueryLangFilter:
+	// they specify how the terms without a field are matched against the log
+	// lines; see FilterMatchOpts.
+	FilterIgnoreCase bool
+	FilterWholeWord  bool
+
+	// Select, if not empty, is the projection: the comma-separated list of
+	// fields which the agent should output instead of the full log lines, like
+	// "timestamp,host,field:status"; see ParseProjection. It reduces the amount
+	// of data transferred from the hosts, but the resulting messages only have
+	// the selected fields in the Context, and an empty Msg.
+	Select string
+
+	// GroupBy, if not empty, is the field to group the matching log lines by,
+	// like "program" or "field:ip" (see ParseGroupBy): the agent counts the
+	// lines by the values of this field, and the counts from all the
+	// logstreams are summed up into LogRespTotal.Groups, e.g. to get the top
+	// 10 IPs across the fleet. The lines without the field aren't counted.
+	// The logs and the histogram are returned as usual.
+	GroupBy string
+
+	// CorrelateKey, if not empty, is the field to correlate the logs by, like
+	// "request_id": only the lines whose field has one of the CorrelateValues
+	// (exactly) are returned, merged from all the logstreams and ordered by
+	// time as usual, e.g. to trace a request across the services within the
+	// time window. The field is looked up the same way as a field in the
+	// filter language, and the condition is added to the Query on the hosts,
+	// regardless of the QueryLang. See also Nerdlog.Correlate, which finds the
+	// values appearing on multiple logstreams.
+	CorrelateKey    string
+	CorrelateValues []string
+
+	// SampleRate, if more than 1, makes the agent only read every Nth line of
+	// the logs, to get the approximate results faster on huge logs, e.g. for
+	// the initial exploration; the minute stats are then multiplied by N, so
+	// they approximate the actual numbers, and the response has Approximate
+	// set. Only the sampled lines are returned as the logs. The logstreams
+	// with a custom agent or the transports which only emulate the agent
+	// (http-ndjson, winevent) don't support sampling, so they're always
+	// queried exactly.
+	SampleRate int
+
+	// StatsBucketMinutes, if more than 1, makes the agent count the minute
+	// stats in the coarser buckets of this many minutes, which makes the
+	// output smaller on long time ranges: every bucket is attributed to its
+	// first minute. It must divide 15, so that the buckets are aligned the same
+	// way in every timezone; Nerdlog.Histogram sets it as per the histogram
+	// bucket size. Like with SampleRate, the logstreams with the transports
+	// which only emulate the agent always return the per-minute stats.
+	StatsBucketMinutes int
+
+	// AggregateOnly, if true, makes the query only return the aggregates: the
+	// minute stats (so the histogram), and the groups if GroupBy is set,
+	// without any log lines, for the analytic queries over huge logs. The
+	// agents compute the aggregates on the hosts, so only the counts are
+	// transferred; see AggregatePartial. MaxNumLines is ignored then, and
+	// LoadEarlier and LoadNewer are not supported.
+	AggregateOnly bool
+
+	// TailNumLines, if more than 0, makes the query a quick peek at the latest
+	// logs: every logstream returns its last TailNumLines lines matching the
+	// Query, taken with "tail -n N" from the latest log file (or "journalctl
+	// -n N"), regardless of the timestamps, so neither the index nor the time
+	// range are involved. From and To are ignored, MaxNumLines is set to
+	// TailNumLines, and the minute stats only cover the returned lines. The
+	// logs from all the logstreams are merged by timestamp, and none of them
+	// are cut (unlike with the regular queries, where only the timespan
+	// covered by all the logstreams is kept). LoadEarlier and LoadNewer are
+	// not supported. See also Nerdlog.TailN.
+	TailNumLines int
+
+	// Pin, if true, makes the query reproducible: the first query with Pin set
+	// pins the latest log file of every logstream at its current size, and
+	// the next ones keep reading it only up to that size, so they read
+	// exactly the same bytes even though the logs keep growing, e.g. while
+	// debugging with a teammate. The pins are kept as long as the queries
+	// have Pin set; the first query without it drops them, so the next pinned
+	// query pins the logs anew. If a log file is rotated after it was pinned,
+	// the pin is ignored with a warning. The logstreams using journalctl, a
+	// custom agent or the transports which only emulate the agent can't be
+	// pinned, so they're read live with a warning.
+	Pin bool
+
+	// AgentEnv, if not empty, contains the env vars to export for the agent
+	// on the hosts, to parameterize the custom agents per query (e.g. with a
+	// database name); see ConfigLogStreamOptions.CustomAgent. Every name gets
+	// AgentEnvPrefix prepended, so e.g. {"DB": "orders"} becomes
+	// NLENV_DB=orders. The names can only contain letters, digits and _, and
+	// the values can be arbitrary.
+	AgentEnv map[string]string
+
 	// If LoadEarlier is true, it means we're only loading the logs _before_ the ones
 	// we already had.
 	LoadEarlier bool
 
+	// If LoadNewer is true, it means we're only loading the logs _after_ the
+	// ones we already had, e.g. the ones which have arrived since the query was
+	// done. Every logstream is only queried since the minute of its latest log
+	// message, so the minute stats are updated as well, but if there are more
+	// than MaxNumLines newer messages, the older ones we had are replaced,
+	// to avoid a gap in the logs.
+	LoadNewer bool
+
+	// If ResumeToken is not nil, the failed query which has returned it is
+	// resumed: only the logstreams which have failed are queried again. All the
+	// other params are ignored then, and taken from the original query. See
+	// QueryResumeToken.
+	ResumeToken *QueryResumeToken
+
 	// If DontAddHistoryItem is true, the browser-like history will not be
 	// populated with a new item (it should be used exactly when we're navigating
 	// this browser-like history back and forth)
@@ -30,6 +139,19 @@ type QueryLogsParams struct {
 	// rebuild it from scratch (no-op for journalctl logstreams, because there's
 	// no nerdlog-maintained index for journalctl).
 	RefreshIndex bool
+
+	// If SkipNotConnected is true, the logstreams which aren't connected are
+	// skipped, and the query proceeds with the rest (as long as at least one
+	// is connected); the skipped ones are listed in
+	// LogRespTotal.SkippedLStreams. Otherwise, the query fails with
+	// ErrNotYetConnected unless all logstreams are connected.
+	SkipNotConnected bool
+
+	// If RetrySkipped is true, the query is only sent to the logstreams which
+	// were skipped by the previous query (see LogRespTotal.SkippedLStreams),
+	// and their logs are added to the ones we already have. The rest of the
+	// params should be the same as in the previous query.
+	RetrySkipped bool
 }
 
 // LogResp is a log response from a single logstream
@@ -44,6 +166,31 @@ type LogResp struct {
 	// included in MinuteStats). This number is usually larger than len(Logs).
 	NumMsgsTotal int
 
+	// SampleRate is non-zero if the logs were sampled (see
+	// QueryLogsParams.SampleRate); the MinuteStats are already scaled by it.
+	SampleRate int
+
+	// Groups maps the values of the QueryLogsParams.GroupBy field to the
+	// number of log lines having them; nil if the logs weren't grouped. Same
+	// as MinuteStats, the counts are scaled by the SampleRate.
+	Groups map[string]int
+
+	// Warnings contains the non-fatal issues printed by the agent to stderr
+	// (e.g. awk warnings, or some file being unreadable), which might mean that
+	// the results are incomplete.
+	Warnings []string
+
+	// RotatedLogfiles contains the log files which were rotated (replaced or
+	// truncated, as opposed to just appended to) while the agent was reading
+	// them, so the results might be incomplete or have duplicates across the
+	// rotation boundary. Every such file also gets a warning in Warnings.
+	RotatedLogfiles []string
+
+	// PinLast is the pin of the latest log file, in the opaque format of the
+	// agent's --pin-last, if it was pinned by this query (see
+	// QueryLogsParams.Pin); empty otherwise.
+	PinLast string
+
 	// DebugInfo contains info collected during this particular query.
 	DebugInfo LogstreamDebugInfo
 }
@@ -62,18 +209,61 @@ type LogRespTotal struct {
 	// the logs (the Logs slice still contains everything though).
 	LoadedEarlier bool
 
+	// If LoadedNewer is true, it means we've just loaded newer logs; like with
+	// LoadedEarlier, the Logs slice still contains everything.
+	LoadedNewer bool
+
 	// MinuteStats is a map from the unix timestamp (in seconds) to the stats for
 	// the minute starting at this timestamp.
 	MinuteStats map[int64]MinuteStatsItem
 
+	// MinuteStatsByLStream contains the same stats per logstream, keyed by the
+	// logstream name.
+	MinuteStatsByLStream map[string]map[int64]MinuteStatsItem
+
 	Logs []LogMsg
 
 	// NumMsgsTotal is the total number of messages in the time range (and
 	// included in MinuteStats). This number is usually larger than len(Logs).
 	NumMsgsTotal int
 
+	// Approximate is true if at least some of the logstreams were sampled (see
+	// QueryLogsParams.SampleRate), so MinuteStats and NumMsgsTotal are only
+	// estimates, and SampleRate is the sample rate which was used.
+	Approximate bool
+	SampleRate  int
+
+	// Groups contains the values of the QueryLogsParams.GroupBy field with the
+	// number of log lines having them, summed up across all the logstreams,
+	// and sorted by the count in descending order; nil if the logs weren't
+	// grouped. When loading the earlier or newer logs, it stays the same as
+	// for the original query.
+	Groups []Group
+
+	// GroupsByLStream contains the same groups per logstream, keyed by the
+	// logstream name, unsorted; nil if the logs weren't grouped. The
+	// logstreams which can't group the logs are not there.
+	GroupsByLStream map[string]map[string]int
+
 	Errs []error
 
+	// ResumeToken, if not nil, can be used to resume the failed query; see
+	// QueryResumeToken. It's only set if some logstreams have failed while the
+	// others have delivered their logs.
+	ResumeToken *QueryResumeToken
+
+	// Warnings contains the warnings from all the logstreams (see
+	// LogResp.Warnings), each one prefixed with the logstream name, like
+	// "web-01: tail: cannot open '/var/log/syslog.1' for reading: Permission
+	// denied". Unlike Errs, warnings don't fail the query.
+	Warnings []string
+
+	// SkippedLStreams contains the sorted names of the logstreams which were
+	// skipped because they weren't connected (see
+	// QueryLogsParams.SkipNotConnected), so the logs are incomplete. They can
+	// be queried later with QueryLogsParams.RetrySkipped.
+	SkippedLStreams []string
+
 	// DebugInfo is a map from the logstream name to the corresponding debug info
 	// collected during this particular query.
 	DebugInfo map[string]LogstreamDebugInfo
@@ -105,6 +295,16 @@ type LogMsg struct {
 	Level   LogLevel
 
 	OrigLine string
+
+	// Late is set by the ReorderBuffer if the message has arrived after the
+	// newer ones were already emitted, so it's out of order.
+	Late bool
+
+	// Labels are the labels of the logstream the message comes from (see
+	// ConfigLogStream.Labels); they're also present in Context. The map is
+	// shared by all the messages from the logstream, so it must not be
+	// modified.
+	Labels map[string]string
 }
 
 type LogLevel string
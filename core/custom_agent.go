@@ -0,0 +1,202 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// SpecialFilenameCustomAgent is the filename reported for the logs from the
+// custom agents; see ConfigLogStreamOptions.CustomAgent.
+const SpecialFilenameCustomAgent = "custom-agent"
+
+// A custom agent is a user-provided bash script, configured for a logstream
+// as ConfigLogStreamOptions.CustomAgent, which replaces nerdlog_agent.sh for
+// reading the logs. It's uploaded to the host on connect, and then for every
+// query, it's executed as "bash <script>" with the following env vars:
+//
+//   - NLFROM, NLTO: the time range of the query, in RFC3339 format in UTC,
+//     like "2025-03-10T10:00:00Z" (possibly with fractional seconds). NLFROM
+//     is inclusive and NLTO is exclusive; either of them can be empty, which
+//     means that the range is unbounded on that side.
+//   - NLFILTER: the awk condition to filter the lines with, like
+//     `($0 ~ /foo/)`; the same condition which nerdlog_agent.sh applies to
+//     every log line. It's empty if all lines are needed. The script can
+//     apply it with e.g. awk "${NLFILTER:-1}".
+//   - NLMAXNUMLINES: the max number of log lines to print; if there are more
+//     matching lines, only the latest ones must be printed.
+//   - NLENV_*: the per-query env vars from QueryLogsParams.AgentEnv, if any.
+//
+// The script must print the following lines to stdout; nothing else is
+// allowed there, and any other line fails the query:
+//
+//   - "m:<number>:<log line>": a matching log line, in chronological order.
+//     The number is the sequential number of the line in the output, starting
+//     from 1. The log line must begin with a timestamp in one of the formats
+//     supported by nerdlog, like "2025-03-10T10:00:00.123456Z" or the
+//     traditional syslog format "Mar 10 10:00:00".
+//   - "s:<unix timestamp>,<number>": optional per-minute stats: the number of
+//     all the matching lines (not only the printed ones) in the minute which
+//     starts at the given timestamp, in seconds. If the script doesn't print
+//     any stats, they are calculated from the printed lines, and so are the
+//     groups if the logs are grouped (see QueryLogsParams.GroupBy); otherwise,
+//     the logs from the script can't be grouped.
+//
+// The lines printed to stderr which start with "error:" are reported as
+// errors; the rest are only kept for debugging. A non-zero exit code fails
+// the query.
+//
+// On connect, the script is also executed once with empty NLFROM, NLTO and
+// NLFILTER, and NLMAXNUMLINES=2; the printed lines are used to detect the
+// format of the timestamps.
+
+const (
+	customAgentEnvFrom        = "NLFROM"
+	customAgentEnvTo          = "NLTO"
+	customAgentEnvFilter      = "NLFILTER"
+	customAgentEnvMaxNumLines = "NLMAXNUMLINES"
+
+	// customAgentHeredocDelimiter terminates the here-document which is used
+	// to upload the custom agent script; so the script can't contain this line.
+	customAgentHeredocDelimiter = "NERDLOG_CUSTOM_AGENT_EOF"
+)
+
+// validateCustomAgent checks that the custom agent script can be used.
+func validateCustomAgent(script string) error {
+	if strings.TrimSpace(script) == "" {
+		return errors.Errorf("custom_agent is empty")
+	}
+
+	for _, line := range strings.Split(script, "\n") {
+		if line == customAgentHeredocDelimiter {
+			return errors.Errorf("custom_agent can't contain the line %q", customAgentHeredocDelimiter)
+		}
+	}
+
+	return nil
+}
+
+// customAgentEnvVars returns the shell-quoted env var assignments to run the
+// custom agent for the given query.
+func customAgentEnvVars(ql *lstreamCmdQueryLogs, filter string) []string {
+	var from string
+	if !ql.from.IsZero() {
+		from = ql.from.UTC().Format(time.RFC3339Nano)
+	}
+
+	maxNumLines := ql.maxNumLines
+
+	if tu := ql.timestampUntil; tu != nil {
+		// The messages at the exact timestamp we've already loaded will be
+		// printed again, so ask for more, and skip them later; see
+		// skipCustomAgentLatest.
+		maxNumLines += tu.numMsgs
+	}
+
+	return []string{
+		customAgentEnvFrom + "=" + shellQuote(from),
+		customAgentEnvTo + "=" + shellQuote(formatCustomAgentTo(ql)),
+		customAgentEnvFilter + "=" + shellQuote(filter),
+		customAgentEnvMaxNumLines + "=" + shellQuote(strconv.Itoa(maxNumLines)),
+	}
+}
+
+// formatCustomAgentTo returns the NLTO value for the query: when loading
+// earlier logs, the range ends right after the earliest loaded message, so
+// that the messages with the same timestamp which weren't loaded yet are
+// included; otherwise, it's just the end of the query's range.
+func formatCustomAgentTo(ql *lstreamCmdQueryLogs) string {
+	to := ql.to
+	if tu := ql.timestampUntil; tu != nil {
+		to = tu.time.Add(time.Nanosecond)
+	}
+
+	if to.IsZero() {
+		return ""
+	}
+
+	return to.UTC().Format(time.RFC3339Nano)
+}
+
+// parseCustomAgentStats parses the stats printed by a custom agent, without
+// the "s:" prefix, like "1741600800,42".
+func parseCustomAgentStats(s string) (time.Time, int, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return time.Time{}, 0, errors.Errorf("expected 2 comma-separated parts, got %d", len(parts))
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.Annotatef(err, "invalid timestamp")
+	}
+
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 0 {
+		return time.Time{}, 0, errors.Errorf("invalid number of messages %q", parts[1])
+	}
+
+	return time.Unix(ts, 0).UTC().Truncate(time.Minute), n, nil
+}
+
+// skipCustomAgentLatest removes the latest numMsgs messages at the given
+// time, which are the ones we've already loaded; see customAgentEnvVars.
+func skipCustomAgentLatest(logs []LogMsg, tu *timeAndNumMsgs) []LogMsg {
+	for n := 0; n < tu.numMsgs && len(logs) > 0; n++ {
+		if !logs[len(logs)-1].Time.Equal(tu.time) {
+			break
+		}
+
+		logs = logs[:len(logs)-1]
+	}
+
+	return logs
+}
+
+// customAgentMalformedLineError returns the error for the stdout line which
+// doesn't follow the custom agent output format.
+func customAgentMalformedLineError(line string) error {
+	return errors.Errorf(
+		"custom agent printed a malformed line %q: only %q and %q lines are allowed in stdout",
+		line, "m:<number>:<log line>", "s:<unix timestamp>,<number>",
+	)
+}
+
+// customAgentScriptUpload returns the shell command to upload the custom
+// agent script to the given path. Unlike nerdlog_agent.sh, it's uploaded with
+// "<<" rather than "<<-", so that the leading tabs in the user's script are
+// kept as is.
+func customAgentScriptUpload(script, path string) string {
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+
+	return fmt.Sprintf(
+		"  cat << '%s' > %s\n%s%s\n",
+		customAgentHeredocDelimiter, shellQuote(path), script, customAgentHeredocDelimiter,
+	)
+}
+
+// finalizeCustomAgentResp is called when the custom agent has printed all the
+// logs: it skips the ones we already have (when loading earlier logs), and
+// calculates the minute stats from the logs if the agent didn't print them.
+func (lsc *LStreamClient) finalizeCustomAgentResp(ql *lstreamCmdQueryLogs, resp *LogResp) {
+	if ql.timestampUntil != nil {
+		resp.Logs = skipCustomAgentLatest(resp.Logs, ql.timestampUntil)
+		if len(resp.Logs) > ql.maxNumLines {
+			resp.Logs = resp.Logs[len(resp.Logs)-ql.maxNumLines:]
+		}
+	}
+
+	if len(resp.MinuteStats) > 0 {
+		return
+	}
+
+	// The script has printed all the matching lines, so aggregate them here.
+	partial := aggregateLogs(resp.Logs, ql.groupBy)
+	resp.MinuteStats = partial.MinuteStats
+	resp.Groups = partial.Groups
+}
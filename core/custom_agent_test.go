@@ -0,0 +1,125 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// customAgentTestScript is a custom agent which "reads" the logs from a
+// here-document, applies the filter, and records the env vars it was called
+// with to the file given as %s. If the filter contains "malformed", it also
+// prints a line which is not allowed by the custom agent contract.
+const customAgentTestScript = `echo "$NLFROM|$NLTO|$NLFILTER|$NLMAXNUMLINES" >> %s
+
+if [[ "$NLFILTER" == *malformed* ]]; then
+  echo "something unexpected"
+fi
+
+cat <<'LOGS' | awk "${NLFILTER:-1}" | tail -n "$NLMAXNUMLINES" | awk '{ print "m:" NR ":" $0 }'
+2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo first
+2025-03-10T10:00:02.000000+00:00 myhost myapp[123]: bar second
+2025-03-10T10:01:03.000000+00:00 myhost myapp[123]: foo third
+LOGS
+`
+
+func TestCustomAgent(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "env")
+
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				Options: ConfigLogStreamOptions{
+					ShellInit:   []string{"export TZ=UTC"},
+					CustomAgent: fmt.Sprintf(customAgentTestScript, envFile),
+				},
+			},
+		},
+		ClientID: "custom_agent_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	from := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 3, 10, 11, 0, 0, 0, time.UTC)
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        from,
+		To:          to,
+		Query:       "foo",
+		QueryLang:   QueryLangFilter,
+		MaxNumLines: 10,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var msgs []string
+	for _, msg := range resp.Logs {
+		msgs = append(msgs, fmt.Sprintf(
+			"%s %s %s", msg.Time.Format(time.RFC3339), msg.Context["program"], msg.Msg,
+		))
+	}
+	assert.Equal(t, []string{
+		"2025-03-10T10:00:01Z myapp foo first",
+		"2025-03-10T10:01:03Z myapp foo third",
+	}, msgs)
+
+	// The custom agent didn't print the stats, so they're calculated from the
+	// logs.
+	assert.Equal(t, map[int64]MinuteStatsItem{
+		time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC).Unix(): {NumMsgs: 1},
+		time.Date(2025, 3, 10, 10, 1, 0, 0, time.UTC).Unix(): {NumMsgs: 1},
+	}, resp.MinuteStats)
+
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		// The bootstrap, to get the example log lines.
+		"|||2",
+		`2025-03-10T09:00:00Z|2025-03-10T11:00:00Z|(index($0, "foo") > 0)|10`,
+	}, strings.Split(strings.TrimSpace(string(env)), "\n"))
+
+	// Any unexpected output fails the query.
+	_, err = n.Query(ctx, QueryLogsParams{
+		From:  from,
+		To:    to,
+		Query: "/malformed/",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `custom agent printed a malformed line "something unexpected"`)
+	}
+}
+
+func TestValidateCustomAgent(t *testing.T) {
+	assert.NoError(t, validateCustomAgent("echo 'm:1:foo'\n"))
+	assert.Error(t, validateCustomAgent(" \n"))
+	assert.Error(t, validateCustomAgent("cat <<EOF\n"+customAgentHeredocDelimiter+"\nEOF\n"))
+}
+
+func TestParseCustomAgentStats(t *testing.T) {
+	ts, num, err := parseCustomAgentStats("1741600830,42")
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC), ts)
+		assert.Equal(t, 42, num)
+	}
+
+	for _, s := range []string{"", "1741600830", "foo,42", "1741600830,-1", "1741600830,42,1"} {
+		_, _, err := parseCustomAgentStats(s)
+		assert.Error(t, err, "%q", s)
+	}
+}
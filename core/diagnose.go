@@ -0,0 +1,779 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+)
+
+// DiagnosisStatus is the outcome of a single check of the DiagnosisReport.
+type DiagnosisStatus string
+
+const (
+	DiagnosisPass DiagnosisStatus = "pass"
+
+	// DiagnosisWarn means that nerdlog should work, but something is off, e.g.
+	// the host's clock is skewed.
+	DiagnosisWarn DiagnosisStatus = "warn"
+
+	DiagnosisFail DiagnosisStatus = "fail"
+
+	// DiagnosisSkipped means that the check couldn't run (e.g. because we
+	// couldn't connect), or it's irrelevant for the logstream (e.g. the
+	// journalctl check when plain log files are used).
+	DiagnosisSkipped DiagnosisStatus = "skipped"
+)
+
+// Names of the checks performed by Diagnose, in the order they're reported.
+const (
+	DiagnosisCheckConnect    = "connect"
+	DiagnosisCheckShell      = "shell"
+	DiagnosisCheckAwk        = "awk"
+	DiagnosisCheckJournalctl = "journalctl"
+	DiagnosisCheckLogFiles   = "log_files"
+	DiagnosisCheckClockSkew  = "clock_skew"
+)
+
+var diagnosisCheckNames = []string{
+	DiagnosisCheckConnect,
+	DiagnosisCheckShell,
+	DiagnosisCheckAwk,
+	DiagnosisCheckJournalctl,
+	DiagnosisCheckLogFiles,
+	DiagnosisCheckClockSkew,
+}
+
+// DiagnosisCheck is the result of a single check.
+type DiagnosisCheck struct {
+	// Name is one of the DiagnosisCheck* constants.
+	Name string
+
+	Status DiagnosisStatus
+
+	// Details is a human-readable description of what was found, like
+	// "GNU Awk 5.1.0" or the connection error.
+	Details string
+
+	// Hint is a human-readable suggestion on how to fix the problem; it's
+	// only set for the failed checks and warnings.
+	Hint string
+}
+
+// DiagnosisReport is the result of Diagnose: it contains all the checks, in
+// the order of diagnosisCheckNames, regardless of whether they've passed.
+type DiagnosisReport struct {
+	// LStream is the name of the diagnosed logstream.
+	LStream string
+
+	Checks []DiagnosisCheck
+
+	// ClockSkew is how much the host's clock is ahead of the local one
+	// (negative if it's behind); only valid if the clock_skew check has
+	// passed or resulted in a warning.
+	ClockSkew time.Duration
+}
+
+// OK returns whether none of the checks have failed; the warnings and the
+// skipped checks are fine.
+func (r *DiagnosisReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Status == DiagnosisFail {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check returns the check with the given name, or false if there's no such
+// check in the report.
+func (r *DiagnosisReport) Check(name string) (DiagnosisCheck, bool) {
+	for _, c := range r.Checks {
+		if c.Name == name {
+			return c, true
+		}
+	}
+
+	return DiagnosisCheck{}, false
+}
+
+// String returns a human-readable multiline report, one check per line, with
+// the hints on separate lines.
+func (r *DiagnosisReport) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Diagnosis of %s:\n", r.LStream)
+	for _, c := range r.Checks {
+		fmt.Fprintf(&sb, "  %-8s %-11s %s\n", "["+string(c.Status)+"]", c.Name, c.Details)
+		if c.Hint != "" {
+			fmt.Fprintf(&sb, "           %-11s hint: %s\n", "", c.Hint)
+		}
+	}
+
+	return sb.String()
+}
+
+// set replaces the check with the same name.
+func (r *DiagnosisReport) set(check DiagnosisCheck) {
+	for i := range r.Checks {
+		if r.Checks[i].Name == check.Name {
+			r.Checks[i] = check
+			return
+		}
+	}
+
+	r.Checks = append(r.Checks, check)
+}
+
+// skipRest marks all the checks which weren't done yet as skipped with the
+// given details.
+func (r *DiagnosisReport) skipRest(details string) {
+	for i := range r.Checks {
+		if r.Checks[i].Status == "" {
+			r.Checks[i].Status = DiagnosisSkipped
+			r.Checks[i].Details = details
+		}
+	}
+}
+
+// DiagnoseProbeTimeout is how long Diagnose waits for the probe script to
+// finish once connected.
+const DiagnoseProbeTimeout = 30 * time.Second
+
+// diagPrefix is the prefix of every line printed by the probe script.
+const diagPrefix = "diag:"
+
+// DiagnoseParams contains the params for the standalone Diagnose; see also
+// Nerdlog.Diagnose which fills them in from the Nerdlog options.
+type DiagnoseParams struct {
+	LogStream LogStream
+
+	// Transport is used to connect to the host; every Diagnose call makes a
+	// separate connection, closed before returning.
+	Transport ShellTransport
+
+	// OnDataRequest is called when the transport needs some data from the
+	// user, the same as Options.OnDataRequest. Optional.
+	OnDataRequest func(req *ShellConnDataRequest)
+
+	// Clock is used for the timeouts and to calculate the clock skew; if nil,
+	// the real clock is used.
+	Clock clock.Clock
+}
+
+// Diagnose connects to the logstream's host and checks whether it's ready to
+// be used by nerdlog: that we can connect, that the shell, gawk and
+// journalctl (if used) are fine, that the log files are readable, and that
+// the host's clock is not skewed too much. It doesn't upload the agent nor
+// touch anything on the host.
+//
+// Every failed check has a hint on how to fix it; the checks which depend on
+// the failed ones are skipped. Diagnose returns an error only if the context
+// is done before the checks are completed.
+func Diagnose(ctx context.Context, params DiagnoseParams) (*DiagnosisReport, error) {
+	if params.Clock == nil {
+		params.Clock = clock.New()
+	}
+
+	report := &DiagnosisReport{LStream: params.LogStream.Name}
+	for _, name := range diagnosisCheckNames {
+		report.Checks = append(report.Checks, DiagnosisCheck{Name: name})
+	}
+
+	conn, err := diagnoseConnect(ctx, params)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Trace(ctx.Err())
+		}
+
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckConnect,
+			Status:  DiagnosisFail,
+			Details: err.Error(),
+			Hint:    connErrHint(connErrCategoryOf(err)),
+		})
+		report.skipRest("not connected")
+
+		return report, nil
+	}
+	defer conn.Close()
+
+	report.set(DiagnosisCheck{
+		Name:    DiagnosisCheckConnect,
+		Status:  DiagnosisPass,
+		Details: "connected",
+	})
+
+	if name := params.LogStream.Transport.EmulatedAgent(); name != "" {
+		report.skipRest(fmt.Sprintf("not applicable to the %s transport", name))
+		return report, nil
+	}
+
+	results, err := runDiagnoseProbe(ctx, conn, params)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	evalDiagnoseProbe(report, params.LogStream, results)
+
+	return report, nil
+}
+
+// diagnoseConnect connects using the params.Transport, and returns the
+// connection.
+func diagnoseConnect(ctx context.Context, params DiagnoseParams) (ShellConn, error) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updCh := make(chan ShellConnUpdate, 8)
+	params.Transport.Connect(connCtx, updCh)
+
+	for {
+		select {
+		case upd := <-updCh:
+			switch {
+			case upd.DataRequest != nil:
+				if params.OnDataRequest != nil {
+					params.OnDataRequest(upd.DataRequest)
+				}
+
+			case upd.Result != nil:
+				if upd.Result.Err != nil {
+					return nil, upd.Result.Err
+				}
+
+				return upd.Result.Conn, nil
+			}
+
+		case <-ctx.Done():
+			// The transport might still succeed to connect, so make sure we close
+			// the connection then.
+			go func() {
+				for upd := range updCh {
+					if upd.Result != nil {
+						if upd.Result.Conn != nil {
+							upd.Result.Conn.Close()
+						}
+						return
+					}
+				}
+			}()
+
+			return nil, errors.Trace(ctx.Err())
+		}
+	}
+}
+
+// diagnoseProbeResults contains the values printed by the probe script.
+type diagnoseProbeResults struct {
+	// done is true if the script has completed; if not, the rest might be
+	// incomplete.
+	done bool
+
+	// shell is the name of the login shell, and bash is the path to bash (empty
+	// if there's no bash).
+	shell string
+	bash  string
+
+	// awk is like "gnu:GNU Awk 5.1.0, API: 3.0" if GNU Awk is found, or like
+	// "other:/usr/bin/mawk" if only some other awk is found, or empty.
+	awk string
+
+	// journalctl is the path to journalctl, or empty if there's no journalctl.
+	journalctl string
+
+	// logFiles contains the results of checking every log file, with the
+	// "auto" already resolved; for journalctl, Filename is "journalctl". If
+	// the log file couldn't be autodetected, it has a single not_found item
+	// with the "auto" filename.
+	logFiles []LStreamVerifyResult
+
+	hostTime  time.Time
+	localTime time.Time
+}
+
+// diagnoseScript returns the probe script for the given logstream. It's
+// written in plain POSIX sh, since it's run by the login shell (and checking
+// this shell is one of the points).
+func diagnoseScript(ls LogStream) string {
+	sudo := ""
+	if ls.Options.SudoMode == SudoModeFull {
+		sudo = "sudo -n "
+	}
+
+	logfilePrev, _ := ls.LogFilePrev()
+
+	lines := []string{
+		`echo "diag:shell:$(ps -p $$ -o comm= 2>/dev/null || echo "$0")"`,
+		`echo "diag:bash:$(command -v bash)"`,
+
+		// Same as find_gawk_binary in the agent.
+		`diag_awk=""`,
+		`for a in gawk awk; do`,
+		`  if command -v "$a" >/dev/null 2>&1; then`,
+		`    v="$("$a" --version 2>&1 | head -n 1)"`,
+		`    case "$v" in *"GNU Awk"*) diag_awk="gnu:$v"; break;; esac`,
+		`    [ -n "$diag_awk" ] || diag_awk="other:$(command -v "$a")"`,
+		`  fi`,
+		`done`,
+		`echo "diag:awk:$diag_awk"`,
+
+		`echo "diag:journalctl:$(command -v journalctl)"`,
+
+		// Resolve the "auto" log files in the same way as the agent does.
+		`logfile_last=` + shellQuote(ls.LogFileLast()),
+		`logfile_prev=` + shellQuote(logfilePrev),
+		`if [ "$logfile_last" = auto ]; then`,
+		`  if [ -e /var/log/messages ]; then logfile_last=/var/log/messages`,
+		`  elif [ -e /var/log/syslog ]; then logfile_last=/var/log/syslog`,
+		`  elif command -v journalctl >/dev/null 2>&1; then logfile_last=journalctl`,
+		`  fi`,
+		`fi`,
+		`if [ "$logfile_prev" = auto ]; then`,
+		`  if [ "$logfile_last" = journalctl ]; then logfile_prev=journalctl; else logfile_prev="$logfile_last.1"; fi`,
+		`fi`,
+
+		`if [ "$logfile_last" = auto ]; then`,
+		`  echo "diag:log_file:not_found:auto"`,
+		`elif [ "$logfile_last" = journalctl ]; then`,
+		`  if ! command -v journalctl >/dev/null 2>&1; then echo "diag:log_file:not_found:journalctl"`,
+		`  elif ! ` + sudo + `journalctl --quiet -n 0 >/dev/null 2>&1; then echo "diag:log_file:permission_denied:journalctl"`,
+		`  else echo "diag:log_file:readable:journalctl"; fi`,
+		`else`,
+		`  for f in "$logfile_last" "$logfile_prev"; do`,
+		`    [ -n "$f" ] || continue`,
+		`    if ! ` + sudo + `test -e "$f"; then echo "diag:log_file:not_found:$f"`,
+		`    elif ! ` + sudo + `test -r "$f"; then echo "diag:log_file:permission_denied:$f"`,
+		`    else echo "diag:log_file:readable:$f"; fi`,
+		`  done`,
+		`fi`,
+
+		`echo "diag:` + hostTimePrefix + `$(date +%s)"`,
+		`echo "diag:done"`,
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// runDiagnoseProbe runs the probe script on the connection, and parses the
+// results. If the script doesn't finish in DiagnoseProbeTimeout (e.g. because
+// the login shell doesn't understand it), the results are incomplete.
+func runDiagnoseProbe(
+	ctx context.Context, conn ShellConn, params DiagnoseParams,
+) (*diagnoseProbeResults, error) {
+	linesCh := make(chan string, 32)
+	go func() {
+		defer close(linesCh)
+
+		scanner := bufio.NewScanner(conn.Stdout())
+		for scanner.Scan() {
+			linesCh <- scanner.Text()
+		}
+	}()
+
+	// If writing fails, the results will just be incomplete, and the shell
+	// check will fail, so the error is ignored.
+	conn.Stdin().Write([]byte(diagnoseScript(params.LogStream)))
+
+	results := &diagnoseProbeResults{}
+	timeoutCh := params.Clock.After(DiagnoseProbeTimeout)
+
+	for !results.done {
+		select {
+		case line, ok := <-linesCh:
+			if !ok {
+				return results, nil
+			}
+
+			parseDiagnoseLine(results, line, params.Clock.Now())
+
+		case <-timeoutCh:
+			return results, nil
+
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+	}
+
+	return results, nil
+}
+
+// parseDiagnoseLine parses a single line printed by the probe script into the
+// results; the lines without the diagPrefix, and the malformed ones, are
+// ignored, since the shell init files might print all kinds of stuff.
+func parseDiagnoseLine(results *diagnoseProbeResults, line string, now time.Time) {
+	if !strings.HasPrefix(line, diagPrefix) {
+		return
+	}
+	line = strings.TrimPrefix(line, diagPrefix)
+
+	if line == "done" {
+		results.done = true
+		return
+	}
+
+	if strings.HasPrefix(line, hostTimePrefix) {
+		hostTime, err := parseHostTime(line)
+		if err == nil {
+			results.hostTime = hostTime
+			results.localTime = now
+		}
+		return
+	}
+
+	idx := strings.IndexRune(line, ':')
+	if idx <= 0 {
+		return
+	}
+
+	key, value := line[:idx], line[idx+1:]
+	switch key {
+	case "shell":
+		results.shell = strings.TrimPrefix(strings.TrimSpace(value), "-")
+	case "bash":
+		results.bash = value
+	case "awk":
+		results.awk = value
+	case "journalctl":
+		results.journalctl = value
+	case "log_file":
+		if res, err := parseVerifyLine(value); err == nil {
+			results.logFiles = append(results.logFiles, res)
+		}
+	}
+}
+
+// nonPOSIXShells are the login shells which can't run the commands nerdlog
+// sends over the connection.
+var nonPOSIXShells = map[string]struct{}{
+	"csh":  {},
+	"tcsh": {},
+	"fish": {},
+	"nu":   {},
+}
+
+// evalDiagnoseProbe fills in the report checks other than connect, according
+// to the probe results.
+func evalDiagnoseProbe(report *DiagnosisReport, ls LogStream, results *diagnoseProbeResults) {
+	// Shell.
+	shellName := results.shell
+	if idx := strings.LastIndex(shellName, "/"); idx >= 0 {
+		shellName = shellName[idx+1:]
+	}
+
+	switch {
+	case !results.done:
+		details := "the probe commands didn't complete"
+		if shellName != "" {
+			details += fmt.Sprintf(" (login shell: %s)", shellName)
+		}
+
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckShell,
+			Status:  DiagnosisFail,
+			Details: details,
+			Hint:    "nerdlog needs a POSIX-compatible login shell which runs the commands from stdin; check the login shell of the user, and the shell init files (like .bashrc) for interactive prompts",
+		})
+		report.skipRest("the probe didn't complete")
+
+		return
+
+	case isNonPOSIXShell(shellName):
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckShell,
+			Status:  DiagnosisFail,
+			Details: fmt.Sprintf("the login shell %s is not POSIX-compatible", shellName),
+			Hint:    "change the login shell of the user to sh or bash, e.g. with chsh",
+		})
+
+	case results.bash == "":
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckShell,
+			Status:  DiagnosisFail,
+			Details: fmt.Sprintf("login shell: %s, but bash is not found", orUnknown(shellName)),
+			Hint:    "install bash, since the nerdlog agent is a bash script",
+		})
+
+	default:
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckShell,
+			Status:  DiagnosisPass,
+			Details: fmt.Sprintf("login shell: %s, bash: %s", orUnknown(shellName), results.bash),
+		})
+	}
+
+	// Awk.
+	switch {
+	case strings.HasPrefix(results.awk, "gnu:"):
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckAwk,
+			Status:  DiagnosisPass,
+			Details: strings.TrimPrefix(results.awk, "gnu:"),
+		})
+
+	case strings.HasPrefix(results.awk, "other:"):
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckAwk,
+			Status:  DiagnosisFail,
+			Details: fmt.Sprintf("only %s is found, which is not GNU Awk", strings.TrimPrefix(results.awk, "other:")),
+			Hint:    "install gawk (GNU Awk), e.g. with: apt install gawk",
+		})
+
+	default:
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckAwk,
+			Status:  DiagnosisFail,
+			Details: "awk is not found",
+			Hint:    "install gawk (GNU Awk), e.g. with: apt install gawk",
+		})
+	}
+
+	// Journalctl and log files. The custom agent reads the logs on its own, so
+	// we can't say anything about them.
+	if ls.Options.CustomAgent != "" {
+		report.skipRest("the logs are read by the custom agent")
+		evalDiagnoseClockSkew(report, results)
+		return
+	}
+
+	usesJournalctl := len(results.logFiles) > 0 &&
+		results.logFiles[0].Filename == SpecialFilenameJournalctl
+
+	if usesJournalctl {
+		report.set(evalDiagnoseJournalctl(results.logFiles[0], ls.Options.SudoMode))
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckLogFiles,
+			Status:  DiagnosisSkipped,
+			Details: "journalctl is used instead of log files",
+		})
+	} else {
+		details := "not used"
+		if results.journalctl != "" {
+			details = fmt.Sprintf("not used (available at %s)", results.journalctl)
+		}
+
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckJournalctl,
+			Status:  DiagnosisSkipped,
+			Details: details,
+		})
+		report.set(evalDiagnoseLogFiles(results.logFiles, ls.Options.SudoMode))
+	}
+
+	evalDiagnoseClockSkew(report, results)
+}
+
+// evalDiagnoseJournalctl returns the journalctl check for the given result
+// of checking journalctl as a log file.
+func evalDiagnoseJournalctl(res LStreamVerifyResult, sudoMode SudoMode) DiagnosisCheck {
+	check := DiagnosisCheck{Name: DiagnosisCheckJournalctl}
+
+	switch res.Status {
+	case LStreamVerifyReadable:
+		check.Status = DiagnosisPass
+		check.Details = "journalctl is readable"
+
+	case LStreamVerifyNotFound:
+		check.Status = DiagnosisFail
+		check.Details = "journalctl is not found"
+		check.Hint = "either install systemd's journalctl, or specify the log files in the logstream config"
+
+	default:
+		check.Status = DiagnosisFail
+		check.Details = "journalctl fails to read the logs"
+		check.Hint = permissionHint(SpecialFilenameJournalctl, sudoMode)
+	}
+
+	return check
+}
+
+// evalDiagnoseLogFiles returns the log_files check for the given results of
+// checking the log files. The missing previous log file is fine, since the
+// agent handles it.
+func evalDiagnoseLogFiles(results []LStreamVerifyResult, sudoMode SudoMode) DiagnosisCheck {
+	check := DiagnosisCheck{Name: DiagnosisCheckLogFiles}
+
+	if len(results) == 0 {
+		check.Status = DiagnosisFail
+		check.Details = "no log files were checked"
+		return check
+	}
+
+	last := results[0]
+	switch {
+	case last.Status == LStreamVerifyNotFound && last.Filename == "auto":
+		check.Status = DiagnosisFail
+		check.Details = "failed to autodetect the log file: neither /var/log/messages nor /var/log/syslog exist, and journalctl is not available either"
+		check.Hint = "specify the log files in the logstream config"
+		return check
+
+	case last.Status == LStreamVerifyNotFound:
+		check.Status = DiagnosisFail
+		check.Details = fmt.Sprintf("%s does not exist", last.Filename)
+		check.Hint = "check the log files in the logstream config"
+		return check
+
+	case last.Status != LStreamVerifyReadable:
+		check.Status = DiagnosisFail
+		check.Details = fmt.Sprintf("%s is not readable", last.Filename)
+		check.Hint = permissionHint(last.Filename, sudoMode)
+		return check
+	}
+
+	readable := []string{last.Filename}
+	check.Status = DiagnosisPass
+
+	for _, res := range results[1:] {
+		switch res.Status {
+		case LStreamVerifyReadable:
+			readable = append(readable, res.Filename)
+		case LStreamVerifyNotFound:
+			// Fine, the agent just pretends it's empty.
+		default:
+			check.Status = DiagnosisFail
+			check.Details = fmt.Sprintf("%s is not readable", res.Filename)
+			check.Hint = permissionHint(res.Filename, sudoMode)
+			return check
+		}
+	}
+
+	check.Details = fmt.Sprintf("readable: %s", strings.Join(readable, ", "))
+
+	return check
+}
+
+// evalDiagnoseClockSkew sets the clock_skew check of the report.
+func evalDiagnoseClockSkew(report *DiagnosisReport, results *diagnoseProbeResults) {
+	if results.hostTime.IsZero() {
+		report.set(DiagnosisCheck{
+			Name:    DiagnosisCheckClockSkew,
+			Status:  DiagnosisSkipped,
+			Details: "the host time is unknown",
+		})
+		return
+	}
+
+	skew := calcClockSkew(results.hostTime, results.localTime)
+	report.ClockSkew = skew
+
+	check := DiagnosisCheck{
+		Name:    DiagnosisCheckClockSkew,
+		Status:  DiagnosisPass,
+		Details: FormatClockSkew(report.LStream, skew),
+	}
+
+	if isClockSkewTooLarge(skew) {
+		check.Status = DiagnosisWarn
+		check.Hint = fmt.Sprintf(
+			"the skew is over %s, so the time ranges of the queries will be off; make sure that NTP is running on the host (and locally)",
+			ClockSkewWarnThreshold,
+		)
+	}
+
+	report.set(check)
+}
+
+// connErrHint returns the remediation hint for the connection errors of the
+// given category.
+func connErrHint(category ConnErrCategory) string {
+	switch category {
+	case ConnErrCategoryAuth:
+		return "check the user and the ssh keys (see --ssh-key), and that the key is authorized on the host; try connecting with plain ssh"
+	case ConnErrCategoryDNS:
+		return "check the hostname, and the HostName in the ssh config if any"
+	case ConnErrCategoryUnreachable, ConnErrCategoryRefused:
+		return "check that the host is up, and that sshd listens on the port"
+	case ConnErrCategoryTimeout:
+		return "the host might be down or firewalled; if it's just slow, increase the timeouts (see conn_timeouts in the logstream config)"
+	case ConnErrCategoryShellNotFound:
+		return "check that the ssh binary (or the custom shell command) is installed"
+	case ConnErrCategoryNoMarker:
+		return "the shell has started but doesn't run the commands from stdin; check the shell init files (like .bashrc) for interactive prompts"
+	}
+
+	return ""
+}
+
+// permissionHint returns the remediation hint for the log file (or
+// journalctl) which is not readable.
+func permissionHint(filename string, sudoMode SudoMode) string {
+	if sudoMode == SudoModeFull {
+		return "the user has to be able to run sudo without a password (sudo -n)"
+	}
+
+	if filename == SpecialFilenameJournalctl {
+		return "add the user to the systemd-journal (or adm) group, or use sudo_mode: full in the logstream config"
+	}
+
+	return fmt.Sprintf("add the user to the group owning %s (typically adm), or use sudo_mode: full in the logstream config", filename)
+}
+
+func isNonPOSIXShell(name string) bool {
+	_, ok := nonPOSIXShells[name]
+	return ok
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+
+	return s
+}
+
+// Diagnose resolves the given logstream spec, which must resolve to a single
+// logstream, and diagnoses it; see the standalone Diagnose for the details.
+// It makes a separate connection, regardless of whether the logstream is
+// already connected.
+func (n *Nerdlog) Diagnose(ctx context.Context, lstream string) (*DiagnosisReport, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, errors.Annotatef(err, "getting current OS user")
+	}
+
+	resolver := NewLStreamsResolver(LStreamsResolverParams{
+		CurOSUser:            u.Username,
+		DefaultTransportMode: n.opts.DefaultTransportMode,
+		ConfigLogStreams:     n.opts.ConfigLogStreams,
+		SSHConfig:            n.opts.SSHConfig,
+	})
+
+	resolved, err := resolver.Resolve(lstream)
+	if err != nil {
+		return nil, errors.Annotatef(err, "resolving logstream")
+	}
+
+	if len(resolved) != 1 {
+		return nil, errors.Errorf("%q resolves to %d logstreams, but exactly one is needed", lstream, len(resolved))
+	}
+
+	var ls LogStream
+	for _, v := range resolved {
+		ls = v
+	}
+
+	var transport ShellTransport
+	if n.opts.NewTransport != nil {
+		transport = n.opts.NewTransport(ls)
+	} else {
+		transport = createTransport(
+			ls.Transport, n.opts.SSHKeys, n.opts.SSHCert, n.opts.SSHPKCS11, n.opts.SSHCredentialProvider,
+			n.opts.HostKeys,
+			nil, nil, ls.Options.ConnTimeouts, ls.Options.ConnStderrPatterns,
+			cachedBusybox(n.opts.CapabilitiesCache, ls), n.opts.Logger,
+		)
+	}
+
+	return Diagnose(ctx, DiagnoseParams{
+		LogStream:     ls,
+		Transport:     transport,
+		OnDataRequest: n.opts.OnDataRequest,
+		Clock:         n.opts.Clock,
+	})
+}
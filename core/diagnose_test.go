@@ -0,0 +1,301 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDiagnoseTransport connects to a fakeDiagnoseConn printing the given
+// stdout, or fails with connErr if it's not nil.
+type fakeDiagnoseTransport struct {
+	stdout  string
+	connErr error
+
+	// stdin receives everything written to the connection.
+	stdin bytes.Buffer
+}
+
+func (t *fakeDiagnoseTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	if t.connErr != nil {
+		resCh <- ShellConnUpdate{Result: &ShellConnResult{Err: t.connErr}}
+		return
+	}
+
+	resCh <- ShellConnUpdate{
+		Result: &ShellConnResult{
+			Conn: &fakeDiagnoseConn{
+				stdin:  &t.stdin,
+				stdout: strings.NewReader(t.stdout),
+			},
+		},
+	}
+}
+
+type fakeDiagnoseConn struct {
+	stdin  io.Writer
+	stdout io.Reader
+}
+
+func (c *fakeDiagnoseConn) Stdin() io.Writer  { return c.stdin }
+func (c *fakeDiagnoseConn) Stdout() io.Reader { return c.stdout }
+func (c *fakeDiagnoseConn) Stderr() io.Reader { return strings.NewReader("") }
+func (c *fakeDiagnoseConn) Close()            {}
+
+func TestDiagnose(t *testing.T) {
+	now := time.Now()
+	hostTimeLine := fmt.Sprintf("diag:host_time:%d", now.Unix())
+
+	healthyLines := []string{
+		"diag:shell:-bash",
+		"diag:bash:/usr/bin/bash",
+		"diag:awk:gnu:GNU Awk 5.1.0, API: 3.0",
+		"diag:journalctl:/usr/bin/journalctl",
+		"diag:log_file:readable:/var/log/syslog",
+		"diag:log_file:not_found:/var/log/syslog.1",
+		hostTimeLine,
+		"diag:done",
+	}
+
+	type testCase struct {
+		name      string
+		logFiles  []string
+		sudoMode  SudoMode
+		connErr   error
+		stdout    []string
+		want      map[string]DiagnosisStatus
+		wantOK    bool
+		wantHints map[string]string
+	}
+
+	testCases := []testCase{
+		{
+			name:     "healthy",
+			logFiles: []string{"auto", "auto"},
+			stdout:   healthyLines,
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisPass,
+				DiagnosisCheckShell:      DiagnosisPass,
+				DiagnosisCheckAwk:        DiagnosisPass,
+				DiagnosisCheckJournalctl: DiagnosisSkipped,
+				DiagnosisCheckLogFiles:   DiagnosisPass,
+				DiagnosisCheckClockSkew:  DiagnosisPass,
+			},
+			wantOK: true,
+		},
+		{
+			name:     "auth failure",
+			logFiles: []string{"/var/log/syslog"},
+			connErr:  classifyErr(ConnErrCategoryAuth, errors.New("ssh: unable to authenticate")),
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisFail,
+				DiagnosisCheckShell:      DiagnosisSkipped,
+				DiagnosisCheckAwk:        DiagnosisSkipped,
+				DiagnosisCheckJournalctl: DiagnosisSkipped,
+				DiagnosisCheckLogFiles:   DiagnosisSkipped,
+				DiagnosisCheckClockSkew:  DiagnosisSkipped,
+			},
+			wantHints: map[string]string{
+				DiagnosisCheckConnect: "authorized on the host",
+			},
+		},
+		{
+			name:     "no gawk and no bash",
+			logFiles: []string{"/var/log/syslog"},
+			stdout: []string{
+				"diag:shell:sh",
+				"diag:bash:",
+				"diag:awk:other:/usr/bin/mawk",
+				"diag:journalctl:",
+				"diag:log_file:readable:/var/log/syslog",
+				hostTimeLine,
+				"diag:done",
+			},
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisPass,
+				DiagnosisCheckShell:      DiagnosisFail,
+				DiagnosisCheckAwk:        DiagnosisFail,
+				DiagnosisCheckJournalctl: DiagnosisSkipped,
+				DiagnosisCheckLogFiles:   DiagnosisPass,
+				DiagnosisCheckClockSkew:  DiagnosisPass,
+			},
+			wantHints: map[string]string{
+				DiagnosisCheckShell: "install bash",
+				DiagnosisCheckAwk:   "install gawk",
+			},
+		},
+		{
+			name:     "journalctl permission denied, clock skew",
+			logFiles: []string{"journalctl"},
+			stdout: []string{
+				"some motd printed by .bashrc",
+				"diag:shell:bash",
+				"diag:bash:/bin/bash",
+				"diag:awk:gnu:GNU Awk 5.1.0, API: 3.0",
+				"diag:journalctl:/usr/bin/journalctl",
+				"diag:log_file:permission_denied:journalctl",
+				fmt.Sprintf("diag:host_time:%d", now.Add(2*time.Minute).Unix()),
+				"diag:done",
+			},
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisPass,
+				DiagnosisCheckShell:      DiagnosisPass,
+				DiagnosisCheckAwk:        DiagnosisPass,
+				DiagnosisCheckJournalctl: DiagnosisFail,
+				DiagnosisCheckLogFiles:   DiagnosisSkipped,
+				DiagnosisCheckClockSkew:  DiagnosisWarn,
+			},
+			wantHints: map[string]string{
+				DiagnosisCheckJournalctl: "systemd-journal",
+				DiagnosisCheckClockSkew:  "NTP",
+			},
+		},
+		{
+			name:     "log file not readable with sudo",
+			logFiles: []string{"/var/log/app.log", "/var/log/app.log.1"},
+			sudoMode: SudoModeFull,
+			stdout: []string{
+				"diag:shell:bash",
+				"diag:bash:/bin/bash",
+				"diag:awk:gnu:GNU Awk 5.1.0, API: 3.0",
+				"diag:journalctl:",
+				"diag:log_file:readable:/var/log/app.log",
+				"diag:log_file:permission_denied:/var/log/app.log.1",
+				hostTimeLine,
+				"diag:done",
+			},
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisPass,
+				DiagnosisCheckShell:      DiagnosisPass,
+				DiagnosisCheckAwk:        DiagnosisPass,
+				DiagnosisCheckJournalctl: DiagnosisSkipped,
+				DiagnosisCheckLogFiles:   DiagnosisFail,
+				DiagnosisCheckClockSkew:  DiagnosisPass,
+			},
+			wantHints: map[string]string{
+				DiagnosisCheckLogFiles: "sudo -n",
+			},
+		},
+		{
+			name:     "log file autodetection fails",
+			logFiles: []string{"auto", "auto"},
+			stdout: []string{
+				"diag:shell:bash",
+				"diag:bash:/bin/bash",
+				"diag:awk:gnu:GNU Awk 5.1.0, API: 3.0",
+				"diag:journalctl:",
+				"diag:log_file:not_found:auto",
+				hostTimeLine,
+				"diag:done",
+			},
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisPass,
+				DiagnosisCheckShell:      DiagnosisPass,
+				DiagnosisCheckAwk:        DiagnosisPass,
+				DiagnosisCheckJournalctl: DiagnosisSkipped,
+				DiagnosisCheckLogFiles:   DiagnosisFail,
+				DiagnosisCheckClockSkew:  DiagnosisPass,
+			},
+			wantHints: map[string]string{
+				DiagnosisCheckLogFiles: "specify the log files",
+			},
+		},
+		{
+			// The login shell doesn't understand the probe script, so it never
+			// completes.
+			name:     "non-POSIX shell",
+			logFiles: []string{"/var/log/syslog"},
+			stdout: []string{
+				"fish: Unsupported use of '='.",
+			},
+			want: map[string]DiagnosisStatus{
+				DiagnosisCheckConnect:    DiagnosisPass,
+				DiagnosisCheckShell:      DiagnosisFail,
+				DiagnosisCheckAwk:        DiagnosisSkipped,
+				DiagnosisCheckJournalctl: DiagnosisSkipped,
+				DiagnosisCheckLogFiles:   DiagnosisSkipped,
+				DiagnosisCheckClockSkew:  DiagnosisSkipped,
+			},
+			wantHints: map[string]string{
+				DiagnosisCheckShell: "POSIX-compatible",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		transport := &fakeDiagnoseTransport{
+			stdout:  strings.Join(tc.stdout, "\n") + "\n",
+			connErr: tc.connErr,
+		}
+
+		report, err := Diagnose(context.Background(), DiagnoseParams{
+			LogStream: LogStream{
+				Name:     "web-01",
+				LogFiles: tc.logFiles,
+				Options:  LogStreamOptions{SudoMode: tc.sudoMode},
+			},
+			Transport: transport,
+		})
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+
+		got := map[string]DiagnosisStatus{}
+		for _, c := range report.Checks {
+			got[c.Name] = c.Status
+		}
+		assert.Equal(t, tc.want, got, tc.name)
+		assert.Equal(t, tc.wantOK, report.OK(), tc.name)
+
+		for name, hint := range tc.wantHints {
+			check, _ := report.Check(name)
+			assert.Contains(t, check.Hint, hint, "%s: %s", tc.name, name)
+		}
+
+		if tc.connErr == nil {
+			assert.Contains(t, transport.stdin.String(), `echo "diag:done"`, tc.name)
+		}
+	}
+}
+
+func TestDiagnoseLocalShell(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "app.log")
+	if err := ioutil.WriteFile(logFile, []byte("foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	report, err := Diagnose(ctx, DiagnoseParams{
+		LogStream: LogStream{
+			Name:     "localhost",
+			LogFiles: []string{logFile, logFile + ".1"},
+		},
+		Transport: NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
+			ShellCommand: LocalShellCommand,
+		}),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logFiles, _ := report.Check(DiagnosisCheckLogFiles)
+	assert.Equal(t, DiagnosisPass, logFiles.Status, report.String())
+	assert.Equal(t, "readable: "+logFile, logFiles.Details)
+
+	clockSkew, _ := report.Check(DiagnosisCheckClockSkew)
+	assert.Equal(t, DiagnosisPass, clockSkew.Status, report.String())
+
+	shell, _ := report.Check(DiagnosisCheckShell)
+	assert.NotEqual(t, DiagnosisSkipped, shell.Status, report.String())
+}
@@ -0,0 +1,482 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/dimonomid/nerdlog/shellescape"
+	"github.com/juju/errors"
+)
+
+// emulatedAgentTimeLayout is the layout of the timestamps in the log lines
+// which the emulatedAgentConn makes from the records. It's one of the layouts
+// known to DetectTimeLayout, so these lines are then parsed as usual.
+const emulatedAgentTimeLayout = "2006-01-02T15:04:05.000000-07:00"
+
+// emulatedAgentQuery contains the params of the query, as given by the
+// LStreamClient to the emulated agent.
+type emulatedAgentQuery struct {
+	from        time.Time
+	to          time.Time
+	maxNumLines int
+	query       string
+
+	// aggregateOnly is set if only the stats are needed, without the logs.
+	aggregateOnly bool
+
+	// untilPrecise and skipNLatest are used when loading earlier logs: only the
+	// logs until untilPrecise (inclusive) are needed, except the skipNLatest
+	// ones exactly on untilPrecise, which we already have.
+	untilPrecise time.Time
+	skipNLatest  int
+}
+
+// parseEmulatedAgentQueryArgs parses the args of the agent's query command,
+// like "query --max-num-lines 250 --from 2025-03-10-10:00 'some query'".
+func parseEmulatedAgentQueryArgs(args []string) (emulatedAgentQuery, error) {
+	var q emulatedAgentQuery
+	var untilSeconds time.Time
+
+	parseTime := func(layout, v string) (time.Time, error) {
+		// The LStreamClient formats the times in the host's timezone, which is
+		// UTC as reported by the emulated agent.
+		t, err := time.ParseInLocation(layout, v, time.UTC)
+		return t, errors.Trace(err)
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--refresh-index" {
+			// There is no index.
+			continue
+		}
+
+		if arg == "--aggregate-only" {
+			q.aggregateOnly = true
+			continue
+		}
+
+		if !strings.HasPrefix(arg, "-") {
+			q.query = arg
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return q, errors.Errorf("no value for %s", arg)
+		}
+		i++
+		v := args[i]
+
+		var err error
+		switch arg {
+		case "-l", "--max-num-lines":
+			q.maxNumLines, err = strconv.Atoi(v)
+		case "--from":
+			q.from, err = parseTime(queryLogsArgsTimeLayout, v)
+		case "--to":
+			q.to, err = parseTime(queryLogsArgsTimeLayout, v)
+		case "--timestamp-until-seconds":
+			untilSeconds, err = parseTime(queryLogsTimestampUntilSecondsTimeLayout, v)
+		case "--timestamp-until-precise":
+			q.untilPrecise, err = parseTime(queryLogsTimestampUntilPreciseTimeLayout, v)
+		case "--skip-n-latest":
+			q.skipNLatest, err = strconv.Atoi(v)
+		}
+
+		if err != nil {
+			return q, errors.Annotatef(err, "parsing %s", arg)
+		}
+	}
+
+	// The source doesn't need to know about the precise timestamp: just query
+	// until the next whole second, and filter out the rest locally.
+	if !untilSeconds.IsZero() && (q.to.IsZero() || untilSeconds.Before(q.to)) {
+		q.to = untilSeconds
+	}
+
+	return q, nil
+}
+
+// emulatedLogRecord is a single log record returned by the
+// emulatedAgentSource.
+type emulatedLogRecord struct {
+	Time    time.Time
+	Msg     string
+	Host    string
+	Program string
+	Pid     string
+}
+
+// logLine formats the record as a syslog-like log line, which is then parsed
+// by the LStreamClient as usual.
+func (r *emulatedLogRecord) logLine(defaultHost string) string {
+	host := r.Host
+	if host == "" {
+		host = defaultHost
+	}
+
+	program := r.Program
+	if program == "" {
+		program = "-"
+	}
+
+	if r.Pid != "" {
+		program += fmt.Sprintf("[%s]", r.Pid)
+	}
+
+	msg := strings.ReplaceAll(r.Msg, "\n", " ")
+
+	return fmt.Sprintf(
+		"%s %s %s: %s",
+		r.Time.UTC().Format(emulatedAgentTimeLayout),
+		strings.ReplaceAll(host, " ", "_"),
+		strings.ReplaceAll(program, " ", "_"),
+		msg,
+	)
+}
+
+// emulatedAgentSource gets the log records for the emulatedAgentConn.
+type emulatedAgentSource interface {
+	// getRecords returns the records for the given query. The records don't
+	// have to be sorted, and the ones outside of the query's time range are
+	// ignored.
+	getRecords(ctx context.Context, q emulatedAgentQuery) ([]emulatedLogRecord, error)
+}
+
+type emulatedAgentConnParams struct {
+	// TransportName is the name of the transport, like "http-ndjson", to be
+	// used in the error messages.
+	TransportName string
+
+	// Filename is the log filename reported by the emulated agent, like
+	// SpecialFilenameHTTPNDJSON.
+	Filename string
+
+	// Host is used for the records which don't have the Host.
+	Host string
+
+	Source emulatedAgentSource
+
+	Logger *log.Logger
+}
+
+// emulatedAgentConn is the ShellConn for the transports which don't provide
+// any actual shell (like ShellTransportHTTPNDJSON): it emulates the shell
+// with the nerdlog_agent.sh, by interpreting the commands written by the
+// LStreamClient, and for every query, getting the records from the
+// emulatedAgentSource and printing them the same way the agent would. So the
+// logs, the minute stats etc are merged with the other logstreams as usual.
+type emulatedAgentConn struct {
+	params emulatedAgentConnParams
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stdin *emulatedAgentStdin
+
+	stdoutR *io.PipeReader
+	stdoutW *io.PipeWriter
+	stderrR *io.PipeReader
+	stderrW *io.PipeWriter
+
+	inHeredoc bool
+}
+
+func newEmulatedAgentConn(params emulatedAgentConnParams) *emulatedAgentConn {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &emulatedAgentConn{
+		params: params,
+		ctx:    ctx,
+		cancel: cancel,
+		stdin: &emulatedAgentStdin{
+			notifyCh: make(chan struct{}, 1),
+		},
+	}
+
+	c.stdoutR, c.stdoutW = io.Pipe()
+	c.stderrR, c.stderrW = io.Pipe()
+
+	go c.run()
+
+	return c
+}
+
+func (c *emulatedAgentConn) Stdin() io.Writer  { return c.stdin }
+func (c *emulatedAgentConn) Stdout() io.Reader { return c.stdoutR }
+func (c *emulatedAgentConn) Stderr() io.Reader { return c.stderrR }
+
+func (c *emulatedAgentConn) Close() {
+	c.cancel()
+	c.stdin.close()
+}
+
+func (c *emulatedAgentConn) run() {
+	defer c.stdoutW.Close()
+	defer c.stderrW.Close()
+
+	for {
+		line, ok := c.stdin.readLine()
+		if !ok {
+			return
+		}
+
+		c.handleLine(line)
+	}
+}
+
+func (c *emulatedAgentConn) stdout(format string, a ...interface{}) {
+	fmt.Fprintf(c.stdoutW, format+"\n", a...)
+}
+
+func (c *emulatedAgentConn) stderr(format string, a ...interface{}) {
+	fmt.Fprintf(c.stderrW, format+"\n", a...)
+}
+
+// handleLine handles a single line of the commands written by the
+// LStreamClient (see LStreamClient.writeCmd); the lines which don't matter
+// for the emulated agent are just ignored.
+func (c *emulatedAgentConn) handleLine(line string) {
+	switch {
+	case c.inHeredoc:
+		// Uploading of the agent script, which we don't need.
+		c.inHeredoc = line != "EOF"
+
+	case strings.Contains(line, "<<- 'EOF'"):
+		c.inHeredoc = true
+
+	case line == "echo reset_output":
+		c.stdout("reset_output")
+
+	case line == "echo reset_output 1>&2":
+		c.stderr("reset_output")
+
+	case line == "echo exit_code:$?":
+		c.stdout("exit_code:0")
+
+	case line == "  echo 'bootstrap ok'":
+		c.stdout("bootstrap ok")
+
+	case strings.HasSuffix(line, "&& echo '"+wireCompressionOKMarker+"'"):
+		// The output isn't actually compressed, but since it's not
+		// transferred anywhere, it doesn't matter.
+		c.stdout(wireCompressionOKMarker)
+
+	case strings.HasPrefix(line, "echo 'command_done:"):
+		msg := strings.TrimPrefix(line, "echo '")
+		msg = msg[:strings.IndexRune(msg, '\'')]
+
+		if strings.HasSuffix(line, "1>&2") {
+			c.stderr("%s", msg)
+		} else {
+			c.stdout("%s", msg)
+		}
+
+	case strings.Contains(line, " logstream_info "):
+		// The timestamps are always formatted in UTC, and the example line lets
+		// the LStreamClient detect the format.
+		c.stdout("host_timezone:UTC")
+		record := emulatedLogRecord{Time: time.Now(), Msg: "example"}
+		c.stdout("example_log_line:%s", record.logLine(c.params.Host))
+
+	case strings.Contains(line, " verify "):
+		// There are no log files to check here, so as long as we're connected,
+		// consider the logs readable; the actual records are only requested by
+		// the queries.
+		c.stdout("verify:readable:%s", c.params.Filename)
+		c.stdout("exit_code:0")
+
+	case strings.Contains(line, adHocOutPrefix):
+		// There is no shell to run the ad hoc commands in.
+		c.stdout("error:ad hoc commands are not supported by the %s transport", c.params.TransportName)
+
+	case strings.Contains(line, " query "):
+		if err := c.handleQuery(line); err != nil {
+			c.params.Logger.Errorf("Query failed: %s", err.Error())
+			c.stdout("error:%s", err.Error())
+			c.stdout("exit_code:1")
+			return
+		}
+
+		// Printed by the agent's trap.
+		c.stdout("exit_code:0")
+	}
+}
+
+func (c *emulatedAgentConn) handleQuery(line string) error {
+	words, err := shellescape.Parse(line)
+	if err != nil {
+		return errors.Annotatef(err, "parsing query command")
+	}
+
+	// Get the args of the query command: everything after the "query" and
+	// until the end of the pipeline.
+	var args []string
+	for i, word := range words {
+		if word == "query" {
+			args = words[i+1:]
+			break
+		}
+	}
+
+	for i, arg := range args {
+		if arg == "|" || arg == ";" {
+			args = args[:i]
+			break
+		}
+	}
+
+	q, err := parseEmulatedAgentQueryArgs(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	records, err := c.params.Source.getRecords(c.ctx, q)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	records = filterEmulatedRecords(records, q)
+
+	timeDescr, err := GenerateTimeDescr(emulatedAgentTimeLayout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Like the agent, print the stats for all the records, and the logs for
+	// the latest maxNumLines of them.
+	minuteStats := map[string]int{}
+	var minuteKeys []string
+	for _, r := range records {
+		minuteKey := r.Time.UTC().Format(timeDescr.MinuteKeyLayout)
+		if minuteStats[minuteKey] == 0 {
+			minuteKeys = append(minuteKeys, minuteKey)
+		}
+		minuteStats[minuteKey]++
+	}
+
+	logRecords := records
+	if q.aggregateOnly {
+		logRecords = nil
+	} else if q.maxNumLines > 0 && len(logRecords) > q.maxNumLines {
+		logRecords = logRecords[len(logRecords)-q.maxNumLines:]
+	}
+
+	c.stdout("logfile:%s:0", c.params.Filename)
+	for i, r := range logRecords {
+		c.stdout("m:%d:%s", i+1, r.logLine(c.params.Host))
+	}
+
+	for _, k := range minuteKeys {
+		c.stdout("s:%s,%d", k, minuteStats[k])
+	}
+
+	return nil
+}
+
+// filterEmulatedRecords returns the sorted records matching the query's time
+// range, except the latest ones which we already have.
+func filterEmulatedRecords(records []emulatedLogRecord, q emulatedAgentQuery) []emulatedLogRecord {
+	filtered := make([]emulatedLogRecord, 0, len(records))
+	for _, r := range records {
+		// The source might not respect the time range exactly, so check it
+		// here as well.
+		if (!q.from.IsZero() && r.Time.Before(q.from)) || (!q.to.IsZero() && !r.Time.Before(q.to)) {
+			continue
+		}
+
+		if !q.untilPrecise.IsZero() && r.Time.After(q.untilPrecise) {
+			continue
+		}
+
+		filtered = append(filtered, r)
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return filtered[i].Time.Before(filtered[j].Time)
+	})
+
+	// Skip the latest records which we already have.
+	if !q.untilPrecise.IsZero() {
+		for n := 0; n < q.skipNLatest && len(filtered) > 0; n++ {
+			if !filtered[len(filtered)-1].Time.Equal(q.untilPrecise) {
+				break
+			}
+
+			filtered = filtered[:len(filtered)-1]
+		}
+	}
+
+	return filtered
+}
+
+// emulatedAgentStdin buffers everything written to the stdin of the
+// emulatedAgentConn, so that writing never blocks: the LStreamClient writes
+// the whole command before reading any output.
+type emulatedAgentStdin struct {
+	mtx    sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+
+	// notifyCh gets a value whenever more data is written, or stdin is closed.
+	notifyCh chan struct{}
+}
+
+func (s *emulatedAgentStdin) Write(p []byte) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	s.buf.Write(p)
+	s.notify()
+
+	return len(p), nil
+}
+
+func (s *emulatedAgentStdin) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+	s.notify()
+}
+
+func (s *emulatedAgentStdin) notify() {
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// readLine blocks until there is a full line written, and returns it without
+// the trailing newline. Once stdin is closed, it returns false.
+func (s *emulatedAgentStdin) readLine() (string, bool) {
+	for {
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			return "", false
+		}
+
+		if idx := bytes.IndexByte(s.buf.Bytes(), '\n'); idx >= 0 {
+			line := string(s.buf.Next(idx + 1))
+			s.mtx.Unlock()
+			return strings.TrimSuffix(line, "\n"), true
+		}
+		s.mtx.Unlock()
+
+		<-s.notifyCh
+	}
+}
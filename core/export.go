@@ -0,0 +1,221 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ExportFormat specifies how log messages are serialized when exported
+// outside of nerdlog, e.g. printed to stdout in headless mode.
+type ExportFormat string
+
+const (
+	// ExportFormatRaw prints just the original log lines, as they are in the
+	// log files.
+	ExportFormatRaw ExportFormat = "raw"
+
+	// ExportFormatJSON prints every message as a separate JSON object on its own
+	// line (NDJSON), see ExportedLogMsg for the fields.
+	ExportFormatJSON ExportFormat = "json"
+
+	// ExportFormatCSV prints messages as CSV, with a header line.
+	ExportFormatCSV ExportFormat = "csv"
+)
+
+var ValidExportFormats = map[ExportFormat]struct{}{
+	ExportFormatRaw:  {},
+	ExportFormatJSON: {},
+	ExportFormatCSV:  {},
+}
+
+// ParseExportFormat parses a string like "json" as an ExportFormat, and
+// returns an error if the format is unknown.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	format := ExportFormat(s)
+	if _, ok := ValidExportFormats[format]; !ok {
+		validFormats := make([]string, 0, len(ValidExportFormats))
+		for f := range ValidExportFormats {
+			validFormats = append(validFormats, string(f))
+		}
+		sort.Strings(validFormats)
+
+		return "", errors.Errorf("invalid export format %q; valid options are: %s", s, validFormats)
+	}
+
+	return format, nil
+}
+
+// exportTimeLayout is used to format timestamps in the JSON and CSV exports.
+const exportTimeLayout = time.RFC3339Nano
+
+// csvExportHeader is the header line for the CSV export. The labels are in
+// a single column, formatted like "env=prod,region=eu", since the set of the
+// labels can be different for every logstream.
+var csvExportHeader = []string{"time", "lstream", "level", "msg", "labels"}
+
+// ExportedLogMsg is the JSON representation of a LogMsg, used by
+// ExportFormatJSON.
+type ExportedLogMsg struct {
+	Time     string            `json:"time"`
+	LStream  string            `json:"lstream"`
+	Level    string            `json:"level,omitempty"`
+	Msg      string            `json:"msg"`
+	Context  map[string]string `json:"context,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	OrigLine string            `json:"orig_line"`
+	Late     bool              `json:"late,omitempty"`
+}
+
+// LogExporter writes log messages to the underlying writer, in the given
+// format. It's not safe for concurrent use.
+type LogExporter struct {
+	w      io.Writer
+	format ExportFormat
+
+	csvWriter   *csv.Writer
+	wroteHeader bool
+
+	// columns, if not empty, define the CSV columns; see SetColumns.
+	columns Columns
+}
+
+// NewLogExporter creates a new LogExporter. The format must be valid (see
+// ParseExportFormat), otherwise NewLogExporter panics.
+func NewLogExporter(w io.Writer, format ExportFormat) *LogExporter {
+	if _, ok := ValidExportFormats[format]; !ok {
+		panic(fmt.Sprintf("invalid export format %q", format))
+	}
+
+	e := &LogExporter{
+		w:      w,
+		format: format,
+	}
+
+	if format == ExportFormatCSV {
+		e.csvWriter = csv.NewWriter(w)
+	}
+
+	return e
+}
+
+// SetColumns makes the CSV export use the given columns, in the given order,
+// instead of the default ones; see Columns. The other formats are not
+// affected. It must be called before the first Write.
+func (e *LogExporter) SetColumns(cols Columns) {
+	e.columns = cols
+}
+
+// Write writes a single log message.
+func (e *LogExporter) Write(msg LogMsg) error {
+	switch e.format {
+	case ExportFormatRaw:
+		if _, err := fmt.Fprintln(e.w, msg.OrigLine); err != nil {
+			return errors.Trace(err)
+		}
+
+	case ExportFormatJSON:
+		data, err := json.Marshal(NewExportedLogMsg(msg))
+		if err != nil {
+			return errors.Annotatef(err, "marshaling log message")
+		}
+
+		data = append(data, '\n')
+		if _, err := e.w.Write(data); err != nil {
+			return errors.Trace(err)
+		}
+
+	case ExportFormatCSV:
+		if !e.wroteHeader {
+			header := csvExportHeader
+			if len(e.columns) > 0 {
+				header = e.columns.Header()
+			}
+
+			if err := e.csvWriter.Write(header); err != nil {
+				return errors.Trace(err)
+			}
+			e.wroteHeader = true
+		}
+
+		if len(e.columns) > 0 {
+			if err := e.csvWriter.Write(e.columns.Row(msg)); err != nil {
+				return errors.Trace(err)
+			}
+
+			break
+		}
+
+		exported := NewExportedLogMsg(msg)
+		if err := e.csvWriter.Write([]string{
+			exported.Time, exported.LStream, exported.Level, exported.Msg,
+			formatLStreamLabels(exported.Labels),
+		}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// WriteAll writes all the given log messages, and flushes the exporter.
+func (e *LogExporter) WriteAll(msgs []LogMsg) error {
+	for _, msg := range msgs {
+		if err := e.Write(msg); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return e.Flush()
+}
+
+// Flush flushes any buffered data to the underlying writer. It must be called
+// after the last Write.
+func (e *LogExporter) Flush() error {
+	if e.csvWriter != nil {
+		e.csvWriter.Flush()
+		if err := e.csvWriter.Error(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// NewExportedLogMsg converts LogMsg to its exported representation.
+func NewExportedLogMsg(msg LogMsg) ExportedLogMsg {
+	ret := ExportedLogMsg{
+		Time:     msg.Time.Format(exportTimeLayout),
+		LStream:  msg.Context["lstream"],
+		Level:    string(msg.Level),
+		Msg:      msg.Msg,
+		Labels:   msg.Labels,
+		OrigLine: msg.OrigLine,
+		Late:     msg.Late,
+	}
+
+	// Copy all the context except lstream and the labels, which have their own
+	// fields already.
+	for k, v := range msg.Context {
+		if k == "lstream" {
+			continue
+		}
+
+		if _, ok := msg.Labels[k]; ok {
+			continue
+		}
+
+		if ret.Context == nil {
+			ret.Context = make(map[string]string, len(msg.Context))
+		}
+
+		ret.Context[k] = v
+	}
+
+	return ret
+}
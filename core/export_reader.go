@@ -0,0 +1,168 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// LogsProducer produces the logs for the LogsReader: it calls emit with
+// every batch of the logs, in the order they should be written, until either
+// it's done or the ctx is cancelled. If emit returns an error (which happens
+// when the LogsReader is closed), the producer must stop and return.
+type LogsProducer func(ctx context.Context, emit func(logs []LogMsg) error) error
+
+// LogsReader is an io.ReadCloser which yields the logs coming from a
+// LogsProducer, formatted by the LogExporter. It's meant for piping the logs
+// to external tools: every batch is made available to the reader as soon as
+// it's emitted, and since nothing is buffered in between (except a single
+// small write buffer), the producer is blocked until the reader catches up.
+//
+// Closing the reader cancels the producer's context, so e.g. if the
+// downstream reader is gone, the query is abandoned instead of keeping
+// fetching the logs nobody is going to read.
+type LogsReader struct {
+	pr     *io.PipeReader
+	cancel context.CancelFunc
+
+	// doneCh is closed once the producer returns.
+	doneCh chan struct{}
+}
+
+var _ io.ReadCloser = &LogsReader{}
+
+// NewLogsReader starts the producer in a separate goroutine, and returns the
+// reader yielding its logs in the given format. Once the producer returns,
+// the reader returns io.EOF, or the error returned by the producer. The
+// format must be valid (see ParseExportFormat).
+func NewLogsReader(ctx context.Context, format ExportFormat, produce LogsProducer) *LogsReader {
+	return NewLogsReaderColumns(ctx, format, nil, produce)
+}
+
+// NewLogsReaderColumns is like NewLogsReader, but the CSV export uses the
+// given columns, if any; see LogExporter.SetColumns.
+func NewLogsReaderColumns(
+	ctx context.Context, format ExportFormat, columns Columns, produce LogsProducer,
+) *LogsReader {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	r := &LogsReader{
+		pr:     pr,
+		cancel: cancel,
+		doneCh: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.doneCh)
+		defer cancel()
+
+		bw := bufio.NewWriter(pw)
+		exporter := NewLogExporter(bw, format)
+		exporter.SetColumns(columns)
+
+		emit := func(logs []LogMsg) error {
+			if err := ctx.Err(); err != nil {
+				return errors.Trace(err)
+			}
+
+			for _, msg := range logs {
+				if err := exporter.Write(msg); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			// Flush every batch right away, so that the reader gets it without
+			// waiting for the next one, which might take a while (e.g. when
+			// following the logs).
+			if err := exporter.Flush(); err != nil {
+				return errors.Trace(err)
+			}
+
+			return errors.Trace(bw.Flush())
+		}
+
+		// If err is nil, the reader gets io.EOF.
+		err := produce(ctx, emit)
+		pw.CloseWithError(err)
+	}()
+
+	return r
+}
+
+// Read reads the formatted logs.
+func (r *LogsReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+// Close cancels the producer's context, and waits for it to return. Reads
+// after Close return io.ErrClosedPipe.
+func (r *LogsReader) Close() error {
+	r.cancel()
+	r.pr.Close()
+	<-r.doneCh
+
+	return nil
+}
+
+// QueryReader runs the query like Query does, and returns the reader yielding
+// the resulting logs in the given format. If the query fails, the reader
+// returns the error. Closing the reader before the query is done cancels it,
+// in the same way as cancelling the ctx given to Query.
+func (n *Nerdlog) QueryReader(ctx context.Context, params QueryLogsParams, format ExportFormat) *LogsReader {
+	return n.trackReader(NewLogsReaderColumns(ctx, format, n.opts.Columns, func(ctx context.Context, emit func(logs []LogMsg) error) error {
+		resp, err := n.Query(ctx, params)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.Trace(emit(resp.Logs))
+	}))
+}
+
+// FollowReader is like Follow, but instead of calling a callback with the new
+// logs, it returns the reader yielding them in the given format, as they
+// arrive. Following stops when either the ctx is done or the reader is
+// closed.
+func (n *Nerdlog) FollowReader(ctx context.Context, params QueryLogsParams, format ExportFormat) *LogsReader {
+	return n.trackReader(NewLogsReaderColumns(ctx, format, n.opts.Columns, func(ctx context.Context, emit func(logs []LogMsg) error) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var emitErr error
+		err := n.Follow(ctx, params, func(logs []LogMsg) {
+			if emitErr != nil {
+				return
+			}
+
+			if emitErr = emit(logs); emitErr != nil {
+				cancel()
+			}
+		})
+		if emitErr != nil {
+			return errors.Trace(emitErr)
+		}
+
+		return errors.Trace(err)
+	}))
+}
+
+// trackReader remembers the reader until its producer returns, so that
+// Shutdown can wait for it; returns the same reader.
+func (n *Nerdlog) trackReader(r *LogsReader) *LogsReader {
+	n.mtx.Lock()
+	n.readers[r] = struct{}{}
+	n.mtx.Unlock()
+
+	go func() {
+		<-r.doneCh
+
+		n.mtx.Lock()
+		delete(n.readers, r)
+		n.mtx.Unlock()
+	}()
+
+	return r
+}
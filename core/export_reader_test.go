@@ -0,0 +1,191 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeReaderLogMsg(line string) LogMsg {
+	return LogMsg{
+		Time:     time.Date(2025, 3, 27, 10, 0, 0, 0, time.UTC),
+		Msg:      line,
+		OrigLine: line,
+		Context:  map[string]string{"lstream": "host1"},
+	}
+}
+
+func TestLogsReaderIncremental(t *testing.T) {
+	// Every batch is only emitted once the previous one was read.
+	nextCh := make(chan struct{})
+	emittedCh := make(chan int, 2)
+
+	r := NewLogsReader(context.Background(), ExportFormatRaw, func(ctx context.Context, emit func(logs []LogMsg) error) error {
+		for i, line := range []string{"line 1", "line 2"} {
+			if err := emit([]LogMsg{makeReaderLogMsg(line)}); err != nil {
+				return errors.Trace(err)
+			}
+			emittedCh <- i
+
+			<-nextCh
+		}
+
+		return nil
+	})
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+
+	line, err := br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "line 1\n", line)
+	assert.Equal(t, 0, <-emittedCh)
+
+	nextCh <- struct{}{}
+
+	// The second batch is blocked until we read it.
+	select {
+	case <-emittedCh:
+		t.Fatalf("the second batch was emitted before being read")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	line, err = br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "line 2\n", line)
+	assert.Equal(t, 1, <-emittedCh)
+
+	nextCh <- struct{}{}
+
+	_, err = br.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLogsReaderJSON(t *testing.T) {
+	r := NewLogsReader(context.Background(), ExportFormatJSON, func(ctx context.Context, emit func(logs []LogMsg) error) error {
+		return emit([]LogMsg{makeReaderLogMsg("foo"), makeReaderLogMsg("bar")})
+	})
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Contains(t, lines[0], `"msg":"foo"`)
+		assert.Contains(t, lines[1], `"msg":"bar"`)
+	}
+}
+
+func TestLogsReaderError(t *testing.T) {
+	r := NewLogsReader(context.Background(), ExportFormatRaw, func(ctx context.Context, emit func(logs []LogMsg) error) error {
+		if err := emit([]LogMsg{makeReaderLogMsg("foo")}); err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.New("query failed")
+	})
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	assert.Equal(t, "foo\n", string(data))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "query failed")
+	}
+}
+
+func TestLogsReaderCloseCancels(t *testing.T) {
+	producerErrCh := make(chan error, 1)
+
+	r := NewLogsReader(context.Background(), ExportFormatRaw, func(ctx context.Context, emit func(logs []LogMsg) error) error {
+		// Keeps producing the logs until the reader is closed.
+		for {
+			if err := emit([]LogMsg{makeReaderLogMsg("foo")}); err != nil {
+				producerErrCh <- ctx.Err()
+				return errors.Trace(err)
+			}
+		}
+	})
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "foo\n", line)
+
+	// Close only returns once the producer is done, so the error must be
+	// there already.
+	assert.NoError(t, r.Close())
+
+	select {
+	case err := <-producerErrCh:
+		assert.Equal(t, context.Canceled, err)
+	default:
+		t.Fatalf("producer is still running after Close")
+	}
+
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestNerdlogQueryReader(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	n := newTestNerdlog(t, logs)
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r := n.QueryReader(ctx, QueryLogsParams{From: now.Add(-time.Hour)}, ExportFormatRaw)
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+
+	// Both logstreams serve the same fake logs.
+	assert.Equal(t, 4, strings.Count(string(data), "\n"))
+	assert.Equal(t, 2, strings.Count(string(data), "foo"))
+	assert.Equal(t, 2, strings.Count(string(data), "bar"))
+}
+
+func TestNerdlogFollowReaderClose(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-2*time.Minute), "foo"))
+
+	n := newTestNerdlog(t, logs)
+	defer n.Close()
+
+	r := n.FollowReader(context.Background(), QueryLogsParams{From: now.Add(-time.Hour)}, ExportFormatRaw)
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, "foo")
+
+	doneCh := make(chan struct{})
+	go func() {
+		r.Close()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("closing the reader didn't stop following")
+	}
+}
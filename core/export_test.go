@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogExporterLabels(t *testing.T) {
+	labels := map[string]string{"region": "eu", "team": "core"}
+
+	msgs := []LogMsg{
+		{
+			Time: time.Date(2025, 3, 10, 10, 0, 1, 0, time.UTC),
+			Msg:  "foo",
+			Context: map[string]string{
+				"lstream": "web-01",
+				"program": "myapp",
+				"region":  "eu",
+				"team":    "core",
+			},
+			Labels:   labels,
+			OrigLine: "Mar 10 10:00:01 web-01 myapp: foo",
+		},
+		{
+			Time: time.Date(2025, 3, 10, 10, 0, 2, 0, time.UTC),
+			Msg:  "bar",
+			Context: map[string]string{
+				"lstream": "web-02",
+			},
+			OrigLine: "Mar 10 10:00:02 web-02 myapp: bar",
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewLogExporter(&buf, ExportFormatJSON).WriteAll(msgs))
+	assert.Equal(t,
+		`{"time":"2025-03-10T10:00:01Z","lstream":"web-01","msg":"foo","context":{"program":"myapp"},"labels":{"region":"eu","team":"core"},"orig_line":"Mar 10 10:00:01 web-01 myapp: foo"}`+"\n"+
+			`{"time":"2025-03-10T10:00:02Z","lstream":"web-02","msg":"bar","orig_line":"Mar 10 10:00:02 web-02 myapp: bar"}`+"\n",
+		buf.String(),
+	)
+
+	buf.Reset()
+	assert.NoError(t, NewLogExporter(&buf, ExportFormatCSV).WriteAll(msgs))
+	assert.Equal(t,
+		"time,lstream,level,msg,labels\n"+
+			"2025-03-10T10:00:01Z,web-01,,foo,\"region=eu,team=core\"\n"+
+			"2025-03-10T10:00:02Z,web-02,,bar,\n",
+		buf.String(),
+	)
+}
+
+func TestLogExporterCSVColumns(t *testing.T) {
+	msgs := []LogMsg{
+		{
+			Time:  time.Date(2025, 3, 10, 10, 0, 1, 0, time.UTC),
+			Level: LogLevelError,
+			Msg:   "connection refused while talking to the upstream",
+			Context: map[string]string{
+				"lstream": "web-01",
+				"program": "myapp",
+				"region":  "eu",
+			},
+			Labels: map[string]string{"region": "eu"},
+		},
+		{
+			Time: time.Date(2025, 3, 10, 10, 0, 2, 0, time.UTC),
+			Msg:  "ok",
+			Context: map[string]string{
+				"lstream": "web-02",
+			},
+		},
+	}
+
+	cols := Columns{
+		{Field: "lstream", Title: "host"},
+		{Field: "region"},
+		{Field: "message", Truncate: 10},
+		{Field: "time", Width: 5},
+		{Field: "level"},
+	}
+	assert.NoError(t, cols.Validate())
+
+	// The order, the titles and the truncation are honored; the width is
+	// not, since it's only for the UI.
+	var buf bytes.Buffer
+	exporter := NewLogExporter(&buf, ExportFormatCSV)
+	exporter.SetColumns(cols)
+	assert.NoError(t, exporter.WriteAll(msgs))
+	assert.Equal(t,
+		"host,region,message,time,level\n"+
+			"web-01,eu,connectio…,2025-03-10T10:00:01Z,error\n"+
+			"web-02,,ok,2025-03-10T10:00:02Z,\n",
+		buf.String(),
+	)
+
+	// The other formats are not affected.
+	buf.Reset()
+	exporter = NewLogExporter(&buf, ExportFormatRaw)
+	exporter.SetColumns(cols)
+	assert.NoError(t, exporter.WriteAll([]LogMsg{{OrigLine: "foo bar"}}))
+	assert.Equal(t, "foo bar\n", buf.String())
+}
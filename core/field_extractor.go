@@ -0,0 +1,288 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// FieldExtractor extracts the fields from the log lines by their positions,
+// like awk does, as a lighter alternative to the regexes with named groups
+// for the logs with a fixed layout. The fields are extracted on the hosts, and
+// end up in LogMsg.Context, same as the named regex captures; see
+// ParseFieldExtractor.
+type FieldExtractor struct {
+	// Separator is the field separator: if empty, the fields are separated by
+	// runs of spaces and tabs, and the leading and trailing ones are ignored,
+	// like awk does by default. A single character is used literally, and
+	// longer separators are regexes (in Go syntax), e.g. " *\| *".
+	Separator string
+
+	// Fields are sorted by name.
+	Fields []ExtractedField
+
+	// sepRegex is the awk regex matching the separator.
+	sepRegex string
+}
+
+// ExtractedField is a single field of the FieldExtractor.
+type ExtractedField struct {
+	Name string
+
+	// Parts are concatenated to get the field value.
+	Parts []ExtractedFieldPart
+}
+
+// ExtractedFieldPart is either a literal text, or a range of the fields of the
+// line.
+type ExtractedFieldPart struct {
+	// Literal is the text to add as is; only used if From is zero.
+	Literal string
+
+	// From and To are the 1-based numbers of the first and the last fields of
+	// the line to add, with the original separators between them. If To is
+	// zero, it's until the end of the line.
+	From int
+	To   int
+}
+
+// ParseFieldExtractor parses the field specs, like they're given in the
+// logstream config:
+//
+//	fields:
+//	  ts: "$1 $2 $3"
+//	  status: "$5"
+//	  msg: "$6-"
+//
+// Every spec is a template, where $N is replaced with the Nth field of the
+// line, $N-M with the fields from N to M (inclusive), $N- with the rest of
+// the line starting from the Nth field (in the last two cases, the original
+// separators are preserved), and $$ is a literal dollar sign. All the other
+// text is taken literally. The fields referenced beyond the end of the line
+// are empty; if the line doesn't even have the first referenced field, or the
+// whole value is empty, the field is not extracted from this line.
+//
+// If the specs are empty, nil is returned.
+func ParseFieldExtractor(specs map[string]string, separator string) (*FieldExtractor, error) {
+	if len(specs) == 0 {
+		if separator != "" {
+			return nil, errors.Errorf("field_separator is given, but there are no fields")
+		}
+
+		return nil, nil
+	}
+
+	fe := &FieldExtractor{Separator: separator}
+
+	if len(separator) > 1 {
+		if _, err := regexp.Compile(separator); err != nil {
+			return nil, errors.Annotatef(err, "field separator")
+		}
+	}
+
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.Errorf("empty field name")
+		}
+
+		for i := 0; i < len(name); i++ {
+			if !isFilterFieldChar(name[i], i == 0) {
+				return nil, errors.Errorf("invalid field name %q", name)
+			}
+		}
+
+		parts, err := parseExtractedFieldSpec(specs[name])
+		if err != nil {
+			return nil, errors.Annotatef(err, "field %s", name)
+		}
+
+		fe.Fields = append(fe.Fields, ExtractedField{Name: name, Parts: parts})
+	}
+
+	return fe.forAWKDialect(AWKDialectDefault)
+}
+
+// forAWKDialect returns the copy of the FieldExtractor with the separator
+// translated to the given awk dialect. The receiver can be nil, then nil is
+// returned.
+func (fe *FieldExtractor) forAWKDialect(dialect AWKDialect) (*FieldExtractor, error) {
+	if fe == nil {
+		return nil, nil
+	}
+
+	ret := *fe
+
+	switch {
+	case fe.Separator == "":
+		ret.sepRegex = "[ \t]+"
+	case len(fe.Separator) == 1:
+		ret.sepRegex = regexQuoteMeta(fe.Separator)
+	default:
+		sepRegex, err := TranslateRegexToAWK(fe.Separator, dialect)
+		if err != nil {
+			return nil, errors.Annotatef(err, "field separator")
+		}
+
+		ret.sepRegex = sepRegex
+	}
+
+	return &ret, nil
+}
+
+// parseExtractedFieldSpec parses a single field spec; see ParseFieldExtractor.
+func parseExtractedFieldSpec(spec string) ([]ExtractedFieldPart, error) {
+	var parts []ExtractedFieldPart
+	var literal strings.Builder
+	hasRefs := false
+
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, ExtractedFieldPart{Literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	// parseNum parses the number starting at i, and returns it together with
+	// the index right after it; if there's no number, it returns 0.
+	parseNum := func(i int) (int, int) {
+		j := i
+		for j < len(spec) && spec[j] >= '0' && spec[j] <= '9' {
+			j++
+		}
+
+		if j == i {
+			return 0, i
+		}
+
+		num, err := strconv.Atoi(spec[i:j])
+		if err != nil {
+			return 0, i
+		}
+
+		return num, j
+	}
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '$' {
+			literal.WriteByte(spec[i])
+			continue
+		}
+
+		if i+1 < len(spec) && spec[i+1] == '$' {
+			literal.WriteByte('$')
+			i++
+			continue
+		}
+
+		from, next := parseNum(i + 1)
+		if from == 0 {
+			return nil, errors.Errorf("invalid spec %q: $ at %d must be followed by a field number from 1, or by another $", spec, i)
+		}
+
+		part := ExtractedFieldPart{From: from, To: from}
+
+		if next < len(spec) && spec[next] == '-' {
+			to, afterTo := parseNum(next + 1)
+			switch {
+			case afterTo == next+1:
+				// "$N-", until the end of the line.
+				part.To = 0
+				next++
+			case to < from:
+				return nil, errors.Errorf("invalid spec %q: the range $%d-%d is reversed", spec, from, to)
+			default:
+				part.To = to
+				next = afterTo
+			}
+		}
+
+		flushLiteral()
+		parts = append(parts, part)
+		hasRefs = true
+
+		i = next - 1
+	}
+
+	flushLiteral()
+
+	if !hasRefs {
+		return nil, errors.Errorf("invalid spec %q: no field references like $1", spec)
+	}
+
+	return parts, nil
+}
+
+// CompileFieldExtractorToAWK generates the awk code which splits the current
+// line ($0) into the fields, and appends the extracted ones to the awk
+// variable nlcaps, in the same format as the code generated by
+// CompileFilterCapturesToAWK does, so it's passed to the agent the same way.
+//
+// Unlike the awk's own field splitting, the separators are kept, so that the
+// ranges of fields can be extracted as they are in the line. The generated
+// code only uses the POSIX awk features.
+func CompileFieldExtractorToAWK(fe *FieldExtractor) string {
+	var sb strings.Builder
+
+	// Split the line into nlxf (the fields) and nlxp (the separator after every
+	// field); nlxn is the number of fields.
+	sb.WriteString("nlxs = $0; nlxn = 0; ")
+	if fe.Separator == "" {
+		sb.WriteString(`sub(/^[ \t]+/, "", nlxs); sub(/[ \t]+$/, "", nlxs); `)
+	}
+	sb.WriteString(fmt.Sprintf(
+		`while (nlxs != "") { nlxn++; if (match(nlxs, %s) && RLENGTH > 0) { nlxf[nlxn] = substr(nlxs, 1, RSTART - 1); nlxp[nlxn] = substr(nlxs, RSTART, RLENGTH); nlxs = substr(nlxs, RSTART + RLENGTH); } else { nlxf[nlxn] = nlxs; nlxp[nlxn] = ""; nlxs = ""; } } `,
+		awkRegexLiteral(fe.sepRegex),
+	))
+
+	for _, f := range fe.Fields {
+		sb.WriteString(`nlv = "";`)
+
+		for _, part := range f.Parts {
+			if part.From == 0 {
+				sb.WriteString(fmt.Sprintf(" nlv = nlv %s;", awkStringLiteral(part.Literal)))
+				continue
+			}
+
+			to := "nlxn"
+			if part.To != 0 {
+				to = fmt.Sprintf("(%d < nlxn ? %d : nlxn)", part.To, part.To)
+			}
+
+			sb.WriteString(fmt.Sprintf(
+				" for (nlxi = %d; nlxi <= %s; nlxi++) { nlv = nlv nlxf[nlxi]; if (nlxi < %s) { nlv = nlv nlxp[nlxi]; } }",
+				part.From, to, to,
+			))
+		}
+
+		// If none of the referenced fields are present, the value is just the
+		// literal text, which we don't want.
+		sb.WriteString(fmt.Sprintf(
+			` if (nlxn >= %d && nlv != "") { nlcaps = nlcaps "\037" %s nlv } `,
+			f.minField(), awkStringLiteral(f.Name+"="),
+		))
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// minField returns the smallest field number referenced by the field.
+func (f ExtractedField) minField() int {
+	ret := 0
+	for _, part := range f.Parts {
+		if part.From != 0 && (ret == 0 || part.From < ret) {
+			ret = part.From
+		}
+	}
+
+	return ret
+}
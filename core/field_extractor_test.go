@@ -0,0 +1,137 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFieldExtractor(t *testing.T) {
+	fe, err := ParseFieldExtractor(nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, fe)
+
+	fe, err = ParseFieldExtractor(map[string]string{
+		"ts":     "$1 $2 $3",
+		"status": "$5",
+		"msg":    "$6-",
+		"span":   "$2-4",
+		"price":  "$$$7",
+	}, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []ExtractedField{
+			{Name: "msg", Parts: []ExtractedFieldPart{{From: 6}}},
+			{Name: "price", Parts: []ExtractedFieldPart{{Literal: "$"}, {From: 7, To: 7}}},
+			{Name: "span", Parts: []ExtractedFieldPart{{From: 2, To: 4}}},
+			{Name: "status", Parts: []ExtractedFieldPart{{From: 5, To: 5}}},
+			{Name: "ts", Parts: []ExtractedFieldPart{
+				{From: 1, To: 1}, {Literal: " "}, {From: 2, To: 2}, {Literal: " "}, {From: 3, To: 3},
+			}},
+		}, fe.Fields)
+	}
+
+	for _, spec := range []string{"", "foo", "$0", "$", "$x", "$5-3", "$$1"} {
+		_, err := ParseFieldExtractor(map[string]string{"foo": spec}, "")
+		assert.Error(t, err, spec)
+	}
+
+	_, err = ParseFieldExtractor(map[string]string{"foo bar": "$1"}, "")
+	assert.Error(t, err)
+
+	_, err = ParseFieldExtractor(map[string]string{"foo": "$1"}, "(+")
+	assert.Error(t, err)
+
+	_, err = ParseFieldExtractor(nil, "|")
+	assert.Error(t, err)
+}
+
+// runFieldExtractorAWK runs the code generated for the given extractor on
+// every line, and returns the extracted fields of every line.
+func runFieldExtractorAWK(t *testing.T, fe *FieldExtractor, lines ...string) []map[string]string {
+	awkBinary, err := exec.LookPath("awk")
+	if err != nil {
+		t.Skip("no awk")
+	}
+
+	code := CompileFieldExtractorToAWK(fe)
+
+	cmd := exec.Command(awkBinary, `{ nlcaps = ""; `+code+` print nlcaps }`)
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running awk: %s", err)
+	}
+
+	var ret []map[string]string
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		ret = append(ret, ParseFilterCaptures(line))
+	}
+
+	return ret
+}
+
+func TestCompileFieldExtractorToAWK(t *testing.T) {
+	fe, err := ParseFieldExtractor(map[string]string{
+		"ts":     "$1 $2",
+		"status": "$4",
+		"msg":    "$5-",
+		"span":   "$3-4",
+	}, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The leading and trailing whitespace is ignored, and the ranges preserve
+	// the original whitespace. The fields beyond the end of the line are
+	// empty, and the empty lines have no fields at all.
+	assert.Equal(t, []map[string]string{
+		{"ts": "2025-03-10 10:00:00", "span": "GET  200", "status": "200", "msg": "served  /index.html in 5ms"},
+		{"ts": "2025-03-10 10:00:01", "span": "POST"},
+		{"ts": "2025-03-10 10:00:02", "span": "PUT 500", "status": "500"},
+		{},
+	}, runFieldExtractorAWK(t, fe,
+		"  2025-03-10 10:00:00 GET  200\tserved  /index.html in 5ms  ",
+		"2025-03-10 10:00:01 POST",
+		"2025-03-10 10:00:02 PUT 500",
+		"",
+	))
+}
+
+func TestCompileFieldExtractorToAWKSeparator(t *testing.T) {
+	// A single character separator is literal, even if it's special in regexes;
+	// the empty fields are not extracted.
+	fe, err := ParseFieldExtractor(map[string]string{
+		"level":  "$2",
+		"user":   "$3",
+		"msg":    "$4-",
+		"prefix": "[$1]",
+	}, "|")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []map[string]string{
+		{"prefix": "[2025-03-10T10:00:00Z]", "level": "INFO", "user": "alice", "msg": "logged in|from 10.0.0.1"},
+		{"prefix": "[2025-03-10T10:00:01Z]", "level": "WARN", "msg": "no user"},
+	}, runFieldExtractorAWK(t, fe,
+		"2025-03-10T10:00:00Z|INFO|alice|logged in|from 10.0.0.1",
+		"2025-03-10T10:00:01Z|WARN||no user",
+	))
+
+	// Longer separators are regexes.
+	fe, err = ParseFieldExtractor(map[string]string{
+		"level": "$2",
+		"msg":   "$3-",
+	}, ` *; *`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []map[string]string{
+		{"level": "error", "msg": "disk full ;  on /var"},
+	}, runFieldExtractorAWK(t, fe,
+		"10:00:00 ; error;disk full ;  on /var",
+	))
+}
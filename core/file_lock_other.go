@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package core
+
+import "os"
+
+// lockFile does nothing, since there is no flock here, so the writes to the
+// files shared by multiple nerdlog instances are not serialized.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package core
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// lockFile takes an exclusive advisory lock on the file, waiting for it if
+// another process holds it; the lock is released once the file is closed.
+func lockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			return errors.Trace(err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// filenameDateMinuteKeyLayout is the MinuteKeyLayout of the logs with the date
+// from the file name: the awk minute key is the date followed by the time of
+// day.
+const filenameDateMinuteKeyLayout = "2006-01-02T15:04"
+
+// FilenameDate is the date of all the lines of the logstream, taken from the
+// name of its log file; see ConfigLogStreamOptions.FilenameDate and
+// ParseFilenameDate.
+type FilenameDate struct {
+	Year  int
+	Month time.Month
+	Day   int
+
+	// TimeOfDayLayout, if not empty, is the layout of the time of day which
+	// every line starts with, like "15:04:05"; if empty, all the lines are at
+	// the midnight of the date.
+	TimeOfDayLayout string
+}
+
+// ParseFilenameDate validates the config, and returns the date taken from the
+// given file name. If the config is nil, nil is returned.
+func ParseFilenameDate(cfg *ConfigFilenameDate, filename string) (*FilenameDate, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.Regex == "" {
+		return nil, errors.Errorf("filename_date: regex is required")
+	}
+
+	re, err := regexp.Compile(cfg.Regex)
+	if err != nil {
+		return nil, errors.Annotatef(err, "filename_date regex")
+	}
+
+	if re.NumSubexp() != 1 {
+		return nil, errors.Errorf(
+			"filename_date: regex must have exactly one capture group with the date, but it has %d", re.NumSubexp(),
+		)
+	}
+
+	if cfg.Layout == "" {
+		return nil, errors.Errorf("filename_date: layout is required")
+	}
+
+	if cfg.TimeOfDay != "" && !strings.Contains(cfg.TimeOfDay, "15:04") {
+		return nil, errors.Errorf("filename_date: time_of_day %q must contain 15:04", cfg.TimeOfDay)
+	}
+
+	matches := re.FindStringSubmatch(filename)
+	if matches == nil {
+		return nil, errors.Errorf("filename_date: log file name %q doesn't match the regex %q", filename, cfg.Regex)
+	}
+
+	date, err := time.Parse(cfg.Layout, matches[1])
+	if err != nil {
+		return nil, errors.Annotatef(err, "filename_date: parsing the date %q from the log file name %q", matches[1], filename)
+	}
+
+	return &FilenameDate{
+		Year:  date.Year(),
+		Month: date.Month(),
+		Day:   date.Day(),
+
+		TimeOfDayLayout: cfg.TimeOfDay,
+	}, nil
+}
+
+// GetFilenameDateTimeFormatDescr is like GetTimeFormatDescrFromLogLines, but
+// for the logs with the date from the file name: the awk expressions take the
+// date as constants, and the time of day (if any) from the beginning of the
+// line. The example lines are only used to check that they indeed start with
+// the time of day.
+func GetFilenameDateTimeFormatDescr(logLines []string, fd *FilenameDate) (*TimeFormatDescr, error) {
+	layout := fd.TimeOfDayLayout
+
+	if layout != "" {
+		for _, line := range logLines {
+			if len(line) < len(layout) {
+				return nil, errors.Errorf("log line %q is too short to start with the time of day %q", line, layout)
+			}
+
+			if _, err := time.Parse(layout, line[:len(layout)]); err != nil {
+				return nil, errors.Annotatef(err, "log line %q doesn't start with the time of day %q", line, layout)
+			}
+		}
+	}
+
+	// Without the time of day, all the lines are at midnight.
+	hhmm := `"00:00"`
+	if layout != "" {
+		hhmm = fmt.Sprintf("substr($0, %d, 5)", strings.Index(layout, "15:04")+1)
+	}
+
+	return &TimeFormatDescr{
+		TimestampLayout: layout,
+		MinuteKeyLayout: filenameDateMinuteKeyLayout,
+		AWKExpr: TimeFormatAWKExpr{
+			Month: fmt.Sprintf(`"%02d"`, int(fd.Month)),
+			Year:  fmt.Sprintf(`"%04d"`, fd.Year),
+			Day:   fmt.Sprintf(`"%02d"`, fd.Day),
+			HHMM:  hhmm,
+			MinuteKey: fmt.Sprintf(
+				`"%04d-%02d-%02dT" %s`, fd.Year, int(fd.Month), fd.Day, hhmm,
+			),
+		},
+	}, nil
+}
+
+// time returns the time of the log line at the given time of day (which can
+// be zero if unknown) in the given location.
+func (fd *FilenameDate) time(timeOfDay time.Time, loc *time.Location) time.Time {
+	hour, min, sec := timeOfDay.Clock()
+	return time.Date(fd.Year, fd.Month, fd.Day, hour, min, sec, timeOfDay.Nanosecond(), loc)
+}
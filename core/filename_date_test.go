@@ -0,0 +1,253 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilenameDate(t *testing.T) {
+	fd, err := ParseFilenameDate(nil, "/var/log/app.log")
+	assert.NoError(t, err)
+	assert.Nil(t, fd)
+
+	fd, err = ParseFilenameDate(&ConfigFilenameDate{
+		Regex:     `app-([0-9]{8})\.log$`,
+		Layout:    "20060102",
+		TimeOfDay: "15:04:05",
+	}, "/dumps/2025/app-20250310.log")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &FilenameDate{
+			Year:  2025,
+			Month: time.March,
+			Day:   10,
+
+			TimeOfDayLayout: "15:04:05",
+		}, fd)
+	}
+
+	for _, tc := range []struct {
+		cfg      ConfigFilenameDate
+		filename string
+		err      string
+	}{
+		{
+			cfg:      ConfigFilenameDate{Layout: "20060102"},
+			filename: "app-20250310.log",
+			err:      "filename_date: regex is required",
+		},
+		{
+			cfg:      ConfigFilenameDate{Regex: `app-[0-9]{8}\.log`, Layout: "20060102"},
+			filename: "app-20250310.log",
+			err:      "filename_date: regex must have exactly one capture group with the date, but it has 0",
+		},
+		{
+			cfg:      ConfigFilenameDate{Regex: `app-([0-9]{8})\.log`},
+			filename: "app-20250310.log",
+			err:      "filename_date: layout is required",
+		},
+		{
+			cfg:      ConfigFilenameDate{Regex: `app-([0-9]{8})\.log`, Layout: "20060102", TimeOfDay: "15h04"},
+			filename: "app-20250310.log",
+			err:      `filename_date: time_of_day "15h04" must contain 15:04`,
+		},
+		{
+			cfg:      ConfigFilenameDate{Regex: `app-([0-9]{8})\.log`, Layout: "20060102"},
+			filename: "app.log",
+			err:      `filename_date: log file name "app.log" doesn't match the regex "app-([0-9]{8})\\.log"`,
+		},
+		{
+			cfg:      ConfigFilenameDate{Regex: `app-([0-9]{8})\.log`, Layout: "20060102"},
+			filename: "app-20251340.log",
+			err:      `filename_date: parsing the date "20251340" from the log file name "app-20251340.log": parsing time "20251340": month out of range`,
+		},
+	} {
+		_, err := ParseFilenameDate(&tc.cfg, tc.filename)
+		assert.EqualError(t, err, tc.err, "%+v", tc.cfg)
+	}
+}
+
+func TestGetFilenameDateTimeFormatDescr(t *testing.T) {
+	fd := &FilenameDate{Year: 2025, Month: time.March, Day: 10}
+
+	timeFormat, err := GetFilenameDateTimeFormatDescr([]string{"foo", "bar"}, fd)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &TimeFormatDescr{
+			MinuteKeyLayout: "2006-01-02T15:04",
+			AWKExpr: TimeFormatAWKExpr{
+				Month:     `"03"`,
+				Year:      `"2025"`,
+				Day:       `"10"`,
+				HHMM:      `"00:00"`,
+				MinuteKey: `"2025-03-10T" "00:00"`,
+			},
+		}, timeFormat)
+	}
+
+	fd.TimeOfDayLayout = "[15:04:05]"
+	timeFormat, err = GetFilenameDateTimeFormatDescr([]string{"[10:00:01] foo"}, fd)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[15:04:05]", timeFormat.TimestampLayout)
+		assert.Equal(t, "substr($0, 2, 5)", timeFormat.AWKExpr.HHMM)
+		assert.Equal(t, `"2025-03-10T" substr($0, 2, 5)`, timeFormat.AWKExpr.MinuteKey)
+	}
+
+	_, err = GetFilenameDateTimeFormatDescr([]string{"[10:00:01] foo", "foo bar baz qux"}, fd)
+	assert.Error(t, err)
+}
+
+func TestFilenameDateQuery(t *testing.T) {
+	dir := t.TempDir()
+
+	writeLog := func(name string, lines ...string) string {
+		logPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		return logPath
+	}
+
+	timedPath := writeLog("app-20250310.log",
+		"10:00:01 myhost myapp[123]: starting",
+		"10:00:02 myhost myapp[123]: working",
+		"10:05:00 myhost myapp[123]: done",
+	)
+	untimedPath := writeLog("dump-2025-03-11.txt",
+		"first record",
+		"second record",
+	)
+
+	n, err := New(Options{
+		LStreams: "timed,untimed",
+		ConfigLogStreams: ConfigLogStreams{
+			"timed": {
+				Hostname: "localhost",
+				LogFiles: []string{timedPath},
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					FilenameDate: &ConfigFilenameDate{
+						Regex:     `app-([0-9]{8})\.log$`,
+						Layout:    "20060102",
+						TimeOfDay: "15:04:05",
+					},
+				},
+			},
+			"untimed": {
+				Hostname: "localhost",
+				LogFiles: []string{untimedPath},
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					FilenameDate: &ConfigFilenameDate{
+						Regex:  `dump-(.*)\.txt$`,
+						Layout: "2006-01-02",
+					},
+				},
+			},
+		},
+		ClientID: "filename_date_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC),
+		To:          time.Date(2025, 3, 12, 0, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, resp.Logs, 5) {
+		return
+	}
+
+	// The date comes from the file name, and the time of day from the line,
+	// if it's there; otherwise, the lines are at midnight.
+	for i, want := range []struct {
+		time time.Time
+		msg  string
+	}{
+		{time.Date(2025, 3, 10, 10, 0, 1, 0, time.UTC), "starting"},
+		{time.Date(2025, 3, 10, 10, 0, 2, 0, time.UTC), "working"},
+		{time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC), "done"},
+		{time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC), "first record"},
+		{time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC), "second record"},
+	} {
+		assert.Equal(t, want.time, resp.Logs[i].Time, "line %d", i)
+		assert.Equal(t, want.msg, resp.Logs[i].Msg, "line %d", i)
+	}
+
+	assert.Equal(t, "myapp", resp.Logs[0].Context["program"])
+
+	// The lines are bucketed by the minute of the day they're at.
+	numMsgs := map[time.Time]int{}
+	for minute, stats := range resp.MinuteStats {
+		numMsgs[time.Unix(minute, 0).UTC()] = stats.NumMsgs
+	}
+	assert.Equal(t, map[time.Time]int{
+		time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC): 2,
+		time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC): 1,
+		time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC):  2,
+	}, numMsgs)
+
+	// The lines of the other days are not there.
+	resp, err = n.Query(ctx, QueryLogsParams{
+		From:        time.Date(2025, 3, 11, 0, 0, 0, 0, time.UTC),
+		To:          time.Date(2025, 3, 12, 0, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+	})
+	if assert.NoError(t, err) && assert.Len(t, resp.Logs, 2) {
+		assert.Equal(t, "first record", resp.Logs[0].Msg)
+	}
+}
+
+func TestFilenameDateValidation(t *testing.T) {
+	cfg := &ConfigFilenameDate{Regex: `app-([0-9]{8})\.log$`, Layout: "20060102"}
+
+	for _, tc := range []struct {
+		ls  ConfigLogStream
+		err string
+	}{
+		{
+			ls: ConfigLogStream{
+				LogFiles: []string{"/var/log/app-20250310.log", "/var/log/app-20250309.log"},
+				Options:  ConfigLogStreamOptions{FilenameDate: cfg},
+			},
+			err: "parsing entry #1 (myhost): myhost: filename_date needs exactly one log file",
+		},
+		{
+			ls: ConfigLogStream{
+				LogFiles: []string{"/var/log/app-20250310.log"},
+				Options: ConfigLogStreamOptions{
+					FilenameDate: cfg,
+					Multiline:    &ConfigMultiline{},
+				},
+			},
+			err: `parsing entry #1 (myhost): myhost: multiline continuation "no_timestamp" needs filename_date.time_of_day, since otherwise no line has a timestamp`,
+		},
+		{
+			ls: ConfigLogStream{
+				LogFiles: []string{"/var/log/app.log"},
+				Options:  ConfigLogStreamOptions{FilenameDate: cfg},
+			},
+			err: `parsing entry #1 (myhost): myhost: filename_date: log file name "/var/log/app.log" doesn't match the regex "app-([0-9]{8})\\.log$"`,
+		},
+	} {
+		resolver := NewLStreamsResolver(LStreamsResolverParams{
+			CurOSUser:            "osuser",
+			DefaultTransportMode: NewTransportModeSSHLib(),
+			ConfigLogStreams:     ConfigLogStreams{"myhost": tc.ls},
+		})
+
+		_, err := resolver.Resolve("myhost")
+		assert.EqualError(t, err, tc.err)
+	}
+}
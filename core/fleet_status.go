@@ -0,0 +1,208 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConnErrCategory is a rough category of the connection error, used to group
+// failures in the FleetSummary.
+type ConnErrCategory string
+
+const (
+	ConnErrCategoryAuth          ConnErrCategory = "auth"
+	ConnErrCategoryDNS           ConnErrCategory = "dns"
+	ConnErrCategoryUnreachable   ConnErrCategory = "unreachable"
+	ConnErrCategoryTimeout       ConnErrCategory = "timeout"
+	ConnErrCategoryRefused       ConnErrCategory = "refused"
+	ConnErrCategoryShellNotFound ConnErrCategory = "no_shell"
+	ConnErrCategoryNoMarker      ConnErrCategory = "no_marker"
+	ConnErrCategoryBootstrap     ConnErrCategory = "bootstrap"
+	ConnErrCategoryAgentMissing  ConnErrCategory = "no_agent"
+	ConnErrCategoryOther         ConnErrCategory = "other"
+)
+
+// connErrCategoryOrder is the order in which the categories are printed.
+var connErrCategoryOrder = []ConnErrCategory{
+	ConnErrCategoryAuth,
+	ConnErrCategoryDNS,
+	ConnErrCategoryUnreachable,
+	ConnErrCategoryTimeout,
+	ConnErrCategoryRefused,
+	ConnErrCategoryShellNotFound,
+	ConnErrCategoryNoMarker,
+	ConnErrCategoryBootstrap,
+	ConnErrCategoryAgentMissing,
+	ConnErrCategoryOther,
+}
+
+// connErrCategoryPatterns maps lowercased substrings of the error messages to
+// the categories; the first matching one wins. Error messages come from
+// different transports (the ssh library, ssh binary, etc), so there are
+// multiple patterns for the same thing.
+var connErrCategoryPatterns = []struct {
+	substr   string
+	category ConnErrCategory
+}{
+	{"unable to authenticate", ConnErrCategoryAuth},
+	{"permission denied", ConnErrCategoryAuth},
+	{"no supported methods remain", ConnErrCategoryAuth},
+	{"failed to read key data", ConnErrCategoryAuth},
+	{"passphrase", ConnErrCategoryAuth},
+
+	{"no such host", ConnErrCategoryDNS},
+	{"could not resolve hostname", ConnErrCategoryDNS},
+	{"name or service not known", ConnErrCategoryDNS},
+	{"temporary failure in name resolution", ConnErrCategoryDNS},
+
+	{"no route to host", ConnErrCategoryUnreachable},
+	{"network is unreachable", ConnErrCategoryUnreachable},
+	{"host is unreachable", ConnErrCategoryUnreachable},
+
+	{"timed out", ConnErrCategoryTimeout},
+	{"timeout", ConnErrCategoryTimeout},
+	{"deadline exceeded", ConnErrCategoryTimeout},
+
+	{"connection refused", ConnErrCategoryRefused},
+
+	{"executable file not found", ConnErrCategoryShellNotFound},
+}
+
+// CategorizeConnErr returns the category of the given connection error
+// message.
+func CategorizeConnErr(errMsg string) ConnErrCategory {
+	lower := strings.ToLower(errMsg)
+	for _, p := range connErrCategoryPatterns {
+		if strings.Contains(lower, p.substr) {
+			return p.category
+		}
+	}
+
+	return ConnErrCategoryOther
+}
+
+// FleetSummary is an aggregated connection status of all the logstreams.
+type FleetSummary struct {
+	NumLStreams int
+
+	NumConnected int
+
+	// NumConnecting is the number of logstreams which are connecting (or
+	// disconnected, waiting for the next attempt) without errors so far.
+	NumConnecting int
+
+	// NumFailed is the number of logstreams which are not connected, and the
+	// last connection or bootstrap attempt has failed. Nerdlog keeps retrying
+	// those, so they might connect later.
+	NumFailed int
+
+	// FailedByCategory contains sorted names of the failed logstreams, grouped
+	// by the error category.
+	FailedByCategory map[ConnErrCategory][]string
+
+	// ErrByLStream contains the last error for every failed logstream.
+	ErrByLStream map[string]string
+}
+
+// lstreamConnErr is the last connection or bootstrap error of a logstream.
+type lstreamConnErr struct {
+	err       string
+	bootstrap bool
+
+	// category is the category of the error as classified by the
+	// LStreamClient; if empty, it's determined from the message.
+	category ConnErrCategory
+}
+
+// newFleetSummary builds the FleetSummary from the states of the logstreams
+// and their last errors.
+func newFleetSummary(
+	states map[string]LStreamClientState,
+	lastErrs map[string]lstreamConnErr,
+) FleetSummary {
+	fs := FleetSummary{
+		NumLStreams:      len(states),
+		FailedByCategory: map[ConnErrCategory][]string{},
+		ErrByLStream:     map[string]string{},
+	}
+
+	for name, state := range states {
+		if isStateConnected(state) {
+			fs.NumConnected++
+			continue
+		}
+
+		lastErr, ok := lastErrs[name]
+		if !ok {
+			fs.NumConnecting++
+			continue
+		}
+
+		category := lastErr.category
+		if category == "" {
+			category = ConnErrCategoryBootstrap
+			if !lastErr.bootstrap {
+				category = CategorizeConnErr(lastErr.err)
+			}
+		}
+
+		fs.NumFailed++
+		fs.FailedByCategory[category] = append(fs.FailedByCategory[category], name)
+		fs.ErrByLStream[name] = lastErr.err
+	}
+
+	for _, names := range fs.FailedByCategory {
+		sort.Strings(names)
+	}
+
+	return fs
+}
+
+// String returns a one-line summary like this:
+// "3 connected, 1 connecting, 2 failed (auth: 1, timeout: 1)".
+func (fs FleetSummary) String() string {
+	parts := []string{fmt.Sprintf("%d connected", fs.NumConnected)}
+
+	if fs.NumConnecting > 0 {
+		parts = append(parts, fmt.Sprintf("%d connecting", fs.NumConnecting))
+	}
+
+	if fs.NumFailed > 0 {
+		var categories []string
+		for _, category := range connErrCategoryOrder {
+			if names := fs.FailedByCategory[category]; len(names) > 0 {
+				categories = append(categories, fmt.Sprintf("%s: %d", category, len(names)))
+			}
+		}
+
+		parts = append(parts, fmt.Sprintf(
+			"%d failed (%s)", fs.NumFailed, strings.Join(categories, ", "),
+		))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// FleetStatus returns the current aggregated connection status of all the
+// logstreams. Unlike most of the LStreamsManager methods, it returns the
+// result synchronously; it's safe to call from any goroutine.
+func (lsman *LStreamsManager) FleetStatus() FleetSummary {
+	lsman.fleetSummaryMtx.Lock()
+	defer lsman.fleetSummaryMtx.Unlock()
+
+	return lsman.fleetSummary
+}
+
+// updateFleetSummary recalculates the summary returned by FleetStatus. Must
+// be called from the LStreamsManager's goroutine whenever the states or
+// errors change.
+func (lsman *LStreamsManager) updateFleetSummary() FleetSummary {
+	fs := newFleetSummary(lsman.lscStates, lsman.lscLastErrs)
+
+	lsman.fleetSummaryMtx.Lock()
+	lsman.fleetSummary = fs
+	lsman.fleetSummaryMtx.Unlock()
+
+	return fs
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCategorizeConnErr(t *testing.T) {
+	testCases := []struct {
+		errMsg string
+		want   ConnErrCategory
+	}{
+		{"attempt 1: using ssh-agent: ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain", ConnErrCategoryAuth},
+		{"attempt 2: Permission denied (publickey).", ConnErrCategoryAuth},
+		{"attempt 1: dial tcp: lookup foo.example: no such host", ConnErrCategoryDNS},
+		{"attempt 1: ssh: Could not resolve hostname foo: Name or service not known", ConnErrCategoryDNS},
+		{"attempt 3: dial tcp 10.0.0.1:22: i/o timeout", ConnErrCategoryTimeout},
+		{"attempt 1: ssh client dial timed out", ConnErrCategoryTimeout},
+		{"attempt 1: dial tcp 127.0.0.1:22: connect: connection refused", ConnErrCategoryRefused},
+		{"attempt 1: something weird", ConnErrCategoryOther},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, CategorizeConnErr(tc.errMsg), "err %q", tc.errMsg)
+	}
+}
+
+func TestNewFleetSummary(t *testing.T) {
+	states := map[string]LStreamClientState{
+		"web-01": LStreamClientStateConnectedIdle,
+		"web-02": LStreamClientStateConnectedBusy,
+		"web-03": LStreamClientStateConnecting,
+		"web-04": LStreamClientStateDisconnected,
+		"db-01":  LStreamClientStateConnecting,
+		"db-02":  LStreamClientStateDisconnected,
+		"db-03":  LStreamClientStateConnecting,
+		"db-04":  LStreamClientStateConnecting,
+	}
+
+	lastErrs := map[string]lstreamConnErr{
+		// Connected already, so the old error doesn't matter.
+		"web-01": {err: "attempt 1: i/o timeout"},
+
+		"db-01": {err: "attempt 2: ssh: unable to authenticate"},
+		"db-02": {err: "attempt 1: Permission denied (publickey)."},
+		"db-03": {err: "attempt 5: dial tcp 10.0.0.5:22: i/o timeout"},
+		"db-04": {err: "no gawk", bootstrap: true},
+	}
+
+	fs := newFleetSummary(states, lastErrs)
+
+	assert.Equal(t, 8, fs.NumLStreams)
+	assert.Equal(t, 2, fs.NumConnected)
+	assert.Equal(t, 2, fs.NumConnecting)
+	assert.Equal(t, 4, fs.NumFailed)
+	assert.Equal(t, map[ConnErrCategory][]string{
+		ConnErrCategoryAuth:      {"db-01", "db-02"},
+		ConnErrCategoryTimeout:   {"db-03"},
+		ConnErrCategoryBootstrap: {"db-04"},
+	}, fs.FailedByCategory)
+	assert.Equal(t, "attempt 2: ssh: unable to authenticate", fs.ErrByLStream["db-01"])
+	assert.Equal(t, 4, len(fs.ErrByLStream))
+
+	assert.Equal(t,
+		"2 connected, 2 connecting, 4 failed (auth: 2, timeout: 1, bootstrap: 1)",
+		fs.String(),
+	)
+
+	fs = newFleetSummary(map[string]LStreamClientState{
+		"web-01": LStreamClientStateConnectedIdle,
+	}, nil)
+	assert.Equal(t, "1 connected", fs.String())
+}
+
+func TestFleetStatusConcurrent(t *testing.T) {
+	lsman := &LStreamsManager{
+		lscStates:   map[string]LStreamClientState{},
+		lscLastErrs: map[string]lstreamConnErr{},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			fs := lsman.FleetStatus()
+			assert.Equal(t, fs.NumLStreams, fs.NumConnected+fs.NumConnecting+fs.NumFailed)
+		}
+	}()
+
+	// Mimic the LStreamsManager's goroutine updating the states meanwhile.
+	for i := 0; i < 100; i++ {
+		lsman.lscStates["web-01"] = LStreamClientStateConnecting
+		if i%2 == 0 {
+			lsman.lscLastErrs["web-01"] = lstreamConnErr{err: "connection refused"}
+		} else {
+			delete(lsman.lscLastErrs, "web-01")
+		}
+		lsman.updateFleetSummary()
+	}
+
+	wg.Wait()
+
+	fs := lsman.FleetStatus()
+	assert.Equal(t, 1, fs.NumLStreams)
+	assert.Equal(t, 1, fs.NumConnecting)
+}
@@ -0,0 +1,362 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DefaultHistogramTargetNumBuckets is a default for
+// HistogramParams.TargetNumBuckets.
+const DefaultHistogramTargetNumBuckets = 60
+
+// maxStatsBucketMinutes is the largest bucket the agent can count the stats
+// in, see QueryLogsParams.StatsBucketMinutes: all the timezone offsets are
+// multiples of 15 minutes, so the buckets which divide 15 minutes are
+// aligned the same way in every timezone.
+const maxStatsBucketMinutes = 15
+
+// histogramBucketSizes are the human-friendly bucket sizes which
+// AutoHistogramBucketSize chooses from; beyond the last one, it's a whole
+// number of weeks.
+var histogramBucketSizes = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// HistogramParams specifies the histogram to get with Nerdlog.Histogram.
+type HistogramParams struct {
+	// Query specifies the time range and the logs to count, the same as for
+	// Nerdlog.Query. MaxNumLines is ignored, since the log lines aren't
+	// needed, and LoadEarlier, LoadNewer and ResumeToken are not supported.
+	//
+	// If From is zero, the histogram starts at the earliest message found; if
+	// To is zero, it ends now.
+	Query QueryLogsParams
+
+	// BucketSize is the size of every bucket; it must be a whole number of
+	// minutes, and either divide 24 hours evenly (like 5m or 1h), or be a
+	// whole number of days. If zero, it's chosen automatically from the time
+	// range, see AutoHistogramBucketSize; if From is zero too, then the range
+	// starts at the earliest message found.
+	BucketSize time.Duration
+
+	// TargetNumBuckets is the approximate number of buckets to have when the
+	// BucketSize is chosen automatically; it's ignored if BucketSize is set.
+	// If zero, DefaultHistogramTargetNumBuckets is used.
+	TargetNumBuckets int
+
+	// Location is the timezone to align the buckets in: e.g. the 1h buckets
+	// start at the beginning of every hour of the local time, and the 24h ones
+	// at the local midnight. If nil, UTC is used.
+	//
+	// The buckets follow the wall clock, so on the days when the DST starts or
+	// ends, the buckets containing the transition are shorter or longer than
+	// BucketSize: e.g. the 1-day bucket can be 23 or 25 hours long.
+	Location *time.Location
+
+	// PerLStream, if true, makes every bucket also contain the counts per
+	// logstream; see HistogramBucket.CountByLStream.
+	PerLStream bool
+}
+
+// Histogram contains the number of matching messages in every bucket.
+type Histogram struct {
+	// Buckets contains all the buckets of the time range in chronological
+	// order, including the empty ones.
+	Buckets []HistogramBucket
+
+	// BucketSize is the size of the buckets: either HistogramParams.BucketSize,
+	// or the automatically chosen one.
+	BucketSize time.Duration
+
+	// Total is the total number of messages in all the buckets.
+	Total int
+
+	// Approximate and SampleRate are set if the logs were sampled, so the
+	// counts are only estimates; see QueryLogsParams.SampleRate.
+	Approximate bool
+	SampleRate  int
+
+	// SkippedLStreams contains the names of the logstreams which weren't
+	// counted since they weren't connected; see LogRespTotal.SkippedLStreams.
+	SkippedLStreams []string
+}
+
+// HistogramBucket is a single bucket of the Histogram.
+type HistogramBucket struct {
+	// Start is the start of the bucket, in HistogramParams.Location; the
+	// bucket ends where the next one starts, or at the end of the time range.
+	Start time.Time
+
+	// Count is the number of the matching messages in the bucket.
+	Count int
+
+	// CountByLStream maps the logstream names to the number of the messages
+	// from them; it only contains non-zero counts, and it's only set if
+	// HistogramParams.PerLStream is true.
+	CountByLStream map[string]int
+}
+
+// Histogram runs the query to get the number of matching messages in every
+// bucket of the given size, without the log lines themselves, which is
+// lighter than a full Query. It waits for the logstreams to connect, and
+// handles the errors, in the same way as Query does.
+func (n *Nerdlog) Histogram(ctx context.Context, params HistogramParams) (*Histogram, error) {
+	if err := validateHistogramParams(&params); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	query := params.Query
+
+	// We only need the stats.
+	query.AggregateOnly = true
+
+	bucketSize := params.BucketSize
+	if bucketSize == 0 && !query.From.IsZero() {
+		to := query.To
+		if to.IsZero() {
+			to = n.opts.Clock.Now()
+		}
+
+		bucketSize = AutoHistogramBucketSize(to.Sub(query.From), params.TargetNumBuckets)
+	}
+
+	// If the bucket size is known already, let the agents count the stats in
+	// coarser buckets too, so that they don't send every minute of a long
+	// time range.
+	if bucketSize != 0 {
+		query.StatsBucketMinutes = gcd(int(bucketSize/time.Minute), maxStatsBucketMinutes)
+	}
+
+	resp, err := n.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	to := query.To
+	if to.IsZero() {
+		to = n.opts.Clock.Now()
+	}
+
+	from := query.From
+	if from.IsZero() {
+		from = earliestMinute(resp.MinuteStats)
+	}
+
+	if bucketSize == 0 && !from.IsZero() {
+		bucketSize = AutoHistogramBucketSize(to.Sub(from), params.TargetNumBuckets)
+	}
+
+	var perLStream map[string]map[int64]MinuteStatsItem
+	if params.PerLStream {
+		perLStream = resp.MinuteStatsByLStream
+	}
+
+	hist := buildHistogram(histogramBuildParams{
+		minuteStats: resp.MinuteStats,
+		perLStream:  perLStream,
+		from:        from,
+		to:          to,
+		bucketSize:  bucketSize,
+		location:    params.Location,
+	})
+	hist.Approximate = resp.Approximate
+	hist.SampleRate = resp.SampleRate
+	hist.SkippedLStreams = resp.SkippedLStreams
+
+	return hist, nil
+}
+
+// validateHistogramParams checks the params and sets the defaults.
+func validateHistogramParams(params *HistogramParams) error {
+	if params.Query.LoadEarlier || params.Query.LoadNewer || params.Query.ResumeToken != nil {
+		return errors.Errorf("loading more logs or resuming is not supported for histograms")
+	}
+
+	if params.TargetNumBuckets == 0 {
+		params.TargetNumBuckets = DefaultHistogramTargetNumBuckets
+	}
+
+	if params.TargetNumBuckets < 0 {
+		return errors.Errorf("invalid target number of buckets %d", params.TargetNumBuckets)
+	}
+
+	if params.Location == nil {
+		params.Location = time.UTC
+	}
+
+	size := params.BucketSize
+	day := 24 * time.Hour
+
+	switch {
+	case size == 0:
+		// It's chosen automatically.
+	case size < time.Minute || size%time.Minute != 0:
+		return errors.Errorf("invalid bucket size %s: must be a whole number of minutes", size)
+	case size < day && day%size != 0:
+		return errors.Errorf("invalid bucket size %s: must divide 24h evenly", size)
+	case size > day && size%day != 0:
+		return errors.Errorf("invalid bucket size %s: must be a whole number of days", size)
+	}
+
+	return nil
+}
+
+// AutoHistogramBucketSize returns the bucket size for the time range of the
+// given duration, so that there are at most targetNumBuckets buckets: the
+// smallest of the human-friendly sizes like 5m, 1h or 1d which is large
+// enough, or a whole number of weeks for the really long ranges.
+//
+// The smallest size is 1m, since that's the granularity of the stats which
+// the agent provides.
+func AutoHistogramBucketSize(d time.Duration, targetNumBuckets int) time.Duration {
+	if targetNumBuckets <= 0 {
+		targetNumBuckets = DefaultHistogramTargetNumBuckets
+	}
+
+	for _, size := range histogramBucketSizes {
+		if numBuckets(d, size) <= targetNumBuckets {
+			return size
+		}
+	}
+
+	week := histogramBucketSizes[len(histogramBucketSizes)-1]
+	numWeeks := numBuckets(d, week*time.Duration(targetNumBuckets))
+
+	return week * time.Duration(numWeeks)
+}
+
+// numBuckets returns the number of buckets of the given size needed to
+// cover the duration d.
+func numBuckets(d, size time.Duration) int {
+	return int((d + size - 1) / size)
+}
+
+// earliestMinute returns the earliest minute from the stats, or zero time if
+// there are no stats.
+func earliestMinute(minuteStats map[int64]MinuteStatsItem) time.Time {
+	var ret time.Time
+	for k := range minuteStats {
+		if t := time.Unix(k, 0); ret.IsZero() || t.Before(ret) {
+			ret = t
+		}
+	}
+
+	return ret
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+type histogramBuildParams struct {
+	// minuteStats are the total stats, and perLStream are the stats per
+	// logstream; if perLStream is nil, the buckets don't have the counts per
+	// logstream.
+	minuteStats map[int64]MinuteStatsItem
+	perLStream  map[string]map[int64]MinuteStatsItem
+
+	// from is inclusive and to is exclusive; if from is zero, the earliest
+	// minute from minuteStats is used.
+	//
+	// The stats of the few minutes right before from (less than
+	// maxStatsBucketMinutes) are counted in the first bucket: if the agent
+	// counted the stats in the coarser buckets (see
+	// QueryLogsParams.StatsBucketMinutes), the first one might start before
+	// from.
+	from time.Time
+	to   time.Time
+
+	bucketSize time.Duration
+	location   *time.Location
+}
+
+// buildHistogram splits the time range into the buckets and sums up the
+// minute stats in every bucket.
+//
+// The time range is walked minute by minute, and a new bucket starts whenever
+// the wall clock time in the location crosses the bucket boundary; this way,
+// the buckets are aligned to the local time even if the UTC offset changes in
+// the middle of the range.
+func buildHistogram(params histogramBuildParams) *Histogram {
+	hist := &Histogram{BucketSize: params.bucketSize}
+
+	from := params.from
+	if from.IsZero() {
+		from = earliestMinute(params.minuteStats)
+		if from.IsZero() {
+			return hist
+		}
+	}
+
+	from = from.Truncate(time.Minute)
+	anchor := wallDate(from.In(params.location))
+	bucketMinutes := int(params.bucketSize / time.Minute)
+
+	lastKey := -1
+	for t := from; t.Before(params.to); t = t.Add(time.Minute) {
+		local := t.In(params.location)
+
+		// The number of minutes since the local midnight of the first day, as
+		// shown by the wall clock.
+		wallMinutes := int(wallDate(local).Sub(anchor)/(24*time.Hour))*24*60 +
+			local.Hour()*60 + local.Minute()
+
+		if key := wallMinutes / bucketMinutes; key != lastKey {
+			lastKey = key
+			hist.Buckets = append(hist.Buckets, HistogramBucket{Start: local})
+		}
+
+		bucket := &hist.Buckets[len(hist.Buckets)-1]
+
+		minuteKeys := []int64{t.Unix()}
+		if t.Equal(from) {
+			for i := 1; i < maxStatsBucketMinutes; i++ {
+				minuteKeys = append(minuteKeys, t.Add(-time.Duration(i)*time.Minute).Unix())
+			}
+		}
+
+		for _, minuteKey := range minuteKeys {
+			num := params.minuteStats[minuteKey].NumMsgs
+			bucket.Count += num
+			hist.Total += num
+
+			if params.perLStream == nil {
+				continue
+			}
+
+			if bucket.CountByLStream == nil {
+				bucket.CountByLStream = map[string]int{}
+			}
+
+			for name, stats := range params.perLStream {
+				if num := stats[minuteKey].NumMsgs; num > 0 {
+					bucket.CountByLStream[name] += num
+				}
+			}
+		}
+	}
+
+	return hist
+}
+
+// wallDate returns the date of the given time as a UTC midnight, so that the
+// number of days between two dates can be calculated regardless of DST.
+func wallDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNerdlogHistogram(t *testing.T) {
+	base := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+
+	logsByLStream := map[string]*fakeLogs{
+		"web-01": {},
+		"web-02": {},
+	}
+	logsByLStream["web-01"].add(
+		fakeLogLine(base.Add(1*time.Minute), "foo"),
+		fakeLogLine(base.Add(5*time.Minute), "foo"),
+		fakeLogLine(base.Add(20*time.Minute), "foo"),
+	)
+	logsByLStream["web-02"].add(
+		fakeLogLine(base.Add(16*time.Minute), "foo"),
+		fakeLogLine(base.Add(61*time.Minute), "foo"),
+	)
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "web-01,web-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logsByLStream[ls.Name], agentCmds: agentCmds}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hist, err := n.Histogram(ctx, HistogramParams{
+		Query: QueryLogsParams{
+			From: base,
+			To:   base.Add(90 * time.Minute),
+		},
+		BucketSize: 15 * time.Minute,
+		PerLStream: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, 5, hist.Total)
+	assert.Equal(t, 15*time.Minute, hist.BucketSize)
+	assert.Equal(t, []HistogramBucket{
+		{Start: base, Count: 2, CountByLStream: map[string]int{"web-01": 2}},
+		{Start: base.Add(15 * time.Minute), Count: 2, CountByLStream: map[string]int{"web-01": 1, "web-02": 1}},
+		{Start: base.Add(30 * time.Minute), Count: 0, CountByLStream: map[string]int{}},
+		{Start: base.Add(45 * time.Minute), Count: 0, CountByLStream: map[string]int{}},
+		{Start: base.Add(60 * time.Minute), Count: 1, CountByLStream: map[string]int{"web-02": 1}},
+		{Start: base.Add(75 * time.Minute), Count: 0, CountByLStream: map[string]int{}},
+	}, hist.Buckets)
+
+	// The agent counts the stats in the same buckets.
+	cmds := agentCmds.get()
+	if assert.True(t, len(cmds) > 0) {
+		assert.Contains(t, cmds[len(cmds)-1], " --stats-bucket-minutes 15 ")
+	}
+
+	// Without the BucketSize, it's chosen automatically from the time range:
+	// 90 minutes with up to 10 buckets is 10-minute buckets, which the agent
+	// counts in 5-minute buckets, since they must divide 15 minutes.
+	hist, err = n.Histogram(ctx, HistogramParams{
+		Query: QueryLogsParams{
+			From: base,
+			To:   base.Add(90 * time.Minute),
+		},
+		TargetNumBuckets: 10,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10*time.Minute, hist.BucketSize)
+		assert.Equal(t, 9, len(hist.Buckets))
+		assert.Equal(t, 5, hist.Total)
+	}
+
+	cmds = agentCmds.get()
+	assert.Contains(t, cmds[len(cmds)-1], " --stats-bucket-minutes 5 ")
+
+	// Invalid bucket sizes are rejected before querying.
+	for _, size := range []time.Duration{30 * time.Second, 7 * time.Minute, 36 * time.Hour} {
+		_, err := n.Histogram(ctx, HistogramParams{
+			Query:      QueryLogsParams{From: base},
+			BucketSize: size,
+		})
+		assert.Error(t, err, "%s", size)
+	}
+}
+
+func TestAutoHistogramBucketSize(t *testing.T) {
+	day := 24 * time.Hour
+
+	type testCase struct {
+		d                time.Duration
+		targetNumBuckets int
+		want             time.Duration
+	}
+
+	testCases := []testCase{
+		{d: 30 * time.Second, want: time.Minute},
+		{d: 5 * time.Minute, want: time.Minute},
+		{d: time.Hour, want: time.Minute},
+		{d: time.Hour + time.Second, want: 5 * time.Minute},
+		{d: 6 * time.Hour, want: 10 * time.Minute},
+		{d: 24 * time.Hour, want: 30 * time.Minute},
+		{d: 7 * day, want: 3 * time.Hour},
+		{d: 30 * day, want: 12 * time.Hour},
+		{d: 365 * day, want: 7 * day},
+		{d: 10 * 365 * day, want: 9 * 7 * day},
+
+		// Custom targets.
+		{d: 24 * time.Hour, targetNumBuckets: 24, want: time.Hour},
+		{d: 24 * time.Hour, targetNumBuckets: 100, want: 15 * time.Minute},
+		{d: 5 * time.Minute, targetNumBuckets: 1, want: 5 * time.Minute},
+	}
+
+	for _, tc := range testCases {
+		got := AutoHistogramBucketSize(tc.d, tc.targetNumBuckets)
+		assert.Equal(t, tc.want, got, "%s, target %d", tc.d, tc.targetNumBuckets)
+
+		// Whatever is chosen, it's a valid bucket size.
+		params := HistogramParams{BucketSize: got}
+		assert.NoError(t, validateHistogramParams(&params), "%s", got)
+	}
+}
+
+func TestBuildHistogramStatsBuckets(t *testing.T) {
+	from := time.Date(2025, 3, 10, 9, 7, 0, 0, time.UTC)
+
+	// The agent counted the stats in 15-minute buckets, so the first one is
+	// attributed to the minute before from.
+	minuteStats := map[int64]MinuteStatsItem{
+		time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC).Unix():  {NumMsgs: 3},
+		time.Date(2025, 3, 10, 9, 15, 0, 0, time.UTC).Unix(): {NumMsgs: 2},
+		time.Date(2025, 3, 10, 9, 30, 0, 0, time.UTC).Unix(): {NumMsgs: 1},
+	}
+
+	hist := buildHistogram(histogramBuildParams{
+		minuteStats: minuteStats,
+		perLStream:  map[string]map[int64]MinuteStatsItem{"web-01": minuteStats},
+		from:        from,
+		to:          time.Date(2025, 3, 10, 9, 45, 0, 0, time.UTC),
+		bucketSize:  15 * time.Minute,
+		location:    time.UTC,
+	})
+
+	assert.Equal(t, 6, hist.Total)
+	assert.Equal(t, []HistogramBucket{
+		{Start: from, Count: 3, CountByLStream: map[string]int{"web-01": 3}},
+		{Start: from.Add(8 * time.Minute), Count: 2, CountByLStream: map[string]int{"web-01": 2}},
+		{Start: from.Add(23 * time.Minute), Count: 1, CountByLStream: map[string]int{"web-01": 1}},
+	}, hist.Buckets)
+}
+
+func TestBuildHistogramDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no tzdata: %s", err)
+	}
+
+	// One message every hour, from Mar 8 to Mar 11 2025 local time; the DST
+	// starts on Mar 9 at 2am, so that day is only 23 hours long.
+	from := time.Date(2025, 3, 8, 0, 0, 0, 0, loc)
+	to := time.Date(2025, 3, 11, 0, 0, 0, 0, loc)
+
+	minuteStats := map[int64]MinuteStatsItem{}
+	for ts := from; ts.Before(to); ts = ts.Add(time.Hour) {
+		minuteStats[ts.Unix()] = MinuteStatsItem{NumMsgs: 1}
+	}
+
+	hist := buildHistogram(histogramBuildParams{
+		minuteStats: minuteStats,
+		from:        from,
+		to:          to,
+		bucketSize:  24 * time.Hour,
+		location:    loc,
+	})
+
+	assert.Equal(t, 71, hist.Total)
+	assert.Equal(t, []HistogramBucket{
+		{Start: time.Date(2025, 3, 8, 0, 0, 0, 0, loc), Count: 24},
+		{Start: time.Date(2025, 3, 9, 0, 0, 0, 0, loc), Count: 23},
+		{Start: time.Date(2025, 3, 10, 0, 0, 0, 0, loc), Count: 24},
+	}, hist.Buckets)
+
+	// The hourly buckets are aligned to the local hours on both sides of the
+	// transition.
+	hist = buildHistogram(histogramBuildParams{
+		minuteStats: minuteStats,
+		from:        time.Date(2025, 3, 9, 0, 30, 0, 0, loc),
+		to:          time.Date(2025, 3, 9, 4, 0, 0, 0, loc),
+		bucketSize:  time.Hour,
+		location:    loc,
+	})
+
+	var starts []string
+	for _, b := range hist.Buckets {
+		starts = append(starts, b.Start.Format("15:04 MST"))
+	}
+	assert.Equal(t, []string{"00:30 EST", "01:00 EST", "03:00 EDT"}, starts)
+	assert.Equal(t, 2, hist.Total)
+}
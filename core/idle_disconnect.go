@@ -0,0 +1,49 @@
+package core
+
+// markActivity is called whenever there is some query activity (a query, a
+// keepalive ping etc): it restarts the IdleTimeout countdown, and if the
+// logstreams were disconnected because of being idle, starts reconnecting
+// them. It's a no-op if the IdleTimeout isn't set.
+func (lsman *LStreamsManager) markActivity() {
+	if lsman.params.IdleTimeout == 0 {
+		return
+	}
+
+	lsman.idleCh = lsman.params.Clock.After(lsman.params.IdleTimeout)
+
+	if !lsman.idleDisconnected {
+		return
+	}
+
+	lsman.params.Logger.Infof("Reconnecting after being idle")
+	lsman.idleDisconnected = false
+	for _, lsc := range lsman.lscs {
+		lsc.SetParked(false)
+	}
+
+	lsman.sendStateUpdate()
+}
+
+// disconnectIdle is called once the IdleTimeout passes without any activity:
+// it disconnects all the logstreams, and they stay disconnected until the
+// next activity (see markActivity).
+func (lsman *LStreamsManager) disconnectIdle() {
+	lsman.idleCh = nil
+
+	if lsman.curQueryLogsCtx != nil || lsman.debouncedQuery != nil {
+		// The query is still in progress, so we're not idle; its completion
+		// restarts the countdown, but just in case, restart it here as well.
+		lsman.idleCh = lsman.params.Clock.After(lsman.params.IdleTimeout)
+		return
+	}
+
+	lsman.params.Logger.Infof(
+		"No activity for %s, disconnecting until the next query", lsman.params.IdleTimeout,
+	)
+	lsman.idleDisconnected = true
+	for _, lsc := range lsman.lscs {
+		lsc.SetParked(true)
+	}
+
+	lsman.sendStateUpdate()
+}
@@ -0,0 +1,335 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// LogFormat is the format of the log lines of a logstream; see
+// ConfigLogStreamOptions.LogFormat.
+type LogFormat string
+
+const (
+	// LogFormatDefault means that every line starts with a timestamp, which is
+	// optionally followed by the syslog-like header, like
+	// "Mar 10 10:00:00 myhost myapp[123]: foo".
+	LogFormatDefault LogFormat = ""
+
+	// LogFormatJSON means that every line is a JSON object, like
+	// {"time":"2025-03-10T10:00:00Z","level":"info","msg":"foo"}; see
+	// JSONLogs.
+	LogFormatJSON LogFormat = "json"
+)
+
+// jsonTimestampFields are the fields which are checked for the timestamp if
+// ConfigJSONLogs.TimestampField is not set, in that order.
+var jsonTimestampFields = []string{"timestamp", "time", "ts", "@timestamp"}
+
+// jsonMessageFields are the fields which are checked for the message if
+// ConfigJSONLogs.MessageField is not set, in that order.
+var jsonMessageFields = []string{"msg", "message"}
+
+// jsonLevelFields are the fields which are checked for the log level, in that
+// order.
+var jsonLevelFields = []string{"level", "severity"}
+
+// JSONLogs configures the logstream with the JSON logs: every line is a JSON
+// object, and the fields are accessed by the dotted paths, like
+// "request.headers.host"; on the hosts, it's done by the nljsonget awk
+// function of nerdlog_agent.sh, so the filter queries (like
+// "request.headers.host:example.com"), the projections and the grouping work
+// with the nested fields too. On the client, all the fields end up in the
+// LogMsg.Context, keyed by their dotted paths. See ParseJSONLogs.
+type JSONLogs struct {
+	// TimestampField is the path to the timestamp, like "time"; if empty, it's
+	// detected from the example log lines (see jsonTimestampFields). The
+	// timestamp must be a string in one of the formats supported by
+	// DetectTimeLayout.
+	//
+	// NOTE: on the hosts, the timestamp is found by the last component of the
+	// path (so e.g. for "meta.time", it's the first "time" key in the line),
+	// because it's done for every log line when indexing, and walking the JSON
+	// there would be too slow.
+	TimestampField string
+
+	// MessageField is the path to the message, like "msg"; if empty, the first
+	// one of the jsonMessageFields which is present in the line is used, and
+	// if there are none, the message is the whole line.
+	MessageField string
+}
+
+// ParseJSONLogs validates the log format and the JSON options, and returns
+// the corresponding JSONLogs, or nil if the format isn't LogFormatJSON.
+func ParseJSONLogs(format LogFormat, cfg *ConfigJSONLogs) (*JSONLogs, error) {
+	switch format {
+	case LogFormatDefault:
+		if cfg != nil {
+			return nil, errors.Errorf("json options can only be used with the log_format %q", LogFormatJSON)
+		}
+
+		return nil, nil
+
+	case LogFormatJSON:
+		// Handled below.
+
+	default:
+		return nil, errors.Errorf("invalid log_format %q, the only supported one is %q", format, LogFormatJSON)
+	}
+
+	jl := &JSONLogs{}
+	if cfg != nil {
+		jl.TimestampField = cfg.TimestampField
+		jl.MessageField = cfg.MessageField
+	}
+
+	for _, path := range []string{jl.TimestampField, jl.MessageField} {
+		if path == "" {
+			continue
+		}
+
+		if err := validateJSONPath(path); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return jl, nil
+}
+
+// validateJSONPath checks that the dotted path can be used in the awk code
+// as is: it has no empty keys, and no quotes, backslashes or whitespace.
+func validateJSONPath(path string) error {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return errors.Errorf("invalid json path %q: empty key", path)
+		}
+
+		if strings.ContainsAny(key, "\"\\ \t") {
+			return errors.Errorf("invalid json path %q: key %q has invalid characters", path, key)
+		}
+	}
+
+	return nil
+}
+
+// decodeJSONLogLine decodes the log line which must be a JSON object. The
+// numbers are kept as json.Number, so they're formatted the same way as in
+// the line.
+func decodeJSONLogLine(line string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, errors.Annotatef(err, "not a JSON object")
+	}
+
+	if obj == nil {
+		return nil, errors.Errorf("not a JSON object")
+	}
+
+	return obj, nil
+}
+
+// jsonPathValue returns the value at the dotted path in the decoded JSON
+// object, formatted the same way as the nljsonget awk function does: the
+// strings as is, and the rest as JSON. If there's no such value, or it's
+// null, ok is false.
+func jsonPathValue(obj map[string]interface{}, path string) (value string, ok bool) {
+	var cur interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, isObj := cur.(map[string]interface{})
+		if !isObj {
+			return "", false
+		}
+
+		cur, ok = m[key]
+		if !ok {
+			return "", false
+		}
+	}
+
+	if cur == nil {
+		return "", false
+	}
+
+	return formatJSONValue(cur), true
+}
+
+// formatJSONValue formats the decoded JSON value for the LogMsg.Context: the
+// strings as is, and the rest as compact JSON.
+func formatJSONValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// flattenJSONFields adds all the scalar and array values of the decoded JSON
+// object to the fields map, keyed by their dotted paths, like
+// "request.headers.host"; the nested objects are flattened recursively, and
+// the nulls are skipped.
+func flattenJSONFields(obj map[string]interface{}, prefix string, fields map[string]string) {
+	for k, v := range obj {
+		path := prefix + k
+
+		switch vv := v.(type) {
+		case nil:
+			// Skip
+
+		case map[string]interface{}:
+			flattenJSONFields(vv, path+".", fields)
+
+		default:
+			fields[path] = formatJSONValue(vv)
+		}
+	}
+}
+
+// firstJSONPath returns the first of the paths which has a value in the
+// object, or an empty string if none of them have.
+func firstJSONPath(obj map[string]interface{}, paths []string) string {
+	for _, path := range paths {
+		if _, ok := jsonPathValue(obj, path); ok {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// GetJSONTimeFormatDescr is like GetTimeFormatDescrFromLogLines, but for the
+// JSON logs: the timestamp is taken from the JSONLogs.TimestampField of the
+// example lines (or, if it's not set, from the first field of the
+// jsonTimestampFields present in the first line), and the awk expressions
+// extract the time components from the value of this field. The returned
+// path is the timestamp field which was used.
+func GetJSONTimeFormatDescr(logLines []string, jl *JSONLogs) (*TimeFormatDescr, string, error) {
+	if len(logLines) == 0 {
+		return nil, "", errors.Errorf("no logs, can't detect time format")
+	}
+
+	tsField := jl.TimestampField
+	var tsValues []string
+
+	for i, line := range logLines {
+		obj, err := decodeJSONLogLine(line)
+		if err != nil {
+			return nil, "", errors.Annotatef(err, "log_format is json, but the log line %q is invalid", line)
+		}
+
+		if i == 0 && tsField == "" {
+			tsField = firstJSONPath(obj, jsonTimestampFields)
+			if tsField == "" {
+				return nil, "", errors.Errorf(
+					"no timestamp in the JSON log line %q: none of the fields %s are present; set json.timestamp_field in the logstream options",
+					line, strings.Join(jsonTimestampFields, ", "),
+				)
+			}
+		}
+
+		tsValue, ok := jsonPathValue(obj, tsField)
+		if !ok {
+			return nil, "", errors.Errorf("no timestamp field %q in the JSON log line %q", tsField, line)
+		}
+
+		tsValues = append(tsValues, tsValue)
+	}
+
+	timeFormat, err := GetTimeFormatDescrFromLogLines(tsValues)
+	if err != nil {
+		return nil, "", errors.Annotatef(err, "JSON timestamp field %q", tsField)
+	}
+
+	// All the expressions generated by GenerateTimeDescr take the time
+	// components from $0, so make them take them from the timestamp value
+	// instead.
+	valueExpr := jsonTimestampAWKExpr(tsField)
+	for _, expr := range []*string{
+		&timeFormat.AWKExpr.Month,
+		&timeFormat.AWKExpr.Year,
+		&timeFormat.AWKExpr.Day,
+		&timeFormat.AWKExpr.HHMM,
+		&timeFormat.AWKExpr.MinuteKey,
+	} {
+		*expr = strings.ReplaceAll(*expr, "$0", valueExpr)
+	}
+
+	return timeFormat, tsField, nil
+}
+
+// jsonTimestampAWKExpr returns the awk expression which evaluates to the
+// JSON line starting from the value of the timestamp field with the given
+// path (only the last component of the path is used; see
+// JSONLogs.TimestampField), or to an empty string if there's no such field.
+// It only uses the POSIX awk, since it's evaluated for every line when
+// indexing.
+func jsonTimestampAWKExpr(path string) string {
+	key := path[strings.LastIndex(path, ".")+1:]
+	re := fmt.Sprintf(`"%s" *: *"`, regexQuoteMeta(key))
+
+	return fmt.Sprintf(`(match($0, %s) ? substr($0, RSTART + RLENGTH) : "")`, awkRegexLiteral(re))
+}
+
+// jsonGetAWKExpr returns the awk expression which evaluates to the value at
+// the given path in the current JSON log line, using the nljsonget function
+// of nerdlog_agent.sh.
+func jsonGetAWKExpr(path string) string {
+	return fmt.Sprintf("nljsonget($0, %s)", awkStringLiteral(path))
+}
+
+// parseJSONLogLine populates the LogMsg from the JSON log line in its Msg:
+// all the fields go to the Context (except the timestamp and the message
+// ones), the Msg is the message field (or the whole line if there's none),
+// and the returned timestamp is the value of the tsField, to be parsed by
+// the caller. If the log level is present in the line, it's returned too.
+func parseJSONLogLine(logMsg *LogMsg, jl *JSONLogs, tsField string) (timestamp, level string, err error) {
+	obj, err := decodeJSONLogLine(logMsg.Msg)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	timestamp, ok := jsonPathValue(obj, tsField)
+	if !ok {
+		return "", "", errors.Errorf("no timestamp field %q", tsField)
+	}
+
+	msgField := jl.MessageField
+	if msgField == "" {
+		msgField = firstJSONPath(obj, jsonMessageFields)
+	}
+
+	if levelField := firstJSONPath(obj, jsonLevelFields); levelField != "" {
+		level, _ = jsonPathValue(obj, levelField)
+	}
+
+	fields := map[string]string{}
+	flattenJSONFields(obj, "", fields)
+	delete(fields, tsField)
+
+	if msg, ok := jsonPathValue(obj, msgField); msgField != "" && ok {
+		logMsg.Msg = msg
+		delete(fields, msgField)
+	}
+
+	// The fields never override the ones set by nerdlog itself, like
+	// "lstream".
+	for k, v := range fields {
+		if _, ok := logMsg.Context[k]; !ok {
+			logMsg.Context[k] = v
+		}
+	}
+
+	return timestamp, level, nil
+}
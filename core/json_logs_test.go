@@ -0,0 +1,227 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSONLogs(t *testing.T) {
+	jl, err := ParseJSONLogs(LogFormatDefault, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, jl)
+
+	jl, err = ParseJSONLogs(LogFormatJSON, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &JSONLogs{}, jl)
+	}
+
+	jl, err = ParseJSONLogs(LogFormatJSON, &ConfigJSONLogs{
+		TimestampField: "meta.time",
+		MessageField:   "event.text",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &JSONLogs{TimestampField: "meta.time", MessageField: "event.text"}, jl)
+	}
+
+	_, err = ParseJSONLogs(LogFormatDefault, &ConfigJSONLogs{TimestampField: "time"})
+	assert.Error(t, err)
+
+	_, err = ParseJSONLogs("logfmt", nil)
+	assert.Error(t, err)
+
+	for _, path := range []string{".time", "meta..time", "time.", `ti"me`, `ti\me`, "ti me"} {
+		_, err := ParseJSONLogs(LogFormatJSON, &ConfigJSONLogs{TimestampField: path})
+		assert.Error(t, err, path)
+	}
+}
+
+func TestGetJSONTimeFormatDescr(t *testing.T) {
+	lines := []string{
+		`{"level":"info","time":"2025-03-10T10:00:00Z","msg":"foo"}`,
+		`{"level":"warn","time":"2025-03-10T10:01:00Z","msg":"bar"}`,
+	}
+
+	timeFormat, tsField, err := GetJSONTimeFormatDescr(lines, &JSONLogs{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "time", tsField)
+	assert.Equal(t, time.RFC3339, timeFormat.TimestampLayout)
+	assert.Contains(t, timeFormat.AWKExpr.MinuteKey, jsonTimestampAWKExpr("time"))
+
+	// The nested timestamp field.
+	_, tsField, err = GetJSONTimeFormatDescr(
+		[]string{`{"meta":{"time":"2025-03-10T10:00:00Z"},"msg":"foo"}`},
+		&JSONLogs{TimestampField: "meta.time"},
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "meta.time", tsField)
+	}
+
+	_, _, err = GetJSONTimeFormatDescr([]string{`Mar 10 10:00:00 myhost foo`}, &JSONLogs{})
+	assert.Error(t, err)
+
+	_, _, err = GetJSONTimeFormatDescr([]string{`{"msg":"foo"}`}, &JSONLogs{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "json.timestamp_field")
+	}
+}
+
+func TestParseJSONLogLine(t *testing.T) {
+	logMsg := &LogMsg{
+		Msg: `{"time":"2025-03-10T10:00:00Z","level":"error","msg":"request failed",` +
+			`"lstream":"foo","status":500,"ok":false,"tags":["a","b"],"trace":null,` +
+			`"request":{"method":"GET","headers":{"host":"example.com"}}}`,
+		Context: map[string]string{"lstream": "myhost"},
+	}
+
+	timestamp, level, err := parseJSONLogLine(logMsg, &JSONLogs{}, "time")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "2025-03-10T10:00:00Z", timestamp)
+	assert.Equal(t, "error", level)
+	assert.Equal(t, "request failed", logMsg.Msg)
+	assert.Equal(t, map[string]string{
+		"lstream":              "myhost",
+		"level":                "error",
+		"status":               "500",
+		"ok":                   "false",
+		"tags":                 `["a","b"]`,
+		"request.method":       "GET",
+		"request.headers.host": "example.com",
+	}, logMsg.Context)
+
+	// Without the message field, the message is the whole line.
+	line := `{"ts":"2025-03-10T10:00:00Z","event":"started"}`
+	logMsg = &LogMsg{Msg: line, Context: map[string]string{}}
+	_, level, err = parseJSONLogLine(logMsg, &JSONLogs{}, "ts")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", level)
+		assert.Equal(t, line, logMsg.Msg)
+		assert.Equal(t, map[string]string{"event": "started"}, logMsg.Context)
+	}
+
+	// The custom message field.
+	logMsg = &LogMsg{Msg: `{"ts":"2025-03-10T10:00:00Z","event":{"text":"hi"}}`, Context: map[string]string{}}
+	_, _, err = parseJSONLogLine(logMsg, &JSONLogs{MessageField: "event.text"}, "ts")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hi", logMsg.Msg)
+		assert.Equal(t, map[string]string{}, logMsg.Context)
+	}
+
+	_, _, err = parseJSONLogLine(&LogMsg{Msg: `{"msg":"foo"}`, Context: map[string]string{}}, &JSONLogs{}, "ts")
+	assert.Error(t, err)
+
+	_, _, err = parseJSONLogLine(&LogMsg{Msg: `not json`, Context: map[string]string{}}, &JSONLogs{}, "ts")
+	assert.Error(t, err)
+}
+
+// awkFuncJSONGet returns the awk functions defined by awk_func_json_get in
+// nerdlog_agent.sh, so that the code generated for the JSON logs can be run
+// by the tests.
+func awkFuncJSONGet(t *testing.T) string {
+	const prefix = "\nawk_func_json_get='\n"
+
+	start := strings.Index(nerdlogAgentSh, prefix)
+	if start < 0 {
+		t.Fatal("no awk_func_json_get in nerdlog_agent.sh")
+	}
+	start += len(prefix)
+
+	end := strings.Index(nerdlogAgentSh[start:], "\n'\n")
+	if end < 0 {
+		t.Fatal("no end of awk_func_json_get in nerdlog_agent.sh")
+	}
+
+	return nerdlogAgentSh[start : start+end]
+}
+
+// TestJSONFilterQueryMatchesWithAWK runs the filters compiled for the JSON logs
+// through the actual awk, together with the nljsonget function of the agent.
+func TestJSONFilterQueryMatchesWithAWK(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not available")
+	}
+
+	lines := []string{
+		`{"time":"2025-03-10T10:00:00Z","level":"error","msg":"request failed","status":500,"request":{"method":"GET","headers":{"host":"example.com"}}}`,
+		`{"time":"2025-03-10T10:00:01Z", "level": "info", "msg": "request done", "status": 200, "request": {"method": "POST", "headers": {"host": "api.example.com"}}}`,
+		`{"time":"2025-03-10T10:00:02Z","level":"info","msg":"say \"host\"","request":{"headers":{"x-host":"example.com"}}}`,
+		`{"time":"2025-03-10T10:00:03Z","level":"warn","msg":"retrying","hostname":"web-01","request":null}`,
+	}
+
+	type testCase struct {
+		query string
+
+		// wantLines are 0-based indices of the matching lines.
+		wantLines []int
+	}
+
+	testCases := []testCase{
+		{query: "request.headers.host:example.com", wantLines: []int{0}},
+		{query: "request.method:POST OR status:500", wantLines: []int{0, 1}},
+		{query: "host:web-01", wantLines: []int{3}},
+		{query: "host:/^web-/", wantLines: []int{3}},
+		{query: "level:error OR level:warn", wantLines: []int{0, 3}},
+		{query: `msg:"say \"host\"" NOT request.headers.host:example.com`, wantLines: []int{2}},
+		{query: "retrying", wantLines: []int{3}},
+	}
+
+	timeFormat, _, err := GetJSONTimeFormatDescr(lines, &JSONLogs{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fieldsCfg := NewFilterFieldsConfig(timeFormat)
+	fieldsCfg.JSONTimestampField = "time"
+
+	funcs := awkFuncJSONGet(t)
+
+	for _, tc := range testCases {
+		expr, err := ParseFilterQuery(tc.query)
+		if !assert.NoError(t, err, "query %q", tc.query) {
+			continue
+		}
+
+		awkExpr := CompileFilterQueryToAWK(expr, fieldsCfg, DefaultFilterMatchOpts)
+
+		cmd := exec.Command("awk", funcs+"\n"+awkExpr+" { print NR-1 }")
+		cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+		out, err := cmd.CombinedOutput()
+		if !assert.NoError(t, err, "query %q, awk %q: %s", tc.query, awkExpr, string(out)) {
+			continue
+		}
+
+		var gotLines []int
+		for _, s := range strings.Fields(string(out)) {
+			var n int
+			for _, c := range s {
+				n = n*10 + int(c-'0')
+			}
+			gotLines = append(gotLines, n)
+		}
+
+		assert.Equal(t, tc.wantLines, gotLines, "query %q, awk %q", tc.query, awkExpr)
+	}
+
+	// The minute key is extracted from the timestamp field, wherever it is in
+	// the line.
+	cmd := exec.Command("awk", "{ print "+timeFormat.AWKExpr.MinuteKey+" }")
+	cmd.Stdin = strings.NewReader(`{"level":"info","time":"2025-03-10T10:07:00Z"}` + "\n")
+	out, err := cmd.CombinedOutput()
+	if assert.NoError(t, err, string(out)) {
+		wantCmd := exec.Command("awk", "{ print "+strings.ReplaceAll(
+			timeFormat.AWKExpr.MinuteKey, jsonTimestampAWKExpr("time"), "$0",
+		)+" }")
+		wantCmd.Stdin = strings.NewReader("2025-03-10T10:07:00Z\n")
+		wantOut, err := wantCmd.CombinedOutput()
+		if assert.NoError(t, err, string(wantOut)) {
+			assert.Equal(t, string(wantOut), string(out))
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+)
+
+// LastVisits stores, for every logstream, when its logs were last viewed up
+// to the present moment, in a JSON file, typically
+// ~/.local/state/nerdlog/last_visits.json; it's what makes it possible to
+// query everything since the last visit, see Nerdlog.QuerySinceLastVisit.
+// It's safe for concurrent use.
+type LastVisits struct {
+	params LastVisitsParams
+
+	mtx sync.Mutex
+}
+
+type LastVisitsParams struct {
+	// Path is the JSON file to store the last visits in. The file and its
+	// directory are created as needed.
+	Path string
+
+	Clock clock.Clock
+}
+
+func NewLastVisits(params LastVisitsParams) *LastVisits {
+	if params.Clock == nil {
+		panic("Clock is nil")
+	}
+
+	return &LastVisits{
+		params: params,
+	}
+}
+
+// Get returns the last visits of the given logstreams. The ones which were
+// never visited are not included, and neither are the ones visited in the
+// future: it means that the clock was adjusted back since then, so the
+// timestamp can't be trusted.
+func (lv *LastVisits) Get(lstreams []string) (map[string]time.Time, error) {
+	lv.mtx.Lock()
+	defer lv.mtx.Unlock()
+
+	visits, err := lv.load()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	now := lv.params.Clock.Now()
+
+	ret := make(map[string]time.Time, len(lstreams))
+	for _, name := range lstreams {
+		t, ok := visits[name]
+		if !ok || t.After(now) {
+			continue
+		}
+
+		ret[name] = t
+	}
+
+	return ret, nil
+}
+
+// Set stores the last visit time for the given logstreams, and saves the
+// file. The file is re-read before saving it, so that the visits written by
+// other nerdlog instances in the meantime are not lost; if it's broken, it's
+// overwritten.
+func (lv *LastVisits) Set(lstreams []string, t time.Time) error {
+	lv.mtx.Lock()
+	defer lv.mtx.Unlock()
+
+	visits, err := lv.load()
+	if err != nil {
+		visits = map[string]time.Time{}
+	}
+
+	for _, name := range lstreams {
+		visits[name] = t
+	}
+
+	data, err := json.MarshalIndent(visits, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(writeFileAtomic(lv.params.Path, data))
+}
+
+// load reads the file. If it doesn't exist, an empty map is returned.
+func (lv *LastVisits) load() (map[string]time.Time, error) {
+	visits := map[string]time.Time{}
+
+	data, err := ioutil.ReadFile(lv.params.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return visits, nil
+		}
+
+		return nil, errors.Trace(err)
+	}
+
+	if err := json.Unmarshal(data, &visits); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", lv.params.Path)
+	}
+
+	return visits, nil
+}
+
+// LastVisit returns the earliest of the last visits of the current
+// logstreams, which is where the QuerySinceLastVisit starts; ok is false if
+// some of them were never visited (or the Options.LastVisits is nil), and
+// then the QuerySinceLastVisit uses the default range.
+func (n *Nerdlog) LastVisit() (since time.Time, ok bool, err error) {
+	if n.opts.LastVisits == nil {
+		return time.Time{}, false, nil
+	}
+
+	lstreams := n.lstreamNames()
+	if len(lstreams) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	visits, err := n.opts.LastVisits.Get(lstreams)
+	if err != nil {
+		return time.Time{}, false, errors.Trace(err)
+	}
+
+	for _, name := range lstreams {
+		t, ok := visits[name]
+		if !ok {
+			return time.Time{}, false, nil
+		}
+
+		if since.IsZero() || t.Before(since) {
+			since = t
+		}
+	}
+
+	return since, true, nil
+}
+
+// QuerySinceLastVisit is like Query, but it queries everything since the
+// last visit of the logstreams (see LastVisit) up to now, regardless of the
+// params.From and params.To. If some of the logstreams were never visited,
+// or the last visits can't be read, the params.From is used as is, so it
+// should be set to the default range start.
+//
+// Every successful query up to now (with the zero params.To) counts as a
+// visit of the queried logstreams; see Options.LastVisits.
+func (n *Nerdlog) QuerySinceLastVisit(ctx context.Context, params QueryLogsParams) (*LogRespTotal, error) {
+	if n.opts.LastVisits == nil {
+		return nil, errors.Errorf("last visits are not stored, Options.LastVisits is nil")
+	}
+
+	// The logstreams are only known once the LStreamsManager reports its
+	// state, so wait for them to connect first, like Query does.
+	if err := n.waitConnected(ctx, nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	since, ok, err := n.LastVisit()
+	if err != nil {
+		n.opts.Logger.Warnf("Failed to read last visits, using the default range: %s", err.Error())
+	}
+
+	if ok {
+		params.From = since
+	}
+	params.To = time.Time{}
+
+	return n.Query(ctx, params)
+}
+
+// lstreamNames returns the sorted names of all the current logstreams,
+// regardless of their state; nil if the state is not known yet.
+func (n *Nerdlog) lstreamNames() []string {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.lastState == nil {
+		return nil
+	}
+
+	var lstreams []string
+	for _, names := range n.lastState.LStreamsByState {
+		for name := range names {
+			lstreams = append(lstreams, name)
+		}
+	}
+	sort.Strings(lstreams)
+
+	return lstreams
+}
+
+// recordVisit records the visit of the given logstreams (or all of them, if
+// lstreams is nil) except the skipped ones, at the given time, if the
+// Options.LastVisits is set.
+func (n *Nerdlog) recordVisit(lstreams, skipped []string, t time.Time) {
+	if n.opts.LastVisits == nil {
+		return
+	}
+
+	if lstreams == nil {
+		lstreams = n.lstreamNames()
+	}
+
+	skippedSet := make(map[string]struct{}, len(skipped))
+	for _, name := range skipped {
+		skippedSet[name] = struct{}{}
+	}
+
+	visited := make([]string, 0, len(lstreams))
+	for _, name := range lstreams {
+		if _, ok := skippedSet[name]; !ok {
+			visited = append(visited, name)
+		}
+	}
+
+	if len(visited) == 0 {
+		return
+	}
+
+	if err := n.opts.LastVisits.Set(visited, t); err != nil {
+		n.opts.Logger.Warnf("Failed to save last visits: %s", err.Error())
+	}
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastVisits(t *testing.T) {
+	clockMock := clock.NewMock()
+	clockMock.Set(time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC))
+
+	fname := filepath.Join(t.TempDir(), "state", "last_visits.json")
+	lv := NewLastVisits(LastVisitsParams{Path: fname, Clock: clockMock})
+
+	// First visit: nothing is there, and the file doesn't exist yet.
+	visits, err := lv.Get([]string{"web-01", "web-02"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Time{}, visits)
+
+	t1 := clockMock.Now().Add(-time.Hour)
+	assert.NoError(t, lv.Set([]string{"web-01", "web-02"}, t1))
+
+	t2 := clockMock.Now().Add(-time.Minute)
+	assert.NoError(t, lv.Set([]string{"web-02"}, t2))
+
+	// Another instance sees the same visits.
+	lv2 := NewLastVisits(LastVisitsParams{Path: fname, Clock: clockMock})
+	visits, err = lv2.Get([]string{"web-01", "web-02", "web-03"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(visits))
+	assert.True(t, visits["web-01"].Equal(t1))
+	assert.True(t, visits["web-02"].Equal(t2))
+
+	// The clock was adjusted back, so the visits from the future are ignored.
+	clockMock.Set(t1.Add(time.Minute))
+	visits, err = lv.Get([]string{"web-01", "web-02"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(visits))
+	assert.True(t, visits["web-01"].Equal(t1))
+
+	// A broken file is an error for Get, but Set overwrites it.
+	assert.NoError(t, ioutil.WriteFile(fname, []byte("{broken"), 0644))
+	_, err = lv.Get([]string{"web-01"})
+	assert.Error(t, err)
+
+	assert.NoError(t, lv.Set([]string{"web-01"}, t1))
+	visits, err = lv.Get([]string{"web-01", "web-02"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(visits))
+	assert.True(t, visits["web-01"].Equal(t1))
+}
+
+func TestNerdlogQuerySinceLastVisit(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-3*time.Hour), "ancient"),
+		fakeLogLine(now.Add(-2*time.Hour), "old"),
+		fakeLogLine(now.Add(-10*time.Minute), "new"),
+	)
+
+	fname := filepath.Join(t.TempDir(), "last_visits.json")
+	lv := NewLastVisits(LastVisitsParams{Path: fname, Clock: clock.New()})
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs, applyQueryArgs: true}
+		},
+		ClientID:   "test",
+		LastVisits: lv,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The default range, used if the logstreams were never visited.
+	defaultParams := QueryLogsParams{
+		From: now.Add(-150 * time.Minute),
+	}
+
+	msgs := func(resp *LogRespTotal) map[string]int {
+		ret := map[string]int{}
+		for _, msg := range resp.Logs {
+			ret[msg.Msg]++
+		}
+		return ret
+	}
+
+	// First visit: the default range is used.
+	resp, err := n.QuerySinceLastVisit(ctx, defaultParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"old": 2, "new": 2}, msgs(resp))
+
+	// The query has been recorded as a visit of both logstreams.
+	since, ok, err := n.LastVisit()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, time.Since(since) < time.Minute, "since: %s", since)
+
+	// The persisted timestamp is used as the range start next time; it's in
+	// the past, so that there are some logs to see.
+	visited := now.Add(-30 * time.Minute)
+	assert.NoError(t, lv.Set([]string{"fake-01", "fake-02"}, visited))
+
+	resp, err = n.QuerySinceLastVisit(ctx, defaultParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"new": 2}, msgs(resp))
+
+	// If the logstreams were visited at different times, the earliest visit
+	// is used, so that nothing is missed on any of them.
+	assert.NoError(t, lv.Set([]string{"fake-01"}, now.Add(-30*time.Minute)))
+	assert.NoError(t, lv.Set([]string{"fake-02"}, now.Add(-200*time.Minute)))
+
+	since, ok, err = n.LastVisit()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, since.Equal(now.Add(-200*time.Minute)), "since: %s", since)
+
+	resp, err = n.QuerySinceLastVisit(ctx, defaultParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"ancient": 2, "old": 2, "new": 2}, msgs(resp))
+
+	// A visit in the future (the clock was adjusted back) can't be trusted, so
+	// it's like the first visit.
+	assert.NoError(t, lv.Set([]string{"fake-01", "fake-02"}, time.Now().Add(time.Hour)))
+
+	_, ok, err = n.LastVisit()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	resp, err = n.QuerySinceLastVisit(ctx, defaultParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"old": 2, "new": 2}, msgs(resp))
+
+	// Viewing a historical time range is not a visit.
+	assert.NoError(t, lv.Set([]string{"fake-01", "fake-02"}, visited))
+	_, err = n.Query(ctx, QueryLogsParams{
+		From: now.Add(-4 * time.Hour),
+		To:   now.Add(-time.Hour),
+	})
+	assert.NoError(t, err)
+
+	since, ok, err = n.LastVisit()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, since.Equal(visited), "since: %s", since)
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxLineLen is the max length of a single line read from the logstream's
+// shell; longer lines (which are pretty much always some binary noise in the
+// logs) are truncated, instead of breaking the scanning altogether.
+const maxLineLen = 1024 * 1024
+
+// lineSplitter implements the bufio.SplitFunc which splits the data on \n
+// only, and is binary-safe: NULs, invalid UTF-8 and whatever else is passed
+// through as is, and too long lines are truncated to maxLen bytes instead of
+// failing with bufio.ErrTooLong.
+//
+// Unlike bufio.ScanLines, it doesn't strip the \r characters either: it's
+// needed to support compression, since we sometimes read text lines and
+// sometimes compressed data, and the latter must stay intact.
+type lineSplitter struct {
+	maxLen int
+
+	// noTruncate disables the truncation of long lines; it's set while
+	// reading the compressed data, which can't be truncated. The max length is
+	// then only limited by the scanner's buffer size.
+	noTruncate bool
+
+	// truncatedHead is non-nil while we're skipping the rest of a too long
+	// line; it contains the first maxLen bytes of it.
+	truncatedHead []byte
+}
+
+// newLineScanner returns the scanner reading lines from r with the
+// lineSplitter, which can be used to control it while scanning.
+func newLineScanner(r io.Reader) (*bufio.Scanner, *lineSplitter) {
+	ls := &lineSplitter{maxLen: maxLineLen}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 2*maxLineLen)
+	scanner.Split(ls.split)
+
+	return scanner, ls
+}
+
+func (ls *lineSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	i := bytes.IndexByte(data, '\n')
+
+	if ls.truncatedHead != nil {
+		// Skip the rest of the too long line, and once it's over, return the
+		// head of it.
+		if i < 0 && !atEOF {
+			return len(data), nil, nil
+		}
+
+		head := ls.truncatedHead
+		ls.truncatedHead = nil
+
+		if i < 0 {
+			return len(data), head, nil
+		}
+
+		return i + 1, head, nil
+	}
+
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i >= 0 {
+		// We have a full newline-terminated line.
+		return i + 1, data[0:i], nil
+	}
+
+	// If we're at EOF, we have a final, non-terminated line. Return it.
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	if !ls.noTruncate && len(data) >= ls.maxLen {
+		ls.truncatedHead = append([]byte(nil), data[:ls.maxLen]...)
+		return len(data), nil, nil
+	}
+
+	// Request more data.
+	return 0, nil, nil
+}
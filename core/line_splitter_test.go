@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scanAllLines(t *testing.T, input []byte) []string {
+	linesCh := make(chan string, 100)
+	getScannerFunc("test", bytes.NewReader(input), linesCh)()
+
+	var lines []string
+	for line := range linesCh {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func TestGetScannerFuncBinarySafe(t *testing.T) {
+	longLine := strings.Repeat("x", maxLineLen+100)
+
+	input := "nul\x00in the middle\n" +
+		"invalid \xff\xfe utf8\n" +
+		"crlf\r\n" +
+		"\n" +
+		longLine + "\n" +
+		"after long\n" +
+		"no newline"
+
+	assert.Equal(t, []string{
+		"nul\x00in the middle",
+		"invalid \xff\xfe utf8",
+		"crlf\r",
+		"",
+		longLine[:maxLineLen],
+		"after long",
+		"no newline",
+	}, scanAllLines(t, []byte(input)))
+}
+
+func TestGetScannerFuncTruncatedAtEOF(t *testing.T) {
+	longLine := strings.Repeat("x", maxLineLen+100)
+
+	assert.Equal(t, []string{
+		"first",
+		longLine[:maxLineLen],
+	}, scanAllLines(t, []byte("first\n"+longLine)))
+}
+
+func TestGetScannerFuncCompressedBinary(t *testing.T) {
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	_, err := gzw.Write([]byte("nul\x00line\r\ninvalid \xff utf8\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, gzw.Close())
+
+	var input bytes.Buffer
+	input.WriteString("before\n")
+	input.WriteString(compressedStartMarkerPrefix + string(WireCompressionGzip) + "\n")
+	input.Write(compressed.Bytes())
+	input.WriteString(compressedEndMarker + "\n")
+	input.WriteString("after\n")
+
+	assert.Equal(t, []string{
+		"before",
+		"nul\x00line",
+		"invalid \xff utf8",
+		"after",
+	}, scanAllLines(t, input.Bytes()))
+}
+
+func TestQueryBinaryLogs(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "nul\x00byte"),
+		fakeLogLine(now.Add(-1*time.Minute), "invalid \xff\xfe utf8"),
+	)
+
+	n := newTestNerdlog(t, logs)
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From: now.Add(-time.Hour),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The raw bytes are preserved, from both logstreams.
+	var msgs []string
+	for _, msg := range resp.Logs {
+		msgs = append(msgs, msg.Msg)
+		assert.True(t, strings.HasSuffix(msg.OrigLine, msg.Msg), msg.OrigLine)
+	}
+
+	assert.Equal(t, []string{
+		"nul\x00byte", "nul\x00byte",
+		"invalid \xff\xfe utf8", "invalid \xff\xfe utf8",
+	}, msgs)
+
+	assert.Equal(t, "invalid �� utf8", SanitizeForDisplay(resp.Logs[2].Msg))
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"regexp"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// DefaultLocale is the locale which the agent runs with, unless configured
+	// otherwise: the output of tools like date(1) or ls(1) depends on the
+	// LC_TIME, LANG etc (e.g. month names or separators), so to parse it
+	// reliably, we make it deterministic.
+	DefaultLocale = "C"
+
+	// LocaleNone means that the locale is not set at all, so the agent runs
+	// with whatever locale the remote shell session has.
+	LocaleNone = "none"
+)
+
+// localeRegex matches the locale names like "C", "C.UTF-8" or
+// "en_US.UTF-8@euro". Since the locale is used in the shell command, it can't
+// contain anything which the shell would interpret.
+var localeRegex = regexp.MustCompile(`^[a-zA-Z0-9_.@-]+$`)
+
+func validateLocale(locale string) error {
+	if locale == "" || locale == LocaleNone {
+		return nil
+	}
+
+	if !localeRegex.MatchString(locale) {
+		return errors.Errorf("invalid locale %q", locale)
+	}
+
+	return nil
+}
+
+// localeCmd returns the shell command which sets the given locale for the
+// remote shell session (an empty locale means DefaultLocale), or an empty
+// string for LocaleNone.
+func localeCmd(locale string) string {
+	switch locale {
+	case "":
+		locale = DefaultLocale
+	case LocaleNone:
+		return ""
+	}
+
+	return "export LC_ALL=" + locale
+}
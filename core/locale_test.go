@@ -0,0 +1,23 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocaleCmd(t *testing.T) {
+	assert.Equal(t, "export LC_ALL=C", localeCmd(""))
+	assert.Equal(t, "export LC_ALL=C.UTF-8", localeCmd("C.UTF-8"))
+	assert.Equal(t, "", localeCmd(LocaleNone))
+}
+
+func TestValidateLocale(t *testing.T) {
+	for _, locale := range []string{"", "none", "C", "C.UTF-8", "en_US.UTF-8", "de_DE@euro"} {
+		assert.NoError(t, validateLocale(locale), locale)
+	}
+
+	for _, locale := range []string{"C; rm -rf /", "$(whoami)", "en US"} {
+		assert.Error(t, validateLocale(locale), locale)
+	}
+}
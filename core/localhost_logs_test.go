@@ -0,0 +1,80 @@
+package core
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The helpers below are for the tests which query the real log files on
+// localhost, using the actual agent.
+
+// localhostTestFrom returns the time to put the test logs at. The agent's
+// stats don't have the year, so it's inferred from the current time, and the
+// logs have to be recent.
+func localhostTestFrom() time.Time {
+	return time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Hour)
+}
+
+// localhostTestLogLine returns the log line at the given time, with the
+// given rest of the line after the timestamp, like "myhost app[1]: foo".
+func localhostTestLogLine(t time.Time, rest string) string {
+	return t.Format("2006-01-02T15:04:05.000000-07:00") + " " + rest
+}
+
+// appendLocalhostTestLog appends the lines to the log file, creating it if
+// needed.
+func appendLocalhostTestLog(t *testing.T, logPath string, lines ...string) {
+	t.Helper()
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localhostTestLogStream returns the config of the logstream with the given
+// log file on localhost, in UTC (the timestamps in the test logs are in UTC
+// as well), with the extra shell init commands, if any.
+func localhostTestLogStream(logPath string, shellInit ...string) ConfigLogStream {
+	return ConfigLogStream{
+		Hostname: "localhost",
+		LogFiles: []string{logPath},
+		Options: ConfigLogStreamOptions{
+			ShellInit: append([]string{"export TZ=UTC"}, shellInit...),
+		},
+	}
+}
+
+// newLocalhostTestNerdlog creates the Nerdlog with all the given logstreams
+// selected; it's closed once the test finishes.
+func newLocalhostTestNerdlog(
+	t *testing.T, clientID string, configLogStreams ConfigLogStreams,
+) *Nerdlog {
+	t.Helper()
+
+	names := make([]string, 0, len(configLogStreams))
+	for name := range configLogStreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	n, err := New(Options{
+		LStreams:         strings.Join(names, ","),
+		ConfigLogStreams: configLogStreams,
+		ClientID:         clientID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Close)
+
+	return n
+}
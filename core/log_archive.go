@@ -0,0 +1,232 @@
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// LogArchiveExtensions are the supported extensions of the log archives; see
+// ConfigLogArchive.
+var LogArchiveExtensions = []string{".tar.gz", ".tgz", ".tar"}
+
+// LogStreamArchive describes the archive entry which the logstream reads; see
+// ConfigLogStream.LogArchive.
+//
+// During bootstrap, the entry is extracted on the host to the logstream's
+// LogFiles[0], and from then on it's queried like any other log file, so the
+// time range, the filters etc all work the same way as for the live logs.
+type LogStreamArchive struct {
+	// Path is the path to the archive on the host.
+	Path string
+
+	// Entry is the name of the entry within the archive.
+	Entry string
+}
+
+// logArchiveIsGzipped returns whether the archive with the given path is
+// gzipped; it returns an error if the extension isn't one of the
+// LogArchiveExtensions.
+func logArchiveIsGzipped(archivePath string) (bool, error) {
+	switch {
+	case strings.HasSuffix(archivePath, ".tar.gz"), strings.HasSuffix(archivePath, ".tgz"):
+		return true, nil
+	case strings.HasSuffix(archivePath, ".tar"):
+		return false, nil
+	}
+
+	return false, errors.Errorf(
+		"unsupported log archive %q: the extension must be one of %s",
+		archivePath, strings.Join(LogArchiveExtensions, ", "),
+	)
+}
+
+// logArchiveEntryPath returns the host-side path of the file which the given
+// archive entry is extracted to.
+func logArchiveEntryPath(archive LogStreamArchive) string {
+	h := fnv.New32a()
+	h.Write([]byte(archive.Path))
+	h.Write([]byte{0})
+	h.Write([]byte(archive.Entry))
+
+	// The agent doesn't quote the log file paths everywhere, so only keep the
+	// safe characters of the entry name; the hash makes the path unique anyway.
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, strings.TrimSuffix(path.Base(archive.Entry), ".gz"))
+
+	return fmt.Sprintf("/tmp/nerdlog_archive_%08x_%s", h.Sum32(), base)
+}
+
+// logArchiveExtractCmd returns the bootstrap shell command which extracts the
+// archive entry to the logstream's log file, unless it's already extracted
+// from the same version of the archive. Since the agent's index of the
+// previously extracted file is no longer valid, indexFile is removed whenever
+// the entry is extracted.
+func logArchiveExtractCmd(archive LogStreamArchive, dst, indexFile string, sudoMode SudoMode) string {
+	gzipped, err := logArchiveIsGzipped(archive.Path)
+	if err != nil {
+		// Checked by the resolver.
+		panic(err.Error())
+	}
+
+	var tarParts []string
+	if sudoMode == SudoModeFull {
+		tarParts = append(tarParts, "sudo", "-n")
+	}
+
+	tarFlags := "-xOf"
+	if gzipped {
+		tarFlags = "-xzOf"
+	}
+	tarParts = append(tarParts, "tar", tarFlags, shellQuote(archive.Path), "--", shellQuote(archive.Entry))
+
+	if strings.HasSuffix(archive.Entry, ".gz") {
+		tarParts = append(tarParts, "|", "gzip", "-dc")
+	}
+
+	qArchive := shellQuote(archive.Path)
+	qDst := shellQuote(dst)
+	qTmp := shellQuote(dst+".tmp") + ".$$"
+	failure := "echo " + shellQuote("error:failed to extract "+archive.Entry+" from "+archive.Path) + " 1>&2; echo 'bootstrap failed'; exit 1"
+
+	var sb strings.Builder
+
+	if sudoMode != SudoModeFull {
+		sb.WriteString("  if [ ! -r " + qArchive + " ]; then echo " +
+			shellQuote("error:log archive "+archive.Path+" does not exist or is not readable") +
+			" 1>&2; echo 'bootstrap failed'; exit 1; fi\n")
+	}
+
+	sb.WriteString("  if [ ! -e " + qDst + " ] || [ " + qArchive + " -nt " + qDst + " ]; then\n")
+	sb.WriteString("    rm -f " + shellQuote(indexFile) + " && " + strings.Join(tarParts, " ") + " > " + qTmp + " && mv " + qTmp + " " + qDst + "\n")
+	sb.WriteString("    if [ $? -ne 0 ]; then rm -f " + qTmp + "; " + failure + "; fi\n")
+	sb.WriteString("  fi\n")
+
+	return sb.String()
+}
+
+// listLocalLogArchive returns the names of all the regular files in the given
+// local archive, in the archive order.
+func listLocalLogArchive(archivePath string) ([]string, error) {
+	gzipped, err := logArchiveIsGzipped(archivePath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading %s", archivePath)
+		}
+		defer gzr.Close()
+
+		r = gzr
+	}
+
+	var entries []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "reading %s", archivePath)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			entries = append(entries, hdr.Name)
+		}
+	}
+
+	return entries, nil
+}
+
+// expandLogArchives replaces every logstream which has a log archive with a
+// separate logstream per archive entry, named "<name>/<entry>"; see
+// ConfigLogStream.LogArchive.
+func expandLogArchives(logStreams []draftLogStream) ([]draftLogStream, error) {
+	ret := make([]draftLogStream, 0, len(logStreams))
+
+	for _, ls := range logStreams {
+		if ls.archive == nil {
+			ret = append(ret, ls)
+			continue
+		}
+
+		if ls.archive.Path == "" {
+			return nil, errors.Errorf("%s: log_archive has no path", ls.name)
+		}
+
+		if _, err := logArchiveIsGzipped(ls.archive.Path); err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		entries := ls.archive.Entries
+		if len(entries) == 0 {
+			if !strings.HasPrefix(ls.host.Addr, "localhost:") {
+				return nil, errors.Errorf(
+					"%s: log_archive entries must be listed explicitly for the remote hosts", ls.name,
+				)
+			}
+
+			var err error
+			entries, err = listLocalLogArchive(ls.archive.Path)
+			if err != nil {
+				return nil, errors.Annotatef(err, "%s: listing log archive", ls.name)
+			}
+
+			if len(entries) == 0 {
+				return nil, errors.Errorf("%s: log archive %s has no files", ls.name, ls.archive.Path)
+			}
+		}
+
+		tags := map[string]struct{}{}
+		for _, entry := range entries {
+			tag := strings.TrimPrefix(entry, "./")
+			if tag == "" {
+				return nil, errors.Errorf("%s: empty log archive entry", ls.name)
+			}
+
+			if _, exists := tags[tag]; exists {
+				return nil, errors.Errorf("%s: log archive entry %q is used more than once", ls.name, tag)
+			}
+			tags[tag] = struct{}{}
+
+			archive := &LogStreamArchive{
+				Path:  ls.archive.Path,
+				Entry: entry,
+			}
+
+			lsCopy := ls
+			lsCopy.name = fmt.Sprintf("%s/%s", ls.name, tag)
+			lsCopy.logFiles = []string{logArchiveEntryPath(*archive)}
+			lsCopy.archive = nil
+			lsCopy.archiveEntry = archive
+			lsCopy.sourceTag = tag
+
+			ret = append(ret, lsCopy)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestLogArchive writes a .tar.gz with the given entries to the given
+// path; the entries ending with ".gz" are gzipped.
+func writeTestLogArchive(t *testing.T, archivePath string, entries map[string]string, order []string) {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for _, name := range order {
+		data := []byte(entries[name])
+		if strings.HasSuffix(name, ".gz") {
+			var gzBuf bytes.Buffer
+			w := gzip.NewWriter(&gzBuf)
+			w.Write(data)
+			w.Close()
+			data = gzBuf.Bytes()
+		}
+
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogArchiveQuery(t *testing.T) {
+	dir := t.TempDir()
+
+	syslog := strings.Join([]string{
+		"2025-03-10T09:58:00.000000+00:00 web-01 sshd[10]: session opened",
+		"2025-03-10T10:00:01.000000+00:00 web-01 myapp[123]: request failed",
+		"2025-03-10T10:02:00.000000+00:00 web-01 myapp[123]: request ok",
+		"2025-03-10T10:04:00.000000+00:00 web-01 myapp[123]: request failed again",
+		"2025-03-10T10:20:00.000000+00:00 web-01 myapp[123]: request failed too late",
+	}, "\n") + "\n"
+
+	appLog := strings.Join([]string{
+		"2025-03-10T09:59:00.000000+00:00 web-01 worker[7]: job failed too early",
+		"2025-03-10T10:03:00.000000+00:00 web-01 worker[7]: job failed",
+		"2025-03-10T10:05:00.000000+00:00 web-01 worker[7]: job done",
+	}, "\n") + "\n"
+
+	syslogPath := filepath.Join(dir, "syslog")
+	appLogPath := filepath.Join(dir, "app.log")
+	for p, data := range map[string]string{syslogPath: syslog, appLogPath: appLog} {
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archivePath := filepath.Join(dir, "bundle.tar.gz")
+	writeTestLogArchive(t, archivePath, map[string]string{
+		"./var/log/syslog":       syslog,
+		"var/log/app/app.log.gz": appLog,
+	}, []string{"./var/log/syslog", "var/log/app/app.log.gz"})
+
+	shellInit := []string{"export TZ=UTC"}
+	configLogStreams := ConfigLogStreams{
+		"live": {
+			Hostname: "localhost",
+			LogSources: []ConfigLogSource{
+				{Tag: "var/log/syslog", LogFiles: []string{syslogPath}},
+				{Tag: "var/log/app/app.log.gz", LogFiles: []string{appLogPath}},
+			},
+			Options: ConfigLogStreamOptions{ShellInit: shellInit},
+		},
+		"bundle": {
+			Hostname:   "localhost",
+			LogArchive: &ConfigLogArchive{Path: archivePath},
+			Options:    ConfigLogStreamOptions{ShellInit: shellInit},
+		},
+	}
+
+	query := func(lstreams string) []string {
+		n, err := New(Options{
+			LStreams:         lstreams,
+			ConfigLogStreams: configLogStreams,
+			ClientID:         "log_archive_test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		resp, err := n.Query(ctx, QueryLogsParams{
+			From:        time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC),
+			To:          time.Date(2025, 3, 10, 10, 10, 0, 0, time.UTC),
+			Query:       "/failed/",
+			QueryLang:   QueryLangFilter,
+			MaxNumLines: 100,
+		})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+
+		var got []string
+		for _, msg := range resp.Logs {
+			got = append(got, fmt.Sprintf(
+				"%s %s: %s", msg.Time.UTC().Format(time.RFC3339), msg.Context["logsource"], msg.Msg,
+			))
+		}
+
+		return got
+	}
+
+	want := []string{
+		"2025-03-10T10:00:01Z var/log/syslog: request failed",
+		"2025-03-10T10:03:00Z var/log/app/app.log.gz: job failed",
+		"2025-03-10T10:04:00Z var/log/syslog: request failed again",
+	}
+
+	assert.Equal(t, want, query("live"))
+	assert.Equal(t, want, query("bundle"))
+
+	// The entries are extracted only once, unless the archive changes.
+	extractedPath := logArchiveEntryPath(LogStreamArchive{Path: archivePath, Entry: "./var/log/syslog"})
+	defer os.Remove(extractedPath)
+	defer os.Remove(logArchiveEntryPath(LogStreamArchive{Path: archivePath, Entry: "var/log/app/app.log.gz"}))
+
+	fi, err := os.Stat(extractedPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, want, query("bundle"))
+
+	fi2, err := os.Stat(extractedPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, fi.ModTime(), fi2.ModTime())
+	}
+
+	// The missing entries fail the bootstrap.
+	configLogStreams["missing"] = ConfigLogStream{
+		Hostname: "localhost",
+		LogArchive: &ConfigLogArchive{
+			Path:    archivePath,
+			Entries: []string{"var/log/nope"},
+		},
+	}
+
+	n, err := New(Options{
+		LStreams:         "missing",
+		ConfigLogStreams: configLogStreams,
+		ClientID:         "log_archive_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	assert.Eventually(t, func() bool {
+		errMsg := n.FleetStatus().ErrByLStream["missing/var/log/nope"]
+		return strings.Contains(errMsg, "failed to extract var/log/nope from "+archivePath)
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// logLevelsByPrecedence are the known levels, in the order in which the level
+// patterns are tried: e.g. if the line matches both the error and info
+// patterns, it's an error.
+var logLevelsByPrecedence = []LogLevel{
+	LogLevelError,
+	LogLevelWarn,
+	LogLevelInfo,
+	LogLevelDebug,
+}
+
+// logLevelUnknownName is how LogLevelUnknown is called in the configs and
+// queries, e.g. "level:unknown".
+const logLevelUnknownName = "unknown"
+
+// ParseLogLevel parses the normalized level name as used in the configs and
+// queries: "error", "warn" (or "warning"), "info", "debug" or "unknown". It's
+// case-insensitive. The second return value is false if the name is invalid.
+func ParseLogLevel(s string) (LogLevel, bool) {
+	s = strings.ToLower(s)
+	switch s {
+	case logLevelUnknownName:
+		return LogLevelUnknown, true
+	case "warning":
+		return LogLevelWarn, true
+	}
+
+	for _, level := range logLevelsByPrecedence {
+		if s == string(level) {
+			return level, true
+		}
+	}
+
+	return LogLevelUnknown, false
+}
+
+// LevelPatterns maps the log levels to the regexes (in Go syntax, which are
+// also translated to awk for the filter queries; see TranslateRegexToAWK)
+// matched against the whole log line, to classify the log messages. The
+// regexes are case-sensitive. The levels which are not in the map are never
+// detected, and the lines matching none of the regexes have LogLevelUnknown.
+//
+// If a logstream doesn't have the patterns configured, the level is guessed
+// by the commonly used words like "error" or "[E]"; see ClassifyLogLevel.
+type LevelPatterns map[LogLevel]string
+
+// ParseLevelPatterns takes the patterns as they're specified in the config,
+// keyed by the normalized level names, like {"error": `level=(error|fatal)`},
+// and returns the validated LevelPatterns. If the map is empty, nil is
+// returned.
+func ParseLevelPatterns(patterns map[string]string) (LevelPatterns, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	ret := make(LevelPatterns, len(patterns))
+	for name, pattern := range patterns {
+		level, ok := ParseLogLevel(name)
+		if !ok || level == LogLevelUnknown {
+			return nil, errors.Errorf(
+				"invalid level %q in level_patterns, valid options are: error, warn, info, debug", name,
+			)
+		}
+
+		ret[level] = pattern
+	}
+
+	if _, err := compileLevelPatterns(ret, AWKDialectDefault); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ret, nil
+}
+
+// levelClassifier classifies the log lines using the LevelPatterns.
+type levelClassifier struct {
+	regexes []levelRegex
+
+	// awkRegexes contains the same regexes translated to awk, for the filter
+	// queries; see FilterFieldsConfig.LevelRegexes.
+	awkRegexes map[LogLevel]string
+}
+
+type levelRegex struct {
+	level LogLevel
+	re    *regexp.Regexp
+}
+
+// compileLevelPatterns compiles the patterns both for the client side and for
+// the given awk dialect. If the patterns are empty, it returns nil.
+func compileLevelPatterns(patterns LevelPatterns, dialect AWKDialect) (*levelClassifier, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	lc := &levelClassifier{
+		awkRegexes: make(map[LogLevel]string, len(patterns)),
+	}
+
+	for _, level := range logLevelsByPrecedence {
+		pattern, ok := patterns[level]
+		if !ok {
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Annotatef(err, "level pattern for %s", level)
+		}
+
+		awkRegex, err := TranslateRegexToAWK(pattern, dialect)
+		if err != nil {
+			return nil, errors.Annotatef(err, "level pattern for %s", level)
+		}
+
+		lc.regexes = append(lc.regexes, levelRegex{level: level, re: re})
+		lc.awkRegexes[level] = awkRegex
+	}
+
+	return lc, nil
+}
+
+// classify returns the level of the first pattern which matches the line, or
+// LogLevelUnknown.
+func (lc *levelClassifier) classify(line string) LogLevel {
+	for _, lr := range lc.regexes {
+		if lr.re.MatchString(line) {
+			return lr.level
+		}
+	}
+
+	return LogLevelUnknown
+}
+
+// defaultLevelRegexes are used by ClassifyLogLevel for the lowercased
+// messages which don't contain the short markers like "[E]".
+var defaultLevelRegexes = []levelRegex{
+	{LogLevelError, regexp.MustCompile(`\berror\b|\berro\b|\berr\b|\bcrit\b|\bcritical\b|\bfatal\b`)},
+	{LogLevelWarn, regexp.MustCompile(`\bwarn(ing)?\b`)},
+	{LogLevelInfo, regexp.MustCompile(`\binfo\b`)},
+	{LogLevelDebug, regexp.MustCompile(`\bdebu(g)?\b`)},
+}
+
+// ClassifyLogLevel tries to guess what the level of the message could be,
+// based on commonly used patterns in the message like "error", "info", "[E]",
+// "[I]" etc. It's what's used for the logstreams without LevelPatterns.
+func ClassifyLogLevel(msg string) LogLevel {
+	msg = strings.ToLower(msg)
+
+	switch {
+	case strings.Contains(msg, "[f]"):
+		return LogLevelError
+	case strings.Contains(msg, "[e]"):
+		return LogLevelError
+	case strings.Contains(msg, "[w]"):
+		return LogLevelWarn
+	case strings.Contains(msg, "[i]"):
+		return LogLevelInfo
+	case strings.Contains(msg, "[d]"):
+		return LogLevelDebug
+	}
+
+	for _, lr := range defaultLevelRegexes {
+		if lr.re.MatchString(msg) {
+			return lr.level
+		}
+	}
+
+	return LogLevelUnknown
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyLogLevel(t *testing.T) {
+	type testCase struct {
+		msg  string
+		want LogLevel
+	}
+
+	testCases := []testCase{
+		// Short markers.
+		{msg: "[E] job failed", want: LogLevelError},
+		{msg: "[F] out of memory", want: LogLevelError},
+		{msg: "[W] disk is almost full", want: LogLevelWarn},
+		{msg: "[I] started", want: LogLevelInfo},
+		{msg: "[D] tick", want: LogLevelDebug},
+
+		// Plain words, in any case.
+		{msg: "ERROR request failed", want: LogLevelError},
+		{msg: "<crit> kernel panic", want: LogLevelError},
+		{msg: "<warning> Logging level changed", want: LogLevelWarn},
+		{msg: "<info> Logging level changed", want: LogLevelInfo},
+		{msg: "DEBUG: cache miss", want: LogLevelDebug},
+
+		// Structured logs.
+		{msg: `time=2025-03-10T12:00:00Z level=error msg="request failed"`, want: LogLevelError},
+		{msg: `{"level":"warn","msg":"slow request"}`, want: LogLevelWarn},
+		{msg: `{"severity": "INFO", "message": "done"}`, want: LogLevelInfo},
+
+		// Errors take precedence.
+		{msg: "info: got an error", want: LogLevelError},
+
+		// Unknown fallback.
+		{msg: "Accepted publickey for root", want: LogLevelUnknown},
+		{msg: "no errors found", want: LogLevelUnknown},
+		{msg: "", want: LogLevelUnknown},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, ClassifyLogLevel(tc.msg), "%q", tc.msg)
+	}
+}
+
+func TestLevelPatterns(t *testing.T) {
+	// klog-style levels, like "E0310 12:00:00.123456 1 foo.go:42] failed".
+	patterns, err := ParseLevelPatterns(map[string]string{
+		"error":   `: [EF]\d+ `,
+		"Warning": `: W\d+ `,
+		"info":    `: I\d+ `,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, LevelPatterns{
+		LogLevelError: `: [EF]\d+ `,
+		LogLevelWarn:  `: W\d+ `,
+		LogLevelInfo:  `: I\d+ `,
+	}, patterns)
+
+	lc, err := compileLevelPatterns(patterns, AWKDialectGawk)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	lines := []string{
+		"Mar 10 12:00:00 node-01 kubelet[1]: E0310 12:00:00.123456 1 pod.go:42] failed",
+		"Mar 10 12:00:01 node-01 kubelet[1]: W0310 12:00:01.123456 1 pod.go:42] retrying",
+		"Mar 10 12:00:02 node-01 kubelet[1]: I0310 12:00:02.123456 1 pod.go:42] no error",
+		"Mar 10 12:00:03 node-01 kubelet[1]: F0310 12:00:03.123456 1 pod.go:42] fatal",
+		"Mar 10 12:00:04 node-01 kubelet[1]: error without the prefix",
+	}
+
+	var got []LogLevel
+	for _, line := range lines {
+		got = append(got, lc.classify(line))
+	}
+	assert.Equal(t, []LogLevel{
+		LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelError, LogLevelUnknown,
+	}, got)
+
+	// The same patterns are used by the filter queries.
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not available")
+	}
+
+	timeFormat, err := GenerateTimeDescr("Jan _2 15:04:05")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fieldsCfg := NewFilterFieldsConfig(timeFormat)
+	fieldsCfg.LevelRegexes = lc.awkRegexes
+
+	wantLinesByQuery := map[string]string{
+		"level:error":   "0 3",
+		"level:warn":    "1",
+		"level:info":    "2",
+		"level:debug":   "",
+		"level:unknown": "4",
+	}
+
+	for query, wantLines := range wantLinesByQuery {
+		expr, err := ParseFilterQuery(query)
+		if !assert.NoError(t, err, "query %q", query) {
+			continue
+		}
+
+		awkExpr := CompileFilterQueryToAWK(expr, fieldsCfg, DefaultFilterMatchOpts)
+
+		cmd := exec.Command("awk", awkExpr+" { print NR-1 }")
+		cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+		out, err := cmd.CombinedOutput()
+		if !assert.NoError(t, err, "query %q, awk %q: %s", query, awkExpr, string(out)) {
+			continue
+		}
+
+		assert.Equal(t, wantLines, strings.Join(strings.Fields(string(out)), " "), "query %q, awk %q", query, awkExpr)
+	}
+}
+
+func TestParseLevelPatternsErrors(t *testing.T) {
+	patterns, err := ParseLevelPatterns(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, patterns)
+
+	_, err = ParseLevelPatterns(map[string]string{"fatal": "FATAL"})
+	assert.EqualError(t, err, `invalid level "fatal" in level_patterns, valid options are: error, warn, info, debug`)
+
+	_, err = ParseLevelPatterns(map[string]string{"unknown": "foo"})
+	assert.Error(t, err)
+
+	_, err = ParseLevelPatterns(map[string]string{"error": "(unclosed"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// logSourceMarkerPrefix is printed before running the agent for every source
+// of the logstream with multiple sources (see LogStream.Sources), followed by
+// the index of the source; all the agent output after it belongs to that
+// source.
+const logSourceMarkerPrefix = "log_source:"
+
+// getSourcesQueryCmdParts returns the query command for the logstream with
+// multiple sources: the agent runs for every source in turn, each run
+// preceded by the logSourceMarkerPrefix line, all in a single subshell, so
+// that the resource limits and the wire compression apply to all of them.
+func (lsc *LStreamClient) getSourcesQueryCmdParts(cmdCtx *lstreamCmdCtx) []string {
+	parts := []string{"("}
+
+	for i, src := range lsc.params.LogStream.Sources {
+		if i > 0 {
+			parts = append(parts, ";")
+		}
+
+		parts = append(parts, markerCmd(fmt.Sprintf("'%s%d'", logSourceMarkerPrefix, i), lsc.busybox), ";")
+		parts = append(parts, lsc.getSudoCmdParts()...)
+		parts = append(parts, lsc.getAgentQueryCmdParts(cmdCtx, src)...)
+	}
+
+	return append(parts, ")")
+}
+
+// startLogSource handles the logSourceMarkerPrefix line with the given source
+// index: the agent output after it belongs to that source, so the log files
+// and the timestamps start anew.
+func (lsc *LStreamClient) startLogSource(respCtx *lstreamCmdCtxQueryLogs, idxStr string) error {
+	sources := lsc.params.LogStream.Sources
+
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if idx < 0 || idx >= len(sources) {
+		return errors.Errorf("no source #%d, have %d", idx, len(sources))
+	}
+
+	respCtx.sourceTag = sources[idx].Tag
+	respCtx.logfiles = nil
+	respCtx.lastTime = time.Time{}
+	respCtx.pendingCaptures = nil
+
+	return nil
+}
+
+// mergeSourceLogs merges the logs from all the sources of the logstream (see
+// LogStream.Sources), which come one source after another, each of them
+// having at most maxNumLines of the latest logs: they're sorted by time (with
+// the same time, the earlier source goes first), and only the latest
+// maxNumLines of them are left.
+//
+// Unlike LStreamsManager, which merges the logs from all the logstreams, we
+// don't need to cut the logs before the timespan covered by every source: if
+// some source has returned maxNumLines logs, then the latest maxNumLines
+// merged logs are all within its timespan anyway.
+func mergeSourceLogs(logs []LogMsg, maxNumLines int) []LogMsg {
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].Time.Before(logs[j].Time)
+	})
+
+	if len(logs) > maxNumLines {
+		logs = logs[len(logs)-maxNumLines:]
+	}
+
+	return logs
+}
+
+// getSourceLinesUntil returns lstreamCmdQueryLogs.sourceLinesUntil to load
+// the logs before the given ones, which are sorted by time: for every source,
+// it's the line number of its earliest message. The sources which have no
+// messages here don't need any: either they have no logs in the time range,
+// or all of them are earlier than these, and were thus dropped by
+// mergeSourceLogs.
+func getSourceLinesUntil(logs []LogMsg) map[string]int {
+	ret := map[string]int{}
+	for _, msg := range logs {
+		tag := msg.Context["logsource"]
+		if _, ok := ret[tag]; !ok {
+			ret[tag] = msg.CombinedLinenumber
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeSourceLogs(t *testing.T) {
+	base := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	msg := func(minute int, source, text string, lineno int) LogMsg {
+		return LogMsg{
+			Time:               base.Add(time.Duration(minute) * time.Minute),
+			CombinedLinenumber: lineno,
+			Msg:                text,
+			Context:            map[string]string{"logsource": source},
+		}
+	}
+
+	texts := func(logs []LogMsg) []string {
+		var ret []string
+		for _, l := range logs {
+			ret = append(ret, l.Msg)
+		}
+		return ret
+	}
+
+	// newLogs returns the logs as they come from the agent: one source after
+	// another, each of them in the time order.
+	newLogs := func() []LogMsg {
+		return []LogMsg{
+			msg(1, "access", "a1", 1),
+			msg(3, "access", "a3", 2),
+			msg(5, "access", "a5", 3),
+
+			msg(0, "app", "b0", 7),
+			msg(3, "app", "b3", 8),
+			msg(4, "app", "b4", 9),
+		}
+	}
+
+	// With the max large enough, everything is there, and with the same time,
+	// the earlier source goes first.
+	assert.Equal(t,
+		[]string{"b0", "a1", "a3", "b3", "b4", "a5"},
+		texts(mergeSourceLogs(newLogs(), 10)),
+	)
+
+	// Otherwise, only the latest ones are left; since both sources have
+	// returned the max number of logs here, the latest ones are all within
+	// the timespan covered by both of them.
+	assert.Equal(t,
+		[]string{"b3", "b4", "a5"},
+		texts(mergeSourceLogs(newLogs(), 3)),
+	)
+
+	// Loading the earlier logs picks up from the earliest message of every
+	// source which is still there.
+	assert.Equal(t,
+		map[string]int{"access": 3, "app": 8},
+		getSourceLinesUntil(mergeSourceLogs(newLogs(), 3)),
+	)
+	assert.Equal(t,
+		map[string]int{"access": 1, "app": 7},
+		getSourceLinesUntil(mergeSourceLogs(newLogs(), 10)),
+	)
+}
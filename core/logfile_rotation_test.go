@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLogfileRotatedDuringQuery checks that if a log file is rotated while the
+// agent is reading it, the query results have a warning about it, but not if
+// the file was just appended to.
+func TestLogfileRotatedDuringQuery(t *testing.T) {
+	dir := t.TempDir()
+	from := localhostTestFrom()
+
+	var lines []string
+	for i := 0; i < 5; i++ {
+		lines = append(lines, localhostTestLogLine(
+			from.Add(time.Duration(i)*time.Minute), fmt.Sprintf("myhost app[1]: msg %d", i),
+		))
+	}
+
+	// Every logstream has a hook which runs right after the scan, to simulate
+	// something happening to the log file in the meantime. The hooks get the
+	// log file path as $1.
+	hooks := map[string]string{
+		// Like logrotate by default: the file is renamed, and a new one is
+		// created in its place.
+		"rotated": `mv "$1" "$1.1" && touch "$1"`,
+		// Like logrotate's copytruncate.
+		"truncated": `cp "$1" "$1.1" && : > "$1"`,
+		// Just a normal append.
+		"appended": `echo "$(date -u +%Y-%m-%dT%H:%M:%S.000000+00:00) myhost app[1]: new" >> "$1"`,
+	}
+
+	configLogStreams := ConfigLogStreams{}
+	logPaths := map[string]string{}
+	for name, hook := range hooks {
+		logPath := filepath.Join(dir, name+".log")
+		appendLocalhostTestLog(t, logPath, lines...)
+		logPaths[name] = logPath
+
+		wrapperDir := writeAfterScanAWKWrapper(t, filepath.Join(dir, name+"_bin"), hook, logPath)
+
+		configLogStreams[name] = localhostTestLogStream(
+			logPath, fmt.Sprintf("export PATH='%s':\"$PATH\"", wrapperDir),
+		)
+	}
+
+	n := newLocalhostTestNerdlog(t, "logfile_rotation_test", configLogStreams)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        from,
+		To:          from.Add(time.Hour),
+		MaxNumLines: 100,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The logs which were read before the rotation are still there.
+	assert.Equal(t, 15, len(resp.Logs))
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("rotated: log %s rotated during the query; results may be incomplete, re-run recommended", logPaths["rotated"]),
+		fmt.Sprintf("truncated: log %s rotated during the query; results may be incomplete, re-run recommended", logPaths["truncated"]),
+	}, resp.Warnings)
+
+	for _, name := range []string{"rotated", "truncated"} {
+		assert.Contains(
+			t, strings.Join(resp.DebugInfo[name].AgentStderr, "\n"),
+			fmt.Sprintf("debug:logfile %s was rotated during the query: inode", logPaths[name]),
+		)
+	}
+}
+
+// writeAfterScanAWKWrapper creates a dir with the gawk and awk wrappers, which
+// run the actual gawk, and then if it was the awk scanning the logs for the
+// query, run the hook with the log file path as $1; the dir is to be put in
+// front of the PATH on the host.
+//
+// The awk scanning the logs is told by the max_num_lines variable in its
+// environment, which the agent only sets for that awk.
+func writeAfterScanAWKWrapper(t *testing.T, dir, hook, logPath string) string {
+	t.Helper()
+
+	realAWK, err := exec.LookPath("gawk")
+	if err != nil {
+		t.Skip("gawk is not found")
+	}
+
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+'%s' "$@"
+code=$?
+if [[ "${max_num_lines+set}" == "set" ]]; then
+  after_scan() { %s ; }
+  after_scan '%s'
+fi
+exit $code
+`, realAWK, hook, logPath)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"gawk", "awk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// DefaultLowPriorityWrappers are the commands which the agent is wrapped
+// with when the low_priority option is set, unless overridden with
+// low_priority_wrappers.
+var DefaultLowPriorityWrappers = []string{"nice -n 19", "ionice -c3"}
+
+// lowPriorityWrapperWordRegex matches the words which can be used in the
+// low priority wrappers. Since the wrappers are echoed by the remote shell
+// (see lowPriorityCmdParts), the words can't contain anything which the
+// shell would interpret.
+var lowPriorityWrapperWordRegex = regexp.MustCompile(`^[a-zA-Z0-9_=%.,:/+@-]+$`)
+
+// validateLowPriorityWrapper checks that the wrapper like "nice -n 19" can be
+// used as is, without any quoting.
+func validateLowPriorityWrapper(wrapper string) error {
+	words := strings.Fields(wrapper)
+	if len(words) == 0 {
+		return errors.Errorf("low priority wrapper is empty")
+	}
+
+	for _, word := range words {
+		if !lowPriorityWrapperWordRegex.MatchString(word) {
+			return errors.Errorf(
+				"low priority wrapper %q: %q contains unsupported characters", wrapper, word,
+			)
+		}
+	}
+
+	return nil
+}
+
+// lowPriorityCmdParts returns the command parts to prepend to the agent
+// invocation, so that it's wrapped with every given wrapper, like
+// "nice -n 19 ionice -c3 bash ...".
+//
+// Not every host has every wrapper (e.g. ionice might be missing on some
+// minimal systems, and systemd-run on non-systemd ones), so every wrapper is
+// only used if its command exists on the host; otherwise, it's skipped, and
+// the agent runs without it.
+func lowPriorityCmdParts(wrappers []string) []string {
+	parts := make([]string, 0, len(wrappers))
+	for _, wrapper := range wrappers {
+		words := strings.Fields(wrapper)
+		parts = append(parts, fmt.Sprintf(
+			"$(command -v %s >/dev/null 2>&1 && echo %s)", words[0], strings.Join(words, " "),
+		))
+	}
+
+	return parts
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLowPriorityWrapper(t *testing.T) {
+	for _, wrapper := range []string{
+		"nice -n 19",
+		"ionice -c3",
+		"systemd-run --user --scope -q -p CPUQuota=20%",
+	} {
+		assert.NoError(t, validateLowPriorityWrapper(wrapper), wrapper)
+	}
+
+	for _, wrapper := range []string{
+		"",
+		"  ",
+		"nice -n '19'",
+		"nice; rm -rf /",
+		"nice $(whoami)",
+		"nice > /tmp/foo",
+	} {
+		assert.Error(t, validateLowPriorityWrapper(wrapper), wrapper)
+	}
+}
+
+func TestLowPriorityCmdParts(t *testing.T) {
+	assert.Equal(t, []string{
+		"$(command -v nice >/dev/null 2>&1 && echo nice -n 19)",
+		"$(command -v ionice >/dev/null 2>&1 && echo ionice -c3)",
+	}, lowPriorityCmdParts(DefaultLowPriorityWrappers))
+
+	assert.Equal(t, []string{}, lowPriorityCmdParts(nil))
+}
+
+func TestLowPriorityCmdPartsShell(t *testing.T) {
+	if _, err := exec.LookPath("nice"); err != nil {
+		t.Skip("nice is not available")
+	}
+
+	runSh := func(wrappers []string, cmd string) string {
+		parts := append(lowPriorityCmdParts(wrappers), cmd)
+		out, err := exec.Command("/bin/sh", "-c", strings.Join(parts, " ")).CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	// Without args, nice prints the current niceness; so when it's wrapped with
+	// "nice -n 19", it should print 19 (which is also the max).
+	assert.Equal(t, "19", runSh([]string{"nice -n 19"}, "nice"))
+
+	// Missing commands are skipped, and the rest still works.
+	assert.Equal(t, "19", runSh([]string{"nerdlog-no-such-cmd -x", "nice -n 19"}, "nice"))
+	assert.Equal(t, "hello", runSh([]string{"nerdlog-no-such-cmd -x"}, "echo hello"))
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// DefaultAdHocTimeout is a default for LStreamsManagerParams.AdHocTimeout.
+	DefaultAdHocTimeout = 10 * time.Second
+
+	// DefaultAdHocMaxOutputSize is a default for
+	// LStreamsManagerParams.AdHocMaxOutputSize, and also the max value for it:
+	// the output is transferred as lines of text, and a single line can't be
+	// too large.
+	DefaultAdHocMaxOutputSize = 32 * 1024
+)
+
+// ErrAdHocCmdsDisabled is returned from RunAdHoc unless the
+// LStreamsManagerParams.AllowAdHocCmds is true.
+var ErrAdHocCmdsDisabled = errors.New("ad hoc commands are disabled")
+
+const (
+	adHocOutPrefix      = "adhoc_out:"
+	adHocExitCodePrefix = "adhoc_exit_code:"
+
+	// adHocExitCodeTimeout is what the "timeout" command exits with when the
+	// command times out.
+	adHocExitCodeTimeout = "124"
+
+	// adHocExitCodeSIGPIPE is what the command exits with if it's killed by
+	// SIGPIPE, which happens when the output is truncated.
+	adHocExitCodeSIGPIPE = "141"
+)
+
+// adHocCmdScript returns the shell script to run the ad hoc command on the
+// host: the command runs with the timeout, its stdin is detached (so that it
+// doesn't consume our commands), and the combined stdout and stderr is
+// limited to maxOutputSize (plus one byte, to know whether it was truncated);
+// every output line gets the adHocOutPrefix, so that the output can't be
+// confused with our own markers. The command's exit code is printed
+// separately, bypassing the limit.
+//
+// If the "timeout" command isn't available on the host, the command is not
+// executed at all, since otherwise a stuck command would block the
+// logstream forever.
+func adHocCmdScript(cmd *lstreamCmdAdHoc) string {
+	timeoutSec := int(math.Ceil(cmd.timeout.Seconds()))
+	if timeoutSec < 1 {
+		timeoutSec = 1
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("nlcmd=" + shellQuote(cmd.command) + "\n")
+	fmt.Fprintf(
+		&sb,
+		"if command -v timeout >/dev/null 2>&1; then "+
+			"{ { timeout %d sh -c \"$nlcmd\" </dev/null 2>&1; echo \"%s$?\" >&3; } "+
+			"| head -c %d | awk '{ print \"%s\" $0 }'; } 3>&1; "+
+			"else echo 'error:timeout command is not available on the host'; fi\n",
+		timeoutSec, adHocExitCodePrefix, cmd.maxOutputSize+1, adHocOutPrefix,
+	)
+	sb.WriteString("echo exit_code:$?\n")
+
+	return sb.String()
+}
+
+// addOutputLine adds a single line of the command output (without the
+// adHocOutPrefix), making sure the total size doesn't exceed maxOutputSize.
+func (ctx *lstreamCmdCtxAdHoc) addOutputLine(line string, maxOutputSize int) {
+	if ctx.truncated {
+		return
+	}
+
+	line += "\n"
+	if remaining := maxOutputSize - ctx.output.Len(); len(line) > remaining {
+		line = line[:remaining]
+		ctx.truncated = true
+	}
+
+	ctx.output.WriteString(line)
+}
+
+// result returns the output of the ad hoc command, and an error if the
+// command has failed or timed out.
+func (ctx *lstreamCmdCtxAdHoc) result(cmd *lstreamCmdAdHoc) (string, error) {
+	output := ctx.output.String()
+	if ctx.truncated {
+		output += fmt.Sprintf("\n[output truncated to %d bytes]\n", cmd.maxOutputSize)
+	}
+
+	exitCode := ctx.exitCode
+	if ctx.truncated && exitCode == adHocExitCodeSIGPIPE {
+		// We've stopped reading the output, it's not an error.
+		exitCode = "0"
+	}
+
+	switch exitCode {
+	case "0":
+		return output, nil
+	case "":
+		return output, errors.Errorf("no exit code from the command")
+	case adHocExitCodeTimeout:
+		return output, errors.Errorf("command timed out after %s", cmd.timeout)
+	}
+
+	if _, err := strconv.Atoi(exitCode); err != nil {
+		return output, errors.Errorf("malformed exit code %q", exitCode)
+	}
+
+	return output, errors.Errorf("command exited with code %s", exitCode)
+}
+
+type lstreamsManagerReqAdHoc struct {
+	lstreamName string
+	cmd         *lstreamCmdAdHoc
+	respCh      chan lstreamCmdRes
+}
+
+// RunAdHoc runs an arbitrary shell command on the given logstream's host,
+// reusing the existing connection, and returns the combined stdout and
+// stderr. It's meant for debugging the host setup, e.g. running
+// "ls -la /var/log" when a query unexpectedly returns nothing.
+//
+// Since the command is arbitrary, it's only allowed if the
+// LStreamsManagerParams.AllowAdHocCmds is true; otherwise,
+// ErrAdHocCmdsDisabled is returned. The command runs with the
+// AdHocTimeout, and its output is truncated to AdHocMaxOutputSize.
+//
+// If the command fails, both the output and an error are returned.
+func (lsman *LStreamsManager) RunAdHoc(ctx context.Context, lstreamName, command string) (string, error) {
+	if !lsman.params.AllowAdHocCmds {
+		return "", errors.Trace(ErrAdHocCmdsDisabled)
+	}
+
+	if strings.TrimSpace(command) == "" {
+		return "", errors.Errorf("command is empty")
+	}
+
+	// Buffered, so that the LStreamClient doesn't get stuck if the ctx is done
+	// before the command finishes.
+	respCh := make(chan lstreamCmdRes, 1)
+
+	lsman.reqCh <- lstreamsManagerReq{
+		adHoc: &lstreamsManagerReqAdHoc{
+			lstreamName: lstreamName,
+			cmd: &lstreamCmdAdHoc{
+				command:       command,
+				timeout:       lsman.params.AdHocTimeout,
+				maxOutputSize: lsman.params.AdHocMaxOutputSize,
+			},
+			respCh: respCh,
+		},
+	}
+
+	select {
+	case resp := <-respCh:
+		output, _ := resp.resp.(string)
+		if resp.err != nil {
+			return output, errors.Annotatef(resp.err, "%s", lstreamName)
+		}
+
+		return output, nil
+
+	case <-ctx.Done():
+		return "", errors.Annotatef(ctx.Err(), "%s", lstreamName)
+	}
+}
+
+// startAdHoc sends the ad hoc command to the logstream, if it's connected.
+// Must be called from the LStreamsManager's goroutine.
+func (lsman *LStreamsManager) startAdHoc(req *lstreamsManagerReqAdHoc) {
+	lsc, ok := lsman.lscs[req.lstreamName]
+	if !ok {
+		req.respCh <- lstreamCmdRes{
+			hostname: req.lstreamName,
+			err:      errors.Errorf("no such logstream"),
+		}
+		return
+	}
+
+	if !isStateConnected(lsman.lscStates[req.lstreamName]) {
+		req.respCh <- lstreamCmdRes{
+			hostname: req.lstreamName,
+			err:      errors.Errorf("not connected"),
+		}
+		return
+	}
+
+	lsman.params.Logger.Infof("Running ad hoc command on %s: %q", req.lstreamName, req.cmd.command)
+
+	lsc.EnqueueCmd(lstreamCmd{
+		respCh: req.respCh,
+		adHoc:  req.cmd,
+	})
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runAdHocScript runs the ad hoc script with the local shell, and parses the
+// output in the same way as the LStreamClient does.
+func runAdHocScript(t *testing.T, cmd *lstreamCmdAdHoc) (string, error) {
+	out, err := exec.Command("sh", "-c", adHocCmdScript(cmd)).Output()
+	if err != nil {
+		t.Fatalf("running script: %s", err)
+	}
+
+	ctx := &lstreamCmdCtxAdHoc{}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, adHocOutPrefix):
+			ctx.addOutputLine(strings.TrimPrefix(line, adHocOutPrefix), cmd.maxOutputSize)
+		case strings.HasPrefix(line, adHocExitCodePrefix):
+			ctx.exitCode = strings.TrimPrefix(line, adHocExitCodePrefix)
+		}
+	}
+
+	return ctx.result(cmd)
+}
+
+func TestAdHocCmdScript(t *testing.T) {
+	if _, err := exec.LookPath("timeout"); err != nil {
+		t.Skip("no timeout command")
+	}
+
+	newCmd := func(command string) *lstreamCmdAdHoc {
+		return &lstreamCmdAdHoc{
+			command:       command,
+			timeout:       5 * time.Second,
+			maxOutputSize: 1024,
+		}
+	}
+
+	// Both stdout and stderr are captured, and the output which looks like
+	// our markers doesn't confuse us.
+	output, err := runAdHocScript(t, newCmd(`echo 'it'"'"'s'; echo exit_code:1; echo err >&2`))
+	assert.NoError(t, err)
+	assert.Equal(t, "it's\nexit_code:1\nerr\n", output)
+
+	// The command doesn't consume our stdin.
+	output, err = runAdHocScript(t, newCmd("cat"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", output)
+
+	output, err = runAdHocScript(t, newCmd("echo foo; exit 3"))
+	if assert.Error(t, err) {
+		assert.Equal(t, "command exited with code 3", err.Error())
+	}
+	assert.Equal(t, "foo\n", output)
+
+	// The output is limited on the host.
+	cmd := newCmd("yes 0123456789")
+	cmd.maxOutputSize = 16
+	output, err = runAdHocScript(t, cmd)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789\n01234\n[output truncated to 16 bytes]\n", output)
+
+	cmd = newCmd("echo foo; sleep 5")
+	cmd.timeout = 100 * time.Millisecond
+	output, err = runAdHocScript(t, cmd)
+	if assert.Error(t, err) {
+		assert.Equal(t, "command timed out after 100ms", err.Error())
+	}
+	assert.Equal(t, "foo\n", output)
+}
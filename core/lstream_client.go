@@ -1,9 +1,8 @@
 package core
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	_ "embed"
 	"fmt"
 	"io"
@@ -20,25 +19,25 @@ import (
 
 const SpecialFilenameJournalctl = "journalctl"
 
-const connectionTimeout = 5 * time.Second
+// SpecialFilenameHTTPNDJSON is the filename reported for the logs from the
+// http-ndjson transport; see ShellTransportHTTPNDJSON.
+const SpecialFilenameHTTPNDJSON = "http-ndjson"
+
+// IsTimestampAddressed returns whether the logs from the given file are
+// addressed by timestamps, as opposed to line numbers: the line numbers we
+// get for such logs are only meaningful within a single query.
+func IsTimestampAddressed(filename string) bool {
+	return filename == SpecialFilenameJournalctl ||
+		filename == SpecialFilenameHTTPNDJSON ||
+		filename == SpecialFilenameWinEvent ||
+		filename == SpecialFilenameCustomAgent
+}
 
-// Setting useGzip to false is just a simple way to disable gzip, for debugging
-// purposes or w/e, since it's still experimental. Maybe we need to add a flag
-// for it, we'll see.
-const useGzip = true
+const connectionTimeout = 5 * time.Second
 
-const (
-	// gzipStartMarker and gzipEndMarker are echoed in the beginning and the end
-	// of the gzipped output. Effectively we're doing this:
-	//
-	//   $ echo gzip_start ; whatever command we need to run | gzip ; echo gzip_end
-	//
-	// and the scanner func (returned by getScannerFunc) sees those markers and
-	// buffers gzipped output until it's done, then gunzips it and sends to the
-	// clients, so it's totally opaque for them.
-	gzipStartMarker = "gzip_start"
-	gzipEndMarker   = "gzip_end"
-)
+// connectRetryDelay is how long to wait before the next connection attempt
+// after a failed one.
+const connectRetryDelay = 2 * time.Second
 
 // queryLogsArgsTimeLayout is used to format the --from and --to arguments for
 // nerdlog_agent.sh.
@@ -63,7 +62,8 @@ const queryLogsTimestampUntilPreciseTimeLayout = "2006-01-02T15:04:05.000000"
 //go:embed nerdlog_agent.sh
 var nerdlogAgentSh string
 
-var syslogRegex = regexp.MustCompile(`^(\S+)\s+(\S+?)(?:\[(\d+)\])?:\s+(.*)`)
+// NOTE: the message itself might span multiple lines, see Multiline.
+var syslogRegex = regexp.MustCompile(`^(\S+)\s+(\S+?)(?:\[(\d+)\])?:\s+((?s:.*))`)
 
 type LStreamClient struct {
 	params LStreamClientParams
@@ -73,6 +73,12 @@ type LStreamClient struct {
 	connectUpdCh chan ShellConnUpdate
 	enqueueCmdCh chan lstreamCmd
 
+	// connectCtx and connectCancel are only non-nil while we're connecting;
+	// cancelling the context aborts the connection attempt, and the transport
+	// will then deliver the result (most likely an error) as usual.
+	connectCtx    context.Context
+	connectCancel context.CancelFunc
+
 	// timezone is a string received from the logstream
 	timezone string
 	// location is loaded based on the timezone. If failed, it'll be UTC.
@@ -83,8 +89,49 @@ type LStreamClient struct {
 	exampleLogLines []string
 	timeFormat      *TimeFormatDescr
 
+	// jsonTimestampField is the path to the timestamp in the JSON logs, as
+	// detected during bootstrap; only used if LogStreamOptions.JSON is set.
+	jsonTimestampField string
+
+	// awkDialect is the awk dialect of the host, as detected during bootstrap;
+	// before that, it's AWKDialectDefault. See setAWKDialect.
+	awkDialect AWKDialect
+
+	// levelClassifier is compiled from the LogStreamOptions.LevelPatterns; if
+	// there are none, it's nil.
+	levelClassifier *levelClassifier
+
+	// multiline and fieldExtractor are the ones from the LogStreamOptions,
+	// translated to the awkDialect.
+	multiline      *Multiline
+	fieldExtractor *FieldExtractor
+
+	// clockSkew is how much the remote clock is ahead of the local one (or
+	// behind, if negative), as measured during bootstrap.
+	clockSkew time.Duration
+
+	// wireCompression is how the query output is compressed: the one from the
+	// LogStreamOptions, unless it turned out to be unavailable during
+	// bootstrap, in which case it's WireCompressionNone.
+	wireCompression WireCompression
+
+	// busybox is true if the host is busybox-based, as detected during
+	// bootstrap; then the busybox-safe forms of the commands are used.
+	busybox bool
+
 	numConnAttempts int
 
+	// connectStartTime is when the first of the numConnAttempts has started;
+	// the LogStreamOptions.ConnectBudget is counted from it.
+	connectStartTime time.Time
+	// connectBudgetCh, if not nil, fires once the ConnectBudget is spent while
+	// connecting; then connectBudgetSpent is set, and the attempt is aborted.
+	connectBudgetCh    <-chan time.Time
+	connectBudgetSpent bool
+	// connectGaveUp is true if the ConnectBudget was spent without getting
+	// connected, so we stay disconnected until Reconnect is called.
+	connectGaveUp bool
+
 	state     LStreamClientState
 	busyStage BusyStage
 
@@ -98,6 +145,22 @@ type LStreamClient struct {
 	curCmdCtx  *lstreamCmdCtx
 	nextCmdIdx int
 
+	// querySched decides whether the next command runs on the main session,
+	// on an additional one, or waits in the queue.
+	querySched *queryScheduler
+
+	// querySessions contains the additional sessions currently running
+	// queries; see ShellConnMultiSession.
+	querySessions map[*querySession]struct{}
+
+	// querySessionLinesCh receives stdout and stderr lines from all the
+	// querySessions.
+	querySessionLinesCh chan querySessionLine
+
+	// querySessionStopCh receives the querySessions whose queries were
+	// cancelled while running; see watchQuerySessionCtx.
+	querySessionStopCh chan *querySession
+
 	// disconnectReqCh is sent to when Close is called.
 	disconnectReqCh chan disconnectReq
 	tearingDown     bool
@@ -105,6 +168,13 @@ type LStreamClient struct {
 	// fully disconnected.
 	disconnectedBeforeTeardownCh chan struct{}
 
+	// parkReqCh receives the requests to park or unpark the client; see
+	// SetParked.
+	parkReqCh chan bool
+	// parked is true if the client was asked to disconnect and stay
+	// disconnected until it's unparked; see SetParked.
+	parked bool
+
 	//debugFile *os.File
 }
 
@@ -126,12 +196,13 @@ type connCtx struct {
 	conn ShellConn
 
 	// stdoutLinesCh receives lines from conn.Stdout(). If stdout had some
-	// gzipped portion, the lines arrive to stdoutLinesCh already gunzipped.
+	// compressed portion, the lines arrive to stdoutLinesCh already
+	// decompressed.
 	stdoutLinesCh chan string
 
 	// stderrLinesCh receives lines from conn.Stderr(). Technically, the same
-	// gunzipping logic as in stdout applies here as well, however in practice
-	// we don't send gzipped data over stderr.
+	// decompressing logic as in stdout applies here as well, however in
+	// practice we don't send compressed data over stderr.
 	stderrLinesCh chan string
 }
 
@@ -151,6 +222,13 @@ type BusyStage struct {
 
 	// Percentage is a percentage of the current stage.
 	Percentage int
+
+	// BytesProcessed and BytesTotal are only set when the current stage is
+	// scanning log files (as opposed to e.g. journalctl, where we don't know
+	// the sizes): how many bytes the agent has processed so far, and how many
+	// it needs to process in total.
+	BytesProcessed int64
+	BytesTotal     int64
 }
 
 type ConnDetails struct {
@@ -161,6 +239,9 @@ type ConnDetails struct {
 	// Err is an error message from the last connection attempt.
 	Err string
 
+	// ErrCategory is the category of Err, if it's not empty.
+	ErrCategory ConnErrCategory `json:",omitempty"`
+
 	// Connected shows whether the connection has already succeeded. Unlike other
 	// fields in this struct, it's set by the LStreamsManager manually.
 	Connected bool
@@ -170,11 +251,50 @@ type BootstrapDetails struct {
 	// Err is an error message from the last bootstrap attempt.
 	Err string
 
+	// ErrCategory is the category of Err, if it's not empty: either
+	// ConnErrCategoryBootstrap, or a more specific one.
+	ErrCategory ConnErrCategory
+
 	// WarnJournalctlNoAdminAccess is set to true if journalctl is used and the
 	// user doesn't have access to all the system logs. It's a separate bool
 	// instead of a generic warning message to make it possible to suppress it
 	// with a flag.
 	WarnJournalctlNoAdminAccess bool
+
+	// WarnClockSkew is non-zero if the remote host's clock differs from the
+	// local one by more than ClockSkewWarnThreshold; it's positive if the
+	// remote clock is ahead.
+	WarnClockSkew time.Duration
+
+	// WarnWireCompression is non-empty if the configured wire compression
+	// can't be used, so the output isn't compressed; it contains the reason.
+	WarnWireCompression string
+}
+
+// querySession is an additional shell session (e.g. another ssh session
+// channel over the same connection) which runs a single query, concurrently
+// with whatever is running on the main session.
+type querySession struct {
+	conn   ShellConn
+	cmdCtx *lstreamCmdCtx
+
+	stdoutClosed bool
+	stderrClosed bool
+
+	// doneCh is closed when the session is closed, to stop the goroutines
+	// forwarding its lines to the querySessionLinesCh.
+	doneCh chan struct{}
+}
+
+// querySessionLine is a single stdout or stderr line from a querySession.
+type querySessionLine struct {
+	sess     *querySession
+	isStderr bool
+
+	line string
+	// closed is true if the corresponding stream was closed; line is empty
+	// then.
+	closed bool
 }
 
 func (c *connCtx) getStdoutLinesCh() chan string {
@@ -205,6 +325,10 @@ type LStreamClientUpdate struct {
 	BootstrapDetails *BootstrapDetails
 	BusyStage        *BusyStage
 
+	// AWKDialect, if not empty, is the awk dialect of the host, as detected
+	// during bootstrap; it's sent right before the client becomes connected.
+	AWKDialect AWKDialect
+
 	DataRequest *ShellConnDataRequest
 
 	// If TornDown is true, it means it's the last update from that client.
@@ -223,6 +347,40 @@ type LStreamClientParams struct {
 	// an existing key is found.
 	SSHKeys []string
 
+	// SSHCert, if not empty, is the path to the OpenSSH certificate for the
+	// ssh key; see ShellTransportSSHLibParams.SSHCert.
+	SSHCert string
+
+	// SSHPKCS11, if not nil, is the PKCS#11 token to authenticate with; see
+	// ShellTransportSSHLibParams.PKCS11.
+	SSHPKCS11 *SSHPKCS11
+
+	// SSHCredentialProvider, if not nil, provides the credentials for the
+	// ssh-lib transport; see ShellTransportSSHLibParams.CredentialProvider.
+	SSHCredentialProvider CredentialProvider
+
+	// HostKeys verifies ssh host keys for the ssh-lib transport; if nil, host
+	// keys are not verified.
+	HostKeys *HostKeys
+
+	// SSHConnPool, if not nil, is used by the ssh-lib transport to share the
+	// ssh connection with other logstreams having the same connection
+	// identity.
+	SSHConnPool *SSHConnPool
+
+	// TransportAutoPicks, if not nil, remembers the transports picked for the
+	// hosts in the auto transport mode; see ShellTransportAuto.
+	TransportAutoPicks *TransportAutoPicks
+
+	// Transport, if non-nil, is used instead of the transport created
+	// accordingly to the LogStream.Transport config.
+	Transport ShellTransport
+
+	// MaxConcurrentQueries is the max number of queries to run at the same
+	// time, if the transport supports it. If zero, DefaultMaxConcurrentQueries
+	// is used.
+	MaxConcurrentQueries int
+
 	Logger *log.Logger
 
 	// ClientID is just an arbitrary string (should be filename-friendly though)
@@ -232,16 +390,50 @@ type LStreamClientParams struct {
 	// files when using the tool concurrently on the same nodes.
 	ClientID string
 
+	// CapabilitiesCache, if not nil, is used to skip probing the host during
+	// bootstrap, if it was probed recently and the host version hasn't
+	// changed.
+	CapabilitiesCache *CapabilitiesCache
+
+	// QueryCache, if not nil, is used to return the results of the queries
+	// over the historical time ranges without querying the host again; see
+	// QueryCache.
+	QueryCache *QueryCache
+
 	UpdatesCh chan<- *LStreamClientUpdate
 
 	Clock clock.Clock
+
+	// Metrics, if not nil, receives the metrics of this logstream; see
+	// Metrics for the details.
+	Metrics Metrics
+
+	// connEvents, if not nil, receives all the updates from the transport.
+	connEvents *connEventsHub
+
+	// connectLimiter, if not nil, limits the number of logstreams connecting
+	// at the same time; connectOrder is the index of this logstream in the
+	// config order, which orders the ones with the same priority in its queue.
+	connectLimiter *connectLimiter
+	connectOrder   int
 }
 
 // createTransport creates a shell transport accordingly to the provided
 // config. The config must be valid (e.g. it should contain exactly one item),
 // otherwise createTransport panics.
 func createTransport(
-	config ConfigLogStreamShellTransport, sshKeys []string, logger *log.Logger,
+	config ConfigLogStreamShellTransport,
+	sshKeys []string,
+	sshCert string,
+	sshPKCS11 *SSHPKCS11,
+	sshCredentialProvider CredentialProvider,
+	hostKeys *HostKeys,
+	sshConnPool *SSHConnPool,
+	transportAutoPicks *TransportAutoPicks,
+	connTimeouts ShellConnTimeouts,
+	connStderrPatterns ConnStderrPatterns,
+	busybox bool,
+	logger *log.Logger,
 ) ShellTransport {
 	var transport ShellTransport
 
@@ -251,11 +443,35 @@ func createTransport(
 		}
 
 		transport = NewShellTransportSSHLib(ShellTransportSSHLibParams{
-			SSHKeys:     sshKeys,
-			ConnDetails: *config.SSHLib,
+			SSHKeys:            sshKeys,
+			SSHCert:            sshCert,
+			PKCS11:             sshPKCS11,
+			CredentialProvider: sshCredentialProvider,
+			ConnDetails:        *config.SSHLib,
+			HostKeys:           hostKeys,
+			ConnPool:           sshConnPool,
 
 			Logger: logger,
 		})
+
+		if config.SSHBinFallback != nil {
+			transport = NewShellTransportAuto(ShellTransportAutoParams{
+				SSHLib: transport,
+				SSHBin: NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
+					ShellCommand:   config.SSHBinFallback.ShellCommand,
+					EnvOverride:    config.SSHBinFallback.EnvOverride,
+					Timeouts:       connTimeouts,
+					StderrPatterns: connStderrPatterns,
+					PrintfMarker:   busybox,
+
+					Logger: logger,
+				}),
+				Key:   config.SSHLib.Identity(),
+				Picks: transportAutoPicks,
+
+				Logger: logger,
+			})
+		}
 	}
 
 	if config.CustomCmd != nil {
@@ -264,8 +480,11 @@ func createTransport(
 		}
 
 		transport = NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
-			ShellCommand: config.CustomCmd.ShellCommand,
-			EnvOverride:  config.CustomCmd.EnvOverride,
+			ShellCommand:   config.CustomCmd.ShellCommand,
+			EnvOverride:    config.CustomCmd.EnvOverride,
+			Timeouts:       connTimeouts,
+			StderrPatterns: connStderrPatterns,
+			PrintfMarker:   busybox,
 
 			Logger: logger,
 		})
@@ -277,7 +496,56 @@ func createTransport(
 		}
 
 		transport = NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
-			ShellCommand: LocalShellCommand,
+			ShellCommand:   LocalShellCommand,
+			Timeouts:       connTimeouts,
+			StderrPatterns: connStderrPatterns,
+			PrintfMarker:   busybox,
+
+			Logger: logger,
+		})
+	}
+
+	if config.HTTPNDJSON != nil {
+		if transport != nil {
+			panic("transport config is ambiguous")
+		}
+
+		transport = NewShellTransportHTTPNDJSON(ShellTransportHTTPNDJSONParams{
+			URLTemplate: config.HTTPNDJSON.URLTemplate,
+			Host:        config.HTTPNDJSON.Host,
+
+			Logger: logger,
+		})
+	}
+
+	if config.WinEvent != nil {
+		if transport != nil {
+			panic("transport config is ambiguous")
+		}
+
+		transport = NewShellTransportWinEvent(ShellTransportWinEventParams{
+			LogNames:     config.WinEvent.LogNames,
+			ShellCommand: config.WinEvent.ShellCommand,
+			EnvOverride:  config.WinEvent.EnvOverride,
+			Host:         config.WinEvent.Host,
+
+			Logger: logger,
+		})
+	}
+
+	if config.Console != nil {
+		if transport != nil {
+			panic("transport config is ambiguous")
+		}
+
+		transport = NewShellTransportConsole(ShellTransportConsoleParams{
+			TelnetAddr:   config.Console.TelnetAddr,
+			BindAddress:  config.Console.BindAddress,
+			SerialDevice: config.Console.SerialDevice,
+			SerialBaud:   config.Console.SerialBaud,
+			User:         config.Console.User,
+			Host:         config.Console.Host,
+			Timeouts:     connTimeouts,
 
 			Logger: logger,
 		})
@@ -300,8 +568,57 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 	params.Logger = params.Logger.WithNamespaceAppended(
 		fmt.Sprintf("LSClient_%s", params.LogStream.Name),
 	)
+	if host := params.LogStream.Transport.Hostname(); host != "" {
+		params.Logger = params.Logger.WithField("host", host)
+	}
+
+	if params.MaxConcurrentQueries == 0 {
+		params.MaxConcurrentQueries = DefaultMaxConcurrentQueries
+	}
 
-	transport := createTransport(params.LogStream.Transport, params.SSHKeys, params.Logger)
+	if params.Metrics == nil {
+		params.Metrics = NoopMetrics{}
+	}
+
+	// Until the first bootstrap tells us otherwise, rely on what we know about
+	// the host from the previous runs.
+	busybox := cachedBusybox(params.CapabilitiesCache, params.LogStream)
+
+	transport := params.Transport
+	if transport == nil {
+		transport = createTransport(
+			params.LogStream.Transport, params.SSHKeys, params.SSHCert, params.SSHPKCS11, params.SSHCredentialProvider,
+			params.HostKeys,
+			params.SSHConnPool, params.TransportAutoPicks, params.LogStream.Options.ConnTimeouts,
+			params.LogStream.Options.ConnStderrPatterns, busybox, params.Logger,
+		)
+
+		if timeout := params.LogStream.Options.ProbeTimeout; timeout > 0 {
+			transport = newProbeTransport(transport, params.LogStream.Transport, timeout, params.Logger)
+		}
+
+		// The pacing goes right on top of the actual transport, so that the
+		// persistent session commands are paced too.
+		if pacing := params.LogStream.Options.StdinPacing; !pacing.IsZero() {
+			transport = newPacedTransport(transport, pacing, params.Clock)
+		}
+
+		if kind := params.LogStream.Options.PersistentSession; kind != "" {
+			transport = newPersistentSessionTransport(
+				transport, kind,
+				persistentSessionName(params.ClientID, params.LogStream.Name),
+				params.Logger,
+			)
+		}
+	}
+
+	// The limiter goes on top of everything, since the slot is held for the
+	// whole connection attempt.
+	if params.connectLimiter != nil {
+		transport = newConnectLimitedTransport(
+			transport, params.connectLimiter, params.LogStream.Options.Priority, params.connectOrder,
+		)
+	}
 
 	lsc := &LStreamClient{
 		params: params,
@@ -311,11 +628,24 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 		timezone: "UTC",
 		location: time.UTC,
 
+		busybox: busybox,
+
 		state:        LStreamClientStateDisconnected,
 		enqueueCmdCh: make(chan lstreamCmd, 32),
 
+		querySessions:       map[*querySession]struct{}{},
+		querySessionLinesCh: make(chan querySessionLine, 32),
+		querySessionStopCh:  make(chan *querySession),
+
 		disconnectReqCh:              make(chan disconnectReq, 1),
 		disconnectedBeforeTeardownCh: make(chan struct{}),
+
+		parkReqCh: make(chan bool, 1),
+	}
+
+	if err := lsc.setAWKDialect(AWKDialectDefault); err != nil {
+		// It's validated by the LStreamsResolver already, so it's not expected.
+		lsc.params.Logger.Errorf("Invalid logstream options, ignoring: %s", err)
 	}
 
 	//debugFile, _ := os.Create("/tmp/lsclient_debug.log")
@@ -341,6 +671,15 @@ const (
 	LStreamClientStateConnectedBusy LStreamClientState = "connected_busy"
 )
 
+// allLStreamClientStates contains all the states, in no particular order.
+var allLStreamClientStates = []LStreamClientState{
+	LStreamClientStateDisconnected,
+	LStreamClientStateConnecting,
+	LStreamClientStateDisconnecting,
+	LStreamClientStateConnectedIdle,
+	LStreamClientStateConnectedBusy,
+}
+
 func isStateConnected(state LStreamClientState) bool {
 	return state == LStreamClientStateConnectedIdle || state == LStreamClientStateConnectedBusy
 }
@@ -352,12 +691,22 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 
 	if isStateConnected(oldState) && !isStateConnected(newState) {
 		// Initiate disconnect
+		lsc.closeQuerySessions()
 		lsc.conn.conn.Close()
+
+		lsc.failPendingCmds(LStreamVerifyResult{
+			Status: LStreamVerifyNotConnected,
+			Err:    "disconnected",
+		}, errors.Errorf("disconnected"))
 	}
 
 	switch oldState {
 	case LStreamClientStateConnecting:
 		lsc.connectUpdCh = nil
+		lsc.connectCancel()
+		lsc.connectCtx = nil
+		lsc.connectCancel = nil
+		lsc.connectBudgetCh = nil
 	case LStreamClientStateConnectedBusy:
 		lsc.curCmdCtx = nil
 		lsc.busyStage = BusyStage{}
@@ -381,23 +730,78 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 		lsc.connDebugMessages = nil
 
 		// Initiate new connection
+		if lsc.numConnAttempts == 0 {
+			lsc.connectStartTime = lsc.params.Clock.Now()
+			lsc.connectBudgetSpent = false
+		}
 		lsc.numConnAttempts++
+		lsc.connectGaveUp = false
+
+		if budget := lsc.params.LogStream.Options.ConnectBudget; budget > 0 {
+			lsc.connectBudgetCh = lsc.params.Clock.After(
+				lsc.connectStartTime.Add(budget).Sub(lsc.params.Clock.Now()),
+			)
+		}
+
 		lsc.connectUpdCh = make(chan ShellConnUpdate, 1)
-		lsc.transport.Connect(lsc.connectUpdCh)
+		lsc.connectCtx, lsc.connectCancel = context.WithCancel(context.Background())
+		lsc.transport.Connect(lsc.connectCtx, lsc.connectUpdCh)
 
 	case LStreamClientStateConnectedIdle:
-		if len(lsc.cmdQueue) > 0 {
-			nextCmd := lsc.cmdQueue[0]
-			lsc.cmdQueue = lsc.cmdQueue[1:]
-
-			lsc.startCmd(nextCmd)
-		}
+		lsc.runQueuedCmds()
 
 	case LStreamClientStateDisconnected:
 		lsc.conn = nil
 	}
 }
 
+// connectBudgetExhausted returns whether the LogStreamOptions.ConnectBudget
+// doesn't allow any more connection attempts: either it's spent already, or
+// the next attempt would only start after that.
+func (lsc *LStreamClient) connectBudgetExhausted() bool {
+	budget := lsc.params.LogStream.Options.ConnectBudget
+	if budget <= 0 {
+		return false
+	}
+
+	if lsc.connectBudgetSpent {
+		return true
+	}
+
+	nextAttemptTime := lsc.params.Clock.Now().Add(connectRetryDelay)
+	return !nextAttemptTime.Before(lsc.connectStartTime.Add(budget))
+}
+
+// giveUpConnecting reports that the ConnectBudget is spent without getting
+// connected, with the error of the last attempt; we then stay disconnected
+// until Reconnect is called.
+func (lsc *LStreamClient) giveUpConnecting(lastErr error) {
+	if lsc.connectBudgetSpent {
+		// The last attempt was aborted by us, so its error is just about the
+		// cancellation.
+		lastErr = errors.Trace(ErrConnectTimeout)
+	}
+
+	attempts := "attempts"
+	if lsc.numConnAttempts == 1 {
+		attempts = "attempt"
+	}
+
+	msg := fmt.Sprintf(
+		"gave up after %s and %d %s: %s",
+		lsc.params.LogStream.Options.ConnectBudget, lsc.numConnAttempts, attempts, lastErr.Error(),
+	)
+	lsc.params.Logger.Errorf("Giving up connecting: %s", msg)
+
+	connDetails := lsc.makeConnDetailsMsg(msg)
+	connDetails.ErrCategory = connErrCategoryOf(lastErr)
+	lsc.sendUpdate(&LStreamClientUpdate{
+		ConnDetails: connDetails,
+	})
+
+	lsc.connectGaveUp = true
+}
+
 func (lsc *LStreamClient) makeConnDetailsMsg(err string) *ConnDetails {
 	return &ConnDetails{
 		Messages: lsc.connDebugMessages,
@@ -412,20 +816,101 @@ func (lsc *LStreamClient) sendBusyStageUpdate() {
 	})
 }
 
+// failPendingCmds responds to the verify and ad hoc commands which are either
+// running or queued, and removes them from the queue: it's used when we're
+// disconnecting, since after that the queue is dropped. The verify commands
+// get the verifyResult, and the ad hoc ones get the adHocErr.
+func (lsc *LStreamClient) failPendingCmds(verifyResult LStreamVerifyResult, adHocErr error) {
+	if lsc.curCmdCtx != nil {
+		switch {
+		case lsc.curCmdCtx.cmd.verify != nil:
+			lsc.sendCmdResp(verifyResult, nil)
+		case lsc.curCmdCtx.cmd.adHoc != nil:
+			lsc.sendCmdResp(nil, adHocErr)
+		}
+	}
+
+	var cmdQueue []lstreamCmd
+	for _, cmd := range lsc.cmdQueue {
+		switch {
+		case cmd.verify != nil:
+			lsc.sendCmdRespTo(&lstreamCmdCtx{cmd: cmd}, verifyResult, nil)
+			continue
+		case cmd.adHoc != nil:
+			lsc.sendCmdRespTo(&lstreamCmdCtx{cmd: cmd}, nil, adHocErr)
+			continue
+		}
+
+		cmdQueue = append(cmdQueue, cmd)
+	}
+
+	lsc.cmdQueue = cmdQueue
+}
+
 func (lsc *LStreamClient) sendCmdResp(resp interface{}, err error) {
-	if lsc.curCmdCtx == nil {
+	lsc.sendCmdRespTo(lsc.curCmdCtx, resp, err)
+}
+
+func (lsc *LStreamClient) sendCmdRespTo(cmdCtx *lstreamCmdCtx, resp interface{}, err error) {
+	if cmdCtx == nil {
 		return
 	}
 
-	if lsc.curCmdCtx.cmd.respCh == nil {
+	if cmdCtx.cmd.respCh == nil {
 		return
 	}
 
-	lsc.curCmdCtx.cmd.respCh <- lstreamCmdRes{
+	res := lstreamCmdRes{
 		hostname: lsc.params.LogStream.Name,
 		resp:     resp,
 		err:      err,
 	}
+
+	if cmdCtx.cmd.queryLogs != nil {
+		res.queryID = cmdCtx.cmd.queryLogs.queryID
+	}
+
+	cmdCtx.cmd.respCh <- res
+}
+
+// skipIfCancelled checks whether the command is a query whose results are
+// not needed anymore (see lstreamCmdQueryLogs.ctx), and if so, responds with
+// the error right away, and returns true; the command must not be started
+// then.
+func (lsc *LStreamClient) skipIfCancelled(cmd lstreamCmd) bool {
+	if cmd.queryLogs == nil || cmd.queryLogs.ctx == nil || cmd.queryLogs.ctx.Err() == nil {
+		return false
+	}
+
+	lsc.params.Logger.Verbose1f("Skipping the cancelled query")
+	lsc.sendCmdRespTo(&lstreamCmdCtx{cmd: cmd}, &LogResp{}, errors.Trace(cmd.queryLogs.ctx.Err()))
+
+	return true
+}
+
+// failIfFilterUntranslatable makes sure that the filter of the query command,
+// if any, is translated to the awk dialect of the host: the LStreamsManager
+// translates it to the dialect it knows of, but it might be sent before the
+// bootstrap is done. If the filter can't be translated, it responds with the
+// error and returns true; the command must not be started then.
+func (lsc *LStreamClient) failIfFilterUntranslatable(cmd lstreamCmd) bool {
+	ql := cmd.queryLogs
+	if ql == nil || ql.filter == nil || ql.filterAWKDialect == lsc.awkDialect {
+		return false
+	}
+
+	filters, err := translateFilterQuery(ql.query, map[string]AWKDialect{
+		lsc.params.LogStream.Name: lsc.awkDialect,
+	})
+	if err != nil {
+		lsc.sendCmdRespTo(&lstreamCmdCtx{cmd: cmd}, &LogResp{}, errors.Trace(err))
+		return true
+	}
+
+	ql.filter = filters[lsc.awkDialect]
+	ql.filterAWKDialect = lsc.awkDialect
+
+	return false
 }
 
 func (lsc *LStreamClient) run() {
@@ -436,6 +921,12 @@ func (lsc *LStreamClient) run() {
 	for {
 		select {
 		case upd := <-lsc.connectUpdCh:
+			lsc.params.connEvents.publish(ConnEvent{
+				LStreamName: lsc.params.LogStream.Name,
+				Time:        lsc.params.Clock.Now(),
+				Update:      upd,
+			})
+
 			if dbg := upd.DebugInfo; dbg != nil {
 				// Got some debug info about the connection.
 				lsc.connDebugMessages = append(lsc.connDebugMessages, dbg.Message)
@@ -452,10 +943,24 @@ func (lsc *LStreamClient) run() {
 			} else if res := upd.Result; res != nil {
 				// The connection has either succeeded or failed.
 
+				// If the attempt was cancelled (because of the disconnect request),
+				// but the connection has succeeded regardless, just close it.
+				cancelled := lsc.connectCtx.Err() != nil
+				if cancelled && res.Err == nil {
+					res.Conn.Close()
+					res.Err = errors.Annotatef(lsc.connectCtx.Err(), "connected after cancellation")
+				}
+
 				if res.Err != nil {
 					lsc.params.Logger.Errorf("Shell connection failed: %s", res.Err.Error())
+					connDetails := lsc.makeConnDetailsMsg(fmt.Sprintf("attempt %d: %s", lsc.numConnAttempts, res.Err.Error()))
+					connDetails.ErrCategory = connErrCategoryOf(res.Err)
+					lsc.params.Metrics.AddCounter(MetricConnectionsFailed, MetricLabels{
+						"lstream": lsc.params.LogStream.Name,
+						"reason":  string(connDetails.ErrCategory),
+					}, 1)
 					lsc.sendUpdate(&LStreamClientUpdate{
-						ConnDetails: lsc.makeConnDetailsMsg(fmt.Sprintf("attempt %d: %s", lsc.numConnAttempts, res.Err.Error())),
+						ConnDetails: connDetails,
 					})
 
 					lsc.changeState(LStreamClientStateDisconnected)
@@ -464,11 +969,32 @@ func (lsc *LStreamClient) run() {
 						continue
 					}
 
-					connectAfter = lsc.params.Clock.Now().Add(2 * time.Second)
+					if lsc.parked {
+						// We were asked to stay disconnected.
+						continue
+					}
+
+					if cancelled && !lsc.connectBudgetSpent {
+						// It was a reconnect request, so reconnect right away, with the
+						// new connect budget.
+						lsc.numConnAttempts = 0
+						lsc.changeState(LStreamClientStateConnecting)
+						continue
+					}
+
+					if lsc.connectBudgetExhausted() {
+						lsc.giveUpConnecting(res.Err)
+						continue
+					}
+
+					connectAfter = lsc.params.Clock.Now().Add(connectRetryDelay)
 					continue
 				}
 
 				lsc.params.Logger.Infof("Shell connection succeeded, starting bootstrap")
+				lsc.params.Metrics.AddCounter(
+					MetricConnectionsOpened, lstreamMetricLabels(lsc.params.LogStream.Name), 1,
+				)
 
 				lsc.numConnAttempts = 0
 
@@ -477,14 +1003,15 @@ func (lsc *LStreamClient) run() {
 				stdoutLinesCh := make(chan string, 32)
 				stderrLinesCh := make(chan string, 32)
 
-				go getScannerFunc("stdout", res.Conn.Stdout(), stdoutLinesCh)()
-				go getScannerFunc("stderr", res.Conn.Stderr(), stderrLinesCh)()
+				go getScannerFunc("stdout", lsc.newMetricsCountingReader(res.Conn.Stdout()), stdoutLinesCh)()
+				go getScannerFunc("stderr", lsc.newMetricsCountingReader(res.Conn.Stderr()), stderrLinesCh)()
 
 				lsc.conn = &connCtx{
 					conn:          res.Conn,
 					stdoutLinesCh: stdoutLinesCh,
 					stderrLinesCh: stderrLinesCh,
 				}
+				lsc.querySched = newQueryScheduler(res.Conn, lsc.params.MaxConcurrentQueries)
 				lsc.changeState(LStreamClientStateConnectedIdle)
 
 				// Send bootstrap command
@@ -494,19 +1021,20 @@ func (lsc *LStreamClient) run() {
 			}
 
 		case cmd := <-lsc.enqueueCmdCh:
+			// The cached results don't need a connection.
+			if lsc.respondFromQueryCache(cmd) {
+				continue
+			}
+
 			// Require a connection.
 			if !isStateConnected(lsc.state) {
-				lsc.sendCmdResp(nil, errors.Errorf("not connected"))
+				lsc.sendCmdRespTo(&lstreamCmdCtx{cmd: cmd}, nil, errors.Errorf("not connected"))
 				continue
 			}
 
-			// And then, depending on whether we're busy or idle, either act
-			// right away, or enqueue for later.
-			if lsc.state == LStreamClientStateConnectedIdle {
-				lsc.startCmd(cmd)
-			} else {
-				lsc.addCmdToQueue(cmd)
-			}
+			// And then, depending on whether we're busy or idle, and on the
+			// transport capabilities, either act right away, or enqueue for later.
+			lsc.dispatchCmd(cmd)
 
 		case line, ok := <-lsc.conn.getStdoutLinesCh():
 			if !ok {
@@ -522,198 +1050,8 @@ func (lsc *LStreamClient) run() {
 
 			lastUpdTime = lsc.params.Clock.Now()
 
-			switch lsc.state {
-			case LStreamClientStateConnectedBusy:
-				cmdCtx := lsc.curCmdCtx
-
-				if cmdCtx == nil {
-					// We received some line before printing any command, must be
-					// just standard welcome message, but we're not interested in that.
-					continue
-				}
-
-				if lsc.checkCommandDone(line, cmdCtx, false) {
-					continue
-				}
-
-				if lsc.checkResetOutput(line, cmdCtx, false) {
-					continue
-				}
-
-				if lsc.checkError(line, cmdCtx) {
-					continue
-				}
-
-				if lsc.checkExitCode(line, cmdCtx) {
-					continue
-				}
-
-				switch {
-				case cmdCtx.cmd.bootstrap != nil:
-					tzPrefix := "host_timezone:"
-					logLinePrefix := "example_log_line:"
-
-					if strings.HasPrefix(line, tzPrefix) {
-						tz := strings.TrimPrefix(line, tzPrefix)
-						lsc.params.Logger.Verbose1f("Got logstream timezone: %s\n", tz)
-
-						location, err := time.LoadLocation(tz)
-						if err != nil {
-							lsc.params.Logger.Errorf("Error: failed to load location %s, will use UTC\n", tz)
-							// TODO: send an update and then the receiver should show a message
-							// to the user
-						} else {
-							lsc.timezone = tz
-							lsc.location = location
-						}
-					} else if strings.HasPrefix(line, logLinePrefix) {
-						exampleLogLine := strings.TrimPrefix(line, logLinePrefix)
-						lsc.params.Logger.Verbose1f("Got example log line: %s\n", exampleLogLine)
-
-						lsc.exampleLogLines = append(lsc.exampleLogLines, exampleLogLine)
-					} else if line == "bootstrap ok" {
-						cmdCtx.bootstrapCtx.receivedSuccess = true
-					} else if line == "bootstrap failed" {
-						cmdCtx.bootstrapCtx.receivedFailure = true
-					} else {
-						cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
-					}
-
-				case cmdCtx.cmd.ping != nil:
-					// Nothing special to do
-					cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
-
-				case cmdCtx.cmd.queryLogs != nil:
-					respCtx := cmdCtx.queryLogsCtx
-					resp := respCtx.Resp
-
-					switch {
-					case strings.HasPrefix(line, "s:"):
-						parts := strings.Split(strings.TrimPrefix(line, "s:"), ",")
-						if len(parts) < 2 {
-							err := errors.Errorf("malformed mstats %q: expected at least 2 parts", line)
-							cmdCtx.errs = append(cmdCtx.errs, err)
-							continue
-						}
-
-						t, err := time.ParseInLocation(lsc.timeFormat.MinuteKeyLayout, parts[0], lsc.location)
-						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
-							continue
-						}
-
-						t = InferYear(lsc.params.Clock.Now(), t)
-						t = t.UTC()
-
-						n, err := strconv.Atoi(parts[1])
-						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
-							continue
-						}
-
-						resp.MinuteStats[t.Unix()] = MinuteStatsItem{
-							NumMsgs: n,
-						}
-
-					case strings.HasPrefix(line, "logfile:"):
-						msg := strings.TrimPrefix(line, "logfile:")
-						idx := strings.IndexRune(msg, ':')
-						if idx <= 0 {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing logfile msg: no number of lines %q", line))
-							continue
-						}
-
-						logFilename := msg[:idx]
-						logNumberOfLinesStr := msg[idx+1:]
-						logNumberOfLines, err := strconv.Atoi(logNumberOfLinesStr)
-						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing logfile msg: invalid number in %q", line))
-							continue
-						}
-
-						respCtx.logfiles = append(respCtx.logfiles, logfileWithStartingLinenumber{
-							filename:       logFilename,
-							fromLinenumber: logNumberOfLines,
-						})
-
-					case strings.HasPrefix(line, "m:"):
-						// msg:Mar 26 17:08:34 localhost myapp[21134]: Mar 26 17:08:34.476329 foo bar foo bar
-						msg := strings.TrimPrefix(line, "m:")
-						idx := strings.IndexRune(msg, ':')
-						if idx <= 0 {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing log msg: no line number in %q", line))
-							continue
-						}
-
-						logLinenoStr := msg[:idx]
-						msg = msg[idx+1:]
-
-						logLinenoCombined, err := strconv.Atoi(logLinenoStr)
-						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg: invalid line number in %q", line))
-							continue
-						}
-
-						var logFilename string
-						logLineno := logLinenoCombined
-
-						for i := len(respCtx.logfiles) - 1; i >= 0; i-- {
-							logfile := respCtx.logfiles[i]
-							if logfile.filename == SpecialFilenameJournalctl || logLineno > logfile.fromLinenumber {
-								logLineno -= logfile.fromLinenumber
-								logFilename = logfile.filename
-								break
-							}
-						}
-
-						// Put together a basic LogMsg, for now with the raw message and
-						// without even the Time parsed, and then give it to parseLine,
-						// which will encirch it.
-						logMsg := LogMsg{
-							// Time will be set later
-
-							LogFilename:   logFilename,
-							LogLinenumber: logLineno,
-
-							CombinedLinenumber: logLinenoCombined,
-
-							Msg: msg,
-							Context: map[string]string{
-								"lstream": lsc.params.LogStream.Name,
-							},
-
-							OrigLine: msg,
-						}
-
-						err = lsc.parseLine(&logMsg)
-						if err != nil {
-							cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg %q", line))
-							continue
-						}
-
-						if logMsg.Time.Before(respCtx.lastTime) {
-							// Time has decreased: this might happen if the previous log line
-							// had a precise timestamp with microseconds (coming from the app
-							// level), but the current line only has a second precision
-							// (e.g. coming from rsyslog level). Then we just hackishly set the
-							// current timestamp to be the same.
-							logMsg.Time = respCtx.lastTime
-							logMsg.DecreasedTimestamp = true
-						}
-
-						resp.Logs = append(resp.Logs, logMsg)
-
-						respCtx.lastTime = logMsg.Time
-
-						// NOTE: the "p:" lines (process-related) are in stderr and thus
-						// are handled below. Why they are in stderr, see comments there.
-					default:
-						cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
-					}
-
-				default:
-					panic("invalid cmdCtx.cmd: no subcontext")
-				}
+			if lsc.state == LStreamClientStateConnectedBusy {
+				lsc.handleStdoutLine(line, lsc.curCmdCtx)
 			}
 
 		case line, ok := <-lsc.conn.getStderrLinesCh():
@@ -731,93 +1069,30 @@ func (lsc *LStreamClient) run() {
 			lastUpdTime = lsc.params.Clock.Now()
 
 			// NOTE: the "p:" lines (process-related) are here in stderr, because
-			// stdout is gzipped and thus we don't have any partial results (we get
+			// stdout is compressed and thus we don't have any partial results (we get
 			// them all at once), but for the process info, we actually want it right
 			// when it's printed by the nerdlog_agent.sh.
-			switch lsc.state {
-			case LStreamClientStateConnectedBusy:
-				cmdCtx := lsc.curCmdCtx
-
-				if cmdCtx == nil {
-					// We received some line before printing any command, just ignore that.
-					continue
-				}
-
-				if lsc.checkCommandDone(line, cmdCtx, true) {
-					continue
-				}
+			if lsc.state == LStreamClientStateConnectedBusy {
+				lsc.handleStderrLine(line, lsc.curCmdCtx)
+			}
 
-				if lsc.checkResetOutput(line, cmdCtx, true) {
-					continue
-				}
+		case sl := <-lsc.querySessionLinesCh:
+			lastUpdTime = lsc.params.Clock.Now()
+			lsc.handleQuerySessionLine(sl)
 
-				if lsc.checkError(line, cmdCtx) {
-					continue
-				}
+		case <-lsc.connectBudgetCh:
+			// The ConnectBudget is spent, so abort the attempt; the result handler
+			// will then give up.
+			lsc.params.Logger.Infof("Connect budget is spent, aborting the connection attempt")
+			lsc.connectBudgetCh = nil
+			lsc.connectBudgetSpent = true
+			lsc.connectCancel()
 
-				switch {
-				case cmdCtx.cmd.bootstrap != nil:
-					if line == "warn_journalctl_no_admin_access" {
-						cmdCtx.bootstrapCtx.warnJournalctlNoAdminAccess = true
-					} else {
-						cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
-					}
-				case cmdCtx.cmd.ping != nil:
-					cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
-				case cmdCtx.cmd.queryLogs != nil:
-					switch {
-					case strings.HasPrefix(line, "p:"):
-						// "p:" means process
-						processLine := strings.TrimPrefix(line, "p:")
-
-						switch {
-						case strings.HasPrefix(processLine, "stage:"):
-							stageLine := strings.TrimPrefix(processLine, "stage:")
-							parts := strings.Split(stageLine, ":")
-							if len(parts) < 2 {
-								cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("received malformed p:stage line: %s (expected at least 2 parts, got %d)", line, len(parts)))
-								continue
-							}
-
-							num, err := strconv.Atoi(parts[0])
-							if err != nil {
-								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:stage line: %s", line))
-								continue
-							}
-
-							lsc.busyStage = BusyStage{
-								Num:   num,
-								Title: parts[1],
-							}
-
-							if len(parts) >= 3 {
-								lsc.busyStage.ExtraInfo = parts[2]
-							}
-
-							lsc.sendBusyStageUpdate()
-
-						case strings.HasPrefix(processLine, "p:"):
-							// second "p:" means percentage
-
-							percentage, err := strconv.Atoi(strings.TrimPrefix(processLine, "p:"))
-							if err != nil {
-								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:p line: %s", line))
-								continue
-							}
-
-							lsc.busyStage.Percentage = percentage
-							lsc.sendBusyStageUpdate()
-						default:
-							cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
-						}
-					default:
-						cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
-					}
+		case <-lsc.runningQueryCtxDone():
+			lsc.stopRunningQuery()
 
-				default:
-					panic("invalid cmdCtx.cmd: no subcontext")
-				}
-			}
+		case sess := <-lsc.querySessionStopCh:
+			lsc.stopQuerySession(sess)
 
 			//case data := <-lsc.stdinCh:
 			//lsc.stdinBuf.Write([]byte(data))
@@ -835,6 +1110,30 @@ func (lsc *LStreamClient) run() {
 				lsc.changeState(LStreamClientStateConnecting)
 			}
 
+		case parked := <-lsc.parkReqCh:
+			if parked == lsc.parked || lsc.tearingDown {
+				continue
+			}
+
+			lsc.params.Logger.Infof("Received park request (parked:%v)", parked)
+			lsc.parked = parked
+
+			// Whether we're parking or unparking, the pending reconnect (if any)
+			// is not needed: either we stay disconnected, or we connect right away.
+			connectAfter = time.Time{}
+
+			switch {
+			case parked && lsc.state == LStreamClientStateConnecting:
+				// Abort the connection attempt; the result handler won't reconnect
+				// since we're parked.
+				lsc.connectCancel()
+			case parked && isStateConnected(lsc.state):
+				lsc.changeState(LStreamClientStateDisconnecting)
+			case !parked && lsc.state == LStreamClientStateDisconnected:
+				lsc.numConnAttempts = 0
+				lsc.changeState(LStreamClientStateConnecting)
+			}
+
 		case req := <-lsc.disconnectReqCh:
 			lsc.params.Logger.Infof("Received disconnect message (teardown:%v)", req.teardown)
 
@@ -851,7 +1150,17 @@ func (lsc *LStreamClient) run() {
 			if lsc.state == LStreamClientStateDisconnected {
 				if req.teardown {
 					close(lsc.disconnectedBeforeTeardownCh)
+				} else if lsc.connectGaveUp && !lsc.parked {
+					// We've given up connecting, so start over, with the new connect
+					// budget.
+					lsc.numConnAttempts = 0
+					lsc.changeState(LStreamClientStateConnecting)
 				}
+			} else if lsc.state == LStreamClientStateConnecting {
+				// Abort the connection attempt; we'll keep receiving updates from the
+				// transport until the result is delivered, and the result handler
+				// will take it from there.
+				lsc.connectCancel()
 			} else {
 				lsc.changeState(LStreamClientStateDisconnecting)
 			}
@@ -866,101 +1175,561 @@ func (lsc *LStreamClient) run() {
 	}
 }
 
-func (lsc *LStreamClient) sendUpdate(upd *LStreamClientUpdate) {
-	upd.Name = lsc.params.LogStream.Name
-	lsc.params.UpdatesCh <- upd
-}
+// handleStdoutLine handles a stdout line received while the given command is
+// running, either on the main session or on an additional one.
+func (lsc *LStreamClient) handleStdoutLine(line string, cmdCtx *lstreamCmdCtx) {
 
-// scanLinesPreserveCarriageReturn is the same as bufio.ScanLines, but it does
-// not strip the \r characters: it's just a hack to support gzipping. In fact,
-// since we sometimes read text lines and sometimes gzipped data, we'd better
-// use some other custom scanner, but for now just this simple hack.
-func scanLinesPreserveCarriageReturn(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + 1, data[0:i], nil
+	if cmdCtx == nil {
+		// We received some line before printing any command, must be
+		// just standard welcome message, but we're not interested in that.
+		return
 	}
-	// If we're at EOF, we have a final, non-terminated line. Return it.
-	if atEOF {
-		return len(data), data, nil
+
+	if lsc.checkCommandDone(line, cmdCtx, false) {
+		return
 	}
-	// Request more data.
-	return 0, nil, nil
-}
 
-func getScannerFunc(name string, reader io.Reader, linesCh chan<- string) func() {
-	return func() {
-		defer func() {
-			close(linesCh)
-		}()
+	if lsc.checkQueryStopped(line, cmdCtx, false) {
+		return
+	}
 
-		scanner := bufio.NewScanner(reader)
+	if lsc.checkResetOutput(line, cmdCtx, false) {
+		return
+	}
 
-		// See comments for scanLinesPreserveCarriageReturn for details why we need
-		// this custom split function.
-		scanner.Split(scanLinesPreserveCarriageReturn)
+	if lsc.checkError(line, cmdCtx) {
+		return
+	}
 
-		// TODO: also defer signal to reconnect
+	if lsc.checkExitCode(line, cmdCtx) {
+		return
+	}
 
-		// inGzip is true when we're receiving gzipped data.
-		// gzipBuf accumulates that data, and once we receive the gzipEndMarker,
-		// we gunzip all this data and feed the lines to the channel.
-		//
-		// TODO: instead of accumulating it and then unpacking all at once, do it
+	switch {
+	case cmdCtx.cmd.bootstrap != nil:
+		tzPrefix := "host_timezone:"
+		logLinePrefix := "example_log_line:"
+
+		if strings.HasPrefix(line, tzPrefix) {
+			tz := strings.TrimPrefix(line, tzPrefix)
+			lsc.params.Logger.Verbose1f("Got logstream timezone: %s\n", tz)
+
+			cmdCtx.bootstrapCtx.timezone = tz
+			lsc.setHostTimezone(tz)
+		} else if strings.HasPrefix(line, awkDialectPrefix) {
+			dialect := AWKDialect(strings.TrimPrefix(line, awkDialectPrefix))
+			if !isValidAWKDialect(dialect) {
+				lsc.params.Logger.Errorf("Error: invalid awk dialect %q, will use %s\n", dialect, AWKDialectDefault)
+				return
+			}
+
+			lsc.params.Logger.Verbose1f("Got awk dialect: %s\n", dialect)
+			cmdCtx.bootstrapCtx.awkDialect = dialect
+		} else if strings.HasPrefix(line, hostVersionPrefix) {
+			cmdCtx.bootstrapCtx.hostVersion = strings.TrimPrefix(line, hostVersionPrefix)
+			lsc.params.Logger.Verbose1f("Got host version: %s\n", cmdCtx.bootstrapCtx.hostVersion)
+		} else if line == capabilitiesCachedMarker && cmdCtx.bootstrapCtx.cachedCaps != nil {
+			// The host version hasn't changed, so the probes were skipped, and we
+			// use the cached results instead.
+			caps := cmdCtx.bootstrapCtx.cachedCaps
+			lsc.params.Logger.Verbose1f("Using cached capabilities probed at %s\n", caps.ProbedAt)
+
+			cmdCtx.bootstrapCtx.usedCachedCaps = true
+			cmdCtx.bootstrapCtx.warnJournalctlNoAdminAccess = caps.WarnJournalctlNoAdminAccess
+			cmdCtx.bootstrapCtx.awkDialect = caps.AWKDialect
+			lsc.setHostTimezone(caps.Timezone)
+			lsc.exampleLogLines = caps.ExampleLogLines
+		} else if strings.HasPrefix(line, logLinePrefix) {
+			exampleLogLine := strings.TrimPrefix(line, logLinePrefix)
+			lsc.params.Logger.Verbose1f("Got example log line: %s\n", exampleLogLine)
+
+			lsc.exampleLogLines = append(lsc.exampleLogLines, exampleLogLine)
+		} else if strings.HasPrefix(line, hostTimePrefix) {
+			hostTime, err := parseHostTime(line)
+			if err != nil {
+				lsc.params.Logger.Errorf("Error: failed to parse host time: %s\n", err)
+				return
+			}
+
+			lsc.clockSkew = calcClockSkew(hostTime, lsc.params.Clock.Now())
+			lsc.params.Logger.Verbose1f("Got host time: %s, clock skew: %s\n", hostTime, lsc.clockSkew)
+		} else if line == wireCompressionOKMarker {
+			cmdCtx.bootstrapCtx.wireCompressionOK = true
+		} else if line == busyboxMarker {
+			lsc.params.Logger.Verbose1f("The host is busybox-based\n")
+			cmdCtx.bootstrapCtx.busybox = true
+		} else if line == "bootstrap ok" {
+			cmdCtx.bootstrapCtx.receivedSuccess = true
+		} else if line == "bootstrap failed" {
+			cmdCtx.bootstrapCtx.receivedFailure = true
+		} else if line == agentUploadFailedMarker {
+			cmdCtx.bootstrapCtx.agentUploadFailed = true
+		} else {
+			cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+		}
+
+	case cmdCtx.cmd.ping != nil:
+		// Nothing special to do
+		cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+
+	case cmdCtx.cmd.verify != nil:
+		if !strings.HasPrefix(line, "verify:") {
+			cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+			return
+		}
+
+		result, err := parseVerifyLine(strings.TrimPrefix(line, "verify:"))
+		if err != nil {
+			cmdCtx.errs = append(cmdCtx.errs, errors.Trace(err))
+			return
+		}
+
+		cmdCtx.verifyCtx.results = append(cmdCtx.verifyCtx.results, result)
+
+	case cmdCtx.cmd.adHoc != nil:
+		switch {
+		case strings.HasPrefix(line, adHocOutPrefix):
+			cmdCtx.adHocCtx.addOutputLine(
+				strings.TrimPrefix(line, adHocOutPrefix), cmdCtx.cmd.adHoc.maxOutputSize,
+			)
+		case strings.HasPrefix(line, adHocExitCodePrefix):
+			cmdCtx.adHocCtx.exitCode = strings.TrimPrefix(line, adHocExitCodePrefix)
+		default:
+			cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+		}
+
+	case cmdCtx.cmd.queryLogs != nil:
+		respCtx := cmdCtx.queryLogsCtx
+		resp := respCtx.Resp
+
+		isCustomAgent := lsc.params.LogStream.Options.CustomAgent != ""
+
+		switch {
+		case isCustomAgent && strings.HasPrefix(line, "s:"):
+			t, n, err := parseCustomAgentStats(strings.TrimPrefix(line, "s:"))
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing custom agent mstats %q", line))
+				return
+			}
+
+			resp.MinuteStats[t.Unix()] = MinuteStatsItem{
+				NumMsgs: n,
+			}
+
+		case isCustomAgent && !strings.HasPrefix(line, "m:"):
+			cmdCtx.errs = append(cmdCtx.errs, customAgentMalformedLineError(line))
+
+		case strings.HasPrefix(line, logSourceMarkerPrefix):
+			err := lsc.startLogSource(respCtx, strings.TrimPrefix(line, logSourceMarkerPrefix))
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log source %q", line))
+			}
+
+		case strings.HasPrefix(line, "s:"):
+			parts := strings.Split(strings.TrimPrefix(line, "s:"), ",")
+			if len(parts) < 2 {
+				err := errors.Errorf("malformed mstats %q: expected at least 2 parts", line)
+				cmdCtx.errs = append(cmdCtx.errs, err)
+				return
+			}
+
+			t, err := time.ParseInLocation(lsc.timeFormat.MinuteKeyLayout, parts[0], lsc.location)
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
+				return
+			}
+
+			// The minute keys normally don't have the year, but they do with
+			// the date from the file name.
+			if t.Year() == 0 {
+				t = InferYear(lsc.params.Clock.Now(), t)
+			}
+			t = t.UTC()
+
+			n, err := strconv.Atoi(parts[1])
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing mstats"))
+				return
+			}
+
+			// The agent has only counted the sampled lines, so scale the
+			// numbers to approximate the actual ones.
+			if resp.SampleRate > 1 {
+				n *= resp.SampleRate
+			}
+
+			// With multiple log sources, every source has its own stats, so
+			// they're added up.
+			item := resp.MinuteStats[t.Unix()]
+			item.NumMsgs += n
+			resp.MinuteStats[t.Unix()] = item
+
+		case strings.HasPrefix(line, "g:") && resp.Groups != nil:
+			value, n, err := parseGroupLine(strings.TrimPrefix(line, "g:"))
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing group %q", line))
+				return
+			}
+
+			// Same as the mstats, scale the sampled counts.
+			if resp.SampleRate > 1 {
+				n *= resp.SampleRate
+			}
+
+			resp.Groups[value] += n
+
+		case strings.HasPrefix(line, "logfile:"):
+			msg := strings.TrimPrefix(line, "logfile:")
+			idx := strings.IndexRune(msg, ':')
+			if idx <= 0 {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing logfile msg: no number of lines %q", line))
+				return
+			}
+
+			logFilename := msg[:idx]
+			logNumberOfLinesStr := msg[idx+1:]
+			logNumberOfLines, err := strconv.Atoi(logNumberOfLinesStr)
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing logfile msg: invalid number in %q", line))
+				return
+			}
+
+			respCtx.logfiles = append(respCtx.logfiles, logfileWithStartingLinenumber{
+				filename:       logFilename,
+				fromLinenumber: logNumberOfLines,
+			})
+
+		case strings.HasPrefix(line, "mc:"):
+			// Named regex captures for the next "m:" line.
+			respCtx.pendingCaptures = ParseFilterCaptures(strings.TrimPrefix(line, "mc:"))
+
+		case strings.HasPrefix(line, "m:"):
+			captures := respCtx.pendingCaptures
+			respCtx.pendingCaptures = nil
+
+			// msg:Mar 26 17:08:34 localhost myapp[21134]: Mar 26 17:08:34.476329 foo bar foo bar
+			msg := strings.TrimPrefix(line, "m:")
+			idx := strings.IndexRune(msg, ':')
+			if idx <= 0 {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing log msg: no line number in %q", line))
+				return
+			}
+
+			logLinenoStr := msg[:idx]
+			msg = msg[idx+1:]
+
+			if lsc.params.LogStream.Options.Multiline != nil {
+				msg = joinMultilineEvent(msg)
+			}
+
+			logLinenoCombined, err := strconv.Atoi(logLinenoStr)
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg: invalid line number in %q", line))
+				return
+			}
+
+			var logFilename string
+			logLineno := logLinenoCombined
+
+			for i := len(respCtx.logfiles) - 1; i >= 0; i-- {
+				logfile := respCtx.logfiles[i]
+				if IsTimestampAddressed(logfile.filename) || logLineno > logfile.fromLinenumber {
+					logLineno -= logfile.fromLinenumber
+					logFilename = logfile.filename
+					break
+				}
+			}
+
+			// Put together a basic LogMsg, for now with the raw message and
+			// without even the Time parsed, and then give it to parseLine,
+			// which will encirch it.
+			logMsg := LogMsg{
+				// Time will be set later
+
+				LogFilename:   logFilename,
+				LogLinenumber: logLineno,
+
+				CombinedLinenumber: logLinenoCombined,
+
+				Msg: msg,
+				Context: map[string]string{
+					"lstream": lsc.params.LogStream.Name,
+				},
+
+				OrigLine: msg,
+			}
+
+			if tag := respCtx.sourceTag; tag != "" {
+				logMsg.Context["logsource"] = tag
+			}
+
+			if cmdCtx.cmd.queryLogs.projection != nil {
+				err = lsc.parseProjectedLine(&logMsg)
+			} else {
+				err = lsc.parseLine(&logMsg)
+			}
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing log msg %q", line))
+				return
+			}
+
+			// Add the captured fields, if any; but they never override the
+			// fields that we've already parsed.
+			for k, v := range captures {
+				if _, ok := logMsg.Context[k]; !ok {
+					logMsg.Context[k] = v
+				}
+			}
+
+			// The labels, on the contrary, override whatever was parsed, so
+			// that they're consistent with how they're queried (see
+			// FilterFieldsConfig.Labels).
+			if labels := lsc.params.LogStream.Labels; len(labels) > 0 {
+				for k, v := range labels {
+					logMsg.Context[k] = v
+				}
+				logMsg.Labels = labels
+			}
+
+			if logMsg.Time.Before(respCtx.lastTime) {
+				// Time has decreased: this might happen if the previous log line
+				// had a precise timestamp with microseconds (coming from the app
+				// level), but the current line only has a second precision
+				// (e.g. coming from rsyslog level). Then we just hackishly set the
+				// current timestamp to be the same.
+				logMsg.Time = respCtx.lastTime
+				logMsg.DecreasedTimestamp = true
+			}
+
+			resp.Logs = append(resp.Logs, logMsg)
+
+			respCtx.lastTime = logMsg.Time
+
+			// NOTE: the "p:" lines (process-related) are in stderr and thus
+			// are handled below. Why they are in stderr, see comments there.
+		default:
+			cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+		}
+
+	default:
+		panic("invalid cmdCtx.cmd: no subcontext")
+	}
+}
+
+// handleStderrLine is the same as handleStdoutLine, but for stderr.
+func (lsc *LStreamClient) handleStderrLine(line string, cmdCtx *lstreamCmdCtx) {
+
+	if cmdCtx == nil {
+		// We received some line before printing any command, just ignore that.
+		return
+	}
+
+	if lsc.checkCommandDone(line, cmdCtx, true) {
+		return
+	}
+
+	if lsc.checkQueryStopped(line, cmdCtx, true) {
+		return
+	}
+
+	if lsc.checkResetOutput(line, cmdCtx, true) {
+		return
+	}
+
+	if lsc.checkError(line, cmdCtx) {
+		return
+	}
+
+	switch {
+	case cmdCtx.cmd.bootstrap != nil:
+		if line == "warn_journalctl_no_admin_access" {
+			cmdCtx.bootstrapCtx.warnJournalctlNoAdminAccess = true
+		} else {
+			cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+		}
+	case cmdCtx.cmd.ping != nil:
+		cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+	case cmdCtx.cmd.verify != nil:
+		cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+	case cmdCtx.cmd.adHoc != nil:
+		cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+	case cmdCtx.cmd.queryLogs != nil:
+		switch {
+		case strings.HasPrefix(line, "p:"):
+			// "p:" means process
+			processLine := strings.TrimPrefix(line, "p:")
+
+			switch {
+			case strings.HasPrefix(processLine, "stage:"):
+				stageLine := strings.TrimPrefix(processLine, "stage:")
+				parts := strings.Split(stageLine, ":")
+				if len(parts) < 2 {
+					cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("received malformed p:stage line: %s (expected at least 2 parts, got %d)", line, len(parts)))
+					return
+				}
+
+				num, err := strconv.Atoi(parts[0])
+				if err != nil {
+					cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:stage line: %s", line))
+					return
+				}
+
+				lsc.busyStage = BusyStage{
+					Num:   num,
+					Title: parts[1],
+				}
+
+				if len(parts) >= 3 {
+					lsc.busyStage.ExtraInfo = parts[2]
+				}
+
+				lsc.sendBusyStageUpdate()
+
+			case strings.HasPrefix(processLine, "p:"):
+				// second "p:" means percentage
+
+				percentage, err := strconv.Atoi(strings.TrimPrefix(processLine, "p:"))
+				if err != nil {
+					cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:p line: %s", line))
+					return
+				}
+
+				lsc.busyStage.Percentage = percentage
+				lsc.sendBusyStageUpdate()
+
+			case strings.HasPrefix(processLine, "b:"):
+				// "b:" means bytes: "p:b:<processed>:<total>"
+
+				bytesProcessed, bytesTotal, err := parseBytesProgress(strings.TrimPrefix(processLine, "b:"))
+				if err != nil {
+					cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:b line: %s", line))
+					return
+				}
+
+				lsc.busyStage.BytesProcessed = bytesProcessed
+				lsc.busyStage.BytesTotal = bytesTotal
+				lsc.sendBusyStageUpdate()
+			default:
+				cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+			}
+
+		case strings.HasPrefix(line, "warn_logfile_rotated:"):
+			resp := cmdCtx.queryLogsCtx.Resp
+			resp.RotatedLogfiles = append(resp.RotatedLogfiles, strings.TrimPrefix(line, "warn_logfile_rotated:"))
+
+		case strings.HasPrefix(line, "pin_last:"):
+			cmdCtx.queryLogsCtx.Resp.PinLast = strings.TrimPrefix(line, "pin_last:")
+
+		case strings.HasPrefix(line, "warn_pin_lost:"):
+			cmdCtx.queryLogsCtx.pinWarning = fmt.Sprintf(
+				"log %s rotated since it was pinned, so it's read live; re-pin to get reproducible results",
+				strings.TrimPrefix(line, "warn_pin_lost:"),
+			)
+
+		case line == "warn_pin_unsupported":
+			cmdCtx.queryLogsCtx.pinWarning = "pinning is not supported by journalctl, so the logs are read live"
+
+		case strings.HasPrefix(line, "awk_failed:"):
+			failure, err := parseAWKFailedLine(strings.TrimPrefix(line, "awk_failed:"))
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed awk_failed line: %s", line))
+				return
+			}
+
+			cmdCtx.queryLogsCtx.awkFailure = failure
+
+		default:
+			cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+		}
+
+	default:
+		panic("invalid cmdCtx.cmd: no subcontext")
+	}
+}
+
+func (lsc *LStreamClient) sendUpdate(upd *LStreamClientUpdate) {
+	upd.Name = lsc.params.LogStream.Name
+	lsc.params.UpdatesCh <- upd
+}
+
+func getScannerFunc(name string, reader io.Reader, linesCh chan<- string) func() {
+	return func() {
+		defer func() {
+			close(linesCh)
+		}()
+
+		// See comments for lineSplitter for details why we need this custom
+		// split function.
+		scanner, splitter := newLineScanner(reader)
+
+		// TODO: also defer signal to reconnect
+
+		// compression is non-empty when we're receiving compressed data.
+		// compressedBuf accumulates that data, and once we receive the
+		// compressedEndMarker, we decompress all this data and feed the lines to
+		// the channel.
+		//
+		// TODO: instead of accumulating it and then unpacking all at once, do it
 		// gradually as we receive data. Idk how much of an improvement it'd be in
 		// practice though, since we're not receiving some huge chunks of data,
 		// just a bit nicer.
-		inGzip := false
-		var gzipBuf bytes.Buffer
+		var compression WireCompression
+		var compressedBuf bytes.Buffer
 
 		for scanner.Scan() {
 			lineBytes := scanner.Bytes()
 			line := string(lineBytes)
 
-			if !inGzip && line == gzipStartMarker {
-				// Gzipped data begins
-				inGzip = true
-				gzipBuf.Reset()
+			if compression == "" && strings.HasPrefix(line, compressedStartMarkerPrefix) {
+				// Compressed data begins
+				compression = WireCompression(strings.TrimPrefix(line, compressedStartMarkerPrefix))
+				compressedBuf.Reset()
+				splitter.noTruncate = true
 
 				// We also need to continue loop iteration now so that we don't
-				// add this gzipStartMarker line to the gzipBuf below.
+				// add this start marker line to the compressedBuf below.
+				continue
+			} else if line == compressedAbortedMarker || (compression != "" && strings.HasSuffix(line, compressedAbortedMarker)) {
+				// The query was stopped, so the compressed data (if any) is
+				// incomplete; just discard it.
+				compression = ""
+				compressedBuf.Reset()
+				splitter.noTruncate = false
 				continue
-			} else if inGzip && strings.HasSuffix(line, gzipEndMarker) {
-				// We just reached the end of the gzipped data
-				inGzip = false
+			} else if compression != "" && strings.HasSuffix(line, compressedEndMarker) {
+				// We just reached the end of the compressed data
 
 				// Append this last piece
-				gzipBuf.Write(lineBytes[:len(lineBytes)-len(gzipEndMarker)])
-
-				var err error
+				compressedBuf.Write(lineBytes[:len(lineBytes)-len(compressedEndMarker)])
 
-				// Gunzip the data and feed all the lines to linesCh
-				var r io.Reader
-				r, err = gzip.NewReader(&gzipBuf)
+				// Decompress the data and feed all the lines to linesCh
+				r, err := decompress(compression, compressedBuf.Bytes())
+				compression = ""
+				splitter.noTruncate = false
 				if err != nil {
-					linesCh <- fmt.Sprintf("error:failed to gunzip data: %s", err.Error())
+					linesCh <- fmt.Sprintf("error:failed to decompress data: %s", err.Error())
 					return
 				}
 
-				scanner := bufio.NewScanner(r)
+				// The decompressed lines are the actual text, so strip the \r-s, same
+				// as bufio.ScanLines does.
+				scanner, _ := newLineScanner(r)
 				for scanner.Scan() {
-					linesCh <- scanner.Text()
+					linesCh <- strings.TrimSuffix(scanner.Text(), "\r")
 				}
 
 				continue
 			}
 
-			if !inGzip {
-				// We're not in gzipped data, so just feed this line directly.
+			if compression == "" {
+				// We're not in compressed data, so just feed this line directly.
 				linesCh <- line
 			} else {
-				// We're reading gzipped data now, so for now just add it to the
-				// gzipBuf (together with the \n which was stripped by the scanner).
-				gzipBuf.Write(lineBytes)
-				gzipBuf.WriteByte('\n')
+				// We're reading compressed data now, so for now just add it to the
+				// compressedBuf (together with the \n which was stripped by the
+				// scanner).
+				compressedBuf.Write(lineBytes)
+				compressedBuf.WriteByte('\n')
 			}
 		}
 
@@ -999,27 +1768,394 @@ func (lsc *LStreamClient) Reconnect() {
 	}
 }
 
+// SetParked parks or unparks the client: the parked client disconnects, and
+// stays disconnected (instead of reconnecting) until it's unparked. Unlike
+// Close, it can be called any number of times; if called again before the
+// previous request is handled, the latest one wins.
+func (lsc *LStreamClient) SetParked(parked bool) {
+	// Only the LStreamsManager calls it, from a single goroutine, so the
+	// channel can't be filled up between draining it and sending.
+	select {
+	case <-lsc.parkReqCh:
+	default:
+	}
+
+	lsc.parkReqCh <- parked
+}
+
 func (lsc *LStreamClient) addCmdToQueue(cmd lstreamCmd) {
 	lsc.cmdQueue = append(lsc.cmdQueue, cmd)
 }
 
-func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
+// dispatchCmd either starts the command right away (on the main session or
+// on an additional one), or adds it to the queue, as decided by the
+// querySched.
+func (lsc *LStreamClient) dispatchCmd(cmd lstreamCmd) {
+	if lsc.skipIfCancelled(cmd) || lsc.failIfFilterUntranslatable(cmd) {
+		return
+	}
+
+	var mainCmd *lstreamCmd
+	if lsc.state == LStreamClientStateConnectedBusy {
+		mainCmd = &lsc.curCmdCtx.cmd
+	}
+
+	switch lsc.querySched.schedule(cmd, mainCmd, len(lsc.cmdQueue)) {
+	case querySchedActionStart:
+		lsc.startCmd(cmd)
+
+	case querySchedActionStartSession:
+		if err := lsc.startCmdInSession(cmd); err != nil {
+			// Opening a new session has failed for whatever reason, so just
+			// fall back to the main one.
+			lsc.params.Logger.Errorf("Failed to start a query session, enqueueing: %s", err.Error())
+			lsc.addCmdToQueue(cmd)
+		}
+
+	case querySchedActionEnqueue:
+		lsc.addCmdToQueue(cmd)
+	}
+}
+
+// runQueuedCmds starts as many commands from the queue as the querySched
+// allows.
+func (lsc *LStreamClient) runQueuedCmds() {
+	for len(lsc.cmdQueue) > 0 && isStateConnected(lsc.state) {
+		nextCmd := lsc.cmdQueue[0]
+
+		if lsc.skipIfCancelled(nextCmd) || lsc.failIfFilterUntranslatable(nextCmd) {
+			lsc.cmdQueue = lsc.cmdQueue[1:]
+			continue
+		}
+
+		var mainCmd *lstreamCmd
+		if lsc.state == LStreamClientStateConnectedBusy {
+			mainCmd = &lsc.curCmdCtx.cmd
+		}
+
+		action := lsc.querySched.schedule(nextCmd, mainCmd, 0)
+		if action == querySchedActionEnqueue {
+			return
+		}
+
+		lsc.cmdQueue = lsc.cmdQueue[1:]
+
+		if action == querySchedActionStart {
+			lsc.startCmd(nextCmd)
+			continue
+		}
+
+		if err := lsc.startCmdInSession(nextCmd); err != nil {
+			lsc.params.Logger.Errorf("Failed to start a query session, enqueueing: %s", err.Error())
+			lsc.cmdQueue = append([]lstreamCmd{nextCmd}, lsc.cmdQueue...)
+			return
+		}
+	}
+}
+
+func (lsc *LStreamClient) newCmdCtx(cmd lstreamCmd) *lstreamCmdCtx {
 	cmdCtx := &lstreamCmdCtx{
 		cmd: cmd,
 		idx: lsc.nextCmdIdx,
+
+		startTime: lsc.params.Clock.Now(),
 	}
 
-	lsc.curCmdCtx = cmdCtx
 	lsc.nextCmdIdx++
 
+	return cmdCtx
+}
+
+func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
+	cmdCtx := lsc.newCmdCtx(cmd)
+	lsc.curCmdCtx = cmdCtx
+
+	lsc.writeCmd(lsc.conn.conn.Stdin(), cmdCtx)
+
+	lsc.changeState(LStreamClientStateConnectedBusy)
+}
+
+// startCmdInSession opens a new additional session, and starts the command
+// there. Only queries can run on additional sessions.
+func (lsc *LStreamClient) startCmdInSession(cmd lstreamCmd) error {
+	ms, ok := lsc.conn.conn.(ShellConnMultiSession)
+	if !ok {
+		return errors.Errorf("transport doesn't support multiple sessions")
+	}
+
+	conn, err := ms.NewSession()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	cmdCtx := lsc.newCmdCtx(cmd)
+
+	sess := &querySession{
+		conn:   conn,
+		cmdCtx: cmdCtx,
+		doneCh: make(chan struct{}),
+	}
+	cmdCtx.session = sess
+
+	lsc.querySessions[sess] = struct{}{}
+	lsc.querySched.sessionStarted()
+
+	go lsc.forwardQuerySessionLines(sess, lsc.newMetricsCountingReader(conn.Stdout()), false)
+	go lsc.forwardQuerySessionLines(sess, lsc.newMetricsCountingReader(conn.Stderr()), true)
+
+	if cmd.queryLogs.ctx != nil {
+		go lsc.watchQuerySessionCtx(sess)
+	}
+
+	stdinBuf := conn.Stdin()
+
+	// The new session is a fresh shell, so we need to do the same preparations
+	// as the bootstrap does; the agent script is already uploaded though.
+	stdinBuf.Write([]byte("cd\n"))
+	if cmd := localeCmd(lsc.params.LogStream.Options.Locale); cmd != "" {
+		stdinBuf.Write([]byte(cmd + "\n"))
+	}
+	for _, cmd := range lsc.params.LogStream.Options.ShellInit {
+		stdinBuf.Write([]byte(cmd))
+		stdinBuf.Write([]byte("\n"))
+	}
+
+	lsc.writeCmd(stdinBuf, cmdCtx)
+
+	// The session is only needed for this one command.
+	stdinBuf.Write([]byte("exit\n"))
+
+	return nil
+}
+
+// forwardQuerySessionLines reads lines from the reader (stdout or stderr of
+// the query session) and forwards them to the querySessionLinesCh, until the
+// reader is closed or the session is done.
+func (lsc *LStreamClient) forwardQuerySessionLines(
+	sess *querySession, reader io.Reader, isStderr bool,
+) {
+	linesCh := make(chan string, 32)
+	go getScannerFunc("session", reader, linesCh)()
+
+	for {
+		sl := querySessionLine{sess: sess, isStderr: isStderr}
+
+		line, ok := <-linesCh
+		if ok {
+			sl.line = line
+		} else {
+			sl.closed = true
+		}
+
+		select {
+		case lsc.querySessionLinesCh <- sl:
+		case <-sess.doneCh:
+			return
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// handleQuerySessionLine handles a line from one of the querySessions.
+func (lsc *LStreamClient) handleQuerySessionLine(sl querySessionLine) {
+	if _, ok := lsc.querySessions[sl.sess]; !ok {
+		// The session was already closed, ignore the leftovers.
+		return
+	}
+
+	if sl.closed {
+		if sl.isStderr {
+			sl.sess.stderrClosed = true
+		} else {
+			sl.sess.stdoutClosed = true
+		}
+
+		if sl.sess.stdoutClosed && sl.sess.stderrClosed {
+			// The session was closed before the command was done.
+			lsc.sendCmdRespTo(sl.sess.cmdCtx, nil, errors.Errorf("query session closed unexpectedly"))
+			lsc.closeQuerySession(sl.sess)
+		}
+
+		return
+	}
+
+	lsc.params.Logger.Verbose3f(
+		"Got session line(%s, stderr:%v): %s", lsc.params.LogStream.Name, sl.isStderr, sl.line,
+	)
+
+	if sl.isStderr {
+		lsc.handleStderrLine(sl.line, sl.sess.cmdCtx)
+	} else {
+		lsc.handleStdoutLine(sl.line, sl.sess.cmdCtx)
+	}
+}
+
+// closeQuerySession closes the additional session, and starts more commands
+// from the queue if possible.
+func (lsc *LStreamClient) closeQuerySession(sess *querySession) {
+	if _, ok := lsc.querySessions[sess]; !ok {
+		return
+	}
+
+	delete(lsc.querySessions, sess)
+	close(sess.doneCh)
+	sess.conn.Close()
+	lsc.querySched.sessionDone()
+
+	lsc.runQueuedCmds()
+}
+
+// closeQuerySessions closes all the additional sessions, without responding
+// to the commands running there (same as for the command running on the
+// main session when we disconnect).
+func (lsc *LStreamClient) closeQuerySessions() {
+	for sess := range lsc.querySessions {
+		delete(lsc.querySessions, sess)
+		close(sess.doneCh)
+		sess.conn.Close()
+		lsc.querySched.sessionDone()
+	}
+}
+
+// setHostTimezone sets the timezone of the host, as reported by the agent.
+func (lsc *LStreamClient) setHostTimezone(tz string) {
+	location, err := time.LoadLocation(tz)
+	if err != nil {
+		lsc.params.Logger.Errorf("Error: failed to load location %s, will use UTC\n", tz)
+		// TODO: send an update and then the receiver should show a message
+		// to the user
+		return
+	}
+
+	lsc.timezone = tz
+	lsc.location = location
+}
+
+// setAWKDialect translates the regexes from the LogStreamOptions to the given
+// awk dialect. If some of them can't be translated, an error is returned, and
+// nothing is changed.
+func (lsc *LStreamClient) setAWKDialect(dialect AWKDialect) error {
+	opts := lsc.params.LogStream.Options
+
+	levelClassifier, err := compileLevelPatterns(opts.LevelPatterns, dialect)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	multiline, err := opts.Multiline.forAWKDialect(dialect)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fieldExtractor, err := opts.FieldExtractor.forAWKDialect(dialect)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	lsc.awkDialect = dialect
+	lsc.levelClassifier = levelClassifier
+	lsc.multiline = multiline
+	lsc.fieldExtractor = fieldExtractor
+
+	return nil
+}
+
+// cacheCapabilities stores the results of the bootstrap probes in the
+// capabilities cache, if it's enabled and the probes were actually done
+// (as opposed to using the cached results).
+func (lsc *LStreamClient) cacheCapabilities(bootstrapCtx *lstreamCmdCtxBootstrap) {
+	if lsc.params.CapabilitiesCache == nil || bootstrapCtx.usedCachedCaps || bootstrapCtx.hostVersion == "" {
+		return
+	}
+
+	err := lsc.params.CapabilitiesCache.Set(capabilitiesCacheKey(lsc.params.LogStream), HostCapabilities{
+		HostVersion:                 bootstrapCtx.hostVersion,
+		Timezone:                    bootstrapCtx.timezone,
+		ExampleLogLines:             lsc.exampleLogLines,
+		WarnJournalctlNoAdminAccess: bootstrapCtx.warnJournalctlNoAdminAccess,
+		Busybox:                     bootstrapCtx.busybox,
+		AWKDialect:                  bootstrapCtx.awkDialect,
+		ProbedAt:                    lsc.params.Clock.Now(),
+	})
+	if err != nil {
+		lsc.params.Logger.Warnf("Failed to save capabilities cache: %s", err.Error())
+	}
+}
+
+// respondFromQueryCache checks whether the command is a query whose results
+// are in the QueryCache, and if so, responds with them right away, and
+// returns true; the command must not be started then.
+func (lsc *LStreamClient) respondFromQueryCache(cmd lstreamCmd) bool {
+	if lsc.params.QueryCache == nil || cmd.queryLogs == nil {
+		return false
+	}
+
+	key, ok := queryCacheKey(lsc.params.LogStream, cmd.queryLogs, lsc.params.Clock.Now())
+	if !ok {
+		return false
+	}
+
+	resp, ok := lsc.params.QueryCache.Get(key)
+	if !ok {
+		return false
+	}
+
+	lsc.params.Logger.Verbose1f("Using the cached query results")
+
+	// The labels map is shared by all the messages; see LogMsg.Labels.
+	if labels := lsc.params.LogStream.Labels; len(labels) > 0 {
+		for i := range resp.Logs {
+			resp.Logs[i].Labels = labels
+		}
+	}
+
+	lsc.sendCmdRespTo(&lstreamCmdCtx{cmd: cmd}, resp, nil)
+
+	return true
+}
+
+// storeInQueryCache stores the results of the query in the QueryCache, if
+// they can be cached.
+func (lsc *LStreamClient) storeInQueryCache(q *lstreamCmdQueryLogs, resp *LogResp) {
+	if lsc.params.QueryCache == nil {
+		return
+	}
+
+	// The results might be incomplete, so the next time the query should
+	// run on the host again.
+	if len(resp.RotatedLogfiles) > 0 {
+		return
+	}
+
+	key, ok := queryCacheKey(lsc.params.LogStream, q, lsc.params.Clock.Now())
+	if !ok {
+		return
+	}
+
+	// A failure to cache is not a big deal: the next time, we'll just query
+	// the host again.
+	if err := lsc.params.QueryCache.Set(key, resp); err != nil {
+		lsc.params.Logger.Errorf("Failed to cache query results: %s", err.Error())
+	}
+}
+
+// newMetricsCountingReader wraps the reader from the logstream's shell, so
+// that the bytes read from it are reported to the metrics.
+func (lsc *LStreamClient) newMetricsCountingReader(r io.Reader) io.Reader {
+	return newMetricsCountingReader(r, lsc.params.Metrics, lstreamMetricLabels(lsc.params.LogStream.Name))
+}
+
+// writeCmd writes the command to the shell's stdin.
+func (lsc *LStreamClient) writeCmd(stdinBuf io.Writer, cmdCtx *lstreamCmdCtx) {
 	switch {
 	case cmdCtx.cmd.bootstrap != nil:
 		lsc.params.Logger.Verbose3f("Starting command: bootstrap %+v", cmdCtx.cmd.bootstrap)
 
 		cmdCtx.bootstrapCtx = &lstreamCmdCtxBootstrap{}
 
-		stdinBuf := lsc.conn.conn.Stdin()
-
 		stdinBuf.Write([]byte("echo reset_output\n"))
 		stdinBuf.Write([]byte("echo reset_output 1>&2\n"))
 
@@ -1028,6 +2164,13 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 		// for localhost, it's not; so setting it explicitly.
 		stdinBuf.Write([]byte("cd\n"))
 
+		// Make the output of the tools used by the agent independent of the
+		// host's locale. It's done before the init commands, so that they can
+		// still override it if needed.
+		if cmd := localeCmd(lsc.params.LogStream.Options.Locale); cmd != "" {
+			stdinBuf.Write([]byte(cmd + "\n"))
+		}
+
 		// Execute whatever arbitrary init commands.
 		for _, cmd := range lsc.params.LogStream.Options.ShellInit {
 			lsc.params.Logger.Verbose3f("Running shell init command: %s", cmd)
@@ -1035,146 +2178,428 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			stdinBuf.Write([]byte("\n"))
 		}
 
+		// Check whether we can compress the query output as configured.
+		lsc.wireCompression = lsc.params.LogStream.Options.WireCompression
+		if lsc.wireCompression == "" {
+			lsc.wireCompression = WireCompressionGzip
+		}
+
+		if lsc.wireCompression != WireCompressionNone {
+			if err := lsc.wireCompression.checkLocalDecompressor(); err != nil {
+				cmdCtx.bootstrapCtx.warnWireCompression = err.Error()
+			} else {
+				stdinBuf.Write([]byte(lsc.wireCompression.probeCmd() + "\n"))
+			}
+		}
+
+		// Check whether the host is busybox-based, so that the rest of the
+		// commands can be adjusted accordingly.
+		stdinBuf.Write([]byte(busyboxProbeCmd + "\n"))
+
 		stdinBuf.Write([]byte("("))
 
 		stdinBuf.Write([]byte("  cat <<- 'EOF' > " + lsc.getLStreamNerdlogAgentPath() + "\n" + nerdlogAgentSh + "EOF\n"))
+		stdinBuf.Write([]byte("  if [ $? -ne 0 ]; then echo '" + agentUploadFailedMarker + "'; echo 'bootstrap failed'; exit 1; fi\n"))
+
+		customAgent := lsc.params.LogStream.Options.CustomAgent
+		if customAgent != "" {
+			stdinBuf.Write([]byte(customAgentScriptUpload(customAgent, lsc.getLStreamCustomAgentPath())))
+			stdinBuf.Write([]byte("  if [ $? -ne 0 ]; then echo '" + agentUploadFailedMarker + "'; echo 'bootstrap failed'; exit 1; fi\n"))
+		}
+
+		// Extract the archive entry, if needed, so that the agent reads it as a
+		// regular log file.
+		if archive := lsc.params.LogStream.Archive; archive != nil {
+			stdinBuf.Write([]byte(logArchiveExtractCmd(
+				*archive,
+				lsc.params.LogStream.LogFileLast(),
+				lsc.getLStreamIndexFilePath(),
+				lsc.params.LogStream.Options.SudoMode,
+			)))
+		}
+
+		// The agent needs bash, which the busybox-based hosts often don't have,
+		// so fail early with a clear error.
+		stdinBuf.Write([]byte("  " + busyboxBashCheckCmd + "\n"))
+
+		var parts []string
+
+		// If requested, run the whole thing with "sudo -n".
+		if lsc.params.LogStream.Options.SudoMode == SudoModeFull {
+			parts = append(parts, "sudo", "-n")
+		}
+
+		parts = append(parts, lsc.getTimeEnvVars()...)
+		parts = append(parts, lowPriorityCmdParts(lsc.params.LogStream.Options.LowPriorityWrappers)...)
+		parts = append(parts, agentWrapperCmdParts(lsc.params.LogStream.Options.AgentWrapper)...)
+
+		parts = append(
+			parts,
+			"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
+			"logstream_info",
+			"--logfile-last", shellQuote(lsc.params.LogStream.LogFileLast()),
+			// We don't know yet whether the host is busybox-based, so let the
+			// shell add the flag as per the busyboxProbeCmd above.
+			"${"+busyboxShellVar+":+--busybox}",
+		)
+
+		if logFilePrev, ok := lsc.params.LogStream.LogFilePrev(); ok {
+			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
+		}
+
+		if customAgent != "" {
+			parts = append(parts, "--custom-agent", shellQuote(lsc.getLStreamCustomAgentPath()))
+		}
+
+		if lsc.params.CapabilitiesCache != nil {
+			// Print the host version, and if it matches the one we have cached
+			// capabilities for, skip the probes.
+			stdinBuf.Write([]byte("  echo \"" + hostVersionPrefix + "$(" + hostVersionCmd + ")\"\n"))
+
+			caps, ok := lsc.params.CapabilitiesCache.Get(capabilitiesCacheKey(lsc.params.LogStream))
+			if ok {
+				cmdCtx.bootstrapCtx.cachedCaps = &caps
+				parts = []string{
+					"if [ \"$(" + hostVersionCmd + ")\" = " + shellQuote(caps.HostVersion) + " ];",
+					"then echo '" + capabilitiesCachedMarker + "';",
+					"else", strings.Join(parts, " ") + ";",
+					"fi",
+				}
+			}
+		}
+
+		stdinBuf.Write([]byte(strings.Join(parts, " ") + "\n"))
 		stdinBuf.Write([]byte("  if [ $? -ne 0 ]; then echo 'bootstrap failed'; exit 1; fi\n"))
 
-		var parts []string
+		// Print the remote time, so we can check how much the remote clock
+		// differs from the local one.
+		stdinBuf.Write([]byte("  echo \"" + hostTimePrefix + "$(date +%s)\"\n"))
+
+		stdinBuf.Write([]byte("  echo 'bootstrap ok'\n"))
+		stdinBuf.Write([]byte(")\n"))
+		stdinBuf.Write([]byte("echo exit_code:$?\n"))
+
+	case cmdCtx.cmd.ping != nil:
+		lsc.params.Logger.Verbose3f("Starting command: ping %+v", cmdCtx.cmd.ping)
+		cmdCtx.pingCtx = &lstreamCmdCtxPing{}
+
+		cmd := "whoami\n"
+		stdinBuf.Write([]byte(cmd))
+		stdinBuf.Write([]byte("echo exit_code:$?\n"))
+
+	case cmdCtx.cmd.verify != nil:
+		lsc.params.Logger.Verbose3f("Starting command: verify %+v", cmdCtx.cmd.verify)
+		cmdCtx.verifyCtx = &lstreamCmdCtxVerify{}
+
+		if lsc.params.LogStream.Options.CustomAgent != "" {
+			// There are no log files to check, and the custom agent has already
+			// run successfully during bootstrap, so consider the logs readable.
+			stdinBuf.Write([]byte("echo 'verify:readable:" + SpecialFilenameCustomAgent + "'\n"))
+			stdinBuf.Write([]byte("echo exit_code:0\n"))
+			break
+		}
+
+		// With multiple log sources, the files of every source are checked.
+		sources := lsc.params.LogStream.Sources
+		if len(sources) == 0 {
+			sources = []LogSource{{LogFiles: lsc.params.LogStream.LogFiles}}
+		}
+
+		for _, src := range sources {
+			var parts []string
+
+			parts = append(parts, lsc.getSudoCmdParts()...)
+			parts = append(parts, agentWrapperCmdParts(lsc.params.LogStream.Options.AgentWrapper)...)
+
+			parts = append(
+				parts,
+				"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
+				"verify",
+				"--logfile-last", shellQuote(src.LogFiles[0]),
+			)
+			parts = append(parts, agentBusyboxArgs(lsc.busybox)...)
+
+			if len(src.LogFiles) >= 2 {
+				parts = append(parts, "--logfile-prev", shellQuote(src.LogFiles[1]))
+			}
+
+			// NOTE: the exit code is printed by the agent's trap.
+			stdinBuf.Write([]byte(strings.Join(parts, " ") + "\n"))
+		}
+
+	case cmdCtx.cmd.adHoc != nil:
+		lsc.params.Logger.Verbose3f("Starting command: adHoc %+v", cmdCtx.cmd.adHoc)
+		cmdCtx.adHocCtx = &lstreamCmdCtxAdHoc{}
+
+		stdinBuf.Write([]byte(adHocCmdScript(cmdCtx.cmd.adHoc)))
+
+	case cmdCtx.cmd.queryLogs != nil:
+		lsc.params.Logger.Verbose3f("Starting command: queryLogs %+v", cmdCtx.cmd.queryLogs)
+		cmdCtx.queryLogsCtx = &lstreamCmdCtxQueryLogs{
+			Resp: &LogResp{
+				MinuteStats: map[int64]MinuteStatsItem{},
+			},
+			sourceTag: lsc.params.LogStream.SourceTag,
+		}
+
+		var parts []string
+
+		if lsc.wireCompression != WireCompressionNone {
+			parts = append(parts, "echo", compressedStartMarkerPrefix+string(lsc.wireCompression), ";")
+		}
+
+		var agentParts []string
+
+		switch {
+		case lsc.params.LogStream.Options.CustomAgent != "":
+			agentParts = append(agentParts, lsc.getSudoCmdParts()...)
+			agentParts = append(agentParts, lsc.getCustomAgentQueryCmdParts(cmdCtx)...)
+
+			// Unlike nerdlog_agent.sh, the custom agent doesn't print the
+			// "exit_code:" line itself, so we wrap it in a subshell which does.
+			agentParts = append([]string{"("}, agentParts...)
+			agentParts = append(agentParts, ";", `echo "exit_code:$?"`, ")")
+
+		case len(lsc.params.LogStream.Sources) > 0:
+			agentParts = append(agentParts, lsc.getSourcesQueryCmdParts(cmdCtx)...)
+
+		default:
+			agentParts = append(agentParts, lsc.getSudoCmdParts()...)
+			agentParts = append(agentParts, lsc.getAgentQueryCmdParts(cmdCtx, LogSource{
+				Tag:      lsc.params.LogStream.SourceTag,
+				LogFiles: lsc.params.LogStream.LogFiles,
+			})...)
+		}
+
+		// If configured, run the agent with the resource limits.
+		parts = append(parts, resourceLimitCmdParts(
+			lsc.params.LogStream.Options.CPULimitSeconds,
+			lsc.params.LogStream.Options.MemoryLimitKB,
+			agentParts,
+		)...)
+
+		if lsc.wireCompression != WireCompressionNone {
+			parts = append(parts, "|")
+			parts = append(parts, lsc.wireCompression.compressCmd()...)
+			parts = append(parts, ";", "echo", compressedEndMarker)
+		}
+
+		cmd := strings.Join(parts, " ") + "\n"
+		lsc.params.Logger.Verbose2f("Executing query command(%s): %s", lsc.params.LogStream.Name, cmd)
+
+		if cmdCtx.session == nil {
+			// On the main session, the query runs in the background, so that we
+			// can stop it without breaking the connection; the command_done
+			// lines are printed by the background job itself.
+			stdinBuf.Write([]byte(backgroundQueryCmd(cmd, cmdCtx.idx, lsc.busybox)))
+			return
+		}
+
+		stdinBuf.Write([]byte(cmd))
+
+		// NOTE: we don't print the "exit_code:" here, because we can't reliably
+		// do that across all possible shells, due to compression: the agent script
+		// is not the last one in the pipeline.
+		//
+		// Instead, the agent script itself has a trap which prints this line for
+		// us.
+
+	default:
+		panic(fmt.Sprintf("invalid command %+v", cmdCtx.cmd))
+	}
+
+	stdinBuf.Write([]byte(commandDoneCmds(cmdCtx.idx, lsc.busybox)))
+}
+
+// commandDoneCmds returns the shell commands which print the "command_done:"
+// line with the given command idx to both stdout and stderr, so that we know
+// that the command is done.
+func commandDoneCmds(idx int, busybox bool) string {
+	marker := fmt.Sprintf("'command_done:%d'", idx)
+	return markerCmd(marker, busybox) + "\n" + markerCmd(marker, busybox) + " 1>&2\n"
+}
+
+// getSudoCmdParts returns the "sudo -n" to run the agent with, if requested.
+func (lsc *LStreamClient) getSudoCmdParts() []string {
+	if lsc.params.LogStream.Options.SudoMode != SudoModeFull {
+		return nil
+	}
+
+	return []string{"sudo", "-n"}
+}
+
+// getAgentQueryCmdParts returns the nerdlog_agent.sh query command for the
+// given queryLogs command, reading the log files of the given source (for the
+// logstreams without LogStream.Sources, it's the logstream itself); sudo and
+// resource limits are added by the caller.
+func (lsc *LStreamClient) getAgentQueryCmdParts(cmdCtx *lstreamCmdCtx, src LogSource) []string {
+	var agentParts []string
 
-		// If requested, run the whole thing with "sudo -n".
-		if lsc.params.LogStream.Options.SudoMode == SudoModeFull {
-			parts = append(parts, "sudo", "-n")
-		}
+	fieldsCfg := lsc.getSourceFilterFieldsConfig(src.Tag)
 
-		parts = append(parts, lsc.getTimeEnvVars()...)
+	linesUntil := cmdCtx.cmd.queryLogs.linesUntil
+	if len(lsc.params.LogStream.Sources) > 0 {
+		linesUntil = cmdCtx.cmd.queryLogs.sourceLinesUntil[src.Tag]
+	}
 
-		parts = append(
-			parts,
-			"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
-			"logstream_info",
-			"--logfile-last", shellQuote(lsc.params.LogStream.LogFileLast()),
-		)
+	agentParts = append(agentParts, lsc.getTimeEnvVars()...)
+	agentParts = append(agentParts, agentEnvCmdParts(cmdCtx.cmd.queryLogs.agentEnv)...)
+	agentParts = append(agentParts, lowPriorityCmdParts(lsc.params.LogStream.Options.LowPriorityWrappers)...)
+	agentParts = append(agentParts, agentWrapperCmdParts(lsc.params.LogStream.Options.AgentWrapper)...)
+
+	agentParts = append(
+		agentParts,
+		"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
+		"query",
+		"--index-file", shellQuote(lsc.getIndexFilePath(src.LogFiles[0])),
+		"--max-num-lines", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.maxNumLines)),
+		"--logfile-last", shellQuote(src.LogFiles[0]),
+	)
+	agentParts = append(agentParts, agentBusyboxArgs(lsc.busybox)...)
 
-		if logFilePrev, ok := lsc.params.LogStream.LogFilePrev(); ok {
-			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
-		}
+	if len(src.LogFiles) >= 2 {
+		agentParts = append(agentParts, "--logfile-prev", shellQuote(src.LogFiles[1]))
+	}
 
-		stdinBuf.Write([]byte(strings.Join(parts, " ") + "\n"))
-		stdinBuf.Write([]byte("  if [ $? -ne 0 ]; then echo 'bootstrap failed'; exit 1; fi\n"))
+	if !cmdCtx.cmd.queryLogs.from.IsZero() {
+		agentParts = append(agentParts, "--from", shellQuote(cmdCtx.cmd.queryLogs.from.In(lsc.location).Format(queryLogsArgsTimeLayout)))
+	}
 
-		stdinBuf.Write([]byte("  echo 'bootstrap ok'\n"))
-		stdinBuf.Write([]byte(")\n"))
-		stdinBuf.Write([]byte("echo exit_code:$?\n"))
+	if !cmdCtx.cmd.queryLogs.to.IsZero() {
+		agentParts = append(agentParts, "--to", shellQuote(cmdCtx.cmd.queryLogs.to.In(lsc.location).Format(queryLogsArgsTimeLayout)))
+	}
 
-	case cmdCtx.cmd.ping != nil:
-		lsc.params.Logger.Verbose3f("Starting command: ping %+v", cmdCtx.cmd.ping)
-		cmdCtx.pingCtx = &lstreamCmdCtxPing{}
+	if linesUntil > 0 {
+		agentParts = append(agentParts, "--lines-until", shellQuote(strconv.Itoa(linesUntil)))
+	}
 
-		cmd := "whoami\n"
-		stdinBuf := lsc.conn.conn.Stdin()
-		stdinBuf.Write([]byte(cmd))
-		stdinBuf.Write([]byte("echo exit_code:$?\n"))
+	if tu := cmdCtx.cmd.queryLogs.timestampUntil; tu != nil {
+		nextWholeSecondTime := roundUpToNextSecond(tu.time)
 
-	case cmdCtx.cmd.queryLogs != nil:
-		lsc.params.Logger.Verbose3f("Starting command: queryLogs %+v", cmdCtx.cmd.queryLogs)
-		cmdCtx.queryLogsCtx = &lstreamCmdCtxQueryLogs{
-			Resp: &LogResp{
-				MinuteStats: map[int64]MinuteStatsItem{},
-			},
-		}
+		agentParts = append(agentParts,
+			"--timestamp-until-seconds",
+			shellQuote(
+				nextWholeSecondTime.In(lsc.location).Format(queryLogsTimestampUntilSecondsTimeLayout),
+			),
 
-		var parts []string
+			"--timestamp-until-precise",
+			shellQuote(
+				tu.time.In(lsc.location).Format(queryLogsTimestampUntilPreciseTimeLayout),
+			),
 
-		if useGzip {
-			parts = append(parts, "echo", gzipStartMarker, ";")
-		}
+			"--skip-n-latest", shellQuote(strconv.Itoa(tu.numMsgs)),
+		)
+	}
 
-		// If requested, run the whole thing with "sudo -n".
-		if lsc.params.LogStream.Options.SudoMode == SudoModeFull {
-			parts = append(parts, "sudo", "-n")
-		}
+	if cmdCtx.cmd.queryLogs.refreshIndex {
+		agentParts = append(agentParts, "--refresh-index")
+	}
 
-		parts = append(parts, lsc.getTimeEnvVars()...)
+	// The transports like http-ndjson only emulate the agent, and always
+	// return all the logs, so they don't support sampling.
+	if rate := cmdCtx.cmd.queryLogs.sampleRate; rate > 1 && lsc.params.LogStream.Transport.EmulatedAgent() == "" {
+		agentParts = append(agentParts, "--sample-rate", shellQuote(strconv.Itoa(rate)))
+		cmdCtx.queryLogsCtx.Resp.SampleRate = rate
+	}
 
-		parts = append(
-			parts,
-			"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
-			"query",
-			"--index-file", shellQuote(lsc.getLStreamIndexFilePath()),
-			"--max-num-lines", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.maxNumLines)),
-			"--logfile-last", shellQuote(lsc.params.LogStream.LogFileLast()),
-		)
+	if n := cmdCtx.cmd.queryLogs.statsBucketMinutes; n > 1 && lsc.params.LogStream.Transport.EmulatedAgent() == "" {
+		agentParts = append(agentParts, "--stats-bucket-minutes", shellQuote(strconv.Itoa(n)))
+	}
 
-		if logFilePrev, ok := lsc.params.LogStream.LogFilePrev(); ok {
-			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
-		}
+	if cmdCtx.cmd.queryLogs.aggregateOnly {
+		agentParts = append(agentParts, "--aggregate-only")
+	}
 
-		if !cmdCtx.cmd.queryLogs.from.IsZero() {
-			parts = append(parts, "--from", shellQuote(cmdCtx.cmd.queryLogs.from.In(lsc.location).Format(queryLogsArgsTimeLayout)))
-		}
+	// The transports which only emulate the agent return the latest
+	// --max-num-lines logs anyway, since there's no time range.
+	if n := cmdCtx.cmd.queryLogs.tailNumLines; n > 0 && lsc.params.LogStream.Transport.EmulatedAgent() == "" {
+		agentParts = append(agentParts, "--tail-lines", shellQuote(strconv.Itoa(n)))
+	}
 
-		if !cmdCtx.cmd.queryLogs.to.IsZero() {
-			parts = append(parts, "--to", shellQuote(cmdCtx.cmd.queryLogs.to.In(lsc.location).Format(queryLogsArgsTimeLayout)))
+	if pinLast := cmdCtx.cmd.queryLogs.pinLast; pinLast != "" {
+		if reason := pinUnsupportedReason(lsc.params.LogStream); reason != "" {
+			cmdCtx.queryLogsCtx.pinWarning = fmt.Sprintf(
+				"pinning is not supported by %s, so the logs are read live", reason,
+			)
+		} else {
+			agentParts = append(agentParts, "--pin-last", shellQuote(pinLast))
 		}
+	}
 
-		if cmdCtx.cmd.queryLogs.linesUntil > 0 {
-			parts = append(parts, "--lines-until", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.linesUntil)))
-		}
+	agentParts = append(agentParts, agentQueryTimeFormatArgs(&lsc.timeFormat.AWKExpr)...)
 
-		if tu := cmdCtx.cmd.queryLogs.timestampUntil; tu != nil {
-			nextWholeSecondTime := roundUpToNextSecond(tu.time)
+	if ml := lsc.multiline; ml != nil {
+		agentParts = append(agentParts, "--multiline-continuation", shellQuote(ml.continuationAWKCond(lsc.timeFormat)))
+	}
 
-			parts = append(parts,
-				"--timestamp-until-seconds",
-				shellQuote(
-					nextWholeSecondTime.In(lsc.location).Format(queryLogsTimestampUntilSecondsTimeLayout),
-				),
+	// Both the named regex captures and the positional fields are extracted by
+	// the same captures code.
+	var capturesCodes []string
 
-				"--timestamp-until-precise",
-				shellQuote(
-					tu.time.In(lsc.location).Format(queryLogsTimestampUntilPreciseTimeLayout),
-				),
+	query := cmdCtx.cmd.queryLogs.query
+	if filter := cmdCtx.cmd.queryLogs.filter; filter != nil {
+		query = CompileFilterQueryToAWK(
+			filter, fieldsCfg, cmdCtx.cmd.queryLogs.filterMatchOpts,
+		)
 
-				"--skip-n-latest", shellQuote(strconv.Itoa(tu.numMsgs)),
-			)
+		if capturesCode := CompileFilterCapturesToAWK(filter); capturesCode != "" {
+			capturesCodes = append(capturesCodes, capturesCode)
 		}
+	}
 
-		if cmdCtx.cmd.queryLogs.refreshIndex {
-			parts = append(parts, "--refresh-index")
-		}
+	if fe := lsc.fieldExtractor; fe != nil {
+		capturesCodes = append(capturesCodes, CompileFieldExtractorToAWK(fe))
+	}
 
-		parts = append(parts, agentQueryTimeFormatArgs(&lsc.timeFormat.AWKExpr)...)
+	query = correlatedQuery(query, cmdCtx.cmd.queryLogs.correlation, fieldsCfg)
 
-		if cmdCtx.cmd.queryLogs.query != "" {
-			parts = append(parts, shellQuote(cmdCtx.cmd.queryLogs.query))
-		}
+	if len(capturesCodes) > 0 {
+		agentParts = append(agentParts, "--captures-code", shellQuote(strings.Join(capturesCodes, " ")))
+	}
 
-		if useGzip {
-			parts = append(parts, "|", "gzip", ";", "echo", gzipEndMarker)
-		}
+	if projection := cmdCtx.cmd.queryLogs.projection; projection != nil {
+		projectionCode := CompileProjectionToAWK(projection, fieldsCfg)
+		agentParts = append(agentParts, "--projection-code", shellQuote(projectionCode))
+	}
 
-		cmd := strings.Join(parts, " ") + "\n"
-		lsc.params.Logger.Verbose2f("Executing query command(%s): %s", lsc.params.LogStream.Name, cmd)
+	if groupBy := cmdCtx.cmd.queryLogs.groupBy; groupBy != nil && groupByUnsupportedReason(lsc.params.LogStream) == "" {
+		groupCode := CompileGroupByToAWK(*groupBy, fieldsCfg)
+		agentParts = append(agentParts, "--group-code", shellQuote(groupCode))
+		cmdCtx.queryLogsCtx.Resp.Groups = map[string]int{}
+	}
 
-		lsc.conn.conn.Stdin().Write([]byte(cmd))
+	if query != "" {
+		agentParts = append(agentParts, shellQuote(query))
+	}
 
-		// NOTE: we don't print the "exit_code:" here, because we can't reliably
-		// do that across all possible shells, due to gzipping: the agent script
-		// is not the last one in the pipeline.
-		//
-		// Instead, the agent script itself has a trap which prints this line for
-		// us.
+	return agentParts
+}
 
-	default:
-		panic(fmt.Sprintf("invalid command %+v", cmdCtx.cmd))
+// getCustomAgentQueryCmdParts is like getAgentQueryCmdParts, but for the
+// custom agent; see SpecialFilenameCustomAgent for the details on how it's
+// called.
+func (lsc *LStreamClient) getCustomAgentQueryCmdParts(cmdCtx *lstreamCmdCtx) []string {
+	ql := cmdCtx.cmd.queryLogs
+
+	// The custom agent doesn't print the "logfile:" lines, since there are no
+	// log files; all the logs are addressed by timestamps.
+	cmdCtx.queryLogsCtx.logfiles = []logfileWithStartingLinenumber{
+		{filename: SpecialFilenameCustomAgent},
 	}
 
-	stdinBuf := lsc.conn.conn.Stdin()
-	stdinBuf.Write([]byte(fmt.Sprintf("echo 'command_done:%d'\n", cmdCtx.idx)))
-	stdinBuf.Write([]byte(fmt.Sprintf("echo 'command_done:%d' 1>&2\n", cmdCtx.idx)))
+	filter := ql.query
+	if ql.filter != nil {
+		filter = CompileFilterQueryToAWK(ql.filter, lsc.getFilterFieldsConfig(), ql.filterMatchOpts)
+	}
+	filter = correlatedQuery(filter, ql.correlation, lsc.getFilterFieldsConfig())
 
-	lsc.changeState(LStreamClientStateConnectedBusy)
+	parts := customAgentEnvVars(ql, filter)
+	parts = append(parts, agentEnvCmdParts(ql.agentEnv)...)
+	parts = append(parts, lowPriorityCmdParts(lsc.params.LogStream.Options.LowPriorityWrappers)...)
+	parts = append(parts, agentWrapperCmdParts(lsc.params.LogStream.Options.AgentWrapper)...)
+	parts = append(parts, "bash", shellQuote(lsc.getLStreamCustomAgentPath()))
+
+	return parts
 }
 
 // getTimeEnvVars is a helper to get time-related env vars to be passed to the
@@ -1211,13 +2636,30 @@ func (lsc *LStreamClient) getLStreamNerdlogAgentPath() string {
 	)
 }
 
+// getLStreamCustomAgentPath returns the logstream-side path to the custom
+// agent script; see LogStreamOptions.CustomAgent.
+func (lsc *LStreamClient) getLStreamCustomAgentPath() string {
+	return fmt.Sprintf(
+		"/tmp/nerdlog_custom_agent_%s_%s.sh",
+		lsc.params.ClientID,
+		filepathToId(lsc.params.LogStream.Name),
+	)
+}
+
 // getLStreamIndexFilePath returns the logstream-side path to the index file for
 // the particular log stream.
 func (lsc *LStreamClient) getLStreamIndexFilePath() string {
+	return lsc.getIndexFilePath(lsc.params.LogStream.LogFileLast())
+}
+
+// getIndexFilePath returns the logstream-side path to the index file for the
+// given latest log file; with multiple log sources, every one of them has its
+// own index.
+func (lsc *LStreamClient) getIndexFilePath(logFileLast string) string {
 	return fmt.Sprintf(
 		"/tmp/nerdlog_agent_index_%s_%s",
 		lsc.params.ClientID,
-		filepathToId(lsc.params.LogStream.LogFileLast()),
+		filepathToId(logFileLast),
 	)
 }
 
@@ -1236,7 +2678,7 @@ func (lsc *LStreamClient) checkIfDisconnected() {
 
 		if lsc.tearingDown {
 			close(lsc.disconnectedBeforeTeardownCh)
-		} else {
+		} else if !lsc.parked {
 			lsc.changeState(LStreamClientStateConnecting)
 		}
 	}
@@ -1288,8 +2730,16 @@ func (lsc *LStreamClient) checkExitCode(
 		return false
 	}
 
-	cmdCtx.exitCode = strings.TrimPrefix(line, "exit_code:")
-	lsc.params.Logger.Verbose1f("Received exit code: %q", cmdCtx.exitCode)
+	exitCode := strings.TrimPrefix(line, "exit_code:")
+	lsc.params.Logger.Verbose1f("Received exit code: %q", exitCode)
+
+	// With multiple log sources, the agent runs once per source, and if any of
+	// the runs fails, the whole query fails.
+	if len(lsc.params.LogStream.Sources) > 0 && cmdCtx.exitCode != "" && cmdCtx.exitCode != "0" {
+		return true
+	}
+
+	cmdCtx.exitCode = exitCode
 	return true
 }
 
@@ -1333,8 +2783,59 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 				})
 			}
 
+			// If the remote clock is too far off, the logs will be in the wrong
+			// places on the timeline, so warn the user about that.
+			if isClockSkewTooLarge(lsc.clockSkew) {
+				lsc.params.Logger.Warnf(
+					"%s", FormatClockSkew(lsc.params.LogStream.Name, lsc.clockSkew),
+				)
+				lsc.sendUpdate(&LStreamClientUpdate{
+					BootstrapDetails: &BootstrapDetails{
+						WarnClockSkew: lsc.clockSkew,
+					},
+				})
+			}
+
+			lsc.busybox = cmdCtx.bootstrapCtx.busybox
+
+			// If the configured compression can't be used, fall back to no
+			// compression, and warn the user about that.
+			warnWireCompression := cmdCtx.bootstrapCtx.warnWireCompression
+			if warnWireCompression == "" && lsc.wireCompression != WireCompressionNone && !cmdCtx.bootstrapCtx.wireCompressionOK {
+				warnWireCompression = fmt.Sprintf("%s is not available on the host", lsc.wireCompression.compressCmd()[0])
+			}
+
+			if warnWireCompression != "" {
+				warnWireCompression = fmt.Sprintf("%s, falling back to no wire compression", warnWireCompression)
+				lsc.params.Logger.Warnf("%s: %s", lsc.params.LogStream.Name, warnWireCompression)
+				lsc.wireCompression = WireCompressionNone
+				lsc.sendUpdate(&LStreamClientUpdate{
+					BootstrapDetails: &BootstrapDetails{
+						WarnWireCompression: warnWireCompression,
+					},
+				})
+			}
+
 			// Let's now try to autodetect the envelope log format.
-			timeFormat, err := GetTimeFormatDescrFromLogLines(lsc.exampleLogLines)
+			var timeFormat *TimeFormatDescr
+			var err error
+			if jl := lsc.params.LogStream.Options.JSON; jl != nil {
+				timeFormat, lsc.jsonTimestampField, err = GetJSONTimeFormatDescr(lsc.exampleLogLines, jl)
+			} else if fd := lsc.params.LogStream.Options.FilenameDate; fd != nil {
+				timeFormat, err = GetFilenameDateTimeFormatDescr(lsc.exampleLogLines, fd)
+			} else {
+				timeFormat, err = GetTimeFormatDescrFromLogLines(lsc.exampleLogLines)
+			}
+			if err == nil {
+				// The hosts which didn't report the awk dialect (e.g. the cached
+				// capabilities are from an older version) run the agent, so gawk.
+				awkDialect := cmdCtx.bootstrapCtx.awkDialect
+				if awkDialect == "" {
+					awkDialect = AWKDialectDefault
+				}
+
+				err = lsc.setAWKDialect(awkDialect)
+			}
 			if err != nil {
 				cmdCtx.errs = append(cmdCtx.errs, err)
 			} else {
@@ -1345,6 +2846,10 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 					timeFormat.TimestampLayout,
 				)
 				lsc.timeFormat = timeFormat
+				lsc.cacheCapabilities(cmdCtx.bootstrapCtx)
+				lsc.sendUpdate(&LStreamClientUpdate{
+					AWKDialect: lsc.awkDialect,
+				})
 				lsc.changeState(LStreamClientStateConnectedIdle)
 				return
 			}
@@ -1365,23 +2870,134 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 			)
 		}
 
+		errCategory := ConnErrCategoryBootstrap
+		if cmdCtx.bootstrapCtx.agentUploadFailed {
+			errCategory = ConnErrCategoryAgentMissing
+			err = classifyErr(errCategory, err)
+		}
+
+		lsc.params.Metrics.AddCounter(MetricConnectionsFailed, MetricLabels{
+			"lstream": lsc.params.LogStream.Name,
+			"reason":  string(errCategory),
+		}, 1)
+
 		lsc.sendUpdate(&LStreamClientUpdate{
 			BootstrapDetails: &BootstrapDetails{
-				Err: err.Error(),
+				Err:         err.Error(),
+				ErrCategory: errCategory,
 			},
 		})
 
+		// The bootstrap checks the log files too, so if it's the reason of the
+		// failure, let the pending verify commands know.
+		lsc.failPendingCmds(verifyResultFromBootstrapErr(err.Error()), err)
+
 		lsc.changeState(LStreamClientStateDisconnected)
 
 	case cmdCtx.cmd.ping != nil:
 		lsc.sendCmdResp(nil, nil)
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
+	case cmdCtx.cmd.verify != nil:
+		if err := summaryCmdError(cmdCtx); err != nil {
+			lsc.sendCmdResp(nil, err)
+		} else {
+			lsc.sendCmdResp(combineVerifyResults(cmdCtx.verifyCtx.results), nil)
+		}
+
+		lsc.changeState(LStreamClientStateConnectedIdle)
+
+	case cmdCtx.cmd.adHoc != nil:
+		if err := summaryCmdError(cmdCtx); err != nil {
+			lsc.sendCmdResp(nil, err)
+		} else {
+			output, err := cmdCtx.adHocCtx.result(cmdCtx.cmd.adHoc)
+			lsc.sendCmdResp(output, err)
+		}
+
+		lsc.changeState(LStreamClientStateConnectedIdle)
+
 	case cmdCtx.cmd.queryLogs != nil:
+		if cmdCtx.queryLogsCtx.stopped {
+			lsc.sendCmdRespTo(cmdCtx, &LogResp{}, ErrQueryStopped)
+			lsc.changeState(LStreamClientStateConnectedIdle)
+			return
+		}
+
 		resp := cmdCtx.queryLogsCtx.Resp
+		if lsc.params.LogStream.Options.CustomAgent != "" {
+			lsc.finalizeCustomAgentResp(cmdCtx.cmd.queryLogs, resp)
+		}
+
+		if len(lsc.params.LogStream.Sources) > 0 {
+			resp.Logs = mergeSourceLogs(resp.Logs, cmdCtx.cmd.queryLogs.maxNumLines)
+		}
+
 		resp.DebugInfo.AgentStdout = cmdCtx.unhandledStdout
 		resp.DebugInfo.AgentStderr = cmdCtx.unhandledStderr
-		lsc.sendCmdResp(resp, summaryCmdError(cmdCtx))
+		resp.Warnings = getAgentWarnings(cmdCtx.unhandledStderr)
+
+		for _, logfile := range resp.RotatedLogfiles {
+			resp.Warnings = append(resp.Warnings, fmt.Sprintf(
+				"log %s rotated during the query; results may be incomplete, re-run recommended", logfile,
+			))
+		}
+
+		if w := cmdCtx.queryLogsCtx.pinWarning; w != "" {
+			resp.Warnings = append(resp.Warnings, w)
+		}
+
+		// The custom agents might not support that, so the logs are
+		// dropped here too.
+		if cmdCtx.cmd.queryLogs.aggregateOnly {
+			resp.Logs = nil
+		}
+
+		if groupBy := cmdCtx.cmd.queryLogs.groupBy; groupBy != nil && resp.Groups == nil {
+			if reason := groupByUnsupportedReason(lsc.params.LogStream); reason != "" {
+				resp.Warnings = append(resp.Warnings, fmt.Sprintf(
+					"grouping by %s is not supported by %s, so the logs are not counted in the groups",
+					groupBy, reason,
+				))
+			}
+		}
+
+		err := summaryCmdError(cmdCtx)
+		if err != nil && isResourceLimitExit(
+			lsc.params.LogStream.Options.CPULimitSeconds,
+			lsc.params.LogStream.Options.MemoryLimitKB,
+			cmdCtx.exitCode,
+			cmdCtx.unhandledStderr,
+		) {
+			lsc.params.Logger.Errorf("Query exceeded resource limits: %s", err.Error())
+			err = &ResourceLimitError{LStreamName: lsc.params.LogStream.Name}
+		} else if err != nil && cmdCtx.queryLogsCtx.awkFailure != nil {
+			lsc.params.Logger.Errorf("Query awk failed: %s", err.Error())
+			err = newAWKError(
+				lsc.params.LogStream.Name, cmdCtx.queryLogsCtx.awkFailure, cmdCtx.unhandledStderr,
+			)
+		} else if err != nil && isAgentMissingExit(
+			lsc.getLStreamNerdlogAgentPath(), cmdCtx.exitCode, cmdCtx.unhandledStderr,
+		) {
+			err = classifyErr(ConnErrCategoryAgentMissing, err)
+		}
+
+		recordQueryMetrics(
+			lsc.params.Metrics, lsc.params.LogStream.Name,
+			cmdCtx.startTime, lsc.params.Clock.Now(), err,
+		)
+
+		if err == nil {
+			lsc.storeInQueryCache(cmdCtx.cmd.queryLogs, resp)
+		}
+
+		lsc.sendCmdRespTo(cmdCtx, resp, err)
+
+		if cmdCtx.session != nil {
+			lsc.closeQuerySession(cmdCtx.session)
+			return
+		}
+
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
 	default:
@@ -1389,32 +3005,37 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 	}
 }
 
-// InferYear infers year from the month of the given timestamp, and the current
-// time. Resulting timestamp (with the year populated) is then returned.
+// InferYear infers the year of the timestamp which doesn't have it (like in
+// the traditional syslog format "Jan 15 10:00:00"), based on the current time.
+// Resulting timestamp (with the year populated) is then returned.
 //
-// Most of the time it just uses the current year, but on the year boundary
-// it can return previous or next year.
+// The year is chosen so that the timestamp is at most one month ahead of the
+// current time: so the current month, the next one (to tolerate the clock
+// and timezone differences), and the 10 months before the current one, get
+// the current year, adjusted on the year boundary: if it's December now, then
+// January is the next year. The rest of the months are the previous year. For
+// example, if it's March now, then "Apr 1" is this year, while "May 1" and
+// "Dec 31" are the previous year.
+//
+// This way, the year only depends on the month and the current time, so
+// it's deterministic, and the logs which span less than 11 months (e.g.
+// across the new year) always get the increasing timestamps. The
+// nerdlog_agent.sh infers the year in exactly the same way.
 func InferYear(now, t time.Time) time.Time {
-	// If month of the syslog being parsed is the same as the current month, just
-	// use the current year.
-	if now.Month() == t.Month() {
-		return timeWithYear(t, now.Year())
-	}
+	delta := int(t.Month()) - int(now.Month())
 
-	// Month of the syslog is different from the current month, so we need to
-	// have logic for the boundary of the year.
+	switch {
+	case delta <= -11:
+		// We're in December now, and we're parsing some logs from January,
+		// which is next month.
+		return timeWithYear(t, now.Year()+1)
 
-	if t.Month() == time.December && now.Month() == time.January {
-		// We're in January now and we're parsing some logs from December.
+	case delta >= 2:
+		// The month is at least two months ahead, so it must be the previous
+		// year; e.g. we're in January now and parsing some logs from December.
 		return timeWithYear(t, now.Year()-1)
-	} else if t.Month() == time.January && now.Month() == time.December {
-		// We're in December now and we're parsing some logs from January.
-		// It's weird to get timestamp from the future, but better to have a case
-		// for that.
-		return timeWithYear(t, now.Year()+1)
 	}
 
-	// For all other cases, still use the current year.
 	return timeWithYear(t, now.Year())
 }
 
@@ -1447,6 +3068,10 @@ type parseLineResult struct {
 }
 
 func (lsc *LStreamClient) parseLine(logMsg *LogMsg) error {
+	if lsc.params.LogStream.Options.JSON != nil {
+		return lsc.parseJSONLine(logMsg)
+	}
+
 	if err := lsc.parseLogMsgTimestamp(logMsg); err != nil {
 		return errors.Annotatef(err, "parsing time")
 	}
@@ -1458,7 +3083,7 @@ func (lsc *LStreamClient) parseLine(logMsg *LogMsg) error {
 	}
 
 	// TODO: offload the custom parsing to Lua
-	if err := lsc.parseLogMsgLevelDefault(logMsg); err != nil {
+	if err := lsc.parseLogMsgLevel(logMsg); err != nil {
 		return errors.Annotatef(err, "custom parsing")
 	}
 
@@ -1467,9 +3092,72 @@ func (lsc *LStreamClient) parseLine(logMsg *LogMsg) error {
 	return nil
 }
 
+// parseJSONLine is like parseLine, but for the JSON logs: all the fields of
+// the line end up in the Context, keyed by their dotted paths, and the Msg is
+// the message field; see JSONLogs.
+func (lsc *LStreamClient) parseJSONLine(logMsg *LogMsg) error {
+	timestamp, level, err := parseJSONLogLine(
+		logMsg, lsc.params.LogStream.Options.JSON, lsc.jsonTimestampField,
+	)
+	if err != nil {
+		return errors.Annotatef(err, "parsing json")
+	}
+
+	// Parse the timestamp the same way as in the plain logs, keeping the
+	// message.
+	msg := logMsg.Msg
+	logMsg.Msg = timestamp
+	if err := lsc.parseLogMsgTimestamp(logMsg); err != nil {
+		return errors.Annotatef(err, "parsing time")
+	}
+	logMsg.Msg = msg
+
+	// Unless the level patterns are configured, the level field is more
+	// reliable than guessing it from the message.
+	if lsc.levelClassifier == nil && level != "" {
+		logMsg.Level = ClassifyLogLevel(level)
+		return nil
+	}
+
+	if err := lsc.parseLogMsgLevel(logMsg); err != nil {
+		return errors.Annotatef(err, "custom parsing")
+	}
+
+	return nil
+}
+
+// parseProjectedLine is like parseLine, but for the lines output with the
+// projection: the line only has the timestamp and the selected fields, which
+// end up in the Context, while the Msg is empty. If the line turns out to be
+// a full one (e.g. the transport doesn't support projections), it falls back
+// to parseLine.
+func (lsc *LStreamClient) parseProjectedLine(logMsg *LogMsg) error {
+	timestamp, fields, ok := parseProjectedLine(logMsg.Msg)
+	if !ok {
+		return lsc.parseLine(logMsg)
+	}
+
+	logMsg.Msg = timestamp
+	logMsg.OrigLine = strings.ReplaceAll(logMsg.OrigLine, projectionSeparator, " ")
+
+	if err := lsc.parseLogMsgTimestamp(logMsg); err != nil {
+		return errors.Annotatef(err, "parsing time")
+	}
+
+	for k, v := range fields {
+		logMsg.Context[k] = v
+	}
+
+	return nil
+}
+
 func (lsc *LStreamClient) parseLogMsgTimestamp(logMsg *LogMsg) error {
 	msg := logMsg.Msg
 
+	if fd := lsc.params.LogStream.Options.FilenameDate; fd != nil {
+		return lsc.parseLogMsgFilenameDate(logMsg, fd)
+	}
+
 	timeLayout := lsc.timeFormat.TimestampLayout
 	timestampLen := len(timeLayout)
 
@@ -1527,6 +3215,33 @@ func (lsc *LStreamClient) parseLogMsgTimestamp(logMsg *LogMsg) error {
 	return nil
 }
 
+// parseLogMsgFilenameDate is like parseLogMsgTimestamp, but for the logs with
+// the date from the file name: the time of day, if any, is taken from the
+// beginning of the message.
+func (lsc *LStreamClient) parseLogMsgFilenameDate(logMsg *LogMsg, fd *FilenameDate) error {
+	msg := logMsg.Msg
+
+	var timeOfDay time.Time
+	if layout := fd.TimeOfDayLayout; layout != "" {
+		if len(msg) < len(layout) {
+			return errors.Errorf("line %q is too short to have the time of day", msg)
+		}
+
+		var err error
+		timeOfDay, err = time.Parse(layout, msg[:len(layout)])
+		if err != nil {
+			return errors.Annotatef(err, "parsing time of day in log msg")
+		}
+
+		msg = msg[len(layout):]
+	}
+
+	logMsg.Time = fd.time(timeOfDay, lsc.location).UTC()
+	logMsg.Msg = strings.TrimSpace(msg)
+
+	return nil
+}
+
 // parseLogMsgEnvelopeDefault takes the LogMsg where the time was already
 // stripped from the Msg, so for syslog, it looks like this:
 //
@@ -1560,51 +3275,40 @@ func (lsc *LStreamClient) parseLogMsgEnvelopeDefault(logMsg *LogMsg) error {
 	return nil
 }
 
-// parseLogMsgLevelDefault tries to guess what the level of the message could
-// be, based on commonly used patterns in the message like "error", "info",
-// "[E]", "[I]" etc.
-func (lsc *LStreamClient) parseLogMsgLevelDefault(logMsg *LogMsg) error {
-	msg := strings.ToLower(logMsg.Msg)
-
-	switch {
-	case strings.Contains(msg, "[f]"):
-		logMsg.Level = LogLevelError
-	case strings.Contains(msg, "[e]"):
-		logMsg.Level = LogLevelError
-	case strings.Contains(msg, "[w]"):
-		logMsg.Level = LogLevelWarn
-	case strings.Contains(msg, "[i]"):
-		logMsg.Level = LogLevelInfo
-	case strings.Contains(msg, "[d]"):
-		logMsg.Level = LogLevelDebug
-	default:
-		logMsg.Level = LogLevelUnknown
-	}
-
-	if logMsg.Level != LogLevelUnknown {
+// parseLogMsgLevel sets the level of the message: using the logstream's
+// LevelPatterns if configured (they're matched against the whole original
+// line, like in the filter queries), or guessing it with ClassifyLogLevel
+// otherwise.
+func (lsc *LStreamClient) parseLogMsgLevel(logMsg *LogMsg) error {
+	if lsc.levelClassifier != nil {
+		logMsg.Level = lsc.levelClassifier.classify(logMsg.OrigLine)
 		return nil
 	}
 
-	// Regex patterns for whole words or bracketed levels
-	patterns := []struct {
-		regex *regexp.Regexp
-		level LogLevel
-	}{
-		{regexp.MustCompile(`\berror\b|\berro\b|\berr\b|\bcrit\b|\bcritical\b|\bfatal\b`), LogLevelError},
-		{regexp.MustCompile(`\bwarn(ing)?\b`), LogLevelWarn},
-		{regexp.MustCompile(`\binfo\b`), LogLevelInfo},
-		{regexp.MustCompile(`\bdebu(g)?\b`), LogLevelDebug},
+	logMsg.Level = ClassifyLogLevel(logMsg.Msg)
+	return nil
+}
+
+// getFilterFieldsConfig returns the FilterFieldsConfig for this logstream.
+func (lsc *LStreamClient) getFilterFieldsConfig() FilterFieldsConfig {
+	return lsc.getSourceFilterFieldsConfig(lsc.params.LogStream.SourceTag)
+}
+
+// getSourceFilterFieldsConfig is like getFilterFieldsConfig, but for the
+// source with the given tag: the "logsource" field is known in advance then,
+// just like the labels.
+func (lsc *LStreamClient) getSourceFilterFieldsConfig(sourceTag string) FilterFieldsConfig {
+	fieldsCfg := NewFilterFieldsConfig(lsc.timeFormat)
+	if lsc.levelClassifier != nil {
+		fieldsCfg.LevelRegexes = lsc.levelClassifier.awkRegexes
 	}
+	fieldsCfg.Labels = withSourceLabel(lsc.params.LogStream.Labels, sourceTag)
 
-	for _, p := range patterns {
-		if p.regex.MatchString(msg) {
-			logMsg.Level = p.level
-			return nil
-		}
+	if lsc.params.LogStream.Options.JSON != nil {
+		fieldsCfg.JSONTimestampField = lsc.jsonTimestampField
 	}
 
-	logMsg.Level = LogLevelUnknown
-	return nil
+	return fieldsCfg
 }
 
 func combineErrors(errs []error) error {
@@ -1623,6 +3327,25 @@ func combineErrors(errs []error) error {
 	return err
 }
 
+// getAgentWarnings returns the warnings from the unhandled stderr lines of the
+// query: everything except the agent's own debug output. If the agent
+// explicitly marked the line as a warning with the "warn:" prefix, the prefix
+// is removed; other lines (typically printed by awk or by the tools like tail)
+// are returned as is.
+func getAgentWarnings(stderr []string) []string {
+	var warnings []string
+	for _, line := range stderr {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "debug:") {
+			continue
+		}
+
+		warnings = append(warnings, strings.TrimPrefix(line, "warn:"))
+	}
+
+	return warnings
+}
+
 func errorFromStdoutStderr(prefix string, stdout []string, stderr []string) error {
 	var sb strings.Builder
 
@@ -1689,6 +3412,31 @@ func parseCommandDoneLine(line string, expectedIdx int) (*commandDoneDetails, er
 	}, nil
 }
 
+// parseBytesProgress parses the payload of the "p:b:" line printed by the
+// agent, which looks like "<processed>:<total>".
+func parseBytesProgress(s string) (processed, total int64, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("expected two parts, got %d", len(parts))
+	}
+
+	processed, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "parsing bytes processed")
+	}
+
+	total, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Annotatef(err, "parsing bytes total")
+	}
+
+	if processed < 0 || total <= 0 {
+		return 0, 0, errors.Errorf("invalid bytes progress %d/%d", processed, total)
+	}
+
+	return processed, total, nil
+}
+
 // requiresShellQuoting returns whether the given string requires to be quoted
 // in a shell.
 func requiresShellQuoting(s string) bool {
@@ -1,6 +1,10 @@
 package core
 
-import "time"
+import (
+	"context"
+	"strings"
+	"time"
+)
 
 type lstreamCmd struct {
 	// respCh must be either nil, or 1-buffered and it'll receive exactly one
@@ -11,6 +15,8 @@ type lstreamCmd struct {
 
 	bootstrap *lstreamCmdBootstrap
 	ping      *lstreamCmdPing
+	verify    *lstreamCmdVerify
+	adHoc     *lstreamCmdAdHoc
 	queryLogs *lstreamCmdQueryLogs
 }
 
@@ -19,8 +25,17 @@ type lstreamCmdCtx struct {
 
 	idx int
 
+	// startTime is when the command has started, used for the metrics.
+	startTime time.Time
+
+	// session is the additional session the command runs on; nil if it runs
+	// on the main one.
+	session *querySession
+
 	bootstrapCtx *lstreamCmdCtxBootstrap
 	pingCtx      *lstreamCmdCtxPing
+	verifyCtx    *lstreamCmdCtxVerify
+	adHocCtx     *lstreamCmdCtxAdHoc
 	queryLogsCtx *lstreamCmdCtxQueryLogs
 
 	// Initially, stdoutDoneIdx and stderrDoneIdx are set to false. Once we
@@ -50,6 +65,9 @@ type lstreamCmdCtx struct {
 type lstreamCmdRes struct {
 	hostname string
 
+	// queryID is copied from the lstreamCmdQueryLogs.
+	queryID int
+
 	err  error
 	resp interface{}
 }
@@ -60,11 +78,40 @@ type lstreamCmdCtxBootstrap struct {
 	receivedSuccess bool
 	receivedFailure bool
 
+	// agentUploadFailed is set to true if the nerdlog_agent.sh couldn't be
+	// written on the host.
+	agentUploadFailed bool
+
 	// warnJournalctlNoAdminAccess is set to true if journalctl is used and the
 	// user doesn't have access to all the system logs. It's a separate bool
 	// instead of a generic warning message to make it possible to suppress it
 	// with a flag.
 	warnJournalctlNoAdminAccess bool
+
+	// timezone and hostVersion are as reported by the host, used to cache the
+	// capabilities.
+	timezone    string
+	hostVersion string
+
+	// cachedCaps is non-nil if we have cached capabilities for the host, and
+	// usedCachedCaps is set to true if the host version matched, so they were
+	// used instead of probing the host.
+	cachedCaps     *HostCapabilities
+	usedCachedCaps bool
+
+	// wireCompressionOK is set to true if the compressor for the configured
+	// wire compression exists on the host. warnWireCompression is non-empty if
+	// it can't be used for some other reason, like the missing local
+	// decompressor.
+	wireCompressionOK   bool
+	warnWireCompression string
+
+	// busybox is set to true if the host turned out to be busybox-based.
+	busybox bool
+
+	// awkDialect is the awk dialect reported by the host; empty if it wasn't
+	// reported.
+	awkDialect AWKDialect
 }
 
 type lstreamCmdPing struct{}
@@ -72,7 +119,44 @@ type lstreamCmdPing struct{}
 type lstreamCmdCtxPing struct {
 }
 
+type lstreamCmdVerify struct{}
+
+type lstreamCmdCtxVerify struct {
+	// results contains the results for every log file, as printed by the
+	// agent.
+	results []LStreamVerifyResult
+}
+
+type lstreamCmdAdHoc struct {
+	command string
+
+	timeout       time.Duration
+	maxOutputSize int
+}
+
+type lstreamCmdCtxAdHoc struct {
+	// output is the combined stdout and stderr of the command, up to the
+	// maxOutputSize; truncated is set if there was more.
+	output    strings.Builder
+	truncated bool
+
+	// exitCode is the exit code of the command itself (as opposed to
+	// lstreamCmdCtx.exitCode, which is the exit code of the whole script).
+	exitCode string
+}
+
 type lstreamCmdQueryLogs struct {
+	// queryID is the ID of the LStreamsManager's query this command is a part
+	// of; it's included in the response.
+	queryID int
+
+	// ctx, if not nil, is cancelled once the results are not needed anymore
+	// (e.g. the query was superseded by a newer one, or stopped). If it
+	// happens before the command has started, it's not started at all; and
+	// if it's running on the host already, it's stopped there, and the
+	// response has ErrQueryStopped.
+	ctx context.Context
+
 	maxNumLines int
 
 	from time.Time
@@ -80,10 +164,62 @@ type lstreamCmdQueryLogs struct {
 
 	query string
 
+	// If filter is not nil, the query is ignored, and the filter is compiled to
+	// an awk pattern instead, using the logstream's time format to extract the
+	// fields.
+	filter FilterExpr
+	// filterAWKDialect is the awk dialect which the regexes in the filter are
+	// translated to.
+	filterAWKDialect AWKDialect
+	// filterMatchOpts is only used with the filter.
+	filterMatchOpts FilterMatchOpts
+
+	// If correlation is not nil, only the lines matching it are returned, on
+	// top of the query or the filter; see QueryLogsParams.CorrelateKey.
+	correlation FilterExpr
+
+	// If projection is not nil, the agent outputs only the selected fields
+	// instead of the full log lines.
+	projection *Projection
+
+	// If groupBy is not nil, the agent also counts the matching lines by the
+	// values of this field; see QueryLogsParams.GroupBy.
+	groupBy *ProjectionField
+
+	// sampleRate, if more than 1, is passed to nerdlog_agent.sh as
+	// --sample-rate; see QueryLogsParams.SampleRate.
+	sampleRate int
+
+	// statsBucketMinutes, if more than 1, is passed to nerdlog_agent.sh as
+	// --stats-bucket-minutes; see QueryLogsParams.StatsBucketMinutes.
+	statsBucketMinutes int
+
+	// aggregateOnly, if true, makes nerdlog_agent.sh only print the
+	// aggregates, without the log lines; see QueryLogsParams.AggregateOnly.
+	aggregateOnly bool
+
+	// tailNumLines, if more than 0, is passed to nerdlog_agent.sh as
+	// --tail-lines; see QueryLogsParams.TailNumLines.
+	tailNumLines int
+
+	// pinLast, if not empty, is passed to nerdlog_agent.sh as --pin-last:
+	// either the pin returned by the earlier query, or "-" to pin the latest
+	// log file now; see QueryLogsParams.Pin.
+	pinLast string
+
+	// agentEnv contains the env vars to export for the agent, without the
+	// AgentEnvPrefix; see QueryLogsParams.AgentEnv.
+	agentEnv map[string]string
+
 	// If linesUntil is not zero, it'll be passed to nerdlog_agent.sh as --lines-until.
 	// Effectively, only logs BEFORE this log line (not including it) will be output.
 	linesUntil int
 
+	// sourceLinesUntil is the same as linesUntil, but for the logstreams with
+	// multiple sources (see LogStream.Sources): it maps the source tag to the
+	// --lines-until for that source.
+	sourceLinesUntil map[string]int
+
 	// timestampUntil is not zero, it'll be passed to nerdlog_agent as
 	// --timestamp-until-precise and --timestamp-until-seconds. It serves the
 	// same purpose as linesUntil for cases when we don't have line numbers (e.g.
@@ -101,6 +237,29 @@ type lstreamCmdCtxQueryLogs struct {
 
 	logfiles []logfileWithStartingLinenumber
 	lastTime time.Time
+
+	// sourceTag is the "logsource" context tag for the log messages: either
+	// LogStream.SourceTag, or for the logstreams with multiple sources, the tag
+	// of the source which the agent is reading now; see LogStream.Sources.
+	sourceTag string
+
+	// pendingCaptures contains the named regex captures from the last "mc:"
+	// line, to be added to the next log message.
+	pendingCaptures map[string]string
+
+	// stopping is set to true once we've written the stopQueryScript, and
+	// stopped is set to true once we've received its "query_stopped:" line on
+	// either stdout or stderr; in this case, the response has ErrQueryStopped.
+	stopping bool
+	stopped  bool
+
+	// pinWarning is the warning about the pin being ignored, if the agent
+	// couldn't honor the --pin-last.
+	pinWarning string
+
+	// awkFailure is set if the agent has reported that the awk script has
+	// failed; see AWKError.
+	awkFailure *awkFailure
 }
 
 type logfileWithStartingLinenumber struct {
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// reservedLabelKeys are the context tags and filter fields which nerdlog sets
+// on its own, so the labels can't use them as keys.
+var reservedLabelKeys = map[string]struct{}{
+	"lstream":           {},
+	"logsource":         {},
+	"pid":               {},
+	FilterFieldHostname: {},
+	FilterFieldProgram:  {},
+	FilterFieldLevel:    {},
+	"host":              {},
+}
+
+// validateLStreamLabels checks that every label key (see
+// ConfigLogStream.Labels) can be used as a field in the filter query, and
+// doesn't clash with the fields set by nerdlog.
+func validateLStreamLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" {
+			return errors.Errorf("empty label key")
+		}
+
+		for i := 0; i < len(key); i++ {
+			if !isFilterFieldChar(key[i], i == 0) {
+				return errors.Errorf(
+					"invalid label key %q: must start with a letter or underscore, and only contain letters, digits, underscores, dots and dashes", key,
+				)
+			}
+		}
+
+		if _, ok := reservedLabelKeys[key]; ok {
+			return errors.Errorf("invalid label key %q: it's reserved", key)
+		}
+	}
+
+	return nil
+}
+
+// formatLStreamLabels formats the labels as a single string like
+// "env=prod,region=eu", sorted by key.
+func formatLStreamLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+labels[k])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// withSourceLabel returns the labels with the "logsource" one added, so that
+// the filter terms like "logsource:nginx-access" are resolved in advance,
+// just like the labels; if the source tag is empty, the labels are returned
+// as is. The given labels are never modified.
+func withSourceLabel(labels map[string]string, sourceTag string) map[string]string {
+	if sourceTag == "" {
+		return labels
+	}
+
+	ret := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		ret[k] = v
+	}
+	ret["logsource"] = sourceTag
+
+	return ret
+}
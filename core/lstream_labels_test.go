@@ -0,0 +1,29 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLStreamLabels(t *testing.T) {
+	assert.NoError(t, validateLStreamLabels(map[string]string{"region": "eu", "k8s.cluster-name": "main"}))
+
+	for _, key := range []string{"", "1st", "has space", "lstream", "hostname", "level"} {
+		assert.Error(t, validateLStreamLabels(map[string]string{key: "foo"}), "%q", key)
+	}
+
+	assert.Equal(t, "region=eu,team=core", formatLStreamLabels(map[string]string{"team": "core", "region": "eu"}))
+	assert.Equal(t, "", formatLStreamLabels(nil))
+}
+
+func TestWithSourceLabel(t *testing.T) {
+	labels := map[string]string{"region": "eu"}
+
+	assert.Equal(t, map[string]string{"region": "eu", "logsource": "app"}, withSourceLabel(labels, "app"))
+	assert.Equal(t, map[string]string{"logsource": "app"}, withSourceLabel(nil, "app"))
+	assert.Equal(t, labels, withSourceLabel(labels, ""))
+
+	// The given labels are shared by the messages, so they stay intact.
+	assert.Equal(t, map[string]string{"region": "eu"}, labels)
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/juju/errors"
+)
+
+// LStreamSelector restricts which logstreams are used in the session: the
+// logstreams resolved from the spec which don't match the selector are
+// neither connected nor queried. It returns true for the logstreams to use.
+// See LStreamsManagerParams.Selector and ParseLStreamSelector.
+type LStreamSelector func(ls LogStream) bool
+
+// lstreamTagPrefix is the prefix of the selector items which match the
+// logstream tags rather than the names, like "tag:db".
+const lstreamTagPrefix = "tag:"
+
+// ParseLStreamSelector parses the selector spec, like "web-*,db-01,tag:prod":
+// comma-separated items, each of which is either a glob matched against the
+// logstream name, or "tag:<glob>" matched against the logstream tags (see
+// ConfigLogStream.Tags). A logstream is selected if it matches any of the
+// items. An item prefixed with "!", like "!tag:canary", excludes the matching
+// logstreams instead; if all the items are exclusions, all the other
+// logstreams are selected.
+//
+// If the spec is empty, the returned selector is nil, which means that all the
+// logstreams are selected.
+func ParseLStreamSelector(spec string) (LStreamSelector, error) {
+	var included, excluded []lstreamSelectorItem
+
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		negated := false
+		if strings.HasPrefix(s, "!") {
+			negated = true
+			s = s[1:]
+		}
+
+		item, err := parseLStreamSelectorItem(s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if negated {
+			excluded = append(excluded, item)
+		} else {
+			included = append(included, item)
+		}
+	}
+
+	if len(included) == 0 && len(excluded) == 0 {
+		return nil, nil
+	}
+
+	return func(ls LogStream) bool {
+		for _, item := range excluded {
+			if item.match(ls) {
+				return false
+			}
+		}
+
+		if len(included) == 0 {
+			return true
+		}
+
+		for _, item := range included {
+			if item.match(ls) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// lstreamSelectorItem is a single item of the selector spec.
+type lstreamSelectorItem struct {
+	pattern glob.Glob
+
+	// isTag is true if the pattern is matched against the tags rather than the
+	// name.
+	isTag bool
+}
+
+func parseLStreamSelectorItem(s string) (lstreamSelectorItem, error) {
+	var item lstreamSelectorItem
+
+	if strings.HasPrefix(s, lstreamTagPrefix) {
+		item.isTag = true
+		s = strings.TrimPrefix(s, lstreamTagPrefix)
+	}
+
+	if s == "" {
+		return lstreamSelectorItem{}, errors.Errorf("empty pattern in the selector")
+	}
+
+	pattern, err := glob.Compile(s)
+	if err != nil {
+		return lstreamSelectorItem{}, errors.Annotatef(err, "parsing selector pattern %q", s)
+	}
+
+	item.pattern = pattern
+
+	return item, nil
+}
+
+func (item lstreamSelectorItem) match(ls LogStream) bool {
+	if !item.isTag {
+		return item.pattern.Match(ls.Name)
+	}
+
+	for _, tag := range ls.Tags {
+		if item.pattern.Match(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectLStreams returns the logstreams matching the selector; if the
+// selector is nil, the logstreams are returned as is.
+func selectLStreams(lstreams map[string]LogStream, selector LStreamSelector) map[string]LogStream {
+	if selector == nil {
+		return lstreams
+	}
+
+	ret := make(map[string]LogStream, len(lstreams))
+	for name, ls := range lstreams {
+		if selector(ls) {
+			ret[name] = ls
+		}
+	}
+
+	return ret
+}
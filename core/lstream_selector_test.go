@@ -0,0 +1,170 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLStreamSelector(t *testing.T) {
+	lstreams := []LogStream{
+		{Name: "web-01", Tags: []string{"prod", "frontend"}},
+		{Name: "web-02", Tags: []string{"prod", "frontend", "canary"}},
+		{Name: "db-01", Tags: []string{"prod", "db"}},
+		{Name: "db-02", Tags: []string{"staging", "db"}},
+		{Name: "misc"},
+	}
+
+	type testCase struct {
+		spec string
+		want []string
+	}
+
+	testCases := []testCase{
+		{spec: "web-*", want: []string{"web-01", "web-02"}},
+		{spec: "web-*, db-01", want: []string{"web-01", "web-02", "db-01"}},
+		{spec: "tag:db", want: []string{"db-01", "db-02"}},
+		{spec: "tag:prod,!tag:canary", want: []string{"web-01", "db-01"}},
+		{spec: "!tag:prod", want: []string{"db-02", "misc"}},
+		{spec: "tag:stag*,misc", want: []string{"db-02", "misc"}},
+		{spec: "nothing-*", want: nil},
+	}
+
+	for _, tc := range testCases {
+		sel, err := ParseLStreamSelector(tc.spec)
+		if !assert.NoError(t, err, tc.spec) {
+			continue
+		}
+
+		var got []string
+		for _, ls := range lstreams {
+			if sel(ls) {
+				got = append(got, ls.Name)
+			}
+		}
+
+		assert.Equal(t, tc.want, got, tc.spec)
+	}
+
+	sel, err := ParseLStreamSelector(" , ")
+	assert.NoError(t, err)
+	assert.Nil(t, sel)
+
+	for _, spec := range []string{"tag:", "!", "web-[01"} {
+		_, err := ParseLStreamSelector(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestLStreamsManagerSelectStreams(t *testing.T) {
+	logs := &fakeLogs{}
+
+	var mtx sync.Mutex
+	numTransports := map[string]int{}
+	var lastState *LStreamsManagerState
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	go func() {
+		for upd := range updatesCh {
+			if upd.State != nil {
+				mtx.Lock()
+				lastState = upd.State
+				mtx.Unlock()
+			}
+		}
+	}()
+
+	// connectedLStreams returns the sorted names of the logstreams the last
+	// state update has.
+	connectedLStreams := func() []string {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if lastState == nil {
+			return nil
+		}
+
+		var ret []string
+		for name := range lastState.ConnDetailsByLStream {
+			ret = append(ret, name)
+		}
+		sort.Strings(ret)
+
+		return ret
+	}
+
+	cfg := ConfigLogStreams{
+		"web-01": {LogFiles: []string{"/var/log/syslog"}, Tags: []string{"prod", "frontend"}},
+		"web-02": {LogFiles: []string{"/var/log/syslog"}, Tags: []string{"prod", "frontend"}},
+		"db-01":  {LogFiles: []string{"/var/log/syslog"}, Tags: []string{"prod", "db"}},
+		"db-02":  {LogFiles: []string{"/var/log/syslog"}, Tags: []string{"staging", "db"}},
+		"misc":   {LogFiles: []string{"/var/log/syslog"}},
+	}
+
+	selector, err := ParseLStreamSelector("web-01,tag:staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: cfg,
+		NewTransport: func(ls LogStream) ShellTransport {
+			mtx.Lock()
+			numTransports[ls.Name]++
+			mtx.Unlock()
+
+			return &fakeShellTransport{logs: logs}
+		},
+		InitialLStreams: "*",
+		Selector:        selector,
+		ClientID:        "test",
+		UpdatesCh:       updatesCh,
+		Clock:           clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+	defer func() {
+		lsman.Close()
+		lsman.Wait()
+		close(updatesCh)
+	}()
+
+	// Only the selected logstreams are connected.
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"db-02", "web-01"}, connectedLStreams())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mtx.Lock()
+	assert.Equal(t, map[string]int{"web-01": 1, "db-02": 1}, numTransports)
+	mtx.Unlock()
+
+	// Changing the selector connects the newly selected ones, disconnects the
+	// ones not selected anymore, and leaves the rest as is.
+	selector, err = ParseLStreamSelector("tag:db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, lsman.SelectStreams(selector))
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"db-01", "db-02"}, connectedLStreams())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mtx.Lock()
+	assert.Equal(t, map[string]int{"web-01": 1, "db-01": 1, "db-02": 1}, numTransports)
+	mtx.Unlock()
+
+	// The nil selector selects everything.
+	assert.NoError(t, lsman.SelectStreams(nil))
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(
+			[]string{"db-01", "db-02", "misc", "web-01", "web-02"}, connectedLStreams(),
+		)
+	}, 5*time.Second, 10*time.Millisecond)
+}
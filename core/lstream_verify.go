@@ -0,0 +1,231 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// LStreamVerifyStatus is the result of checking whether the logs of a
+// logstream are actually readable; see LStreamsManager.VerifyLStreams.
+type LStreamVerifyStatus string
+
+const (
+	// LStreamVerifyReadable means the logstream is connected, and its logs are
+	// readable.
+	LStreamVerifyReadable LStreamVerifyStatus = "readable"
+
+	// LStreamVerifyNotFound means that the log file (or journalctl) doesn't
+	// exist on the host.
+	LStreamVerifyNotFound LStreamVerifyStatus = "not_found"
+
+	// LStreamVerifyPermissionDenied means that the log file exists, but we
+	// can't read it (or journalctl fails).
+	LStreamVerifyPermissionDenied LStreamVerifyStatus = "permission_denied"
+
+	// LStreamVerifyNotConnected means that the logstream is not connected, so
+	// it couldn't be verified.
+	LStreamVerifyNotConnected LStreamVerifyStatus = "not_connected"
+
+	// LStreamVerifyFailed means that the check itself has failed for some
+	// other reason; see LStreamVerifyResult.Err.
+	LStreamVerifyFailed LStreamVerifyStatus = "failed"
+)
+
+// LStreamVerifyResult is the result of verification of a single logstream.
+type LStreamVerifyResult struct {
+	Status LStreamVerifyStatus
+
+	// Filename is the log file which the Status is about; for the readable
+	// logstreams, it's the last checked file. For journalctl, it's
+	// "journalctl".
+	Filename string
+
+	// Err contains the error message for LStreamVerifyNotConnected and
+	// LStreamVerifyFailed; it's empty if there's no details.
+	Err string
+}
+
+// Ready returns whether the logstream is connected and its logs are readable.
+func (r LStreamVerifyResult) Ready() bool {
+	return r.Status == LStreamVerifyReadable
+}
+
+// String returns a human-readable result like "readable" or
+// "permission denied: /var/log/syslog".
+func (r LStreamVerifyResult) String() string {
+	desc := strings.Replace(string(r.Status), "_", " ", -1)
+
+	switch r.Status {
+	case LStreamVerifyNotFound, LStreamVerifyPermissionDenied:
+		return fmt.Sprintf("%s: %s", desc, r.Filename)
+	case LStreamVerifyNotConnected, LStreamVerifyFailed:
+		if r.Err != "" {
+			return fmt.Sprintf("%s: %s", desc, r.Err)
+		}
+	}
+
+	return desc
+}
+
+var validVerifyStatuses = map[LStreamVerifyStatus]struct{}{
+	LStreamVerifyReadable:         {},
+	LStreamVerifyNotFound:         {},
+	LStreamVerifyPermissionDenied: {},
+}
+
+// parseVerifyLine parses the "verify:<status>:<filename>" line printed by the
+// agent's verify command (without the "verify:" prefix).
+func parseVerifyLine(line string) (LStreamVerifyResult, error) {
+	idx := strings.IndexRune(line, ':')
+	if idx <= 0 {
+		return LStreamVerifyResult{}, errors.Errorf("malformed verify line %q", line)
+	}
+
+	status := LStreamVerifyStatus(line[:idx])
+	if _, ok := validVerifyStatuses[status]; !ok {
+		return LStreamVerifyResult{}, errors.Errorf("invalid verify status %q", status)
+	}
+
+	return LStreamVerifyResult{
+		Status:   status,
+		Filename: line[idx+1:],
+	}, nil
+}
+
+var (
+	bootstrapNotFoundRegex     = regexp.MustCompile(`(\S+) does not exist`)
+	bootstrapNotReadableRegex  = regexp.MustCompile(`(\S+) exists but is not readable`)
+	bootstrapNoJournalctlRegex = regexp.MustCompile(`journalctl is not found`)
+)
+
+// verifyResultFromBootstrapErr returns the verify result for the logstream
+// which has failed to bootstrap with the given error: the bootstrap also
+// checks that the log files are readable, so if that's the reason, we can
+// classify it.
+func verifyResultFromBootstrapErr(errMsg string) LStreamVerifyResult {
+	if m := bootstrapNotFoundRegex.FindStringSubmatch(errMsg); m != nil {
+		return LStreamVerifyResult{Status: LStreamVerifyNotFound, Filename: m[1]}
+	}
+
+	if m := bootstrapNotReadableRegex.FindStringSubmatch(errMsg); m != nil {
+		return LStreamVerifyResult{Status: LStreamVerifyPermissionDenied, Filename: m[1]}
+	}
+
+	if bootstrapNoJournalctlRegex.MatchString(errMsg) {
+		return LStreamVerifyResult{Status: LStreamVerifyNotFound, Filename: SpecialFilenameJournalctl}
+	}
+
+	return LStreamVerifyResult{Status: LStreamVerifyFailed, Err: errMsg}
+}
+
+// combineVerifyResults returns the first non-readable result, or the last
+// readable one if all of them are readable.
+func combineVerifyResults(results []LStreamVerifyResult) LStreamVerifyResult {
+	if len(results) == 0 {
+		return LStreamVerifyResult{
+			Status: LStreamVerifyFailed,
+			Err:    "no verification results from the agent",
+		}
+	}
+
+	for _, r := range results {
+		if !r.Ready() {
+			return r
+		}
+	}
+
+	return results[len(results)-1]
+}
+
+type lstreamsManagerReqVerify struct {
+	resCh chan<- map[string]LStreamVerifyResult
+	ctx   context.Context
+}
+
+// VerifyLStreams checks that the logs of every logstream are actually
+// readable (which isn't guaranteed by just connecting successfully: the log
+// files might be missing, or have wrong permissions), and returns the results
+// for every logstream. The logstreams which are not connected are not
+// checked, and have the LStreamVerifyNotConnected status. If the ctx is done
+// before some logstream responds, it gets LStreamVerifyFailed.
+func (lsman *LStreamsManager) VerifyLStreams(ctx context.Context) map[string]LStreamVerifyResult {
+	resCh := make(chan map[string]LStreamVerifyResult, 1)
+
+	lsman.reqCh <- lstreamsManagerReq{
+		verify: &lstreamsManagerReqVerify{
+			resCh: resCh,
+			ctx:   ctx,
+		},
+	}
+
+	return <-resCh
+}
+
+// startVerify sends the verify command to all connected logstreams, and
+// collects the results in a separate goroutine. Must be called from the
+// LStreamsManager's goroutine.
+func (lsman *LStreamsManager) startVerify(req *lstreamsManagerReqVerify) {
+	results := make(map[string]LStreamVerifyResult, len(lsman.lscs))
+	respCh := make(chan lstreamCmdRes, len(lsman.lscs))
+	pending := map[string]struct{}{}
+
+	for name, lsc := range lsman.lscs {
+		if !isStateConnected(lsman.lscStates[name]) {
+			res := LStreamVerifyResult{Status: LStreamVerifyNotConnected}
+			if lastErr, ok := lsman.lscLastErrs[name]; ok {
+				res.Err = lastErr.err
+
+				// If the bootstrap has failed because of the log files, report it.
+				if bootstrapRes := verifyResultFromBootstrapErr(lastErr.err); lastErr.bootstrap && bootstrapRes.Status != LStreamVerifyFailed {
+					res = bootstrapRes
+				}
+			}
+
+			results[name] = res
+			continue
+		}
+
+		pending[name] = struct{}{}
+		lsc.EnqueueCmd(lstreamCmd{
+			respCh: respCh,
+			verify: &lstreamCmdVerify{},
+		})
+	}
+
+	go func() {
+		for len(pending) > 0 {
+			select {
+			case resp := <-respCh:
+				if _, ok := pending[resp.hostname]; !ok {
+					continue
+				}
+				delete(pending, resp.hostname)
+
+				if resp.err != nil {
+					results[resp.hostname] = LStreamVerifyResult{
+						Status: LStreamVerifyFailed,
+						Err:    resp.err.Error(),
+					}
+					continue
+				}
+
+				results[resp.hostname] = resp.resp.(LStreamVerifyResult)
+
+			case <-req.ctx.Done():
+				for name := range pending {
+					results[name] = LStreamVerifyResult{
+						Status: LStreamVerifyFailed,
+						Err:    req.ctx.Err().Error(),
+					}
+				}
+				pending = nil
+			}
+		}
+
+		req.resCh <- results
+	}()
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVerifyLine(t *testing.T) {
+	res, err := parseVerifyLine("permission_denied:/var/log/my:log")
+	assert.NoError(t, err)
+	assert.Equal(t, LStreamVerifyResult{
+		Status: LStreamVerifyPermissionDenied, Filename: "/var/log/my:log",
+	}, res)
+
+	_, err = parseVerifyLine("foo:/var/log/syslog")
+	assert.Error(t, err)
+
+	_, err = parseVerifyLine("readable")
+	assert.Error(t, err)
+}
+
+func TestCombineVerifyResults(t *testing.T) {
+	readable := LStreamVerifyResult{Status: LStreamVerifyReadable, Filename: "/var/log/syslog"}
+	notFound := LStreamVerifyResult{Status: LStreamVerifyNotFound, Filename: "/var/log/syslog.1"}
+
+	assert.Equal(t, readable, combineVerifyResults([]LStreamVerifyResult{readable}))
+	assert.Equal(t, notFound, combineVerifyResults([]LStreamVerifyResult{readable, notFound}))
+	assert.Equal(t, LStreamVerifyFailed, combineVerifyResults(nil).Status)
+}
+
+func TestVerifyResultFromBootstrapErr(t *testing.T) {
+	assert.Equal(t,
+		LStreamVerifyResult{Status: LStreamVerifyNotFound, Filename: "/var/log/foo"},
+		verifyResultFromBootstrapErr("/var/log/foo does not exist"),
+	)
+	assert.Equal(t,
+		LStreamVerifyResult{Status: LStreamVerifyPermissionDenied, Filename: "/var/log/foo"},
+		verifyResultFromBootstrapErr("/var/log/foo exists but is not readable, check your permissions"),
+	)
+	assert.Equal(t,
+		LStreamVerifyResult{Status: LStreamVerifyNotFound, Filename: "journalctl"},
+		verifyResultFromBootstrapErr("journalctl is not found"),
+	)
+	assert.Equal(t,
+		LStreamVerifyResult{Status: LStreamVerifyFailed, Err: "unable to detect time format"},
+		verifyResultFromBootstrapErr("unable to detect time format"),
+	)
+}
@@ -1,11 +1,13 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"os/user"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dimonomid/clock"
@@ -23,6 +25,12 @@ type LStreamsManager struct {
 
 	lstreamsStr      string
 	parsedLogStreams map[string]LogStream
+	// lstreamsOrder contains the names of the parsedLogStreams in the config
+	// order (see LStreamsResolver.ResolveList).
+	lstreamsOrder []string
+
+	// selector is the current session selector; see SelectStreams.
+	selector LStreamSelector
 
 	lscs      map[string]*LStreamClient
 	lscStates map[string]LStreamClientState
@@ -33,6 +41,13 @@ type LStreamsManager struct {
 	// lscBusyStages only contains items for lstreams which are in the
 	// LStreamClientStateConnectedBusy state.
 	lscBusyStages map[string]BusyStage
+	// lscLastErrs contains the last connection or bootstrap error for lstreams
+	// which are not connected; the item is removed once the connection
+	// succeeds.
+	lscLastErrs map[string]lstreamConnErr
+	// lscAWKDialects contains the awk dialects of the lstreams which have
+	// bootstrapped at least once; the filter queries are translated to them.
+	lscAWKDialects map[string]AWKDialect
 
 	// lscPendingTeardown contains info about LStreamClient-s that are being torn
 	// down. NOTE that when a LStreamClient starts tearing down, its key changes
@@ -55,11 +70,76 @@ type LStreamsManager struct {
 	// Wait waits for it.
 	torndownCh chan struct{}
 
+	// shutdownReqCh is written to once when Shutdown is called.
+	shutdownReqCh chan struct{}
+	// shuttingDown is true once the Shutdown is started; see startShutdown.
+	shuttingDown bool
+	// shutdownLStreams contains the logstreams which were running the query
+	// when the Shutdown was started; it waits for them to stop it.
+	shutdownLStreams map[string]struct{}
+	// shutdownGraceCh fires once the ShutdownGracePeriod passes after the
+	// Shutdown has started waiting for the busy logstreams; it's nil otherwise.
+	shutdownGraceCh <-chan time.Time
+
 	curQueryLogsCtx *manQueryLogsCtx
+	// nextQueryID is incremented for every query, to tell the responses to
+	// the current query from the late responses to the older ones.
+	nextQueryID int
+
+	// debouncedQuery is the query waiting for the QueryDebounce to pass before
+	// it's started, and debounceCh fires once it has passed; both are nil if
+	// there is no such query.
+	debouncedQuery *QueryLogsParams
+	debounceCh     <-chan time.Time
+
+	// idleCh fires once the IdleTimeout passes since the last activity; it's
+	// nil if the IdleTimeout isn't set, or if we're idle-disconnected already.
+	idleCh <-chan time.Time
+	// idleDisconnected is true if the logstreams are parked because of the
+	// IdleTimeout; see disconnectIdle.
+	idleDisconnected bool
 
 	curLogs manLogsCtx
 
+	// skippedLStreams contains the logstreams skipped by the last query (see
+	// QueryLogsParams.SkipNotConnected); they're queried by the next query
+	// with RetrySkipped.
+	skippedLStreams map[string]struct{}
+
+	// resumableQuery is the last query which has failed on some logstreams,
+	// so that it can be resumed; see QueryResumeToken. It's forgotten once
+	// another query is started.
+	resumableQuery *manResumableQuery
+
+	// pins contains the pins of the latest log files returned by the agents
+	// (see LogResp.PinLast), by the logstream name, to be passed to the next
+	// queries; it's nil unless the last query had QueryLogsParams.Pin set.
+	pins map[string]string
+
+	// fleetSummary is what FleetStatus returns; it's updated from the
+	// LStreamsManager's goroutine, but can be read from any goroutine, so it's
+	// guarded by fleetSummaryMtx.
+	fleetSummary    FleetSummary
+	fleetSummaryMtx sync.Mutex
+
 	defaultTransportMode *TransportMode
+
+	// sshConnPool is nil unless CoalesceConnections is set.
+	sshConnPool *SSHConnPool
+
+	// connectLimiter is nil unless MaxConcurrentConnects is set.
+	connectLimiter *connectLimiter
+
+	// transportAutoPicks remembers the transports picked for the hosts in the
+	// auto transport mode, for as long as the LStreamsManager lives.
+	transportAutoPicks *TransportAutoPicks
+
+	// maxOpenStreams is resolved from the MaxOpenStreams param.
+	maxOpenStreams maxOpenStreams
+
+	// connEvents delivers the transport updates of all logstreams to the
+	// subscribers; see Subscribe.
+	connEvents *connEventsHub
 }
 
 type LStreamsManagerParams struct {
@@ -75,10 +155,109 @@ type LStreamsManagerParams struct {
 	// an existing key is found.
 	SSHKeys []string
 
+	// SSHCert, if not empty, is the path to the OpenSSH certificate for the
+	// ssh key; by default, it's looked up next to the key.
+	SSHCert string
+
+	// SSHPKCS11, if not nil, is the PKCS#11 token to authenticate with
+	// instead of the ssh keys; see ShellTransportSSHLibParams.PKCS11.
+	SSHPKCS11 *SSHPKCS11
+
+	// SSHCredentialProvider, if not nil, provides the credentials for the
+	// ssh-lib transport instead of the ssh keys; see
+	// ShellTransportSSHLibParams.CredentialProvider.
+	SSHCredentialProvider CredentialProvider
+
+	// HostKeys verifies ssh host keys for the ssh-lib transport; if nil, host
+	// keys are not verified.
+	HostKeys *HostKeys
+
+	// CapabilitiesCache, if not nil, is used to cache the results of probing
+	// the hosts during bootstrap; see LStreamClientParams.CapabilitiesCache.
+	CapabilitiesCache *CapabilitiesCache
+
+	// QueryCache, if not nil, is used to cache the results of the queries
+	// over the historical time ranges; see LStreamClientParams.QueryCache.
+	QueryCache *QueryCache
+
+	// CoalesceConnections, if true, makes the logstreams which have the same
+	// connection identity (see ConfigLogStreamShellTransportSSHLib.Identity)
+	// share a single ssh connection, instead of connecting separately. The
+	// logstreams are still separate otherwise. Only the ssh-lib transport
+	// supports it.
+	CoalesceConnections bool
+
+	// NewTransport, if non-nil, is called to create the shell transport for
+	// every logstream, instead of creating it accordingly to the config. It's
+	// useful for tests, and for embedders which need some custom transport.
+	NewTransport func(ls LogStream) ShellTransport
+
+	// MaxConcurrentQueries is the max number of queries to run at the same time
+	// on a single logstream, if the transport supports it. If zero,
+	// DefaultMaxConcurrentQueries is used.
+	MaxConcurrentQueries int
+
+	// MaxQueriesInFlight is the max number of logstreams to query at the same
+	// time, across the whole fleet; the rest of them are queried as the
+	// in-flight ones respond. If zero, all logstreams are queried at once.
+	MaxQueriesInFlight int
+
+	// MaxOpenStreams is the max number of logstreams to have open at the same
+	// time; setting the logstreams spec which resolves to more of them fails
+	// with a clear error, instead of failing mid-connect with "too many open
+	// files". If zero, it's derived from the RLIMIT_NOFILE of the process; if
+	// negative, there is no limit.
+	MaxOpenStreams int
+
+	// MaxConcurrentConnects is the max number of logstreams to connect at the
+	// same time; the rest of them wait, and the ones with the higher
+	// ConfigLogStreamOptions.Priority start first, the same priority going in
+	// the config order. If zero, all logstreams connect at once.
+	MaxConcurrentConnects int
+
+	// QueryDebounce, if non-zero, makes every query wait for this long before
+	// it actually starts; if another query comes in meanwhile, the waiting one
+	// is superseded by it. Also, a new query supersedes the one in progress,
+	// instead of failing with ErrBusyWithAnotherQuery. See ErrQuerySuperseded.
+	QueryDebounce time.Duration
+
+	// IdleTimeout, if non-zero, makes all the logstreams disconnect once
+	// there was no query activity (queries, verifications, ad hoc commands or
+	// keepalive pings from Ping) for this long; they are reconnected on the
+	// next activity, or on WakeUp. Keep in mind that the query which triggers
+	// reconnecting fails with ErrNotYetConnected, since the logstreams aren't
+	// connected yet; so the callers should call WakeUp and wait for the
+	// connection first, the same as Nerdlog.Query does.
+	IdleTimeout time.Duration
+
+	// AllowAdHocCmds, if true, allows running arbitrary shell commands on the
+	// hosts with RunAdHoc.
+	AllowAdHocCmds bool
+
+	// AdHocTimeout and AdHocMaxOutputSize limit the ad hoc commands; see
+	// RunAdHoc. If zero, DefaultAdHocTimeout and DefaultAdHocMaxOutputSize are
+	// used. AdHocMaxOutputSize can't exceed DefaultAdHocMaxOutputSize.
+	AdHocTimeout       time.Duration
+	AdHocMaxOutputSize int
+
+	// ShutdownGracePeriod is how long Shutdown waits for the busy logstreams
+	// to stop their commands, before closing the connections regardless. If
+	// zero, DefaultShutdownGracePeriod is used.
+	ShutdownGracePeriod time.Duration
+
+	// Metrics, if not nil, receives the metrics of all the logstreams, as well
+	// as of the LStreamsManager itself; see Metrics for the details.
+	Metrics Metrics
+
 	Logger *log.Logger
 
 	InitialLStreams string
 
+	// Selector, if not nil, restricts the logstreams to connect to for the
+	// session: the ones resolved from the spec but not matching the selector
+	// stay disconnected. It can be changed later with SelectStreams.
+	Selector LStreamSelector
+
 	InitialDefaultTransportMode *TransportMode
 
 	// ClientID is just an arbitrary string (should be filename-friendly though)
@@ -102,6 +281,22 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 
 	params.Logger = params.Logger.WithNamespaceAppended("LSMan")
 
+	if params.AdHocTimeout == 0 {
+		params.AdHocTimeout = DefaultAdHocTimeout
+	}
+
+	if params.AdHocMaxOutputSize <= 0 || params.AdHocMaxOutputSize > DefaultAdHocMaxOutputSize {
+		params.AdHocMaxOutputSize = DefaultAdHocMaxOutputSize
+	}
+
+	if params.Metrics == nil {
+		params.Metrics = NoopMetrics{}
+	}
+
+	if params.ShutdownGracePeriod == 0 {
+		params.ShutdownGracePeriod = DefaultShutdownGracePeriod
+	}
+
 	lsman := &LStreamsManager{
 		params: params,
 
@@ -109,6 +304,8 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 		lscStates:          map[string]LStreamClientState{},
 		lscConnDetails:     map[string]ConnDetails{},
 		lscBusyStages:      map[string]BusyStage{},
+		lscLastErrs:        map[string]lstreamConnErr{},
+		lscAWKDialects:     map[string]AWKDialect{},
 		lscPendingTeardown: map[string]int{},
 
 		lstreamUpdatesCh: make(chan *LStreamClientUpdate, 1024),
@@ -117,10 +314,32 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 
 		teardownReqCh: make(chan struct{}, 1),
 		torndownCh:    make(chan struct{}, 1),
+		shutdownReqCh: make(chan struct{}, 1),
 
 		defaultTransportMode: params.InitialDefaultTransportMode,
+		selector:             params.Selector,
+
+		connEvents: newConnEventsHub(),
+
+		transportAutoPicks: NewTransportAutoPicks(),
+
+		connectLimiter: newConnectLimiter(params.MaxConcurrentConnects),
+	}
+
+	if params.CoalesceConnections {
+		lsman.sshConnPool = NewSSHConnPool()
 	}
 
+	maxOpen, err := resolveMaxOpenStreams(params.MaxOpenStreams)
+	if err != nil {
+		params.Logger.Warnf("Not limiting the number of open logstreams: %s", err.Error())
+	} else if maxOpen.numFDs != 0 {
+		params.Logger.Infof(
+			"Max number of open logstreams: %d (RLIMIT_NOFILE is %d)", maxOpen.max, maxOpen.numFDs,
+		)
+	}
+	lsman.maxOpenStreams = maxOpen
+
 	if err := lsman.setLStreams(params.InitialLStreams); err != nil {
 		panic("setLStreams didn't like the initial logStreamsSpec: " + err.Error())
 	}
@@ -129,6 +348,8 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 	lsman.updateLStreamsByState()
 	lsman.sendStateUpdate()
 
+	lsman.markActivity()
+
 	go lsman.run()
 
 	return lsman
@@ -173,9 +394,51 @@ func (lsman *LStreamsManager) setDefaultTransportMode(defaultTransportMode *Tran
 const LocalShellCommand = "/bin/sh"
 
 func (lsman *LStreamsManager) setLStreams(lstreamsStr string) error {
+	parsedLogStreams, lstreamsOrder, err := lsman.resolveLStreams(lstreamsStr, lsman.params.ConfigLogStreams)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// All went well, remember the logstreams spec
+	lsman.lstreamsStr = lstreamsStr
+	lsman.parsedLogStreams = parsedLogStreams
+	lsman.lstreamsOrder = lstreamsOrder
+
+	return nil
+}
+
+// ValidateLStreams checks the InitialLStreams spec from the given params in
+// the same way as NewLStreamsManager does: it's resolved, and the number of
+// the selected logstreams is checked against the MaxOpenStreams. Since
+// NewLStreamsManager panics on an invalid initial spec, the spec coming from
+// the user should be validated first.
+func ValidateLStreams(params LStreamsManagerParams) error {
+	maxOpen, err := resolveMaxOpenStreams(params.MaxOpenStreams)
+	if err != nil {
+		// Same as NewLStreamsManager, just don't limit it.
+		maxOpen = maxOpenStreams{}
+	}
+
+	lsman := &LStreamsManager{
+		params:               params,
+		defaultTransportMode: params.InitialDefaultTransportMode,
+		selector:             params.Selector,
+		maxOpenStreams:       maxOpen,
+	}
+
+	_, _, err = lsman.resolveLStreams(params.InitialLStreams, params.ConfigLogStreams)
+	return errors.Trace(err)
+}
+
+// resolveLStreams resolves the given logstreams spec using the given
+// nerdlog config, and the rest of the config from the params. Along with the
+// logstreams, it returns their names in the config order.
+func (lsman *LStreamsManager) resolveLStreams(
+	lstreamsStr string, configLogStreams ConfigLogStreams,
+) (map[string]LogStream, []string, error) {
 	u, err := user.Current()
 	if err != nil {
-		return errors.Annotatef(err, "getting current OS user")
+		return nil, nil, errors.Annotatef(err, "getting current OS user")
 	}
 
 	resolver := NewLStreamsResolver(LStreamsResolverParams{
@@ -183,20 +446,33 @@ func (lsman *LStreamsManager) setLStreams(lstreamsStr string) error {
 
 		DefaultTransportMode: lsman.defaultTransportMode,
 
-		ConfigLogStreams: lsman.params.ConfigLogStreams,
+		ConfigLogStreams: configLogStreams,
 		SSHConfig:        lsman.params.SSHConfig,
 	})
 
-	parsedLogStreams, err := resolver.Resolve(lstreamsStr)
+	lstreams, err := resolver.ResolveList(lstreamsStr)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 
-	// All went well, remember the logstreams spec
-	lsman.lstreamsStr = lstreamsStr
-	lsman.parsedLogStreams = parsedLogStreams
+	parsedLogStreams := make(map[string]LogStream, len(lstreams))
+	for _, ls := range lstreams {
+		parsedLogStreams[ls.Name] = ls
+	}
 
-	return nil
+	selected := selectLStreams(parsedLogStreams, lsman.selector)
+	if err := lsman.maxOpenStreams.check(len(selected)); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	order := make([]string, 0, len(selected))
+	for _, ls := range lstreams {
+		if _, ok := selected[ls.Name]; ok {
+			order = append(order, ls.Name)
+		}
+	}
+
+	return selected, order, nil
 }
 
 func (lsman *LStreamsManager) updateHAs() {
@@ -208,38 +484,100 @@ func (lsman *LStreamsManager) updateHAs() {
 		}
 
 		// We used to use this logstream, but now it's filtered out, so close it
-		lsman.params.Logger.Verbose1f("Closing LSClient %s", key)
-		delete(lsman.lscs, key)
-		delete(lsman.lscStates, key)
-		delete(lsman.lscConnDetails, key)
-		delete(lsman.lscBusyStages, key)
+		lsman.closeLSClient(key, oldHA)
+	}
 
-		keyNew := fmt.Sprintf("OLD_%s_%s", lsman.randomString(4), key)
-		lsman.lscPendingTeardown[keyNew] += 1
-		oldHA.Close(keyNew)
+	// The config order of the logstreams, for the connectLimiter queue.
+	configOrder := make(map[string]int, len(lsman.lstreamsOrder))
+	for i, key := range lsman.lstreamsOrder {
+		configOrder[key] = i
 	}
 
-	// Create new logstream clients
-	for key, ls := range lsman.parsedLogStreams {
+	// Create new logstream clients. Every client starts connecting right
+	// away (or gets in the connectLimiter queue), so they're created in the
+	// order of priority; see ConfigLogStreamOptions.Priority.
+	for _, key := range sortByConnectPriority(lsman.lstreamsOrder, lsman.parsedLogStreams) {
+		ls := lsman.parsedLogStreams[key]
 		if _, ok := lsman.lscs[key]; ok {
 			// This logstream client already exists
 			continue
 		}
 
 		// We need to create a new logstream client
+		var transport ShellTransport
+		if lsman.params.NewTransport != nil {
+			transport = lsman.params.NewTransport(ls)
+		}
+
 		lsc := NewLStreamClient(LStreamClientParams{
 			LogStream: ls,
 			SSHKeys:   lsman.params.SSHKeys,
-			Logger:    lsman.params.Logger,
+			SSHCert:   lsman.params.SSHCert,
+			SSHPKCS11: lsman.params.SSHPKCS11,
+			HostKeys:  lsman.params.HostKeys,
+			Transport: transport,
+
+			SSHCredentialProvider: lsman.params.SSHCredentialProvider,
+
+			SSHConnPool:        lsman.sshConnPool,
+			TransportAutoPicks: lsman.transportAutoPicks,
+
+			CapabilitiesCache: lsman.params.CapabilitiesCache,
+			QueryCache:        lsman.params.QueryCache,
+			Logger:            lsman.params.Logger,
+
 			ClientID:  lsman.params.ClientID, //fmt.Sprintf("%s-%d", lsman.params.ClientID, rand.Int()),
 			UpdatesCh: lsman.lstreamUpdatesCh,
 			Clock:     lsman.params.Clock,
+
+			MaxConcurrentQueries: lsman.params.MaxConcurrentQueries,
+
+			Metrics: lsman.params.Metrics,
+
+			connEvents: lsman.connEvents,
+
+			connectLimiter: lsman.connectLimiter,
+			connectOrder:   configOrder[key],
 		})
 		lsman.lscs[key] = lsc
 		lsman.lscStates[key] = LStreamClientStateDisconnected
+
+		// If all the other logstreams are disconnected because of being idle,
+		// this one shouldn't stay connected either.
+		if lsman.idleDisconnected {
+			lsc.SetParked(true)
+		}
 	}
 }
 
+// sortByConnectPriority returns the given names of the logstreams in the
+// order to connect to them: the higher ConfigLogStreamOptions.Priority goes
+// first, and the same priority keeps the given order.
+func sortByConnectPriority(names []string, lstreams map[string]LogStream) []string {
+	ret := append([]string(nil), names...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return lstreams[ret[i]].Options.Priority > lstreams[ret[j]].Options.Priority
+	})
+
+	return ret
+}
+
+// closeLSClient forgets the given logstream client and closes it; the
+// teardown is tracked in lscPendingTeardown.
+func (lsman *LStreamsManager) closeLSClient(key string, lsc *LStreamClient) {
+	lsman.params.Logger.Verbose1f("Closing LSClient %s", key)
+	delete(lsman.lscs, key)
+	delete(lsman.lscStates, key)
+	delete(lsman.lscConnDetails, key)
+	delete(lsman.lscBusyStages, key)
+	delete(lsman.lscLastErrs, key)
+	delete(lsman.lscAWKDialects, key)
+
+	keyNew := fmt.Sprintf("OLD_%s_%s", lsman.randomString(4), key)
+	lsman.lscPendingTeardown[keyNew] += 1
+	lsc.Close(keyNew)
+}
+
 func (lsman *LStreamsManager) run() {
 	lsclientsByState := map[LStreamClientState]map[string]struct{}{}
 	for name := range lsman.lscs {
@@ -266,6 +604,8 @@ func (lsman *LStreamsManager) run() {
 						cd := lsman.lscConnDetails[upd.Name]
 						cd.Connected = true
 						lsman.lscConnDetails[upd.Name] = cd
+
+						delete(lsman.lscLastErrs, upd.Name)
 					}
 
 					// Maintain lsman.lscBusyStages
@@ -286,25 +626,59 @@ func (lsman *LStreamsManager) run() {
 
 				lsman.updateLStreamsByState()
 				lsman.sendStateUpdate()
+
+				if lsman.shuttingDown && lsman.continueShutdown() {
+					return
+				}
 			} else if upd.ConnDetails != nil {
 				lsman.params.Logger.Verbose1f("ConnDetails for %s: %+v", upd.Name, *upd.ConnDetails)
 				lsman.lscConnDetails[upd.Name] = *upd.ConnDetails
+
+				// Maintain lsman.lscLastErrs. NOTE: we don't delete the error here
+				// when ConnDetails.Err is empty, because it's also empty for the
+				// debug messages from the next attempt.
+				if upd.ConnDetails.Err != "" {
+					if _, ok := lsman.lscStates[upd.Name]; ok {
+						lsman.lscLastErrs[upd.Name] = lstreamConnErr{
+							err:      upd.ConnDetails.Err,
+							category: upd.ConnDetails.ErrCategory,
+						}
+					}
+				}
+
 				lsman.sendStateUpdate()
 			} else if upd.BootstrapDetails != nil {
 				lsman.params.Logger.Verbose1f("BootstrapDetails for %s: %+v", upd.Name, *upd.BootstrapDetails)
 
+				if upd.BootstrapDetails.Err != "" {
+					if _, ok := lsman.lscStates[upd.Name]; ok {
+						lsman.lscLastErrs[upd.Name] = lstreamConnErr{
+							err:       upd.BootstrapDetails.Err,
+							bootstrap: true,
+							category:  upd.BootstrapDetails.ErrCategory,
+						}
+						lsman.updateFleetSummary()
+					}
+				}
+
 				upd := LStreamsManagerUpdate{
 					BootstrapIssue: &BootstrapIssue{
 						LStreamName: upd.Name,
 						Err:         upd.BootstrapDetails.Err,
 
 						WarnJournalctlNoAdminAccess: upd.BootstrapDetails.WarnJournalctlNoAdminAccess,
+						WarnClockSkew:               upd.BootstrapDetails.WarnClockSkew,
+						WarnWireCompression:         upd.BootstrapDetails.WarnWireCompression,
 					},
 				}
 				lsman.params.UpdatesCh <- upd
 			} else if upd.BusyStage != nil {
 				lsman.lscBusyStages[upd.Name] = *upd.BusyStage
 				lsman.sendStateUpdate()
+			} else if upd.AWKDialect != "" {
+				if _, ok := lsman.lscStates[upd.Name]; ok {
+					lsman.lscAWKDialects[upd.Name] = upd.AWKDialect
+				}
 			} else if upd.DataRequest != nil {
 				lsman.params.UpdatesCh <- LStreamsManagerUpdate{
 					DataRequest: upd.DataRequest,
@@ -352,6 +726,7 @@ func (lsman *LStreamsManager) run() {
 					// If the whole LStreamsManager was shutting down, we're done now.
 					if lsman.tearingDown {
 						lsman.params.Logger.Infof("LStreamsManager teardown is completed")
+						lsman.connEvents.close()
 						close(lsman.torndownCh)
 						return
 					}
@@ -363,96 +738,64 @@ func (lsman *LStreamsManager) run() {
 		case req := <-lsman.reqCh:
 			switch {
 			case req.queryLogs != nil:
-				if len(lsman.lscs) == 0 {
+				if lsman.shuttingDown {
 					lsman.sendLogRespUpdate(&LogRespTotal{
-						Errs: []error{errors.Errorf("no matching lstreams to get logs from")},
+						Errs: []error{ErrShuttingDown},
 					})
 					continue
 				}
 
-				if lsman.numNotConnected > 0 {
-					lsman.sendLogRespUpdate(&LogRespTotal{
-						Errs: []error{ErrNotYetConnected},
-					})
+				lsman.markActivity()
+
+				if lsman.params.QueryDebounce > 0 {
+					lsman.debounceQuery(req.queryLogs)
 					continue
 				}
 
+				lsman.startQueryLogs(req.queryLogs)
+
+			case req.updLStreams != nil:
+				r := req.updLStreams
+				lsman.params.Logger.Infof("LStreams manager: update logstreams spec: %s", r.logStreamsSpec)
+
 				if lsman.curQueryLogsCtx != nil {
-					lsman.sendLogRespUpdate(&LogRespTotal{
-						Errs: []error{ErrBusyWithAnotherQuery},
-					})
+					r.resCh <- ErrBusyWithAnotherQuery
 					continue
 				}
 
-				if req.queryLogs.MaxNumLines == 0 {
-					panic("req.queryLogs.MaxNumLines is zero")
-				}
-
-				lsman.curQueryLogsCtx = &manQueryLogsCtx{
-					req:       req.queryLogs,
-					startTime: lsman.params.Clock.Now(),
-					resps:     make(map[string]*LogResp, len(lsman.lscs)),
-					errs:      map[string]error{},
+				if err := lsman.setLStreams(r.logStreamsSpec); err != nil {
+					r.resCh <- errors.Trace(err)
+					continue
 				}
 
-				// sendStateUpdate must be done after setting curQueryLogsCtx.
+				lsman.updateHAs()
+				lsman.updateLStreamsByState()
 				lsman.sendStateUpdate()
 
-				for lstreamName, lsc := range lsman.lscs {
-					cmdQueryLogs := lstreamCmdQueryLogs{
-						maxNumLines: req.queryLogs.MaxNumLines,
+				r.resCh <- nil
 
-						from:  req.queryLogs.From,
-						to:    req.queryLogs.To,
-						query: req.queryLogs.Query,
+			case req.setDefaultTransportMode != nil:
+				r := req.setDefaultTransportMode
+				lsman.params.Logger.Infof("LStreams manager: setting defaultTransportMode: %s", r.defaultTransportMode.String())
 
-						refreshIndex: req.queryLogs.RefreshIndex,
-					}
+				lsman.setDefaultTransportMode(r.defaultTransportMode)
 
-					if req.queryLogs.LoadEarlier {
-						// TODO: right now, this loadEarlier case isn't optimized at all:
-						// we again query the whole timerange, and every node goes through
-						// all same lines and builds all the same mstats again (which we
-						// then ignore). We can optimize it; however honestly the actual
-						// performance, as per my experiments, isn't going to be
-						// SPECTACULARLY better. Just kinda marginally better (try loading
-						// older logs with time period 5h or 1m: the 1m is somewhat faster,
-						// but not super fast. That's the difference we're talking about)
-						//
-						// Anyway, the way to optimize it is as follows: we already have
-						// mstats, so we know what kind of timeframe we should query to get
-						// the next maxNumLines messages. So we should query only this time
-						// range, and we should avoid building any mstats. This way, no
-						// matter how large the current time period is, loading more
-						// messages will be as fast as possible.
-
-						if nodeCtx, ok := lsman.curLogs.perNode[lstreamName]; ok {
-							if len(nodeCtx.logs) > 0 {
-								if nodeCtx.logs[0].LogFilename == SpecialFilenameJournalctl {
-									cmdQueryLogs.timestampUntil = getEarliestTimeAndNumMsgs(nodeCtx.logs)
-								} else {
-									cmdQueryLogs.linesUntil = nodeCtx.logs[0].CombinedLinenumber
-								}
-							}
-						}
-					}
+				r.resCh <- struct{}{}
 
-					lsc.EnqueueCmd(lstreamCmd{
-						respCh:    lsman.respCh,
-						queryLogs: &cmdQueryLogs,
-					})
-				}
-
-			case req.updLStreams != nil:
-				r := req.updLStreams
-				lsman.params.Logger.Infof("LStreams manager: update logstreams spec: %s", r.logStreamsSpec)
+			case req.selectStreams != nil:
+				r := req.selectStreams
+				lsman.params.Logger.Infof("LStreams manager: updating the selector")
 
 				if lsman.curQueryLogsCtx != nil {
 					r.resCh <- ErrBusyWithAnotherQuery
 					continue
 				}
 
-				if err := lsman.setLStreams(r.logStreamsSpec); err != nil {
+				oldSelector := lsman.selector
+				lsman.selector = r.selector
+
+				if err := lsman.setLStreams(lsman.lstreamsStr); err != nil {
+					lsman.selector = oldSelector
 					r.resCh <- errors.Trace(err)
 					continue
 				}
@@ -463,15 +806,25 @@ func (lsman *LStreamsManager) run() {
 
 				r.resCh <- nil
 
-			case req.setDefaultTransportMode != nil:
-				r := req.setDefaultTransportMode
-				lsman.params.Logger.Infof("LStreams manager: setting defaultTransportMode: %s", r.defaultTransportMode.String())
+			case req.reload != nil:
+				lsman.reload(req.reload)
 
-				lsman.setDefaultTransportMode(r.defaultTransportMode)
+			case req.verify != nil:
+				lsman.markActivity()
+				lsman.startVerify(req.verify)
 
-				r.resCh <- struct{}{}
+			case req.adHoc != nil:
+				lsman.markActivity()
+				lsman.startAdHoc(req.adHoc)
+
+			case req.wakeUp:
+				lsman.markActivity()
+
+			case req.stopQuery:
+				lsman.stopQuery()
 
 			case req.ping:
+				lsman.markActivity()
 				for _, lsc := range lsman.lscs {
 					lsc.EnqueueCmd(lstreamCmd{
 						ping: &lstreamCmdPing{},
@@ -480,10 +833,8 @@ func (lsman *LStreamsManager) run() {
 
 			case req.reconnect:
 				lsman.params.Logger.Infof("Reconnect command")
-				if lsman.curQueryLogsCtx != nil {
-					lsman.params.Logger.Infof("Forgetting the in-progress query")
-					lsman.curQueryLogsCtx = nil
-				}
+				lsman.forgetCurQuery()
+				lsman.markActivity()
 				for _, lsc := range lsman.lscs {
 					lsc.Reconnect()
 				}
@@ -496,10 +847,7 @@ func (lsman *LStreamsManager) run() {
 
 			case req.disconnect:
 				lsman.params.Logger.Infof("Disconnect command")
-				if lsman.curQueryLogsCtx != nil {
-					lsman.params.Logger.Infof("Forgetting the in-progress query")
-					lsman.curQueryLogsCtx = nil
-				}
+				lsman.forgetCurQuery()
 				lsman.setLStreams("")
 
 				lsman.updateHAs()
@@ -511,7 +859,9 @@ func (lsman *LStreamsManager) run() {
 			lsman.params.Logger.Verbose1f("Got a response from %v: %+v", resp.hostname, resp)
 
 			switch {
-			case lsman.curQueryLogsCtx != nil:
+			case lsman.curQueryLogsCtx != nil && resp.queryID == lsman.curQueryLogsCtx.id:
+				lsman.curQueryLogsCtx.numInFlight--
+
 				if resp.err != nil {
 					lsman.params.Logger.Errorf("Got an error response from %v: %s", resp.hostname, resp.err)
 					lsman.curQueryLogsCtx.errs[resp.hostname] = resp.err
@@ -521,8 +871,12 @@ func (lsman *LStreamsManager) run() {
 				case *LogResp:
 					lsman.curQueryLogsCtx.resps[resp.hostname] = v
 
+					if v.PinLast != "" && lsman.pins != nil {
+						lsman.pins[resp.hostname] = v.PinLast
+					}
+
 					// If we collected responses from all nodes, handle them.
-					if len(lsman.curQueryLogsCtx.resps) == len(lsman.lscs) {
+					if len(lsman.curQueryLogsCtx.resps) == lsman.curQueryLogsCtx.numLStreams {
 						lsman.params.Logger.Verbose1f(
 							"Got logs from %v, this was the last one, query is completed",
 							resp.hostname,
@@ -530,16 +884,22 @@ func (lsman *LStreamsManager) run() {
 
 						lsman.mergeLogRespsAndSend()
 
+						lsman.curQueryLogsCtx.cancel()
 						lsman.curQueryLogsCtx = nil
 
+						// The idle countdown starts once the query is done.
+						lsman.markActivity()
+
 						// sendStateUpdate must be done after setting curQueryLogsCtx.
 						lsman.sendStateUpdate()
 					} else {
 						lsman.params.Logger.Verbose1f(
 							"Got logs from %v, %d more to go",
 							resp.hostname,
-							len(lsman.lscs)-len(lsman.curQueryLogsCtx.resps),
+							lsman.curQueryLogsCtx.numLStreams-len(lsman.curQueryLogsCtx.resps),
 						)
+
+						lsman.dispatchPendingQueries()
 					}
 
 				default:
@@ -550,27 +910,417 @@ func (lsman *LStreamsManager) run() {
 				lsman.params.Logger.Errorf("Dropping update from %s on the floor", resp.hostname)
 			}
 
+		case <-lsman.debounceCh:
+			lsman.startDebouncedQuery()
+
+		case <-lsman.idleCh:
+			lsman.disconnectIdle()
+
 		case <-lsman.teardownReqCh:
-			lsman.params.Logger.Infof("LStreamsManager teardown is started")
-			lsman.tearingDown = true
-			lsman.setLStreams("")
-
-			lsman.updateHAs()
-			lsman.updateLStreamsByState()
-
-			// Check if we don't need to wait for anything, and can teardown right away.
-			numPending := lsman.getNumLStreamClientsTearingDown()
-			if numPending == 0 {
-				lsman.params.Logger.Infof("LStreamsManager teardown is completed")
-				close(lsman.torndownCh)
+			if lsman.teardown() {
+				return
+			}
+
+		case <-lsman.shutdownReqCh:
+			if lsman.startShutdown() {
 				return
 			}
 
-			// We still need to wait for some LStreamClient-s to teardown, so send an
-			// update for now and keep going.
-			lsman.sendStateUpdate()
+		case <-lsman.shutdownGraceCh:
+			lsman.shutdownGraceCh = nil
+			lsman.params.Logger.Infof("Shutdown grace period has passed, closing the busy logstreams")
+
+			if lsman.teardown() {
+				return
+			}
+		}
+	}
+}
+
+// teardown disconnects from all the logstreams, and returns true if the
+// teardown is completed right away, in which case the caller (the run loop)
+// must return. Otherwise, it's completed once all the LStreamClient-s have
+// torn down. Does nothing if the teardown is in progress already.
+func (lsman *LStreamsManager) teardown() (done bool) {
+	if lsman.tearingDown {
+		return false
+	}
+
+	lsman.params.Logger.Infof("LStreamsManager teardown is started")
+	lsman.tearingDown = true
+	lsman.setLStreams("")
+
+	lsman.updateHAs()
+	lsman.updateLStreamsByState()
+
+	// Check if we don't need to wait for anything, and can teardown right away.
+	numPending := lsman.getNumLStreamClientsTearingDown()
+	if numPending == 0 {
+		lsman.params.Logger.Infof("LStreamsManager teardown is completed")
+		lsman.connEvents.close()
+		close(lsman.torndownCh)
+		return true
+	}
+
+	// We still need to wait for some LStreamClient-s to teardown, so send an
+	// update for now and keep going.
+	lsman.sendStateUpdate()
+
+	return false
+}
+
+// startQueryLogs sends the query to all the logstreams (or the ones allowed
+// by the params), or fails it right away by sending the LogResp with the
+// error.
+func (lsman *LStreamsManager) startQueryLogs(params *QueryLogsParams) {
+	if len(lsman.lscs) == 0 {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Errorf("no matching lstreams to get logs from")},
+		})
+		return
+	}
+
+	var resumed *manResumableQuery
+	if params.ResumeToken != nil {
+		var err error
+		resumed, err = lsman.getResumableQuery(params.ResumeToken)
+		if err != nil {
+			lsman.sendLogRespUpdate(&LogRespTotal{
+				Errs: []error{err},
+			})
+			return
+		}
+
+		// The resumed query is the same as the original one.
+		resumedParams := *resumed.req
+		resumedParams.ResumeToken = params.ResumeToken
+		params = &resumedParams
+	}
+
+	queryLSCs, skipped, err := lsman.getQueryLStreams(params)
+	if err != nil {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{err},
+		})
+		return
+	}
+
+	if lsman.curQueryLogsCtx != nil {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{ErrBusyWithAnotherQuery},
+		})
+		return
+	}
+
+	if params.MaxNumLines == 0 {
+		panic("params.MaxNumLines is zero")
+	}
+
+	if params.LoadEarlier && params.LoadNewer {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Errorf("can't load earlier and newer logs at the same time")},
+		})
+		return
+	}
+
+	if params.AggregateOnly && (params.LoadEarlier || params.LoadNewer) {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Errorf("can't load more logs for the aggregate-only query")},
+		})
+		return
+	}
+
+	if params.TailNumLines < 0 {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Errorf("invalid number of lines to tail: %d", params.TailNumLines)},
+		})
+		return
+	}
+
+	if params.TailNumLines > 0 && (params.LoadEarlier || params.LoadNewer) {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Errorf("can't load more logs for the tail query")},
+		})
+		return
+	}
+
+	// The regexes in the filter are translated to the awk dialect of every
+	// logstream, so we need a separate filter for every dialect.
+	var filters map[AWKDialect]FilterExpr
+	if params.QueryLang == QueryLangFilter && params.Query != "" {
+		awkDialects := make(map[string]AWKDialect, len(queryLSCs))
+		for name := range queryLSCs {
+			awkDialects[name] = lsman.getAWKDialect(name)
+		}
+
+		var err error
+		filters, err = translateFilterQuery(params.Query, awkDialects)
+		if err != nil {
+			lsman.sendLogRespUpdate(&LogRespTotal{
+				Errs: []error{err},
+			})
+			return
+		}
+	}
+
+	projection, err := ParseProjection(params.Select)
+	if err != nil {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Annotatef(err, "parsing select")},
+		})
+		return
+	}
+
+	groupBy, err := ParseGroupBy(params.GroupBy)
+	if err != nil {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Annotatef(err, "parsing group by")},
+		})
+		return
+	}
+
+	correlation, err := parseCorrelation(params.CorrelateKey, params.CorrelateValues)
+	if err != nil {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Annotatef(err, "parsing correlation")},
+		})
+		return
+	}
+
+	if n := params.StatsBucketMinutes; n < 0 || (n > 1 && maxStatsBucketMinutes%n != 0) {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Errorf("invalid stats bucket %d minutes: must divide %d", n, maxStatsBucketMinutes)},
+		})
+		return
+	}
+
+	if err := validateAgentEnv(params.AgentEnv); err != nil {
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{errors.Annotatef(err, "agent env")},
+		})
+		return
+	}
+
+	if len(skipped) > 0 {
+		lsman.params.Logger.Infof("Skipping not connected logstreams: %v", skipped)
+	}
+
+	// Whatever query we start, the saved one can't be resumed anymore.
+	lsman.resumableQuery = nil
+	if resumed != nil {
+		skipped = append(skipped, resumed.skipped...)
+		sort.Strings(skipped)
+	}
+
+	lsman.skippedLStreams = make(map[string]struct{}, len(skipped))
+	for _, name := range skipped {
+		lsman.skippedLStreams[name] = struct{}{}
+	}
+
+	// The pins are only kept while the queries are pinned, so that the next
+	// pinned query after an unpinned one pins the logs anew.
+	if !params.Pin {
+		lsman.pins = nil
+	} else if lsman.pins == nil {
+		lsman.pins = map[string]string{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lsman.nextQueryID++
+	lsman.curQueryLogsCtx = &manQueryLogsCtx{
+		id:          lsman.nextQueryID,
+		ctx:         ctx,
+		cancel:      cancel,
+		req:         params,
+		startTime:   lsman.params.Clock.Now(),
+		numLStreams: len(queryLSCs),
+		skipped:     skipped,
+		resps:       make(map[string]*LogResp, len(queryLSCs)),
+		errs:        map[string]error{},
+		resumed:     resumed,
+	}
+
+	if params.LoadNewer {
+		lsman.curQueryLogsCtx.newerFrom = make(map[string]time.Time, len(queryLSCs))
+	}
+
+	// sendStateUpdate must be done after setting curQueryLogsCtx.
+	lsman.sendStateUpdate()
+
+	lstreamNames := make([]string, 0, len(queryLSCs))
+	for name := range queryLSCs {
+		lstreamNames = append(lstreamNames, name)
+	}
+	sort.Strings(lstreamNames)
+
+	for _, lstreamName := range lstreamNames {
+		cmdQueryLogs := lstreamCmdQueryLogs{
+			queryID: lsman.curQueryLogsCtx.id,
+			ctx:     ctx,
+
+			maxNumLines: params.MaxNumLines,
+
+			from:  params.From,
+			to:    params.To,
+			query: params.Query,
+			filterMatchOpts: FilterMatchOpts{
+				CaseSensitive: !params.FilterIgnoreCase,
+				WholeWord:     params.FilterWholeWord,
+			},
+			correlation: correlation,
+
+			projection: projection,
+			groupBy:    groupBy,
+			sampleRate: params.SampleRate,
+			agentEnv:   params.AgentEnv,
+
+			statsBucketMinutes: params.StatsBucketMinutes,
+			aggregateOnly:      params.AggregateOnly,
+
+			refreshIndex: params.RefreshIndex,
+		}
+
+		if filters != nil {
+			cmdQueryLogs.filterAWKDialect = lsman.getAWKDialect(lstreamName)
+			cmdQueryLogs.filter = filters[cmdQueryLogs.filterAWKDialect]
+		}
+
+		if params.TailNumLines > 0 {
+			cmdQueryLogs.maxNumLines = params.TailNumLines
+			cmdQueryLogs.tailNumLines = params.TailNumLines
+			cmdQueryLogs.from = time.Time{}
+			cmdQueryLogs.to = time.Time{}
+		}
+
+		if params.Pin {
+			cmdQueryLogs.pinLast = lsman.pins[lstreamName]
+			if cmdQueryLogs.pinLast == "" {
+				cmdQueryLogs.pinLast = pinLastNow
+			}
+		}
+
+		if params.LoadEarlier {
+			// TODO: right now, this loadEarlier case isn't optimized at all:
+			// we again query the whole timerange, and every node goes through
+			// all same lines and builds all the same mstats again (which we
+			// then ignore). We can optimize it; however honestly the actual
+			// performance, as per my experiments, isn't going to be
+			// SPECTACULARLY better. Just kinda marginally better (try loading
+			// older logs with time period 5h or 1m: the 1m is somewhat faster,
+			// but not super fast. That's the difference we're talking about)
+			//
+			// Anyway, the way to optimize it is as follows: we already have
+			// mstats, so we know what kind of timeframe we should query to get
+			// the next maxNumLines messages. So we should query only this time
+			// range, and we should avoid building any mstats. This way, no
+			// matter how large the current time period is, loading more
+			// messages will be as fast as possible.
+
+			if nodeCtx, ok := lsman.curLogs.perNode[lstreamName]; ok {
+				if len(nodeCtx.logs) > 0 {
+					if IsTimestampAddressed(nodeCtx.logs[0].LogFilename) {
+						cmdQueryLogs.timestampUntil = getEarliestTimeAndNumMsgs(nodeCtx.logs)
+					} else if len(lsman.parsedLogStreams[lstreamName].Sources) > 0 {
+						cmdQueryLogs.sourceLinesUntil = getSourceLinesUntil(nodeCtx.logs)
+					} else {
+						cmdQueryLogs.linesUntil = nodeCtx.logs[0].CombinedLinenumber
+					}
+				}
+			}
+		}
+
+		if params.LoadNewer {
+			cmdQueryLogs.from = getNewerFrom(params.From, lsman.curLogs.perNode[lstreamName].logs)
+			lsman.curQueryLogsCtx.newerFrom[lstreamName] = cmdQueryLogs.from
 		}
+
+		lsman.curQueryLogsCtx.pending = append(lsman.curQueryLogsCtx.pending, pendingLStreamQuery{
+			lsc: queryLSCs[lstreamName],
+			cmd: &cmdQueryLogs,
+		})
 	}
+
+	lsman.dispatchPendingQueries()
+}
+
+// getQueryLStreams returns the logstreams to send the query to, and the sorted
+// names of the ones which are skipped, as per the SkipNotConnected and
+// RetrySkipped params. If some logstreams aren't connected and they can't be
+// skipped, or if none are left, it returns ErrNotYetConnected.
+func (lsman *LStreamsManager) getQueryLStreams(
+	params *QueryLogsParams,
+) (map[string]*LStreamClient, []string, error) {
+	candidates := lsman.lscs
+	if params.ResumeToken != nil {
+		candidates = make(map[string]*LStreamClient, len(params.ResumeToken.Pending))
+		for _, name := range lsman.resumableQuery.token.Pending {
+			candidates[name] = lsman.lscs[name]
+		}
+	} else if params.RetrySkipped {
+		if params.LoadEarlier || params.LoadNewer {
+			return nil, nil, errors.Errorf("can't load earlier or newer logs while retrying skipped lstreams")
+		}
+
+		candidates = map[string]*LStreamClient{}
+		for name := range lsman.skippedLStreams {
+			if lsc, ok := lsman.lscs[name]; ok {
+				candidates[name] = lsc
+			}
+		}
+
+		if len(candidates) == 0 {
+			return nil, nil, errors.Errorf("no skipped lstreams to retry")
+		}
+	}
+
+	lscs := make(map[string]*LStreamClient, len(candidates))
+	var skipped []string
+
+	for name, lsc := range candidates {
+		switch {
+		case (params.LoadEarlier || params.LoadNewer) && lsman.curLogs.perNode[name] == nil:
+			// This logstream was skipped by the original query, so there is
+			// nothing to load earlier or newer logs for; it stays skipped.
+			skipped = append(skipped, name)
+
+		case !isStateConnected(lsman.lscStates[name]):
+			if !params.SkipNotConnected {
+				return nil, nil, ErrNotYetConnected
+			}
+
+			skipped = append(skipped, name)
+
+		default:
+			lscs[name] = lsc
+		}
+	}
+
+	if len(lscs) == 0 {
+		return nil, nil, ErrNotYetConnected
+	}
+
+	sort.Strings(skipped)
+
+	return lscs, skipped, nil
+}
+
+// getNewerFrom returns the time since which to query the logs newer than the
+// given ones, for QueryLogsParams.LoadNewer: it's the start of the minute of
+// the latest message, since the agent only takes the minute-precise --from,
+// and so this minute is queried again as a whole. If there are no logs, it's
+// just the from of the original query.
+func getNewerFrom(from time.Time, logs []LogMsg) time.Time {
+	if len(logs) == 0 {
+		return from
+	}
+
+	newerFrom := logs[len(logs)-1].Time.Truncate(time.Minute)
+	if newerFrom.Before(from) {
+		return from
+	}
+
+	return newerFrom
 }
 
 type timeAndNumMsgs struct {
@@ -629,8 +1379,14 @@ type lstreamsManagerReq struct {
 
 	queryLogs               *QueryLogsParams
 	updLStreams             *lstreamsManagerReqUpdLStreams
+	selectStreams           *lstreamsManagerReqSelectStreams
 	setDefaultTransportMode *lstreamsManagerReqSetDefaultTransportMode
+	reload                  *lstreamsManagerReqReload
+	verify                  *lstreamsManagerReqVerify
+	adHoc                   *lstreamsManagerReqAdHoc
 	ping                    bool
+	wakeUp                  bool
+	stopQuery               bool
 	reconnect               bool
 	disconnect              bool
 }
@@ -640,6 +1396,11 @@ type lstreamsManagerReqUpdLStreams struct {
 	resCh          chan<- error
 }
 
+type lstreamsManagerReqSelectStreams struct {
+	selector LStreamSelector
+	resCh    chan<- error
+}
+
 type lstreamsManagerReqSetDefaultTransportMode struct {
 	defaultTransportMode *TransportMode
 	resCh                chan<- struct{}
@@ -665,12 +1426,56 @@ func (lsman *LStreamsManager) SetLStreams(logStreamsSpec string) error {
 	return <-resCh
 }
 
+// SelectStreams replaces the session selector (see
+// LStreamsManagerParams.Selector): the current logstreams spec is resolved
+// again, the newly selected logstreams are connected, and the ones which
+// aren't selected anymore are disconnected. A nil selector selects all the
+// logstreams.
+//
+// Same as with SetLStreams, it fails with ErrBusyWithAnotherQuery if a query
+// is in progress.
+func (lsman *LStreamsManager) SelectStreams(selector LStreamSelector) error {
+	resCh := make(chan error, 1)
+
+	lsman.reqCh <- lstreamsManagerReq{
+		selectStreams: &lstreamsManagerReqSelectStreams{
+			selector: selector,
+			resCh:    resCh,
+		},
+	}
+
+	return <-resCh
+}
+
+// Subscribe returns the channel which receives the updates from the
+// transports of all logstreams (connection debug info, data requests and
+// results), and the function to unsubscribe, which closes the channel.
+//
+// The events are buffered for every subscriber separately, so a slow
+// subscriber never blocks the transports or other subscribers; if it falls
+// too far behind, the oldest DebugInfo events are dropped (see
+// ConnEvent.NumDropped), but other events are never dropped. Once the
+// LStreamsManager is torn down, the channel is closed after delivering the
+// pending events.
+func (lsman *LStreamsManager) Subscribe() (<-chan ConnEvent, func()) {
+	return lsman.connEvents.subscribe()
+}
+
 func (lsman *LStreamsManager) Ping() {
 	lsman.reqCh <- lstreamsManagerReq{
 		ping: true,
 	}
 }
 
+// WakeUp counts as the query activity for the IdleTimeout: if the logstreams
+// are disconnected because of being idle, it makes them reconnect, and
+// otherwise it just restarts the idle countdown.
+func (lsman *LStreamsManager) WakeUp() {
+	lsman.reqCh <- lstreamsManagerReq{
+		wakeUp: true,
+	}
+}
+
 func (lsman *LStreamsManager) Reconnect() {
 	lsman.reqCh <- lstreamsManagerReq{
 		reconnect: true,
@@ -684,19 +1489,47 @@ func (lsman *LStreamsManager) Disconnect() {
 }
 
 type manQueryLogsCtx struct {
+	// id is the unique ID of the query, which the responses carry.
+	id int
+
+	// ctx is cancelled once the query is done or superseded, to make the
+	// logstreams skip the commands which haven't started yet.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	req *QueryLogsParams
 
 	startTime time.Time
 
+	// numLStreams is how many logstreams the query was sent to; it's less than
+	// the total number of logstreams if some of them were skipped.
+	numLStreams int
+	// skipped contains the sorted names of the skipped logstreams.
+	skipped []string
+
 	// resps is a map from logstream name to its response. Once all responses have
 	// been collected, we'll start merging them together.
 	resps map[string]*LogResp
 	errs  map[string]error
+
+	// pending contains the logstreams which weren't queried yet, because of
+	// the MaxQueriesInFlight; numInFlight is how many of them are queried now.
+	pending     []pendingLStreamQuery
+	numInFlight int
+
+	// newerFrom is only used with LoadNewer: it's a map from the logstream
+	// name to the time since which it's queried.
+	newerFrom map[string]time.Time
+
+	// resumed is only set if the query resumes the failed one: the responses
+	// from it are merged with the ones from this query.
+	resumed *manResumableQuery
 }
 
 type manLogsCtx struct {
-	minuteStats  map[int64]MinuteStatsItem
-	numMsgsTotal int
+	// total contains the aggregates merged from all the logstreams; its Groups
+	// are nil if the logs aren't grouped. See QueryLogsParams.GroupBy.
+	total AggregatePartial
 
 	perNode map[string]*manLogsNodeCtx
 }
@@ -704,6 +1537,14 @@ type manLogsCtx struct {
 type manLogsNodeCtx struct {
 	logs          []LogMsg
 	isMaxNumLines bool
+
+	// minuteStats are the stats from this logstream only; they're only needed
+	// to update the total stats on LoadNewer.
+	minuteStats map[int64]MinuteStatsItem
+
+	// groups are the groups from this logstream only; nil if the logs aren't
+	// grouped, or the logstream can't group them.
+	groups map[string]int
 }
 
 type LStreamsManagerUpdate struct {
@@ -735,11 +1576,19 @@ type LStreamsManagerState struct {
 	// Busy is true when a query is in progress.
 	Busy bool
 
+	// IdleDisconnected is true when the logstreams are disconnected because of
+	// the LStreamsManagerParams.IdleTimeout; they reconnect on the next query.
+	IdleDisconnected bool `json:",omitempty"`
+
 	ConnDetailsByLStream map[string]ConnDetails
 	BusyStageByLStream   map[string]BusyStage
 
 	// TearingDown contains logstream names whic are in the process of teardown.
 	TearingDown []string
+
+	// Fleet is the aggregated connection status, the same as returned by
+	// LStreamsManager.FleetStatus.
+	Fleet FleetSummary
 }
 
 type BootstrapIssue struct {
@@ -751,6 +1600,13 @@ type BootstrapIssue struct {
 	// instead of a generic warning message to make it possible to suppress it
 	// with a flag.
 	WarnJournalctlNoAdminAccess bool
+
+	// WarnClockSkew is non-zero if the logstream's clock differs from the
+	// local one by more than ClockSkewWarnThreshold; see FormatClockSkew.
+	WarnClockSkew time.Duration
+
+	// WarnWireCompression is the same as in BootstrapDetails.
+	WarnWireCompression string
 }
 
 func (lsman *LStreamsManager) updateLStreamsByState() {
@@ -770,6 +1626,14 @@ func (lsman *LStreamsManager) updateLStreamsByState() {
 			lsman.numNotConnected++
 		}
 	}
+
+	for _, state := range allLStreamClientStates {
+		lsman.params.Metrics.SetGauge(
+			MetricLStreams,
+			MetricLabels{"state": string(state)},
+			float64(len(lsman.lstreamsByState[state])),
+		)
+	}
 }
 
 func (lsman *LStreamsManager) sendStateUpdate() {
@@ -806,9 +1670,11 @@ func (lsman *LStreamsManager) sendStateUpdate() {
 			NoMatchingLStreams:   lsman.numNotConnected == 0 && numConnected == 0,
 			Connected:            lsman.numNotConnected == 0 && numConnected > 0,
 			Busy:                 lsman.curQueryLogsCtx != nil,
+			IdleDisconnected:     lsman.idleDisconnected,
 			ConnDetailsByLStream: connDetailsCopy,
 			BusyStageByLStream:   busyStagesCopy,
 			TearingDown:          tearingDown,
+			Fleet:                lsman.updateFleetSummary(),
 		},
 	}
 
@@ -829,6 +1695,16 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 	resps := lsman.curQueryLogsCtx.resps
 	errs := lsman.curQueryLogsCtx.errs
 
+	if resumed := lsman.curQueryLogsCtx.resumed; resumed != nil {
+		resps = make(map[string]*LogResp, len(resumed.resps)+len(lsman.curQueryLogsCtx.resps))
+		for name, resp := range resumed.resps {
+			resps[name] = resp
+		}
+		for name, resp := range lsman.curQueryLogsCtx.resps {
+			resps[name] = resp
+		}
+	}
+
 	if len(errs) != 0 {
 		errs2 := make([]error, 0, len(errs))
 		for hostname, err := range errs {
@@ -840,64 +1716,130 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 		})
 
 		lsman.sendLogRespUpdate(&LogRespTotal{
-			Errs: errs2,
+			Errs:        errs2,
+			ResumeToken: lsman.saveResumableQuery(resps, errs),
 		})
 
 		return
 	}
 
 	// If we're not adding to already existing logs, reset w/e we've had already,
-	// and calculate minuteStats from the resps.
-	if !lsman.curQueryLogsCtx.req.LoadEarlier {
-		lsman.curLogs = manLogsCtx{
-			minuteStats: map[int64]MinuteStatsItem{},
-			perNode:     map[string]*manLogsNodeCtx{},
+	// and calculate minuteStats from the resps. When retrying the skipped
+	// logstreams, their logs and minuteStats are added to the ones we already
+	// have from the rest.
+	switch {
+	case lsman.curQueryLogsCtx.req.LoadEarlier:
+		// Add to existing logs
+		for nodeName, resp := range resps {
+			pn := lsman.curLogs.perNode[nodeName]
+			pn.logs = append(resp.Logs, pn.logs...)
+			pn.isMaxNumLines = len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines
 		}
 
+	case lsman.curQueryLogsCtx.req.LoadNewer:
 		for nodeName, resp := range resps {
-			for k, v := range resp.MinuteStats {
-				lsman.curLogs.minuteStats[k] = MinuteStatsItem{
-					NumMsgs: lsman.curLogs.minuteStats[k].NumMsgs + v.NumMsgs,
-				}
+			lsman.curLogs.perNode[nodeName].addNewer(
+				resp,
+				lsman.curQueryLogsCtx.newerFrom[nodeName],
+				lsman.curQueryLogsCtx.req.MaxNumLines,
+			)
+		}
 
-				lsman.curLogs.numMsgsTotal += v.NumMsgs
+		lsman.curLogs.updateMinuteStats()
+
+	default:
+		if !lsman.curQueryLogsCtx.req.RetrySkipped {
+			lsman.curLogs = manLogsCtx{
+				total: AggregatePartial{
+					MinuteStats: map[int64]MinuteStatsItem{},
+				},
+				perNode: map[string]*manLogsNodeCtx{},
 			}
 
+			if lsman.curQueryLogsCtx.req.GroupBy != "" {
+				lsman.curLogs.total.Groups = map[string]int{}
+			}
+		}
+
+		for nodeName, resp := range resps {
+			partial := resp.AggregatePartial()
+
+			// The logstreams which can't group the logs have no groups, which
+			// must not make the total groups non-nil.
+			if lsman.curLogs.total.Groups == nil {
+				partial.Groups = nil
+			}
+
+			lsman.curLogs.total.Merge(partial)
+
 			lsman.curLogs.perNode[nodeName] = &manLogsNodeCtx{
 				logs:          resp.Logs,
 				isMaxNumLines: len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines,
+				minuteStats:   resp.MinuteStats,
+				groups:        partial.Groups,
 			}
 		}
-	} else {
-		// Add to existing logs
-		for nodeName, resp := range resps {
-			pn := lsman.curLogs.perNode[nodeName]
-			pn.logs = append(resp.Logs, pn.logs...)
-			pn.isMaxNumLines = len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines
-		}
 	}
 
-	// Collect debug info
+	// Collect debug info and warnings
 	debugInfo := make(map[string]LogstreamDebugInfo, len(resps))
+	lstreamNames := make([]string, 0, len(resps))
 	for lstreamName, resp := range resps {
 		debugInfo[lstreamName] = resp.DebugInfo
+		lstreamNames = append(lstreamNames, lstreamName)
+	}
+	sort.Strings(lstreamNames)
+
+	var warnings []string
+	for _, lstreamName := range lstreamNames {
+		for _, w := range resps[lstreamName].Warnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", lstreamName, w))
+		}
 	}
 
 	ret := &LogRespTotal{
-		MinuteStats:   lsman.curLogs.minuteStats,
-		NumMsgsTotal:  lsman.curLogs.numMsgsTotal,
+		MinuteStats:   lsman.curLogs.total.MinuteStats,
+		NumMsgsTotal:  lsman.curLogs.total.NumMsgs,
 		LoadedEarlier: lsman.curQueryLogsCtx.req.LoadEarlier,
+		LoadedNewer:   lsman.curQueryLogsCtx.req.LoadNewer,
+		Warnings:      warnings,
 		DebugInfo:     debugInfo,
+
+		SkippedLStreams: lsman.curQueryLogsCtx.skipped,
+	}
+
+	for _, resp := range resps {
+		if resp.SampleRate > 1 {
+			ret.Approximate = true
+			ret.SampleRate = resp.SampleRate
+		}
+	}
+
+	if lsman.curLogs.total.Groups != nil {
+		ret.Groups = sortedGroups(lsman.curLogs.total.Groups)
+
+		ret.GroupsByLStream = map[string]map[string]int{}
+		for nodeName, pn := range lsman.curLogs.perNode {
+			if pn.groups != nil {
+				ret.GroupsByLStream[nodeName] = pn.groups
+			}
+		}
 	}
 
 	var logsCoveredSince time.Time
 
-	for _, pn := range lsman.curLogs.perNode {
+	// The tail queries return the last lines of every logstream no matter the
+	// timespan, so none of them are cut below.
+	isTail := lsman.curQueryLogsCtx.req.TailNumLines > 0
+
+	ret.MinuteStatsByLStream = make(map[string]map[int64]MinuteStatsItem, len(lsman.curLogs.perNode))
+	for nodeName, pn := range lsman.curLogs.perNode {
 		ret.Logs = append(ret.Logs, pn.logs...)
+		ret.MinuteStatsByLStream[nodeName] = pn.minuteStats
 
 		// If the timespan covered by logs from this logstream is shorter than what
 		// we've seen before, remember it.
-		if pn.isMaxNumLines && logsCoveredSince.Before(pn.logs[0].Time) {
+		if pn.isMaxNumLines && !isTail && logsCoveredSince.Before(pn.logs[0].Time) {
 			logsCoveredSince = pn.logs[0].Time
 		}
 	}
@@ -921,6 +1863,47 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 	lsman.sendLogRespUpdate(ret)
 }
 
+// addNewer adds the logs and the minute stats which were queried since the
+// given time (see QueryLogsParams.LoadNewer) to the ones we already have.
+func (pn *manLogsNodeCtx) addNewer(resp *LogResp, from time.Time, maxNumLines int) {
+	fromKey := from.Unix()
+
+	minuteStats := make(map[int64]MinuteStatsItem, len(pn.minuteStats)+len(resp.MinuteStats))
+	for k, v := range pn.minuteStats {
+		if k < fromKey {
+			minuteStats[k] = v
+		}
+	}
+	for k, v := range resp.MinuteStats {
+		minuteStats[k] = v
+	}
+	pn.minuteStats = minuteStats
+
+	if len(resp.Logs) == maxNumLines {
+		// There might be more newer logs than we've got, so to avoid the gap,
+		// drop the older logs we had, as if it was a new query.
+		pn.logs = resp.Logs
+		pn.isMaxNumLines = true
+		return
+	}
+
+	idx := sort.Search(len(pn.logs), func(i int) bool {
+		return !pn.logs[i].Time.Before(from)
+	})
+	pn.logs = append(pn.logs[:idx:idx], resp.Logs...)
+}
+
+// updateMinuteStats recalculates the total minute stats from the
+// per-logstream ones.
+func (lc *manLogsCtx) updateMinuteStats() {
+	lc.total.MinuteStats = map[int64]MinuteStatsItem{}
+	lc.total.NumMsgs = 0
+
+	for _, pn := range lc.perNode {
+		lc.total.Merge(newAggregatePartial(pn.minuteStats, nil))
+	}
+}
+
 func (lsman *LStreamsManager) randomString(length int) string {
 	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
@@ -931,3 +1914,13 @@ func (lsman *LStreamsManager) randomString(length int) string {
 	}
 	return string(prefix)
 }
+
+// getAWKDialect returns the awk dialect of the given lstream, or
+// AWKDialectDefault if it hasn't bootstrapped yet.
+func (lsman *LStreamsManager) getAWKDialect(name string) AWKDialect {
+	if dialect, ok := lsman.lscAWKDialects[name]; ok {
+		return dialect
+	}
+
+	return AWKDialectDefault
+}
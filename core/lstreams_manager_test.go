@@ -0,0 +1,485 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/nerdlog/core/testutils"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingServer accepts TCP connections and never responds, so the ssh
+// handshake hangs until the connection is closed by the client.
+type hangingServer struct {
+	listener net.Listener
+
+	mtx   sync.Mutex
+	conns []net.Conn
+
+	doneCh chan struct{}
+}
+
+func newHangingServer(t *testing.T) *hangingServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &hangingServer{
+		listener: listener,
+		doneCh:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.doneCh)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mtx.Lock()
+			s.conns = append(s.conns, conn)
+			s.mtx.Unlock()
+		}
+	}()
+
+	return s
+}
+
+func (s *hangingServer) numConns() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.conns)
+}
+
+func (s *hangingServer) close() {
+	s.listener.Close()
+	<-s.doneCh
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// waitNumGoroutines waits until the number of goroutines drops to at most
+// want, and returns the last observed number.
+func waitNumGoroutines(want int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLStreamsManagerCloseWhileConnecting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_lsman_close")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	resetSSHAuthMethodShared(t)
+
+	keyPath, _, err := testutils.WriteSSHKey(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	srv := newHangingServer(t)
+	defer srv.close()
+
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+
+	const numHosts = 10
+
+	cfgLogStreams := ConfigLogStreams{}
+	for i := 0; i < numHosts; i++ {
+		cfgLogStreams[fmt.Sprintf("sshlib-%.2d", i)] = ConfigLogStream{
+			Hostname: "127.0.0.1",
+			Port:     port,
+			User:     "nerdlog",
+			LogFiles: []string{"/var/log/syslog"},
+		}
+
+		cfgLogStreams[fmt.Sprintf("custom-%.2d", i)] = ConfigLogStream{
+			Hostname: "127.0.0.1",
+			LogFiles: []string{"/var/log/syslog"},
+			Options: ConfigLogStreamOptions{
+				// The command never prints the connection marker, so the
+				// connection hangs.
+				Transport: "custom:sleep 30",
+			},
+		}
+
+		// The proxy command never prints anything, so the connection hangs
+		// before the handshake even starts; the marker file tells that the
+		// command has been started.
+		marker := filepath.Join(dir, fmt.Sprintf("proxy-%.2d", i))
+		cfgLogStreams[fmt.Sprintf("proxy-%.2d", i)] = ConfigLogStream{
+			Hostname:     "127.0.0.1",
+			Port:         port,
+			User:         "nerdlog",
+			LogFiles:     []string{"/var/log/syslog"},
+			ProxyCommand: fmt.Sprintf("sh -c 'touch %s; exec sleep 30'", marker),
+		}
+	}
+
+	numGoroutinesBefore := runtime.NumGoroutine()
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: cfgLogStreams,
+		SSHKeys:          []string{keyPath},
+		InitialLStreams:  "sshlib-*,custom-*,proxy-*",
+		ClientID:         "test",
+		UpdatesCh:        updatesCh,
+		Clock:            clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+
+	// Wait until all the ssh connections are mid-handshake.
+	for i := 0; i < 100 && srv.numConns() < numHosts; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, numHosts, srv.numConns())
+
+	// And all the proxy commands are started.
+	numProxies := func() int {
+		matches, _ := filepath.Glob(filepath.Join(dir, "proxy-*"))
+		return len(matches)
+	}
+	for i := 0; i < 100 && numProxies() < numHosts; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, numHosts, numProxies())
+
+	doneCh := make(chan struct{})
+	go func() {
+		lsman.Close()
+		lsman.Wait()
+		close(doneCh)
+	}()
+
+	startTime := time.Now()
+
+	select {
+	case <-doneCh:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("LStreamsManager didn't tear down in time")
+	}
+
+	assert.Less(t, int64(time.Since(startTime)), int64(time.Second))
+
+	numGoroutines := waitNumGoroutines(numGoroutinesBefore, time.Second)
+	if !assert.LessOrEqual(t, numGoroutines, numGoroutinesBefore) {
+		buf := make([]byte, 1<<20)
+		t.Logf("%s", buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// connectOrderTransport records the logstream name once Connect is called,
+// and never connects.
+type connectOrderTransport struct {
+	name string
+
+	mtx   *sync.Mutex
+	order *[]string
+}
+
+func (t *connectOrderTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	t.mtx.Lock()
+	*t.order = append(*t.order, t.name)
+	t.mtx.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		resCh <- ShellConnUpdate{
+			Result: &ShellConnResult{Err: ctx.Err()},
+		}
+	}()
+}
+
+func TestLStreamsManagerConnectPriority(t *testing.T) {
+	var mtx sync.Mutex
+	var order []string
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: ConfigLogStreams{
+			"web-a": {},
+			"web-b": {Options: ConfigLogStreamOptions{Priority: 5}},
+			"db-a":  {},
+			"db-b":  {Options: ConfigLogStreamOptions{Priority: 5}},
+			"db-c":  {Options: ConfigLogStreamOptions{Priority: 10}},
+		},
+		InitialLStreams: "web-*,db-*",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &connectOrderTransport{
+				name:  ls.Name,
+				mtx:   &mtx,
+				order: &order,
+			}
+		},
+		ClientID:  "test",
+		UpdatesCh: updatesCh,
+		Clock:     clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+
+	// The higher priority connects first, and the same priority keeps the
+	// config order, which is web-* before db-* here.
+	mtx.Lock()
+	assert.Equal(t, []string{"db-c", "web-b", "db-b", "web-a", "db-a"}, order)
+	mtx.Unlock()
+
+	doneCh := make(chan struct{})
+	go func() {
+		lsman.Close()
+		lsman.Wait()
+		close(doneCh)
+	}()
+
+	for {
+		select {
+		case <-updatesCh:
+		case <-doneCh:
+			return
+		case <-time.After(3 * time.Second):
+			t.Fatalf("LStreamsManager didn't tear down in time")
+		}
+	}
+}
+
+// connectSpanTransport records "start:<name>" once Connect is called, and
+// "end:<name>" once the attempt fails shortly after.
+type connectSpanTransport struct {
+	name string
+
+	mtx    *sync.Mutex
+	events *[]string
+}
+
+func (t *connectSpanTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	t.record("start")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+
+		t.record("end")
+		resCh <- ShellConnUpdate{
+			Result: &ShellConnResult{Err: errors.Errorf("connection refused")},
+		}
+	}()
+}
+
+func (t *connectSpanTransport) record(what string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	*t.events = append(*t.events, what+":"+t.name)
+}
+
+func TestLStreamsManagerMaxConcurrentConnects(t *testing.T) {
+	var mtx sync.Mutex
+	var events []string
+
+	getEvents := func() []string {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return append([]string(nil), events...)
+	}
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: ConfigLogStreams{
+			"web-a": {},
+			"web-b": {Options: ConfigLogStreamOptions{Priority: 5}},
+			"db-a":  {},
+			"db-b":  {Options: ConfigLogStreamOptions{Priority: 5}},
+			"db-c":  {Options: ConfigLogStreamOptions{Priority: 10}},
+		},
+		InitialLStreams: "web-*,db-*",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &connectSpanTransport{
+				name:   ls.Name,
+				mtx:    &mtx,
+				events: &events,
+			}
+		},
+		MaxConcurrentConnects: 1,
+		ClientID:              "test",
+		UpdatesCh:             updatesCh,
+		Clock:                 clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+
+	// Wait for every logstream to make its first attempt; the retries only
+	// come after connectRetryDelay.
+	const numEvents = 10
+	for i := 0; i < 200 && len(getEvents()) < numEvents; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// With one connection at a time, every attempt is done before the next
+	// one starts, so the higher priority hosts are connected (or failed)
+	// before the lower priority ones even start; the same priority keeps the
+	// config order.
+	got := getEvents()
+	if len(got) > numEvents {
+		got = got[:numEvents]
+	}
+	assert.Equal(t, []string{
+		"start:db-c", "end:db-c",
+		"start:web-b", "end:web-b",
+		"start:db-b", "end:db-b",
+		"start:web-a", "end:web-a",
+		"start:db-a", "end:db-a",
+	}, got)
+
+	doneCh := make(chan struct{})
+	go func() {
+		lsman.Close()
+		lsman.Wait()
+		close(doneCh)
+	}()
+
+	for {
+		select {
+		case <-updatesCh:
+		case <-doneCh:
+			return
+		case <-time.After(3 * time.Second):
+			t.Fatalf("LStreamsManager didn't tear down in time")
+		}
+	}
+}
+
+func TestLStreamsManagerAWKDialects(t *testing.T) {
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(time.Now().Add(-time.Minute), "foo"))
+
+	awkDialects := map[string]AWKDialect{
+		// The first host doesn't report the dialect, so it's the default one.
+		"fake-01": "",
+		"fake-02": AWKDialectMawk,
+		"fake-03": AWKDialectMawk,
+	}
+
+	env := &throttleTestEnv{
+		t:         t,
+		updatesCh: make(chan LStreamsManagerUpdate, 1024),
+		agentCmds: map[string]*fakeLogs{"fake-01": {}, "fake-02": {}, "fake-03": {}},
+	}
+
+	newTransport := func(ls LogStream) ShellTransport {
+		return &fakeShellTransport{
+			logs:       logs,
+			agentCmds:  env.agentCmds[ls.Name],
+			awkDialect: awkDialects[ls.Name],
+		}
+	}
+
+	env.start(LStreamsManagerParams{
+		InitialLStreams: "fake-01,fake-02",
+		NewTransport:    newTransport,
+	})
+	defer env.close()
+
+	queryLogs := func(query string) *LogRespTotal {
+		env.lsman.QueryLogs(QueryLogsParams{
+			MaxNumLines: 100,
+			From:        time.Now().Add(-time.Hour),
+			Query:       query,
+			QueryLang:   QueryLangFilter,
+		})
+
+		return env.nextLogResp()
+	}
+
+	// The word boundary is only supported by gawk, so the query fails for the
+	// mawk host, without running anything there.
+	assertWordBoundaryFails := func() {
+		t.Helper()
+
+		resp := queryLogs(`/\bfoo\b/`)
+		if assert.Equal(t, 1, len(resp.Errs)) {
+			var qvErr *QueryValidationError
+			if assert.True(t, errors.As(resp.Errs[0], &qvErr), "%v", resp.Errs[0]) {
+				assert.Equal(t, []string{"fake-02"}, qvErr.LStreams)
+				assert.Equal(t, AWKDialectMawk, qvErr.Dialect)
+			}
+		}
+	}
+
+	// The first query might be sent before the bootstrap is done, so it's
+	// translated to the default dialect, and the client translates it again.
+	assertWordBoundaryFails()
+
+	// The translatable regexes work everywhere.
+	resp := queryLogs(`/\w+/`)
+	assert.Equal(t, 0, len(resp.Errs))
+	for _, name := range []string{"fake-01", "fake-02"} {
+		cmds := env.agentCmds[name].get()
+		if assert.NotEmpty(t, cmds) {
+			assert.Contains(t, cmds[len(cmds)-1], "[A-Za-z0-9_]+", "%s", name)
+		}
+	}
+
+	// By now, the dialects are known to the manager, so it fails the query
+	// right away.
+	assertWordBoundaryFails()
+
+	// The regexes from the logstream options are translated to the host's
+	// dialect on connect, so the host fails to bootstrap if they can't be.
+	env2 := &throttleTestEnv{
+		t:         t,
+		updatesCh: make(chan LStreamsManagerUpdate, 1024),
+	}
+	env2.lsman = NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: ConfigLogStreams{
+			"fake-03": {Options: ConfigLogStreamOptions{
+				LevelPatterns: map[string]string{"error": `\bERR\b`},
+			}},
+		},
+		InitialLStreams: "fake-03",
+		NewTransport:    newTransport,
+		ClientID:        "test",
+		UpdatesCh:       env2.updatesCh,
+		Clock:           clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+	defer env2.close()
+
+	for {
+		upd := env2.nextUpdate()
+		if upd.BootstrapIssue != nil && upd.BootstrapIssue.Err != "" {
+			assert.Contains(t, upd.BootstrapIssue.Err, `level pattern for error: word boundary \b is not supported by mawk`)
+			break
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+// LStreamsDiff describes how the set of logstreams changes after reloading
+// the config; see LStreamsManager.Reload. Logstreams are identified by their
+// names (LogStream.Name), which are stable across reloads as long as the
+// logstreams spec is the same. All slices are sorted.
+type LStreamsDiff struct {
+	// Added are the logstreams which didn't exist before, and will be
+	// connected.
+	Added []string
+	// Removed are the logstreams which don't exist anymore, and will be
+	// closed.
+	Removed []string
+	// Changed are the logstreams whose resolved details (like host, log files
+	// or options) have changed, so they will be reconnected.
+	Changed []string
+	// Unchanged are the logstreams which are left untouched.
+	Unchanged []string
+}
+
+// IsEmpty returns true if nothing is added, removed or changed.
+func (d *LStreamsDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffLStreams computes the diff between the old and new resolved logstreams.
+func diffLStreams(oldLStreams, newLStreams map[string]LogStream) *LStreamsDiff {
+	diff := &LStreamsDiff{}
+
+	for name, newLS := range newLStreams {
+		oldLS, ok := oldLStreams[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, name)
+		case !reflect.DeepEqual(oldLS, newLS):
+			diff.Changed = append(diff.Changed, name)
+		default:
+			diff.Unchanged = append(diff.Unchanged, name)
+		}
+	}
+
+	for name := range oldLStreams {
+		if _, ok := newLStreams[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Unchanged)
+
+	return diff
+}
+
+type lstreamsManagerReqReload struct {
+	configLogStreams ConfigLogStreams
+	resCh            chan<- lstreamsManagerResReload
+}
+
+type lstreamsManagerResReload struct {
+	diff *LStreamsDiff
+	err  error
+}
+
+// Reload applies the new nerdlog logstreams config (typically, re-read from
+// the same file after the user has edited it) without restarting: the current
+// logstreams spec is resolved again using the new config, and then the
+// logstreams which were removed are closed, the added ones are connected, and
+// the ones which have changed are reconnected; the rest are left untouched.
+//
+// If the new config is invalid, nothing is changed and an error is returned.
+// Same as with SetLStreams, it fails with ErrBusyWithAnotherQuery if a query
+// is in progress.
+func (lsman *LStreamsManager) Reload(
+	ctx context.Context, configLogStreams ConfigLogStreams,
+) (*LStreamsDiff, error) {
+	// Buffered, so that the LStreamsManager doesn't get stuck if the ctx is
+	// done before the response.
+	resCh := make(chan lstreamsManagerResReload, 1)
+
+	select {
+	case lsman.reqCh <- lstreamsManagerReq{
+		reload: &lstreamsManagerReqReload{
+			configLogStreams: configLogStreams,
+			resCh:            resCh,
+		},
+	}:
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			return nil, errors.Trace(res.err)
+		}
+
+		return res.diff, nil
+
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+// reload handles the reload request. Must be called from the
+// LStreamsManager's goroutine.
+func (lsman *LStreamsManager) reload(req *lstreamsManagerReqReload) {
+	if lsman.curQueryLogsCtx != nil {
+		req.resCh <- lstreamsManagerResReload{err: ErrBusyWithAnotherQuery}
+		return
+	}
+
+	parsedLogStreams, lstreamsOrder, err := lsman.resolveLStreams(lsman.lstreamsStr, req.configLogStreams)
+	if err != nil {
+		req.resCh <- lstreamsManagerResReload{err: errors.Trace(err)}
+		return
+	}
+
+	diff := diffLStreams(lsman.parsedLogStreams, parsedLogStreams)
+	lsman.params.Logger.Infof(
+		"Reloading config: added %v, removed %v, changed %v",
+		diff.Added, diff.Removed, diff.Changed,
+	)
+
+	lsman.params.ConfigLogStreams = req.configLogStreams
+	lsman.parsedLogStreams = parsedLogStreams
+	lsman.lstreamsOrder = lstreamsOrder
+
+	// Close the changed clients, so that updateHAs creates them anew, with the
+	// new details; the removed ones will be closed by updateHAs.
+	for _, name := range diff.Changed {
+		lsman.closeLSClient(name, lsman.lscs[name])
+	}
+
+	lsman.updateHAs()
+	lsman.updateLStreamsByState()
+	lsman.sendStateUpdate()
+
+	req.resCh <- lstreamsManagerResReload{diff: diff}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLStreamsManagerReload(t *testing.T) {
+	logs := &fakeLogs{}
+
+	var mtx sync.Mutex
+	numTransports := map[string]int{}
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	go func() {
+		for range updatesCh {
+		}
+	}()
+
+	oldCfg := ConfigLogStreams{
+		"host-1": {LogFiles: []string{"/var/log/syslog"}},
+		"host-2": {LogFiles: []string{"/var/log/syslog"}},
+		"host-3": {LogFiles: []string{"/var/log/syslog"}},
+	}
+
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: oldCfg,
+		NewTransport: func(ls LogStream) ShellTransport {
+			mtx.Lock()
+			numTransports[ls.Name]++
+			mtx.Unlock()
+
+			return &fakeShellTransport{logs: logs}
+		},
+		InitialLStreams: "host-*",
+		ClientID:        "test",
+		UpdatesCh:       updatesCh,
+		Clock:           clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+	defer func() {
+		lsman.Close()
+		lsman.Wait()
+		close(updatesCh)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Invalid config doesn't change anything.
+	_, err := lsman.Reload(ctx, ConfigLogStreams{
+		"host-1": {
+			LogFiles:   []string{"/var/log/syslog"},
+			LogSources: []ConfigLogSource{{Tag: "foo", LogFiles: []string{"/var/log/foo"}}},
+		},
+	})
+	assert.Error(t, err)
+
+	newCfg := ConfigLogStreams{
+		"host-1": {LogFiles: []string{"/var/log/syslog"}},
+		"host-2": {LogFiles: []string{"/var/log/messages"}},
+		"host-4": {LogFiles: []string{"/var/log/syslog"}},
+	}
+
+	diff, err := lsman.Reload(ctx, newCfg)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &LStreamsDiff{
+			Added:     []string{"host-4"},
+			Removed:   []string{"host-3"},
+			Changed:   []string{"host-2"},
+			Unchanged: []string{"host-1"},
+		}, diff)
+		assert.False(t, diff.IsEmpty())
+	}
+
+	// The changed logstream is reconnected, the added one is connected, and
+	// the unchanged one is left as is.
+	mtx.Lock()
+	assert.Equal(t, map[string]int{
+		"host-1": 1,
+		"host-2": 2,
+		"host-3": 1,
+		"host-4": 1,
+	}, numTransports)
+	mtx.Unlock()
+
+	// Reloading the same config again changes nothing.
+	diff, err = lsman.Reload(ctx, newCfg)
+	if assert.NoError(t, err) {
+		assert.True(t, diff.IsEmpty())
+		assert.Equal(t, []string{"host-1", "host-2", "host-4"}, diff.Unchanged)
+	}
+
+	mtx.Lock()
+	assert.Equal(t, 2, numTransports["host-2"])
+	assert.Equal(t, 1, numTransports["host-4"])
+	mtx.Unlock()
+}
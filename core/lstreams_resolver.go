@@ -2,7 +2,9 @@ package core
 
 import (
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/dimonomid/nerdlog/shellescape"
 	"github.com/dimonomid/ssh_config"
@@ -59,14 +61,76 @@ type LogStream struct {
 	// It must contain at least a single item, otherwise LogStream is invalid.
 	LogFiles []string
 
+	// Sources is non-empty if the logstream was created from the
+	// ConfigLogStream.LogSources: then the agent reads every source in turn,
+	// and the logs from all of them are merged by time, every message having
+	// the "logsource" context tag set to its source's Tag. LogFiles are then
+	// the ones of Sources[0], which is used to bootstrap the logstream (e.g.
+	// to detect the time format, which must be the same for all the sources).
+	Sources []LogSource
+
+	// SourceTag is non-empty if the logstream was created from an entry of
+	// the ConfigLogStream.LogArchive; it's included in log messages as the
+	// "logsource" context tag.
+	SourceTag string
+
+	// Archive is non-nil if the logstream was created from an entry of the
+	// ConfigLogStream.LogArchive; LogFiles[0] is then the file which the entry
+	// is extracted to during bootstrap.
+	Archive *LogStreamArchive
+
+	// Tags are copied from ConfigLogStream.Tags of the config entry the
+	// logstream was resolved from.
+	Tags []string
+
+	// Labels are copied from ConfigLogStream.Labels of the config entry the
+	// logstream was resolved from; they must not be modified, since they're
+	// shared by all the messages from the logstream (see LogMsg.Labels).
+	Labels map[string]string
+
 	Options LogStreamOptions
 }
 
+// LogSource is a single tagged source of the logstream; see
+// LogStream.Sources.
+type LogSource struct {
+	// Tag is included in log messages from this source as the "logsource"
+	// context tag.
+	Tag string
+
+	// LogFiles has the same meaning as LogStream.LogFiles, but for this
+	// particular source.
+	LogFiles []string
+}
+
 // ConfigLogStreamShellTransportSSHLib contains params for the ssh transport
 // using internal ssh library.
 type ConfigLogStreamShellTransportSSHLib struct {
-	Host     ConfigHost
-	Jumphost *ConfigHost
+	Host ConfigHost
+
+	// Jumphosts is the chain of jumphosts to connect through: first we connect
+	// to Jumphosts[0], then through it to Jumphosts[1], etc, and finally to the
+	// Host.
+	Jumphosts []ConfigHost
+
+	// BindAddress, if not empty, is the local IP address to dial the
+	// connection from (for jumphosts, it only affects the first one).
+	BindAddress string
+
+	// ProxyCommand, if not empty, is the command to connect through instead
+	// of dialing the host; see ConfigLogStream.ProxyCommand. The tokens like
+	// %h are not expanded yet.
+	ProxyCommand string
+
+	// ProxyURL, if not empty, is the HTTP CONNECT proxy or the WebSocket
+	// tunnel to connect through; see ConfigLogStream.ProxyURL. The tokens like
+	// %h are not expanded yet.
+	ProxyURL string
+
+	// IdentityFile, if not empty, is the private key to authenticate with,
+	// instead of ssh-agent and the keys from the params; see
+	// ConfigLogStreamSSH.IdentityFile.
+	IdentityFile string
 }
 
 // ConfigLogStreamShellTransportCustomCmd contains params for the custom
@@ -83,10 +147,108 @@ type ConfigLogStreamShellTransportLocalhost struct {
 	// No details are needed here
 }
 
+// ConfigLogStreamShellTransportHTTPNDJSON contains params for the read-only
+// transport which gets the logs from an HTTP endpoint returning NDJSON.
+type ConfigLogStreamShellTransportHTTPNDJSON struct {
+	// URLTemplate is the URL to query for the logs. It may contain the
+	// placeholders {host}, {query}, {from}, {to} and {limit}, which are
+	// replaced with the URL-escaped values.
+	URLTemplate string
+
+	// Host is the hostname of the logstream, used for the {host} placeholder.
+	Host string
+}
+
+// ConfigLogStreamShellTransportWinEvent contains params for the read-only
+// transport which gets the logs from the Windows Event Log.
+type ConfigLogStreamShellTransportWinEvent struct {
+	// LogNames are the names of the event logs to read, like "System".
+	LogNames []string
+
+	// See description for ShellTransportCustomCmdParams.ShellCommand
+	ShellCommand string
+
+	// See description for ShellTransportCustomCmdParams.EnvOverride
+	EnvOverride map[string]string
+
+	// Host is the hostname of the logstream.
+	Host string
+}
+
+// ConfigLogStreamShellTransportConsole contains params for the transport
+// which logs in over a plain terminal stream: either telnet or a local serial
+// device.
+type ConfigLogStreamShellTransportConsole struct {
+	// See description for ShellTransportConsoleParams.TelnetAddr
+	TelnetAddr string
+
+	// See description for ShellTransportConsoleParams.BindAddress
+	BindAddress string
+
+	// See description for ShellTransportConsoleParams.SerialDevice
+	SerialDevice string
+
+	// See description for ShellTransportConsoleParams.SerialBaud
+	SerialBaud int
+
+	// User is the username to log in with.
+	User string
+
+	// Host is the hostname of the logstream.
+	Host string
+}
+
 type ConfigLogStreamShellTransport struct {
-	SSHLib    *ConfigLogStreamShellTransportSSHLib
-	CustomCmd *ConfigLogStreamShellTransportCustomCmd
-	Localhost *ConfigLogStreamShellTransportLocalhost
+	SSHLib     *ConfigLogStreamShellTransportSSHLib
+	CustomCmd  *ConfigLogStreamShellTransportCustomCmd
+	Localhost  *ConfigLogStreamShellTransportLocalhost
+	HTTPNDJSON *ConfigLogStreamShellTransportHTTPNDJSON
+	WinEvent   *ConfigLogStreamShellTransportWinEvent
+	Console    *ConfigLogStreamShellTransportConsole
+
+	// SSHBinFallback, if not nil, is only set along with SSHLib, for the auto
+	// transport mode: it's the ssh-bin command to fall back to if ssh-lib
+	// can't connect; see ShellTransportAuto.
+	SSHBinFallback *ConfigLogStreamShellTransportCustomCmd
+}
+
+// EmulatedAgent returns the name of the transport if it only emulates the
+// agent (see emulatedAgentConn), like "http-ndjson", or an empty string if
+// the transport runs the actual agent on the host.
+func (t *ConfigLogStreamShellTransport) EmulatedAgent() string {
+	switch {
+	case t.HTTPNDJSON != nil:
+		return TransportModeKindHTTPNDJSON
+	case t.WinEvent != nil:
+		return TransportModeKindWinEvent
+	}
+
+	return ""
+}
+
+// Hostname returns the name of the host which the transport connects to, like
+// "myhost", or an empty string if it's unknown (e.g. a custom shell command
+// which doesn't use the NLHOST env var).
+func (t *ConfigLogStreamShellTransport) Hostname() string {
+	switch {
+	case t.SSHLib != nil:
+		if host, _, err := net.SplitHostPort(t.SSHLib.Host.Addr); err == nil {
+			return host
+		}
+		return t.SSHLib.Host.Addr
+	case t.CustomCmd != nil:
+		return t.CustomCmd.EnvOverride["NLHOST"]
+	case t.Localhost != nil:
+		return "localhost"
+	case t.HTTPNDJSON != nil:
+		return t.HTTPNDJSON.Host
+	case t.WinEvent != nil:
+		return t.WinEvent.Host
+	case t.Console != nil:
+		return t.Console.Host
+	}
+
+	return ""
 }
 
 type LogStreamOptions struct {
@@ -97,6 +259,81 @@ type LogStreamOptions struct {
 	// custom env vars for tests, like: "export TZ=America/New_York", but
 	// might be useful outside of tests as well.
 	ShellInit []string
+
+	// LowPriorityWrappers, if not empty, are the commands which the agent is
+	// wrapped with, like "nice -n 19"; see ConfigLogStreamOptions.LowPriority.
+	LowPriorityWrappers []string
+
+	// AgentWrapper, if not empty, is the command which the agent is run
+	// through; see ConfigLogStreamOptions.AgentWrapper.
+	AgentWrapper string
+
+	// WireCompression is how the agent output is compressed; if empty,
+	// WireCompressionGzip is used.
+	WireCompression WireCompression
+
+	// CPULimitSeconds and MemoryLimitKB are the resource limits of the agent
+	// during queries; zero means no limit. See
+	// ConfigLogStreamOptions.CPULimitSeconds.
+	CPULimitSeconds int
+	MemoryLimitKB   int
+
+	// Locale is exported as LC_ALL before running the agent; if empty,
+	// DefaultLocale is used. See ConfigLogStreamOptions.Locale.
+	Locale string
+
+	// ConnTimeouts are the timeouts for the transports using an external
+	// command; see ConfigLogStreamOptions.ShellStartTimeout.
+	ConnTimeouts ShellConnTimeouts
+
+	// ConnStderrPatterns are the extra stderr patterns for the transports
+	// using an external command; see ConfigLogStreamOptions.StderrBenign.
+	ConnStderrPatterns ConnStderrPatterns
+
+	// ProbeTimeout, if positive, is the timeout of the TCP probe before
+	// connecting; see ConfigLogStreamOptions.ProbeTimeout.
+	ProbeTimeout time.Duration
+
+	// ConnectBudget, if positive, is the total time to spend on connecting,
+	// across all the attempts; see ConfigLogStreamOptions.ConnectBudget.
+	ConnectBudget time.Duration
+
+	// Priority orders the connection attempts; see
+	// ConfigLogStreamOptions.Priority.
+	Priority int
+
+	// LevelPatterns, if not nil, are used to classify the log messages by
+	// level, instead of guessing it.
+	LevelPatterns LevelPatterns
+
+	// FieldExtractor, if not nil, extracts the fields from the log lines by
+	// their positions; see ConfigLogStreamOptions.Fields.
+	FieldExtractor *FieldExtractor
+
+	// CustomAgent, if not empty, is the script which is used instead of
+	// nerdlog_agent.sh to read the logs; see ConfigLogStreamOptions.CustomAgent.
+	CustomAgent string
+
+	// PersistentSession, if not empty, is the multiplexer which runs the
+	// remote shell in a persistent session; see
+	// ConfigLogStreamOptions.PersistentSession.
+	PersistentSession PersistentSessionKind
+
+	// StdinPacing configures the writes to the remote shell; see
+	// ConfigLogStreamOptions.StdinChunkSize.
+	StdinPacing StdinPacing
+
+	// Multiline, if not nil, makes the multi-line log events be coalesced into
+	// single log messages; see ConfigLogStreamOptions.Multiline.
+	Multiline *Multiline
+
+	// JSON, if not nil, means that the log lines are JSON objects; see
+	// ConfigLogStreamOptions.LogFormat.
+	JSON *JSONLogs
+
+	// FilenameDate, if not nil, is the date of all the log lines, taken from
+	// the log file name; see ConfigLogStreamOptions.FilenameDate.
+	FilenameDate *FilenameDate
 }
 
 // SudoMode can be used to configure nerdlog to read log files with "sudo -n".
@@ -166,16 +403,35 @@ func (ls LogStream) LogFilePrev() (string, bool) {
 // - "myuser@myserver.com"
 // - "myserver.com"
 func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, error) {
-	lstreamsStr = strings.TrimSpace(lstreamsStr)
+	lstreams, err := r.ResolveList(lstreamsStr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	parsedLogStreams := make(map[string]LogStream, len(lstreams))
+	for _, ls := range lstreams {
+		parsedLogStreams[ls.Name] = ls
+	}
+
+	return parsedLogStreams, nil
+}
 
-	parsedLogStreams := map[string]LogStream{}
+// ResolveList is like Resolve, but returns the logstreams in the config
+// order: the entries of the spec go in the order they're given, and the
+// logstreams expanded from a single entry go in the order of the
+// ConfigLogStreams keys (see ConfigLogStreams.Keys).
+func (r *LStreamsResolver) ResolveList(lstreamsStr string) ([]LogStream, error) {
+	lstreamsStr = strings.TrimSpace(lstreamsStr)
 
 	// Special case for an empty input: it's allowed and just results in no
 	// logstreams.
 	if lstreamsStr == "" {
-		return parsedLogStreams, nil
+		return nil, nil
 	}
 
+	var lstreams []LogStream
+	names := map[string]struct{}{}
+
 	// TODO: when json is supported, splitting by commas will need to be improved.
 	parts := strings.Split(lstreamsStr, ",")
 	for i, part := range parts {
@@ -193,25 +449,37 @@ func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, er
 		for _, ch := range cfs {
 			key := ch.Name
 
-			if _, exists := parsedLogStreams[key]; exists {
+			if _, exists := names[key]; exists {
 				return nil, errors.Errorf("the logstream %s is present at least twice", key)
 			}
 
-			parsedLogStreams[key] = ch
+			names[key] = struct{}{}
+			lstreams = append(lstreams, ch)
 		}
 	}
 
-	return parsedLogStreams, nil
+	return lstreams, nil
 }
 
 // draftLogStream is a draft version of LogStream; it's used as temporary
 // storage in the process of resolving logstreams.
 type draftLogStream struct {
-	name     string
-	host     ConfigHost
-	jumphost *ConfigHost
-	logFiles []string
-	options  ConfigLogStreamOptions
+	name      string
+	host      ConfigHost
+	jumphosts []ConfigHost
+	bindAddr  string
+	proxyCmd  string
+	proxyURL  string
+	ssh       *ConfigLogStreamSSH
+	logFiles  []string
+	sources   []ConfigLogSource
+	sourceTag string
+	tags      []string
+	labels    map[string]string
+	options   ConfigLogStreamOptions
+
+	archive      *ConfigLogArchive
+	archiveEntry *LogStreamArchive
 }
 
 // parseLogStreamSpecEntry parses a single logstream spec entry like
@@ -228,7 +496,7 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 	}
 
 	var plstream *parsedLStream
-	var jhconf *ConfigHost
+	var jumphosts []ConfigHost
 	var logFiles []string
 
 	curFlag := ""
@@ -240,25 +508,12 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 
 		switch curFlag {
 		case "-J", "--jumphost":
-			jhparsed, err := r.parseLStreamStr(part)
+			jhconf, err := parseJumphost(part)
 			if err != nil {
-				return nil, errors.Annotatef(err, "parsing %q as a jumphost", part)
+				return nil, errors.Trace(err)
 			}
 
-			//if jhparsed.logFileLast != "" || jhparsed.logFilePrev != "" {
-			//return nil, errors.Annotatef(err, "jumphost config shouldn't contain files")
-			//}
-
-			jhPort := jhparsed.port
-
-			if len(jhparsed.colonParts) > 1 {
-				return nil, errors.Errorf("parsing %q as a jumphost: too many colons", part)
-			}
-
-			jhconf = &ConfigHost{
-				Addr: fmt.Sprintf("%s:%s", jhparsed.hostname, jhPort),
-				User: jhparsed.user,
-			}
+			jumphosts = append(jumphosts, jhconf)
 
 		case "":
 			var err error
@@ -297,7 +552,7 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 				Addr: fmt.Sprintf("%s:%s", plstream.hostname, plstream.port),
 				User: plstream.user,
 			},
-			jumphost: jhconf,
+			jumphosts: jumphosts,
 
 			logFiles: logFiles,
 		},
@@ -341,11 +596,28 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		return nil, errors.Annotatef(err, "expanding from ssh config")
 	}
 
+	// Resolve jumphosts details in the same way as for the final hosts.
+	lstreams, err = resolveJumphosts(
+		lstreams, r.params.CurOSUser,
+		r.params.ConfigLogStreams, lsConfigFromSSHConfig,
+	)
+	if err != nil {
+		return nil, errors.Annotatef(err, "resolving jumphosts")
+	}
+
 	// Set defaults.
 	lstreams, err = setLogStreamsConnDefaults(lstreams, r.params.CurOSUser)
 	if err != nil {
 		return nil, errors.Annotatef(err, "setting defaults")
 	}
+	lstreams, err = setLogSourcesDefaults(lstreams)
+	if err != nil {
+		return nil, errors.Annotatef(err, "setting log sources defaults")
+	}
+	lstreams, err = expandLogArchives(lstreams)
+	if err != nil {
+		return nil, errors.Annotatef(err, "expanding log archives")
+	}
 	lstreams, err = setLogStreamsFileDefaults(lstreams)
 	if err != nil {
 		return nil, errors.Annotatef(err, "setting defaults")
@@ -386,15 +658,111 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 				return nil, errors.Annotatef(err, "parsing transport mode for %s", ls.name)
 			}
 
-			// Use ssh
-			if tm.Kind() == TransportModeKindSSHLib {
+			if err := checkSSHBlockTransport(ls.name, ls.ssh, tm.Kind()); err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			if tm.Kind() == TransportModeKindHTTPNDJSON {
+				parsedAddr, err := parseAddr(ls.host.Addr)
+				if err != nil {
+					return nil, errors.Annotatef(err, "parsing addr %s for http-ndjson transport", ls.host.Addr)
+				}
+
+				transport = ConfigLogStreamShellTransport{
+					HTTPNDJSON: &ConfigLogStreamShellTransportHTTPNDJSON{
+						URLTemplate: tm.HTTPURLTemplate(),
+						Host:        parsedAddr.host,
+					},
+				}
+			} else if tm.Kind() == TransportModeKindWinEvent {
+				parsedAddr, err := parseAddr(ls.host.Addr)
+				if err != nil {
+					return nil, errors.Annotatef(err, "parsing addr %s for winevent transport", ls.host.Addr)
+				}
+
+				transport = ConfigLogStreamShellTransport{
+					WinEvent: &ConfigLogStreamShellTransportWinEvent{
+						LogNames:     tm.WinEventLogNames(),
+						ShellCommand: tm.CustomShellCommand(),
+						EnvOverride:  ls.sshEnvOverride(parsedAddr),
+						Host:         parsedAddr.host,
+					},
+				}
+			} else if tm.Kind() == TransportModeKindTelnet || tm.Kind() == TransportModeKindSerial {
+				parsedAddr, err := parseAddr(ls.host.Addr)
+				if err != nil {
+					return nil, errors.Annotatef(err, "parsing addr %s for %s transport", ls.host.Addr, tm.Kind())
+				}
+
+				if len(ls.jumphosts) > 0 || ls.proxyCmd != "" || ls.proxyURL != "" {
+					return nil, errors.Errorf(
+						"%s: jumphosts and proxies are not supported by the %s transport", ls.name, tm.Kind(),
+					)
+				}
+
+				user := ls.host.User
+				if user == "" {
+					user = r.params.CurOSUser
+				}
+
+				console := &ConfigLogStreamShellTransportConsole{
+					User: user,
+					Host: parsedAddr.host,
+				}
+
+				if tm.Kind() == TransportModeKindTelnet {
+					console.TelnetAddr = tm.TelnetAddr()
+					if console.TelnetAddr == "" {
+						port := parsedAddr.port
+						if port == "" {
+							port = "23"
+						}
+
+						console.TelnetAddr = net.JoinHostPort(parsedAddr.host, port)
+					}
+
+					console.BindAddress = ls.bindAddr
+				} else {
+					console.SerialDevice, console.SerialBaud = tm.SerialDevice()
+				}
+
+				transport = ConfigLogStreamShellTransport{
+					Console: console,
+				}
+			} else if tm.Kind() == TransportModeKindSSHLib || (tm.Kind() == TransportModeKindAuto && !ls.ssh.needsSSHBin()) {
+				var identityFile string
+				if ls.ssh != nil && ls.ssh.IdentityFile != "" {
+					identityFile = expandHomeDir(ls.ssh.IdentityFile)
+				}
+
 				// Use internal ssh library
 				transport = ConfigLogStreamShellTransport{
 					SSHLib: &ConfigLogStreamShellTransportSSHLib{
-						Host:     ls.host,
-						Jumphost: ls.jumphost,
+						Host:         ls.host,
+						Jumphosts:    ls.jumphosts,
+						BindAddress:  ls.bindAddr,
+						ProxyCommand: ls.proxyCmd,
+						ProxyURL:     ls.proxyURL,
+						IdentityFile: identityFile,
 					},
 				}
+
+				if tm.Kind() == TransportModeKindAuto {
+					parsedAddr, err := parseAddr(ls.host.Addr)
+					if err != nil {
+						return nil, errors.Annotatef(err, "parsing addr %s for ssh-bin fallback", ls.host.Addr)
+					}
+
+					shellCommand := DefaultSSHShellCommand
+					if ls.ssh != nil {
+						shellCommand = sshBinShellCommand(ls.ssh)
+					}
+
+					transport.SSHBinFallback = &ConfigLogStreamShellTransportCustomCmd{
+						ShellCommand: shellCommand,
+						EnvOverride:  ls.sshEnvOverride(parsedAddr),
+					}
+				}
 			} else {
 				// Use external custom command.
 				parsedAddr, err := parseAddr(ls.host.Addr)
@@ -402,34 +770,316 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 					return nil, errors.Annotatef(err, "parsing addr %s for external custom command", ls.host.Addr)
 				}
 
-				envOverride := map[string]string{
-					"NLHOST": parsedAddr.host,
+				shellCommand := tm.CustomShellCommand()
+				// The auto mode only gets here if the ssh block needs ssh-bin anyway.
+				if (tm.Kind() == TransportModeKindSSHBin || tm.Kind() == TransportModeKindAuto) && ls.ssh != nil {
+					shellCommand = sshBinShellCommand(ls.ssh)
 				}
 
-				if parsedAddr.port != "" {
-					envOverride["NLPORT"] = parsedAddr.port
+				transport = ConfigLogStreamShellTransport{
+					CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
+						ShellCommand: shellCommand,
+						EnvOverride:  ls.sshEnvOverride(parsedAddr),
+					},
 				}
+			}
+		}
+
+		var lowPriorityWrappers []string
+		if ls.options.LowPriority {
+			lowPriorityWrappers = ls.options.LowPriorityWrappers
+			if len(lowPriorityWrappers) == 0 {
+				lowPriorityWrappers = DefaultLowPriorityWrappers
+			}
 
-				if ls.host.User != "" {
-					envOverride["NLUSER"] = ls.host.User
+			for _, wrapper := range lowPriorityWrappers {
+				if err := validateLowPriorityWrapper(wrapper); err != nil {
+					return nil, errors.Annotatef(err, "%s", ls.name)
 				}
+			}
+		}
 
-				transport = ConfigLogStreamShellTransport{
-					CustomCmd: &ConfigLogStreamShellTransportCustomCmd{
-						ShellCommand: tm.CustomShellCommand(),
-						EnvOverride:  envOverride,
-					},
+		if err := validateAgentWrapper(ls.options.AgentWrapper); err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		if ls.options.WireCompression != "" {
+			if _, ok := ValidWireCompressions[ls.options.WireCompression]; !ok {
+				return nil, errors.Errorf(
+					"%s: invalid wire_compression %q", ls.name, ls.options.WireCompression,
+				)
+			}
+		}
+
+		if ls.options.CPULimitSeconds < 0 {
+			return nil, errors.Errorf(
+				"%s: invalid cpu_limit_seconds %d", ls.name, ls.options.CPULimitSeconds,
+			)
+		}
+
+		if ls.options.MemoryLimitKB < 0 {
+			return nil, errors.Errorf(
+				"%s: invalid memory_limit_kb %d", ls.name, ls.options.MemoryLimitKB,
+			)
+		}
+
+		if err := validateLocale(ls.options.Locale); err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		if ls.options.ShellStartTimeout < 0 || ls.options.MarkerTimeout < 0 {
+			return nil, errors.Errorf(
+				"%s: shell_start_timeout and marker_timeout can't be negative", ls.name,
+			)
+		}
+
+		if ls.options.ProbeTimeout < 0 {
+			return nil, errors.Errorf("%s: probe_timeout can't be negative", ls.name)
+		}
+
+		if ls.options.ConnectBudget < 0 {
+			return nil, errors.Errorf("%s: connect_budget can't be negative", ls.name)
+		}
+
+		connStderrPatterns := ConnStderrPatterns{
+			Benign: ls.options.StderrBenign,
+			Fatal:  ls.options.StderrFatal,
+		}
+		if _, err := newConnStderrClassifier(connStderrPatterns); err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		levelPatterns, err := ParseLevelPatterns(ls.options.LevelPatterns)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		fieldExtractor, err := ParseFieldExtractor(ls.options.Fields, ls.options.FieldSeparator)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		multiline, err := ParseMultiline(ls.options.Multiline)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		if multiline != nil {
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: multiline can't be used with the %s transport", ls.name, name,
+				)
+			}
+
+			if ls.options.CustomAgent != "" {
+				return nil, errors.Errorf("%s: multiline can't be used with custom_agent", ls.name)
+			}
+		}
+
+		jsonLogs, err := ParseJSONLogs(ls.options.LogFormat, ls.options.JSON)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", ls.name)
+		}
+
+		if jsonLogs != nil {
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: log_format json can't be used with the %s transport", ls.name, name,
+				)
+			}
+
+			if ls.options.CustomAgent != "" {
+				return nil, errors.Errorf("%s: log_format json can't be used with custom_agent", ls.name)
+			}
+
+			if multiline != nil {
+				return nil, errors.Errorf("%s: log_format json can't be used with multiline", ls.name)
+			}
+
+			for _, logFile := range ls.logFiles {
+				if logFile == SpecialFilenameJournalctl {
+					return nil, errors.Errorf("%s: log_format json can't be used with journalctl", ls.name)
 				}
 			}
 		}
 
+		if len(ls.sources) > 0 {
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: log_sources can't be used with the %s transport", ls.name, name,
+				)
+			}
+
+			if ls.options.CustomAgent != "" {
+				return nil, errors.Errorf("%s: log_sources can't be used with custom_agent", ls.name)
+			}
+
+			if ls.options.FilenameDate != nil {
+				return nil, errors.Errorf("%s: filename_date can't be used with log_sources", ls.name)
+			}
+		}
+
+		var filenameDate *FilenameDate
+		if ls.options.FilenameDate != nil {
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: filename_date can't be used with the %s transport", ls.name, name,
+				)
+			}
+
+			if ls.options.CustomAgent != "" {
+				return nil, errors.Errorf("%s: filename_date can't be used with custom_agent", ls.name)
+			}
+
+			if jsonLogs != nil {
+				return nil, errors.Errorf("%s: filename_date can't be used with log_format json", ls.name)
+			}
+
+			// All the lines get the same date, so there can't be the previous
+			// log file with another one; only the default "auto" one is allowed,
+			// which is the same file with ".1" appended, if it exists at all.
+			if len(ls.logFiles) != 2 || ls.logFiles[1] != "auto" ||
+				ls.logFiles[0] == "auto" || ls.logFiles[0] == SpecialFilenameJournalctl {
+				return nil, errors.Errorf("%s: filename_date needs exactly one log file", ls.name)
+			}
+
+			filename := ls.logFiles[0]
+			if ls.archiveEntry != nil {
+				filename = ls.archiveEntry.Entry
+			}
+
+			filenameDate, err = ParseFilenameDate(ls.options.FilenameDate, filename)
+			if err != nil {
+				return nil, errors.Annotatef(err, "%s", ls.name)
+			}
+
+			if multiline != nil && multiline.ContinuationRegex == "" && filenameDate.TimeOfDayLayout == "" {
+				return nil, errors.Errorf(
+					"%s: multiline continuation %q needs filename_date.time_of_day, since otherwise no line has a timestamp",
+					ls.name, MultilineContinuationNoTimestamp,
+				)
+			}
+		}
+
+		if ls.options.CustomAgent != "" {
+			if err := validateCustomAgent(ls.options.CustomAgent); err != nil {
+				return nil, errors.Annotatef(err, "%s", ls.name)
+			}
+
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: custom_agent can't be used with the %s transport", ls.name, name,
+				)
+			}
+		}
+
+		if ls.archiveEntry != nil {
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: log_archive can't be used with the %s transport", ls.name, name,
+				)
+			}
+
+			if ls.options.CustomAgent != "" {
+				return nil, errors.Errorf("%s: log_archive can't be used with custom_agent", ls.name)
+			}
+		}
+
+		// terminalReason is non-empty if the output goes through a terminal,
+		// and says why.
+		var terminalReason string
+
+		wireCompression := ls.options.WireCompression
+		if ls.options.PersistentSession != "" {
+			if _, ok := ValidPersistentSessionKinds[ls.options.PersistentSession]; !ok {
+				return nil, errors.Errorf(
+					"%s: invalid persistent_session %q", ls.name, ls.options.PersistentSession,
+				)
+			}
+
+			if name := transport.EmulatedAgent(); name != "" {
+				return nil, errors.Errorf(
+					"%s: persistent_session can't be used with the %s transport", ls.name, name,
+				)
+			}
+
+			terminalReason = "persistent_session"
+		}
+
+		if transport.Console != nil {
+			terminalReason = "transport " + ls.options.Transport
+		}
+
+		// The compressed output can't go through a terminal.
+		if terminalReason != "" {
+			switch wireCompression {
+			case "":
+				wireCompression = WireCompressionNone
+			case WireCompressionNone:
+			default:
+				return nil, errors.Errorf(
+					"%s: wire_compression %q can't be used with %s", ls.name, wireCompression, terminalReason,
+				)
+			}
+		}
+
+		var sources []LogSource
+		for _, src := range ls.sources {
+			sources = append(sources, LogSource{
+				Tag:      src.Tag,
+				LogFiles: src.LogFiles,
+			})
+		}
+
 		ret = append(ret, LogStream{
 			Name:      ls.name,
 			Transport: transport,
 			LogFiles:  ls.logFiles,
+			Sources:   sources,
+			SourceTag: ls.sourceTag,
+			Archive:   ls.archiveEntry,
+			Tags:      ls.tags,
+			Labels:    ls.labels,
 			Options: LogStreamOptions{
 				SudoMode:  ls.options.SudoMode,
 				ShellInit: ls.options.ShellInit,
+
+				LowPriorityWrappers: lowPriorityWrappers,
+				AgentWrapper:        ls.options.AgentWrapper,
+				WireCompression:     wireCompression,
+
+				CPULimitSeconds: ls.options.CPULimitSeconds,
+				MemoryLimitKB:   ls.options.MemoryLimitKB,
+
+				Locale: ls.options.Locale,
+
+				ConnTimeouts: ShellConnTimeouts{
+					ShellStart: ls.options.ShellStartTimeout,
+					Marker:     ls.options.MarkerTimeout,
+				},
+				ConnStderrPatterns: connStderrPatterns,
+				ProbeTimeout:       ls.options.ProbeTimeout,
+				ConnectBudget:      ls.options.ConnectBudget,
+				Priority:           ls.options.Priority,
+
+				LevelPatterns:  levelPatterns,
+				FieldExtractor: fieldExtractor,
+
+				CustomAgent: ls.options.CustomAgent,
+
+				PersistentSession: ls.options.PersistentSession,
+
+				StdinPacing: StdinPacing{
+					ChunkSize:  ls.options.StdinChunkSize,
+					LineChunks: ls.options.StdinLineChunks,
+					Delay:      ls.options.StdinChunkDelay,
+				},
+
+				Multiline: multiline,
+
+				JSON: jsonLogs,
+
+				FilenameDate: filenameDate,
 			},
 		})
 	}
@@ -540,7 +1190,13 @@ func expandFromLogStreamsConfig(
 			// Always override the name with the key from the config.
 			lsCopy.name = strings.Replace(lsCopy.name, globPattern, matchedItem.Key, -1)
 
-			if lsCopy.options.Transport == "" || lsCopy.options.Transport == "ssh-lib" {
+			if err := applySSHBlock(matchedItem.Key, &matchedItem.ConfigLogStream); err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			// With the ssh block, nerdlog assembles the transport on its own, so
+			// the connection details are needed even for ssh-bin.
+			if lsCopy.options.Transport == "" || isSSHLibTransportSpec(lsCopy.options.Transport) || matchedItem.SSH != nil {
 				// Overwrite the host address (since what we've had might be a glob):
 				// either with the Hostname if it's specified explicitly, or if not, then
 				// with the item key.
@@ -580,8 +1236,184 @@ func expandFromLogStreamsConfig(
 				lsCopy.options.Transport = matchedItem.Options.Transport
 			}
 
-			if len(lsCopy.logFiles) == 0 {
+			if lsCopy.ssh == nil {
+				lsCopy.ssh = matchedItem.SSH
+			}
+
+			// Only the ssh binary understands the ssh options.
+			if lsCopy.options.Transport == "" && lsCopy.ssh.needsSSHBin() {
+				lsCopy.options.Transport = TransportModeKindSSHBin
+			}
+
+			if !lsCopy.options.LowPriority {
+				lsCopy.options.LowPriority = matchedItem.Options.LowPriority
+			}
+
+			if lsCopy.options.LowPriorityWrappers == nil {
+				lsCopy.options.LowPriorityWrappers = matchedItem.Options.LowPriorityWrappers
+			}
+
+			if lsCopy.options.AgentWrapper == "" {
+				lsCopy.options.AgentWrapper = matchedItem.Options.AgentWrapper
+			}
+
+			if lsCopy.options.WireCompression == "" {
+				lsCopy.options.WireCompression = matchedItem.Options.WireCompression
+			}
+
+			if lsCopy.options.CPULimitSeconds == 0 {
+				lsCopy.options.CPULimitSeconds = matchedItem.Options.CPULimitSeconds
+			}
+
+			if lsCopy.options.MemoryLimitKB == 0 {
+				lsCopy.options.MemoryLimitKB = matchedItem.Options.MemoryLimitKB
+			}
+
+			if lsCopy.options.Locale == "" {
+				lsCopy.options.Locale = matchedItem.Options.Locale
+			}
+
+			if lsCopy.options.ShellStartTimeout == 0 {
+				lsCopy.options.ShellStartTimeout = matchedItem.Options.ShellStartTimeout
+			}
+
+			if lsCopy.options.MarkerTimeout == 0 {
+				lsCopy.options.MarkerTimeout = matchedItem.Options.MarkerTimeout
+			}
+
+			if lsCopy.options.ProbeTimeout == 0 {
+				lsCopy.options.ProbeTimeout = matchedItem.Options.ProbeTimeout
+			}
+
+			if lsCopy.options.ConnectBudget == 0 {
+				lsCopy.options.ConnectBudget = matchedItem.Options.ConnectBudget
+			}
+
+			if lsCopy.options.Priority == 0 {
+				lsCopy.options.Priority = matchedItem.Options.Priority
+			}
+
+			if lsCopy.options.StderrBenign == nil {
+				lsCopy.options.StderrBenign = matchedItem.Options.StderrBenign
+			}
+
+			if lsCopy.options.StderrFatal == nil {
+				lsCopy.options.StderrFatal = matchedItem.Options.StderrFatal
+			}
+
+			if lsCopy.options.LevelPatterns == nil {
+				lsCopy.options.LevelPatterns = matchedItem.Options.LevelPatterns
+			}
+
+			if lsCopy.options.Fields == nil {
+				lsCopy.options.Fields = matchedItem.Options.Fields
+			}
+
+			if lsCopy.options.FieldSeparator == "" {
+				lsCopy.options.FieldSeparator = matchedItem.Options.FieldSeparator
+			}
+
+			if lsCopy.options.CustomAgent == "" {
+				lsCopy.options.CustomAgent = matchedItem.Options.CustomAgent
+			}
+
+			if lsCopy.options.PersistentSession == "" {
+				lsCopy.options.PersistentSession = matchedItem.Options.PersistentSession
+			}
+
+			if lsCopy.options.StdinChunkSize == 0 {
+				lsCopy.options.StdinChunkSize = matchedItem.Options.StdinChunkSize
+			}
+
+			if !lsCopy.options.StdinLineChunks {
+				lsCopy.options.StdinLineChunks = matchedItem.Options.StdinLineChunks
+			}
+
+			if lsCopy.options.StdinChunkDelay == 0 {
+				lsCopy.options.StdinChunkDelay = matchedItem.Options.StdinChunkDelay
+			}
+
+			if lsCopy.options.Multiline == nil {
+				lsCopy.options.Multiline = matchedItem.Options.Multiline
+			}
+
+			if lsCopy.options.LogFormat == LogFormatDefault {
+				lsCopy.options.LogFormat = matchedItem.Options.LogFormat
+			}
+
+			if lsCopy.options.JSON == nil {
+				lsCopy.options.JSON = matchedItem.Options.JSON
+			}
+
+			if lsCopy.options.FilenameDate == nil {
+				lsCopy.options.FilenameDate = matchedItem.Options.FilenameDate
+			}
+
+			if len(matchedItem.LogFiles) > 0 && len(matchedItem.LogSources) > 0 {
+				return nil, errors.Errorf("%s: log_files and log_sources can't be used together", matchedItem.Key)
+			}
+
+			if matchedItem.LogArchive != nil && (len(matchedItem.LogFiles) > 0 || len(matchedItem.LogSources) > 0) {
+				return nil, errors.Errorf("%s: log_archive can't be used together with log_files or log_sources", matchedItem.Key)
+			}
+
+			if len(lsCopy.logFiles) == 0 && len(lsCopy.sources) == 0 && lsCopy.archive == nil {
 				lsCopy.logFiles = matchedItem.LogFiles
+				lsCopy.sources = matchedItem.LogSources
+				lsCopy.archive = matchedItem.LogArchive
+			}
+
+			if len(lsCopy.tags) == 0 {
+				lsCopy.tags = matchedItem.Tags
+			}
+
+			if len(lsCopy.labels) == 0 && len(matchedItem.Labels) > 0 {
+				if err := validateLStreamLabels(matchedItem.Labels); err != nil {
+					return nil, errors.Annotatef(err, "%s", matchedItem.Key)
+				}
+
+				lsCopy.labels = matchedItem.Labels
+			}
+
+			if len(lsCopy.jumphosts) == 0 && matchedItem.Jump != "" {
+				jumphosts, err := parseJumphosts(matchedItem.Jump)
+				if err != nil {
+					return nil, errors.Annotatef(err, "%s: parsing jump", matchedItem.Key)
+				}
+
+				lsCopy.jumphosts = jumphosts
+			}
+
+			if lsCopy.bindAddr == "" && matchedItem.BindAddress != "" {
+				if err := validateBindAddress(matchedItem.BindAddress); err != nil {
+					return nil, errors.Annotatef(err, "%s", matchedItem.Key)
+				}
+
+				lsCopy.bindAddr = matchedItem.BindAddress
+			}
+
+			if lsCopy.proxyCmd == "" {
+				lsCopy.proxyCmd = matchedItem.ProxyCommand
+			}
+
+			if lsCopy.proxyCmd != "" && len(lsCopy.jumphosts) > 0 {
+				return nil, errors.Errorf("%s: jump and proxy_command can't be used together", matchedItem.Key)
+			}
+
+			if lsCopy.proxyURL == "" && matchedItem.ProxyURL != "" {
+				if err := validateProxyURL(matchedItem.ProxyURL); err != nil {
+					return nil, errors.Annotatef(err, "%s", matchedItem.Key)
+				}
+
+				lsCopy.proxyURL = matchedItem.ProxyURL
+			}
+
+			if lsCopy.proxyURL != "" && len(lsCopy.jumphosts) > 0 {
+				return nil, errors.Errorf("%s: jump and proxy_url can't be used together", matchedItem.Key)
+			}
+
+			if lsCopy.proxyURL != "" && lsCopy.proxyCmd != "" {
+				return nil, errors.Errorf("%s: proxy_command and proxy_url can't be used together", matchedItem.Key)
 			}
 
 			lsCopy.host.Addr = fmt.Sprintf("%s:%s", addrCopy.host, addrCopy.port)
@@ -593,6 +1425,13 @@ func expandFromLogStreamsConfig(
 	return ret, nil
 }
 
+// isSSHLibTransportSpec returns true if the logstreams with the given
+// transport spec connect using ssh-lib, at least initially (like the auto
+// mode does), so the connection details have to be resolved by nerdlog.
+func isSSHLibTransportSpec(spec string) bool {
+	return spec == TransportModeKindSSHLib || spec == TransportModeKindAuto
+}
+
 // setLogStreamsConnDefaults goes through each of the logstreams, and fills in
 // missing pieces for which it knows the defaults for how to connect to the
 // hosts: port 22, user as the current OS user.
@@ -609,7 +1448,7 @@ func setLogStreamsConnDefaults(
 		// Only fill in default port and user if the custom transport command is
 		// not set; because if it's set, we'll want to defer all the defaults to
 		// that external command.
-		if ls.options.Transport == "ssh-lib" {
+		if isSSHLibTransportSpec(ls.options.Transport) {
 			port, err := portFromAddr(ls.host.Addr)
 			if err != nil {
 				return nil, errors.Annotatef(err, "logstream #%d, getting port", i+1)
@@ -630,22 +1469,231 @@ func setLogStreamsConnDefaults(
 	return ret, nil
 }
 
+// setLogSourcesDefaults validates the log sources of every logstream which
+// has them, fills in the default log files of every source, just like
+// setLogStreamsFileDefaults does for the logstreams, and sets the logstream's
+// own log files to the ones of the first source (see LogStream.Sources).
+func setLogSourcesDefaults(logStreams []draftLogStream) ([]draftLogStream, error) {
+	ret := make([]draftLogStream, 0, len(logStreams))
+
+	for _, ls := range logStreams {
+		if len(ls.sources) == 0 {
+			ret = append(ret, ls)
+			continue
+		}
+
+		sources := make([]ConfigLogSource, 0, len(ls.sources))
+		tags := map[string]struct{}{}
+		for i, src := range ls.sources {
+			if src.Tag == "" {
+				return nil, errors.Errorf("%s: log source #%d has no tag", ls.name, i+1)
+			}
+
+			if _, exists := tags[src.Tag]; exists {
+				return nil, errors.Errorf("%s: log source tag %q is used more than once", ls.name, src.Tag)
+			}
+			tags[src.Tag] = struct{}{}
+
+			if len(src.LogFiles) == 0 {
+				return nil, errors.Errorf("%s: log source %q has no log files", ls.name, src.Tag)
+			}
+
+			// The logs from the sources are merged by the line numbers, so the
+			// ones addressed by timestamps can't be used.
+			if IsTimestampAddressed(src.LogFiles[0]) {
+				return nil, errors.Errorf("%s: log source %q can't use %s", ls.name, src.Tag, src.LogFiles[0])
+			}
+
+			src.LogFiles = logFilesWithDefaults(src.LogFiles)
+			sources = append(sources, src)
+		}
+
+		ls.sources = sources
+		ls.logFiles = sources[0].LogFiles
+
+		ret = append(ret, ls)
+	}
+
+	return ret, nil
+}
+
 // setLogStreamsFileDefaults goes through each of the logstreams, and fills in
 // missing non-connection pieces, such as default log files.
 func setLogStreamsFileDefaults(logStreams []draftLogStream) ([]draftLogStream, error) {
 	ret := make([]draftLogStream, 0, len(logStreams))
 
 	for _, ls := range logStreams {
-		if len(ls.logFiles) == 0 {
-			// Will be autodetected by the agent script.
-			ls.logFiles = append(ls.logFiles, "auto")
+		ls.logFiles = logFilesWithDefaults(ls.logFiles)
+		ret = append(ret, ls)
+	}
+
+	return ret, nil
+}
+
+// logFilesWithDefaults returns a copy of the given log files, with the
+// missing latest and previous ones set to "auto", to be autodetected by the
+// agent script.
+func logFilesWithDefaults(logFiles []string) []string {
+	ret := append([]string(nil), logFiles...)
+	for len(ret) < 2 {
+		ret = append(ret, "auto")
+	}
+
+	return ret
+}
+
+// parseJumphost parses a single jumphost like "user@bastion:2222"; user and
+// port are optional, so the resulting Addr might have an empty port, like
+// "bastion:".
+func parseJumphost(s string) (ConfigHost, error) {
+	r := &LStreamsResolver{}
+	jhparsed, err := r.parseLStreamStr(s)
+	if err != nil {
+		return ConfigHost{}, errors.Annotatef(err, "parsing %q as a jumphost", s)
+	}
+
+	if len(jhparsed.colonParts) > 0 {
+		return ConfigHost{}, errors.Errorf("parsing %q as a jumphost: too many colons", s)
+	}
+
+	return ConfigHost{
+		Addr: fmt.Sprintf("%s:%s", jhparsed.hostname, jhparsed.port),
+		User: jhparsed.user,
+	}, nil
+}
+
+// parseJumphosts parses a comma-separated chain of jumphosts, like
+// "user1@bastion1,user2@bastion2:2222".
+func parseJumphosts(s string) ([]ConfigHost, error) {
+	var ret []ConfigHost
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, errors.Errorf("empty jumphost in %q", s)
+		}
+
+		jh, err := parseJumphost(part)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ret = append(ret, jh)
+	}
+
+	return ret, nil
+}
+
+// sshEnvOverride returns the env vars for the external ssh command like
+// DefaultSSHShellCommand; see ShellTransportCustomCmdParams.EnvOverride.
+func (ls *draftLogStream) sshEnvOverride(parsedAddr parsedAddr) map[string]string {
+	envOverride := map[string]string{
+		"NLHOST": parsedAddr.host,
+	}
+
+	if parsedAddr.port != "" {
+		envOverride["NLPORT"] = parsedAddr.port
+	}
+
+	if ls.host.User != "" {
+		envOverride["NLUSER"] = ls.host.User
+	}
+
+	if len(ls.jumphosts) > 0 {
+		envOverride["NLJUMP"] = formatJumphosts(ls.jumphosts)
+	}
+
+	if ls.bindAddr != "" {
+		envOverride["NLBIND"] = ls.bindAddr
+	}
+
+	if ls.proxyCmd != "" {
+		envOverride["NLPROXYCOMMAND"] = ls.proxyCmd
+	}
+
+	if ls.proxyURL != "" {
+		envOverride["NLPROXYURL"] = ls.proxyURL
+	}
+
+	return envOverride
+}
+
+// formatJumphosts formats the chain of jumphosts in the format accepted by
+// the -J option of ssh, like "user1@bastion1,user2@bastion2:2222".
+func formatJumphosts(jumphosts []ConfigHost) string {
+	parts := make([]string, 0, len(jumphosts))
+
+	for _, jh := range jumphosts {
+		s := strings.TrimSuffix(jh.Addr, ":")
+		if jh.User != "" {
+			s = jh.User + "@" + s
 		}
 
-		if len(ls.logFiles) == 1 {
-			// Will be autodetected by the agent script.
-			ls.logFiles = append(ls.logFiles, "auto")
+		parts = append(parts, s)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// resolveJumphosts goes through each of the logstreams using the ssh-lib
+// transport, and fills in missing details of their jumphosts in the same way
+// as for the final hosts: first from the given configs (only exact matches,
+// no globs), and then the defaults: port 22, user as the current OS user.
+//
+// For other transports, jumphosts are left intact, since the external command
+// will resolve them on its own.
+func resolveJumphosts(
+	logStreams []draftLogStream,
+	osUser string,
+	lsConfigs ...ConfigLogStreams,
+) ([]draftLogStream, error) {
+	ret := make([]draftLogStream, 0, len(logStreams))
+
+	for i, ls := range logStreams {
+		if !isSSHLibTransportSpec(ls.options.Transport) || len(ls.jumphosts) == 0 {
+			ret = append(ret, ls)
+			continue
+		}
+
+		jumphosts := make([]ConfigHost, 0, len(ls.jumphosts))
+		for _, jh := range ls.jumphosts {
+			addr, err := parseAddr(jh.Addr)
+			if err != nil {
+				return nil, errors.Annotatef(err, "logstream #%d, parsing jumphost address", i+1)
+			}
+
+			for _, lsConfig := range lsConfigs {
+				item, ok := lsConfig[addr.host]
+				if !ok {
+					continue
+				}
+
+				if item.Hostname != "" {
+					addr.host = item.Hostname
+				}
+
+				if addr.port == "" {
+					addr.port = item.Port
+				}
+
+				if jh.User == "" {
+					jh.User = item.User
+				}
+			}
+
+			if addr.port == "" {
+				addr.port = "22"
+			}
+
+			if jh.User == "" {
+				jh.User = osUser
+			}
+
+			jh.Addr = fmt.Sprintf("%s:%s", addr.host, addr.port)
+			jumphosts = append(jumphosts, jh)
 		}
 
+		ls.jumphosts = jumphosts
 		ret = append(ret, ls)
 	}
 
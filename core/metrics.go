@@ -0,0 +1,116 @@
+package core
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics is a sink for the metrics reported by nerdlog, like the number of
+// connections or queries; see the Metric* constants for the names and labels
+// of all the metrics. It's deliberately minimal, so that it can be backed by
+// Prometheus (see the prommetrics package), statsd or anything else, without
+// the core depending on any of those.
+//
+// The methods are called from multiple goroutines, so they must be safe for
+// concurrent use, and they must not block.
+type Metrics interface {
+	// AddCounter adds delta, which is never negative, to the counter.
+	AddCounter(name string, labels MetricLabels, delta float64)
+
+	// SetGauge sets the gauge to the given value.
+	SetGauge(name string, labels MetricLabels, value float64)
+
+	// ObserveHistogram adds a single observation to the histogram.
+	ObserveHistogram(name string, labels MetricLabels, value float64)
+}
+
+// MetricLabels are the labels of a single metric series, like
+// {"lstream": "myhost-01"}. The metrics don't modify the labels given to
+// them, and they must not keep modifying the labels either.
+type MetricLabels map[string]string
+
+const (
+	// MetricConnectionsOpened is a counter of the successful shell
+	// connections, labeled by "lstream".
+	MetricConnectionsOpened = "nerdlog_connections_opened_total"
+
+	// MetricConnectionsFailed is a counter of the failed connection and
+	// bootstrap attempts, labeled by "lstream" and "reason"; the reason is the
+	// ConnErrCategory, like "auth" or "timeout".
+	MetricConnectionsFailed = "nerdlog_connections_failed_total"
+
+	// MetricQueries is a counter of the queries ran on every logstream,
+	// labeled by "lstream" and "result", which is either "ok" or "error".
+	MetricQueries = "nerdlog_queries_total"
+
+	// MetricQueryDuration is a histogram of the query durations in seconds on
+	// every logstream, labeled by "lstream".
+	MetricQueryDuration = "nerdlog_query_duration_seconds"
+
+	// MetricBytesReceived is a counter of the bytes received from the
+	// logstream's shell (stdout and stderr), labeled by "lstream". If the wire
+	// compression is used, it's the compressed size.
+	MetricBytesReceived = "nerdlog_bytes_received_total"
+
+	// MetricLStreams is a gauge of the number of logstreams in every state,
+	// labeled by "state", like "connected_idle" or "disconnected".
+	MetricLStreams = "nerdlog_lstreams"
+)
+
+// NoopMetrics is a Metrics which just discards everything; it's used if no
+// Metrics is given.
+type NoopMetrics struct{}
+
+var _ Metrics = NoopMetrics{}
+
+func (NoopMetrics) AddCounter(name string, labels MetricLabels, delta float64)       {}
+func (NoopMetrics) SetGauge(name string, labels MetricLabels, value float64)         {}
+func (NoopMetrics) ObserveHistogram(name string, labels MetricLabels, value float64) {}
+
+// metricsCountingReader is an io.Reader which reports the number of bytes
+// read from the underlying reader to the MetricBytesReceived counter.
+type metricsCountingReader struct {
+	r       io.Reader
+	metrics Metrics
+	labels  MetricLabels
+}
+
+func newMetricsCountingReader(r io.Reader, metrics Metrics, labels MetricLabels) *metricsCountingReader {
+	return &metricsCountingReader{
+		r:       r,
+		metrics: metrics,
+		labels:  labels,
+	}
+}
+
+func (cr *metricsCountingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.metrics.AddCounter(MetricBytesReceived, cr.labels, float64(n))
+	}
+
+	return n, err
+}
+
+// lstreamMetricLabels returns the labels for the metrics of the given
+// logstream.
+func lstreamMetricLabels(name string) MetricLabels {
+	return MetricLabels{"lstream": name}
+}
+
+// recordQueryMetrics reports the query which has started at startTime and
+// has just finished with the given error (or nil).
+func recordQueryMetrics(metrics Metrics, lstreamName string, startTime, now time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	metrics.AddCounter(MetricQueries, MetricLabels{
+		"lstream": lstreamName,
+		"result":  result,
+	}, 1)
+	metrics.ObserveHistogram(
+		MetricQueryDuration, lstreamMetricLabels(lstreamName), now.Sub(startTime).Seconds(),
+	)
+}
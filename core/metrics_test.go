@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMetrics records all the metrics in memory; the series are keyed by the
+// metric name followed by the sorted labels, like
+// `nerdlog_queries_total{lstream="fake-01",result="ok"}`.
+type fakeMetrics struct {
+	mtx        sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string][]float64
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		counters:   map[string]float64{},
+		gauges:     map[string]float64{},
+		histograms: map[string][]float64{},
+	}
+}
+
+func fakeMetricsKey(name string, labels MetricLabels) string {
+	var parts []string
+	for k, v := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(parts)
+
+	return fmt.Sprintf("%s{%s}", name, strings.Join(parts, ","))
+}
+
+func (m *fakeMetrics) AddCounter(name string, labels MetricLabels, delta float64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.counters[fakeMetricsKey(name, labels)] += delta
+}
+
+func (m *fakeMetrics) SetGauge(name string, labels MetricLabels, value float64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.gauges[fakeMetricsKey(name, labels)] = value
+}
+
+func (m *fakeMetrics) ObserveHistogram(name string, labels MetricLabels, value float64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key := fakeMetricsKey(name, labels)
+	m.histograms[key] = append(m.histograms[key], value)
+}
+
+func (m *fakeMetrics) counter(key string) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.counters[key]
+}
+
+func (m *fakeMetrics) gauge(key string) float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.gauges[key]
+}
+
+func (m *fakeMetrics) histogram(key string) []float64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]float64(nil), m.histograms[key]...)
+}
+
+// fakeAuthFailedTransport always fails to connect, like a host which rejects
+// our key.
+type fakeAuthFailedTransport struct{}
+
+func (t *fakeAuthFailedTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	resCh <- ShellConnUpdate{
+		Result: &ShellConnResult{
+			Err: errors.New("ssh: handshake failed: ssh: unable to authenticate"),
+		},
+	}
+}
+
+func TestMetricsConnectAndQuery(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	metrics := newFakeMetrics()
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs}
+		},
+		ClientID: "test",
+		Metrics:  metrics,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = n.Query(ctx, QueryLogsParams{
+		From: now.Add(-time.Hour),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, name := range []string{"fake-01", "fake-02"} {
+		assert.Equal(t, 1.0, metrics.counter(`nerdlog_connections_opened_total{lstream="`+name+`"}`), name)
+		assert.Equal(t, 1.0, metrics.counter(`nerdlog_queries_total{lstream="`+name+`",result="ok"}`), name)
+		assert.Equal(t, 0.0, metrics.counter(`nerdlog_queries_total{lstream="`+name+`",result="error"}`), name)
+		assert.Greater(t, metrics.counter(`nerdlog_bytes_received_total{lstream="`+name+`"}`), 0.0, name)
+
+		durations := metrics.histogram(`nerdlog_query_duration_seconds{lstream="` + name + `"}`)
+		if assert.Equal(t, 1, len(durations), name) {
+			assert.GreaterOrEqual(t, durations[0], 0.0)
+		}
+	}
+
+	// Once the query is done, both logstreams become idle.
+	assert.Eventually(t, func() bool {
+		return metrics.gauge(`nerdlog_lstreams{state="connected_idle"}`) == 2 &&
+			metrics.gauge(`nerdlog_lstreams{state="connected_busy"}`) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0.0, metrics.gauge(`nerdlog_lstreams{state="disconnected"}`))
+}
+
+func TestMetricsConnectFailed(t *testing.T) {
+	metrics := newFakeMetrics()
+
+	n, err := New(Options{
+		LStreams: "fake-01",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeAuthFailedTransport{}
+		},
+		ClientID: "test",
+		Metrics:  metrics,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer n.Close()
+
+	assert.Eventually(t, func() bool {
+		return metrics.counter(`nerdlog_connections_failed_total{lstream="fake-01",reason="auth"}`) >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 0.0, metrics.counter(`nerdlog_connections_opened_total{lstream="fake-01"}`))
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// MultilineContinuation is the rule which tells the continuation lines of the
+// multi-line log events; see ConfigMultiline.
+type MultilineContinuation string
+
+const (
+	// MultilineContinuationNoTimestamp means that the lines which don't start
+	// with a timestamp belong to the previous event.
+	MultilineContinuationNoTimestamp MultilineContinuation = "no_timestamp"
+
+	// MultilineContinuationRegex means that the lines matching the
+	// ConfigMultiline.Regex belong to the previous event.
+	MultilineContinuationRegex MultilineContinuation = "regex"
+)
+
+// multilineSeparator separates the lines of a multi-line event in the agent
+// output; the client replaces it with "\n".
+const multilineSeparator = "\x1e"
+
+// Multiline configures how the multi-line log events, like stack traces, are
+// coalesced: the continuation lines are joined with the previous line on the
+// hosts, so the whole event is a single log message, and it's counted once.
+// See ParseMultiline.
+type Multiline struct {
+	// ContinuationRegex, if not empty, is the regex (in Go syntax) matching the
+	// continuation lines. If empty, the continuation lines are the ones which
+	// don't start with a timestamp.
+	ContinuationRegex string
+
+	// awkRegex is the ContinuationRegex translated to awk.
+	awkRegex string
+}
+
+// ParseMultiline validates the multiline config, and returns the
+// corresponding Multiline. If the config is nil, nil is returned.
+func ParseMultiline(cfg *ConfigMultiline) (*Multiline, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	continuation := cfg.Continuation
+	if continuation == "" {
+		continuation = MultilineContinuationNoTimestamp
+		if cfg.Regex != "" {
+			continuation = MultilineContinuationRegex
+		}
+	}
+
+	switch continuation {
+	case MultilineContinuationNoTimestamp:
+		if cfg.Regex != "" {
+			return nil, errors.Errorf(
+				"multiline: regex can only be used with the continuation %q", MultilineContinuationRegex,
+			)
+		}
+
+		return &Multiline{}, nil
+
+	case MultilineContinuationRegex:
+		if cfg.Regex == "" {
+			return nil, errors.Errorf("multiline: continuation %q needs the regex", continuation)
+		}
+
+		if _, err := regexp.Compile(cfg.Regex); err != nil {
+			return nil, errors.Annotatef(err, "multiline regex")
+		}
+
+		m := &Multiline{ContinuationRegex: cfg.Regex}
+		return m.forAWKDialect(AWKDialectDefault)
+
+	default:
+		return nil, errors.Errorf("multiline: invalid continuation %q", continuation)
+	}
+}
+
+// forAWKDialect returns the copy of the Multiline with the ContinuationRegex
+// translated to the given awk dialect. The receiver can be nil, then nil is
+// returned.
+func (m *Multiline) forAWKDialect(dialect AWKDialect) (*Multiline, error) {
+	if m == nil || m.ContinuationRegex == "" {
+		return m, nil
+	}
+
+	awkRegex, err := TranslateRegexToAWK(m.ContinuationRegex, dialect)
+	if err != nil {
+		return nil, errors.Annotatef(err, "multiline regex")
+	}
+
+	ret := *m
+	ret.awkRegex = awkRegex
+
+	return &ret, nil
+}
+
+// continuationAWKCond returns the awk condition which is true for the
+// continuation lines, for the logs with the given time format.
+func (m *Multiline) continuationAWKCond(timeFormat *TimeFormatDescr) string {
+	if m.awkRegex != "" {
+		return awkRegexLiteral(m.awkRegex)
+	}
+
+	return "!" + awkRegexLiteral(timestampPrefixAWKRegex(timeFormat))
+}
+
+// timestampPrefixAWKRegex returns the awk regex which matches the lines
+// starting with a timestamp of the given format, up to the minute key: every
+// digit in the layout matches any digit, every letter matches any letter,
+// and "_" (the space padding) matches a space or a digit.
+func timestampPrefixAWKRegex(timeFormat *TimeFormatDescr) string {
+	layout := timeFormat.TimestampLayout
+	if idx := strings.Index(layout, timeFormat.MinuteKeyLayout); idx >= 0 {
+		layout = layout[:idx+len(timeFormat.MinuteKeyLayout)]
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('^')
+
+	for i := 0; i < len(layout); i++ {
+		c := layout[i]
+		switch {
+		case c >= '0' && c <= '9':
+			sb.WriteString("[0-9]")
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			sb.WriteString("[A-Za-z]")
+		case c == '_':
+			sb.WriteString("[ 0-9]")
+		default:
+			sb.WriteString(regexQuoteMeta(string(c)))
+		}
+	}
+
+	return sb.String()
+}
+
+// joinMultilineEvent turns the multi-line event from the agent output back
+// into the normal multi-line string.
+func joinMultilineEvent(msg string) string {
+	return strings.ReplaceAll(msg, multilineSeparator, "\n")
+}
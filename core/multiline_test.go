@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMultiline(t *testing.T) {
+	ml, err := ParseMultiline(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, ml)
+
+	ml, err = ParseMultiline(&ConfigMultiline{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Multiline{}, ml)
+	}
+
+	ml, err = ParseMultiline(&ConfigMultiline{Regex: `^\s+at `})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `^\s+at `, ml.ContinuationRegex)
+		assert.Equal(t, `/^[ \t\r\n\f\v]+at /`, ml.continuationAWKCond(nil))
+	}
+
+	for _, cfg := range []ConfigMultiline{
+		{Continuation: "foo"},
+		{Continuation: MultilineContinuationRegex},
+		{Continuation: MultilineContinuationNoTimestamp, Regex: "foo"},
+		{Regex: "(+"},
+	} {
+		_, err := ParseMultiline(&cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestMultilineNoTimestampCond(t *testing.T) {
+	ml := &Multiline{}
+
+	timeFormat, err := GenerateTimeDescr("Jan _2 15:04:05")
+	if assert.NoError(t, err) {
+		assert.Equal(t,
+			`!/^[A-Za-z][A-Za-z][A-Za-z] [ 0-9][0-9] [0-9][0-9]:[0-9][0-9]/`,
+			ml.continuationAWKCond(timeFormat),
+		)
+	}
+
+	timeFormat, err = GenerateTimeDescr("2006-01-02T15:04:05.000000Z07:00")
+	if assert.NoError(t, err) {
+		assert.Equal(t,
+			`!/^[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9][A-Za-z][0-9][0-9]:[0-9][0-9]/`,
+			ml.continuationAWKCond(timeFormat),
+		)
+	}
+}
+
+func TestMultilineQuery(t *testing.T) {
+	dir := t.TempDir()
+
+	logPath := filepath.Join(dir, "app.log")
+	logData := strings.Join([]string{
+		"2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: starting",
+		"2025-03-10T10:00:02.000000+00:00 myhost myapp[123]: request failed",
+		"java.lang.NullPointerException: foo is null",
+		"\tat com.example.Foo.bar(Foo.java:42)",
+		"\tat com.example.Main.main(Main.java:7)",
+		"2025-03-10T10:01:00.000000+00:00 myhost myapp[123]: done",
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(logPath, []byte(logData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		descr     string
+		multiline *ConfigMultiline
+	}{
+		{descr: "no timestamp", multiline: &ConfigMultiline{}},
+		{descr: "regex", multiline: &ConfigMultiline{Regex: `^(\S+Exception|\s+at )`}},
+	} {
+		n, err := New(Options{
+			LStreams: "localhost",
+			ConfigLogStreams: ConfigLogStreams{
+				"localhost": {
+					LogFiles: []string{logPath},
+					Options: ConfigLogStreamOptions{
+						ShellInit: []string{"export TZ=UTC"},
+						Multiline: tc.multiline,
+					},
+				},
+			},
+			ClientID: "multiline_test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		resp, err := n.Query(ctx, QueryLogsParams{
+			From:        time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC),
+			MaxNumLines: 10,
+		})
+		if assert.NoError(t, err, tc.descr) && assert.Len(t, resp.Logs, 3, tc.descr) {
+			assert.Equal(t, "starting", resp.Logs[0].Msg, tc.descr)
+
+			// The stack trace is a part of the event.
+			assert.Equal(t, strings.Join([]string{
+				"request failed",
+				"java.lang.NullPointerException: foo is null",
+				"\tat com.example.Foo.bar(Foo.java:42)",
+				"\tat com.example.Main.main(Main.java:7)",
+			}, "\n"), resp.Logs[1].Msg, tc.descr)
+			assert.Equal(t, 2, resp.Logs[1].LogLinenumber, tc.descr)
+
+			assert.Equal(t, "done", resp.Logs[2].Msg, tc.descr)
+			assert.Equal(t, 6, resp.Logs[2].LogLinenumber, tc.descr)
+
+			// And it's counted once.
+			var minutes []int64
+			for minute := range resp.MinuteStats {
+				minutes = append(minutes, minute)
+			}
+			sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+
+			var numMsgs []int
+			for _, minute := range minutes {
+				numMsgs = append(numMsgs, resp.MinuteStats[minute].NumMsgs)
+			}
+			assert.Equal(t, []int{2, 1}, numMsgs, tc.descr)
+			assert.Equal(t, 3, resp.NumMsgsTotal, tc.descr)
+		}
+
+		// The filter matches the whole event.
+		resp, err = n.Query(ctx, QueryLogsParams{
+			From:        time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC),
+			Query:       "/NullPointerException/",
+			QueryLang:   QueryLangFilter,
+			MaxNumLines: 10,
+		})
+		if assert.NoError(t, err, tc.descr) && assert.Len(t, resp.Logs, 1, tc.descr) {
+			assert.True(t, strings.HasPrefix(resp.Logs[0].Msg, "request failed\n"), tc.descr)
+		}
+
+		cancel()
+		n.Close()
+	}
+}
@@ -0,0 +1,1053 @@
+package core
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/dimonomid/ssh_config"
+	"github.com/juju/errors"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+const (
+	// DefaultConnectTimeout is a default for Options.ConnectTimeout.
+	DefaultConnectTimeout = 30 * time.Second
+
+	// DefaultFollowInterval is a default for Options.FollowInterval.
+	DefaultFollowInterval = 5 * time.Second
+)
+
+// Options configures the Nerdlog instance created by New. Only LStreams is
+// required; everything else has sensible defaults.
+type Options struct {
+	// LStreams is the logstreams spec, the same as the one accepted by the
+	// nerdlog's UI, e.g. "myhost-*,otherhost".
+	LStreams string
+
+	// ConfigLogStreams contains nerdlog-specific config, typically coming from
+	// ~/.config/nerdlog/logstreams.yaml. The templated entries like
+	// "web-[01-50]" are expanded; see ExpandConfigLogStreams.
+	ConfigLogStreams ConfigLogStreams
+
+	// Selector, if not nil, restricts the logstreams resolved from LStreams to
+	// the matching ones, e.g. to only investigate a few hosts of a big fleet
+	// without changing the config; see ParseLStreamSelector. It can be changed
+	// later with SelectStreams.
+	Selector LStreamSelector
+
+	// SSHConfig contains the general ssh config, typically coming from
+	// ~/.ssh/config. Optional.
+	SSHConfig *ssh_config.Config
+
+	// SSHKeys specifies paths to ssh keys to try, in the given order, until
+	// an existing key is found.
+	SSHKeys []string
+
+	// SSHCert, if not empty, is the path to the OpenSSH certificate for the
+	// ssh key; by default, it's looked up next to the key, like
+	// ~/.ssh/id_ed25519-cert.pub.
+	SSHCert string
+
+	// SSHPKCS11, if not nil, is the PKCS#11 token (like a YubiKey or an HSM)
+	// to authenticate with when using the ssh-lib transport, instead of the
+	// ssh-agent or the ssh keys; the PIN is requested via the
+	// ShellConnDataRequest, like the key passphrase.
+	SSHPKCS11 *SSHPKCS11
+
+	// SSHCredentialProvider, if not nil, provides the credentials for the
+	// ssh-lib transport, for embedders having their own source of the
+	// credentials, like a secrets manager; the built-in ones are
+	// AgentCredentialProvider, FileCredentialProvider and
+	// EnvCredentialProvider, and they can be combined with
+	// ChainCredentialProvider.
+	SSHCredentialProvider CredentialProvider
+
+	// HostKeys verifies ssh host keys for the ssh-lib transport; if nil, host
+	// keys are not verified.
+	HostKeys *HostKeys
+
+	// CapabilitiesCache, if not nil, is used to cache the results of probing
+	// the hosts, so that the next time they connect faster.
+	CapabilitiesCache *CapabilitiesCache
+
+	// QueryCache, if not nil, is used to cache the results of the queries
+	// over the historical time ranges, so that re-running them is instant.
+	QueryCache *QueryCache
+
+	// LastVisits, if not nil, stores when the logs of every logstream were
+	// last viewed up to now: every successful query with the zero To (except
+	// LoadEarlier) counts as a visit. See QuerySinceLastVisit.
+	LastVisits *LastVisits
+
+	// CoalesceConnections, if true, makes the logstreams resolving to the same
+	// user, host and port share a single ssh connection; see
+	// LStreamsManagerParams.CoalesceConnections.
+	CoalesceConnections bool
+
+	// DefaultTransportMode is used for all logstreams which don't specify the
+	// transport explicitly. If nil, ssh-lib is used.
+	DefaultTransportMode *TransportMode
+
+	// NewTransport, if non-nil, is called to create the shell transport for
+	// every logstream, instead of the ones created accordingly to the config.
+	NewTransport func(ls LogStream) ShellTransport
+
+	// ConnectTimeout is how long Query waits for all logstreams to connect.
+	// If zero, DefaultConnectTimeout is used.
+	ConnectTimeout time.Duration
+
+	// SkipNotConnected, if true, makes Query proceed with the connected
+	// logstreams once the ConnectTimeout expires, instead of failing: the
+	// ones still not connected are skipped for this query (see
+	// LogRespTotal.SkippedLStreams), and can be queried later with
+	// RetrySkipped. If none are connected, Query fails anyway.
+	SkipNotConnected bool
+
+	// Columns, if not empty, define the columns of the CSV export done by
+	// QueryReader and FollowReader; see Columns.
+	Columns Columns
+
+	// MaxNumLines is used for queries which don't specify it. If zero,
+	// MaxNumLinesDefault is used.
+	MaxNumLines int
+
+	// MaxConcurrentQueries is the max number of queries to run at the same
+	// time on a single logstream, if the transport supports it. If zero,
+	// DefaultMaxConcurrentQueries is used.
+	MaxConcurrentQueries int
+
+	// MaxQueriesInFlight is the max number of logstreams to query at the same
+	// time, across the whole fleet. If zero, all logstreams are queried at
+	// once. See LStreamsManagerParams.MaxQueriesInFlight.
+	MaxQueriesInFlight int
+
+	// MaxOpenStreams is the max number of logstreams to have open at the same
+	// time; if the LStreams resolve to more of them, New fails. If zero, it's
+	// derived from the RLIMIT_NOFILE. See LStreamsManagerParams.MaxOpenStreams.
+	MaxOpenStreams int
+
+	// MaxConcurrentConnects is the max number of logstreams to connect at the
+	// same time, in the order of ConfigLogStreamOptions.Priority. If zero, all
+	// logstreams connect at once. See
+	// LStreamsManagerParams.MaxConcurrentConnects.
+	MaxConcurrentConnects int
+
+	// FollowInterval is how often Follow polls for new logs. If zero,
+	// DefaultFollowInterval is used.
+	FollowInterval time.Duration
+
+	// FollowReorderWindow, if non-zero, makes Follow hold the new logs for
+	// this long to merge the logs from all the logstreams in timestamp order,
+	// even if some hosts report them later than others; see ReorderBuffer.
+	// If zero, Follow reports the logs as they come, and the logs which arrive
+	// later than the newer ones from other hosts are skipped.
+	FollowReorderWindow time.Duration
+
+	// IdleTimeout, if non-zero, makes the logstreams disconnect once there were
+	// no queries (including the Follow polls), verifications or ad hoc
+	// commands for this long, to free the resources on both ends; the next
+	// query reconnects transparently, just taking longer. See
+	// LStreamsManagerParams.IdleTimeout.
+	IdleTimeout time.Duration
+
+	// AllowAdHocCmds, if true, allows running arbitrary shell commands on the
+	// hosts with RunAdHoc; AdHocTimeout and AdHocMaxOutputSize limit them. See
+	// LStreamsManager.RunAdHoc.
+	AllowAdHocCmds     bool
+	AdHocTimeout       time.Duration
+	AdHocMaxOutputSize int
+
+	// ShutdownGracePeriod is how long Shutdown waits for the busy logstreams
+	// to stop their commands; see LStreamsManagerParams.ShutdownGracePeriod.
+	ShutdownGracePeriod time.Duration
+
+	// ClientID is appended to the nerdlog_agent.sh and its index filenames on
+	// the hosts, to avoid conflicts with other clients; see
+	// LStreamsManagerParams.ClientID. If empty, the current OS username is
+	// used.
+	ClientID string
+
+	// Metrics, if not nil, receives the metrics like the number of
+	// connections and queries; see Metrics for the details.
+	Metrics Metrics
+
+	Logger *log.Logger
+
+	// Clock is the clock to use; if nil, the real clock is used.
+	Clock clock.Clock
+
+	// Callbacks below are all optional. They are called from the Nerdlog's
+	// internal goroutine, so they must not block.
+
+	// OnStateUpdate is called whenever the connection state changes.
+	OnStateUpdate func(state *LStreamsManagerState)
+
+	// OnBootstrapIssue is called when some logstream fails to bootstrap, or
+	// has some bootstrap warning.
+	OnBootstrapIssue func(issue *BootstrapIssue)
+
+	// OnDataRequest is called when the transport needs some data from the
+	// user, e.g. the passphrase for the ssh key. The response must be sent to
+	// the req.ResponseCh. If OnDataRequest is nil, such connections will just
+	// never succeed.
+	OnDataRequest func(req *ShellConnDataRequest)
+}
+
+// Nerdlog is the entrypoint for using nerdlog as a library: it connects to
+// the logstreams, and allows to query logs from them. It's a thin layer over
+// the LStreamsManager, which turns its asynchronous updates into blocking
+// calls.
+type Nerdlog struct {
+	opts Options
+
+	lsman     *LStreamsManager
+	updatesCh chan LStreamsManagerUpdate
+
+	// queryMtx serializes queries, since the LStreamsManager only runs one
+	// query at a time.
+	queryMtx sync.Mutex
+
+	mtx sync.Mutex
+	// lastState is the last state received from the LStreamsManager.
+	lastState *LStreamsManagerState
+	// stateCh is closed (and replaced with a new one) whenever lastState is
+	// updated.
+	stateCh chan struct{}
+	// logRespCh is non-nil while a query is in progress; it's 1-buffered, and
+	// receives the query response.
+	logRespCh chan *LogRespTotal
+	// viewParams and viewResp are the params and the response of the last
+	// successful query, i.e. the current view; used by SnapshotView.
+	viewParams QueryLogsParams
+	viewResp   *LogRespTotal
+
+	// lastQuery and lastSkipped are the params of the last successful query
+	// and the logstreams skipped by it; used by RetrySkipped. Guarded by
+	// queryMtx.
+	lastQuery   QueryLogsParams
+	lastSkipped []string
+
+	// failedQuery is the params of the last query which has returned a
+	// ResumeToken; once it's resumed successfully, it becomes the lastQuery.
+	// Guarded by queryMtx.
+	failedQuery QueryLogsParams
+
+	// readers contains the LogsReader-s returned by
+	// QueryReader and FollowReader whose producers are still running, so that
+	// Shutdown can wait for them to flush the last logs. Guarded by mtx.
+	readers map[*LogsReader]struct{}
+
+	closeOnce sync.Once
+	// closedCh is closed once the Nerdlog is fully closed.
+	closedCh chan struct{}
+}
+
+// New creates a Nerdlog instance, which immediately starts connecting to the
+// logstreams in the background. Close must be called once it's not needed.
+func New(opts Options) (*Nerdlog, error) {
+	if opts.LStreams == "" {
+		return nil, errors.Errorf("no logstreams specified")
+	}
+
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+
+	if opts.MaxNumLines == 0 {
+		opts.MaxNumLines = MaxNumLinesDefault
+	}
+
+	if err := opts.Columns.Validate(); err != nil {
+		return nil, errors.Annotatef(err, "columns")
+	}
+
+	if opts.FollowInterval == 0 {
+		opts.FollowInterval = DefaultFollowInterval
+	}
+
+	if opts.DefaultTransportMode == nil {
+		opts.DefaultTransportMode = NewTransportModeSSHLib()
+	}
+
+	if opts.ClientID == "" {
+		opts.ClientID = os.Getenv("USER")
+	}
+
+	if opts.Clock == nil {
+		opts.Clock = clock.New()
+	}
+
+	configLogStreams, err := ExpandConfigLogStreams(opts.ConfigLogStreams)
+	if err != nil {
+		return nil, errors.Annotatef(err, "expanding logstreams config")
+	}
+	opts.ConfigLogStreams = configLogStreams
+
+	// Validate the logstreams spec before creating the LStreamsManager, since
+	// it panics on invalid initial spec.
+	u, err := user.Current()
+	if err != nil {
+		return nil, errors.Annotatef(err, "getting current OS user")
+	}
+
+	resolver := NewLStreamsResolver(LStreamsResolverParams{
+		CurOSUser:            u.Username,
+		DefaultTransportMode: opts.DefaultTransportMode,
+		ConfigLogStreams:     opts.ConfigLogStreams,
+		SSHConfig:            opts.SSHConfig,
+	})
+
+	resolved, err := resolver.Resolve(opts.LStreams)
+	if err != nil {
+		return nil, errors.Annotatef(err, "resolving logstreams")
+	}
+
+	selected := selectLStreams(resolved, opts.Selector)
+	if len(resolved) > 0 && len(selected) == 0 {
+		return nil, errors.Errorf("none of the %d logstreams match the selector", len(resolved))
+	}
+
+	// If the RLIMIT_NOFILE can't be obtained, the LStreamsManager only logs
+	// it and doesn't limit anything, so don't fail here either.
+	if maxOpen, err := resolveMaxOpenStreams(opts.MaxOpenStreams); err == nil {
+		if err := maxOpen.check(len(selected)); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	n := &Nerdlog{
+		opts:      opts,
+		updatesCh: make(chan LStreamsManagerUpdate, 128),
+		stateCh:   make(chan struct{}),
+		closedCh:  make(chan struct{}),
+		readers:   map[*LogsReader]struct{}{},
+	}
+
+	n.lsman = NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: opts.ConfigLogStreams,
+		SSHConfig:        opts.SSHConfig,
+		SSHKeys:          opts.SSHKeys,
+		SSHCert:          opts.SSHCert,
+		SSHPKCS11:        opts.SSHPKCS11,
+		HostKeys:         opts.HostKeys,
+
+		SSHCredentialProvider: opts.SSHCredentialProvider,
+
+		CapabilitiesCache:   opts.CapabilitiesCache,
+		QueryCache:          opts.QueryCache,
+		CoalesceConnections: opts.CoalesceConnections,
+		NewTransport:        opts.NewTransport,
+
+		MaxConcurrentQueries:  opts.MaxConcurrentQueries,
+		MaxQueriesInFlight:    opts.MaxQueriesInFlight,
+		MaxOpenStreams:        opts.MaxOpenStreams,
+		MaxConcurrentConnects: opts.MaxConcurrentConnects,
+
+		IdleTimeout: opts.IdleTimeout,
+
+		AllowAdHocCmds:     opts.AllowAdHocCmds,
+		AdHocTimeout:       opts.AdHocTimeout,
+		AdHocMaxOutputSize: opts.AdHocMaxOutputSize,
+
+		ShutdownGracePeriod: opts.ShutdownGracePeriod,
+
+		Metrics: opts.Metrics,
+		Logger:  opts.Logger,
+
+		InitialLStreams:             opts.LStreams,
+		Selector:                    opts.Selector,
+		InitialDefaultTransportMode: opts.DefaultTransportMode,
+
+		ClientID: opts.ClientID,
+
+		UpdatesCh: n.updatesCh,
+
+		Clock: opts.Clock,
+	})
+
+	go n.run()
+
+	return n, nil
+}
+
+func (n *Nerdlog) run() {
+	for {
+		select {
+		case upd := <-n.updatesCh:
+			n.applyUpdate(upd)
+
+		// The LStreamsManager doesn't send anything once it's torn down; and
+		// until then, we keep consuming the updates even if the Nerdlog is
+		// considered closed already (see Shutdown), so that it doesn't get
+		// stuck.
+		case <-n.lsman.torndownCh:
+			return
+		}
+	}
+}
+
+func (n *Nerdlog) applyUpdate(upd LStreamsManagerUpdate) {
+	switch {
+	case upd.State != nil:
+		n.mtx.Lock()
+		n.lastState = upd.State
+		close(n.stateCh)
+		n.stateCh = make(chan struct{})
+		n.mtx.Unlock()
+
+		if n.opts.OnStateUpdate != nil {
+			n.opts.OnStateUpdate(upd.State)
+		}
+
+	case upd.LogResp != nil:
+		n.mtx.Lock()
+		respCh := n.logRespCh
+		n.logRespCh = nil
+		n.mtx.Unlock()
+
+		if respCh != nil {
+			respCh <- upd.LogResp
+		}
+
+	case upd.BootstrapIssue != nil:
+		if n.opts.OnBootstrapIssue != nil {
+			n.opts.OnBootstrapIssue(upd.BootstrapIssue)
+		}
+
+	case upd.DataRequest != nil:
+		if n.opts.OnDataRequest != nil {
+			n.opts.OnDataRequest(upd.DataRequest)
+		}
+	}
+}
+
+// Query waits for the logstreams to connect (up to the ConnectTimeout), runs
+// the query and returns the merged response. Queries are serialized: if
+// another query is in progress, Query waits for it to finish first.
+//
+// If some of the logstreams have returned errors, the response is returned
+// anyway (since it contains the errors), together with the combined error.
+//
+// If Options.SkipNotConnected is true, the logstreams which fail to connect
+// in time are skipped, and listed in the LogRespTotal.SkippedLStreams. The
+// SkipNotConnected and RetrySkipped query params are ignored: use the
+// Options.SkipNotConnected and RetrySkipped instead.
+//
+// If the query has failed on some logstreams while the others have delivered
+// their logs, the response contains the ResumeToken, which can be passed in
+// the params of the next Query to only query the failed logstreams again; see
+// QueryResumeToken.
+func (n *Nerdlog) Query(ctx context.Context, params QueryLogsParams) (*LogRespTotal, error) {
+	n.queryMtx.Lock()
+
+	if params.MaxNumLines == 0 {
+		params.MaxNumLines = n.opts.MaxNumLines
+	}
+
+	params.SkipNotConnected = n.opts.SkipNotConnected
+	params.RetrySkipped = false
+
+	// When resuming, only wait for the logstreams which are going to be
+	// queried.
+	var lstreams []string
+	if params.ResumeToken != nil {
+		lstreams = params.ResumeToken.Pending
+	}
+
+	return n.queryLocked(ctx, params, lstreams)
+}
+
+// TailN is a quick peek at the latest logs, which is usually the first thing
+// to do before narrowing the query by time: it returns the last numLines log
+// lines of every logstream regardless of the timestamps, merged by timestamp,
+// without scanning any time range; see QueryLogsParams.TailNumLines. To only
+// peek at some of the logstreams, select them with SelectStreams first.
+func (n *Nerdlog) TailN(ctx context.Context, numLines int) (*LogRespTotal, error) {
+	if numLines <= 0 {
+		return nil, errors.Errorf("invalid number of lines to tail: %d", numLines)
+	}
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		MaxNumLines:  numLines,
+		TailNumLines: numLines,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+// StopQuery stops the query in progress (if any) on all the logstreams,
+// without closing the connections: the Query returns ErrQueryStopped, and
+// the next one can run right away. Cancelling the Query's context has the
+// same effect, except that the Query returns the context's error.
+func (n *Nerdlog) StopQuery() {
+	if n.isClosed() {
+		return
+	}
+
+	n.lsman.StopQuery()
+}
+
+// RetrySkipped re-runs the last query only for the logstreams which were
+// skipped by it (see Options.SkipNotConnected): it waits for them to connect
+// (up to the ConnectTimeout), and returns the merged response containing the
+// logs from all the logstreams, like the original query. The ones which are
+// still not connected are skipped again.
+func (n *Nerdlog) RetrySkipped(ctx context.Context) (*LogRespTotal, error) {
+	n.queryMtx.Lock()
+
+	if len(n.lastSkipped) == 0 {
+		n.queryMtx.Unlock()
+		return nil, errors.Errorf("no skipped lstreams to retry")
+	}
+
+	params := n.lastQuery
+	params.RetrySkipped = true
+
+	return n.queryLocked(ctx, params, n.lastSkipped)
+}
+
+// queryLocked waits for the given logstreams (or all of them, if lstreams is
+// nil) to connect, and runs the query. It must be called with the queryMtx
+// locked, and it takes care of unlocking it.
+func (n *Nerdlog) queryLocked(
+	ctx context.Context, params QueryLogsParams, lstreams []string,
+) (*LogRespTotal, error) {
+	unlock := true
+	defer func() {
+		if unlock {
+			n.queryMtx.Unlock()
+		}
+	}()
+
+	if err := n.waitConnected(ctx, lstreams); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	respCh := make(chan *LogRespTotal, 1)
+
+	n.mtx.Lock()
+	n.logRespCh = respCh
+	n.mtx.Unlock()
+
+	// The visit covers the logs up to the moment the query starts, so that
+	// the ones arriving while it runs are not considered seen.
+	startedAt := n.opts.Clock.Now()
+
+	n.lsman.QueryLogs(params)
+
+	select {
+	case resp := <-respCh:
+		if err := combineErrors(resp.Errs); err != nil {
+			if resp.ResumeToken != nil && params.ResumeToken == nil {
+				n.failedQuery = params
+			}
+
+			return resp, errors.Trace(err)
+		}
+
+		switch {
+		case params.ResumeToken != nil:
+			n.lastQuery = n.failedQuery
+		case !params.RetrySkipped:
+			n.lastQuery = params
+		}
+		n.lastSkipped = resp.SkippedLStreams
+
+		n.mtx.Lock()
+		n.viewParams = n.lastQuery
+		n.viewResp = resp
+		n.mtx.Unlock()
+
+		if params.To.IsZero() && !params.LoadEarlier {
+			n.recordVisit(lstreams, resp.SkippedLStreams, startedAt)
+		}
+
+		return resp, nil
+
+	case <-ctx.Done():
+		// Stop the query on the hosts; the next one can only be started once
+		// this one is stopped, which doesn't take long, and the connections
+		// stay in place.
+		n.lsman.StopQuery()
+
+		unlock = false
+		go func() {
+			select {
+			case <-respCh:
+			case <-n.closedCh:
+			}
+
+			n.queryMtx.Unlock()
+		}()
+
+		return nil, errors.Trace(ctx.Err())
+
+	case <-n.closedCh:
+		return nil, errors.Errorf("closed")
+	}
+}
+
+// waitConnected waits until the given logstreams (or all of them, if
+// lstreams is nil) are connected. If Options.SkipNotConnected is true, then
+// after the ConnectTimeout it's enough for some of them to be connected.
+//
+// Since it's only called right before doing something with the logstreams,
+// it also wakes them up, in case they're disconnected because of the
+// Options.IdleTimeout.
+func (n *Nerdlog) waitConnected(ctx context.Context, lstreams []string) error {
+	timeout := n.opts.Clock.After(n.opts.ConnectTimeout)
+
+	if n.opts.IdleTimeout > 0 {
+		n.lsman.WakeUp()
+	}
+
+	for {
+		n.mtx.Lock()
+		st := n.lastState
+		stateCh := n.stateCh
+		n.mtx.Unlock()
+
+		if st != nil {
+			if st.NoMatchingLStreams {
+				return errors.Errorf("no matching lstreams")
+			}
+
+			// NOTE: Connected also becomes true when the logstreams are busy
+			// bootstrapping, and queries are queued until bootstrap is done.
+			if lstreams == nil && st.Connected {
+				return nil
+			}
+
+			if lstreams != nil && numLStreamsConnected(st, lstreams) == len(lstreams) {
+				return nil
+			}
+		}
+
+		select {
+		case <-stateCh:
+		case <-timeout:
+			if n.opts.SkipNotConnected && st != nil {
+				numConnected := st.NumConnected
+				if lstreams != nil {
+					numConnected = numLStreamsConnected(st, lstreams)
+				}
+
+				if numConnected > 0 {
+					return nil
+				}
+			}
+
+			fs := n.FleetStatus()
+
+			// If some logstreams have failed, return the details, so that the
+			// caller can check them with errors.Is(err, ErrAuthFailed) etc.
+			if err := fs.Err(); err != nil {
+				return errors.Annotatef(err, "after %s: %s", n.opts.ConnectTimeout, fs)
+			}
+
+			return errors.Annotatef(
+				ErrNotYetConnected, "after %s: %s", n.opts.ConnectTimeout, fs,
+			)
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-n.closedCh:
+			return errors.Errorf("closed")
+		}
+	}
+}
+
+// numLStreamsConnected returns how many of the given logstreams are connected
+// as per the state.
+func numLStreamsConnected(st *LStreamsManagerState, lstreams []string) int {
+	num := 0
+	for _, name := range lstreams {
+		for state, names := range st.LStreamsByState {
+			if _, ok := names[name]; ok && isStateConnected(state) {
+				num++
+			}
+		}
+	}
+
+	return num
+}
+
+// hasLStream returns whether the given logstream exists as per the state.
+func hasLStream(st *LStreamsManagerState, lstream string) bool {
+	for _, names := range st.LStreamsByState {
+		if _, ok := names[lstream]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Follow keeps polling the logstreams for new logs matching the query, every
+// FollowInterval, and calls fn with every batch of new logs, until the ctx is
+// done or an error occurs. The first batch contains the latest logs since
+// params.From (or just the latest logs, if it's zero); params.To is ignored.
+//
+// Keep in mind that if more than params.MaxNumLines new logs arrive between
+// the polls, the older ones of them are skipped.
+//
+// The polls are regular queries, which run over the same connections as
+// Query does: the connections belong to the logstreams rather than to any
+// particular query, so switching between Query and Follow, or stopping
+// Follow, never reconnects.
+//
+// Since the polls are queries, the logs are only sent once the hosts have the
+// whole response, so the latency is up to Options.FollowInterval, regardless
+// of any output buffering on the hosts.
+//
+// If Options.FollowReorderWindow is set, the logs are reordered by timestamp
+// before being reported; see followReordered.
+func (n *Nerdlog) Follow(
+	ctx context.Context, params QueryLogsParams, fn func(logs []LogMsg),
+) error {
+	if n.opts.FollowReorderWindow > 0 {
+		return n.followReordered(ctx, params, fn)
+	}
+
+	cursor := followCursor{}
+
+	for {
+		queryParams := params
+		queryParams.To = time.Time{}
+		if !cursor.lastTime.IsZero() {
+			queryParams.From = cursor.lastTime
+		}
+
+		resp, err := n.Query(ctx, queryParams)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if logs := cursor.newLogs(resp.Logs); len(logs) > 0 {
+			fn(logs)
+		}
+
+		select {
+		case <-n.opts.Clock.After(n.opts.FollowInterval):
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-n.closedCh:
+			return errors.Errorf("closed")
+		}
+	}
+}
+
+// followCursor remembers the last log message reported by Follow, so that
+// only the new ones are reported next time. Messages are identified by the
+// timestamp and the number of messages with the same timestamp, the same way
+// as the "load earlier" logic does it.
+type followCursor struct {
+	lastTime      time.Time
+	numAtLastTime int
+}
+
+// newLogs takes the logs sorted by time, and returns the ones which weren't
+// seen yet, updating the cursor.
+func (c *followCursor) newLogs(logs []LogMsg) []LogMsg {
+	var ret []LogMsg
+
+	numAtLastTime := 0
+	for _, msg := range logs {
+		if msg.Time.Before(c.lastTime) {
+			continue
+		}
+
+		if msg.Time.Equal(c.lastTime) {
+			numAtLastTime++
+			if numAtLastTime <= c.numAtLastTime {
+				continue
+			}
+		}
+
+		ret = append(ret, msg)
+	}
+
+	if len(ret) == 0 {
+		return nil
+	}
+
+	c.lastTime = ret[len(ret)-1].Time
+	c.numAtLastTime = 0
+	for _, msg := range logs {
+		if msg.Time.Equal(c.lastTime) {
+			c.numAtLastTime++
+		}
+	}
+
+	return ret
+}
+
+// followReordered is the Follow implementation used when
+// Options.FollowReorderWindow is set. Every poll queries the logs since the
+// reorder window before the latest seen message, so that the logs which
+// arrive late from some hosts are still picked up; the ones which were already
+// seen are filtered out by followSeen, and the new ones go through the
+// ReorderBuffer. Whatever is still held in the buffer when it returns is
+// reported before returning.
+func (n *Nerdlog) followReordered(
+	ctx context.Context, params QueryLogsParams, fn func(logs []LogMsg),
+) error {
+	window := n.opts.FollowReorderWindow
+	rb := NewReorderBuffer(window)
+	seen := newFollowSeen()
+
+	defer func() {
+		if logs := rb.Flush(); len(logs) > 0 {
+			fn(logs)
+		}
+	}()
+
+	for {
+		queryParams := params
+		queryParams.To = time.Time{}
+		if !seen.since.IsZero() {
+			queryParams.From = seen.since
+		}
+
+		resp, err := n.Query(ctx, queryParams)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		newLogs := seen.newLogs(resp.Logs, window)
+		if logs := rb.Add(newLogs, n.opts.Clock.Now()); len(logs) > 0 {
+			fn(logs)
+		}
+
+		select {
+		case <-n.opts.Clock.After(n.opts.FollowInterval):
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-n.closedCh:
+			return errors.Errorf("closed")
+		}
+	}
+}
+
+// followSeen remembers the log messages recently seen by followReordered,
+// so that the overlapping query results don't report them again. Unlike
+// followCursor, it doesn't rely on the results being ordered: the messages
+// are identified by the logstream, timestamp and the original line, and the
+// number of such messages.
+type followSeen struct {
+	// since is the time from which the messages are remembered; the older
+	// ones are ignored.
+	since time.Time
+
+	counts map[followSeenKey]int
+}
+
+type followSeenKey struct {
+	lstream  string
+	time     time.Time
+	origLine string
+}
+
+func newFollowSeen() *followSeen {
+	return &followSeen{
+		counts: map[followSeenKey]int{},
+	}
+}
+
+// newLogs returns the logs which weren't seen yet, and then forgets the ones
+// older than the window before the latest seen message.
+func (s *followSeen) newLogs(logs []LogMsg, window time.Duration) []LogMsg {
+	var ret []LogMsg
+
+	counts := map[followSeenKey]int{}
+	maxTime := s.since.Add(window)
+	for _, msg := range logs {
+		if msg.Time.Before(s.since) {
+			continue
+		}
+
+		key := followSeenKey{
+			lstream:  msg.Context["lstream"],
+			time:     msg.Time,
+			origLine: msg.OrigLine,
+		}
+
+		counts[key]++
+		if counts[key] > s.counts[key] {
+			ret = append(ret, msg)
+		}
+
+		if msg.Time.After(maxTime) {
+			maxTime = msg.Time
+		}
+	}
+
+	for key, cnt := range counts {
+		if cnt > s.counts[key] {
+			s.counts[key] = cnt
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil
+	}
+
+	s.since = maxTime.Add(-window)
+	for key := range s.counts {
+		if key.time.Before(s.since) {
+			delete(s.counts, key)
+		}
+	}
+
+	return ret
+}
+
+// Subscribe returns the channel which receives the transport updates of all
+// the logstreams, and the function to unsubscribe; see
+// LStreamsManager.Subscribe.
+func (n *Nerdlog) Subscribe() (<-chan ConnEvent, func()) {
+	return n.lsman.Subscribe()
+}
+
+// VerifyStreams waits for the logstreams to connect (like Query does), and
+// then checks that their logs are actually readable; see
+// LStreamsManager.VerifyLStreams. The logstreams which fail to connect in time
+// are reported as not connected, instead of failing the whole call.
+func (n *Nerdlog) VerifyStreams(ctx context.Context) (map[string]LStreamVerifyResult, error) {
+	if err := n.waitConnected(ctx, nil); err != nil {
+		// Only proceed if it's just the connection timeout.
+		if ctx.Err() != nil || n.isClosed() || n.FleetStatus().NumLStreams == 0 {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return n.lsman.VerifyLStreams(ctx), nil
+}
+
+// RunAdHoc waits for the given logstream to connect (like Query does), and
+// runs an arbitrary shell command on its host; see LStreamsManager.RunAdHoc.
+func (n *Nerdlog) RunAdHoc(ctx context.Context, lstream, command string) (string, error) {
+	if !n.opts.AllowAdHocCmds {
+		return "", errors.Trace(ErrAdHocCmdsDisabled)
+	}
+
+	// Don't wait for the logstream which doesn't exist.
+	n.mtx.Lock()
+	st := n.lastState
+	n.mtx.Unlock()
+
+	if st != nil && !hasLStream(st, lstream) {
+		return "", errors.Errorf("%s: no such logstream", lstream)
+	}
+
+	if err := n.waitConnected(ctx, []string{lstream}); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	output, err := n.lsman.RunAdHoc(ctx, lstream, command)
+	if err != nil {
+		return output, errors.Trace(err)
+	}
+
+	return output, nil
+}
+
+// Reload applies the new logstreams config without reconnecting the
+// logstreams which haven't changed; see LStreamsManager.Reload. If a query is
+// in progress, Reload waits for it to finish first.
+func (n *Nerdlog) Reload(ctx context.Context, configLogStreams ConfigLogStreams) (*LStreamsDiff, error) {
+	n.queryMtx.Lock()
+	defer n.queryMtx.Unlock()
+
+	diff, err := n.lsman.Reload(ctx, configLogStreams)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return diff, nil
+}
+
+// SelectStreams replaces the selector given as Options.Selector; see
+// LStreamsManager.SelectStreams.
+func (n *Nerdlog) SelectStreams(selector LStreamSelector) error {
+	n.queryMtx.Lock()
+	defer n.queryMtx.Unlock()
+
+	return errors.Trace(n.lsman.SelectStreams(selector))
+}
+
+// isClosed returns whether Close was called.
+func (n *Nerdlog) isClosed() bool {
+	select {
+	case <-n.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// FleetStatus returns the current aggregated connection status of all the
+// logstreams; see LStreamsManager.FleetStatus.
+func (n *Nerdlog) FleetStatus() FleetSummary {
+	return n.lsman.FleetStatus()
+}
+
+// Close disconnects from all the logstreams, and waits for the teardown to
+// complete. It's safe to call Close multiple times.
+func (n *Nerdlog) Close() {
+	n.lsman.Close()
+	n.lsman.Wait()
+	n.markClosed()
+}
+
+// Shutdown is the orderly version of Close, e.g. for handling Ctrl-C: it
+// cancels the connects in progress, stops the queries on the hosts, closes
+// the connections (see LStreamsManager.Shutdown for the details), and then
+// waits for the LogsReader-s returned by QueryReader and FollowReader to
+// write out the logs they have already got; their producers fail once the
+// Nerdlog is closed. Keep in mind that the readers have to be read until
+// io.EOF (or an error) for that.
+//
+// It returns once all that is done, or once the ctx is done, in which case
+// the ctx's error is returned; the teardown then completes in the
+// background, without waiting for anything. It's safe to call Shutdown
+// multiple times and concurrently, as well as together with Close.
+func (n *Nerdlog) Shutdown(ctx context.Context) error {
+	err := n.lsman.Shutdown(ctx)
+	n.markClosed()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	n.mtx.Lock()
+	readers := make([]*LogsReader, 0, len(n.readers))
+	for r := range n.readers {
+		readers = append(readers, r)
+	}
+	n.mtx.Unlock()
+
+	for _, r := range readers {
+		select {
+		case <-r.doneCh:
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "waiting for readers")
+		}
+	}
+
+	return nil
+}
+
+// markClosed makes the Nerdlog closed, so that all the calls in progress
+// and the new ones fail.
+func (n *Nerdlog) markClosed() {
+	n.closeOnce.Do(func() {
+		close(n.closedCh)
+	})
+}
@@ -37,6 +37,31 @@ positional_args=()
 
 max_num_lines=100
 
+# If more than 1, only every Nth line is read; see --sample-rate.
+sample_rate=1
+
+# If more than 1, the stats are counted in the buckets of this many minutes;
+# see --stats-bucket-minutes.
+stats_bucket_minutes=1
+
+# If not empty, only the stats and the groups are printed; see
+# --aggregate-only.
+aggregate_only=''
+
+# If not empty, only the last N lines are read; see --tail-lines.
+tail_lines=''
+
+# If not empty, the latest logfile is only read up to the pinned size; see
+# --pin-last.
+pin_last=''
+
+# If not empty, the host is busybox-based; see --busybox.
+busybox=''
+
+# If not empty, the awk condition which is true for the continuation lines of
+# the multi-line log events; see --multiline-continuation.
+multiline_continuation=''
+
 awktime_month='monthByName[substr($0, 1, 3)]'
 awktime_year='yearByMonth[month]'
 awktime_day='(substr($0, 5, 1) == " ") ? "0" substr($0, 6, 1) : substr($0, 5, 2)'
@@ -60,6 +85,13 @@ function find_gawk_binary() { # {{{
     fi
   fi
 
+  # On the busybox-based hosts, awk is the busybox applet, which is never
+  # GNU Awk, and which prints the whole usage to stderr in response to the
+  # --version, so don't bother.
+  if [[ "$busybox" != "" ]]; then
+    exit 1
+  fi
+
   awk_path="$(which awk)"
   if [[ $? == 0 ]]; then
     if [ -x "$awk_path" ]; then
@@ -77,6 +109,30 @@ function find_gawk_binary() { # {{{
   exit 1
 } # }}}
 
+# Prints the flavour of the awk which the custom agents run the NLFILTER with,
+# i.e. the default awk on the host: gawk, mawk, busybox or posix (meaning the
+# unknown one, which hopefully supports at least the POSIX regexes).
+function detect_awk_dialect() { # {{{
+  awk_version_str="$(awk --version 2>&1 < /dev/null)"
+  if echo "$awk_version_str" | grep -q 'GNU Awk'; then
+    echo "gawk"
+    exit 0
+  fi
+
+  if echo "$awk_version_str" | grep -q 'BusyBox'; then
+    echo "busybox"
+    exit 0
+  fi
+
+  # Older versions of mawk don't support --version.
+  if awk -W version 2>&1 < /dev/null | grep -q 'mawk'; then
+    echo "mawk"
+    exit 0
+  fi
+
+  echo "posix"
+} # }}}
+
 function detect_timezone() { # {{{
   # Prefer TZ env var if available
   if [[ "$TZ" != "" ]]; then
@@ -269,6 +325,70 @@ while [[ $# -gt 0 ]]; do
       shift # past value
       ;;
 
+    # Only read every Nth line, ignoring the rest, to get the approximate
+    # results faster on huge logs; the stats are printed as counted, and it's
+    # up to the client to scale them.
+    --sample-rate)
+      sample_rate="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # Count the stats in the buckets of N minutes instead of every minute, to
+    # make the output smaller on long time ranges; every bucket is printed
+    # with the minute key of its first minute. N must divide 60.
+    --stats-bucket-minutes)
+      stats_bucket_minutes="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # Only print the aggregates (the stats, and the groups if --group-code is
+    # given), without any log lines, for the analytic queries which don't need
+    # them.
+    --aggregate-only)
+      aggregate_only="1"
+      shift # past argument
+      ;;
+
+    # Only read the last N lines of the latest log file (or of journalctl),
+    # regardless of the timestamps, for a quick peek at the latest logs: the
+    # index isn't used, and --from and --to should not be given. The line
+    # numbers are then counted from the first of those N lines.
+    --tail-lines)
+      tail_lines="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # Pins the latest log file, so that the re-runs of the query read exactly
+    # the same bytes even though the file keeps growing: the value is either
+    # "<inode>:<size>", and then only the first <size> bytes of the file are
+    # read, or "-", and then the current inode and size are pinned and printed
+    # to stderr as "pin_last:<inode>:<size>", to be passed on the next runs.
+    # If the file has been rotated since it was pinned, the pin is ignored
+    # with the "warn_pin_lost" warning.
+    --pin-last)
+      pin_last="$2"
+      if ! [[ "$pin_last" == "-" || "$pin_last" =~ ^[0-9]+:[0-9]+$ ]]; then
+        echo "error:invalid --pin-last: '$pin_last'" 1>&2
+        exit 1
+      fi
+      shift # past argument
+      shift # past value
+      ;;
+
+    # Awk condition which is true for the continuation lines of the multi-line
+    # log events, like stack traces: such lines are joined with the previous
+    # ones, so that every event is handled as a single line. The lines are
+    # joined with the \036 character, and the line number of the event is the
+    # number of its first line.
+    --multiline-continuation)
+      multiline_continuation="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
     --awktime-month)
       awktime_month="$2"
       shift # past argument
@@ -295,6 +415,47 @@ while [[ $# -gt 0 ]]; do
       shift # past value
       ;;
 
+    # Awk code which extracts named regex captures from the current line into
+    # the nlcaps variable; they are printed as "mc:" lines right before the
+    # corresponding "m:" lines.
+    --captures-code)
+      captures_code="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # Awk code which replaces the current line ($0) with just the selected
+    # fields, to reduce the amount of data we output.
+    --projection-code)
+      projection_code="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # Awk code which sets the nlgrp variable to the value of the field to
+    # group the lines by; the matching lines are counted by these values, and
+    # the counts are printed as "g:<count>:<value>" lines.
+    --group-code)
+      group_code="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
+    # The host is busybox-based, like Alpine: the Go app detects that during
+    # bootstrap, and passes this flag to all the commands.
+    --busybox)
+      busybox=1
+      shift # past argument
+      ;;
+
+    # Path to the custom agent script which reads the logs instead of this
+    # one; only used by the logstream_info command, see below.
+    --custom-agent)
+      custom_agent="$2"
+      shift # past argument
+      shift # past value
+      ;;
+
     -*|--*)
       echo "Unknown option $1" 1>&2
       exit 1
@@ -308,6 +469,30 @@ done
 
 set -- "${positional_args[@]}" # restore positional parameters
 
+# The logstreams with a custom agent don't use the log files: the custom agent
+# reads the logs on its own. So for logstream_info, we only detect the
+# timezone, and print the latest lines from the custom agent as the example
+# ones, so that the client can autodetect the format.
+if [[ "$1" == "logstream_info" && "$custom_agent" != "" ]]; then
+  host_timezone="$(detect_timezone)"
+  if [[ $? == 0 ]]; then
+    echo "host_timezone:$host_timezone"
+  else
+    echo "warn:failed to detect host timezone"
+  fi
+
+  echo "awk_dialect:$(detect_awk_dialect)"
+
+  custom_agent_output="$(NLFROM= NLTO= NLFILTER= NLMAXNUMLINES=2 bash "$custom_agent")"
+  if [[ $? != 0 ]]; then
+    echo "error:custom agent $custom_agent has failed" 1>&2
+    exit 1
+  fi
+
+  echo "$custom_agent_output" | sed -n 's/^m:[0-9]*:/example_log_line:/p'
+  exit 0
+fi
+
 if [[ $timestamp_until_precise != "" || $timestamp_until_seconds != "" || $skip_n_latest != "" ]]; then
   if [[ "$timestamp_until_precise" == "" ]]; then
     echo "error:--timestamp-until-seconds, --timestamp-until-precise, --skip-n-latest should all be given together, but --timestamp-until-precise is not set" 1>&2
@@ -339,6 +524,11 @@ fi
 # logstream_info command.
 awk_binary="$(find_gawk_binary)"
 if [[ $? != 0 ]]; then
+  if [[ "$busybox" != "" ]]; then
+    echo "error:gawk (GNU Awk) is a requirement, but the busybox awk can't be used. Please install gawk (on Alpine: apk add gawk), then retry" 1>&2
+    exit 1
+  fi
+
   echo "error:gawk (GNU Awk) is a requirement, but not found on the system. Please install it, then retry" 1>&2
   exit 1
 fi
@@ -394,17 +584,18 @@ if [[ "$logfile_prev" == "${SPECIAL_FILENAME_AUTO}" ]]; then
   fi
 fi
 
-# A simple hack to account for cases when /var/log/syslog.1 doesn't exist:
-# create an empty file and pretend that it's an empty log file.
-if [ ! -e "$logfile_prev" ] && [[ "$logfile_prev" != "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
-  echo "debug:prev logfile $logfile_prev doesn't exist, using a dummy empty file /tmp/nerdlog-empty-file" 1>&2
+# function use_dummy_prev_logfile() {{{
+#
+# Replaces the $logfile_prev with a dummy empty file, so that the rest of the
+# script pretends that the prev log file is empty.
+function use_dummy_prev_logfile() {
   # TODO: instead of using the same file /tmp/nerdlog-empty-file , maybe
   # generate the name based on the index filename, to make the tests more
   # self-contained.
   logfile_prev="/tmp/nerdlog-empty-file"
   if [ ! -f "$logfile_prev" ] || [ -s "$logfile_prev" ]; then
-    rm -f $logfile_prev || exit 1
-    touch $logfile_prev || exit 1
+    rm -f $logfile_prev || return 1
+    touch $logfile_prev || return 1
   fi
 
   # For stable output in tests, also update the creation/modification time of
@@ -415,6 +606,13 @@ if [ ! -e "$logfile_prev" ] && [[ "$logfile_prev" != "${SPECIAL_FILENAME_JOURNAL
   if [[ $? == 0 ]]; then
     touch -d "@$ctime" $logfile_prev
   fi
+} # }}}
+
+# A simple hack to account for cases when /var/log/syslog.1 doesn't exist:
+# create an empty file and pretend that it's an empty log file.
+if [ ! -e "$logfile_prev" ] && [[ "$logfile_prev" != "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
+  echo "debug:prev logfile $logfile_prev doesn't exist, using a dummy empty file /tmp/nerdlog-empty-file" 1>&2
+  use_dummy_prev_logfile || exit 1
 fi
 
 command="$1"
@@ -437,6 +635,9 @@ case "${command}" in
       echo "warn:failed to detect host timezone"
     fi
 
+    # All the awk code runs by the $awk_binary, which is always gawk.
+    echo "awk_dialect:gawk"
+
     if [[ "${logfile_last}" != "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
       if [ ! -e ${logfile_last} ]; then
         echo "error:${logfile_last} does not exist" 1>&2
@@ -497,6 +698,33 @@ case "${command}" in
     exit 0
     ;;
 
+  verify)
+    # Cheaply check that the logs are actually readable, printing the result
+    # for every log file as "verify:<status>:<filename>", where status is one
+    # of: readable, not_found, permission_denied.
+    if [[ "${logfile_last}" != "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
+      for logfile in "${logfile_last}" "${logfile_prev}"; do
+        if [ ! -e "${logfile}" ]; then
+          echo "verify:not_found:${logfile}"
+        elif [ ! -r "${logfile}" ]; then
+          echo "verify:permission_denied:${logfile}"
+        else
+          echo "verify:readable:${logfile}"
+        fi
+      done
+    else
+      if ! command -v "$journalctl_binary" > /dev/null 2>&1; then
+        echo "verify:not_found:${SPECIAL_FILENAME_JOURNALCTL}"
+      elif ! $journalctl_binary --quiet -n 0 > /dev/null 2>&1; then
+        echo "verify:permission_denied:${SPECIAL_FILENAME_JOURNALCTL}"
+      else
+        echo "verify:readable:${SPECIAL_FILENAME_JOURNALCTL}"
+      fi
+    fi
+
+    exit 0
+    ;;
+
   *)
     echo "error:invalid command ${command}" 1>&2
     exit 1
@@ -516,14 +744,226 @@ function printPercentage(numCur, numTotal) {
     lastPercent = curPercent
   }
 }
+
+# printBytesProgress is the same as printPercentage, but for the scans of
+# files, where we know the byte offsets; so whenever the percentage is
+# printed, it also prints the number of bytes processed and the total number
+# of bytes to process, as "p:b:<cur>:<total>".
+function printBytesProgress(bytesCur, bytesTotal) {
+  curPercent = int(bytesCur/bytesTotal*20);
+  if (curPercent != lastPercent) {
+    print "p:p:" curPercent*5 >> "/dev/stderr"
+    print "p:b:" bytesCur ":" bytesTotal >> "/dev/stderr"
+    lastPercent = curPercent
+  }
+}
 '
 
+# The functions to access the fields of the JSON logs, used by the filters,
+# projections etc generated by the client for the logstreams with
+# log_format json. They only use the POSIX awk.
+awk_func_json_get='
+# nljsonget returns the value at the dotted path, like "request.headers.host",
+# in the JSON object s (typically $0), or an empty string if there is no such
+# value, or it is null. The strings are returned without the quotes and with
+# the escapes resolved (except \u), and the rest of the values (numbers,
+# booleans, objects and arrays) as they are in the JSON.
+function nljsonget(s, path,    keys, n, i) {
+  n = split(path, keys, ".");
+  for (i = 1; i <= n; i++) {
+    s = nljsonkey(s, keys[i]);
+    if (s == "") {
+      return "";
+    }
+  }
+
+  if (substr(s, 1, 1) == "\"") {
+    return nljsonunquote(s);
+  }
+
+  if (s == "null") {
+    return "";
+  }
+
+  return s;
+}
+
+# nljsonkey returns the raw JSON value of the given key of the object s, or
+# an empty string if there is no such key (or s is not an object).
+function nljsonkey(s, key,    n, i, j, c, depth) {
+  # Quick check, to avoid scanning the lines which surely do not have it.
+  if (index(s, "\"" key "\"") == 0) {
+    return "";
+  }
+
+  n = length(s);
+  depth = 0;
+  for (i = 1; i <= n; i++) {
+    c = substr(s, i, 1);
+    if (c == "\"") {
+      j = nljsonstrend(s, i);
+      if (depth == 1 && substr(s, i + 1, j - i - 1) == key) {
+        # It might be either a key or a value; the key is followed by a colon.
+        for (i = j + 1; i <= n && index(" \t", substr(s, i, 1)) > 0; i++) {}
+        if (substr(s, i, 1) == ":") {
+          for (i++; i <= n && index(" \t", substr(s, i, 1)) > 0; i++) {}
+          return nljsonvalue(s, i);
+        }
+        i--;
+      } else {
+        i = j;
+      }
+    } else if (c == "{" || c == "[") {
+      if (depth == 0 && c == "[") {
+        return "";
+      }
+      depth++;
+    } else if (c == "}" || c == "]") {
+      depth--;
+      if (depth <= 0) {
+        return "";
+      }
+    }
+  }
+
+  return "";
+}
+
+# nljsonvalue returns the raw JSON value starting at the position i of s.
+function nljsonvalue(s, i,    n, j, c, depth) {
+  c = substr(s, i, 1);
+  if (c == "\"") {
+    return substr(s, i, nljsonstrend(s, i) - i + 1);
+  }
+
+  n = length(s);
+  if (c == "{" || c == "[") {
+    depth = 0;
+    for (j = i; j <= n; j++) {
+      c = substr(s, j, 1);
+      if (c == "\"") {
+        j = nljsonstrend(s, j);
+      } else if (c == "{" || c == "[") {
+        depth++;
+      } else if (c == "}" || c == "]") {
+        depth--;
+        if (depth == 0) {
+          break;
+        }
+      }
+    }
+
+    return substr(s, i, j - i + 1);
+  }
+
+  for (j = i; j <= n && index(",}] \t", substr(s, j, 1)) == 0; j++) {}
+
+  return substr(s, i, j - i);
+}
+
+# nljsonstrend returns the position of the closing quote of the JSON string
+# which starts at the position i of s.
+function nljsonstrend(s, i,    n, c) {
+  n = length(s);
+  for (i++; i <= n; i++) {
+    c = substr(s, i, 1);
+    if (c == "\\") {
+      i++;
+    } else if (c == "\"") {
+      return i;
+    }
+  }
+
+  return n;
+}
+
+# nljsonunquote returns the contents of the quoted JSON string s, with the
+# escapes resolved (except \u, which is left as is).
+function nljsonunquote(s,    n, i, c, ret) {
+  n = length(s) - 1;
+  ret = "";
+  for (i = 2; i <= n; i++) {
+    c = substr(s, i, 1);
+    if (c == "\\" && i < n) {
+      i++;
+      c = substr(s, i, 1);
+      if (c == "n") {
+        c = "\n";
+      } else if (c == "t") {
+        c = "\t";
+      } else if (c == "r") {
+        c = "\r";
+      } else if (c == "u") {
+        c = "\\u";
+      }
+    }
+    ret = ret c;
+  }
+
+  return ret;
+}
+'
+
+# Prints the awk code which sets the nlsk variable to the stats key of the
+# current line: the minute key, with the minutes rounded down to the
+# multiple of stats_bucket_minutes, if it's more than 1.
+function awk_stats_key_code {
+  echo "nlsk = $awktime_minute_key;"
+  if [[ "$stats_bucket_minutes" -gt 1 ]]; then
+    echo "nlhm = $awktime_hhmm; nli = index(nlsk, nlhm);
+    if (nli > 0) {
+      nlmm = substr(nlhm, 4, 2) + 0;
+      nlsk = substr(nlsk, 1, nli + 2) sprintf(\"%02d\", nlmm - nlmm % $stats_bucket_minutes) substr(nlsk, nli + 5);
+    }"
+  fi
+}
+
 function run_awk_script_logfiles {
   awk_pattern=''
   if [[ "$user_pattern" != "" ]]; then
     awk_pattern="!($user_pattern) {numFilteredOut++; next}"
   fi
 
+  awk_sample_check=''
+  if [[ "$sample_rate" -gt 1 ]]; then
+    awk_sample_check="NR % $sample_rate != 0 {next}"
+  fi
+
+  awk_stats_key="$(awk_stats_key_code)"
+
+  awk_aggregate_only_skip=''
+  if [[ "$aggregate_only" != "" ]]; then
+    awk_aggregate_only_skip='next;'
+  fi
+
+  captures_store=''
+  captures_print=''
+  if [[ "$captures_code" != "" ]]; then
+    captures_store="nlcaps = \"\"
+    $captures_code
+    lastcaps[curline] = nlcaps;"
+    captures_print="if (lastcaps[ln] != \"\") { print \"mc:\" lastcaps[ln]; }"
+  fi
+
+  group_store=''
+  group_print=''
+  if [[ "$group_code" != "" ]]; then
+    group_store="$group_code
+    if (nlgrp != \"\") { groups[nlgrp]++; }"
+    group_print='for (g in groups) { print "g:" groups[g] ":" g; }'
+  fi
+
+  # With the multi-line events, every event comes from the
+  # awk_join_script prefixed with the number of its first line, so cut it.
+  awk_multiline_strip=''
+  if [[ "$multiline_continuation" != "" ]]; then
+    awk_multiline_strip='{
+    nlsep = index($0, "\036");
+    linenr = substr($0, 1, nlsep - 1) + 0;
+    $0 = substr($0, nlsep + 1);
+  }'
+  fi
+
   # NOTE: this script MUST be executed with the "-b" awk key, which means that
   # awk will work in terms of bytes, not characters. We use length($0) there and
   # we rely on it being number of bytes.
@@ -535,19 +975,23 @@ function run_awk_script_logfiles {
   # "<".
   awk_script='
   '$awk_func_print_percentage'
+  '$awk_func_json_get'
 
   BEGIN {
     bytenr=1; curline=0; maxlines='$max_num_lines'; lastPercent=0;
     numFilteredOut=0;
     prevMinKey="";
   }
+  '$awk_multiline_strip'
   { bytenr += length($0)+1 }
   NR % 100 == 0 {
-    printPercentage(bytenr, '$num_bytes_to_scan')
+    printBytesProgress(bytenr, '$num_bytes_to_scan')
   }
+  '$awk_sample_check'
   '$awk_pattern'
   {
-    curMinKey = '"$awktime_minute_key"';
+    '$awk_stats_key'
+    curMinKey = nlsk;
 
     # NOTE: this was a naive attempt to better handle the case when timestamps
     # have decreased: instead of incrementing the bucket of the decreased
@@ -577,11 +1021,15 @@ function run_awk_script_logfiles {
     #}
 
     stats[curMinKey]++;
+    '$group_store'
+    '$awk_aggregate_only_skip'
 
     '$lines_until_check'
 
+    '$captures_store'
+    '$projection_code'
     lastlines[curline] = $0;
-    lastNRs[curline] = NR;
+    lastNRs[curline] = '$awk_linenr';
     curline++
     if (curline >= maxlines) {
       curline = 0;
@@ -600,6 +1048,8 @@ function run_awk_script_logfiles {
       print "s:" x "," stats[x]
     }
 
+    '$group_print'
+
     for (i = 0; i < maxlines; i++) {
       ln = curline + i;
       if (ln >= maxlines) {
@@ -612,15 +1062,52 @@ function run_awk_script_logfiles {
 
       curNR = lastNRs[ln] + '$from_linenr_int' - 1;
 
+      '$captures_print'
       print "m:" curNR ":" lastlines[ln];
     }
   }
   '
 
-  "$awk_binary" -b "$awk_script" "$@"
-  if [[ "$?" != 0 ]]; then
-    return 1
+  if [[ "$multiline_continuation" == "" ]]; then
+    # The awk's own exit code is returned, so that check_query_pipeline can
+    # tell awk failures.
+    "$awk_binary" -b "$awk_script" "$@"
+    return $?
+  fi
+
+  # Join the continuation lines of the multi-line events with the first
+  # lines, and prefix every event with the number of its first line, like
+  # "12\036<first line>\036<continuation line>". The continuation lines before
+  # the first event (which might happen at the very beginning of the logs)
+  # are dropped, since there's nothing to join them with.
+  awk_join_script='
+  ('$multiline_continuation') {
+    if (eventNR) {
+      event = event "\036" $0;
+    }
+    next;
+  }
+  {
+    if (eventNR) {
+      print eventNR "\036" event;
+    }
+    event = $0;
+    eventNR = NR;
+  }
+  END {
+    if (eventNR) {
+      print eventNR "\036" event;
+    }
+  }
+  '
+
+  "$awk_binary" -b "$awk_join_script" "$@" | "$awk_binary" -b "$awk_script" -
+  codes=(${PIPESTATUS[@]})
+  if [[ "${codes[0]}" != 0 ]]; then
+    return ${codes[0]}
   fi
+
+  return ${codes[1]}
 }
 
 function run_awk_script_journalctl {
@@ -629,6 +1116,35 @@ function run_awk_script_journalctl {
     awk_pattern_check="!($user_pattern) {numFilteredOut++; next}"
   fi
 
+  awk_sample_check=''
+  if [[ "$sample_rate" -gt 1 ]]; then
+    awk_sample_check="NR % $sample_rate != 0 {next}"
+  fi
+
+  awk_stats_key="$(awk_stats_key_code)"
+
+  awk_aggregate_only_skip=''
+  if [[ "$aggregate_only" != "" ]]; then
+    awk_aggregate_only_skip='next;'
+  fi
+
+  captures_store=''
+  captures_print=''
+  if [[ "$captures_code" != "" ]]; then
+    captures_store="nlcaps = \"\"
+    $captures_code
+    caps[curline] = nlcaps;"
+    captures_print="if (caps[i] != \"\") { print \"mc:\" caps[i]; }"
+  fi
+
+  group_store=''
+  group_print=''
+  if [[ "$group_code" != "" ]]; then
+    group_store="$group_code
+    if (nlgrp != \"\") { groups[nlgrp]++; }"
+    group_print='for (g in groups) { print "g:" groups[g] ":" g; }'
+  fi
+
   awk_skip_n_latest_check=''
   if [[ "$timestamp_until_precise" != "" && "$skip_n_latest" != "" ]]; then
     awk_skip_n_latest_check='
@@ -770,12 +1286,18 @@ function run_awk_script_journalctl {
     }
   }
 
+  '$awk_sample_check'
   '$awk_pattern_check'
   '$awk_skip_n_latest_check'
   {
-    stats['"$awktime_minute_key"']++;
+    '$awk_stats_key'
+    stats[nlsk]++;
+    '$group_store'
+    '$awk_aggregate_only_skip'
 
     if (curline < maxlines) {
+      '$captures_store'
+      '$projection_code'
       lines[curline] = $0;
       curline++
     }
@@ -791,16 +1313,60 @@ function run_awk_script_journalctl {
       print "s:" x "," stats[x]
     }
 
+    '$group_print'
+
     for (i = curline-1; i >= 0; i--) {
+      '$captures_print'
       print "m:0:" lines[i];
     }
   }
   '
 
   "$awk_binary" "$awk_script" "$@"
-  if [[ "$?" != 0 ]]; then
-    return 1
+  return $?
+}
+
+# Checks the exit codes of the query pipeline, where the last command is the
+# awk script, and exits if anything has failed. If the awk script itself has
+# failed (e.g. with a runtime error on some weird line, or crashed), as
+# opposed to just getting to the end of the data, nerdlog is told about that
+# with the "awk_failed:<exit code>:<first line number>" line, so that the query
+# fails with the awk error instead of returning the truncated results; the
+# awk's own error message is already in stderr, and the first line number
+# (empty if the lines aren't numbered) lets nerdlog tell the approximate line
+# where awk has failed. The SIGPIPE exit code 141 of the commands feeding awk
+# is ignored if allow_sigpipe is 1.
+# Usage: check_query_pipeline <first line number> <allow_sigpipe> <exit codes...>
+function check_query_pipeline {
+  local first_linenr="$1"
+  local allow_sigpipe="$2"
+  shift 2
+
+  local codes=("$@")
+  local awk_status="${codes[${#codes[@]}-1]}"
+
+  for status in "${codes[@]}"; do
+    if [[ $status -eq 152 || $status -eq 137 ]]; then
+      # Killed due to the resource limits (SIGXCPU or SIGKILL), let nerdlog
+      # know about that.
+      exit $status
+    fi
+  done
+
+  # If awk has failed, the commands feeding it are likely to get SIGPIPE, so
+  # awk is checked first.
+  if [[ $awk_status -ne 0 ]]; then
+    echo "awk_failed:$awk_status:$first_linenr" 1>&2
+    exit 1
   fi
+
+  for status in "${codes[@]}"; do
+    if [[ $status -eq 141 && "$allow_sigpipe" == 1 ]]; then
+      continue
+    elif [[ $status -ne 0 ]]; then
+      exit 1
+    fi
+  done
 }
 
 user_pattern=$1
@@ -808,6 +1374,11 @@ user_pattern=$1
 if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
   echo "p:stage:$STAGE_QUERYING:querying logs:Note that journalctl can be SLOW. Consider using log files." 1>&2
 
+  # There are no files to pin, so the logs are read as usual.
+  if [[ "$pin_last" != "" ]]; then
+    echo "warn_pin_unsupported" 1>&2
+  fi
+
   # For both $from and $to, convert the format
   # "2006-01-02-15:04" -> "2006-01-02 15:04:00"
   journalctl_from=""
@@ -835,6 +1406,10 @@ if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
   # accumulating $max_num_lines.
   cmd="$journalctl_binary $JOURNALCTL_FORMAT_FLAG --quiet --reverse"
 
+  if [[ -n "$tail_lines" ]]; then
+    cmd="$cmd --lines $tail_lines"
+  fi
+
   if [[ -n "$journalctl_from" ]]; then
     cmd="$cmd --since \"$journalctl_from\""
   fi
@@ -856,17 +1431,19 @@ if [[ "$logfile_last" == "${SPECIAL_FILENAME_JOURNALCTL}" ]]; then
     stop_after_max_num_lines="$stop_after_max_num_lines"   \
     timestamp_until_precise="$timestamp_until_precise"   \
     skip_n_latest="$skip_n_latest"   \
+    captures_code="$captures_code"   \
+    projection_code="$projection_code"   \
+    group_code="$group_code"   \
+    sample_rate="$sample_rate"   \
+    stats_bucket_minutes="$stats_bucket_minutes"   \
+    aggregate_only="$aggregate_only"   \
     run_awk_script_journalctl -
 
-  codes=(${PIPESTATUS[@]})
-  for status in "${codes[@]}"; do
-    # The exit code 141 means SIGPIPE + 128, which is what journalctl returns
-    # if awk didn't consume the whole output, which is totally normal when
-    # we're querying the next page and exiting after getting enough lines.
-    if [[ $status -ne 0 && $status -ne 141 ]]; then
-      exit 1
-    fi
-  done
+  # The exit code 141 means SIGPIPE + 128, which is what journalctl returns
+  # if awk didn't consume the whole output, which is totally normal when
+  # we're querying the next page and exiting after getting enough lines. The
+  # journalctl lines aren't numbered.
+  check_query_pipeline "" 1 "${PIPESTATUS[@]}"
 
   echo "p:stage:$STAGE_DONE:done" 1>&2
 
@@ -889,6 +1466,41 @@ get_file_size() {
   esac
 }
 
+# A portable function to get file inode number.
+# Usage: get_file_inode /path/to/file
+get_file_inode() {
+  case $os_kind in
+    linux)
+      stat -c %i "$1"
+      ;;
+    macos|bsd)
+      stat -f %i "$1"
+      ;;
+    *)
+      echo "error:internal error: invalid os_kind '$os_kind'" 1>&2
+      return 1
+  esac
+}
+
+# Checks whether the logfile was rotated since its inode and size were
+# recorded before the scan, and if so, lets nerdlog know that the results
+# might be incomplete. The file having grown is just a normal append; but if
+# the inode is different (or the file is gone), it was replaced by a new file,
+# and if it got smaller, it was truncated (like with logrotate's copytruncate).
+# Usage: check_logfile_rotated /path/to/file <inode> <size>
+function check_logfile_rotated {
+  local cur_inode cur_size
+  cur_inode="$(get_file_inode "$1" 2>/dev/null)"
+  cur_size="$(get_file_size "$1" 2>/dev/null)"
+
+  if [[ "$cur_inode" == "$2" && "$cur_size" != "" ]] && (( cur_size >= $3 )); then
+    return 0
+  fi
+
+  echo "debug:logfile $1 was rotated during the query: inode $2 -> ${cur_inode:-none}, size $3 -> ${cur_size:-none}" 1>&2
+  echo "warn_logfile_rotated:$1" 1>&2
+}
+
 # A portable function to get file modification time.
 # Usage: get_file_modtime /path/to/file
 get_file_modtime() {
@@ -907,10 +1519,106 @@ get_file_modtime() {
   esac
 }
 
+# A portable function to get file modification time as a unix timestamp.
+# Usage: get_file_modtime_unix /path/to/file
+get_file_modtime_unix() {
+  case $os_kind in
+    linux)
+      stat -c %Y "$1"
+      ;;
+    macos|bsd)
+      stat -f %m "$1"
+      ;;
+    *)
+      echo "error:internal error: invalid os_kind '$os_kind'" 1>&2
+      return 1
+  esac
+}
+
+# Converts the time in the --from / --to format "2006-01-02-15:04" (in the
+# local timezone) to a unix timestamp.
+# Usage: query_time_to_unix 2006-01-02-15:04
+query_time_to_unix() {
+  "$awk_binary" -v t="$1" 'BEGIN { gsub(/[-:]/, " ", t); ts = mktime(t " 00"); if (ts < 0) { exit 1 } print ts }'
+}
+
+# How much earlier than the --from the prev logfile must have been last
+# modified for us to skip it. Normally the log lines can't be newer than the
+# file modification time, so it could be zero, but we want to be conservative:
+# this margin covers DST transitions, and loggers which don't flush
+# immediately.
+PREV_LOGFILE_SKIP_MARGIN_SECONDS=3600
+
+# If the prev logfile was last modified before the --from (minus the margin),
+# it can't contain any lines in the requested range, so we pretend it's empty
+# and don't read (and more importantly, index) it at all. The latest logfile
+# is never skipped: it's the one being written to.
+#
+# If the existing index was built with the actual prev logfile, we keep using
+# it though, since it's valid anyway and it's cheaper than rebuilding it.
+if [[ "$from" != "" && "$logfile_prev" != "/tmp/nerdlog-empty-file" ]]; then
+  index_has_prev=0
+  if [[ "$refresh_index" != "1" ]] && [ -s "$indexfile" ]; then
+    index_prevlog_modtime="$("$awk_binary" -F"\t" '$1 == "prevlog_modtime" { print $2; exit }' $indexfile)"
+    if [[ "$index_prevlog_modtime" == "$(get_file_modtime $logfile_prev)" ]]; then
+      index_has_prev=1
+    fi
+  fi
+
+  if [[ "$index_has_prev" == 0 ]]; then
+    from_unix="$(query_time_to_unix "$from")"
+    logfile_prev_modtime_unix="$(get_file_modtime_unix $logfile_prev)"
+    if [[ "$from_unix" != "" && "$logfile_prev_modtime_unix" != "" ]] &&
+      (( logfile_prev_modtime_unix < from_unix - PREV_LOGFILE_SKIP_MARGIN_SECONDS )); then
+      echo "debug:prev logfile $logfile_prev was last modified before the from ${from}, skipping it" 1>&2
+      use_dummy_prev_logfile || exit 1
+    fi
+  fi
+fi
+
 logfile_prev_size=$(get_file_size $logfile_prev) || exit 1
 logfile_last_size=$(get_file_size $logfile_last) || exit 1
 total_size=$((logfile_prev_size+logfile_last_size)) || exit 1
 
+# Remember the inodes, to detect the rotation during the query; see
+# check_logfile_rotated.
+logfile_prev_inode=$(get_file_inode $logfile_prev) || exit 1
+logfile_last_inode=$(get_file_inode $logfile_last) || exit 1
+
+# If the latest logfile is pinned (see --pin-last), it's only read up to the
+# pinned size, as if nothing was appended to it since then. The prev logfile
+# doesn't need pinning: it only changes when the logs are rotated, and then
+# the latest one gets a new inode too.
+pin_last_size=''
+if [[ "$pin_last" == "-" ]]; then
+  pin_last_size=$logfile_last_size
+  echo "pin_last:$logfile_last_inode:$logfile_last_size" 1>&2
+elif [[ "$pin_last" != "" ]]; then
+  pinned_inode="${pin_last%%:*}"
+  pinned_size="${pin_last#*:}"
+  if [[ "$pinned_inode" == "$logfile_last_inode" ]] && (( logfile_last_size >= pinned_size )); then
+    echo "debug:logfile $logfile_last is pinned at $pinned_size bytes (actual size $logfile_last_size)" 1>&2
+    pin_last_size=$pinned_size
+    logfile_last_size=$pinned_size
+    total_size=$((logfile_prev_size+logfile_last_size))
+  else
+    echo "debug:logfile $logfile_last was rotated since it was pinned: inode $pinned_inode -> $logfile_last_inode, size $pinned_size -> $logfile_last_size" 1>&2
+    echo "warn_pin_lost:$logfile_last" 1>&2
+  fi
+fi
+
+# Prints the command which reads the latest logfile through the given filter
+# command, like "tail -c +100" or "cat"; if the logfile is pinned, the bytes
+# beyond the pinned size are cut off before the filter.
+# Usage: logfile_last_cmd <filter command>
+function logfile_last_cmd {
+  if [[ "$pin_last_size" != "" ]]; then
+    echo "head -c $pin_last_size $logfile_last | $1"
+  else
+    echo "$1 $logfile_last"
+  fi
+}
+
 if [[ "$refresh_index" == "1" ]]; then
   rm -f $indexfile || exit 1
 fi
@@ -971,12 +1679,14 @@ function refresh_index { # {{{
   # bunch of other time-filtering logic here. Although it's cool since it
   # includes the year, microseconds, and timezone.
   awk_functions='
+# The same logic as InferYear in Go: the year is chosen so that the log month
+# is at most one month ahead of the current one.
 function inferYear(logMonth, curYear, curMonth) {
   delta = logMonth - curMonth
 
   if (delta <= -11)       # log month is Jan, current is Dec -> next year
     return curYear + 1
-  else if (delta >= 8)    # log month is Sep-Dec, current is Jan -> previous year
+  else if (delta >= 2)    # log month is 2+ months ahead -> previous year
     return curYear - 1
   else
     return curYear
@@ -1024,6 +1734,13 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   curHHMM = '"$awktime_hhmm"';
 }'
 
+  # The continuation lines of the multi-line events don't have timestamps, so
+  # they should never make it to the index.
+  if [[ "$multiline_continuation" != "" ]]; then
+    script1="$script1
+  ($multiline_continuation) { next }"
+  fi
+
   if [ -s $indexfile ]
   then
     echo "p:stage:$STAGE_INDEX_APPEND:indexing up" 1>&2
@@ -1042,7 +1759,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   ( lastHHMM != curHHMM ) {
     '"$scriptSetCurTimestr"';
     printIndexLine("'$indexfile'", curTimestr, NR+'$(( last_linenr-1 ))', bytenr_cur+'$(( last_bytenr-1 ))');
-    printPercentage(bytenr_cur, '$size_to_index');
+    printBytesProgress(bytenr_cur, '$size_to_index');
     '"$scriptSetLastTimestrEtc"'
   }
   ' -
@@ -1061,7 +1778,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   ( lastHHMM != curHHMM ) {
     '"$scriptSetCurTimestr"';
     printIndexLine("'$indexfile'", curTimestr, NR, bytenr_cur);
-    printPercentage(bytenr_cur, '$total_size');
+    printBytesProgress(bytenr_cur, '$total_size');
     '"$scriptSetLastTimestrEtc"'
   }
   END { print "prevlog_lines\t" NR >> "'$indexfile'" }
@@ -1087,7 +1804,7 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
     '"$scriptSetCurTimestr"';
     bytenr = bytenr_cur+'$prevlog_bytes';
     printIndexLine("'$indexfile'", curTimestr, NR+'$(get_prevlog_lines_from_index)', bytenr);
-    printPercentage(bytenr, '$total_size');
+    printBytesProgress(bytenr, '$total_size');
     '"$scriptSetLastTimestrEtc"'
   }
   ' $logfile_last
@@ -1243,7 +1960,7 @@ if [[ "$from" != "" || "$to" != "" ]]; then
     fi
 
   fi
-else
+elif [[ "$tail_lines" == "" ]]; then
   if ! [ -s $indexfile ]; then
     echo "debug:neither --from or --to are given, but index doesn't exist at all, gonna rebuild" 1>&2
     refresh_index || exit 1
@@ -1257,7 +1974,12 @@ fi
 
 echo "p:stage:$STAGE_QUERYING:querying logs" 1>&2
 
-prevlog_lines=$(get_prevlog_lines_from_index)
+# When tailing, there's no index, since only the latest log file is read, and
+# the lines are numbered from the first one we get.
+prevlog_lines=0
+if [[ "$tail_lines" == "" ]]; then
+  prevlog_lines=$(get_prevlog_lines_from_index)
+fi
 prevlog_bytes=$(get_prevlog_bytenr)
 
 from_linenr_int=$from_linenr
@@ -1265,13 +1987,24 @@ if [[ "$from_linenr" == "" ]]; then
   from_linenr_int=1
 fi
 
+# The awk expression of the current line number; with the multi-line events,
+# it's the number of the first line of the event.
+awk_linenr='NR'
+if [[ "$multiline_continuation" != "" ]]; then
+  awk_linenr='linenr'
+fi
+
 lines_until_check=''
 if [[ "$lines_until" != "" ]]; then
-  lines_until_check="if (NR >= $((lines_until-from_linenr_int+1))) { next; }"
+  lines_until_check="if ($awk_linenr >= $((lines_until-from_linenr_int+1))) { next; }"
 fi
 
 num_bytes_to_scan=0
-if [[ "$from_bytenr" == "" && "$to_bytenr" == "" ]]; then
+if [[ "$tail_lines" != "" ]]; then
+  # We don't know how many bytes the last N lines take, but surely not more
+  # than the whole latest log file.
+  num_bytes_to_scan=$logfile_last_size
+elif [[ "$from_bytenr" == "" && "$to_bytenr" == "" ]]; then
   # Getting _all_ available logs
   num_bytes_to_scan=$total_size
 elif [[ "$from_bytenr" != "" && "$to_bytenr" == "" ]]; then
@@ -1311,17 +2044,20 @@ fi
 
 # Generate commands to get all the logs as per requested timerange.
 declare -a cmds
-if [[ "$from_bytenr" != "" && $(( from_bytenr > prevlog_bytes )) == 1 ]]; then
+if [[ "$tail_lines" != "" ]]; then
+  echo "debug:Getting the last $tail_lines lines of latest $logfile_last" 1>&2
+  cmds+=("$(logfile_last_cmd "tail -n $tail_lines")")
+elif [[ "$from_bytenr" != "" && $(( from_bytenr > prevlog_bytes )) == 1 ]]; then
   # Only $logfile_last is used.
   from_bytenr=$(( from_bytenr - prevlog_bytes ))
   if [[ "$to_bytenr" != "" ]]; then
     to_bytenr=$(( to_bytenr - prevlog_bytes ))
     echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the latest $logfile_last" 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_last | head -c $((to_bytenr - from_bytenr))")
+    cmds+=("$(logfile_last_cmd "tail -c +$from_bytenr") | head -c $((to_bytenr - from_bytenr))")
   else
     # Most common case
     echo "debug:Getting logs from offset $from_bytenr until the end of latest $logfile_last." 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_last")
+    cmds+=("$(logfile_last_cmd "tail -c +$from_bytenr")")
   fi
 elif [[ "$to_bytenr" != "" && $(( to_bytenr <= prevlog_bytes )) == 1 ]]; then
   # Only $logfile_prev is used.
@@ -1344,10 +2080,10 @@ else
 
   if [[ "$to_bytenr" != "" ]]; then
     info="$info to offset $(( to_bytenr - prevlog_bytes - 1 )) in latest $logfile_last"
-    cmds+=("head -c $(( to_bytenr - prevlog_bytes - 1 )) $logfile_last")
+    cmds+=("$(logfile_last_cmd "head -c $(( to_bytenr - prevlog_bytes - 1 ))")")
   else
     info="$info until the end of latest $logfile_last"
-    cmds+=("cat $logfile_last")
+    cmds+=("$(logfile_last_cmd cat)")
   fi
 
   echo "debug:$info" 1>&2
@@ -1366,13 +2102,19 @@ eval $cmds_concatenated | \
   lines_until_check="$lines_until_check"                \
   prevlog_lines="$prevlog_lines"                        \
   from_linenr_int="$from_linenr_int"                    \
+  captures_code="$captures_code"                        \
+  projection_code="$projection_code"                    \
+  group_code="$group_code"                              \
+  sample_rate="$sample_rate"                            \
+  stats_bucket_minutes="$stats_bucket_minutes"          \
+  aggregate_only="$aggregate_only"                      \
   run_awk_script_logfiles -
 
-codes=(${PIPESTATUS[@]})
-for status in "${codes[@]}"; do
-  if [[ $status -ne 0 ]]; then
-    exit 1
-  fi
-done
+check_query_pipeline "$from_linenr_int" 0 "${PIPESTATUS[@]}"
+
+check_logfile_rotated $logfile_last "$logfile_last_inode" "$logfile_last_size"
+if [[ "$tail_lines" == "" && "$logfile_prev" != "/tmp/nerdlog-empty-file" ]]; then
+  check_logfile_rotated $logfile_prev "$logfile_prev_inode" "$logfile_prev_size"
+fi
 
 echo "p:stage:$STAGE_DONE:done" 1>&2
@@ -30,6 +30,11 @@ type AgentTestCaseYaml struct {
 	Descr    string                     `yaml:"descr"`
 	Logfiles testutils.TestCaseLogfiles `yaml:"logfiles"`
 
+	// LogfilePrevModTime, if not empty, overrides the modification time of the
+	// prev logfile (by default, it's the time of its last log line, but the
+	// year is the current one). Format: "2006-01-02 15:04:05", in UTC.
+	LogfilePrevModTime string `yaml:"logfile_prev_modtime"`
+
 	// CurYear and CurMonth specify today's date. If not specified, 1970-01 will
 	// be used. This matters for inferring the log's year (because traditional
 	// syslog timestamp format doesn't include year).
@@ -108,6 +113,17 @@ func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot,
 		return errors.Annotatef(err, "provisioning logfiles")
 	}
 
+	if tc.LogfilePrevModTime != "" {
+		modTime, err := time.ParseInLocation("2006-01-02 15:04:05", tc.LogfilePrevModTime, time.UTC)
+		if err != nil {
+			return errors.Annotatef(err, "parsing logfile_prev_modtime")
+		}
+
+		if err := os.Chtimes(provisioned.LogfilePrev, modTime, modTime); err != nil {
+			return errors.Annotatef(err, "setting mod time of %s", provisioned.LogfilePrev)
+		}
+	}
+
 	indexFname := filepath.Join(testOutputDir, "nerdlog_agent_index")
 
 	os.Remove(indexFname)
@@ -148,6 +164,11 @@ func runAgentTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, repoRoot,
 		return nil
 	}
 
+	// Same if the index wasn't even built, like with --tail-lines.
+	if _, err := os.Stat(indexFname); os.IsNotExist(err) {
+		return nil
+	}
+
 	// For log files tests, we rerun the test multiple times after removing some
 	// latest lines from the index, expecting it to index up and to produce the same
 	// result.
@@ -342,11 +363,14 @@ func runNerdlogAgent(
 //	exit_code:0
 //
 // And returns the same string, but all the lines starting from "s:" being sorted
-// lexicographically. This is just for better testability.
+// lexicographically. The same is done for the group lines starting from "g:",
+// which are printed in random order as well. This is just for better
+// testability.
 func sortStatBucketLines(nerdlogStdout []byte) []byte {
 	scanner := bufio.NewScanner(bytes.NewReader(nerdlogStdout))
 	var out bytes.Buffer
 	var statLines []string
+	var statPrefix string
 
 	flushStatLines := func() {
 		if len(statLines) > 0 {
@@ -361,7 +385,11 @@ func sortStatBucketLines(nerdlogStdout []byte) []byte {
 
 	for scanner.Scan() {
 		line := scanner.Text()
-		if len(line) > 2 && line[:2] == "s:" {
+		if len(line) > 2 && (line[:2] == "s:" || line[:2] == "g:") {
+			if line[:2] != statPrefix {
+				flushStatLines()
+				statPrefix = line[:2]
+			}
 			statLines = append(statLines, line)
 		} else {
 			flushStatLines()
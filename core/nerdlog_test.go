@@ -0,0 +1,1977 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeShellTransport implements ShellTransport, and on connection it returns
+// a fakeShellConn which pretends to be a shell running nerdlog_agent.sh.
+type fakeShellTransport struct {
+	logs *fakeLogs
+
+	// logsByFile, if not nil, is used instead of logs: the logs are picked by
+	// the --logfile-last arg of the agent command.
+	logsByFile map[string]*fakeLogs
+
+	// agentCmds, if not nil, receives all the agent invocations.
+	agentCmds *fakeLogs
+
+	// progress, if true, makes the fake agent print the progress markers to
+	// stderr while printing the logs, like the real agent does.
+	progress bool
+
+	// queryStderr contains the extra lines which the fake agent prints to
+	// stderr during every query, like warnings.
+	queryStderr []string
+
+	// hostVersion is what the fake host reports as "uname -srm".
+	hostVersion string
+
+	// queryKilledBy, if not empty, makes every query fail as if the agent was
+	// killed with this signal, e.g. "XCPU".
+	queryKilledBy string
+
+	// localizedLogs, if not nil, is what the fake host outputs instead of the
+	// logs unless the session has LC_ALL=C, like a host with non-C locale.
+	localizedLogs *fakeLogs
+
+	// projectedLogs, if not nil, is what the fake agent outputs instead of the
+	// logs when the query has the --projection-code.
+	projectedLogs *fakeLogs
+
+	// verifyStatus is what the fake agent reports for the log file on the
+	// verify command; if empty, the file is readable.
+	verifyStatus LStreamVerifyStatus
+
+	// adHocOutputs contains the outputs of the ad hoc commands by the command;
+	// the commands which are not there fail with the exit code 127. The output
+	// is printed as is, not limited in size.
+	adHocOutputs map[string]string
+
+	// queryGate, if not nil, makes every query wait until it can receive from
+	// the channel before printing the results, like a slow host.
+	queryGate <-chan struct{}
+
+	// applyQueryArgs, if true, makes the fake agent only return the logs since
+	// the --from, and at most --max-num-lines latest of them, like the real
+	// agent does; the stats still cover all the logs since the --from.
+	applyQueryArgs bool
+
+	// queryFails, if not nil, is called on every query, and if it returns
+	// true, the fake agent fails with a non-zero exit code.
+	queryFails func() bool
+
+	// queryAWKFailsAt, if more than 0, makes the fake agent's awk fail on
+	// this line of the logs (counting from 1) with a runtime error, after
+	// printing the previous lines.
+	queryAWKFailsAt int
+
+	// queryGroups, if not nil, is what the fake agent prints as the group
+	// counts when the query has the --group-code.
+	queryGroups map[string]int
+
+	// busybox, if true, makes the fake host report itself as busybox-based.
+	busybox bool
+
+	// awkDialect, if not empty, is reported by the fake agent as the awk
+	// dialect of the host.
+	awkDialect AWKDialect
+
+	// markerCmds, if not nil, receives all the commands printing the
+	// "command_done:" markers.
+	markerCmds *fakeLogs
+}
+
+func (t *fakeShellTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	conn := newFakeShellConn(t.logs)
+	conn.logsByFile = t.logsByFile
+	conn.agentCmds = t.agentCmds
+	conn.progress = t.progress
+	conn.queryStderr = t.queryStderr
+	conn.hostVersion = t.hostVersion
+	conn.queryKilledBy = t.queryKilledBy
+	conn.localizedLogs = t.localizedLogs
+	conn.projectedLogs = t.projectedLogs
+	conn.verifyStatus = t.verifyStatus
+	conn.adHocOutputs = t.adHocOutputs
+	conn.queryGate = t.queryGate
+	conn.applyQueryArgs = t.applyQueryArgs
+	conn.queryFails = t.queryFails
+	conn.queryAWKFailsAt = t.queryAWKFailsAt
+	conn.queryGroups = t.queryGroups
+	conn.busybox = t.busybox
+	conn.awkDialect = t.awkDialect
+	conn.markerCmds = t.markerCmds
+
+	resCh <- ShellConnUpdate{
+		Result: &ShellConnResult{
+			Conn: conn,
+		},
+	}
+}
+
+// fakeUnreachableTransport is like a host which is down: every connection
+// attempt hangs until it's cancelled, unless the reachableCh is closed, in
+// which case it connects like the fakeShellTransport.
+type fakeUnreachableTransport struct {
+	fakeShellTransport
+
+	// reachableCh, if not nil, is closed once the host becomes reachable.
+	reachableCh chan struct{}
+}
+
+func (t *fakeUnreachableTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		select {
+		case <-t.reachableCh:
+			t.fakeShellTransport.Connect(ctx, resCh)
+
+		case <-ctx.Done():
+			resCh <- ShellConnUpdate{
+				Result: &ShellConnResult{
+					Err: errors.Annotatef(ctx.Err(), "connecting"),
+				},
+			}
+		}
+	}()
+}
+
+// fakeLogs contains the log lines returned by the fakeShellConn; more lines
+// can be added concurrently.
+type fakeLogs struct {
+	mtx   sync.Mutex
+	lines []string
+}
+
+func (l *fakeLogs) add(lines ...string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.lines = append(l.lines, lines...)
+}
+
+func (l *fakeLogs) get() []string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return append([]string(nil), l.lines...)
+}
+
+// fakeShellConn reads the commands written by the LStreamClient to stdin, and
+// responds to them the same way as the shell running nerdlog_agent.sh would
+// (but ignoring all the query args, and just returning all the logs).
+type fakeShellConn struct {
+	logs        *fakeLogs
+	logsByFile  map[string]*fakeLogs
+	agentCmds   *fakeLogs
+	progress    bool
+	queryStderr []string
+	hostVersion string
+
+	queryKilledBy string
+
+	localizedLogs *fakeLogs
+	lcAll         string
+
+	projectedLogs *fakeLogs
+
+	verifyStatus LStreamVerifyStatus
+
+	adHocOutputs map[string]string
+	adHocCmd     string
+
+	queryGate <-chan struct{}
+
+	applyQueryArgs  bool
+	queryFails      func() bool
+	queryAWKFailsAt int
+	queryGroups     map[string]int
+
+	busybox    bool
+	awkDialect AWKDialect
+	markerCmds *fakeLogs
+
+	// closedCh is closed by Close, so that a query waiting for the queryGate
+	// doesn't hang forever.
+	closedCh  chan struct{}
+	closeOnce sync.Once
+
+	stdinR  *io.PipeReader
+	stdinW  *io.PipeWriter
+	stdoutR *io.PipeReader
+	stdoutW *io.PipeWriter
+	stderrR *io.PipeReader
+	stderrW *io.PipeWriter
+}
+
+func newFakeShellConn(logs *fakeLogs) *fakeShellConn {
+	c := &fakeShellConn{logs: logs, closedCh: make(chan struct{})}
+
+	c.stdinR, c.stdinW = io.Pipe()
+	c.stdoutR, c.stdoutW = io.Pipe()
+	c.stderrR, c.stderrW = io.Pipe()
+
+	go c.run()
+
+	return c
+}
+
+// getLogs returns the logs for the given agent command line.
+func (c *fakeShellConn) getLogs(cmdLine string) []string {
+	if c.localizedLogs != nil && c.lcAll != "C" {
+		return c.localizedLogs.get()
+	}
+
+	if c.projectedLogs != nil && strings.Contains(cmdLine, " --projection-code ") {
+		return c.projectedLogs.get()
+	}
+
+	if c.logsByFile == nil {
+		return c.logs.get()
+	}
+
+	fields := strings.Fields(cmdLine)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "--logfile-last" {
+			if logs, ok := c.logsByFile[strings.Trim(fields[i+1], "'")]; ok {
+				return logs.get()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *fakeShellConn) Stdin() io.Writer  { return c.stdinW }
+func (c *fakeShellConn) Stdout() io.Reader { return c.stdoutR }
+func (c *fakeShellConn) Stderr() io.Reader { return c.stderrR }
+
+func (c *fakeShellConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closedCh)
+	})
+	c.stdinW.Close()
+}
+
+func (c *fakeShellConn) run() {
+	defer c.stdoutW.Close()
+	defer c.stderrW.Close()
+
+	stdout := func(format string, a ...interface{}) {
+		fmt.Fprintf(c.stdoutW, format+"\n", a...)
+	}
+
+	stderr := func(format string, a ...interface{}) {
+		fmt.Fprintf(c.stderrW, format+"\n", a...)
+	}
+
+	logstreamInfo := func(cmdLine string) {
+		stdout("host_timezone:UTC")
+		if c.awkDialect != "" {
+			stdout("awk_dialect:%s", c.awkDialect)
+		}
+		for _, l := range c.getLogs(cmdLine) {
+			stdout("example_log_line:%s", l)
+		}
+	}
+
+	inHeredoc := false
+
+	// Read stdin in a separate goroutine, with a large buffer: the
+	// LStreamClient writes commands and reads their output in the same
+	// goroutine, so with the unbuffered pipes, printing a lot of output while
+	// the client is still writing the command would deadlock (unlike with the
+	// real shell, which has the OS pipe buffers).
+	linesCh := make(chan string, 1024)
+	go func() {
+		defer close(linesCh)
+
+		scanner := bufio.NewScanner(c.stdinR)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			linesCh <- scanner.Text()
+		}
+	}()
+
+	// pendingLines are handled before reading the next line from stdin; see
+	// splitFakeSourceRuns.
+	var pendingLines []string
+
+	for {
+		var line string
+		if len(pendingLines) > 0 {
+			line, pendingLines = pendingLines[0], pendingLines[1:]
+		} else {
+			var ok bool
+			if line, ok = <-linesCh; !ok {
+				break
+			}
+		}
+
+		switch {
+		case inHeredoc:
+			// Uploading of the agent script.
+			inHeredoc = line != "EOF"
+
+		case strings.Contains(line, "<<- 'EOF'"):
+			inHeredoc = true
+
+		case strings.HasPrefix(line, "export LC_ALL="):
+			c.lcAll = strings.TrimPrefix(line, "export LC_ALL=")
+
+		case line == "echo reset_output":
+			stdout("reset_output")
+
+		case line == "echo reset_output 1>&2":
+			fmt.Fprintf(c.stderrW, "reset_output\n")
+
+		case line == "echo exit_code:$?":
+			stdout("exit_code:0")
+
+		case line == "  echo 'bootstrap ok'":
+			stdout("bootstrap ok")
+
+		case strings.HasSuffix(line, "&& echo 'wire_compression_ok'"):
+			stdout("wire_compression_ok")
+
+		case line == busyboxProbeCmd:
+			if c.busybox {
+				stdout("%s", busyboxMarker)
+			}
+
+		case line == `  echo "host_version:$(uname -srm)"`:
+			stdout("host_version:%s", c.hostVersion)
+
+		case strings.HasPrefix(line, `if [ "$(uname -srm)" = `):
+			// Cached capabilities check: skip the probes if the version matches.
+			cachedVersion := strings.TrimPrefix(line, `if [ "$(uname -srm)" = `)
+			cachedVersion = cachedVersion[:strings.Index(cachedVersion, " ];")]
+			if strings.Trim(cachedVersion, "'") == c.hostVersion {
+				stdout("capabilities_cached")
+			} else {
+				c.recordAgentCmd(line)
+				logstreamInfo(line)
+			}
+
+		case strings.Contains(line, " logstream_info ") && c.recordAgentCmd(line):
+			logstreamInfo(line)
+
+		case strings.Contains(line, " verify ") && c.recordAgentCmd(line):
+			status := c.verifyStatus
+			if status == "" {
+				status = LStreamVerifyReadable
+			}
+
+			stdout("verify:%s:/var/log/syslog", status)
+			stdout("verify:readable:/var/log/syslog.1")
+
+			// Printed by the agent's trap.
+			stdout("exit_code:0")
+
+		case strings.HasPrefix(line, "nlcmd="):
+			cmd := strings.TrimPrefix(line, "nlcmd=")
+			if strings.HasPrefix(cmd, "'") {
+				cmd = strings.Replace(cmd[1:len(cmd)-1], `'"'"'`, "'", -1)
+			}
+			c.adHocCmd = cmd
+
+		case strings.Contains(line, adHocOutPrefix):
+			output, ok := c.adHocOutputs[c.adHocCmd]
+			if !ok {
+				stdout("%ssh: 1: %s: not found", adHocOutPrefix, c.adHocCmd)
+				stdout("%s127", adHocExitCodePrefix)
+				continue
+			}
+
+			for _, l := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+				stdout("%s%s", adHocOutPrefix, l)
+			}
+			stdout("%s0", adHocExitCodePrefix)
+
+		case strings.Contains(line, " query ") && strings.Contains(line, logSourceMarkerPrefix) &&
+			c.recordAgentCmd(line):
+			pendingLines = append(splitFakeSourceRuns(line), pendingLines...)
+
+		case strings.HasPrefix(line, "echo '"+logSourceMarkerPrefix):
+			stdout("%s", strings.Trim(strings.TrimPrefix(line, "echo "), "'"))
+
+		case strings.Contains(line, " query ") && c.queryKilledBy != "" && c.recordAgentCmd(line):
+			// The agent was killed, so its trap didn't print anything; but the
+			// ulimit subshell does.
+			stdout("logfile:/var/log/syslog:0")
+			if strings.Contains(line, "( ulimit ") {
+				stdout("exit_code:%d", 128+fakeSignalNumbers[c.queryKilledBy])
+			}
+
+		case strings.Contains(line, " query ") && c.recordAgentCmd(line):
+			if c.queryGate != nil {
+				select {
+				case <-c.queryGate:
+				case <-c.closedCh:
+				}
+			}
+
+			if c.queryFails != nil && c.queryFails() {
+				stderr("something went wrong")
+
+				// Printed by the agent's trap.
+				stdout("exit_code:1")
+				continue
+			}
+
+			lines := c.getLogs(line)
+			statsLines := lines
+			var lineNums []int
+			if c.applyQueryArgs {
+				statsLines, lines, lineNums = applyFakeQueryArgs(line, lines)
+			}
+
+			minuteStats := map[string]int{}
+			var minuteKeys []string
+			for _, l := range statsLines {
+				minuteKey := l[:len("Jan _2 15:04")]
+				if minuteStats[minuteKey] == 0 {
+					minuteKeys = append(minuteKeys, minuteKey)
+				}
+				minuteStats[minuteKey]++
+			}
+
+			if c.progress {
+				stderr("p:stage:1:querying logs")
+			}
+
+			// Pretend that every line is 100 bytes.
+			bytesTotal := len(lines) * 100
+
+			for _, l := range c.queryStderr {
+				stderr("%s", l)
+			}
+
+			stdout("logfile:/var/log/syslog:0")
+			for i, l := range lines {
+				if c.queryAWKFailsAt > 0 && i+1 == c.queryAWKFailsAt {
+					break
+				}
+
+				if c.progress {
+					stderr("p:p:%d", i*100/len(lines))
+					stderr("p:b:%d:%d", i*100, bytesTotal)
+				}
+
+				lineNum := i + 1
+				if lineNums != nil {
+					lineNum = lineNums[i]
+				}
+
+				stdout("m:%d:%s", lineNum, l)
+			}
+
+			if c.queryAWKFailsAt > 0 {
+				// The output stops abruptly, and the agent reports the failure;
+				// see check_query_pipeline.
+				stderr("gawk: cmd. line:12: (FILENAME=- FNR=%d) fatal: division by zero attempted", c.queryAWKFailsAt)
+				stderr("awk_failed:2:1")
+
+				// Printed by the agent's trap.
+				stdout("exit_code:1")
+				continue
+			}
+
+			for _, k := range minuteKeys {
+				stdout("s:%s,%d", k, minuteStats[k])
+			}
+
+			if strings.Contains(line, " --group-code ") {
+				for value, n := range c.queryGroups {
+					stdout("g:%d:%s", n, value)
+				}
+			}
+
+			// Printed by the agent's trap.
+			stdout("exit_code:0")
+
+		case strings.HasPrefix(line, "echo 'command_done:"),
+			strings.HasPrefix(line, `printf '%s\n' 'command_done:`):
+			if c.markerCmds != nil {
+				c.markerCmds.add(line)
+			}
+
+			msg := line[strings.Index(line, "'command_done:")+1:]
+			msg = msg[:strings.IndexRune(msg, '\'')]
+
+			if strings.HasSuffix(line, "1>&2") {
+				fmt.Fprintf(c.stderrW, "%s\n", msg)
+			} else {
+				stdout("%s", msg)
+			}
+		}
+	}
+}
+
+// fakeSourceMarkerRegexp matches the commands printing the log source markers;
+// see getSourcesQueryCmdParts.
+var fakeSourceMarkerRegexp = regexp.MustCompile(`echo '` + logSourceMarkerPrefix + `[0-9]+'`)
+
+// splitFakeSourceRuns splits the query command of the logstream with multiple
+// log sources, which is a single line, into the separate lines: the marker
+// command for every source, followed by the agent run for that source.
+func splitFakeSourceRuns(cmdLine string) []string {
+	var ret []string
+
+	locs := fakeSourceMarkerRegexp.FindAllStringIndex(cmdLine, -1)
+	for i, loc := range locs {
+		end := len(cmdLine)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+
+		ret = append(ret, cmdLine[loc[0]:loc[1]], cmdLine[loc[1]:end])
+	}
+
+	return ret
+}
+
+// applyFakeQueryArgs takes the agent query command line and the fake log
+// lines, and returns the lines since the --from (if any), and the latest
+// --max-num-lines of them before the --lines-until (if any), together with
+// their line numbers.
+func applyFakeQueryArgs(cmdLine string, lines []string) (sinceFrom, latest []string, latestNums []int) {
+	var from time.Time
+	maxNumLines := len(lines)
+	linesUntil := 0
+
+	fields := strings.Fields(cmdLine)
+	for i := 0; i < len(fields)-1; i++ {
+		v := strings.Trim(fields[i+1], "'")
+		switch fields[i] {
+		case "--from":
+			from, _ = time.Parse(queryLogsArgsTimeLayout, v)
+		case "--max-num-lines":
+			maxNumLines, _ = strconv.Atoi(v)
+		case "--lines-until":
+			linesUntil, _ = strconv.Atoi(v)
+		}
+	}
+
+	for i, l := range lines {
+		t, err := time.Parse(time.Stamp, l[:len(time.Stamp)])
+		if err != nil {
+			panic(err)
+		}
+
+		t = t.AddDate(from.Year(), 0, 0)
+		if !from.IsZero() && t.Before(from) {
+			continue
+		}
+
+		sinceFrom = append(sinceFrom, l)
+
+		if linesUntil == 0 || i+1 < linesUntil {
+			latest = append(latest, l)
+			latestNums = append(latestNums, i+1)
+		}
+	}
+
+	if len(latest) > maxNumLines {
+		latest = latest[len(latest)-maxNumLines:]
+		latestNums = latestNums[len(latestNums)-maxNumLines:]
+	}
+
+	return sinceFrom, latest, latestNums
+}
+
+// fakeSignalNumbers are the numbers of the signals which might be used as
+// fakeShellTransport.queryKilledBy.
+var fakeSignalNumbers = map[string]int{
+	"KILL": 9,
+	"XCPU": 24,
+}
+
+// recordAgentCmd adds the line to agentCmds, if needed, and returns true.
+func (c *fakeShellConn) recordAgentCmd(line string) bool {
+	if c.agentCmds != nil {
+		c.agentCmds.add(line)
+	}
+
+	return true
+}
+
+func fakeLogLine(t time.Time, msg string) string {
+	return fmt.Sprintf("%s myhost myapp[123]: %s", t.UTC().Format(time.Stamp), msg)
+}
+
+func newTestNerdlog(t *testing.T, logs *fakeLogs) *Nerdlog {
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs}
+		},
+		ClientID:       "test",
+		FollowInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestNerdlogQuery(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	n := newTestNerdlog(t, logs)
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From: now.Add(-time.Hour),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Both logstreams return the same two messages.
+	if !assert.Equal(t, 4, len(resp.Logs)) {
+		return
+	}
+	assert.Equal(t, 4, resp.NumMsgsTotal)
+
+	assert.Equal(t, "foo", resp.Logs[0].Msg)
+	assert.Equal(t, "fake-01", resp.Logs[0].Context["lstream"])
+	assert.Equal(t, "fake-02", resp.Logs[1].Context["lstream"])
+	assert.Equal(t, "bar", resp.Logs[3].Msg)
+	assert.True(t, resp.Logs[3].Time.Equal(now.Add(-time.Minute)))
+
+	fs := n.FleetStatus()
+	assert.Equal(t, 2, fs.NumLStreams)
+	assert.Equal(t, 2, fs.NumConnected)
+}
+
+func TestNerdlogFollow(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-2*time.Minute), "foo"))
+
+	n := newTestNerdlog(t, logs)
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var batches [][]string
+
+	err := n.Follow(ctx, QueryLogsParams{From: now.Add(-time.Hour)}, func(newLogs []LogMsg) {
+		var msgs []string
+		for _, msg := range newLogs {
+			msgs = append(msgs, fmt.Sprintf("%s:%s", msg.Context["lstream"], msg.Msg))
+		}
+		batches = append(batches, msgs)
+
+		if len(batches) == 1 {
+			logs.add(fakeLogLine(now.Add(-time.Minute), "bar"))
+		} else {
+			cancel()
+		}
+	})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+
+	assert.Equal(t, [][]string{
+		{"fake-01:foo", "fake-02:foo"},
+		{"fake-01:bar", "fake-02:bar"},
+	}, batches)
+}
+
+// connRecordingTransport is a fakeShellTransport which records all the
+// connections it has established.
+type connRecordingTransport struct {
+	fakeShellTransport
+
+	mtx   *sync.Mutex
+	conns *[]ShellConn
+}
+
+func (t *connRecordingTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	// The fake transport sends the result right away.
+	innerCh := make(chan ShellConnUpdate, 1)
+	t.fakeShellTransport.Connect(ctx, innerCh)
+	upd := <-innerCh
+
+	t.mtx.Lock()
+	*t.conns = append(*t.conns, upd.Result.Conn)
+	t.mtx.Unlock()
+
+	resCh <- upd
+}
+
+func TestNerdlogQueryFollowReuseConns(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-2*time.Minute), "foo"))
+
+	agentCmds := &fakeLogs{}
+
+	var mtx sync.Mutex
+	var conns []ShellConn
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &connRecordingTransport{
+				fakeShellTransport: fakeShellTransport{logs: logs, agentCmds: agentCmds},
+				mtx:                &mtx,
+				conns:              &conns,
+			}
+		},
+		ClientID:       "test",
+		FollowInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := QueryLogsParams{From: now.Add(-time.Hour)}
+
+	_, err = n.Query(ctx, query)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mtx.Lock()
+	connsAfterQuery := append([]ShellConn(nil), conns...)
+	mtx.Unlock()
+	assert.Equal(t, 2, len(connsAfterQuery))
+
+	// Switch to following, and then back to a range query: all of them run on
+	// the connections established for the first query.
+	followCtx, followCancel := context.WithCancel(ctx)
+	numPolls := 0
+	err = n.Follow(followCtx, query, func(newLogs []LogMsg) {
+		numPolls++
+		followCancel()
+	})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+	assert.Equal(t, 1, numPolls)
+
+	_, err = n.Query(ctx, query)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	mtx.Lock()
+	if assert.Equal(t, len(connsAfterQuery), len(conns)) {
+		for i := range conns {
+			assert.Same(t, connsAfterQuery[i], conns[i])
+		}
+	}
+	mtx.Unlock()
+
+	numQueries := 0
+	for _, cmd := range agentCmds.get() {
+		if strings.Contains(cmd, " query ") {
+			numQueries++
+		}
+	}
+	assert.Equal(t, 6, numQueries)
+}
+
+func TestNerdlogIdleTimeout(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-2*time.Minute), "foo"))
+
+	var mtx sync.Mutex
+	var conns []ShellConn
+
+	numConns := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return len(conns)
+	}
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &connRecordingTransport{
+				fakeShellTransport: fakeShellTransport{logs: logs},
+				mtx:                &mtx,
+				conns:              &conns,
+			}
+		},
+		ClientID:    "test",
+		IdleTimeout: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := QueryLogsParams{From: now.Add(-time.Hour)}
+
+	// While the queries keep coming more often than the IdleTimeout, the
+	// connections stay.
+	for i := 0; i < 5; i++ {
+		resp, err := n.Query(ctx, query)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 2, len(resp.Logs))
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, 2, numConns())
+
+	// Once idle for long enough, the connections are closed.
+	assert.Eventually(t, func() bool {
+		n.mtx.Lock()
+		defer n.mtx.Unlock()
+
+		st := n.lastState
+		return st.IdleDisconnected &&
+			len(st.LStreamsByState[LStreamClientStateDisconnected]) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// And the next query reconnects.
+	resp, err := n.Query(ctx, query)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, len(resp.Logs))
+	assert.Equal(t, 4, numConns())
+
+	n.mtx.Lock()
+	assert.False(t, n.lastState.IdleDisconnected)
+	n.mtx.Unlock()
+}
+
+func TestNerdlogPaging(t *testing.T) {
+	base := time.Now().UTC().Truncate(time.Minute)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(base.Add(-10*time.Minute), "a"),
+		fakeLogLine(base.Add(-5*time.Minute), "b"),
+		fakeLogLine(base.Add(-5*time.Minute+10*time.Second), "c"),
+	)
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "fake-01",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{
+				logs:           logs,
+				agentCmds:      agentCmds,
+				applyQueryArgs: true,
+			}
+		},
+		ClientID:    "test",
+		MaxNumLines: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := func(params QueryLogsParams) (msgs []string, numMsgsTotal int, agentCmd string) {
+		params.From = base.Add(-time.Hour)
+
+		resp, err := n.Query(ctx, params)
+		if !assert.NoError(t, err) {
+			return nil, 0, ""
+		}
+
+		for _, msg := range resp.Logs {
+			msgs = append(msgs, msg.Msg)
+		}
+
+		cmds := agentCmds.get()
+		return msgs, resp.NumMsgsTotal, cmds[len(cmds)-1]
+	}
+
+	fromArg := func(t time.Time) string {
+		return fmt.Sprintf("--from '%s'", t.Format(queryLogsArgsTimeLayout))
+	}
+
+	msgs, numMsgsTotal, agentCmd := query(QueryLogsParams{})
+	assert.Equal(t, []string{"a", "b", "c"}, msgs)
+	assert.Equal(t, 3, numMsgsTotal)
+	assert.Contains(t, agentCmd, "--max-num-lines 4")
+	assert.Contains(t, agentCmd, fromArg(base.Add(-time.Hour)))
+
+	// Only the logs since the minute of the latest one are queried, and added
+	// to the ones we had.
+	logs.add(fakeLogLine(base.Add(-2*time.Minute), "d"))
+
+	msgs, numMsgsTotal, agentCmd = query(QueryLogsParams{LoadNewer: true})
+	assert.Equal(t, []string{"a", "b", "c", "d"}, msgs)
+	assert.Equal(t, 4, numMsgsTotal)
+	assert.Contains(t, agentCmd, "--max-num-lines 4")
+	assert.Contains(t, agentCmd, fromArg(base.Add(-5*time.Minute)))
+
+	// If there are more newer logs than the max number of lines, the older
+	// ones are dropped, but the stats still cover everything.
+	logs.add(
+		fakeLogLine(base.Add(-90*time.Second), "e"),
+		fakeLogLine(base.Add(-time.Minute), "f"),
+		fakeLogLine(base.Add(-30*time.Second), "g"),
+	)
+
+	msgs, numMsgsTotal, agentCmd = query(QueryLogsParams{LoadNewer: true})
+	assert.Equal(t, []string{"d", "e", "f", "g"}, msgs)
+	assert.Equal(t, 7, numMsgsTotal)
+	assert.Contains(t, agentCmd, fromArg(base.Add(-2*time.Minute)))
+
+	// Loading the earlier logs picks up from there.
+	msgs, numMsgsTotal, agentCmd = query(QueryLogsParams{LoadEarlier: true})
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g"}, msgs)
+	assert.Equal(t, 7, numMsgsTotal)
+	assert.Contains(t, agentCmd, "--lines-until 4")
+}
+
+func TestNerdlogLogSources(t *testing.T) {
+	base := time.Now().UTC().Truncate(time.Minute)
+
+	accessLogs := &fakeLogs{}
+	accessLogs.add(
+		fakeLogLine(base.Add(-5*time.Minute), "GET /foo"),
+		fakeLogLine(base.Add(-3*time.Minute), "GET /bar"),
+		fakeLogLine(base.Add(-1*time.Minute), "GET /baz"),
+	)
+
+	appLogs := &fakeLogs{}
+	appLogs.add(
+		fakeLogLine(base.Add(-10*time.Minute), "booting"),
+		fakeLogLine(base.Add(-5*time.Minute), "started"),
+		fakeLogLine(base.Add(-3*time.Minute+10*time.Second), "ready"),
+	)
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "web-01",
+		ConfigLogStreams: ConfigLogStreams{
+			"web-01": ConfigLogStream{
+				LogSources: []ConfigLogSource{
+					{Tag: "access", LogFiles: []string{"/var/log/nginx/access.log"}},
+					{Tag: "app", LogFiles: []string{"/var/log/app.log", "/var/log/app.log.1"}},
+				},
+			},
+		},
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{
+				logsByFile: map[string]*fakeLogs{
+					"/var/log/nginx/access.log": accessLogs,
+					"/var/log/app.log":          appLogs,
+				},
+				agentCmds:      agentCmds,
+				applyQueryArgs: true,
+			}
+		},
+		ClientID:    "test",
+		MaxNumLines: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// query returns the messages along with their logstream and source, and
+	// the query command followed by the agent runs for every source.
+	query := func(params QueryLogsParams) (msgs []string, numMsgsTotal int, cmds []string) {
+		params.From = base.Add(-time.Hour)
+
+		resp, err := n.Query(ctx, params)
+		if !assert.NoError(t, err) {
+			return nil, 0, nil
+		}
+
+		for _, msg := range resp.Logs {
+			msgs = append(msgs, fmt.Sprintf(
+				"%s %s: %s", msg.Context["lstream"], msg.Context["logsource"], msg.Msg,
+			))
+		}
+
+		allCmds := agentCmds.get()
+		return msgs, resp.NumMsgsTotal, allCmds[len(allCmds)-3:]
+	}
+
+	// Both sources are read as a single logstream, and the messages from them
+	// are merged in the timestamp order; only the latest ones are left, and
+	// the stats from both sources are added up.
+	msgs, numMsgsTotal, cmds := query(QueryLogsParams{})
+	assert.Equal(t, []string{
+		"web-01 access: GET /bar",
+		"web-01 app: ready",
+		"web-01 access: GET /baz",
+	}, msgs)
+	assert.Equal(t, 6, numMsgsTotal)
+
+	// The agent runs for every source in turn, each with its own log files and
+	// index file, in the same command.
+	assert.Regexp(t, `\( echo 'log_source:0' ; [^;]* query [^;]* ; echo 'log_source:1' ; [^;]* query [^;]* \) \| gzip`, cmds[0])
+	assert.Contains(t, cmds[1], "--index-file /tmp/nerdlog_agent_index_test__var_log_nginx_access.log ")
+	assert.Contains(t, cmds[1], "--logfile-last /var/log/nginx/access.log --logfile-prev auto ")
+	assert.Contains(t, cmds[2], "--index-file /tmp/nerdlog_agent_index_test__var_log_app.log ")
+	assert.Contains(t, cmds[2], "--logfile-last /var/log/app.log --logfile-prev /var/log/app.log.1 ")
+
+	// Loading the earlier logs picks up from the earliest message of every
+	// source; the app logs before the access ones were cut above, since the
+	// access logs might be missing there, so they're loaded now.
+	msgs, numMsgsTotal, cmds = query(QueryLogsParams{LoadEarlier: true})
+	assert.Equal(t, []string{
+		"web-01 app: booting",
+		"web-01 access: GET /foo",
+		"web-01 app: started",
+		"web-01 access: GET /bar",
+		"web-01 app: ready",
+		"web-01 access: GET /baz",
+	}, msgs)
+	assert.Equal(t, 6, numMsgsTotal)
+	assert.Contains(t, cmds[1], "--lines-until 2 ")
+	assert.Contains(t, cmds[2], "--lines-until 3 ")
+
+	// The source is known in advance for every agent run, so the filter by it
+	// is resolved right away.
+	_, _, cmds = query(QueryLogsParams{Query: "logsource:app", QueryLang: QueryLangFilter})
+	assert.Regexp(t, ` 0 ; $`, cmds[1])
+	assert.Regexp(t, ` 1 \) `, cmds[2])
+}
+
+func TestNerdlogLowPriority(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "low-01,low-02,normal-01",
+		ConfigLogStreams: ConfigLogStreams{
+			"low-01": ConfigLogStream{
+				Options: ConfigLogStreamOptions{LowPriority: true},
+			},
+			"low-02": ConfigLogStream{
+				Options: ConfigLogStreamOptions{
+					LowPriority:         true,
+					LowPriorityWrappers: []string{"systemd-run --user --scope -q -p CPUQuota=20%"},
+				},
+			},
+			"normal-01": ConfigLogStream{},
+		},
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs, agentCmds: agentCmds}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Every logstream has invoked the agent twice: logstream_info and query.
+	cmds := agentCmds.get()
+	if !assert.Equal(t, 6, len(cmds)) {
+		return
+	}
+
+	// The agent path doesn't include the logstream name, so just count how
+	// many invocations were wrapped in which way.
+	niceWrapper := "CUR_MONTH=%.2d" +
+		" $(command -v nice >/dev/null 2>&1 && echo nice -n 19)" +
+		" $(command -v ionice >/dev/null 2>&1 && echo ionice -c3)" +
+		" bash "
+	systemdWrapper := "CUR_MONTH=%.2d" +
+		" $(command -v systemd-run >/dev/null 2>&1 && echo systemd-run --user --scope -q -p CPUQuota=20%%)" +
+		" bash "
+	noWrapper := "CUR_MONTH=%.2d bash "
+
+	counts := map[string]int{}
+	for _, cmd := range cmds {
+		for _, wrapper := range []string{niceWrapper, systemdWrapper, noWrapper} {
+			if strings.Contains(cmd, fmt.Sprintf(wrapper, time.Now().Month())) {
+				counts[wrapper]++
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]int{
+		niceWrapper:    2,
+		systemdWrapper: 2,
+		noWrapper:      2,
+	}, counts)
+}
+
+func TestNerdlogSampling(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-2*time.Minute+time.Second), "bar"),
+	)
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "fake-01",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs, agentCmds: agentCmds}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.False(t, resp.Approximate)
+	assert.Equal(t, 2, resp.NumMsgsTotal)
+	assert.NotContains(t, agentCmds.get()[len(agentCmds.get())-1], "--sample-rate")
+
+	resp, err = n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour), SampleRate: 4})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cmds := agentCmds.get()
+	assert.Contains(t, cmds[len(cmds)-1], " --sample-rate 4 ")
+
+	// The fake agent doesn't actually sample the lines, but the stats it
+	// prints are scaled anyway, as if it did.
+	assert.True(t, resp.Approximate)
+	assert.Equal(t, 4, resp.SampleRate)
+	assert.Equal(t, 8, resp.NumMsgsTotal)
+	assert.Equal(t, map[int64]MinuteStatsItem{
+		now.Add(-2 * time.Minute).Unix(): {NumMsgs: 8},
+	}, resp.MinuteStats)
+}
+
+func TestNerdlogLabels(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	agentCmds := map[string]*fakeLogs{
+		"web-01": {},
+		"web-02": {},
+	}
+
+	n, err := New(Options{
+		LStreams: "web-01,web-02",
+		ConfigLogStreams: ConfigLogStreams{
+			"web-01": {Labels: map[string]string{"region": "eu", "team": "core"}},
+			"web-02": {Labels: map[string]string{"region": "us"}},
+		},
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs, agentCmds: agentCmds[ls.Name]}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	labelsByLStream := map[string]map[string]string{}
+	for _, msg := range resp.Logs {
+		lstream := msg.Context["lstream"]
+		labelsByLStream[lstream] = msg.Labels
+
+		assert.Equal(t, msg.Labels["region"], msg.Context["region"], lstream)
+	}
+	assert.Equal(t, map[string]map[string]string{
+		"web-01": {"region": "eu", "team": "core"},
+		"web-02": {"region": "us"},
+	}, labelsByLStream)
+
+	// The label fields in the filter query are resolved for every logstream
+	// right away.
+	_, err = n.Query(ctx, QueryLogsParams{
+		From:      now.Add(-time.Hour),
+		Query:     "region:eu",
+		QueryLang: QueryLangFilter,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cmds := agentCmds["web-01"].get()
+	assert.Regexp(t, `\s1 \|`, cmds[len(cmds)-1])
+
+	cmds = agentCmds["web-02"].get()
+	assert.Regexp(t, `\s0 \|`, cmds[len(cmds)-1])
+}
+
+func TestNerdlogResourceLimits(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	agentCmds := &fakeLogs{}
+	queryKilledBy := ""
+
+	newNerdlog := func() *Nerdlog {
+		n, err := New(Options{
+			LStreams: "limited-01,normal-01",
+			ConfigLogStreams: ConfigLogStreams{
+				"limited-01": ConfigLogStream{
+					Options: ConfigLogStreamOptions{
+						CPULimitSeconds: 60,
+						MemoryLimitKB:   1048576,
+					},
+				},
+				"normal-01": ConfigLogStream{},
+			},
+			NewTransport: func(ls LogStream) ShellTransport {
+				transport := &fakeShellTransport{logs: logs}
+				if ls.Name == "limited-01" {
+					transport.agentCmds = agentCmds
+					transport.queryKilledBy = queryKilledBy
+				}
+
+				return transport
+			},
+			ClientID: "test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	n := newNerdlog()
+	_, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	n.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Only the query is run with the limits, not the logstream_info.
+	cmds := agentCmds.get()
+	if !assert.Equal(t, 2, len(cmds)) {
+		return
+	}
+	assert.NotContains(t, cmds[0], "ulimit")
+	assert.Contains(t, cmds[1], "( ulimit -t 60 -v 1048576 ; CUR_YEAR=")
+	assert.Contains(t, cmds[1], ` ; nlrc=$? ; [ $nlrc -gt 128 ] && echo "exit_code:$nlrc" ) | gzip -c`)
+
+	// Once the agent is killed due to the limits, the query fails with the
+	// specific error.
+	for _, sig := range []string{"XCPU", "KILL"} {
+		queryKilledBy = sig
+
+		n = newNerdlog()
+		_, err = n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+		n.Close()
+
+		if assert.Error(t, err, sig) {
+			assert.True(t, errors.Is(err, ErrResourceLimit), sig)
+			assert.Contains(t, err.Error(), "query exceeded resource limit on host limited-01", sig)
+		}
+	}
+}
+
+func TestNerdlogAWKFailed(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	for i := 5; i > 0; i-- {
+		logs.add(fakeLogLine(now.Add(-time.Duration(i)*time.Minute), fmt.Sprintf("foo %d", i)))
+	}
+
+	n, err := New(Options{
+		LStreams: "broken-01,normal-01",
+		ConfigLogStreams: ConfigLogStreams{
+			"broken-01": ConfigLogStream{},
+			"normal-01": ConfigLogStream{},
+		},
+		NewTransport: func(ls LogStream) ShellTransport {
+			transport := &fakeShellTransport{logs: logs}
+			if ls.Name == "broken-01" {
+				transport.queryAWKFailsAt = 3
+			}
+
+			return transport
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The logs printed before the failure are not returned as if they were
+	// all the logs; the query fails on that host instead.
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrAWKFailed))
+		assert.Contains(
+			t, err.Error(),
+			"awk failed on host broken-01 at ~line 3: gawk: cmd. line:12: (FILENAME=- FNR=3) fatal: division by zero attempted",
+		)
+		assert.NotContains(t, err.Error(), "normal-01")
+	}
+
+	if assert.NotNil(t, resp) && assert.NotNil(t, resp.ResumeToken) {
+		assert.Equal(t, []string{"broken-01"}, resp.ResumeToken.Pending)
+	}
+}
+
+func TestNerdlogLocale(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	// With the host's own locale, the timestamps are formatted like in
+	// de_DE.UTF-8, which can't be parsed.
+	localizedLogs := &fakeLogs{}
+	localizedLogs.add(fmt.Sprintf(
+		"%s myhost myapp[123]: foo", now.Add(-time.Minute).UTC().Format("02.01.2006, 15:04:05"),
+	))
+
+	newNerdlog := func(locale string) *Nerdlog {
+		n, err := New(Options{
+			LStreams: "fake-01",
+			ConfigLogStreams: ConfigLogStreams{
+				"fake-01": ConfigLogStream{
+					Options: ConfigLogStreamOptions{Locale: locale},
+				},
+			},
+			NewTransport: func(ls LogStream) ShellTransport {
+				return &fakeShellTransport{logs: logs, localizedLogs: localizedLogs}
+			},
+			ClientID: "test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// By default, the C locale is used, so the logs are parsed fine.
+	n := newNerdlog("")
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	n.Close()
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(resp.Logs)) {
+		assert.Equal(t, "foo", resp.Logs[0].Msg)
+		assert.True(t, resp.Logs[0].Time.Equal(now.Add(-time.Minute)))
+	}
+
+	// Without setting the locale, the host's one is used, and it breaks
+	// parsing, so the bootstrap fails.
+	n = newNerdlog(LocaleNone)
+	defer n.Close()
+
+	assert.Eventually(t, func() bool {
+		err := n.FleetStatus().Err()
+		return err != nil && strings.Contains(err.Error(), "unable to detect time format")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNerdlogProjection(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	ts := now.Add(-time.Minute).UTC().Format(time.Stamp)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo status=500 bar"))
+
+	// What the real agent would output for the projection below.
+	projectedLogs := &fakeLogs{}
+	projectedLogs.add(ts + "\x1fhostname=myhost\x1fstatus=500")
+
+	agentCmds := &fakeLogs{}
+
+	newNerdlog := func(projectedLogs *fakeLogs) *Nerdlog {
+		n, err := New(Options{
+			LStreams: "fake-01",
+			NewTransport: func(ls LogStream) ShellTransport {
+				return &fakeShellTransport{
+					logs:          logs,
+					projectedLogs: projectedLogs,
+					agentCmds:     agentCmds,
+				}
+			},
+			ClientID: "test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	n := newNerdlog(projectedLogs)
+	defer n.Close()
+
+	params := QueryLogsParams{
+		From:   now.Add(-time.Hour),
+		Select: "timestamp,host,field:status",
+	}
+
+	resp, err := n.Query(ctx, params)
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(resp.Logs)) {
+		msg := resp.Logs[0]
+		assert.True(t, msg.Time.Equal(now.Add(-time.Minute)))
+		assert.Equal(t, "", msg.Msg)
+		assert.Equal(t, map[string]string{
+			"lstream":  "fake-01",
+			"hostname": "myhost",
+			"status":   "500",
+		}, msg.Context)
+		assert.Equal(t, ts+" hostname=myhost status=500", msg.OrigLine)
+	}
+
+	// The projection is compiled for the agent.
+	projectionCode := CompileProjectionToAWK(&Projection{
+		Fields: []ProjectionField{
+			{Kind: ProjectionFieldHostname},
+			{Kind: ProjectionFieldKeyValue, Name: "status"},
+		},
+	}, FilterFieldsConfig{NumTimestampFields: 3})
+
+	cmds := agentCmds.get()
+	assert.Contains(t, cmds[len(cmds)-1], " --projection-code "+shellQuote(projectionCode)+" ")
+
+	// Invalid projection fails the query.
+	params.Select = "timestamp,foo"
+	_, err = n.Query(ctx, params)
+	assert.Error(t, err)
+
+	// If the agent ignores the projection, the full lines are parsed as usual.
+	n2 := newNerdlog(nil)
+	defer n2.Close()
+
+	params.Select = "host"
+	resp, err = n2.Query(ctx, params)
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(resp.Logs)) {
+		assert.Equal(t, "foo status=500 bar", resp.Logs[0].Msg)
+		assert.Equal(t, "myhost", resp.Logs[0].Context["hostname"])
+	}
+}
+
+func TestNerdlogQueryProgress(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	for i := 0; i < 50; i++ {
+		logs.add(fakeLogLine(now.Add(time.Duration(i-50)*time.Second), fmt.Sprintf("msg %d", i)))
+	}
+
+	var mtx sync.Mutex
+	var stages []BusyStage
+
+	n, err := New(Options{
+		LStreams: "fake-01",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs, progress: true}
+		},
+		ClientID: "test",
+		OnStateUpdate: func(state *LStreamsManagerState) {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			if stage, ok := state.BusyStageByLStream["fake-01"]; ok {
+				stages = append(stages, stage)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The progress markers interleaved with the data don't affect the result.
+	if !assert.Equal(t, 50, len(resp.Logs)) {
+		return
+	}
+	for i, msg := range resp.Logs {
+		assert.Equal(t, fmt.Sprintf("msg %d", i), msg.Msg)
+	}
+	assert.Equal(t, 0, len(resp.Errs))
+
+	// And the progress is surfaced in the busy stage.
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if !assert.NotEmpty(t, stages) {
+		return
+	}
+
+	last := stages[len(stages)-1]
+	assert.Equal(t, 1, last.Num)
+	assert.Equal(t, "querying logs", last.Title)
+	assert.Equal(t, 98, last.Percentage)
+	assert.Equal(t, int64(4900), last.BytesProcessed)
+	assert.Equal(t, int64(5000), last.BytesTotal)
+}
+
+func TestNerdlogQueryWarnings(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	n, err := New(Options{
+		LStreams: "fake-01, fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			transport := &fakeShellTransport{logs: logs}
+			if ls.Name == "fake-02" {
+				transport.queryStderr = []string{
+					"debug:this is not a warning",
+					"tail: cannot open '/var/log/syslog.1' for reading: Permission denied",
+					"warn:something is off",
+				}
+			}
+
+			return transport
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Warnings don't fail the query.
+	assert.Equal(t, 0, len(resp.Errs))
+	assert.Equal(t, 4, len(resp.Logs))
+
+	assert.Equal(t, []string{
+		"fake-02: tail: cannot open '/var/log/syslog.1' for reading: Permission denied",
+		"fake-02: something is off",
+	}, resp.Warnings)
+}
+
+func TestNerdlogSkipNotConnected(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	reachableCh := make(chan struct{})
+
+	newNerdlog := func(skipNotConnected bool) *Nerdlog {
+		n, err := New(Options{
+			LStreams: "fake-01, fake-02, fake-03, fake-04",
+			NewTransport: func(ls LogStream) ShellTransport {
+				switch ls.Name {
+				case "fake-03":
+					// Never connects.
+					return &fakeUnreachableTransport{
+						fakeShellTransport: fakeShellTransport{logs: logs},
+					}
+				case "fake-04":
+					// Connects once reachableCh is closed.
+					return &fakeUnreachableTransport{
+						fakeShellTransport: fakeShellTransport{logs: logs},
+						reachableCh:        reachableCh,
+					}
+				}
+
+				return &fakeShellTransport{logs: logs}
+			},
+			ClientID:         "test",
+			ConnectTimeout:   300 * time.Millisecond,
+			SkipNotConnected: skipNotConnected,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Without SkipNotConnected, the query fails.
+	n := newNerdlog(false)
+	_, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	assert.Error(t, err)
+	n.Close()
+
+	n = newNerdlog(true)
+	defer n.Close()
+
+	// Nothing to retry yet.
+	_, err = n.RetrySkipped(ctx)
+	assert.EqualError(t, err, "no skipped lstreams to retry")
+
+	// The query proceeds with the connected ones, and reports the skipped ones.
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"fake-03", "fake-04"}, resp.SkippedLStreams)
+	assert.Equal(t, 4, len(resp.Logs))
+	assert.Equal(t, 4, resp.NumMsgsTotal)
+
+	// Once one of them is reachable, retrying only queries the skipped ones,
+	// and adds their logs to the ones we have.
+	close(reachableCh)
+
+	resp, err = n.RetrySkipped(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"fake-03"}, resp.SkippedLStreams)
+	if !assert.Equal(t, 6, len(resp.Logs)) {
+		return
+	}
+	assert.Equal(t, 6, resp.NumMsgsTotal)
+	assert.Equal(t, 1, len(resp.DebugInfo))
+	assert.Contains(t, resp.DebugInfo, "fake-04")
+
+	lstreams := map[string]int{}
+	for _, msg := range resp.Logs {
+		lstreams[msg.Context["lstream"]]++
+	}
+	assert.Equal(t, map[string]int{"fake-01": 2, "fake-02": 2, "fake-04": 2}, lstreams)
+
+	// The last one is still down, so retrying again fails.
+	_, err = n.RetrySkipped(ctx)
+	assert.Error(t, err)
+}
+
+func TestParseBytesProgress(t *testing.T) {
+	processed, total, err := parseBytesProgress("123:4567")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(123), processed)
+	assert.Equal(t, int64(4567), total)
+
+	for _, s := range []string{"", "123", "1:2:3", "a:10", "1:b", "-1:10", "1:0"} {
+		_, _, err := parseBytesProgress(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestNerdlogCapabilitiesCache(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	cache := NewCapabilitiesCache(CapabilitiesCacheParams{
+		Path:  filepath.Join(t.TempDir(), "capabilities.json"),
+		Clock: clock.New(),
+	})
+
+	// runQuery runs a query with a fresh Nerdlog instance, like a new nerdlog
+	// run, and returns how many times the host was probed.
+	runQuery := func(hostVersion string) int {
+		agentCmds := &fakeLogs{}
+
+		n, err := New(Options{
+			LStreams: "fake-01",
+			NewTransport: func(ls LogStream) ShellTransport {
+				return &fakeShellTransport{
+					logs: logs, agentCmds: agentCmds, hostVersion: hostVersion,
+				}
+			},
+			CapabilitiesCache: cache,
+			ClientID:          "test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+		if assert.NoError(t, err) && assert.Equal(t, 1, len(resp.Logs)) {
+			assert.Equal(t, "foo", resp.Logs[0].Msg)
+		}
+
+		numProbes := 0
+		for _, cmd := range agentCmds.get() {
+			if strings.Contains(cmd, " logstream_info ") {
+				numProbes++
+			}
+		}
+
+		return numProbes
+	}
+
+	// Cache miss: the host is probed.
+	assert.Equal(t, 1, runQuery("Linux 6.1.0 x86_64"))
+
+	// Cache hit: the probes are skipped, and the cached time format works.
+	assert.Equal(t, 0, runQuery("Linux 6.1.0 x86_64"))
+
+	// The host was upgraded: probed again, and the cache is updated.
+	assert.Equal(t, 1, runQuery("Linux 6.12.0 x86_64"))
+
+	cache.mtx.Lock()
+	assert.Equal(t, 1, len(cache.entries))
+	for _, caps := range cache.entries {
+		assert.Equal(t, "Linux 6.12.0 x86_64", caps.HostVersion)
+	}
+	cache.mtx.Unlock()
+
+	assert.Equal(t, 0, runQuery("Linux 6.12.0 x86_64"))
+}
+
+func TestNerdlogInvalidOptions(t *testing.T) {
+	_, err := New(Options{})
+	assert.Error(t, err)
+
+	_, err = New(Options{LStreams: "foo,,bar"})
+	assert.Error(t, err)
+}
+
+func TestNerdlogVerifyStreams(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	verifyStatuses := map[string]LStreamVerifyStatus{
+		"fake-01": LStreamVerifyReadable,
+		"fake-02": LStreamVerifyNotFound,
+		"fake-03": LStreamVerifyPermissionDenied,
+	}
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02,fake-03",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{
+				logs:         logs,
+				agentCmds:    agentCmds,
+				verifyStatus: verifyStatuses[ls.Name],
+			}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	results, err := n.VerifyStreams(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]LStreamVerifyResult{
+			"fake-01": {Status: LStreamVerifyReadable, Filename: "/var/log/syslog.1"},
+			"fake-02": {Status: LStreamVerifyNotFound, Filename: "/var/log/syslog"},
+			"fake-03": {Status: LStreamVerifyPermissionDenied, Filename: "/var/log/syslog"},
+		}, results)
+
+		assert.True(t, results["fake-01"].Ready())
+		assert.Equal(t, "not found: /var/log/syslog", results["fake-02"].String())
+	}
+
+	// The verification is done by the agent.
+	var verifyCmds []string
+	for _, cmd := range agentCmds.get() {
+		if strings.Contains(cmd, " verify ") {
+			verifyCmds = append(verifyCmds, cmd)
+		}
+	}
+	assert.Equal(t, 3, len(verifyCmds))
+}
+
+func TestNerdlogVerifyStreamsNotConnected(t *testing.T) {
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(time.Now(), "foo"))
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			if ls.Name == "fake-02" {
+				return &fakeUnreachableTransport{}
+			}
+
+			return &fakeShellTransport{logs: logs}
+		},
+		ClientID:       "test",
+		ConnectTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	results, err := n.VerifyStreams(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, LStreamVerifyReadable, results["fake-01"].Status)
+		assert.Equal(t, LStreamVerifyNotConnected, results["fake-02"].Status)
+	}
+}
+
+func TestNerdlogRunAdHoc(t *testing.T) {
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(time.Now(), "foo"))
+
+	newNerdlog := func(allow bool) *Nerdlog {
+		n, err := New(Options{
+			LStreams: "fake-01",
+			NewTransport: func(ls LogStream) ShellTransport {
+				return &fakeShellTransport{
+					logs: logs,
+					adHocOutputs: map[string]string{
+						"ls -la '/var/log'": "total 8\nsyslog\nsyslog.1\n",
+						"cat big":           strings.Repeat("0123456789\n", 10),
+					},
+				}
+			},
+			ClientID:           "test",
+			AllowAdHocCmds:     allow,
+			AdHocMaxOutputSize: 25,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Disabled by default.
+	n := newNerdlog(false)
+	_, err := n.RunAdHoc(ctx, "fake-01", "ls")
+	assert.True(t, errors.Is(err, ErrAdHocCmdsDisabled))
+	n.Close()
+
+	n = newNerdlog(true)
+	defer n.Close()
+
+	output, err := n.RunAdHoc(ctx, "fake-01", "ls -la '/var/log'")
+	assert.NoError(t, err)
+	assert.Equal(t, "total 8\nsyslog\nsyslog.1\n", output)
+
+	// The output is truncated.
+	output, err = n.RunAdHoc(ctx, "fake-01", "cat big")
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789\n0123456789\n012\n[output truncated to 25 bytes]\n", output)
+
+	// The failed command returns both the output and the error.
+	output, err = n.RunAdHoc(ctx, "fake-01", "foo")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "fake-01: command exited with code 127")
+	}
+	assert.Equal(t, "sh: 1: foo: not found\n", output)
+
+	_, err = n.RunAdHoc(ctx, "fake-02", "ls")
+	assert.Error(t, err)
+
+	// The logstream is still usable after that.
+	resp, err := n.Query(ctx, QueryLogsParams{From: time.Now().Add(-time.Hour)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(resp.Logs))
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"github.com/juju/errors"
+)
+
+const (
+	// fdsPerLStream is how many file descriptors a single connected logstream
+	// takes, roughly: with the ssh-bin and other external commands, it's the
+	// stdin, stdout and stderr pipes of the process and then some; the ssh-lib
+	// transport only needs a socket, but we don't want to be too optimistic.
+	fdsPerLStream = 4
+
+	// reservedFDs is how many file descriptors are left for nerdlog itself:
+	// the tty, the log file, the history files, the caches etc.
+	reservedFDs = 32
+)
+
+// getOpenFilesLimit returns the soft limit of the number of open files for
+// the process (RLIMIT_NOFILE), or 0 if it's unknown. It's a var so that tests
+// can mock it.
+var getOpenFilesLimit = openFilesLimit
+
+// maxOpenStreams contains the resolved max number of logstreams to have open
+// at the same time, as well as where it came from, for the error message.
+type maxOpenStreams struct {
+	// max is the max number of logstreams; 0 means no limit.
+	max int
+
+	// numFDs is the RLIMIT_NOFILE the max was derived from; 0 if the max was
+	// given explicitly.
+	numFDs uint64
+}
+
+// resolveMaxOpenStreams returns the max number of the logstreams to have open
+// at the same time, given the configured one (see
+// LStreamsManagerParams.MaxOpenStreams): if it's zero, the max is derived from
+// the RLIMIT_NOFILE; if it's negative, there is no limit.
+func resolveMaxOpenStreams(configured int) (maxOpenStreams, error) {
+	if configured < 0 {
+		return maxOpenStreams{}, nil
+	}
+
+	if configured > 0 {
+		return maxOpenStreams{max: configured}, nil
+	}
+
+	numFDs, err := getOpenFilesLimit()
+	if err != nil {
+		return maxOpenStreams{}, errors.Annotatef(err, "getting RLIMIT_NOFILE")
+	}
+
+	// Unknown or unlimited.
+	if numFDs == 0 {
+		return maxOpenStreams{}, nil
+	}
+
+	max := 1
+	if numFDs > reservedFDs+fdsPerLStream {
+		max = int((numFDs - reservedFDs) / fdsPerLStream)
+	}
+
+	return maxOpenStreams{max: max, numFDs: numFDs}, nil
+}
+
+// check returns an error if the given number of logstreams exceeds the max.
+func (m maxOpenStreams) check(numLStreams int) error {
+	if m.max == 0 || numLStreams <= m.max {
+		return nil
+	}
+
+	if m.numFDs != 0 {
+		return errors.Errorf(
+			"%d logstreams requested, but only %d file descriptors are available, which is enough for %d logstreams; raise the limit with ulimit -n, or select fewer logstreams",
+			numLStreams, m.numFDs, m.max,
+		)
+	}
+
+	return errors.Errorf(
+		"%d logstreams requested, but the max number of open logstreams is %d; raise the max, or select fewer logstreams",
+		numLStreams, m.max,
+	)
+}
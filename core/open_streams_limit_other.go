@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package core
+
+// openFilesLimit returns 0, since there is no RLIMIT_NOFILE here, so the
+// number of open logstreams is only limited if it's configured explicitly.
+func openFilesLimit() (uint64, error) {
+	return 0, nil
+}
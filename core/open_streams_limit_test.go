@@ -0,0 +1,150 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockOpenFilesLimit makes getOpenFilesLimit return the given limit until the
+// test is done.
+func mockOpenFilesLimit(t *testing.T, limit uint64) {
+	orig := getOpenFilesLimit
+	getOpenFilesLimit = func() (uint64, error) {
+		return limit, nil
+	}
+
+	t.Cleanup(func() {
+		getOpenFilesLimit = orig
+	})
+}
+
+func TestResolveMaxOpenStreams(t *testing.T) {
+	mockOpenFilesLimit(t, 256)
+
+	m, err := resolveMaxOpenStreams(0)
+	assert.NoError(t, err)
+	assert.Equal(t, maxOpenStreams{max: 56, numFDs: 256}, m)
+
+	m, err = resolveMaxOpenStreams(100)
+	assert.NoError(t, err)
+	assert.Equal(t, maxOpenStreams{max: 100}, m)
+
+	m, err = resolveMaxOpenStreams(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, maxOpenStreams{}, m)
+
+	// Even a ridiculously low limit allows at least a single logstream.
+	mockOpenFilesLimit(t, 16)
+	m, err = resolveMaxOpenStreams(0)
+	assert.NoError(t, err)
+	assert.Equal(t, maxOpenStreams{max: 1, numFDs: 16}, m)
+
+	// Unlimited.
+	mockOpenFilesLimit(t, 0)
+	m, err = resolveMaxOpenStreams(0)
+	assert.NoError(t, err)
+	assert.Equal(t, maxOpenStreams{}, m)
+	assert.NoError(t, m.check(100000))
+}
+
+func TestMaxOpenStreamsPreflight(t *testing.T) {
+	mockOpenFilesLimit(t, 64)
+
+	configLogStreams := ConfigLogStreams{}
+	for i := 1; i <= 20; i++ {
+		configLogStreams[fmt.Sprintf("host-%02d", i)] = ConfigLogStream{
+			LogFiles: []string{"/var/log/syslog"},
+		}
+	}
+
+	params := LStreamsManagerParams{
+		ConfigLogStreams:            configLogStreams,
+		InitialLStreams:             "host-*",
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	}
+
+	// 64 fds are only enough for 8 logstreams.
+	assert.EqualError(
+		t, ValidateLStreams(params),
+		"20 logstreams requested, but only 64 file descriptors are available, which is enough for 8 logstreams; raise the limit with ulimit -n, or select fewer logstreams",
+	)
+
+	params.InitialLStreams = "host-0*"
+	assert.EqualError(
+		t, ValidateLStreams(params),
+		"9 logstreams requested, but only 64 file descriptors are available, which is enough for 8 logstreams; raise the limit with ulimit -n, or select fewer logstreams",
+	)
+
+	params.InitialLStreams = "host-0[1-8]"
+	assert.NoError(t, ValidateLStreams(params))
+
+	// The explicit max takes precedence over the fds limit.
+	params.InitialLStreams = "host-*"
+	params.MaxOpenStreams = 10
+	assert.EqualError(
+		t, ValidateLStreams(params),
+		"20 logstreams requested, but the max number of open logstreams is 10; raise the max, or select fewer logstreams",
+	)
+
+	params.MaxOpenStreams = -1
+	assert.NoError(t, ValidateLStreams(params))
+
+	// Same for Nerdlog.
+	_, err := New(Options{
+		LStreams:         "host-*",
+		ConfigLogStreams: configLogStreams,
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: &fakeLogs{}}
+		},
+	})
+	assert.EqualError(
+		t, err,
+		"20 logstreams requested, but only 64 file descriptors are available, which is enough for 8 logstreams; raise the limit with ulimit -n, or select fewer logstreams",
+	)
+}
+
+func TestMaxOpenStreamsSetLStreams(t *testing.T) {
+	mockOpenFilesLimit(t, 64)
+
+	updatesCh := make(chan LStreamsManagerUpdate, 1024)
+	go func() {
+		for range updatesCh {
+		}
+	}()
+
+	configLogStreams := ConfigLogStreams{}
+	for i := 1; i <= 20; i++ {
+		configLogStreams[fmt.Sprintf("host-%02d", i)] = ConfigLogStream{
+			LogFiles: []string{"/var/log/syslog"},
+		}
+	}
+
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		ConfigLogStreams: configLogStreams,
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: &fakeLogs{}}
+		},
+		InitialLStreams: "host-01",
+		ClientID:        "test",
+		UpdatesCh:       updatesCh,
+		Clock:           clock.New(),
+
+		InitialDefaultTransportMode: NewTransportModeSSHLib(),
+	})
+	defer func() {
+		lsman.Close()
+		lsman.Wait()
+		close(updatesCh)
+	}()
+
+	err := lsman.SetLStreams("host-*")
+	assert.EqualError(
+		t, err,
+		"20 logstreams requested, but only 64 file descriptors are available, which is enough for 8 logstreams; raise the limit with ulimit -n, or select fewer logstreams",
+	)
+
+	assert.NoError(t, lsman.SetLStreams("host-0[1-8]"))
+}
@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package core
+
+import (
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+func openFilesLimit() (uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// RLIM_INFINITY differs between the platforms, and the type of Cur too,
+	// so just treat anything huge as unlimited.
+	cur := uint64(rlim.Cur)
+	if cur >= 1<<62 {
+		return 0, nil
+	}
+
+	return cur, nil
+}
@@ -1,7 +1,9 @@
 package core
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -154,3 +156,86 @@ func TestGenerateTimeDescr(t *testing.T) {
 		})
 	}
 }
+
+func TestInferYear(t *testing.T) {
+	type testCase struct {
+		now      string
+		logMonth time.Month
+		wantYear int
+	}
+
+	testCases := []testCase{
+		{now: "2021-03-15", logMonth: time.March, wantYear: 2021},
+		{now: "2021-03-15", logMonth: time.January, wantYear: 2021},
+		// A month ahead is tolerated, e.g. due to the timezone difference.
+		{now: "2021-03-15", logMonth: time.April, wantYear: 2021},
+		// Further ahead is the previous year.
+		{now: "2021-03-15", logMonth: time.May, wantYear: 2020},
+		{now: "2021-03-15", logMonth: time.December, wantYear: 2020},
+		{now: "2021-01-15", logMonth: time.December, wantYear: 2020},
+		{now: "2021-01-15", logMonth: time.February, wantYear: 2021},
+		{now: "2021-01-15", logMonth: time.March, wantYear: 2020},
+		{now: "2021-12-15", logMonth: time.January, wantYear: 2022},
+		{now: "2021-12-15", logMonth: time.February, wantYear: 2021},
+		{now: "2021-11-15", logMonth: time.January, wantYear: 2021},
+	}
+
+	for _, tc := range testCases {
+		now, err := time.Parse("2006-01-02", tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := InferYear(now, time.Date(0, tc.logMonth, 10, 12, 0, 0, 0, time.UTC))
+		assert.Equal(t, tc.wantYear, got.Year(), "now %s, month %s", tc.now, tc.logMonth)
+	}
+}
+
+func TestInferYearAcrossNewYear(t *testing.T) {
+	// Year-less timestamps spanning the new year boundary, in the traditional
+	// syslog format.
+	timestamps := []string{
+		"Dec 30 23:59:59",
+		"Dec 31 12:00:00",
+		"Dec 31 23:59:59",
+		"Jan  1 00:00:00",
+		"Jan  1 00:00:01",
+		"Jan  2 08:00:00",
+	}
+
+	// Whenever we're reading these logs, as long as they're not older than 10
+	// months, they have the increasing timestamps: December of one year, and
+	// January of the next one.
+	for month := time.January; month <= time.December; month++ {
+		if month == time.November {
+			// The January here would be 10 months old, and the December would be
+			// next month.
+			continue
+		}
+
+		now := time.Date(2021, month, 15, 12, 0, 0, 0, time.UTC)
+		wantDecYear := 2020
+		if month == time.December {
+			wantDecYear = 2021
+		}
+
+		var got []string
+		var want []string
+		for _, ts := range timestamps {
+			parsed, err := time.Parse(time.Stamp, ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, InferYear(now, parsed).Format("2006 "+time.Stamp))
+
+			wantYear := wantDecYear
+			if parsed.Month() == time.January {
+				wantYear++
+			}
+			want = append(want, fmt.Sprintf("%d %s", wantYear, ts))
+		}
+
+		assert.Equal(t, want, got, "now %s", now)
+	}
+}
@@ -0,0 +1,485 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// PersistentSessionKind specifies the terminal multiplexer which keeps the
+// remote shell alive across the disconnects; see ConfigLogStreamOptions.PersistentSession.
+type PersistentSessionKind string
+
+const (
+	// PersistentSessionTmux runs the remote shell inside a tmux session.
+	PersistentSessionTmux PersistentSessionKind = "tmux"
+
+	// PersistentSessionScreen runs the remote shell inside a GNU screen session.
+	PersistentSessionScreen PersistentSessionKind = "screen"
+)
+
+var ValidPersistentSessionKinds = map[PersistentSessionKind]struct{}{
+	PersistentSessionTmux:   {},
+	PersistentSessionScreen: {},
+}
+
+const (
+	// persistentSessionReadyMarkerPrefix, followed by a unique number and
+	// "__", is printed by the shell inside the session once it's initialized;
+	// the number makes sure that we don't confuse it with the marker from a
+	// previous connection, which the multiplexer might redraw on reattaching.
+	// Whenever we send a marker to the shell, it's split with an empty string
+	// ("") in the middle, so that the echoed input, which the terminal might
+	// print before the echo is turned off, doesn't match.
+	persistentSessionReadyMarkerPrefix = "__NERDLOG_SESSION_READY_"
+
+	// persistentSessionUnavailableMarker is printed if the multiplexer (or
+	// script(1), which we need to give it a terminal) is not available on the
+	// host.
+	persistentSessionUnavailableMarker = "__NERDLOG_SESSION_UNAVAILABLE__"
+
+	// persistentSessionStderrPrefix is prepended to every stderr line of the
+	// shell inside the session: the terminal merges stdout and stderr, so
+	// the stderr is redirected through a fifo which adds this prefix, and the
+	// lines are demultiplexed back on our side.
+	persistentSessionStderrPrefix = "__NLERR__:"
+
+	// persistentSessionCols is the width of the terminal of the session: the
+	// longer lines are wrapped by the multiplexer. It's just under the max
+	// width supported by tmux.
+	persistentSessionCols = 9999
+)
+
+const (
+	// DefaultPersistentSessionAttachTimeout is how long to wait for the
+	// session to get ready after the underlying transport has connected.
+	DefaultPersistentSessionAttachTimeout = 30 * time.Second
+
+	// persistentSessionInitInterval is how often the init command is resent
+	// until the session gets ready; see persistentSessionInitCmd.
+	persistentSessionInitInterval = 1 * time.Second
+
+	// persistentSessionExitTimeout is how long Close waits for the session to
+	// end before closing the underlying connection.
+	persistentSessionExitTimeout = 1 * time.Second
+)
+
+// persistentSessionName returns the name of the tmux or screen session for
+// the given client and logstream, consisting of only the characters which are
+// safe to use in the session names and in filenames.
+func persistentSessionName(clientID, lstreamName string) string {
+	name := []byte(fmt.Sprintf("nerdlog_%s_%s", clientID, lstreamName))
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+			name[i] = '_'
+		}
+	}
+
+	return string(name)
+}
+
+// persistentSessionAttachCmd returns the shell command which replaces the
+// shell of the underlying connection with the multiplexer client, attaching
+// to the named session, or creating it with /bin/sh if it doesn't exist yet.
+//
+// The multiplexer needs a terminal, and we only have pipes, so it's run via
+// script(1), which allocates a pseudo-terminal; the terminal is made as wide
+// as possible, so that the multiplexer doesn't wrap the lines.
+//
+// If the multiplexer or script is not available on the host, the command
+// prints persistentSessionUnavailableMarker instead.
+func persistentSessionAttachCmd(kind PersistentSessionKind, name string) string {
+	var mplexBin, mplexCmd string
+	switch kind {
+	case PersistentSessionTmux:
+		// -A attaches to the existing session if any, and -D detaches the other
+		// clients from it, e.g. the one from the connection which has dropped,
+		// but which the host doesn't know about yet.
+		mplexBin = "tmux"
+		mplexCmd = "exec tmux new-session -A -D -s " + shellQuote(name) + " /bin/sh"
+	case PersistentSessionScreen:
+		// -D -RR is the same as the tmux's -A -D above, and -q suppresses the
+		// error messages and the startup screen.
+		mplexBin = "screen"
+		mplexCmd = "exec screen -q -D -RR -S " + shellQuote(name) + " /bin/sh"
+	default:
+		panic(fmt.Sprintf("invalid persistent session kind %q", kind))
+	}
+
+	termCmd := fmt.Sprintf(
+		"TERM=xterm; export TERM; stty cols %d rows 50 -echo; %s",
+		persistentSessionCols, mplexCmd,
+	)
+
+	return fmt.Sprintf(
+		`if command -v %s >/dev/null 2>&1 && command -v script >/dev/null 2>&1; then exec script -qfc %s /dev/null; fi; echo %s`,
+		mplexBin, shellQuote(termCmd), splitMarker(persistentSessionUnavailableMarker),
+	)
+}
+
+// persistentSessionInitCmd returns the command which initializes the shell
+// inside the session (no matter whether it's just created or reattached), and
+// prints the given ready marker; see terminalShellInitCmd. Also, the tmux
+// status line is turned off.
+//
+// Since the shell of the underlying connection might read ahead past the
+// attach command (and thus run the init command outside of the session),
+// the command is a no-op outside of the session, and we keep resending it
+// until the session is ready.
+func persistentSessionInitCmd(name, readyMarker string) string {
+	return `if [ -n "$TMUX$STY" ]; then ` +
+		`if [ -n "$TMUX" ]; then tmux set-option status off >/dev/null; fi; ` +
+		terminalShellInitCmd(name, readyMarker) + `; fi`
+}
+
+// terminalShellInitCmd returns the command which prepares the shell running
+// in a terminal for nerdlog, and prints the given ready marker:
+//
+//   - The terminal echo, the job control and the prompts are turned off, and
+//     the line editing is turned off as well, since it limits the lines to
+//     4096 bytes and treats some characters specially;
+//   - The stderr is redirected through a fifo named after fifoName,
+//     prefixing every line with persistentSessionStderrPrefix; it's done by
+//     the shell itself, since awk or sed would buffer the lines.
+func terminalShellInitCmd(fifoName, readyMarker string) string {
+	return fmt.Sprintf(
+		`stty -echo -icanon -isig -ixon min 1 time 0; set +m; PS1=''; PS2=''; `+
+			`nlerr="${TMPDIR:-/tmp}/%s.stderr"; rm -f "$nlerr"; `+
+			`if mkfifo "$nlerr"; then while IFS= read -r nlline; do printf '%%s%%s\n' '%s' "$nlline"; done < "$nlerr" & exec 2>"$nlerr"; fi; `+
+			`echo %s`,
+		fifoName, persistentSessionStderrPrefix, splitMarker(readyMarker),
+	)
+}
+
+// splitMarker returns the shell word which evaluates to the given marker, but
+// doesn't contain it literally.
+func splitMarker(marker string) string {
+	mid := len(marker) / 2
+	return marker[:mid] + `""` + marker[mid:]
+}
+
+// persistentSessionTransport wraps another transport, running the remote
+// shell inside a persistent tmux or screen session: if the connection drops,
+// the session keeps running on the host, and the next connection reattaches
+// to it, instead of starting a new shell.
+//
+// It doesn't implement ShellConnMultiSession, so all the queries go through
+// the single session.
+type persistentSessionTransport struct {
+	inner ShellTransport
+	kind  PersistentSessionKind
+	name  string
+
+	// attachCmd is the command which is written to the inner connection to
+	// attach to the session; it's only overridden in tests.
+	attachCmd string
+
+	attachTimeout time.Duration
+
+	logger *log.Logger
+}
+
+var _ ShellTransport = &persistentSessionTransport{}
+
+func newPersistentSessionTransport(
+	inner ShellTransport, kind PersistentSessionKind, name string, logger *log.Logger,
+) *persistentSessionTransport {
+	return &persistentSessionTransport{
+		inner: inner,
+		kind:  kind,
+		name:  name,
+
+		attachCmd:     persistentSessionAttachCmd(kind, name),
+		attachTimeout: DefaultPersistentSessionAttachTimeout,
+
+		logger: logger.WithNamespaceAppended("PersistentSession"),
+	}
+}
+
+func (t *persistentSessionTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		res := t.doConnect(ctx, resCh)
+		if res.Err != nil {
+			t.logger.Errorf("Attaching to the %s session failed: %s", t.kind, res.Err)
+		}
+
+		resCh <- ShellConnUpdate{Result: &res}
+	}()
+}
+
+func (t *persistentSessionTransport) doConnect(
+	ctx context.Context, resCh chan<- ShellConnUpdate,
+) ShellConnResult {
+	// Connect using the inner transport, forwarding all its updates except the
+	// result.
+	innerResCh := make(chan ShellConnUpdate, 1)
+	t.inner.Connect(ctx, innerResCh)
+
+	var innerConn ShellConn
+	for innerConn == nil {
+		upd := <-innerResCh
+		if upd.Result == nil {
+			resCh <- upd
+			continue
+		}
+
+		if upd.Result.Err != nil {
+			return *upd.Result
+		}
+
+		innerConn = upd.Result.Conn
+	}
+
+	resCh <- ShellConnUpdate{
+		DebugInfo: &ShellConnDebugInfo{
+			Message: fmt.Sprintf("Connected, attaching to the %s session %q", t.kind, t.name),
+		},
+	}
+
+	readyMarker := fmt.Sprintf("%s%d__", persistentSessionReadyMarkerPrefix, time.Now().UnixNano())
+	conn := newPersistentSessionConn(innerConn, readyMarker, t.logger)
+
+	if _, err := io.WriteString(innerConn.Stdin(), t.attachCmd+"\n"); err != nil {
+		innerConn.Close()
+		return ShellConnResult{Err: errors.Annotatef(err, "writing the %s attach command", t.kind)}
+	}
+
+	initCmd := persistentSessionInitCmd(t.name, readyMarker) + "\n"
+
+	attachTimer := time.NewTimer(t.attachTimeout)
+	defer attachTimer.Stop()
+
+	initTicker := time.NewTicker(persistentSessionInitInterval)
+	defer initTicker.Stop()
+
+	for {
+		if _, err := io.WriteString(innerConn.Stdin(), initCmd); err != nil {
+			// The error will be reported by the reader once the output ends.
+			t.logger.Errorf("Failed to write the init command: %s", err.Error())
+		}
+
+		select {
+		case err := <-conn.readyCh:
+			if err != nil {
+				innerConn.Close()
+				return ShellConnResult{Err: errors.Trace(err)}
+			}
+
+			return ShellConnResult{Conn: conn}
+
+		case <-initTicker.C:
+			t.logger.Verbose3f("The session is not ready yet, resending the init command")
+
+		case <-attachTimer.C:
+			innerConn.Close()
+			return ShellConnResult{
+				Err: classifyErr(ConnErrCategoryNoMarker, errors.Errorf(
+					"timeout waiting for the %s session to get ready after %s", t.kind, t.attachTimeout,
+				)),
+			}
+
+		case <-ctx.Done():
+			innerConn.Close()
+			return ShellConnResult{
+				Err: errors.Annotatef(ctx.Err(), "attaching to the %s session", t.kind),
+			}
+		}
+	}
+}
+
+// persistentSessionConn is the connection to the shell inside the session.
+// The output of the session is the terminal output rendered by the
+// multiplexer, so the terminal control sequences are stripped from it, and the
+// stderr lines are demultiplexed from it; see persistentSessionInitCmd.
+type persistentSessionConn struct {
+	inner ShellConn
+
+	stdoutR *io.PipeReader
+	stderrR *io.PipeReader
+
+	// readyCh receives nil once the session is ready, or an error if the
+	// output has ended before that.
+	readyCh chan error
+
+	// outputDoneCh is closed once the output has ended.
+	outputDoneCh chan struct{}
+}
+
+func newPersistentSessionConn(
+	inner ShellConn, readyMarker string, logger *log.Logger,
+) *persistentSessionConn {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+
+	c := &persistentSessionConn{
+		inner: inner,
+
+		stdoutR: stdoutR,
+		stderrR: stderrR,
+
+		readyCh:      make(chan error, 1),
+		outputDoneCh: make(chan struct{}),
+	}
+
+	// Nothing is supposed to be printed to the stderr of the underlying shell,
+	// since it's replaced with the multiplexer client, so we only log it.
+	go func() {
+		scanner := bufio.NewScanner(inner.Stderr())
+		for scanner.Scan() {
+			logger.Verbose1f("Got stderr line from the underlying shell: %s", scanner.Text())
+		}
+	}()
+
+	go func() {
+		defer close(c.outputDoneCh)
+		defer stdoutW.Close()
+		defer stderrW.Close()
+
+		ready := false
+
+		br := bufio.NewReader(inner.Stdout())
+		for {
+			rawLine, err := br.ReadString('\n')
+			if rawLine != "" {
+				line := stripTerminalControls(strings.TrimSuffix(rawLine, "\n"))
+
+				switch {
+				case ready:
+					w := stdoutW
+					if strings.HasPrefix(line, persistentSessionStderrPrefix) {
+						w = stderrW
+						line = strings.TrimPrefix(line, persistentSessionStderrPrefix)
+					}
+
+					if _, err := io.WriteString(w, line+"\n"); err != nil {
+						return
+					}
+
+				case strings.Contains(line, readyMarker):
+					logger.Verbose3f("The session is ready")
+					ready = true
+					c.readyCh <- nil
+
+				case strings.Contains(line, persistentSessionUnavailableMarker):
+					c.readyCh <- classifyErr(ConnErrCategoryShellNotFound, errors.Errorf(
+						"tmux or screen, as well as script, must be available on the host to use persistent sessions",
+					))
+					return
+
+				default:
+					logger.Verbose3f("Got line while waiting for the session: %q", line)
+				}
+			}
+
+			if err != nil {
+				if !ready {
+					c.readyCh <- errors.Errorf("the output has ended before the session got ready")
+				}
+
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *persistentSessionConn) Stdin() io.Writer  { return c.inner.Stdin() }
+func (c *persistentSessionConn) Stdout() io.Reader { return c.stdoutR }
+func (c *persistentSessionConn) Stderr() io.Reader { return c.stderrR }
+
+// Close ends the session, since it's an intentional disconnect: the session
+// is only supposed to survive the connection drops. If the shell is busy
+// running something, the session ends once it's done.
+func (c *persistentSessionConn) Close() {
+	if _, err := io.WriteString(c.inner.Stdin(), "\nexit\n"); err == nil {
+		// Give the exit a chance to get through, before closing the
+		// connection.
+		select {
+		case <-c.outputDoneCh:
+		case <-time.After(persistentSessionExitTimeout):
+		}
+	}
+
+	c.inner.Close()
+}
+
+// stripTerminalControls removes the terminal control sequences and the
+// control characters (except tabs) from the line printed by a terminal
+// multiplexer. The cursor forward sequences, which the multiplexers use
+// instead of the tabs and runs of spaces, are replaced with the spaces.
+func stripTerminalControls(line string) string {
+	if !strings.ContainsAny(line, "\x1b\r\x07\x08\x7f") {
+		return line
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == '\x1b' && i+1 < len(line):
+			switch line[i+1] {
+			case '[':
+				// CSI: parameters and intermediate bytes, then the final byte.
+				j := i + 2
+				for j < len(line) && (line[j] < 0x40 || line[j] > 0x7e) {
+					j++
+				}
+
+				if j < len(line) && line[j] == 'C' {
+					n, err := strconv.Atoi(line[i+2 : j])
+					if err != nil || n < 1 {
+						n = 1
+					}
+					if n > persistentSessionCols {
+						n = persistentSessionCols
+					}
+
+					sb.WriteString(strings.Repeat(" ", n))
+				}
+
+				i = j
+
+			case ']', 'P', '_', '^':
+				// OSC, DCS and the like: until BEL or ST (ESC \).
+				j := i + 2
+				for j < len(line) && line[j] != '\x07' && !(line[j] == '\x1b' && j+1 < len(line) && line[j+1] == '\\') {
+					j++
+				}
+
+				if j < len(line) && line[j] == '\x1b' {
+					j++
+				}
+
+				i = j
+
+			case '(', ')', '*', '+', '#', '%':
+				// Charset selection and the like: one more byte.
+				i += 2
+
+			default:
+				i++
+			}
+
+		case c == '\t':
+			sb.WriteByte(c)
+
+		case c < 0x20 || c == 0x7f:
+			// Skip the rest of the control characters.
+
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistentSessionAttachCmd(t *testing.T) {
+	assert.Equal(t,
+		`if command -v tmux >/dev/null 2>&1 && command -v script >/dev/null 2>&1; then `+
+			`exec script -qfc 'TERM=xterm; export TERM; stty cols 9999 rows 50 -echo; exec tmux new-session -A -D -s nerdlog_test_web-01 /bin/sh' /dev/null; `+
+			`fi; echo __NERDLOG_SESSI""ON_UNAVAILABLE__`,
+		persistentSessionAttachCmd(PersistentSessionTmux, persistentSessionName("test", "web-01")),
+	)
+
+	assert.Contains(t,
+		persistentSessionAttachCmd(PersistentSessionScreen, "nerdlog_test_web-01"),
+		`exec screen -q -D -RR -S nerdlog_test_web-01 /bin/sh`,
+	)
+
+	assert.Equal(t, "nerdlog_alice_web_01_example_com", persistentSessionName("alice", "web/01.example.com"))
+
+	// The echoed init command doesn't contain the ready marker.
+	marker := persistentSessionReadyMarkerPrefix + "123__"
+	initCmd := persistentSessionInitCmd("nerdlog_test_web-01", marker)
+	assert.NotContains(t, initCmd, marker)
+	assert.Contains(t, initCmd, `tmux set-option status off`)
+}
+
+func TestStripTerminalControls(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{"plain line\twith tab", "plain line\twith tab"},
+		{"foo\r", "foo"},
+		{"\x1b[K\x1b[?12l\x1b[?25h\x1b[2d__marker__\r", "__marker__"},
+		{"a\x1b[7Cb\x1b[Cc", "a       b c"},
+		{"\x1b(B\x1b[m\x1b[30m\x1b[42mcolored\x1b(B\x1b[m", "colored"},
+		{"\x1b]0;window title\x07after\x1b]2;title\x1b\\end", "afterend"},
+		{"\x1b=\x1b>keypad\x1b", "keypad"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, stripTerminalControls(tc.in), "%q", tc.in)
+	}
+}
+
+// connectPersistentSession connects using the given transport, and fails the
+// test on errors.
+func connectPersistentSession(t *testing.T, transport ShellTransport) ShellConn {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	resCh := make(chan ShellConnUpdate, 8)
+	transport.Connect(ctx, resCh)
+
+	for upd := range resCh {
+		if upd.Result == nil {
+			continue
+		}
+
+		if upd.Result.Err != nil {
+			t.Fatalf("connecting: %s", upd.Result.Err)
+		}
+
+		return upd.Result.Conn
+	}
+
+	return nil
+}
+
+// readLineAsync starts reading the next line from r, and returns the channel
+// which receives it, without the trailing newline. Since stdout and stderr of
+// the session are demultiplexed from the same output, they must be read
+// concurrently.
+func readLineAsync(r *bufio.Reader) <-chan string {
+	lineCh := make(chan string, 1)
+	go func() {
+		line, _ := r.ReadString('\n')
+		lineCh <- strings.TrimSuffix(line, "\n")
+	}()
+
+	return lineCh
+}
+
+// readLineTimeout waits for the line from the channel returned by
+// readLineAsync.
+func readLineTimeout(t *testing.T, lineCh <-chan string) string {
+	select {
+	case line := <-lineCh:
+		return line
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout reading line")
+		return ""
+	}
+}
+
+func TestPersistentSessionTransportNoise(t *testing.T) {
+	transport := newPersistentSessionTransport(
+		NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
+			ShellCommand: LocalShellCommand,
+		}),
+		PersistentSessionScreen, "nerdlog_test_noise", nil,
+	)
+
+	// Instead of the actual multiplexer, print the same kind of noise which
+	// tmux prints: the terminal control sequences, the echoed input, and the
+	// stale ready marker from a previous connection, redrawn on reattaching;
+	// then run a shell pretending to be inside a screen session.
+	transport.attachCmd = `printf '\033[?1049h\033[H\033[2J# if [ -n "$TMUX$STY" ]; then echo __NERDLOG_SESSION_""READY_1__; fi\033[512X\033[K\r\n` +
+		`\033[K\r\n\033[?25h\033[2d__NERDLOG_SESSION_READY_1__\r\n\033[30m\033[42m[nerdlog_test_noise] 0:sh*\033(B\033[m\r\n'; ` +
+		`STY=fake; export STY; TMPDIR=` + shellQuote(t.TempDir()) + `; export TMPDIR; exec /bin/sh`
+
+	conn := connectPersistentSession(t, transport)
+	defer conn.Close()
+
+	stdout := bufio.NewReader(conn.Stdout())
+	stderrLineCh := readLineAsync(bufio.NewReader(conn.Stderr()))
+
+	_, err := io.WriteString(conn.Stdin(), "echo foo; echo bar 1>&2; echo baz\n")
+	assert.NoError(t, err)
+
+	// The ready marker might be printed more than once, if the init command
+	// was resent.
+	line := readLineTimeout(t, readLineAsync(stdout))
+	for strings.HasPrefix(line, persistentSessionReadyMarkerPrefix) {
+		line = readLineTimeout(t, readLineAsync(stdout))
+	}
+
+	assert.Equal(t, "foo", line)
+	assert.Equal(t, "baz", readLineTimeout(t, readLineAsync(stdout)))
+	assert.Equal(t, "bar", readLineTimeout(t, stderrLineCh))
+}
+
+func TestPersistentSessionTransportUnavailable(t *testing.T) {
+	transport := newPersistentSessionTransport(
+		NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
+			ShellCommand: LocalShellCommand,
+		}),
+		PersistentSessionTmux, "nerdlog_test_unavailable", nil,
+	)
+	transport.attachCmd = `echo __NERDLOG_SESSION""_UNAVAILABLE__`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resCh := make(chan ShellConnUpdate, 8)
+	transport.Connect(ctx, resCh)
+
+	for upd := range resCh {
+		if upd.Result != nil {
+			assert.ErrorIs(t, upd.Result.Err, ErrShellNotFound)
+			assert.Contains(t, upd.Result.Err.Error(), "must be available on the host")
+			return
+		}
+	}
+}
+
+func TestPersistentSessionTransportTmux(t *testing.T) {
+	for _, bin := range []string{"tmux", "script"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("no %s", bin)
+		}
+	}
+
+	name := persistentSessionName("test", t.Name())
+	defer exec.Command("tmux", "kill-session", "-t", name).Run()
+
+	newTransport := func() ShellTransport {
+		return newPersistentSessionTransport(
+			NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
+				ShellCommand: LocalShellCommand,
+			}),
+			PersistentSessionTmux, name, nil,
+		)
+	}
+
+	conn := connectPersistentSession(t, newTransport())
+	stdout := bufio.NewReader(conn.Stdout())
+	stderrLineCh := readLineAsync(bufio.NewReader(conn.Stderr()))
+
+	_, err := io.WriteString(conn.Stdin(), "nlvar=42; printf 'a\\tb\\n'; echo bar 1>&2\n")
+	assert.NoError(t, err)
+
+	// The tabs are rendered as spaces.
+	assert.Equal(t, "a       b", readLineTimeout(t, readLineAsync(stdout)))
+	assert.Equal(t, "bar", readLineTimeout(t, stderrLineCh))
+
+	// Drop the connection without ending the session, and reconnect: the
+	// shell inside the session is still the same.
+	conn.(*persistentSessionConn).inner.Close()
+
+	conn = connectPersistentSession(t, newTransport())
+	stdout = bufio.NewReader(conn.Stdout())
+
+	_, err = io.WriteString(conn.Stdin(), "echo nlvar=$nlvar\n")
+	assert.NoError(t, err)
+
+	line := readLineTimeout(t, readLineAsync(stdout))
+	for strings.HasPrefix(line, persistentSessionReadyMarkerPrefix) {
+		line = readLineTimeout(t, readLineAsync(stdout))
+	}
+	assert.Equal(t, "nlvar=42", line)
+
+	// Intentional disconnect ends the session.
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return exec.Command("tmux", "has-session", "-t", name).Run() != nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// AggregatePartial contains the aggregates of the matching logs from a single
+// logstream, or from a few of them merged together: the number of messages
+// per minute (which is what the histogram is built from), and the counts per
+// group if the logs are grouped (see QueryLogsParams.GroupBy).
+//
+// The agent computes these aggregates on the host, so no matter how many log
+// lines match, only the counts are sent over the wire (and with
+// QueryLogsParams.AggregateOnly, nothing else is sent); the partials from all
+// the logstreams are then merged on the client with Merge.
+type AggregatePartial struct {
+	// MinuteStats maps the unix timestamp (in seconds) of every minute to the
+	// stats for this minute.
+	MinuteStats map[int64]MinuteStatsItem
+
+	// NumMsgs is the total number of messages in MinuteStats.
+	NumMsgs int
+
+	// Groups maps the values of the QueryLogsParams.GroupBy field to the
+	// number of log lines having them; nil if the logs aren't grouped.
+	Groups map[string]int
+}
+
+// newAggregatePartial returns the partial with the given minute stats, and
+// the NumMsgs calculated from them.
+func newAggregatePartial(minuteStats map[int64]MinuteStatsItem, groups map[string]int) AggregatePartial {
+	p := AggregatePartial{
+		MinuteStats: minuteStats,
+		Groups:      groups,
+	}
+
+	for _, v := range minuteStats {
+		p.NumMsgs += v.NumMsgs
+	}
+
+	return p
+}
+
+// AggregatePartial returns the aggregates from the response.
+func (r *LogResp) AggregatePartial() AggregatePartial {
+	return newAggregatePartial(r.MinuteStats, r.Groups)
+}
+
+// Merge adds the counts from the other partial to this one; the other one is
+// not modified. The merge is associative and commutative: the result doesn't
+// depend on the order in which the partials from different logstreams are
+// merged, or on how they are grouped. The Groups are nil after merging only
+// if they're nil in both partials.
+func (p *AggregatePartial) Merge(other AggregatePartial) {
+	if p.MinuteStats == nil {
+		p.MinuteStats = make(map[int64]MinuteStatsItem, len(other.MinuteStats))
+	}
+
+	for k, v := range other.MinuteStats {
+		p.MinuteStats[k] = MinuteStatsItem{
+			NumMsgs: p.MinuteStats[k].NumMsgs + v.NumMsgs,
+		}
+	}
+
+	p.NumMsgs += other.NumMsgs
+
+	if other.Groups != nil {
+		if p.Groups == nil {
+			p.Groups = make(map[string]int, len(other.Groups))
+		}
+
+		addGroups(p.Groups, other.Groups)
+	}
+}
+
+// aggregateLogs aggregates the given log messages on the client, the same way
+// the agent does it on the host: it's used for the logstreams whose agents
+// don't aggregate the logs themselves, like the custom agents which only print
+// the log lines. If groupBy is nil, the logs aren't grouped.
+func aggregateLogs(logs []LogMsg, groupBy *ProjectionField) AggregatePartial {
+	p := AggregatePartial{
+		MinuteStats: map[int64]MinuteStatsItem{},
+	}
+
+	if groupBy != nil {
+		p.Groups = map[string]int{}
+	}
+
+	for _, msg := range logs {
+		key := msg.Time.Truncate(time.Minute).Unix()
+		p.MinuteStats[key] = MinuteStatsItem{
+			NumMsgs: p.MinuteStats[key].NumMsgs + 1,
+		}
+		p.NumMsgs++
+
+		if groupBy == nil {
+			continue
+		}
+
+		// Like on the host, the lines without the field aren't counted.
+		if v := groupValue(*groupBy, msg); v != "" {
+			p.Groups[v]++
+		}
+	}
+
+	return p
+}
+
+// groupValue returns the value of the field in the log message, or an empty
+// string if there's no such field; it's the Go counterpart of the awk code
+// generated by CompileGroupByToAWK.
+func groupValue(f ProjectionField, msg LogMsg) string {
+	if f.Kind != ProjectionFieldKeyValue {
+		return msg.Context[f.ContextKey()]
+	}
+
+	line := msg.OrigLine
+	if line == "" {
+		line = msg.Msg
+	}
+
+	key := regexp.QuoteMeta(f.Name)
+	re := regexp.MustCompile(fmt.Sprintf(
+		`(^|[^A-Za-z0-9_.-])%s=("([^"]*)"|([^ \t"]+))|"%s": *("([^"]*)"|([^ \t",}]+))`,
+		key, key,
+	))
+
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+
+	return m[3] + m[4] + m[6] + m[7]
+}
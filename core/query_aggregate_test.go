@@ -0,0 +1,235 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregatePartialMerge(t *testing.T) {
+	newPartial := func(stats map[int64]int, groups map[string]int) AggregatePartial {
+		minuteStats := map[int64]MinuteStatsItem{}
+		for k, v := range stats {
+			minuteStats[k] = MinuteStatsItem{NumMsgs: v}
+		}
+		return newAggregatePartial(minuteStats, groups)
+	}
+
+	a := newPartial(map[int64]int{60: 1, 120: 2}, map[string]int{"foo": 3})
+	b := newPartial(map[int64]int{120: 5}, map[string]int{"foo": 1, "bar": 4})
+	c := newPartial(map[int64]int{180: 7}, map[string]int{"baz": 7})
+
+	want := newPartial(
+		map[int64]int{60: 1, 120: 7, 180: 7},
+		map[string]int{"foo": 4, "bar": 4, "baz": 7},
+	)
+	assert.Equal(t, 15, want.NumMsgs)
+
+	merge := func(ps ...AggregatePartial) AggregatePartial {
+		var ret AggregatePartial
+		for _, p := range ps {
+			ret.Merge(p)
+		}
+		return ret
+	}
+
+	assert.Equal(t, want, merge(a, b, c))
+	assert.Equal(t, want, merge(c, b, a))
+	assert.Equal(t, want, merge(b, merge(c, a)))
+	assert.Equal(t, want, merge(merge(a, b), c))
+
+	// The merged partials are not modified.
+	assert.Equal(t, newPartial(map[int64]int{60: 1, 120: 2}, map[string]int{"foo": 3}), a)
+
+	// If none of the partials are grouped, neither is the result.
+	assert.Nil(t, merge(newPartial(map[int64]int{60: 1}, nil), newPartial(nil, nil)).Groups)
+}
+
+func TestGroupValue(t *testing.T) {
+	msg := LogMsg{
+		Msg:      "ignored",
+		OrigLine: `2025-03-10T10:00:01Z myhost myapp[123]: x.ip=1.1.1.1 ip=10.0.0.1 user="john doe" {"code": 404, "path": "/a b"}`,
+		Context: map[string]string{
+			"hostname": "myhost",
+			"program":  "myapp",
+			"pid":      "123",
+		},
+	}
+
+	for _, tc := range []struct {
+		field string
+		want  string
+	}{
+		{"hostname", "myhost"},
+		{"program", "myapp"},
+		{"pid", "123"},
+		{"field:ip", "10.0.0.1"},
+		{"field:user", "john doe"},
+		{"field:code", "404"},
+		{"field:path", "/a b"},
+		{"field:nope", ""},
+	} {
+		f, err := ParseGroupBy(tc.field)
+		if !assert.NoError(t, err, tc.field) {
+			continue
+		}
+		assert.Equal(t, tc.want, groupValue(*f, msg), tc.field)
+	}
+}
+
+// TestAggregateOnlyQuery checks that the aggregates computed by the agents on
+// the hosts, and merged on the client, match the ones aggregated on the client
+// from the raw log lines, no matter in which order the partials are merged.
+func TestAggregateOnlyQuery(t *testing.T) {
+	dir := t.TempDir()
+	from := localhostTestFrom()
+
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, localhostTestLogLine(
+			from.Add(time.Duration(i)*13*time.Second),
+			fmt.Sprintf("myhost app%d[%d]: req status=%d", i%3, 100+i%7, 200+i%4*100),
+		))
+	}
+
+	// The logs are split between two logstreams unevenly.
+	logs := map[string][]string{
+		"host-a": lines[:130],
+		"host-b": lines[130:],
+	}
+
+	configLogStreams := ConfigLogStreams{}
+	for name, hostLines := range logs {
+		logPath := filepath.Join(dir, name+".log")
+		appendLocalhostTestLog(t, logPath, hostLines...)
+		configLogStreams[name] = localhostTestLogStream(logPath)
+	}
+
+	n := newLocalhostTestNerdlog(t, "query_aggregate_test", configLogStreams)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	for _, groupByStr := range []string{"program", "pid"} {
+		groupBy, err := ParseGroupBy(groupByStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params := QueryLogsParams{
+			From:          from,
+			To:            from.Add(time.Hour),
+			Query:         "/status=[24]00/",
+			QueryLang:     QueryLangFilter,
+			GroupBy:       groupByStr,
+			AggregateOnly: true,
+		}
+
+		aggResp, err := n.Query(ctx, params)
+		if !assert.NoError(t, err, groupByStr) {
+			continue
+		}
+		assert.Empty(t, aggResp.Logs, groupByStr)
+
+		// Now get all the raw lines, to aggregate them on the client.
+		params.AggregateOnly = false
+		params.MaxNumLines = len(lines)
+
+		rawResp, err := n.Query(ctx, params)
+		if !assert.NoError(t, err, groupByStr) {
+			continue
+		}
+
+		perLStream := map[string][]LogMsg{}
+		for _, msg := range rawResp.Logs {
+			perLStream[msg.Context["lstream"]] = append(perLStream[msg.Context["lstream"]], msg)
+		}
+
+		a := aggregateLogs(perLStream["host-a"], groupBy)
+		b := aggregateLogs(perLStream["host-b"], groupBy)
+
+		// The host-side aggregates match the client-side ones per logstream.
+		assert.Equal(t, a.MinuteStats, aggResp.MinuteStatsByLStream["host-a"], groupByStr)
+		assert.Equal(t, b.MinuteStats, aggResp.MinuteStatsByLStream["host-b"], groupByStr)
+
+		for _, total := range []AggregatePartial{
+			mergeTestPartials(a, b),
+			mergeTestPartials(b, a),
+			aggregateLogs(rawResp.Logs, groupBy),
+		} {
+			assert.Equal(t, total.MinuteStats, aggResp.MinuteStats, groupByStr)
+			assert.Equal(t, total.NumMsgs, aggResp.NumMsgsTotal, groupByStr)
+			assert.Equal(t, sortedGroups(total.Groups), aggResp.Groups, groupByStr)
+		}
+
+		assert.Equal(t, rawResp.MinuteStats, aggResp.MinuteStats, groupByStr)
+		assert.Equal(t, rawResp.Groups, aggResp.Groups, groupByStr)
+	}
+
+	// Loading more logs makes no sense without the logs.
+	_, err := n.Query(ctx, QueryLogsParams{
+		LoadEarlier:   true,
+		AggregateOnly: true,
+	})
+	assert.Error(t, err)
+}
+
+func mergeTestPartials(ps ...AggregatePartial) AggregatePartial {
+	var ret AggregatePartial
+	for _, p := range ps {
+		ret.Merge(p)
+	}
+	return ret
+}
+
+// TestAggregateOnlyCustomAgent checks that the logs from the custom agents,
+// which only print the lines, are aggregated on the client.
+func TestAggregateOnlyCustomAgent(t *testing.T) {
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					CustomAgent: `cat <<'LOGS' | awk '{ print "m:" NR ":" $0 }'
+2025-03-10T10:00:01.000000+00:00 myhost foo[1]: ip=10.0.0.1
+2025-03-10T10:00:02.000000+00:00 myhost bar[2]: ip=10.0.0.2
+2025-03-10T10:01:03.000000+00:00 myhost foo[1]: ip=10.0.0.1
+LOGS
+`,
+				},
+			},
+		},
+		ClientID: "query_aggregate_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:          time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		To:            time.Date(2025, 3, 10, 11, 0, 0, 0, time.UTC),
+		GroupBy:       "field:ip",
+		AggregateOnly: true,
+		MaxNumLines:   10,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Empty(t, resp.Logs)
+	assert.Empty(t, resp.Warnings)
+	assert.Equal(t, 3, resp.NumMsgsTotal)
+	assert.Equal(t, []Group{
+		{Value: "10.0.0.1", Count: 2},
+		{Value: "10.0.0.2", Count: 1},
+	}, resp.Groups)
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+)
+
+const (
+	// DefaultQueryCacheTTL is how long the cached query results are used.
+	DefaultQueryCacheTTL = 24 * time.Hour
+
+	// DefaultQueryCacheMaxSize is the default max total size of the cached
+	// query results, in bytes.
+	DefaultQueryCacheMaxSize = 100 * 1024 * 1024
+)
+
+// QueryCacheMinAge is how far in the past the end of the time range must be
+// for the query results to be cached: the logs for the more recent times
+// might still be coming (e.g. buffered by the apps or by the log shippers),
+// so these queries are always run on the hosts.
+const QueryCacheMinAge = 10 * time.Minute
+
+// queryCacheFileExt is the extension of the cache entry files.
+const queryCacheFileExt = ".json"
+
+// QueryCache stores the query results of every logstream on disk, typically
+// in ~/.cache/nerdlog/queries, so that re-running the same query over the
+// same historical time range doesn't query the hosts again. Only the time
+// ranges which are entirely in the past (see QueryCacheMinAge) are cached,
+// since the logs there don't change anymore. It's shared between all the
+// LStreamClients, and is safe for concurrent use.
+type QueryCache struct {
+	params QueryCacheParams
+
+	mtx sync.Mutex
+}
+
+type QueryCacheParams struct {
+	// Dir is the directory to store the cached results in, one file per
+	// query and logstream. It's created as needed.
+	Dir string
+
+	// MaxSize is the max total size of the cached results, in bytes; once
+	// it's exceeded, the oldest results are removed. If zero,
+	// DefaultQueryCacheMaxSize is used.
+	MaxSize int64
+
+	// TTL is how long the cached results are valid. If zero,
+	// DefaultQueryCacheTTL is used.
+	TTL time.Duration
+
+	Clock clock.Clock
+}
+
+// queryCacheEntry is stored in the cache file.
+type queryCacheEntry struct {
+	// Key is the full key, to make sure that the file (whose name is the hash
+	// of the key) is for the right query.
+	Key string `json:"key"`
+
+	StoredAt time.Time `json:"stored_at"`
+
+	Resp *LogResp `json:"resp"`
+}
+
+func NewQueryCache(params QueryCacheParams) *QueryCache {
+	if params.Clock == nil {
+		panic("Clock is nil")
+	}
+
+	if params.MaxSize == 0 {
+		params.MaxSize = DefaultQueryCacheMaxSize
+	}
+
+	if params.TTL == 0 {
+		params.TTL = DefaultQueryCacheTTL
+	}
+
+	return &QueryCache{
+		params: params,
+	}
+}
+
+// Get returns the cached response for the given key, if any, and if it
+// hasn't expired yet. Every call returns a separate copy of the response.
+func (qc *QueryCache) Get(key string) (*LogResp, bool) {
+	qc.mtx.Lock()
+	defer qc.mtx.Unlock()
+
+	path := qc.entryPath(key)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var entry queryCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key || entry.Resp == nil {
+		// A broken entry is not a big deal: we'll just query the hosts and
+		// overwrite it.
+		return nil, false
+	}
+
+	age := qc.params.Clock.Now().Sub(entry.StoredAt)
+	if age < 0 || age >= qc.params.TTL {
+		os.Remove(path)
+		return nil, false
+	}
+
+	return entry.Resp, true
+}
+
+// Set stores the response for the given key, and removes the oldest entries
+// if the cache has grown too large.
+func (qc *QueryCache) Set(key string, resp *LogResp) error {
+	qc.mtx.Lock()
+	defer qc.mtx.Unlock()
+
+	data, err := json.Marshal(queryCacheEntry{
+		Key:      key,
+		StoredAt: qc.params.Clock.Now(),
+		Resp:     resp,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if int64(len(data)) > qc.params.MaxSize {
+		// It would evict everything else, and itself too.
+		return nil
+	}
+
+	if err := writeFileAtomic(qc.entryPath(key), data); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(qc.evict())
+}
+
+// evict removes the oldest entries until the total size fits into the
+// MaxSize. The expired entries are removed by Get.
+func (qc *QueryCache) evict() error {
+	files, err := ioutil.ReadDir(qc.params.Dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var entries []os.FileInfo
+	var totalSize int64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), queryCacheFileExt) {
+			continue
+		}
+
+		entries = append(entries, f)
+		totalSize += f.Size()
+	}
+
+	// Newest first.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+
+	for len(entries) > 0 && totalSize > qc.params.MaxSize {
+		oldest := entries[len(entries)-1]
+		entries = entries[:len(entries)-1]
+
+		if err := os.Remove(filepath.Join(qc.params.Dir, oldest.Name())); err != nil {
+			return errors.Trace(err)
+		}
+		totalSize -= oldest.Size()
+	}
+
+	return nil
+}
+
+func (qc *QueryCache) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(qc.params.Dir, fmt.Sprintf("%x%s", sum, queryCacheFileExt))
+}
+
+// queryCacheKey returns the key for the results of the given query on the
+// given logstream; ok is false if the results can't be cached: the time range
+// isn't entirely in the past (see QueryCacheMinAge), or the query is loading
+// more logs relative to the ones we already have (their line numbers might
+// change once the logs are rotated), or the index is being refreshed.
+func queryCacheKey(ls LogStream, q *lstreamCmdQueryLogs, now time.Time) (key string, ok bool) {
+	if q.to.IsZero() || now.Sub(q.to) < QueryCacheMinAge {
+		return "", false
+	}
+
+	// The pinned queries have to run on the host, to capture or check the
+	// pins.
+	if q.linesUntil > 0 || q.timestampUntil != nil || q.refreshIndex || q.pinLast != "" {
+		return "", false
+	}
+
+	lsKey, err := queryCacheLogStreamKey(ls)
+	if err != nil {
+		return "", false
+	}
+
+	parts := []string{
+		capabilitiesCacheKey(ls),
+		"lstream=" + lsKey,
+		"from=" + q.from.UTC().Format(time.RFC3339),
+		"to=" + q.to.UTC().Format(time.RFC3339),
+		"max=" + strconv.Itoa(q.maxNumLines),
+		"query=" + q.query,
+	}
+
+	if q.filter != nil {
+		parts = append(parts, fmt.Sprintf(
+			"filter_opts=%t,%t", q.filterMatchOpts.CaseSensitive, q.filterMatchOpts.WholeWord,
+		))
+	}
+
+	if q.correlation != nil {
+		parts = append(parts, "correlation="+q.correlation.String())
+	}
+
+	if q.projection != nil {
+		parts = append(parts, "select="+q.projection.String())
+	}
+
+	if q.groupBy != nil {
+		parts = append(parts, "group="+q.groupBy.String())
+	}
+
+	if q.sampleRate > 1 {
+		parts = append(parts, "sample="+strconv.Itoa(q.sampleRate))
+	}
+
+	if q.statsBucketMinutes > 1 {
+		parts = append(parts, "stats_bucket="+strconv.Itoa(q.statsBucketMinutes))
+	}
+
+	if q.aggregateOnly {
+		parts = append(parts, "aggregate_only")
+	}
+
+	if len(q.agentEnv) > 0 {
+		envKeys := make([]string, 0, len(q.agentEnv))
+		for k := range q.agentEnv {
+			envKeys = append(envKeys, k)
+		}
+		sort.Strings(envKeys)
+
+		for _, k := range envKeys {
+			parts = append(parts, "env="+k+"="+q.agentEnv[k])
+		}
+	}
+
+	return strings.Join(parts, "\n"), true
+}
+
+// queryCacheLogStreamKey returns the hash of everything in the logstream
+// config which affects the query results, besides what's already in the
+// capabilitiesCacheKey: the name and labels which end up in the messages, and
+// the options which affect the parsing and filtering of the lines (e.g. the
+// level: and label filter terms are compiled from them).
+func queryCacheLogStreamKey(ls LogStream) (string, error) {
+	data, err := json.Marshal(struct {
+		Name      string
+		Sources   []LogSource
+		SourceTag string
+		Archive   *LogStreamArchive
+		Labels    map[string]string
+
+		LevelPatterns  LevelPatterns
+		FieldExtractor *FieldExtractor
+		Multiline      *Multiline
+		JSON           *JSONLogs
+		FilenameDate   *FilenameDate
+	}{
+		Name:      ls.Name,
+		Sources:   ls.Sources,
+		SourceTag: ls.SourceTag,
+		Archive:   ls.Archive,
+		Labels:    ls.Labels,
+
+		LevelPatterns:  ls.Options.LevelPatterns,
+		FieldExtractor: ls.Options.FieldExtractor,
+		Multiline:      ls.Options.Multiline,
+		JSON:           ls.Options.JSON,
+		FilenameDate:   ls.Options.FilenameDate,
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
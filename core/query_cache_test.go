@@ -0,0 +1,256 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCacheKey(t *testing.T) {
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	ls := LogStream{
+		Name:      "localhost",
+		Transport: ConfigLogStreamShellTransport{Localhost: &ConfigLogStreamShellTransportLocalhost{}},
+		LogFiles:  []string{"/var/log/syslog"},
+	}
+
+	past := &lstreamCmdQueryLogs{
+		from:        now.Add(-2 * time.Hour),
+		to:          now.Add(-time.Hour),
+		maxNumLines: 100,
+		query:       "/foo/",
+	}
+
+	key, ok := queryCacheKey(ls, past, now)
+	assert.True(t, ok)
+
+	// Everything which affects the results is in the key.
+	for _, q := range []lstreamCmdQueryLogs{
+		{from: past.from, to: past.to, maxNumLines: 100, query: "/bar/"},
+		{from: past.from, to: past.to, maxNumLines: 200, query: "/foo/"},
+		{from: past.from.Add(time.Minute), to: past.to, maxNumLines: 100, query: "/foo/"},
+		{from: past.from, to: past.to, maxNumLines: 100, query: "/foo/", sampleRate: 10},
+		{from: past.from, to: past.to, maxNumLines: 100, query: "/foo/", agentEnv: map[string]string{"DB": "orders"}},
+	} {
+		otherKey, ok := queryCacheKey(ls, &q, now)
+		assert.True(t, ok)
+		assert.NotEqual(t, key, otherKey)
+	}
+
+	otherLS := ls
+	otherLS.LogFiles = []string{"/var/log/messages"}
+	otherKey, _ := queryCacheKey(otherLS, past, now)
+	assert.NotEqual(t, key, otherKey)
+
+	// And so is everything in the logstream config which affects the
+	// parsing or filtering of the lines.
+	for i, modify := range []func(ls *LogStream){
+		func(ls *LogStream) { ls.Labels = map[string]string{"env": "prod"} },
+		func(ls *LogStream) { ls.Options.LevelPatterns = LevelPatterns{LogLevelError: "ERR"} },
+		func(ls *LogStream) {
+			ls.Options.FieldExtractor = &FieldExtractor{Separator: ";"}
+		},
+		func(ls *LogStream) { ls.Options.Multiline = &Multiline{} },
+		func(ls *LogStream) { ls.Options.JSON = &JSONLogs{MessageField: "msg"} },
+		func(ls *LogStream) {
+			ls.Options.FilenameDate = &FilenameDate{Year: 2025, Month: time.March, Day: 10}
+		},
+	} {
+		otherLS := ls
+		modify(&otherLS)
+
+		otherKey, ok := queryCacheKey(otherLS, past, now)
+		assert.True(t, ok)
+		assert.NotEqual(t, key, otherKey, "modification #%d", i)
+	}
+
+	// The ranges which are not entirely in the past, and the queries
+	// relative to the logs we already have, are not cached.
+	for _, q := range []lstreamCmdQueryLogs{
+		{from: past.from},
+		{from: past.from, to: now.Add(-time.Minute)},
+		{from: past.from, to: past.to, linesUntil: 1000},
+		{from: past.from, to: past.to, timestampUntil: &timeAndNumMsgs{time: past.to}},
+		{from: past.from, to: past.to, refreshIndex: true},
+	} {
+		_, ok := queryCacheKey(ls, &q, now)
+		assert.False(t, ok, "%+v", q)
+	}
+}
+
+func TestQueryCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	resp := &LogResp{
+		Logs:         []LogMsg{{Msg: strings.Repeat("x", 300)}},
+		NumMsgsTotal: 1,
+	}
+
+	// Find out the size of a single entry, and make room for two of them.
+	probe := NewQueryCache(QueryCacheParams{Dir: filepath.Join(dir, "probe"), Clock: clock.New()})
+	assert.NoError(t, probe.Set("a", resp))
+	entrySize := fileSize(t, probe.entryPath("a"))
+
+	qc := NewQueryCache(QueryCacheParams{
+		Dir:     filepath.Join(dir, "cache"),
+		MaxSize: entrySize*2 + entrySize/2,
+		Clock:   clock.New(),
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, qc.Set(key, resp))
+
+		// Make sure the files have different mtimes.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the latest two fit.
+	_, ok := qc.Get("a")
+	assert.False(t, ok)
+
+	for _, key := range []string{"b", "c"} {
+		cached, ok := qc.Get(key)
+		if assert.True(t, ok, key) {
+			assert.Equal(t, resp.Logs[0].Msg, cached.Logs[0].Msg)
+		}
+	}
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	mockClock := clock.NewMock()
+	mockClock.Set(time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	qc := NewQueryCache(QueryCacheParams{
+		Dir:   t.TempDir(),
+		TTL:   time.Hour,
+		Clock: mockClock,
+	})
+
+	assert.NoError(t, qc.Set("a", &LogResp{NumMsgsTotal: 1}))
+
+	mockClock.Add(59 * time.Minute)
+	_, ok := qc.Get("a")
+	assert.True(t, ok)
+
+	mockClock.Add(time.Minute)
+	_, ok = qc.Get("a")
+	assert.False(t, ok)
+
+	// The expired entry is removed.
+	_, err := os.Stat(qc.entryPath("a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fi.Size()
+}
+
+func TestQueryCacheQuery(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+
+	// The past logs are in the rotated file, and the recent ones are in the
+	// current file.
+	logPath := filepath.Join(dir, "app.log")
+	prevLogPath := logPath + ".1"
+
+	writeLogs := func(path string, msgs []string, modTime time.Time) {
+		data := strings.Join(msgs, "\n") + "\n"
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pastLine := func(sec int, msg string) string {
+		ts := time.Date(2025, 3, 10, 10, 0, sec, 0, time.UTC)
+		return ts.Format("2006-01-02T15:04:05.000000-07:00") + " myhost myapp[123]: " + msg
+	}
+
+	recentTime := now.Add(-5 * time.Minute).Truncate(time.Minute)
+	recentLine := func(sec int, msg string) string {
+		ts := recentTime.Add(time.Duration(sec) * time.Second)
+		return ts.Format("2006-01-02T15:04:05.000000-07:00") + " myhost myapp[123]: " + msg
+	}
+
+	writeLogs(prevLogPath, []string{pastLine(0, "past foo")}, now.Add(-2*time.Hour))
+	writeLogs(logPath, []string{recentLine(0, "recent foo")}, now)
+
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				LogFiles: []string{logPath, prevLogPath},
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+				},
+			},
+		},
+		QueryCache: NewQueryCache(QueryCacheParams{
+			Dir:   filepath.Join(dir, "cache"),
+			Clock: clock.New(),
+		}),
+		ClientID: "query_cache_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	getMsgs := func(params QueryLogsParams) []string {
+		params.MaxNumLines = 10
+
+		resp, err := n.Query(ctx, params)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+
+		var msgs []string
+		for _, msg := range resp.Logs {
+			msgs = append(msgs, msg.Msg)
+		}
+
+		return msgs
+	}
+
+	pastParams := QueryLogsParams{
+		From: time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		To:   time.Date(2025, 3, 10, 11, 0, 0, 0, time.UTC),
+	}
+	recentParams := QueryLogsParams{
+		From: now.Add(-time.Hour),
+	}
+
+	assert.Equal(t, []string{"past foo"}, getMsgs(pastParams))
+	assert.Equal(t, []string{"recent foo"}, getMsgs(recentParams))
+
+	// The logs change, but the past range is served from the cache, while the
+	// now-anchored one is queried again.
+	writeLogs(prevLogPath, []string{pastLine(0, "past bar")}, now.Add(-time.Hour))
+	writeLogs(logPath, []string{recentLine(0, "recent foo"), recentLine(1, "recent bar")}, now)
+
+	assert.Equal(t, []string{"past foo"}, getMsgs(pastParams))
+	assert.Equal(t, []string{"recent foo", "recent bar"}, getMsgs(recentParams))
+
+	// A different query over the same past range is not cached yet.
+	pastParams.Query = "/bar/"
+	assert.Equal(t, []string{"past bar"}, getMsgs(pastParams))
+}
@@ -0,0 +1,252 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// DefaultCorrelateMinLStreams is a default for
+	// CorrelateParams.MinLStreams.
+	DefaultCorrelateMinLStreams = 2
+
+	// DefaultCorrelateMaxValues is a default for CorrelateParams.MaxValues.
+	DefaultCorrelateMaxValues = 100
+)
+
+// parseCorrelation returns the filter expression matching the lines whose
+// field key has one of the given values (see QueryLogsParams.CorrelateKey),
+// or nil if the key is empty.
+func parseCorrelation(key string, values []string) (FilterExpr, error) {
+	if key == "" {
+		if len(values) > 0 {
+			return nil, errors.Errorf("correlation values are given, but there is no key")
+		}
+
+		return nil, nil
+	}
+
+	for i := 0; i < len(key); i++ {
+		if !isFilterFieldChar(key[i], i == 0) {
+			return nil, errors.Errorf("invalid correlation key %q", key)
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, errors.Errorf("no values to correlate by %s", key)
+	}
+
+	var expr FilterExpr
+	for _, value := range values {
+		if value == "" {
+			return nil, errors.Errorf("empty value to correlate by %s", key)
+		}
+
+		term := &FilterTerm{Field: key, Value: value}
+		if expr == nil {
+			expr = term
+		} else {
+			expr = &FilterOr{Left: expr, Right: term}
+		}
+	}
+
+	return expr, nil
+}
+
+// correlatedQuery returns the awk condition which matches the lines matching
+// both the query (which is already an awk condition, possibly empty) and the
+// correlation (which can be nil).
+func correlatedQuery(query string, correlation FilterExpr, fieldsCfg FilterFieldsConfig) string {
+	if correlation == nil {
+		return query
+	}
+
+	// The values are matched exactly, regardless of the options of the query.
+	cond := CompileFilterQueryToAWK(correlation, fieldsCfg, DefaultFilterMatchOpts)
+	if query == "" {
+		return cond
+	}
+
+	return fmt.Sprintf("(%s) && %s", query, cond)
+}
+
+// CorrelateParams are the params for Nerdlog.Correlate.
+type CorrelateParams struct {
+	// Query is the query to correlate the logs of, which defines the time
+	// window, and optionally narrows down the lines. Its CorrelateKey and
+	// CorrelateValues must be empty, and it can't load more logs or resume.
+	Query QueryLogsParams
+
+	// Key is the field to correlate the logs by, like "request_id"; it's
+	// looked up the same way as a field in the filter language.
+	Key string
+
+	// MinLStreams is on how many logstreams a value must appear to be
+	// correlated. If zero, DefaultCorrelateMinLStreams is used.
+	MinLStreams int
+
+	// MaxValues is how many values are correlated at most: the ones appearing
+	// on more logstreams go first, then the more frequent ones. If zero,
+	// DefaultCorrelateMaxValues is used.
+	MaxValues int
+}
+
+// Correlation is the result of Nerdlog.Correlate.
+type Correlation struct {
+	// Values are the values of the key which appear on at least
+	// CorrelateParams.MinLStreams logstreams, in the order described in
+	// CorrelateParams.MaxValues.
+	Values []string
+
+	// Resp contains the log lines having any of the Values, merged from all
+	// the logstreams and ordered by time, as usual; nil if there are no
+	// Values.
+	Resp *LogRespTotal
+}
+
+// Correlate finds the values of the key field which appear on multiple
+// logstreams within the query time window, like the request ids of the
+// requests which went through several services, and returns the log lines
+// having these values. It runs two queries: the first one only counts the
+// lines by the values of the key on every logstream (see
+// QueryLogsParams.GroupBy), and the second one gets the lines with the chosen
+// values (see QueryLogsParams.CorrelateKey). To get the lines with the known
+// value instead, just use Query with the CorrelateKey and CorrelateValues.
+//
+// Like with GroupBy, the logstreams with a custom agent or the transports
+// which only emulate the agent don't count the values, so their values are
+// only correlated if they also appear on the other logstreams.
+func (n *Nerdlog) Correlate(ctx context.Context, params CorrelateParams) (*Correlation, error) {
+	if err := validateCorrelateParams(&params); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	countQuery := params.Query
+	countQuery.GroupBy = fmt.Sprintf("%s:%s", ProjectionFieldKeyValue, params.Key)
+	countQuery.AggregateOnly = true
+
+	countResp, err := n.Query(ctx, countQuery)
+	if err != nil {
+		return nil, errors.Annotatef(err, "counting the values of %s", params.Key)
+	}
+
+	values := correlatedValues(countResp.GroupsByLStream, params.MinLStreams, params.MaxValues)
+	if len(values) == 0 {
+		return &Correlation{}, nil
+	}
+
+	query := params.Query
+	query.CorrelateKey = params.Key
+	query.CorrelateValues = values
+
+	resp, err := n.Query(ctx, query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &Correlation{
+		Values: values,
+		Resp:   resp,
+	}, nil
+}
+
+// validateCorrelateParams checks the params and sets the defaults.
+func validateCorrelateParams(params *CorrelateParams) error {
+	q := params.Query
+	if q.CorrelateKey != "" || len(q.CorrelateValues) > 0 {
+		return errors.Errorf("the query to correlate can't have its own correlation key")
+	}
+
+	if q.LoadEarlier || q.LoadNewer || q.ResumeToken != nil {
+		return errors.Errorf("loading more logs or resuming is not supported for correlation")
+	}
+
+	if q.GroupBy != "" || q.AggregateOnly {
+		return errors.Errorf("the query to correlate can't be grouped or aggregate-only")
+	}
+
+	if _, err := parseCorrelation(params.Key, []string{"-"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	if params.MinLStreams == 0 {
+		params.MinLStreams = DefaultCorrelateMinLStreams
+	}
+
+	if params.MinLStreams < 0 {
+		return errors.Errorf("invalid min number of logstreams %d", params.MinLStreams)
+	}
+
+	if params.MaxValues == 0 {
+		params.MaxValues = DefaultCorrelateMaxValues
+	}
+
+	if params.MaxValues < 0 {
+		return errors.Errorf("invalid max number of values %d", params.MaxValues)
+	}
+
+	return nil
+}
+
+// correlatedValues returns the values which appear in the groups of at least
+// minLStreams logstreams, at most maxValues of them: the ones appearing on
+// more logstreams first, then the ones with the larger total count, then
+// alphabetically.
+func correlatedValues(groupsByLStream map[string]map[string]int, minLStreams, maxValues int) []string {
+	type valueStats struct {
+		value       string
+		numLStreams int
+		count       int
+	}
+
+	statsByValue := map[string]*valueStats{}
+	for _, groups := range groupsByLStream {
+		for value, count := range groups {
+			if value == "" {
+				continue
+			}
+
+			vs, ok := statsByValue[value]
+			if !ok {
+				vs = &valueStats{value: value}
+				statsByValue[value] = vs
+			}
+
+			vs.numLStreams++
+			vs.count += count
+		}
+	}
+
+	var stats []*valueStats
+	for _, vs := range statsByValue {
+		if vs.numLStreams >= minLStreams {
+			stats = append(stats, vs)
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].numLStreams != stats[j].numLStreams {
+			return stats[i].numLStreams > stats[j].numLStreams
+		}
+
+		if stats[i].count != stats[j].count {
+			return stats[i].count > stats[j].count
+		}
+
+		return stats[i].value < stats[j].value
+	})
+
+	if len(stats) > maxValues {
+		stats = stats[:maxValues]
+	}
+
+	values := make([]string, 0, len(stats))
+	for _, vs := range stats {
+		values = append(values, vs.value)
+	}
+
+	return values
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelatedQuery(t *testing.T) {
+	fieldsCfg := FilterFieldsConfig{NumTimestampFields: 1}
+
+	correlation, err := parseCorrelation("request_id", []string{"abc", "d.e"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t,
+		`(/foo/) && (($0 ~ /(^|[^A-Za-z0-9_.-])request_id=("abc"|abc)([^A-Za-z0-9_.\/-]|$)|"request_id": *"abc"/) || `+
+			`($0 ~ /(^|[^A-Za-z0-9_.-])request_id=("d\.e"|d\.e)([^A-Za-z0-9_.\/-]|$)|"request_id": *"d\.e"/))`,
+		correlatedQuery("/foo/", correlation, fieldsCfg),
+	)
+
+	// Without the query, it's just the correlation condition.
+	correlation, err = parseCorrelation("request_id", []string{"abc"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t,
+		`($0 ~ /(^|[^A-Za-z0-9_.-])request_id=("abc"|abc)([^A-Za-z0-9_.\/-]|$)|"request_id": *"abc"/)`,
+		correlatedQuery("", correlation, fieldsCfg),
+	)
+
+	// Without the correlation, the query is left as is.
+	assert.Equal(t, "/foo/", correlatedQuery("/foo/", nil, fieldsCfg))
+
+	for _, tc := range []struct {
+		key    string
+		values []string
+		err    string
+	}{
+		{key: "", values: []string{"abc"}, err: "correlation values are given, but there is no key"},
+		{key: "request id", values: []string{"abc"}, err: `invalid correlation key "request id"`},
+		{key: "request_id", err: "no values to correlate by request_id"},
+		{key: "request_id", values: []string{"abc", ""}, err: "empty value to correlate by request_id"},
+	} {
+		_, err := parseCorrelation(tc.key, tc.values)
+		assert.EqualError(t, err, tc.err, "key %q", tc.key)
+	}
+}
+
+func TestCorrelatedValues(t *testing.T) {
+	groupsByLStream := map[string]map[string]int{
+		"api-01":  {"r1": 3, "r2": 1, "r3": 5, "": 10},
+		"db-01":   {"r1": 1, "r2": 2, "r4": 1, "": 10},
+		"auth-01": {"r2": 1, "r5": 1},
+	}
+
+	// r2 is on all 3 logstreams; r1 is on 2 of them; the empty values are
+	// never correlated.
+	assert.Equal(t, []string{"r2", "r1"}, correlatedValues(groupsByLStream, 2, 100))
+	assert.Equal(t, []string{"r2"}, correlatedValues(groupsByLStream, 2, 1))
+	assert.Equal(t, []string{"r2"}, correlatedValues(groupsByLStream, 3, 100))
+	assert.Equal(t, []string{}, correlatedValues(groupsByLStream, 4, 100))
+
+	// With just 1 logstream, it's all the values: the ones on more logstreams
+	// first, then the more frequent ones.
+	assert.Equal(t, []string{"r2", "r1", "r3", "r4", "r5"}, correlatedValues(groupsByLStream, 1, 100))
+}
+
+func TestQueryCorrelateKey(t *testing.T) {
+	dir := t.TempDir()
+	from := localhostTestFrom()
+	line := func(sec int, rest string) string {
+		return localhostTestLogLine(from.Add(time.Duration(sec)*time.Second), rest)
+	}
+
+	logs := map[string][]string{
+		"api-01": {
+			line(1, "api-01 api[1]: request_id=abc started"),
+			line(2, "api-01 api[1]: request_id=xyz started"),
+			line(5, "api-01 api[1]: request_id=abc done"),
+			line(6, "api-01 api[1]: request_id=abcd started"),
+		},
+		"db-01": {
+			line(3, `db-01 db[2]: request_id="abc" select`),
+			line(4, "db-01 db[2]: request_id=xyz select"),
+			line(7, "db-01 db[2]: no request at all"),
+		},
+	}
+
+	configLogStreams := ConfigLogStreams{}
+	for name, lines := range logs {
+		logPath := filepath.Join(dir, name+".log")
+		appendLocalhostTestLog(t, logPath, lines...)
+		configLogStreams[name] = localhostTestLogStream(logPath)
+	}
+
+	n := newLocalhostTestNerdlog(t, "query_correlate_test", configLogStreams)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:            from,
+		To:              from.Add(time.Hour),
+		MaxNumLines:     100,
+		CorrelateKey:    "request_id",
+		CorrelateValues: []string{"abc"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Only the lines with exactly this request id are returned, from both
+	// logstreams, ordered by time.
+	var msgs []string
+	for _, msg := range resp.Logs {
+		msgs = append(msgs, msg.Msg)
+	}
+	assert.Equal(t, []string{
+		"request_id=abc started",
+		`request_id="abc" select`,
+		"request_id=abc done",
+	}, msgs)
+	assert.Equal(t, 3, resp.NumMsgsTotal)
+
+	// The correlation is added on top of the query.
+	resp, err = n.Query(ctx, QueryLogsParams{
+		From:            from,
+		To:              from.Add(time.Hour),
+		MaxNumLines:     100,
+		Query:           "/started/",
+		CorrelateKey:    "request_id",
+		CorrelateValues: []string{"abc", "xyz"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	msgs = nil
+	for _, msg := range resp.Logs {
+		msgs = append(msgs, msg.Msg)
+	}
+	assert.Equal(t, []string{
+		"request_id=abc started",
+		"request_id=xyz started",
+	}, msgs)
+}
+
+func TestNerdlogCorrelate(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "request_id=r1 foo"))
+
+	groupsByLStream := map[string]map[string]int{
+		"fake-01": {"r1": 2, "r2": 1},
+		"fake-02": {"r1": 1, "r3": 4},
+		"fake-03": {"r3": 1},
+	}
+
+	agentCmds := &fakeLogs{}
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02,fake-03",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{
+				logs:        logs,
+				agentCmds:   agentCmds,
+				queryGroups: groupsByLStream[ls.Name],
+			}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	corr, err := n.Correlate(ctx, CorrelateParams{
+		Query: QueryLogsParams{From: now.Add(-time.Hour)},
+		Key:   "request_id",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// r3 goes first since it's more frequent; r2 is only on one logstream.
+	assert.Equal(t, []string{"r3", "r1"}, corr.Values)
+	if assert.NotNil(t, corr.Resp) {
+		assert.Nil(t, corr.Resp.Groups)
+	}
+
+	// The first query only counts the values, and the second one gets the
+	// lines with the correlated values, on all the logstreams.
+	var numCounting, numCorrelated int
+	for _, cmd := range agentCmds.get() {
+		if !strings.Contains(cmd, " query ") {
+			continue
+		}
+
+		switch {
+		case strings.Contains(cmd, " --group-code ") && strings.Contains(cmd, " --aggregate-only"):
+			numCounting++
+		case strings.Contains(cmd, `request_id=("r3"|r3)`) && strings.Contains(cmd, `request_id=("r1"|r1)`):
+			numCorrelated++
+		default:
+			t.Errorf("unexpected query: %s", cmd)
+		}
+	}
+	assert.Equal(t, 3, numCounting)
+	assert.Equal(t, 3, numCorrelated)
+
+	// If no values are on enough logstreams, there's nothing to correlate.
+	corr, err = n.Correlate(ctx, CorrelateParams{
+		Query:       QueryLogsParams{From: now.Add(-time.Hour)},
+		Key:         "request_id",
+		MinLStreams: 3,
+	})
+	if assert.NoError(t, err) {
+		assert.Empty(t, corr.Values)
+		assert.Nil(t, corr.Resp)
+	}
+
+	_, err = n.Correlate(ctx, CorrelateParams{
+		Query: QueryLogsParams{From: now.Add(-time.Hour), GroupBy: "program"},
+		Key:   "request_id",
+	})
+	assert.EqualError(t, err, "the query to correlate can't be grouped or aggregate-only")
+
+	_, err = n.Correlate(ctx, CorrelateParams{
+		Query: QueryLogsParams{From: now.Add(-time.Hour)},
+		Key:   "request id",
+	})
+	assert.EqualError(t, err, `invalid correlation key "request id"`)
+}
@@ -0,0 +1,1004 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// QueryLang specifies how QueryLogsParams.Query should be interpreted.
+type QueryLang string
+
+const (
+	// QueryLangAWK means that the query is a raw awk pattern, which is passed
+	// to the nerdlog_agent.sh as is. This is the default.
+	QueryLangAWK QueryLang = "awk"
+
+	// QueryLangFilter means that the query is written in the filter language
+	// (see ParseFilterQuery), like this:
+	//
+	//   level:error AND (service:api OR service:worker) AND NOT path:/health
+	//
+	// It's compiled into an awk pattern for every logstream separately, since
+	// the way fields are extracted depends on the log format.
+	QueryLangFilter QueryLang = "filter"
+)
+
+func ParseQueryLang(s string) (QueryLang, error) {
+	switch QueryLang(s) {
+	case QueryLangAWK, QueryLangFilter:
+		return QueryLang(s), nil
+	}
+
+	return "", errors.Errorf("invalid query language %q, valid options are: %s, %s", s, QueryLangAWK, QueryLangFilter)
+}
+
+// Field names in the filter language which are extracted from the syslog-like
+// header, instead of being searched as key=value pairs in the message.
+const (
+	FilterFieldHostname = "hostname"
+	FilterFieldProgram  = "program"
+	FilterFieldLevel    = "level"
+)
+
+// filterFieldAliases maps alternative field names to the canonical ones.
+var filterFieldAliases = map[string]string{
+	"host": FilterFieldHostname,
+}
+
+// filterLevelRegexes maps the supported values of the "level" field to the
+// awk regexes which are matched against the lowercased log line. They mirror
+// what ClassifyLogLevel does on the client side. The "unknown" level means
+// that none of them match.
+var filterLevelRegexes = map[string]string{
+	"error": `\[[ef]\]|(^|[^a-z0-9_])(error|erro|err|crit|critical|fatal)([^a-z0-9_]|$)`,
+	"warn":  `\[w\]|(^|[^a-z0-9_])(warn|warning)([^a-z0-9_]|$)`,
+	"info":  `\[i\]|(^|[^a-z0-9_])info([^a-z0-9_]|$)`,
+	"debug": `\[d\]|(^|[^a-z0-9_])(debu|debug)([^a-z0-9_]|$)`,
+}
+
+// FilterQueryError is returned by ParseFilterQuery if the query is invalid.
+type FilterQueryError struct {
+	// Pos is the 0-based byte offset in the query where the error is.
+	Pos int
+	Msg string
+}
+
+func (e *FilterQueryError) Error() string {
+	return fmt.Sprintf("invalid filter query at position %d: %s", e.Pos+1, e.Msg)
+}
+
+// FilterExpr is a node of the filter query AST. It's one of: *FilterAnd,
+// *FilterOr, *FilterNot, *FilterTerm.
+type FilterExpr interface {
+	// String returns the expression in the fully parenthesized prefix form,
+	// like "(and level:error (not path:/health))". Mostly useful for tests and
+	// debugging.
+	String() string
+
+	isFilterExpr()
+}
+
+type FilterAnd struct {
+	Left, Right FilterExpr
+}
+
+type FilterOr struct {
+	Left, Right FilterExpr
+}
+
+type FilterNot struct {
+	Expr FilterExpr
+}
+
+// FilterTerm is a single predicate: either a field predicate like
+// "level:error", or, if Field is empty, a search for the Value in the whole
+// log line.
+type FilterTerm struct {
+	Field string
+	Value string
+
+	// If IsRegex is true, Value is an (extended POSIX) regex, otherwise it's a
+	// literal string.
+	IsRegex bool
+
+	// Pos is the position of the value in the query, for error reporting.
+	Pos int
+
+	// NamedGroups contains the named capture groups of the regex; only set by
+	// TranslateFilterRegexes.
+	NamedGroups []RegexNamedGroup
+}
+
+func (*FilterAnd) isFilterExpr()  {}
+func (*FilterOr) isFilterExpr()   {}
+func (*FilterNot) isFilterExpr()  {}
+func (*FilterTerm) isFilterExpr() {}
+
+func (e *FilterAnd) String() string {
+	return fmt.Sprintf("(and %s %s)", e.Left, e.Right)
+}
+
+func (e *FilterOr) String() string {
+	return fmt.Sprintf("(or %s %s)", e.Left, e.Right)
+}
+
+func (e *FilterNot) String() string {
+	return fmt.Sprintf("(not %s)", e.Expr)
+}
+
+func (e *FilterTerm) String() string {
+	value := e.Value
+	if e.IsRegex {
+		value = "/" + value + "/"
+	} else if strings.ContainsAny(value, " \t()\"") {
+		value = fmt.Sprintf("%q", value)
+	}
+
+	if e.Field == "" {
+		return value
+	}
+
+	return e.Field + ":" + value
+}
+
+// ParseFilterQuery parses the query in the filter language. The grammar is:
+//
+//	expr    = orExpr
+//	orExpr  = andExpr { "OR" andExpr }
+//	andExpr = notExpr { ["AND"] notExpr }
+//	notExpr = "NOT" notExpr | primary
+//	primary = "(" expr ")" | term
+//	term    = [field ":"] value
+//	value   = word | "quoted string" | /regex/
+//
+// So NOT binds tighter than AND, which binds tighter than OR, and two terms
+// next to each other are implicitly AND-ed. The keywords must be uppercase;
+// in lowercase, they are just words to search for.
+//
+// A term without the field matches lines containing the value. Supported
+// fields are "hostname" (or "host") and "program" from the syslog-like
+// header, "level" (one of: error, warn, info, debug), and any other field
+// name is looked up as a key=value or "key":"value" pair in the message.
+func ParseFilterQuery(query string) (FilterExpr, error) {
+	tokens, err := lexFilterQuery(query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p := &filterParser{
+		tokens: tokens,
+	}
+
+	if p.peek().kind == filterTokenEOF {
+		return nil, &FilterQueryError{Pos: 0, Msg: "empty query"}
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if tok := p.peek(); tok.kind != filterTokenEOF {
+		return nil, &FilterQueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %s", tok.descr())}
+	}
+
+	return expr, nil
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEOF filterTokenKind = iota
+	filterTokenLParen
+	filterTokenRParen
+	filterTokenAnd
+	filterTokenOr
+	filterTokenNot
+	filterTokenTerm
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	pos  int
+
+	// term is only set for filterTokenTerm.
+	term *FilterTerm
+}
+
+func (t filterToken) descr() string {
+	switch t.kind {
+	case filterTokenEOF:
+		return "end of query"
+	case filterTokenLParen:
+		return `"("`
+	case filterTokenRParen:
+		return `")"`
+	case filterTokenAnd:
+		return "AND"
+	case filterTokenOr:
+		return "OR"
+	case filterTokenNot:
+		return "NOT"
+	default:
+		return fmt.Sprintf("%q", t.term.String())
+	}
+}
+
+func lexFilterQuery(query string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	i := 0
+	for {
+		for i < len(query) && isFilterSpace(query[i]) {
+			i++
+		}
+
+		if i >= len(query) {
+			tokens = append(tokens, filterToken{kind: filterTokenEOF, pos: i})
+			return tokens, nil
+		}
+
+		switch query[i] {
+		case '(':
+			tokens = append(tokens, filterToken{kind: filterTokenLParen, pos: i})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, filterToken{kind: filterTokenRParen, pos: i})
+			i++
+			continue
+		}
+
+		start := i
+
+		// Check if it's a field name followed by a colon.
+		var field string
+		j := i
+		for j < len(query) && isFilterFieldChar(query[j], j == i) {
+			j++
+		}
+		if j > i && j < len(query) && query[j] == ':' {
+			field = strings.ToLower(query[i:j])
+			if canonical, ok := filterFieldAliases[field]; ok {
+				field = canonical
+			}
+			i = j + 1
+		}
+
+		valuePos := i
+		value, isRegex, next, err := lexFilterValue(query, i, field != "")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		i = next
+
+		if field == "" && !isRegex {
+			// Check for keywords; they are only recognized unquoted, so that one
+			// can still search for e.g. "AND" by quoting it.
+			if query[start] != '"' {
+				kind := filterTokenTerm
+				switch value {
+				case "AND":
+					kind = filterTokenAnd
+				case "OR":
+					kind = filterTokenOr
+				case "NOT":
+					kind = filterTokenNot
+				}
+
+				if kind != filterTokenTerm {
+					tokens = append(tokens, filterToken{kind: kind, pos: start})
+					continue
+				}
+			}
+		}
+
+		term := &FilterTerm{
+			Field:   field,
+			Value:   value,
+			IsRegex: isRegex,
+			Pos:     valuePos,
+		}
+
+		if err := validateFilterTerm(term, valuePos); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		tokens = append(tokens, filterToken{
+			kind: filterTokenTerm,
+			pos:  start,
+			term: term,
+		})
+	}
+}
+
+// lexFilterValue lexes the value starting at the position i: either a quoted
+// string, a regex, or a plain word. Returns the value, whether it's a regex,
+// and the position right after the value.
+func lexFilterValue(query string, i int, isFieldValue bool) (value string, isRegex bool, next int, err error) {
+	if i >= len(query) || isFilterSpace(query[i]) || query[i] == ')' {
+		return "", false, 0, &FilterQueryError{Pos: i, Msg: "expected a value after the field name"}
+	}
+
+	switch query[i] {
+	case '"':
+		var sb strings.Builder
+		j := i + 1
+		for ; j < len(query); j++ {
+			c := query[j]
+			if c == '\\' && j+1 < len(query) {
+				j++
+				sb.WriteByte(query[j])
+				continue
+			}
+
+			if c == '"' {
+				return sb.String(), false, j + 1, nil
+			}
+
+			sb.WriteByte(c)
+		}
+
+		return "", false, 0, &FilterQueryError{Pos: i, Msg: "unterminated quoted string"}
+
+	case '/':
+		// It's a regex if there is a closing slash followed by a space, a
+		// closing paren, or the end of the query. Otherwise, for field values,
+		// it's just a word like "/health" or "/api/v1"; but a bare word can't
+		// start with a slash, since it'd be too confusing.
+		for j := i + 1; j < len(query); j++ {
+			c := query[j]
+			if c == '\\' && j+1 < len(query) {
+				j++
+				continue
+			}
+
+			if c == '/' {
+				if j+1 == len(query) || isFilterSpace(query[j+1]) || query[j+1] == ')' {
+					if j == i+1 {
+						return "", false, 0, &FilterQueryError{Pos: i, Msg: "empty regex"}
+					}
+
+					return query[i+1 : j], true, j + 1, nil
+				}
+
+				break
+			}
+		}
+
+		if !isFieldValue {
+			return "", false, 0, &FilterQueryError{Pos: i, Msg: "unterminated regex"}
+		}
+	}
+
+	j := i
+	for j < len(query) && !isFilterSpace(query[j]) && query[j] != '(' && query[j] != ')' {
+		j++
+	}
+
+	return query[i:j], false, j, nil
+}
+
+func validateFilterTerm(term *FilterTerm, valuePos int) error {
+	switch term.Field {
+	case "", FilterFieldHostname, FilterFieldProgram:
+		return nil
+
+	case FilterFieldLevel:
+		if term.IsRegex {
+			return &FilterQueryError{Pos: valuePos, Msg: "level can't be a regex"}
+		}
+
+		level, ok := ParseLogLevel(term.Value)
+		if !ok {
+			return &FilterQueryError{
+				Pos: valuePos,
+				Msg: fmt.Sprintf("invalid level %q, valid options are: error, warn, info, debug, unknown", term.Value),
+			}
+		}
+
+		term.Value = string(level)
+		if level == LogLevelUnknown {
+			term.Value = logLevelUnknownName
+		}
+
+		return nil
+
+	default:
+		if term.IsRegex {
+			return &FilterQueryError{
+				Pos: valuePos,
+				Msg: fmt.Sprintf("regex is not supported for the field %q, only for: %s, %s", term.Field, FilterFieldHostname, FilterFieldProgram),
+			}
+		}
+
+		return nil
+	}
+}
+
+func isFilterSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isFilterFieldChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		return true
+	case (c >= '0' && c <= '9') || c == '.' || c == '-':
+		return !first
+	default:
+		return false
+	}
+}
+
+type filterParser struct {
+	tokens []filterToken
+	cur    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.cur]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.cur]
+	if tok.kind != filterTokenEOF {
+		p.cur++
+	}
+	return tok
+}
+
+func (p *filterParser) parseOr() (FilterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for p.peek().kind == filterTokenOr {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		left = &FilterOr{Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (FilterExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for {
+		switch p.peek().kind {
+		case filterTokenAnd:
+			p.next()
+		case filterTokenNot, filterTokenLParen, filterTokenTerm:
+			// Implicit AND.
+		default:
+			return left, nil
+		}
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		left = &FilterAnd{Left: left, Right: right}
+	}
+}
+
+func (p *filterParser) parseNot() (FilterExpr, error) {
+	if p.peek().kind == filterTokenNot {
+		p.next()
+
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return &FilterNot{Expr: expr}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (FilterExpr, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case filterTokenTerm:
+		return tok.term, nil
+
+	case filterTokenLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if closing := p.next(); closing.kind != filterTokenRParen {
+			return nil, &FilterQueryError{
+				Pos: closing.pos,
+				Msg: fmt.Sprintf("expected \")\" to match the one at position %d, got %s", tok.pos+1, closing.descr()),
+			}
+		}
+
+		return expr, nil
+
+	default:
+		return nil, &FilterQueryError{
+			Pos: tok.pos,
+			Msg: fmt.Sprintf("expected a term, NOT or \"(\", got %s", tok.descr()),
+		}
+	}
+}
+
+// TranslateFilterRegexes translates all the regexes in the filter expression
+// to the given awk dialect (see TranslateRegexToAWK), in place. If some regex
+// can't be translated, a *FilterQueryError is returned.
+func TranslateFilterRegexes(expr FilterExpr, dialect AWKDialect) error {
+	switch v := expr.(type) {
+	case *FilterAnd:
+		if err := TranslateFilterRegexes(v.Left, dialect); err != nil {
+			return errors.Trace(err)
+		}
+		return TranslateFilterRegexes(v.Right, dialect)
+
+	case *FilterOr:
+		if err := TranslateFilterRegexes(v.Left, dialect); err != nil {
+			return errors.Trace(err)
+		}
+		return TranslateFilterRegexes(v.Right, dialect)
+
+	case *FilterNot:
+		return TranslateFilterRegexes(v.Expr, dialect)
+
+	case *FilterTerm:
+		if !v.IsRegex {
+			return nil
+		}
+
+		translated, namedGroups, err := TranslateRegexToAWKWithGroups(v.Value, dialect)
+		if err != nil {
+			var rtErr *RegexTranslateError
+			if errors.As(err, &rtErr) {
+				// The +1 is for the opening slash.
+				return &FilterQueryError{Pos: v.Pos + 1 + rtErr.Pos, Msg: rtErr.Error()}
+			}
+
+			return errors.Trace(err)
+		}
+
+		v.Value = translated
+		v.NamedGroups = namedGroups
+		return nil
+
+	default:
+		panic(fmt.Sprintf("unexpected filter expr %T", expr))
+	}
+}
+
+// FilterFieldsConfig describes how to extract the fields from log lines; see
+// NewFilterFieldsConfig.
+type FilterFieldsConfig struct {
+	// NumTimestampFields is the number of whitespace-separated awk fields taken
+	// by the timestamp. The syslog-like header fields (hostname and program)
+	// are expected to follow right after.
+	NumTimestampFields int
+
+	// LevelRegexes, if not nil, are the awk regexes for the "level" field,
+	// matched against the whole log line as is; see LevelPatterns. If nil,
+	// the default filterLevelRegexes are used.
+	LevelRegexes map[LogLevel]string
+
+	// Labels are the labels of the logstream (see ConfigLogStream.Labels).
+	// Since they're the same for all the messages, the terms on the label
+	// fields are resolved right away, instead of being searched in the log
+	// lines.
+	Labels map[string]string
+
+	// JSONTimestampField, if not empty, means that the log lines are JSON
+	// objects with the timestamp in this field (see JSONLogs): then all the
+	// fields except the level (including the hostname and the program) are
+	// looked up by their dotted paths in the JSON, using the nljsonget
+	// function of nerdlog_agent.sh.
+	JSONTimestampField string
+}
+
+// NewFilterFieldsConfig returns the fields config for the logs with the given
+// time format.
+func NewFilterFieldsConfig(timeFormat *TimeFormatDescr) FilterFieldsConfig {
+	return FilterFieldsConfig{
+		NumTimestampFields: len(strings.Fields(timeFormat.TimestampLayout)),
+	}
+}
+
+// FilterMatchOpts specifies how the terms without a field (the ones which
+// are searched in the whole log line) are matched.
+type FilterMatchOpts struct {
+	// CaseSensitive, if false, makes the matching ignore the case of ASCII
+	// letters.
+	CaseSensitive bool
+
+	// WholeWord, if true, makes the value only match as a whole word, i.e.
+	// not preceded or followed by a letter, digit or underscore. For regexes,
+	// it applies to the whole match.
+	WholeWord bool
+}
+
+// DefaultFilterMatchOpts is what's used unless the user asks otherwise: the
+// matching is case-sensitive, and not limited to whole words.
+var DefaultFilterMatchOpts = FilterMatchOpts{CaseSensitive: true}
+
+// filterWordChars are the characters which can be a part of a word, for
+// FilterMatchOpts.WholeWord, to be used in a bracket expression. We can't use
+// \b or \y, since they are not POSIX, and not supported by all awks.
+const filterWordChars = "A-Za-z0-9_"
+
+// CompileFilterQueryToAWK generates the awk condition implementing the given
+// filter expression. The result can be used as QueryLogsParams.Query with
+// QueryLangAWK.
+func CompileFilterQueryToAWK(
+	expr FilterExpr, fieldsCfg FilterFieldsConfig, matchOpts FilterMatchOpts,
+) string {
+	switch v := expr.(type) {
+	case *FilterAnd:
+		return fmt.Sprintf("(%s && %s)",
+			CompileFilterQueryToAWK(v.Left, fieldsCfg, matchOpts),
+			CompileFilterQueryToAWK(v.Right, fieldsCfg, matchOpts),
+		)
+
+	case *FilterOr:
+		return fmt.Sprintf("(%s || %s)",
+			CompileFilterQueryToAWK(v.Left, fieldsCfg, matchOpts),
+			CompileFilterQueryToAWK(v.Right, fieldsCfg, matchOpts),
+		)
+
+	case *FilterNot:
+		return fmt.Sprintf("!%s", CompileFilterQueryToAWK(v.Expr, fieldsCfg, matchOpts))
+
+	case *FilterTerm:
+		return compileFilterTermToAWK(v, fieldsCfg, matchOpts)
+
+	default:
+		panic(fmt.Sprintf("unexpected filter expr %T", expr))
+	}
+}
+
+// compileFilterSearchToAWK generates the awk condition for the term without
+// a field, which is searched in the whole log line.
+func compileFilterSearchToAWK(term *FilterTerm, matchOpts FilterMatchOpts) string {
+	line := "$0"
+	value := term.Value
+	if !matchOpts.CaseSensitive {
+		// Lowercase both the line and the value. NOTE: only ASCII letters are
+		// lowercased, since that's what all awks can do with tolower().
+		line = "tolower($0)"
+		if term.IsRegex {
+			value = regexToLowerASCII(value)
+		} else {
+			value = toLowerASCII(value)
+		}
+	}
+
+	if !matchOpts.WholeWord {
+		if term.IsRegex {
+			return fmt.Sprintf("(%s ~ %s)", line, awkRegexLiteral(value))
+		}
+
+		return fmt.Sprintf("(index(%s, %s) > 0)", line, awkStringLiteral(value))
+	}
+
+	if !term.IsRegex {
+		value = regexQuoteMeta(value)
+	}
+
+	re := fmt.Sprintf("(^|[^%s])(%s)([^%s]|$)", filterWordChars, value, filterWordChars)
+
+	return fmt.Sprintf("(%s ~ %s)", line, awkRegexLiteral(re))
+}
+
+func compileFilterTermToAWK(
+	term *FilterTerm, fieldsCfg FilterFieldsConfig, matchOpts FilterMatchOpts,
+) string {
+	if _, ok := fieldsCfg.Labels[term.Field]; !ok && fieldsCfg.JSONTimestampField != "" {
+		switch term.Field {
+		case "", FilterFieldLevel:
+			// Handled below, same as for the plain logs.
+
+		default:
+			field := jsonGetAWKExpr(term.Field)
+			if term.IsRegex {
+				return fmt.Sprintf("(%s ~ %s)", field, awkRegexLiteral(term.Value))
+			}
+
+			return fmt.Sprintf("(%s == %s)", field, awkStringLiteral(term.Value))
+		}
+	}
+
+	switch term.Field {
+	case "":
+		return compileFilterSearchToAWK(term, matchOpts)
+
+	case FilterFieldHostname:
+		field := fmt.Sprintf("$%d", fieldsCfg.NumTimestampFields+1)
+		if term.IsRegex {
+			return fmt.Sprintf("(%s ~ %s)", field, awkRegexLiteral(term.Value))
+		}
+
+		return fmt.Sprintf("(%s == %s)", field, awkStringLiteral(term.Value))
+
+	case FilterFieldProgram:
+		// The program is followed by an optional pid in square brackets, and
+		// a colon, like "sshd[1234]:".
+		field := fmt.Sprintf("$%d", fieldsCfg.NumTimestampFields+2)
+		if term.IsRegex {
+			// Match the regex against the program name only.
+			return fmt.Sprintf(
+				"(match(%s, /^[^:[]+/) && substr(%s, RSTART, RLENGTH) ~ %s)",
+				field, field, awkRegexLiteral(term.Value),
+			)
+		}
+
+		return fmt.Sprintf(
+			"(%s ~ %s)",
+			field, awkRegexLiteral("^"+regexQuoteMeta(term.Value)+`(\[[0-9]+\])?:$`),
+		)
+
+	case FilterFieldLevel:
+		return compileFilterLevelToAWK(term.Value, fieldsCfg)
+
+	default:
+		if labelValue, ok := fieldsCfg.Labels[term.Field]; ok {
+			if labelValue == term.Value {
+				return "1"
+			}
+
+			return "0"
+		}
+
+		// Look for either key=value (optionally quoted) or "key":"value".
+		key := regexQuoteMeta(term.Field)
+		value := regexQuoteMeta(term.Value)
+		re := fmt.Sprintf(
+			`(^|[^A-Za-z0-9_.-])%s=("%s"|%s)([^A-Za-z0-9_.\/-]|$)|"%s": *"%s"`,
+			key, value, value, key, value,
+		)
+
+		return fmt.Sprintf("($0 ~ %s)", awkRegexLiteral(re))
+	}
+}
+
+// compileFilterLevelToAWK generates the awk condition for the "level" field
+// with the given (already validated) value.
+func compileFilterLevelToAWK(value string, fieldsCfg FilterFieldsConfig) string {
+	matchLevel := func(level LogLevel) string {
+		if fieldsCfg.LevelRegexes == nil {
+			return fmt.Sprintf("(tolower($0) ~ %s)", awkRegexLiteral(filterLevelRegexes[string(level)]))
+		}
+
+		re, ok := fieldsCfg.LevelRegexes[level]
+		if !ok {
+			// This level is never detected.
+			return "0"
+		}
+
+		return fmt.Sprintf("($0 ~ %s)", awkRegexLiteral(re))
+	}
+
+	if value != logLevelUnknownName {
+		return matchLevel(LogLevel(value))
+	}
+
+	conds := make([]string, 0, len(logLevelsByPrecedence))
+	for _, level := range logLevelsByPrecedence {
+		conds = append(conds, "!"+matchLevel(level))
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(conds, " && "))
+}
+
+// filterCapturesSeparator separates the captured fields in the output of the
+// code generated by CompileFilterCapturesToAWK.
+const filterCapturesSeparator = "\x1f"
+
+// CompileFilterCapturesToAWK generates the awk code which extracts the named
+// capture groups from the regexes in the filter expression (which must have
+// been processed by TranslateFilterRegexes), and appends them to the awk
+// variable nlcaps, as "name=value" separated by the filterCapturesSeparator.
+// Only the regexes without a field (matched against the whole line) are
+// considered. If there are no named groups, an empty string is returned.
+//
+// The generated code uses the 3-arg match(), so it needs gawk.
+func CompileFilterCapturesToAWK(expr FilterExpr) string {
+	var sb strings.Builder
+
+	walkFilterTerms(expr, func(term *FilterTerm) {
+		if term.Field != "" || !term.IsRegex || len(term.NamedGroups) == 0 {
+			return
+		}
+
+		sb.WriteString(fmt.Sprintf("if (match($0, %s, nlcapm)) { ", awkRegexLiteral(term.Value)))
+		for _, g := range term.NamedGroups {
+			sb.WriteString(fmt.Sprintf(
+				`if (nlcapm[%d] != "") { nlcaps = nlcaps "\037" %s nlcapm[%d] } `,
+				g.Index, awkStringLiteral(g.Name+"="), g.Index,
+			))
+		}
+		sb.WriteString("} ")
+	})
+
+	return strings.TrimSpace(sb.String())
+}
+
+// ParseFilterCaptures parses the captured fields, as generated by the code
+// from CompileFilterCapturesToAWK, to the map from the field name to the
+// value.
+func ParseFilterCaptures(s string) map[string]string {
+	ret := map[string]string{}
+
+	for _, part := range strings.Split(s, filterCapturesSeparator) {
+		idx := strings.IndexByte(part, '=')
+		if idx <= 0 {
+			continue
+		}
+
+		ret[part[:idx]] = part[idx+1:]
+	}
+
+	return ret
+}
+
+func walkFilterTerms(expr FilterExpr, f func(term *FilterTerm)) {
+	switch v := expr.(type) {
+	case *FilterAnd:
+		walkFilterTerms(v.Left, f)
+		walkFilterTerms(v.Right, f)
+	case *FilterOr:
+		walkFilterTerms(v.Left, f)
+		walkFilterTerms(v.Right, f)
+	case *FilterNot:
+		walkFilterTerms(v.Expr, f)
+	case *FilterTerm:
+		f(v)
+	}
+}
+
+// awkStringLiteral returns the awk string literal with the given contents.
+func awkStringLiteral(s string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+// awkRegexLiteral returns the awk regex literal like /foo/, escaping the
+// slashes which aren't escaped yet. A trailing unpaired backslash is escaped
+// too, since otherwise it'd escape the closing slash.
+func awkRegexLiteral(re string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('/')
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+		switch {
+		case c == '\\' && i+1 < len(re):
+			sb.WriteByte(c)
+			i++
+			sb.WriteByte(re[i])
+		case c == '\\':
+			sb.WriteString(`\\`)
+		case c == '/':
+			sb.WriteString(`\/`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('/')
+
+	return sb.String()
+}
+
+// regexQuoteMeta is like regexp.QuoteMeta, but for POSIX extended regexes as
+// understood by awk.
+func regexQuoteMeta(s string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if strings.IndexByte(`\.+*?()|[]{}^$/`, c) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String()
+}
+
+// toLowerASCII lowercases only the ASCII letters, like awk's tolower() does
+// in the C locale.
+func toLowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+
+	return string(b)
+}
+
+// regexToLowerASCII lowercases the ASCII letters in the regex, so that it
+// can be matched against the lowercased line. The escaped characters (like
+// in "\S") and the character class names (like "[:upper:]") are left as is.
+func regexToLowerASCII(re string) string {
+	var sb strings.Builder
+
+	inBracket := false
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+
+		switch {
+		case c == '\\' && i+1 < len(re):
+			sb.WriteByte(c)
+			i++
+			sb.WriteByte(re[i])
+			continue
+
+		case !inBracket && c == '[':
+			inBracket = true
+			sb.WriteByte(c)
+
+			// The "]" right after "[" or "[^" is a literal.
+			if i+1 < len(re) && re[i+1] == '^' {
+				i++
+				sb.WriteByte(re[i])
+			}
+			if i+1 < len(re) && re[i+1] == ']' {
+				i++
+				sb.WriteByte(re[i])
+			}
+			continue
+
+		case inBracket && strings.HasPrefix(re[i:], "[:"):
+			end := strings.Index(re[i+2:], ":]")
+			if end >= 0 {
+				sb.WriteString(re[i : i+2+end+2])
+				i += 2 + end + 1
+				continue
+			}
+
+		case inBracket && c == ']':
+			inBracket = false
+		}
+
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,410 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type parseFilterQueryTestCase struct {
+	query string
+
+	wantAST string
+
+	// If wantErrPos is not -1, an error at this position is expected.
+	wantErrPos int
+}
+
+func TestParseFilterQuery(t *testing.T) {
+	testCases := []parseFilterQueryTestCase{
+		{
+			query:      "foo",
+			wantAST:    "foo",
+			wantErrPos: -1,
+		},
+		{
+			query:      "level:error AND (service:api OR service:worker) AND NOT path:/health",
+			wantAST:    "(and (and level:error (or service:api service:worker)) (not path:/health))",
+			wantErrPos: -1,
+		},
+		{
+			// AND binds tighter than OR.
+			query:      "a OR b AND c",
+			wantAST:    "(or a (and b c))",
+			wantErrPos: -1,
+		},
+		{
+			query:      "a AND b OR c",
+			wantAST:    "(or (and a b) c)",
+			wantErrPos: -1,
+		},
+		{
+			// NOT binds tighter than AND.
+			query:      "NOT a AND b",
+			wantAST:    "(and (not a) b)",
+			wantErrPos: -1,
+		},
+		{
+			query:      "NOT NOT a",
+			wantAST:    "(not (not a))",
+			wantErrPos: -1,
+		},
+		{
+			// Implicit AND.
+			query:      "a b OR c",
+			wantAST:    "(or (and a b) c)",
+			wantErrPos: -1,
+		},
+		{
+			// Lowercase keywords are just words.
+			query:      "a or b",
+			wantAST:    "(and (and a or) b)",
+			wantErrPos: -1,
+		},
+		{
+			query:      `"AND" msg:"foo bar" host:/^web-[0-9]+$/ /some (regex)/`,
+			wantAST:    `(and (and (and AND msg:"foo bar") hostname:/^web-[0-9]+$/) /some (regex)/)`,
+			wantErrPos: -1,
+		},
+		{
+			query:      "Level:WARNING path:/api/v1",
+			wantAST:    "(and level:warn path:/api/v1)",
+			wantErrPos: -1,
+		},
+		{
+			query:      "level:Unknown",
+			wantAST:    "level:unknown",
+			wantErrPos: -1,
+		},
+		{
+			query:      "10:30 http://foo",
+			wantAST:    "(and 10:30 http://foo)",
+			wantErrPos: -1,
+		},
+
+		{query: "", wantErrPos: 0},
+		{query: "a AND", wantErrPos: 5},
+		{query: "(a OR b", wantErrPos: 7},
+		{query: "a OR b)", wantErrPos: 6},
+		{query: "level:fatal", wantErrPos: 6},
+		{query: "level:/err/", wantErrPos: 6},
+		{query: "a AND service:/api/", wantErrPos: 14},
+		{query: `foo "bar`, wantErrPos: 4},
+		{query: "foo /bar", wantErrPos: 4},
+		{query: "foo: bar", wantErrPos: 4},
+		{query: "OR a", wantErrPos: 0},
+	}
+
+	for _, tc := range testCases {
+		expr, err := ParseFilterQuery(tc.query)
+		if tc.wantErrPos != -1 {
+			var fqErr *FilterQueryError
+			if assert.True(t, errors.As(err, &fqErr), "query %q: expected FilterQueryError, got %v", tc.query, err) {
+				assert.Equal(t, tc.wantErrPos, fqErr.Pos, "query %q: %s", tc.query, err)
+			}
+			continue
+		}
+
+		if !assert.NoError(t, err, "query %q", tc.query) {
+			continue
+		}
+
+		assert.Equal(t, tc.wantAST, expr.String(), "query %q", tc.query)
+	}
+}
+
+func TestCompileFilterQueryToAWK(t *testing.T) {
+	type testCase struct {
+		query   string
+		wantAWK string
+	}
+
+	// Traditional syslog format: the timestamp takes 3 fields.
+	fieldsCfg := FilterFieldsConfig{NumTimestampFields: 3}
+
+	testCases := []testCase{
+		{
+			query:   `foo "bar \"baz\""`,
+			wantAWK: `((index($0, "foo") > 0) && (index($0, "bar \"baz\"") > 0))`,
+		},
+		{
+			query:   `/a\/b|c/`,
+			wantAWK: `($0 ~ /a\/b|c/)`,
+		},
+		{
+			query:   "host:web-01 OR NOT program:sshd",
+			wantAWK: `(($4 == "web-01") || !($5 ~ /^sshd(\[[0-9]+\])?:$/))`,
+		},
+		{
+			query:   "program:/cron|anacron/",
+			wantAWK: `(match($5, /^[^:[]+/) && substr($5, RSTART, RLENGTH) ~ /cron|anacron/)`,
+		},
+		{
+			query:   "level:warn",
+			wantAWK: `(tolower($0) ~ /\[w\]|(^|[^a-z0-9_])(warn|warning)([^a-z0-9_]|$)/)`,
+		},
+		{
+			query:   "path:/health",
+			wantAWK: `($0 ~ /(^|[^A-Za-z0-9_.-])path=("\/health"|\/health)([^A-Za-z0-9_.\/-]|$)|"path": *"\/health"/)`,
+		},
+	}
+
+	for _, tc := range testCases {
+		expr, err := ParseFilterQuery(tc.query)
+		if !assert.NoError(t, err, "query %q", tc.query) {
+			continue
+		}
+
+		assert.Equal(t, tc.wantAWK, CompileFilterQueryToAWK(expr, fieldsCfg, DefaultFilterMatchOpts), "query %q", tc.query)
+	}
+}
+
+func TestCompileFilterQueryToAWKLabels(t *testing.T) {
+	fieldsCfg := FilterFieldsConfig{
+		NumTimestampFields: 3,
+		Labels:             map[string]string{"region": "eu"},
+	}
+
+	expr, err := ParseFilterQuery("(region:eu AND foo) OR region:us OR team:core")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The terms on the labels are resolved right away, while the fields which
+	// are not labels are still searched in the log lines.
+	assert.Equal(t,
+		`(((1 && (index($0, "foo") > 0)) || 0) || ($0 ~ /(^|[^A-Za-z0-9_.-])team=("core"|core)([^A-Za-z0-9_.\/-]|$)|"team": *"core"/))`,
+		CompileFilterQueryToAWK(expr, fieldsCfg, DefaultFilterMatchOpts),
+	)
+}
+
+// TestFilterQueryMatchesWithAWK runs the compiled filters through the actual
+// awk, to make sure that the generated code is valid and does what we want.
+func TestFilterQueryMatchesWithAWK(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not available")
+	}
+
+	lines := []string{
+		`Apr  8 01:02:03 web-01 api[123]: ERROR request failed path=/health status=500`,
+		`Apr  8 01:02:04 web-01 api[123]: info request done path=/users status=200`,
+		`Apr  8 01:02:05 web-02 worker[45]: warning something {"service": "worker", "path":"/healthz"}`,
+		`Apr  8 01:02:06 web-02 cron: [E] job failed service=worker`,
+		`Apr  8 01:02:07 web-01 sshd[9]: Accepted publickey for root`,
+	}
+
+	type testCase struct {
+		query string
+
+		// wantLines are 0-based indices of the matching lines.
+		wantLines []int
+	}
+
+	testCases := []testCase{
+		{query: "level:error", wantLines: []int{0, 3}},
+		{query: "level:error AND NOT path:/health", wantLines: []int{3}},
+		{query: "path:/health", wantLines: []int{0}},
+		{query: "path:/healthz OR service:worker", wantLines: []int{2, 3}},
+		{query: "host:web-02 program:cron", wantLines: []int{3}},
+		{query: "program:/^(api|worker)$/ NOT level:info", wantLines: []int{0, 2}},
+		{query: `"status=200" OR /failed/`, wantLines: []int{0, 1, 3}},
+		{query: "level:unknown", wantLines: []int{4}},
+		{query: "level:unknown OR level:info", wantLines: []int{1, 4}},
+	}
+
+	timeFormat, err := GenerateTimeDescr("Jan _2 15:04:05")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fieldsCfg := NewFilterFieldsConfig(timeFormat)
+
+	for _, tc := range testCases {
+		expr, err := ParseFilterQuery(tc.query)
+		if !assert.NoError(t, err, "query %q", tc.query) {
+			continue
+		}
+
+		awkExpr := CompileFilterQueryToAWK(expr, fieldsCfg, DefaultFilterMatchOpts)
+
+		cmd := exec.Command("awk", awkExpr+" { print NR-1 }")
+		cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+		out, err := cmd.CombinedOutput()
+		if !assert.NoError(t, err, "query %q, awk %q: %s", tc.query, awkExpr, string(out)) {
+			continue
+		}
+
+		var gotLines []int
+		for _, s := range strings.Fields(string(out)) {
+			var n int
+			for _, c := range s {
+				n = n*10 + int(c-'0')
+			}
+			gotLines = append(gotLines, n)
+		}
+
+		assert.Equal(t, tc.wantLines, gotLines, "query %q, awk %q", tc.query, awkExpr)
+	}
+}
+
+func TestCompileFilterQueryToAWKMatchOpts(t *testing.T) {
+	fieldsCfg := FilterFieldsConfig{NumTimestampFields: 3}
+
+	type testCase struct {
+		matchOpts FilterMatchOpts
+		wantAWK   string
+	}
+
+	// The field predicates are not affected.
+	query := `Foo.Bar /Err[A-Z]\S[[:upper:]]/ host:Web-01`
+	hostAWK := `($4 == "Web-01")`
+
+	testCases := []testCase{
+		{
+			matchOpts: FilterMatchOpts{CaseSensitive: true},
+			wantAWK:   `(((index($0, "Foo.Bar") > 0) && ($0 ~ /Err[A-Z]\S[[:upper:]]/)) && ` + hostAWK + `)`,
+		},
+		{
+			matchOpts: FilterMatchOpts{},
+			wantAWK:   `(((index(tolower($0), "foo.bar") > 0) && (tolower($0) ~ /err[a-z]\S[[:upper:]]/)) && ` + hostAWK + `)`,
+		},
+		{
+			matchOpts: FilterMatchOpts{CaseSensitive: true, WholeWord: true},
+			wantAWK: `((($0 ~ /(^|[^A-Za-z0-9_])(Foo\.Bar)([^A-Za-z0-9_]|$)/) && ` +
+				`($0 ~ /(^|[^A-Za-z0-9_])(Err[A-Z]\S[[:upper:]])([^A-Za-z0-9_]|$)/)) && ` + hostAWK + `)`,
+		},
+		{
+			matchOpts: FilterMatchOpts{WholeWord: true},
+			wantAWK: `(((tolower($0) ~ /(^|[^A-Za-z0-9_])(foo\.bar)([^A-Za-z0-9_]|$)/) && ` +
+				`(tolower($0) ~ /(^|[^A-Za-z0-9_])(err[a-z]\S[[:upper:]])([^A-Za-z0-9_]|$)/)) && ` + hostAWK + `)`,
+		},
+	}
+
+	expr, err := ParseFilterQuery(query)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.wantAWK, CompileFilterQueryToAWK(expr, fieldsCfg, tc.matchOpts), "opts %+v", tc.matchOpts)
+	}
+}
+
+func TestFilterQueryMatchOptsWithAWK(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not available")
+	}
+
+	lines := []string{
+		`Apr  8 01:02:03 web-01 api[123]: Request failed: Timeout (a.b)`,
+		`Apr  8 01:02:04 web-01 api[123]: request timeouts: 3`,
+		`Apr  8 01:02:05 web-02 api[123]: TIMEOUT_MS=100 axb`,
+		`Apr  8 01:02:06 web-02 api[123]: got timeout, retrying a.b`,
+	}
+
+	type testCase struct {
+		query     string
+		matchOpts FilterMatchOpts
+
+		// wantLines are 0-based indices of the matching lines.
+		wantLines []int
+	}
+
+	testCases := []testCase{
+		{query: "timeout", matchOpts: FilterMatchOpts{CaseSensitive: true}, wantLines: []int{1, 3}},
+		{query: "timeout", matchOpts: FilterMatchOpts{}, wantLines: []int{0, 1, 2, 3}},
+		{query: "timeout", matchOpts: FilterMatchOpts{CaseSensitive: true, WholeWord: true}, wantLines: []int{3}},
+		{query: "timeout", matchOpts: FilterMatchOpts{WholeWord: true}, wantLines: []int{0, 3}},
+
+		// The special chars are literal, so "." doesn't match "x".
+		{query: `"a.b"`, matchOpts: FilterMatchOpts{WholeWord: true}, wantLines: []int{0, 3}},
+
+		{query: "/time[a-z]+/", matchOpts: FilterMatchOpts{WholeWord: true}, wantLines: []int{0, 1, 3}},
+		{query: "/TIME[A-Z]+/", matchOpts: FilterMatchOpts{CaseSensitive: true}, wantLines: []int{2}},
+		{query: "/TIME[A-Z]+/", matchOpts: FilterMatchOpts{}, wantLines: []int{0, 1, 2, 3}},
+	}
+
+	timeFormat, err := GenerateTimeDescr("Jan _2 15:04:05")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fieldsCfg := NewFilterFieldsConfig(timeFormat)
+
+	for _, tc := range testCases {
+		expr, err := ParseFilterQuery(tc.query)
+		if !assert.NoError(t, err, "query %q", tc.query) {
+			continue
+		}
+
+		awkExpr := CompileFilterQueryToAWK(expr, fieldsCfg, tc.matchOpts)
+
+		cmd := exec.Command("awk", awkExpr+" { print NR-1 }")
+		cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+		out, err := cmd.CombinedOutput()
+		if !assert.NoError(t, err, "query %q, awk %q: %s", tc.query, awkExpr, string(out)) {
+			continue
+		}
+
+		var gotLines []int
+		for _, s := range strings.Fields(string(out)) {
+			var n int
+			for _, c := range s {
+				n = n*10 + int(c-'0')
+			}
+			gotLines = append(gotLines, n)
+		}
+
+		assert.Equal(t, tc.wantLines, gotLines, "query %q, opts %+v, awk %q", tc.query, tc.matchOpts, awkExpr)
+	}
+}
+
+func TestTranslateFilterRegexes(t *testing.T) {
+	expr, err := ParseFilterQuery(`program:/^\w+d$/ OR /id=\d+/`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, TranslateFilterRegexes(expr, AWKDialectGawk))
+	assert.Equal(t, `(or program:/^[A-Za-z0-9_]+d$/ /id=[0-9]+/)`, expr.String())
+
+	expr, err = ParseFilterQuery(`foo AND /bar(?=baz)/`)
+	assert.NoError(t, err)
+
+	err = TranslateFilterRegexes(expr, AWKDialectGawk)
+	var fqErr *FilterQueryError
+	if assert.True(t, errors.As(err, &fqErr), "expected FilterQueryError, got %v", err) {
+		assert.Equal(t, 12, fqErr.Pos)
+		assert.Contains(t, fqErr.Msg, "lookahead")
+	}
+}
+
+func TestAWKRegexLiteral(t *testing.T) {
+	assert.Equal(t, `/foo/`, awkRegexLiteral(`foo`))
+	assert.Equal(t, `/\/api\/v1/`, awkRegexLiteral(`/api\/v1`))
+	assert.Equal(t, `/foo\\/`, awkRegexLiteral(`foo\\`))
+
+	// The trailing unpaired backslash would escape the closing slash.
+	assert.Equal(t, `/foo\\/`, awkRegexLiteral(`foo\`))
+}
+
+func TestFilterCaptures(t *testing.T) {
+	expr, err := ParseFilterQuery(`/status=(?P<status>\d{3})/ AND NOT /x(?P<ignored>y)/ program:/(?P<prog>cron)/`)
+	assert.NoError(t, err)
+	assert.NoError(t, TranslateFilterRegexes(expr, AWKDialectGawk))
+
+	assert.Equal(t,
+		`if (match($0, /status=([0-9]{3})/, nlcapm)) { if (nlcapm[1] != "") { nlcaps = nlcaps "\037" "status=" nlcapm[1] } } `+
+			`if (match($0, /x(y)/, nlcapm)) { if (nlcapm[1] != "") { nlcaps = nlcaps "\037" "ignored=" nlcapm[1] } }`,
+		CompileFilterCapturesToAWK(expr),
+	)
+
+	expr, err = ParseFilterQuery(`/foo(bar)/ level:error`)
+	assert.NoError(t, err)
+	assert.NoError(t, TranslateFilterRegexes(expr, AWKDialectGawk))
+	assert.Equal(t, "", CompileFilterCapturesToAWK(expr))
+
+	assert.Equal(t,
+		map[string]string{"status": "200", "method": "GET", "path": "/a=b"},
+		ParseFilterCaptures("\x1fstatus=200\x1fmethod=GET\x1fpath=/a=b\x1f=bogus"),
+	)
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Group is a single value of the field which the logs are grouped by, along
+// with the number of the matching log lines having this value; see
+// QueryLogsParams.GroupBy.
+type Group struct {
+	Value string
+	Count int
+}
+
+// ParseGroupBy parses the field to group the logs by; the syntax is the same
+// as for a single field of the projection (see ParseProjection), like
+// "program" or "field:ip", except that the timestamp can't be used. If the
+// spec is empty, nil is returned, which means no grouping.
+func ParseGroupBy(spec string) (*ProjectionField, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	if strings.Contains(spec, ",") {
+		return nil, errors.Errorf("can only group by a single field, got %q", spec)
+	}
+
+	p, err := ParseProjection(spec)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(p.Fields) == 0 {
+		return nil, errors.Errorf("can't group by the timestamp; use the histogram instead")
+	}
+
+	return &p.Fields[0], nil
+}
+
+// CompileGroupByToAWK generates the awk code which sets nlgrp to the value
+// of the given field in the current line, or to an empty string if it's not
+// found; the agent then counts the lines by these values, and prints the
+// counts as "g:<count>:<value>" lines.
+//
+// The generated code uses the 3-arg match(), so it needs gawk.
+func CompileGroupByToAWK(f ProjectionField, fieldsCfg FilterFieldsConfig) string {
+	return projectionFieldValueAWK(f, fieldsCfg) + " nlgrp = nlv;"
+}
+
+// parseGroupLine parses the "g:" line printed by the agent, without the "g:"
+// prefix, like "42:sshd".
+func parseGroupLine(line string) (value string, count int, err error) {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return "", 0, errors.Errorf("no count")
+	}
+
+	count, err = strconv.Atoi(line[:idx])
+	if err != nil {
+		return "", 0, errors.Annotatef(err, "parsing count")
+	}
+
+	return line[idx+1:], count, nil
+}
+
+// groupByUnsupportedReason returns why the logstream can't group the logs, or
+// an empty string if it can: only the actual nerdlog_agent.sh groups the logs.
+// The logs from the custom agents which don't print the stats are still
+// grouped on the client (see finalizeCustomAgentResp), so then the reason is
+// not used.
+func groupByUnsupportedReason(ls LogStream) string {
+	if ls.Options.CustomAgent != "" {
+		return "the custom agent"
+	}
+
+	if name := ls.Transport.EmulatedAgent(); name != "" {
+		return fmt.Sprintf("the %s transport", name)
+	}
+
+	return ""
+}
+
+// addGroups adds the counts from src to dst.
+func addGroups(dst, src map[string]int) {
+	for value, count := range src {
+		dst[value] += count
+	}
+}
+
+// sortedGroups returns the groups sorted by the count in descending order, so
+// the top N are the first N; the groups with the same count are sorted by the
+// value.
+func sortedGroups(groups map[string]int) []Group {
+	ret := make([]Group, 0, len(groups))
+	for value, count := range groups {
+		ret = append(ret, Group{Value: value, Count: count})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+
+		return ret[i].Value < ret[j].Value
+	})
+
+	return ret
+}
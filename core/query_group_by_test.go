@@ -0,0 +1,79 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGroupBy(t *testing.T) {
+	f, err := ParseGroupBy(" ")
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	f, err = ParseGroupBy("field:ip")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ProjectionField{Kind: ProjectionFieldKeyValue, Name: "ip"}, f)
+	}
+
+	f, err = ParseGroupBy("host")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ProjectionField{Kind: ProjectionFieldHostname}, f)
+	}
+
+	for _, spec := range []string{"timestamp", "program,pid", "foo", "field:"} {
+		_, err := ParseGroupBy(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestQueryGroupBy(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	groupsByLStream := map[string]map[string]int{
+		"fake-01": {"10.0.0.1": 5, "10.0.0.2": 1, "10.0.0.3": 2},
+		"fake-02": {"10.0.0.2": 7, "10.0.0.3": 2, "10.0.0.4": 1},
+	}
+
+	n, err := New(Options{
+		LStreams: "fake-01,fake-02",
+		NewTransport: func(ls LogStream) ShellTransport {
+			return &fakeShellTransport{logs: logs, queryGroups: groupsByLStream[ls.Name]}
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The counts from both logstreams are summed up, and sorted by the count.
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour), GroupBy: "field:ip"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Group{
+		{Value: "10.0.0.2", Count: 8},
+		{Value: "10.0.0.1", Count: 5},
+		{Value: "10.0.0.3", Count: 4},
+		{Value: "10.0.0.4", Count: 1},
+	}, resp.Groups)
+
+	// The logs are returned as usual.
+	assert.Equal(t, 2, resp.NumMsgsTotal)
+
+	// Without the group by, there are no groups.
+	resp, err = n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, resp.Groups)
+}
@@ -0,0 +1,28 @@
+package core
+
+import "fmt"
+
+// pinLastNow is the --pin-last value which makes the agent pin the latest log
+// file at its current size; see QueryLogsParams.Pin.
+const pinLastNow = "-"
+
+// pinUnsupportedReason returns why the logstream can't be pinned, or an empty
+// string if it can: only the actual nerdlog_agent.sh reads the log files in a
+// way which can be pinned. The journalctl logstreams can't be pinned either,
+// but that's only known on the host, so the agent warns about it.
+func pinUnsupportedReason(ls LogStream) string {
+	if ls.Options.CustomAgent != "" {
+		return "the custom agent"
+	}
+
+	if name := ls.Transport.EmulatedAgent(); name != "" {
+		return fmt.Sprintf("the %s transport", name)
+	}
+
+	// Every source has its own log files, while there is a single pin.
+	if len(ls.Sources) > 0 {
+		return "the logstream with multiple log sources"
+	}
+
+	return ""
+}
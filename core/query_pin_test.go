@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestQueryPin checks that the pinned queries return the same results
+// despite the logs growing between them, until they're unpinned.
+func TestQueryPin(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	from := localhostTestFrom()
+
+	nextMsg := 0
+	appendLogs := func(n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			appendLocalhostTestLog(t, logPath, localhostTestLogLine(
+				from.Add(time.Duration(nextMsg)*time.Minute), fmt.Sprintf("myhost app[1]: msg %d", nextMsg),
+			))
+			nextMsg++
+		}
+	}
+
+	appendLogs(5)
+
+	n := newLocalhostTestNerdlog(t, "query_pin_test", ConfigLogStreams{
+		"myhost": localhostTestLogStream(logPath),
+	})
+
+	query := func(pin bool) *LogRespTotal {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		resp, err := n.Query(ctx, QueryLogsParams{
+			From:        from,
+			To:          from.Add(time.Hour),
+			MaxNumLines: 100,
+			Pin:         pin,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	pinned1 := query(true)
+	assert.Equal(t, 5, len(pinned1.Logs))
+	assert.Empty(t, pinned1.Warnings)
+
+	// The logs keep growing, but the pinned query still reads the same bytes.
+	appendLogs(3)
+
+	pinned2 := query(true)
+	assert.Equal(t, pinned1.Logs, pinned2.Logs)
+	assert.Equal(t, pinned1.MinuteStats, pinned2.MinuteStats)
+	assert.Equal(t, pinned1.NumMsgsTotal, pinned2.NumMsgsTotal)
+	assert.Empty(t, pinned2.Warnings)
+
+	// The unpinned query gets the new logs, and drops the pins.
+	live := query(false)
+	assert.Equal(t, 8, len(live.Logs))
+
+	// So the next pinned query pins the logs anew.
+	appendLogs(2)
+
+	pinned3 := query(true)
+	assert.Equal(t, 10, len(pinned3.Logs))
+
+	// After the rotation, the pin can't be honored anymore.
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(logPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	appendLogs(1)
+
+	pinned4 := query(true)
+	assert.Equal(t, 11, len(pinned4.Logs))
+	assert.Contains(
+		t, pinned4.Warnings,
+		fmt.Sprintf("myhost: log %s rotated since it was pinned, so it's read live; re-pin to get reproducible results", logPath),
+	)
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ProjectionFieldKind is the kind of a field in the Projection.
+type ProjectionFieldKind string
+
+const (
+	// ProjectionFieldTimestamp is the timestamp of the log line. It's always
+	// included in the projection, even if not specified explicitly, since we
+	// can't do anything with the log lines without the timestamps.
+	ProjectionFieldTimestamp ProjectionFieldKind = "timestamp"
+
+	// ProjectionFieldHostname, ProjectionFieldProgram and ProjectionFieldPid
+	// are the fields of the syslog-like header.
+	ProjectionFieldHostname ProjectionFieldKind = "hostname"
+	ProjectionFieldProgram  ProjectionFieldKind = "program"
+	ProjectionFieldPid      ProjectionFieldKind = "pid"
+
+	// ProjectionFieldKeyValue is a field from the message, either key=value
+	// (optionally quoted) or "key":"value", the same way as the filter
+	// language finds them.
+	ProjectionFieldKeyValue ProjectionFieldKind = "field"
+)
+
+// projectionFieldAliases maps alternative names to the canonical ones.
+var projectionFieldAliases = map[string]ProjectionFieldKind{
+	"time":     ProjectionFieldTimestamp,
+	"host":     ProjectionFieldHostname,
+	"hostname": ProjectionFieldHostname,
+}
+
+// ProjectionField is a single field of the Projection.
+type ProjectionField struct {
+	Kind ProjectionFieldKind
+
+	// Name is only relevant for ProjectionFieldKeyValue: it's the key of the
+	// field to extract.
+	Name string
+}
+
+// ContextKey returns the key of LogMsg.Context which the field is populated
+// to.
+func (f ProjectionField) ContextKey() string {
+	if f.Kind == ProjectionFieldKeyValue {
+		return f.Name
+	}
+
+	return string(f.Kind)
+}
+
+func (f ProjectionField) String() string {
+	if f.Kind == ProjectionFieldKeyValue {
+		return fmt.Sprintf("%s:%s", ProjectionFieldKeyValue, f.Name)
+	}
+
+	return string(f.Kind)
+}
+
+// Projection specifies which fields of the log lines the agent should output,
+// instead of the full lines, to reduce the amount of data transferred from
+// the hosts and parsed. See ParseProjection.
+type Projection struct {
+	// Fields doesn't include the timestamp, which is always there.
+	Fields []ProjectionField
+}
+
+func (p *Projection) String() string {
+	parts := []string{string(ProjectionFieldTimestamp)}
+	for _, f := range p.Fields {
+		parts = append(parts, f.String())
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// ParseProjection parses the comma-separated list of fields, like this:
+//
+//	timestamp,host,program,field:status
+//
+// The timestamp is always included, even if not specified. If the spec is
+// empty, nil is returned, which means the full lines.
+func ParseProjection(spec string) (*Projection, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	p := &Projection{}
+	seen := map[string]struct{}{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return nil, errors.Errorf("empty field in projection %q", spec)
+		}
+
+		var field ProjectionField
+
+		if strings.HasPrefix(item, string(ProjectionFieldKeyValue)+":") {
+			name := strings.TrimPrefix(item, string(ProjectionFieldKeyValue)+":")
+			if name == "" {
+				return nil, errors.Errorf("no field name in %q", item)
+			}
+
+			for i := 0; i < len(name); i++ {
+				if !isFilterFieldChar(name[i], i == 0) {
+					return nil, errors.Errorf("invalid field name %q", name)
+				}
+			}
+
+			field = ProjectionField{Kind: ProjectionFieldKeyValue, Name: name}
+		} else {
+			kind, ok := projectionFieldAliases[item]
+			if !ok {
+				kind = ProjectionFieldKind(item)
+			}
+
+			switch kind {
+			case ProjectionFieldTimestamp:
+				continue
+			case ProjectionFieldHostname, ProjectionFieldProgram, ProjectionFieldPid:
+				field = ProjectionField{Kind: kind}
+			default:
+				return nil, errors.Errorf(
+					"invalid projection field %q; valid ones are: timestamp, host, program, pid, field:<name>",
+					item,
+				)
+			}
+		}
+
+		if _, ok := seen[field.ContextKey()]; ok {
+			continue
+		}
+		seen[field.ContextKey()] = struct{}{}
+
+		p.Fields = append(p.Fields, field)
+	}
+
+	return p, nil
+}
+
+// projectionSeparator separates the fields in the projected log lines; it's
+// the same as the filterCapturesSeparator, so the fields are parsed by
+// ParseFilterCaptures.
+const projectionSeparator = filterCapturesSeparator
+
+// CompileProjectionToAWK generates the awk code which replaces the current
+// line ($0) with the projected one: the timestamp, followed by the fields as
+// "name=value", all separated by the projectionSeparator, like
+// "Mar 10 10:00:00\x1fhostname=myhost\x1fstatus=500". The fields which aren't
+// found in the line are omitted, but the separator after the timestamp is
+// always there, so that the projected lines can be told apart from the full
+// ones.
+//
+// The generated code uses the 3-arg match(), so it needs gawk.
+func CompileProjectionToAWK(p *Projection, fieldsCfg FilterFieldsConfig) string {
+	var sb strings.Builder
+
+	if fieldsCfg.JSONTimestampField != "" {
+		// The JSON logs don't start with the timestamp, so take it from its
+		// field.
+		sb.WriteString(fmt.Sprintf(
+			`nlproj = %s "\037"; nlsep = ""; `, jsonGetAWKExpr(fieldsCfg.JSONTimestampField),
+		))
+	} else {
+		// Find where the timestamp ends, preserving the original whitespace
+		// between the timestamp fields, since e.g. "Mar  5" has two spaces.
+		sb.WriteString("nlpos = 0; ")
+		sb.WriteString(fmt.Sprintf(
+			"for (nli = 1; nli <= %d && nli <= NF; nli++) { nlpos += index(substr($0, nlpos + 1), $nli) + length($nli) - 1; } ",
+			fieldsCfg.NumTimestampFields,
+		))
+		sb.WriteString(`nlproj = substr($0, 1, nlpos) "\037"; nlsep = ""; `)
+	}
+
+	for _, f := range p.Fields {
+		sb.WriteString(projectionFieldValueAWK(f, fieldsCfg))
+		sb.WriteString(fmt.Sprintf(
+			` if (nlv != "") { nlproj = nlproj nlsep %s nlv; nlsep = "\037"; } `,
+			awkStringLiteral(f.ContextKey()+"="),
+		))
+	}
+
+	sb.WriteString("$0 = nlproj;")
+
+	return sb.String()
+}
+
+// projectionFieldValueAWK generates the awk code which sets nlv to the value
+// of the given field in the current line ($0), or to an empty string if it's
+// not found. Needs gawk for the 3-arg match(), unless the logs are JSON.
+func projectionFieldValueAWK(f ProjectionField, fieldsCfg FilterFieldsConfig) string {
+	if fieldsCfg.JSONTimestampField != "" {
+		// In the JSON logs, all the fields are looked up by their paths.
+		return fmt.Sprintf("nlv = %s;", jsonGetAWKExpr(f.ContextKey()))
+	}
+
+	hostnameField := fmt.Sprintf("$%d", fieldsCfg.NumTimestampFields+1)
+	programField := fmt.Sprintf("$%d", fieldsCfg.NumTimestampFields+2)
+
+	var valueCode string
+
+	switch f.Kind {
+	case ProjectionFieldHostname:
+		valueCode = fmt.Sprintf("nlv = %s;", hostnameField)
+
+	case ProjectionFieldProgram:
+		// The program is followed by an optional pid in square brackets, and
+		// a colon, like "sshd[1234]:".
+		valueCode = fmt.Sprintf(
+			`nlv = ""; if (match(%s, /^[^:[]+/)) { nlv = substr(%s, RSTART, RLENGTH); }`,
+			programField, programField,
+		)
+
+	case ProjectionFieldPid:
+		valueCode = fmt.Sprintf(
+			`nlv = ""; if (match(%s, /\[[0-9]+\]/)) { nlv = substr(%s, RSTART + 1, RLENGTH - 2); }`,
+			programField, programField,
+		)
+
+	case ProjectionFieldKeyValue:
+		// Same as the filter language looks for fields, but capturing the
+		// value: either key=value (optionally quoted) or "key":"value" (or a
+		// non-string JSON value).
+		key := regexQuoteMeta(f.Name)
+		re := fmt.Sprintf(
+			`(^|[^A-Za-z0-9_.-])%s=("([^"]*)"|([^ \t"]+))|"%s": *("([^"]*)"|([^ \t",}]+))`,
+			key, key,
+		)
+
+		valueCode = fmt.Sprintf(
+			`nlv = ""; if (match($0, %s, nlpm)) { nlv = nlpm[3] nlpm[4] nlpm[6] nlpm[7]; }`,
+			awkRegexLiteral(re),
+		)
+
+	default:
+		panic(fmt.Sprintf("unexpected projection field kind %q", f.Kind))
+	}
+
+	return valueCode
+}
+
+// parseProjectedLine splits the projected log line, as generated by the code
+// from CompileProjectionToAWK, into the timestamp and the fields. If the line
+// isn't actually projected (e.g. when the agent doesn't support projections),
+// ok is false.
+func parseProjectedLine(line string) (timestamp string, fields map[string]string, ok bool) {
+	idx := strings.Index(line, projectionSeparator)
+	if idx < 0 {
+		return "", nil, false
+	}
+
+	return line[:idx], ParseFilterCaptures(line[idx+1:]), true
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProjection(t *testing.T) {
+	p, err := ParseProjection("")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = ParseProjection("timestamp, host ,program,pid,field:status,hostname")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []ProjectionField{
+			{Kind: ProjectionFieldHostname},
+			{Kind: ProjectionFieldProgram},
+			{Kind: ProjectionFieldPid},
+			{Kind: ProjectionFieldKeyValue, Name: "status"},
+		}, p.Fields)
+		assert.Equal(t, "timestamp,hostname,program,pid,field:status", p.String())
+	}
+
+	for _, spec := range []string{"foo", "host,,pid", "field:", "field:foo bar", "field:=x"} {
+		_, err := ParseProjection(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// runProjectionAWK runs the projection code on every line with the given awk
+// binary, and returns the output lines.
+func runProjectionAWK(t *testing.T, awkBinary string, p *Projection, lines ...string) []string {
+	code := CompileProjectionToAWK(p, FilterFieldsConfig{NumTimestampFields: 3})
+
+	cmd := exec.Command(awkBinary, "{ "+code+" print $0 }")
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running awk: %s", err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
+
+func TestCompileProjectionToAWK(t *testing.T) {
+	awkBinary, err := exec.LookPath("awk")
+	if err != nil {
+		t.Skip("no awk")
+	}
+
+	lines := []string{
+		"Mar  5 10:00:00 myhost sshd[123]: Accepted key status=200",
+		"Mar 10 10:00:01 otherhost kernel: foo",
+	}
+
+	// Only the selected header fields are printed, and the timestamp is
+	// preserved as is, including the double spaces.
+	assert.Equal(t, []string{
+		"Mar  5 10:00:00\x1fhostname=myhost\x1fprogram=sshd\x1fpid=123",
+		"Mar 10 10:00:01\x1fhostname=otherhost\x1fprogram=kernel",
+	}, runProjectionAWK(t, awkBinary, &Projection{
+		Fields: []ProjectionField{
+			{Kind: ProjectionFieldHostname},
+			{Kind: ProjectionFieldProgram},
+			{Kind: ProjectionFieldPid},
+		},
+	}, lines...))
+
+	// Just the timestamp.
+	assert.Equal(t, []string{
+		"Mar  5 10:00:00\x1f",
+		"Mar 10 10:00:01\x1f",
+	}, runProjectionAWK(t, awkBinary, &Projection{}, lines...))
+}
+
+func TestCompileProjectionToAWKFields(t *testing.T) {
+	p := &Projection{
+		Fields: []ProjectionField{{Kind: ProjectionFieldKeyValue, Name: "status"}},
+	}
+
+	code := CompileProjectionToAWK(p, FilterFieldsConfig{NumTimestampFields: 3})
+	assert.Contains(t, code, `if (match($0, /(^|[^A-Za-z0-9_.-])status=("([^"]*)"|([^ \t"]+))|"status": *("([^"]*)"|([^ \t",}]+))/, nlpm)) { nlv = nlpm[3] nlpm[4] nlpm[6] nlpm[7]; }`)
+	assert.Contains(t, code, `nlproj = nlproj nlsep "status=" nlv;`)
+
+	// The fields extraction needs the 3-arg match, which is gawk-only.
+	gawkBinary, err := exec.LookPath("gawk")
+	if err != nil {
+		t.Skip("no gawk")
+	}
+	if out, _ := exec.Command(gawkBinary, "--version").Output(); strings.Contains(string(out), "(fake)") {
+		t.Skip("no real gawk")
+	}
+
+	assert.Equal(t, []string{
+		"Mar 10 10:00:00\x1fstatus=500",
+		"Mar 10 10:00:01\x1fstatus=not found",
+		"Mar 10 10:00:02\x1fstatus=201",
+		"Mar 10 10:00:03\x1f",
+	}, runProjectionAWK(t, gawkBinary, p,
+		"Mar 10 10:00:00 myhost app[1]: foo status=500 bar",
+		`Mar 10 10:00:01 myhost app[1]: foo status="not found"`,
+		`Mar 10 10:00:02 myhost app[1]: {"msg": "foo", "status": 201}`,
+		"Mar 10 10:00:03 myhost app[1]: foo xstatus=500",
+	))
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ErrStaleResumeToken is returned when resuming a query with the
+// QueryResumeToken which can't be used anymore: another query was started
+// since the one which returned the token, or the logstreams have changed.
+var ErrStaleResumeToken = errors.New("the query can't be resumed anymore, run it again")
+
+// QueryResumeToken is returned in LogRespTotal.ResumeToken when a query has
+// failed on some logstreams (e.g. because the connection has dropped), while
+// the others have delivered their logs. Passing it as
+// QueryLogsParams.ResumeToken resumes the query: only the Pending logstreams
+// are queried again, and the result is merged with the logs which were
+// already delivered, as if the original query has succeeded.
+//
+// The delivered logs are kept by the LStreamsManager, so the token is only
+// valid until the next query is started.
+type QueryResumeToken struct {
+	// queryID is the ID of the failed query.
+	queryID int
+
+	// Delivered maps the names of the logstreams which have delivered their
+	// logs to the position of the latest delivered message.
+	Delivered map[string]LStreamResumePos
+
+	// Pending contains the sorted names of the logstreams which have failed,
+	// and will be queried on resume.
+	Pending []string
+}
+
+// LStreamResumePos is the position in the logstream up to which the logs were
+// delivered.
+type LStreamResumePos struct {
+	// LastTime is the timestamp of the latest delivered message, and
+	// NumMsgsAtLastTime is the number of the delivered messages with this
+	// timestamp. Both are zero if there were no messages.
+	LastTime          time.Time
+	NumMsgsAtLastTime int
+
+	// LastLinenumber is the LogMsg.CombinedLinenumber of the latest delivered
+	// message in the log files; it's zero for journalctl, where the messages
+	// are only addressed by the timestamps.
+	LastLinenumber int
+}
+
+// manResumableQuery is what the LStreamsManager keeps for the failed query
+// to be able to resume it.
+type manResumableQuery struct {
+	token *QueryResumeToken
+
+	req *QueryLogsParams
+
+	// resps contains the responses from the logstreams which have delivered
+	// their logs.
+	resps map[string]*LogResp
+
+	skipped []string
+}
+
+// saveResumableQuery is called when the current query has failed on some
+// logstreams (the ones in errs), and it saves the responses from the rest, so
+// that the query can be resumed later. It returns the token to resume it, or
+// nil if there is nothing to resume.
+//
+// Loading earlier or newer logs can't be resumed, since they depend on the
+// logs we had before.
+func (lsman *LStreamsManager) saveResumableQuery(
+	resps map[string]*LogResp, errs map[string]error,
+) *QueryResumeToken {
+	lsman.resumableQuery = nil
+
+	req := lsman.curQueryLogsCtx.req
+	if req.LoadEarlier || req.LoadNewer {
+		return nil
+	}
+
+	token := &QueryResumeToken{
+		queryID:   lsman.curQueryLogsCtx.id,
+		Delivered: map[string]LStreamResumePos{},
+	}
+
+	delivered := map[string]*LogResp{}
+	for name, resp := range resps {
+		if _, failed := errs[name]; failed {
+			token.Pending = append(token.Pending, name)
+			continue
+		}
+
+		delivered[name] = resp
+		token.Delivered[name] = getLStreamResumePos(resp.Logs)
+	}
+
+	if len(delivered) == 0 {
+		return nil
+	}
+
+	sort.Strings(token.Pending)
+
+	lsman.resumableQuery = &manResumableQuery{
+		token:   token,
+		req:     req,
+		resps:   delivered,
+		skipped: lsman.curQueryLogsCtx.skipped,
+	}
+
+	return token
+}
+
+// getResumableQuery returns the saved query for the given token, or
+// ErrStaleResumeToken.
+func (lsman *LStreamsManager) getResumableQuery(token *QueryResumeToken) (*manResumableQuery, error) {
+	rq := lsman.resumableQuery
+	if rq == nil || rq.token.queryID != token.queryID {
+		return nil, ErrStaleResumeToken
+	}
+
+	// All the logstreams must still be there.
+	for name := range rq.resps {
+		if _, ok := lsman.lscs[name]; !ok {
+			return nil, ErrStaleResumeToken
+		}
+	}
+
+	for _, name := range rq.token.Pending {
+		if _, ok := lsman.lscs[name]; !ok {
+			return nil, ErrStaleResumeToken
+		}
+	}
+
+	return rq, nil
+}
+
+func getLStreamResumePos(logs []LogMsg) LStreamResumePos {
+	if len(logs) == 0 {
+		return LStreamResumePos{}
+	}
+
+	last := logs[len(logs)-1]
+
+	pos := LStreamResumePos{
+		LastTime: last.Time,
+	}
+
+	if !IsTimestampAddressed(last.LogFilename) {
+		pos.LastLinenumber = last.CombinedLinenumber
+	}
+
+	for i := len(logs) - 1; i >= 0 && logs[i].Time.Equal(last.Time); i-- {
+		pos.NumMsgsAtLastTime++
+	}
+
+	return pos
+}
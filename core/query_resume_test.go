@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryResume(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	lstreamNames := []string{"fake-01", "fake-02", "fake-03"}
+	agentCmds := map[string]*fakeLogs{}
+	for _, name := range lstreamNames {
+		agentCmds[name] = &fakeLogs{}
+	}
+
+	fail02 := int32(1)
+
+	n, err := New(Options{
+		LStreams: strings.Join(lstreamNames, ","),
+		NewTransport: func(ls LogStream) ShellTransport {
+			transport := &fakeShellTransport{logs: logs, agentCmds: agentCmds[ls.Name]}
+			if ls.Name == "fake-02" {
+				transport.queryFails = func() bool {
+					return atomic.LoadInt32(&fail02) == 1
+				}
+			}
+
+			return transport
+		},
+		ClientID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	numQueries := func() map[string]int {
+		ret := map[string]int{}
+		for name, cmds := range agentCmds {
+			for _, cmd := range cmds.get() {
+				if strings.Contains(cmd, " query ") {
+					ret[name]++
+				}
+			}
+		}
+
+		return ret
+	}
+
+	resp, err := n.Query(ctx, QueryLogsParams{From: now.Add(-time.Hour)})
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Contains(t, err.Error(), "fake-02")
+
+	token := resp.ResumeToken
+	if !assert.NotNil(t, token) {
+		return
+	}
+	assert.Equal(t, []string{"fake-02"}, token.Pending)
+	assert.Equal(t, map[string]LStreamResumePos{
+		"fake-01": {LastTime: now.Add(-time.Minute).UTC(), NumMsgsAtLastTime: 1, LastLinenumber: 2},
+		"fake-03": {LastTime: now.Add(-time.Minute).UTC(), NumMsgsAtLastTime: 1, LastLinenumber: 2},
+	}, token.Delivered)
+
+	// If it fails again, there's a new token, and the logstreams which have
+	// delivered their logs are not queried again.
+	resp, err = n.Query(ctx, QueryLogsParams{ResumeToken: token})
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"fake-01": 1, "fake-02": 2, "fake-03": 1}, numQueries())
+
+	if !assert.NotNil(t, resp.ResumeToken) {
+		return
+	}
+	assert.Equal(t, token.Pending, resp.ResumeToken.Pending)
+	assert.Equal(t, token.Delivered, resp.ResumeToken.Delivered)
+	token = resp.ResumeToken
+
+	// Once it succeeds, the result contains the logs from all the logstreams,
+	// without duplicates.
+	atomic.StoreInt32(&fail02, 0)
+
+	resp, err = n.Query(ctx, QueryLogsParams{ResumeToken: token})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"fake-01": 1, "fake-02": 3, "fake-03": 1}, numQueries())
+
+	var msgs []string
+	for _, msg := range resp.Logs {
+		msgs = append(msgs, fmt.Sprintf("%s:%s", msg.Context["lstream"], msg.Msg))
+	}
+	assert.Equal(t, []string{
+		"fake-01:foo", "fake-02:foo", "fake-03:foo",
+		"fake-01:bar", "fake-02:bar", "fake-03:bar",
+	}, msgs)
+	assert.Equal(t, 6, resp.NumMsgsTotal)
+	assert.Nil(t, resp.ResumeToken)
+
+	// The token can't be used again.
+	_, err = n.Query(ctx, QueryLogsParams{ResumeToken: token})
+	assert.Equal(t, ErrStaleResumeToken, errors.Cause(err))
+}
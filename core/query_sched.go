@@ -0,0 +1,114 @@
+package core
+
+// DefaultMaxConcurrentQueries is the default max number of queries which can
+// be in flight at the same time for a single logstream, if the transport
+// supports multiple sessions (e.g. ssh-lib can open multiple session channels
+// over the same connection).
+const DefaultMaxConcurrentQueries = 3
+
+// ShellConnMultiSession is implemented by the ShellConn-s which can open
+// additional shell sessions over the same underlying connection; e.g. ssh
+// can have multiple session channels. Pipe-based transports (like the
+// custom-cmd one) don't implement it, since they only have a single
+// stdin/stdout/stderr.
+type ShellConnMultiSession interface {
+	// NewSession opens a new independent shell session. It needs to be closed
+	// separately; but closing the parent connection closes all its sessions as
+	// well.
+	NewSession() (ShellConn, error)
+}
+
+type querySchedAction int
+
+const (
+	// querySchedActionStart means that the command should be started right
+	// away on the main session.
+	querySchedActionStart querySchedAction = iota
+
+	// querySchedActionStartSession means that the command should be started
+	// right away on a new additional session, concurrently with whatever is
+	// running on the main session.
+	querySchedActionStartSession
+
+	// querySchedActionEnqueue means that the command should wait in the queue.
+	querySchedActionEnqueue
+)
+
+// queryScheduler decides how to run every next command for the logstream:
+// if the transport supports multiple sessions, queries are executed
+// concurrently, each on its own session (up to a cap); otherwise, they are
+// all serialized through the main session.
+type queryScheduler struct {
+	// maxSessions is the max number of additional sessions which can be opened
+	// at the same time; it's 0 if the transport doesn't support them.
+	maxSessions int
+
+	// numSessions is the number of additional sessions currently open.
+	numSessions int
+}
+
+// newQueryScheduler creates a scheduler for the given connection;
+// maxConcurrent is the max number of queries to run at the same time
+// (including the one on the main session), if the connection supports it.
+func newQueryScheduler(conn ShellConn, maxConcurrent int) *queryScheduler {
+	qs := &queryScheduler{}
+
+	if _, ok := conn.(ShellConnMultiSession); ok && maxConcurrent > 1 {
+		qs.maxSessions = maxConcurrent - 1
+	}
+
+	return qs
+}
+
+// schedule returns what to do with the new command. mainCmd is the command
+// currently running on the main session, or nil if it's idle; numQueued is
+// the number of commands already waiting in the queue.
+func (qs *queryScheduler) schedule(
+	cmd lstreamCmd, mainCmd *lstreamCmd, numQueued int,
+) querySchedAction {
+	// Never let commands jump the queue.
+	if numQueued > 0 {
+		return querySchedActionEnqueue
+	}
+
+	// The refresh-index query deletes the index file, so it must not run
+	// concurrently with any other query.
+	refreshIndex := cmd.queryLogs != nil && cmd.queryLogs.refreshIndex
+
+	if mainCmd == nil {
+		if refreshIndex && qs.numSessions > 0 {
+			return querySchedActionEnqueue
+		}
+
+		return querySchedActionStart
+	}
+
+	switch {
+	case cmd.queryLogs == nil || refreshIndex:
+		// Only regular queries can run on the additional sessions.
+		return querySchedActionEnqueue
+
+	case mainCmd.queryLogs == nil || mainCmd.queryLogs.refreshIndex:
+		// The main session is bootstrapping (so we can't run queries yet), or
+		// pinging or verifying (which is quick), or running an ad hoc command
+		// (which is bounded by a timeout), or refreshing the index (so we can't
+		// run other queries concurrently).
+		return querySchedActionEnqueue
+
+	case qs.numSessions >= qs.maxSessions:
+		return querySchedActionEnqueue
+	}
+
+	return querySchedActionStartSession
+}
+
+// sessionStarted must be called whenever an additional session is opened
+// as a result of querySchedActionStartSession.
+func (qs *queryScheduler) sessionStarted() {
+	qs.numSessions++
+}
+
+// sessionDone must be called whenever an additional session is closed.
+func (qs *queryScheduler) sessionDone() {
+	qs.numSessions--
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuerySchedulerSSHLibConcurrent(t *testing.T) {
+	qs := newQueryScheduler(&ShellConnSSHLib{}, 2)
+
+	query1 := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{}}
+	query2 := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{}}
+	query3 := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{}}
+
+	// First query runs on the main session, and the second one runs
+	// concurrently on a new session.
+	assert.Equal(t, querySchedActionStart, qs.schedule(query1, nil, 0))
+	assert.Equal(t, querySchedActionStartSession, qs.schedule(query2, &query1, 0))
+	qs.sessionStarted()
+
+	// But we're at the cap now, so the third one has to wait.
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(query3, &query1, 0))
+
+	qs.sessionDone()
+	assert.Equal(t, querySchedActionStartSession, qs.schedule(query3, &query1, 0))
+
+	// Queries never jump the queue.
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(query3, &query1, 1))
+}
+
+func TestQuerySchedulerCustomCmdSerial(t *testing.T) {
+	qs := newQueryScheduler(&ShellConnCustomCmd{}, 2)
+
+	query1 := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{}}
+	query2 := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{}}
+
+	assert.Equal(t, querySchedActionStart, qs.schedule(query1, nil, 0))
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(query2, &query1, 0))
+
+	// Once the main session is idle, the next one can run.
+	assert.Equal(t, querySchedActionStart, qs.schedule(query2, nil, 0))
+}
+
+func TestQuerySchedulerNonConcurrentCmds(t *testing.T) {
+	qs := newQueryScheduler(&ShellConnSSHLib{}, 3)
+
+	bootstrap := lstreamCmd{bootstrap: &lstreamCmdBootstrap{}}
+	ping := lstreamCmd{ping: &lstreamCmdPing{}}
+	query := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{}}
+	refresh := lstreamCmd{queryLogs: &lstreamCmdQueryLogs{refreshIndex: true}}
+
+	// Queries have to wait for the bootstrap.
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(query, &bootstrap, 0))
+
+	// Only queries can run on additional sessions.
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(ping, &query, 0))
+
+	// Refreshing the index can't run concurrently with other queries.
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(refresh, &query, 0))
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(query, &refresh, 0))
+
+	qs.sessionStarted()
+	assert.Equal(t, querySchedActionEnqueue, qs.schedule(refresh, nil, 0))
+	assert.Equal(t, querySchedActionStart, qs.schedule(query, nil, 0))
+}
+
+// fakeMultiSessionTransport is a fakeShellTransport whose connections can
+// open additional sessions, like the ssh-lib ones can. The queryGate only
+// applies to the main session: the queries on the additional ones respond
+// right away.
+type fakeMultiSessionTransport struct {
+	fakeShellTransport
+}
+
+func (t *fakeMultiSessionTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	innerResCh := make(chan ShellConnUpdate, 1)
+	t.fakeShellTransport.Connect(ctx, innerResCh)
+
+	upd := <-innerResCh
+	upd.Result.Conn = &fakeMultiSessionConn{
+		fakeShellConn: upd.Result.Conn.(*fakeShellConn),
+		transport:     t,
+	}
+
+	resCh <- upd
+}
+
+type fakeMultiSessionConn struct {
+	*fakeShellConn
+
+	transport *fakeMultiSessionTransport
+}
+
+var _ ShellConnMultiSession = &fakeMultiSessionConn{}
+
+func (c *fakeMultiSessionConn) NewSession() (ShellConn, error) {
+	sessTransport := c.transport.fakeShellTransport
+	sessTransport.queryGate = nil
+
+	resCh := make(chan ShellConnUpdate, 1)
+	sessTransport.Connect(context.Background(), resCh)
+
+	return (<-resCh).Result.Conn, nil
+}
+
+func TestQuerySchedLStreamsManager(t *testing.T) {
+	for _, tc := range []struct {
+		descr        string
+		multiSession bool
+	}{
+		{descr: "ssh-lib", multiSession: true},
+		{descr: "custom-cmd", multiSession: false},
+	} {
+		t.Run(tc.descr, func(t *testing.T) {
+			queryGate := make(chan struct{})
+			defer close(queryGate)
+
+			logs := &fakeLogs{}
+			logs.add(fakeLogLine(time.Now().Add(-time.Minute), "foo"))
+
+			env := &throttleTestEnv{
+				t:         t,
+				updatesCh: make(chan LStreamsManagerUpdate, 1024),
+				agentCmds: map[string]*fakeLogs{"fake-01": {}},
+			}
+
+			env.start(LStreamsManagerParams{
+				InitialLStreams: "fake-01",
+				QueryDebounce:   10 * time.Millisecond,
+				NewTransport: func(ls LogStream) ShellTransport {
+					transport := fakeShellTransport{
+						logs:      logs,
+						agentCmds: env.agentCmds[ls.Name],
+						queryGate: queryGate,
+					}
+
+					if tc.multiSession {
+						return &fakeMultiSessionTransport{fakeShellTransport: transport}
+					}
+
+					return &transport
+				},
+			})
+			defer env.close()
+
+			// The first query hangs on the host, and the second one supersedes it,
+			// so both of them are in flight on the same logstream.
+			env.query("q1")
+			env.waitQueries("fake-01", []string{"q1"})
+
+			env.query("q2")
+			assertQuerySuperseded(t, env.nextLogResp())
+
+			if tc.multiSession {
+				// The second query runs on another session, and responds while the
+				// first one is still hanging.
+				env.waitQueries("fake-01", []string{"q1", "q2"})
+			} else {
+				// The second query waits for the first one to finish.
+				time.Sleep(100 * time.Millisecond)
+				assert.Equal(t, []string{"q1"}, env.queries("fake-01"))
+
+				queryGate <- struct{}{}
+				env.waitQueries("fake-01", []string{"q1", "q2"})
+
+				// And it's gated too, so let it respond.
+				queryGate <- struct{}{}
+			}
+
+			resp := env.nextLogResp()
+			assert.Equal(t, 0, len(resp.Errs))
+			assert.Equal(t, 1, len(resp.Logs))
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ErrQueryStopped is the error in the LogRespTotal of the query which was
+// stopped by LStreamsManager.StopQuery before it was done.
+var ErrQueryStopped = errors.Errorf("query stopped")
+
+// queryStoppedPrefix is the prefix of the lines printed by the
+// stopQueryScript once the query is stopped, followed by the command idx;
+// it's printed to both stdout and stderr, and it's used instead of the
+// "command_done:" line of the stopped query.
+const queryStoppedPrefix = "query_stopped:"
+
+// compressedAbortedMarker is printed by the stopQueryScript in case the
+// query was stopped in the middle of the compressed output, so that the
+// partial compressed data is discarded instead of being decompressed; see
+// getScannerFunc.
+const compressedAbortedMarker = "compressed_aborted"
+
+// backgroundQueryCmd wraps the query command written on the main session, so
+// that it runs in the background, and the shell can read the
+// stopQueryScript while the query is running. The command_done lines are
+// printed by the background job itself once the query is done, and the pid
+// of the job is remembered in $nlqpid.
+func backgroundQueryCmd(cmd string, idx int, busybox bool) string {
+	var sb strings.Builder
+
+	sb.WriteString("{\n")
+	sb.WriteString(cmd)
+	sb.WriteString(commandDoneCmds(idx, busybox))
+	sb.WriteString("} </dev/null &\n")
+	sb.WriteString("nlqpid=$!\n")
+
+	return sb.String()
+}
+
+// stopQueryScript returns the script which stops the query started with
+// backgroundQueryCmd: it kills the whole process tree of the query (the
+// agent, awk, the compressor etc), waits for it to exit, and prints the
+// "query_stopped:" lines, after which the shell is ready for the next
+// command.
+//
+// If the query is done by the time the script runs, there's nothing to kill,
+// and the "query_stopped:" lines are printed after the "command_done:" ones.
+// If pgrep isn't available on the host, the query can't be killed, so the
+// script only waits for it to finish.
+func stopQueryScript(idx int) string {
+	var sb strings.Builder
+
+	sb.WriteString(`nlqtree() { echo "$1"; for nlc in $(pgrep -P "$1" 2>/dev/null); do nlqtree "$nlc"; done; }` + "\n")
+
+	// Make sure that $nlqpid is still our child, and not some unrelated
+	// process which got the same pid after the query was done.
+	sb.WriteString(`if [ -n "$nlqpid" ] && [ "$(ps -o ppid= -p "$nlqpid" 2>/dev/null | tr -d ' ')" = "$$" ]; then` + "\n")
+	sb.WriteString("  if command -v pgrep > /dev/null 2>&1; then\n")
+	sb.WriteString(`    nlqpids=$(nlqtree "$nlqpid")` + "\n")
+	sb.WriteString("    kill -TERM $nlqpids 2>/dev/null\n")
+	sb.WriteString("  fi\n")
+	sb.WriteString(`  wait "$nlqpid" 2>/dev/null` + "\n")
+
+	// The grandchildren are not ours to wait for, so poll until they're gone
+	// (or are zombies, waiting for their parents to be reaped).
+	sb.WriteString("  nlqi=0\n")
+	sb.WriteString("  for nlp in $nlqpids; do\n")
+	sb.WriteString(`    while [ "$nlqi" -lt 100 ] && ps -o stat= -p "$nlp" 2>/dev/null | grep -qv '^Z'; do` + "\n")
+	sb.WriteString("      nlqi=$((nlqi + 1)); sleep 0.05 2>/dev/null || sleep 1\n")
+	sb.WriteString("    done\n")
+	sb.WriteString("  done\n")
+	sb.WriteString("fi\n")
+	sb.WriteString("nlqpid=\n")
+	sb.WriteString("nlqpids=\n")
+
+	// The killed query might have left an incomplete line (or compressed
+	// data) on both stdout and stderr, so terminate it first.
+	sb.WriteString("echo\n")
+	sb.WriteString("echo " + compressedAbortedMarker + "\n")
+	sb.WriteString(fmt.Sprintf("echo '%s%d'\n", queryStoppedPrefix, idx))
+	sb.WriteString("echo 1>&2\n")
+	sb.WriteString(fmt.Sprintf("echo '%s%d' 1>&2\n", queryStoppedPrefix, idx))
+
+	return sb.String()
+}
+
+// parseQueryStoppedLine returns the command idx from the "query_stopped:"
+// line.
+func parseQueryStoppedLine(line string) (int, error) {
+	idx, err := strconv.Atoi(strings.TrimPrefix(line, queryStoppedPrefix))
+	if err != nil {
+		return 0, errors.Annotatef(err, "parsing idx as integer")
+	}
+
+	return idx, nil
+}
+
+// runningQueryCtxDone returns the Done channel of the context of the query
+// which is running on the main session, so that the run loop stops the query
+// once it's cancelled; if there's no such query, or it's being stopped
+// already, nil is returned.
+func (lsc *LStreamClient) runningQueryCtxDone() <-chan struct{} {
+	cmdCtx := lsc.curCmdCtx
+	if lsc.state != LStreamClientStateConnectedBusy || cmdCtx == nil || cmdCtx.queryLogsCtx == nil {
+		return nil
+	}
+
+	if cmdCtx.cmd.queryLogs.ctx == nil || cmdCtx.queryLogsCtx.stopping {
+		return nil
+	}
+
+	return cmdCtx.cmd.queryLogs.ctx.Done()
+}
+
+// stopRunningQuery stops the query running on the main session, by writing
+// the stopQueryScript; the response with ErrQueryStopped is sent once we get
+// the "query_stopped:" lines, see checkQueryStopped.
+func (lsc *LStreamClient) stopRunningQuery() {
+	cmdCtx := lsc.curCmdCtx
+
+	lsc.params.Logger.Infof("Stopping the running query (%s)", lsc.params.LogStream.Name)
+	cmdCtx.queryLogsCtx.stopping = true
+
+	lsc.conn.conn.Stdin().Write([]byte(stopQueryScript(cmdCtx.idx)))
+}
+
+// stopQuerySession stops the query running on the additional session: since
+// the session is only needed for this one query, we just close it, and
+// respond with ErrQueryStopped right away.
+func (lsc *LStreamClient) stopQuerySession(sess *querySession) {
+	if _, ok := lsc.querySessions[sess]; !ok {
+		// The query is done already.
+		return
+	}
+
+	lsc.params.Logger.Infof("Stopping the query on the additional session (%s)", lsc.params.LogStream.Name)
+	lsc.sendCmdRespTo(sess.cmdCtx, &LogResp{}, ErrQueryStopped)
+	lsc.closeQuerySession(sess)
+}
+
+// watchQuerySessionCtx sends the session to the querySessionStopCh once the
+// context of its query is cancelled, unless the session is done before that.
+func (lsc *LStreamClient) watchQuerySessionCtx(sess *querySession) {
+	ctx := sess.cmdCtx.cmd.queryLogs.ctx
+
+	select {
+	case <-ctx.Done():
+		select {
+		case lsc.querySessionStopCh <- sess:
+		case <-sess.doneCh:
+		}
+	case <-sess.doneCh:
+	}
+}
+
+// checkQueryStopped handles the "query_stopped:" lines printed by the
+// stopQueryScript; they only matter if we're stopping the query, since
+// otherwise they might be a leftover from the previous query, which was
+// done by the time it was stopped.
+func (lsc *LStreamClient) checkQueryStopped(
+	line string, cmdCtx *lstreamCmdCtx, isStderr bool,
+) bool {
+	if !strings.HasPrefix(line, queryStoppedPrefix) {
+		return false
+	}
+
+	idx, err := parseQueryStoppedLine(line)
+	if err != nil {
+		lsc.params.Logger.Errorf("Got malformed query_stopped line: %s (%s)", line, err.Error())
+		return true
+	}
+
+	if cmdCtx.queryLogsCtx == nil || !cmdCtx.queryLogsCtx.stopping || idx != cmdCtx.idx {
+		return true
+	}
+
+	cmdCtx.queryLogsCtx.stopped = true
+
+	if isStderr {
+		cmdCtx.stderrDone = true
+	} else {
+		cmdCtx.stdoutDone = true
+	}
+
+	lsc.handleCommandResultsIfDone(cmdCtx)
+	return true
+}
+
+// StopQuery stops the query in progress, if any: the logstreams which weren't
+// queried yet won't be queried, and the ones which are running the query
+// have it stopped on the hosts, without breaking the connections, so that
+// the next query can run right away. The stopped query gets the
+// LogRespTotal with ErrQueryStopped.
+func (lsman *LStreamsManager) StopQuery() {
+	lsman.reqCh <- lstreamsManagerReq{
+		stopQuery: true,
+	}
+}
+
+// stopQuery handles the StopQuery request.
+func (lsman *LStreamsManager) stopQuery() {
+	if lsman.debouncedQuery != nil {
+		lsman.params.Logger.Infof("Stopping the debounced query")
+		lsman.debouncedQuery = nil
+		lsman.debounceCh = nil
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{ErrQueryStopped},
+		})
+	}
+
+	if lsman.curQueryLogsCtx == nil {
+		return
+	}
+
+	// Cancelling the query's context makes the LStreamClients stop it on the
+	// hosts.
+	lsman.params.Logger.Infof("Stopping the query in progress")
+	lsman.forgetCurQuery()
+	lsman.sendLogRespUpdate(&LogRespTotal{
+		Errs: []error{ErrQueryStopped},
+	})
+	lsman.sendStateUpdate()
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryStopAbortsCompressedData(t *testing.T) {
+	data := compressLocally(t, WireCompressionGzip, []byte("m:1:foo\nm:2:bar\n"))
+
+	var stream bytes.Buffer
+	stream.WriteString("before\n")
+	stream.WriteString(compressedStartMarkerPrefix + string(WireCompressionGzip) + "\n")
+	stream.Write(data[:len(data)/2])
+	stream.WriteString("\n" + compressedAbortedMarker + "\n")
+	stream.WriteString("query_stopped:3\n")
+
+	// The marker without any compressed data is ignored too.
+	stream.WriteString(compressedAbortedMarker + "\n")
+	stream.WriteString("after\n")
+
+	linesCh := make(chan string, 10)
+	getScannerFunc("stdout", &stream, linesCh)()
+
+	var got []string
+	for line := range linesCh {
+		got = append(got, line)
+	}
+
+	assert.Equal(t, []string{"before", "query_stopped:3", "after"}, got)
+}
+
+func TestQueryStop(t *testing.T) {
+	metrics := newFakeMetrics()
+
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					CustomAgent: `if [ -n "$NLENV_SLOW" ]; then sleep 30; fi
+echo "m:1:2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo"
+`,
+				},
+			},
+		},
+		ClientID: "query_stop_test",
+		Metrics:  metrics,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	slowParams := QueryLogsParams{
+		From:        time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+		AgentEnv:    map[string]string{"SLOW": "1"},
+	}
+
+	fastParams := slowParams
+	fastParams.AgentEnv = nil
+
+	checkFastQuery := func() {
+		resp, err := n.Query(ctx, fastParams)
+		if assert.NoError(t, err) && assert.Len(t, resp.Logs, 1) {
+			assert.Equal(t, "foo", resp.Logs[0].Msg)
+		}
+	}
+
+	// Stopping explicitly.
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := n.Query(ctx, slowParams)
+		errCh <- err
+	}()
+
+	// Give the query some time to start on the host.
+	time.Sleep(1 * time.Second)
+
+	startTime := time.Now()
+	n.StopQuery()
+
+	select {
+	case err := <-errCh:
+		assert.True(t, errors.Is(err, ErrQueryStopped), "%v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("query wasn't stopped")
+	}
+	assert.Less(t, int64(time.Since(startTime)), int64(5*time.Second))
+
+	checkFastQuery()
+
+	// Cancelling the context.
+	slowCtx, slowCancel := context.WithTimeout(ctx, 1*time.Second)
+	defer slowCancel()
+
+	_, err = n.Query(slowCtx, slowParams)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	startTime = time.Now()
+	checkFastQuery()
+	assert.Less(t, int64(time.Since(startTime)), int64(5*time.Second))
+
+	// The connection was reused all along.
+	assert.Equal(t, 1.0, metrics.counter(`nerdlog_connections_opened_total{lstream="localhost"}`))
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"github.com/juju/errors"
+)
+
+// ErrQuerySuperseded is the error in the LogRespTotal of the query which was
+// superseded by a newer one before it was done; see
+// LStreamsManagerParams.QueryDebounce. It doesn't need to be shown to the
+// user: the response to the newer query follows.
+var ErrQuerySuperseded = errors.Errorf("superseded by a newer query")
+
+// pendingLStreamQuery is the query command for a single logstream, which
+// wasn't sent to it yet because of the MaxQueriesInFlight.
+type pendingLStreamQuery struct {
+	lsc *LStreamClient
+	cmd *lstreamCmdQueryLogs
+}
+
+// dispatchPendingQueries sends the pending commands of the current query to
+// the logstreams, as long as the MaxQueriesInFlight allows it.
+func (lsman *LStreamsManager) dispatchPendingQueries() {
+	q := lsman.curQueryLogsCtx
+	maxInFlight := lsman.params.MaxQueriesInFlight
+
+	for len(q.pending) > 0 && (maxInFlight == 0 || q.numInFlight < maxInFlight) {
+		pq := q.pending[0]
+		q.pending = q.pending[1:]
+
+		pq.lsc.EnqueueCmd(lstreamCmd{
+			respCh:    lsman.respCh,
+			queryLogs: pq.cmd,
+		})
+
+		q.numInFlight++
+	}
+}
+
+// debounceQuery remembers the query to start it once the QueryDebounce
+// passes; if there was another one waiting already, it's superseded.
+func (lsman *LStreamsManager) debounceQuery(params *QueryLogsParams) {
+	if lsman.debouncedQuery != nil {
+		lsman.params.Logger.Verbose1f("Debounced query is superseded by a newer one")
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{ErrQuerySuperseded},
+		})
+	}
+
+	lsman.debouncedQuery = params
+	lsman.debounceCh = lsman.params.Clock.After(lsman.params.QueryDebounce)
+}
+
+// startDebouncedQuery starts the query which has been waiting for the
+// QueryDebounce to pass, superseding the one in progress, if any.
+func (lsman *LStreamsManager) startDebouncedQuery() {
+	params := lsman.debouncedQuery
+	lsman.debouncedQuery = nil
+	lsman.debounceCh = nil
+
+	if lsman.curQueryLogsCtx != nil {
+		lsman.params.Logger.Infof("Query in progress is superseded by a newer one")
+		lsman.forgetCurQuery()
+		lsman.sendLogRespUpdate(&LogRespTotal{
+			Errs: []error{ErrQuerySuperseded},
+		})
+		lsman.sendStateUpdate()
+	}
+
+	lsman.startQueryLogs(params)
+}
+
+// forgetCurQuery drops the query in progress, if any: the logstreams which
+// weren't queried yet won't be queried, the queued commands won't start, and
+// the responses to the ones already running will be ignored.
+func (lsman *LStreamsManager) forgetCurQuery() {
+	if lsman.curQueryLogsCtx == nil {
+		return
+	}
+
+	lsman.params.Logger.Infof("Forgetting the in-progress query")
+	lsman.curQueryLogsCtx.cancel()
+	lsman.curQueryLogsCtx = nil
+}
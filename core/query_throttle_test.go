@@ -0,0 +1,237 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// throttleTestEnv is the LStreamsManager with the fake logstreams, which
+// records the queries ran on every logstream.
+type throttleTestEnv struct {
+	t *testing.T
+
+	lsman     *LStreamsManager
+	updatesCh chan LStreamsManagerUpdate
+
+	// agentCmds contains the agent invocations by the logstream name.
+	agentCmds map[string]*fakeLogs
+}
+
+func newThrottleTestEnv(
+	t *testing.T, lstreams []string, queryGate <-chan struct{}, params LStreamsManagerParams,
+) *throttleTestEnv {
+	now := time.Now()
+
+	logs := &fakeLogs{}
+	logs.add(fakeLogLine(now.Add(-time.Minute), "foo"))
+
+	env := &throttleTestEnv{
+		t:         t,
+		updatesCh: make(chan LStreamsManagerUpdate, 1024),
+		agentCmds: map[string]*fakeLogs{},
+	}
+
+	for _, name := range lstreams {
+		env.agentCmds[name] = &fakeLogs{}
+	}
+
+	params.InitialLStreams = strings.Join(lstreams, ",")
+	params.NewTransport = func(ls LogStream) ShellTransport {
+		return &fakeShellTransport{
+			logs:      logs,
+			agentCmds: env.agentCmds[ls.Name],
+			queryGate: queryGate,
+		}
+	}
+
+	env.start(params)
+
+	return env
+}
+
+// start creates the LStreamsManager with the given params, and waits until
+// all the logstreams are connected.
+func (env *throttleTestEnv) start(params LStreamsManagerParams) {
+	params.ClientID = "test"
+	params.UpdatesCh = env.updatesCh
+	params.Clock = clock.New()
+	params.InitialDefaultTransportMode = NewTransportModeSSHLib()
+
+	env.lsman = NewLStreamsManager(params)
+
+	for {
+		upd := env.nextUpdate()
+		if upd.State != nil && upd.State.Connected && !upd.State.Busy {
+			break
+		}
+	}
+}
+
+func (env *throttleTestEnv) close() {
+	env.lsman.Close()
+
+	doneCh := make(chan struct{})
+	go func() {
+		env.lsman.Wait()
+		close(doneCh)
+	}()
+
+	for {
+		select {
+		case <-env.updatesCh:
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+func (env *throttleTestEnv) nextUpdate() LStreamsManagerUpdate {
+	select {
+	case upd := <-env.updatesCh:
+		return upd
+	case <-time.After(5 * time.Second):
+		env.t.Fatalf("timed out waiting for an update")
+		return LStreamsManagerUpdate{}
+	}
+}
+
+func (env *throttleTestEnv) nextLogResp() *LogRespTotal {
+	for {
+		if upd := env.nextUpdate(); upd.LogResp != nil {
+			return upd.LogResp
+		}
+	}
+}
+
+func (env *throttleTestEnv) query(name string) {
+	env.lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		From:        time.Now().Add(-time.Hour),
+		Query:       fmt.Sprintf("/%s/", name),
+	})
+}
+
+// queries returns the names of the queries ran on the logstream, in order.
+func (env *throttleTestEnv) queries(lstream string) []string {
+	var ret []string
+	for _, cmd := range env.agentCmds[lstream].get() {
+		if !strings.Contains(cmd, " query ") {
+			continue
+		}
+
+		for _, name := range []string{"q1", "q2", "q3", "q4", "q5"} {
+			if strings.Contains(cmd, "/"+name+"/") {
+				ret = append(ret, name)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (env *throttleTestEnv) waitQueries(lstream string, want []string) {
+	assert.Eventually(env.t, func() bool {
+		return assert.ObjectsAreEqual(want, env.queries(lstream))
+	}, 5*time.Second, 10*time.Millisecond, "%s: queries %v", lstream, env.queries(lstream))
+}
+
+func assertQuerySuperseded(t *testing.T, resp *LogRespTotal) {
+	if assert.Equal(t, 1, len(resp.Errs)) {
+		assert.Equal(t, ErrQuerySuperseded, resp.Errs[0])
+	}
+}
+
+func TestQueryDebounce(t *testing.T) {
+	lstreams := []string{"fake-01", "fake-02"}
+	env := newThrottleTestEnv(t, lstreams, nil, LStreamsManagerParams{
+		QueryDebounce: 100 * time.Millisecond,
+	})
+	defer env.close()
+
+	// Every query but the last one is superseded by the next one while it's
+	// still being debounced.
+	for _, name := range []string{"q1", "q2", "q3", "q4", "q5"} {
+		env.query(name)
+	}
+
+	for i := 0; i < 4; i++ {
+		assertQuerySuperseded(t, env.nextLogResp())
+	}
+
+	resp := env.nextLogResp()
+	assert.Equal(t, 0, len(resp.Errs))
+	assert.Equal(t, 2, len(resp.Logs))
+
+	for _, name := range lstreams {
+		assert.Equal(t, []string{"q5"}, env.queries(name), name)
+	}
+}
+
+func TestQuerySupersedeInProgress(t *testing.T) {
+	queryGate := make(chan struct{})
+
+	lstreams := []string{"fake-01", "fake-02", "fake-03"}
+	env := newThrottleTestEnv(t, lstreams, queryGate, LStreamsManagerParams{
+		QueryDebounce:      10 * time.Millisecond,
+		MaxQueriesInFlight: 1,
+	})
+	defer env.close()
+
+	// Only the first logstream is queried, the rest wait for it.
+	env.query("q1")
+	env.waitQueries("fake-01", []string{"q1"})
+
+	// The second query supersedes the first one: the rest of the logstreams
+	// never get the first query. It's sent to the first logstream right away,
+	// but it only starts there once the first query is done.
+	env.query("q2")
+	assertQuerySuperseded(t, env.nextLogResp())
+
+	// The third query supersedes the second one before it has started, so
+	// the second query never runs at all.
+	env.query("q3")
+	assertQuerySuperseded(t, env.nextLogResp())
+
+	close(queryGate)
+
+	resp := env.nextLogResp()
+	assert.Equal(t, 0, len(resp.Errs))
+	assert.Equal(t, 3, len(resp.Logs))
+
+	assert.Equal(t, []string{"q1", "q3"}, env.queries("fake-01"))
+	assert.Equal(t, []string{"q3"}, env.queries("fake-02"))
+	assert.Equal(t, []string{"q3"}, env.queries("fake-03"))
+}
+
+func TestMaxQueriesInFlight(t *testing.T) {
+	queryGate := make(chan struct{})
+
+	lstreams := []string{"fake-01", "fake-02", "fake-03"}
+	env := newThrottleTestEnv(t, lstreams, queryGate, LStreamsManagerParams{
+		MaxQueriesInFlight: 2,
+	})
+	defer env.close()
+
+	env.query("q1")
+
+	env.waitQueries("fake-01", []string{"q1"})
+	env.waitQueries("fake-02", []string{"q1"})
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string(nil), env.queries("fake-03"))
+
+	// Once one of the queries is done, the last logstream is queried.
+	queryGate <- struct{}{}
+	env.waitQueries("fake-03", []string{"q1"})
+
+	close(queryGate)
+
+	resp := env.nextLogResp()
+	assert.Equal(t, 0, len(resp.Errs))
+	assert.Equal(t, 3, len(resp.Logs))
+}
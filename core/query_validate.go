@@ -0,0 +1,151 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// QueryCapabilities describes the logstreams which a query is going to run
+// on, for ValidateQuery.
+type QueryCapabilities struct {
+	// AWKDialects maps the logstream names to the awk dialects which run the
+	// queries on them. If empty, the query is only validated for
+	// AWKDialectDefault.
+	AWKDialects map[string]AWKDialect
+}
+
+// QueryValidationError is returned by ValidateQuery when the query can't be
+// compiled for some of the logstreams.
+type QueryValidationError struct {
+	// LStreams are the names of the logstreams which the query can't run on,
+	// sorted; empty if the query wasn't validated for any particular
+	// logstreams.
+	LStreams []string
+
+	// Dialect is the awk dialect of these logstreams.
+	Dialect AWKDialect
+
+	// Err is the actual error, typically a *FilterQueryError with the
+	// position of the unsupported construct in the query.
+	Err error
+}
+
+func (e *QueryValidationError) Error() string {
+	if len(e.LStreams) == 0 {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%s (%s): %s", strings.Join(e.LStreams, ", "), e.Dialect, e.Err.Error())
+}
+
+func (e *QueryValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateQuery checks that the query can be compiled for all the given
+// logstreams, without running anything on the hosts: the filter is parsed,
+// and its regexes are translated to the awk dialect of every logstream (so
+// e.g. a lookahead fails everywhere, but a word boundary \b only fails on
+// the non-gawk hosts); the select, the group by, the correlation and the
+// agent env are validated as well.
+//
+// If the filter can't be translated for some logstreams, a
+// *QueryValidationError is returned, listing the logstreams with the same
+// dialect; if there are multiple such dialects, the error is about the first
+// one in alphabetical order. The errors which don't depend on the dialect,
+// like the filter syntax errors, are returned as is.
+func ValidateQuery(params QueryLogsParams, caps QueryCapabilities) error {
+	if _, err := ParseProjection(params.Select); err != nil {
+		return errors.Annotatef(err, "parsing select")
+	}
+
+	if _, err := ParseGroupBy(params.GroupBy); err != nil {
+		return errors.Annotatef(err, "parsing group by")
+	}
+
+	if _, err := parseCorrelation(params.CorrelateKey, params.CorrelateValues); err != nil {
+		return errors.Annotatef(err, "parsing correlation")
+	}
+
+	if err := validateAgentEnv(params.AgentEnv); err != nil {
+		return errors.Annotatef(err, "agent env")
+	}
+
+	if params.QueryLang != QueryLangFilter || params.Query == "" {
+		// Raw awk queries are passed to awk as is, so there's nothing we can
+		// check locally.
+		return nil
+	}
+
+	if _, err := translateFilterQuery(params.Query, caps.AWKDialects); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// translateFilterQuery parses the filter query, and translates its regexes to
+// every awk dialect from the given map (from the logstream names to their
+// dialects), or only to AWKDialectDefault if the map is empty. The errors are
+// as described for ValidateQuery.
+func translateFilterQuery(query string, awkDialects map[string]AWKDialect) (map[AWKDialect]FilterExpr, error) {
+	if _, err := ParseFilterQuery(query); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	lstreamsByDialect := map[AWKDialect][]string{}
+	for name, dialect := range awkDialects {
+		lstreamsByDialect[dialect] = append(lstreamsByDialect[dialect], name)
+	}
+
+	if len(lstreamsByDialect) == 0 {
+		lstreamsByDialect[AWKDialectDefault] = nil
+	}
+
+	dialects := make([]AWKDialect, 0, len(lstreamsByDialect))
+	for dialect := range lstreamsByDialect {
+		dialects = append(dialects, dialect)
+	}
+	sort.Slice(dialects, func(i, j int) bool { return dialects[i] < dialects[j] })
+
+	filters := make(map[AWKDialect]FilterExpr, len(dialects))
+	for _, dialect := range dialects {
+		lstreams := lstreamsByDialect[dialect]
+		sort.Strings(lstreams)
+
+		if !isValidAWKDialect(dialect) {
+			return nil, errors.Errorf("%s: invalid awk dialect %q", strings.Join(lstreams, ", "), dialect)
+		}
+
+		// The regexes are translated in place, so every dialect needs its own
+		// copy of the parsed filter.
+		filter, err := ParseFilterQuery(query)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if err := TranslateFilterRegexes(filter, dialect); err != nil {
+			return nil, &QueryValidationError{
+				LStreams: lstreams,
+				Dialect:  dialect,
+				Err:      err,
+			}
+		}
+
+		filters[dialect] = filter
+	}
+
+	return filters, nil
+}
+
+func isValidAWKDialect(dialect AWKDialect) bool {
+	switch dialect {
+	case AWKDialectGawk, AWKDialectMawk, AWKDialectBusybox, AWKDialectPOSIX:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateQuery(t *testing.T) {
+	caps := QueryCapabilities{
+		AWKDialects: map[string]AWKDialect{
+			"web-01":   AWKDialectGawk,
+			"web-02":   AWKDialectGawk,
+			"legacy-2": AWKDialectPOSIX,
+			"legacy-1": AWKDialectPOSIX,
+		},
+	}
+
+	filterParams := func(query string) QueryLogsParams {
+		return QueryLogsParams{Query: query, QueryLang: QueryLangFilter}
+	}
+
+	// The word boundary is only supported by gawk.
+	params := filterParams(`level:error AND /\bpanic\b/`)
+	assert.NoError(t, ValidateQuery(params, QueryCapabilities{
+		AWKDialects: map[string]AWKDialect{"web-01": AWKDialectGawk},
+	}))
+
+	err := ValidateQuery(params, caps)
+	var qvErr *QueryValidationError
+	if assert.True(t, errors.As(err, &qvErr), "%v", err) {
+		assert.Equal(t, []string{"legacy-1", "legacy-2"}, qvErr.LStreams)
+		assert.Equal(t, AWKDialectPOSIX, qvErr.Dialect)
+
+		var fqErr *FilterQueryError
+		if assert.True(t, errors.As(err, &fqErr)) {
+			assert.Equal(t, 17, fqErr.Pos)
+		}
+	}
+	assert.Equal(t,
+		`legacy-1, legacy-2 (posix): invalid filter query at position 18: word boundary \b is not supported by posix; it is supported by gawk, so consider installing it`,
+		err.Error(),
+	)
+
+	// The lookahead isn't supported anywhere; without the capabilities, the
+	// query is validated for the default dialect.
+	err = ValidateQuery(filterParams(`/foo(?=bar)/`), QueryCapabilities{})
+	if assert.True(t, errors.As(err, &qvErr), "%v", err) {
+		assert.Empty(t, qvErr.LStreams)
+		assert.Equal(t, AWKDialectDefault, qvErr.Dialect)
+	}
+
+	// The translatable PCRE features are fine everywhere.
+	assert.NoError(t, ValidateQuery(filterParams(`/(?:foo|bar)\d+/ OR status:500`), caps))
+
+	// The syntax errors don't depend on the dialect.
+	err = ValidateQuery(filterParams(`foo AND (bar`), caps)
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &qvErr))
+
+	// The raw awk queries can't be validated locally.
+	assert.NoError(t, ValidateQuery(QueryLogsParams{Query: `/\bfoo(?=bar)/`}, caps))
+
+	assert.Error(t, ValidateQuery(QueryLogsParams{Select: "foo,,bar"}, caps))
+	assert.Error(t, ValidateQuery(QueryLogsParams{AgentEnv: map[string]string{"1": ""}}, caps))
+	assert.Error(t, ValidateQuery(filterParams("foo"), QueryCapabilities{
+		AWKDialects: map[string]AWKDialect{"web-01": "nawk"},
+	}))
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+// ReorderBuffer holds the log messages which arrive out of order (e.g. from
+// multiple hosts with different latencies) for a short window, and emits them
+// ordered by timestamp.
+//
+// A message is held until either a message which is newer by at least the
+// window arrives (so it's unlikely that anything older than it is still on
+// the way), or it's been held for the window itself, measured by the local
+// clock (so that a slow or quiet host doesn't stall the output forever). The
+// messages which arrive after a newer message was already emitted are
+// emitted right away, marked as LogMsg.Late.
+//
+// It's not safe for concurrent use.
+type ReorderBuffer struct {
+	window time.Duration
+
+	// held contains the messages which are not emitted yet, in the order of
+	// arrival.
+	held []reorderBufferItem
+
+	// maxTime is the latest timestamp seen so far.
+	maxTime time.Time
+	// lastEmittedTime is the timestamp of the last emitted message which
+	// wasn't late.
+	lastEmittedTime time.Time
+}
+
+type reorderBufferItem struct {
+	msg       LogMsg
+	arrivedAt time.Time
+}
+
+// NewReorderBuffer creates a ReorderBuffer with the given window.
+func NewReorderBuffer(window time.Duration) *ReorderBuffer {
+	return &ReorderBuffer{
+		window: window,
+	}
+}
+
+// Add adds the messages, in any order, which have arrived at the time now,
+// and returns the ones which are ready to be emitted; see Ready.
+func (rb *ReorderBuffer) Add(msgs []LogMsg, now time.Time) []LogMsg {
+	var late []LogMsg
+
+	for _, msg := range msgs {
+		if !rb.lastEmittedTime.IsZero() && msg.Time.Before(rb.lastEmittedTime) {
+			msg.Late = true
+			late = append(late, msg)
+			continue
+		}
+
+		rb.held = append(rb.held, reorderBufferItem{
+			msg:       msg,
+			arrivedAt: now,
+		})
+
+		if msg.Time.After(rb.maxTime) {
+			rb.maxTime = msg.Time
+		}
+	}
+
+	sortLogMsgs(late)
+
+	return append(late, rb.Ready(now)...)
+}
+
+// Ready returns the messages which are ready to be emitted at the time now,
+// ordered by timestamp, and removes them from the buffer. The late messages
+// are never held, so they are only returned from Add.
+func (rb *ReorderBuffer) Ready(now time.Time) []LogMsg {
+	if len(rb.held) == 0 {
+		return nil
+	}
+
+	// Everything older than the latest message by at least the window is
+	// ready, and so is everything not newer than a message which was held for
+	// the whole window (otherwise the order would break).
+	cutoff := rb.maxTime.Add(-rb.window)
+	for _, item := range rb.held {
+		if now.Sub(item.arrivedAt) >= rb.window && item.msg.Time.After(cutoff) {
+			cutoff = item.msg.Time
+		}
+	}
+
+	return rb.emit(func(msg *LogMsg) bool {
+		return !msg.Time.After(cutoff)
+	})
+}
+
+// Flush returns all the held messages ordered by timestamp, and empties the
+// buffer.
+func (rb *ReorderBuffer) Flush() []LogMsg {
+	return rb.emit(func(msg *LogMsg) bool {
+		return true
+	})
+}
+
+// Len returns the number of the held messages.
+func (rb *ReorderBuffer) Len() int {
+	return len(rb.held)
+}
+
+// emit removes the messages for which ready returns true from the buffer,
+// and returns them ordered by timestamp.
+func (rb *ReorderBuffer) emit(ready func(msg *LogMsg) bool) []LogMsg {
+	var ret []LogMsg
+	var stillHeld []reorderBufferItem
+
+	for _, item := range rb.held {
+		if ready(&item.msg) {
+			ret = append(ret, item.msg)
+		} else {
+			stillHeld = append(stillHeld, item)
+		}
+	}
+
+	rb.held = stillHeld
+
+	if len(ret) == 0 {
+		return nil
+	}
+
+	sortLogMsgs(ret)
+	rb.lastEmittedTime = ret[len(ret)-1].Time
+
+	return ret
+}
+
+// sortLogMsgs sorts the messages by timestamp; the ones with the same
+// timestamp keep their relative order.
+func sortLogMsgs(msgs []LogMsg) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Time.Before(msgs[j].Time)
+	})
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var reorderTestBase = time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func reorderTestMsg(lstream string, sec int) LogMsg {
+	return LogMsg{
+		Time:     reorderTestBase.Add(time.Duration(sec) * time.Second),
+		Msg:      fmt.Sprintf("%s:%d", lstream, sec),
+		OrigLine: fmt.Sprintf("line %d", sec),
+		Context:  map[string]string{"lstream": lstream},
+	}
+}
+
+func reorderTestMsgs(logs []LogMsg) []string {
+	var ret []string
+	for _, msg := range logs {
+		s := msg.Msg
+		if msg.Late {
+			s += " (late)"
+		}
+		ret = append(ret, s)
+	}
+
+	return ret
+}
+
+func TestReorderBufferInterleaved(t *testing.T) {
+	rb := NewReorderBuffer(5 * time.Second)
+	now := reorderTestBase
+
+	// Two hosts report their logs out of order, the second one lagging behind.
+	ready := rb.Add([]LogMsg{
+		reorderTestMsg("a", 1),
+		reorderTestMsg("a", 3),
+		reorderTestMsg("a", 4),
+	}, now)
+	assert.Nil(t, ready)
+
+	ready = rb.Add([]LogMsg{
+		reorderTestMsg("b", 2),
+		reorderTestMsg("b", 0),
+	}, now.Add(time.Second))
+	assert.Nil(t, ready)
+	assert.Equal(t, 5, rb.Len())
+
+	// Once there is a message newer by the window, the older ones are emitted
+	// in order.
+	ready = rb.Add([]LogMsg{
+		reorderTestMsg("a", 8),
+		reorderTestMsg("b", 7),
+	}, now.Add(2*time.Second))
+	assert.Equal(t, []string{"b:0", "a:1", "b:2", "a:3"}, reorderTestMsgs(ready))
+	assert.Equal(t, 3, rb.Len())
+
+	assert.Equal(t, []string{"a:4", "b:7", "a:8"}, reorderTestMsgs(rb.Flush()))
+	assert.Equal(t, 0, rb.Len())
+}
+
+func TestReorderBufferWindowExpiry(t *testing.T) {
+	rb := NewReorderBuffer(5 * time.Second)
+	now := reorderTestBase
+
+	ready := rb.Add([]LogMsg{
+		reorderTestMsg("a", 2),
+		reorderTestMsg("a", 1),
+	}, now)
+	assert.Nil(t, ready)
+
+	ready = rb.Add([]LogMsg{
+		reorderTestMsg("b", 3),
+	}, now.Add(3*time.Second))
+	assert.Nil(t, ready)
+
+	assert.Nil(t, rb.Ready(now.Add(4*time.Second)))
+
+	// The first messages have been held for the whole window, so they're
+	// emitted even though nothing newer has arrived; the later one is still
+	// held.
+	assert.Equal(t, []string{"a:1", "a:2"}, reorderTestMsgs(rb.Ready(now.Add(5*time.Second))))
+	assert.Equal(t, 1, rb.Len())
+
+	assert.Equal(t, []string{"b:3"}, reorderTestMsgs(rb.Ready(now.Add(8*time.Second))))
+	assert.Equal(t, 0, rb.Len())
+}
+
+func TestReorderBufferLate(t *testing.T) {
+	rb := NewReorderBuffer(5 * time.Second)
+	now := reorderTestBase
+
+	rb.Add([]LogMsg{
+		reorderTestMsg("a", 1),
+		reorderTestMsg("a", 3),
+	}, now)
+
+	ready := rb.Ready(now.Add(5 * time.Second))
+	assert.Equal(t, []string{"a:1", "a:3"}, reorderTestMsgs(ready))
+
+	// The messages older than the last emitted one are emitted right away,
+	// marked as late, while the newer ones are held as usual.
+	ready = rb.Add([]LogMsg{
+		reorderTestMsg("b", 4),
+		reorderTestMsg("b", 2),
+		reorderTestMsg("b", 0),
+	}, now.Add(6*time.Second))
+	assert.Equal(t, []string{"b:0 (late)", "b:2 (late)"}, reorderTestMsgs(ready))
+
+	assert.Equal(t, []string{"b:4"}, reorderTestMsgs(rb.Flush()))
+}
+
+func TestFollowSeen(t *testing.T) {
+	window := 5 * time.Second
+	seen := newFollowSeen()
+
+	newLogs := seen.newLogs([]LogMsg{
+		reorderTestMsg("a", 1),
+		reorderTestMsg("a", 10),
+		reorderTestMsg("b", 10),
+	}, window)
+	assert.Equal(t, []string{"a:1", "a:10", "b:10"}, reorderTestMsgs(newLogs))
+	assert.Equal(t, reorderTestBase.Add(5*time.Second), seen.since)
+
+	// The overlapping results only yield what wasn't seen yet, including the
+	// late message within the window, and the duplicate line.
+	newLogs = seen.newLogs([]LogMsg{
+		reorderTestMsg("a", 1),
+		reorderTestMsg("b", 7),
+		reorderTestMsg("a", 10),
+		reorderTestMsg("b", 10),
+		reorderTestMsg("b", 10),
+		reorderTestMsg("a", 12),
+	}, window)
+	assert.Equal(t, []string{"b:7", "b:10", "a:12"}, reorderTestMsgs(newLogs))
+	assert.Equal(t, reorderTestBase.Add(7*time.Second), seen.since)
+
+	// Nothing new.
+	newLogs = seen.newLogs([]LogMsg{
+		reorderTestMsg("b", 7),
+		reorderTestMsg("a", 12),
+	}, window)
+	assert.Nil(t, newLogs)
+}
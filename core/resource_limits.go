@@ -0,0 +1,128 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// ErrResourceLimit is the sentinel error for ResourceLimitError, so that the
+// client code can check whether any of the logstreams has exceeded its
+// resource limits like: errors.Is(err, ErrResourceLimit).
+var ErrResourceLimit = errors.New("query exceeded resource limit")
+
+// ResourceLimitError is returned when the agent was killed because it
+// exceeded the resource limits configured for the logstream (see
+// ConfigLogStreamOptions.CPULimitSeconds and MemoryLimitKB).
+type ResourceLimitError struct {
+	LStreamName string
+}
+
+func (e *ResourceLimitError) Error() string {
+	return fmt.Sprintf("%s on host %s", ErrResourceLimit.Error(), e.LStreamName)
+}
+
+func (e *ResourceLimitError) Is(target error) bool {
+	return target == ErrResourceLimit
+}
+
+// resourceLimitExitCodes are the exit codes of the processes killed by the
+// kernel due to the ulimit: 152 is 128 + SIGXCPU, sent once the CPU time
+// limit is exceeded, and 137 is 128 + SIGKILL, sent if the process keeps
+// running after that.
+var resourceLimitExitCodes = map[string]struct{}{
+	"152": {},
+	"137": {},
+}
+
+// outOfMemoryMarkers are the substrings of the error messages which the agent
+// (or the tools it runs) print to stderr when a memory allocation fails,
+// which is how exceeding "ulimit -v" manifests.
+var outOfMemoryMarkers = []string{
+	"cannot allocate memory",
+	"memory exhausted",
+	"out of memory",
+}
+
+// resourceLimitExitCodeVar is the shell variable which holds the exit code of
+// the agent inside the ulimit subshell; see resourceLimitCmdParts.
+const resourceLimitExitCodeVar = "nlrc"
+
+// resourceLimitPreamble returns the ulimit command like "ulimit -t 60 -v
+// 1048576", or an empty string if no limits are configured.
+func resourceLimitPreamble(cpuLimitSeconds, memoryLimitKB int) string {
+	if cpuLimitSeconds <= 0 && memoryLimitKB <= 0 {
+		return ""
+	}
+
+	parts := []string{"ulimit"}
+	if cpuLimitSeconds > 0 {
+		parts = append(parts, "-t", fmt.Sprintf("%d", cpuLimitSeconds))
+	}
+	if memoryLimitKB > 0 {
+		parts = append(parts, "-v", fmt.Sprintf("%d", memoryLimitKB))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// resourceLimitCmdParts wraps the agent invocation so that it runs in a
+// subshell with the given limits, like this:
+//
+//	( ulimit -t 60 -v 1048576 ; bash agent.sh query ... ; nlrc=$? ; [ $nlrc -gt 128 ] && echo "exit_code:$nlrc" )
+//
+// The subshell makes sure that the limits only apply to the agent, and not
+// to the whole shell session. Normally, the agent prints the "exit_code:"
+// line itself (from its trap), but if it was killed by a signal, the trap
+// doesn't run, so the subshell prints it instead.
+//
+// If no limits are configured, agentParts are returned as is.
+func resourceLimitCmdParts(cpuLimitSeconds, memoryLimitKB int, agentParts []string) []string {
+	preamble := resourceLimitPreamble(cpuLimitSeconds, memoryLimitKB)
+	if preamble == "" {
+		return agentParts
+	}
+
+	parts := make([]string, 0, len(agentParts)+8)
+	parts = append(parts, "(", preamble, ";")
+	parts = append(parts, agentParts...)
+	parts = append(parts,
+		";", resourceLimitExitCodeVar+"=$?",
+		";", "[ $"+resourceLimitExitCodeVar+" -gt 128 ]",
+		"&&", `echo "exit_code:$`+resourceLimitExitCodeVar+`"`,
+		")",
+	)
+
+	return parts
+}
+
+// isResourceLimitExit returns whether the agent, having exited with the given
+// code and printed the given stderr lines, was killed due to exceeding the
+// configured resource limits.
+func isResourceLimitExit(
+	cpuLimitSeconds, memoryLimitKB int, exitCode string, stderr []string,
+) bool {
+	if exitCode == "0" {
+		return false
+	}
+
+	if cpuLimitSeconds > 0 || memoryLimitKB > 0 {
+		if _, ok := resourceLimitExitCodes[exitCode]; ok {
+			return true
+		}
+	}
+
+	if memoryLimitKB > 0 {
+		for _, line := range stderr {
+			lower := strings.ToLower(line)
+			for _, marker := range outOfMemoryMarkers {
+				if strings.Contains(lower, marker) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
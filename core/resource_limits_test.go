@@ -0,0 +1,69 @@
+package core
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceLimitPreamble(t *testing.T) {
+	assert.Equal(t, "", resourceLimitPreamble(0, 0))
+	assert.Equal(t, "ulimit -t 60", resourceLimitPreamble(60, 0))
+	assert.Equal(t, "ulimit -v 1048576", resourceLimitPreamble(0, 1048576))
+	assert.Equal(t, "ulimit -t 60 -v 1048576", resourceLimitPreamble(60, 1048576))
+}
+
+func TestResourceLimitCmdParts(t *testing.T) {
+	agentParts := []string{"bash", "'/tmp/agent.sh'", "query"}
+
+	assert.Equal(t, agentParts, resourceLimitCmdParts(0, 0, agentParts))
+
+	assert.Equal(
+		t,
+		`( ulimit -t 60 ; bash '/tmp/agent.sh' query ; nlrc=$? ; [ $nlrc -gt 128 ] && echo "exit_code:$nlrc" )`,
+		strings.Join(resourceLimitCmdParts(60, 0, agentParts), " "),
+	)
+}
+
+func TestResourceLimitCmdPartsShell(t *testing.T) {
+	runSh := func(cmd string) string {
+		parts := resourceLimitCmdParts(60, 0, []string{cmd})
+		out, _ := exec.Command("/bin/sh", "-c", strings.Join(parts, " ")).Output()
+		return strings.TrimSpace(string(out))
+	}
+
+	// The limit is applied to the command.
+	assert.Equal(t, "60", runSh("ulimit -t"))
+
+	// If the command is killed, the exit code is printed for it.
+	assert.Equal(t, "exit_code:152", runSh("sh -c 'kill -XCPU $$'"))
+
+	// Otherwise, the command is responsible for printing it.
+	assert.Equal(t, "", runSh("sh -c 'exit 1'"))
+}
+
+func TestIsResourceLimitExit(t *testing.T) {
+	oomStderr := []string{"gawk: cmd. line:1: fatal: cannot allocate memory"}
+
+	assert.False(t, isResourceLimitExit(60, 0, "0", nil))
+	assert.False(t, isResourceLimitExit(60, 0, "1", nil))
+	assert.True(t, isResourceLimitExit(60, 0, "152", nil))
+	assert.True(t, isResourceLimitExit(0, 1024, "137", nil))
+
+	// Without the limits, it's not our business.
+	assert.False(t, isResourceLimitExit(0, 0, "152", nil))
+
+	// Memory allocation failures only matter with the memory limit.
+	assert.True(t, isResourceLimitExit(0, 1024, "1", oomStderr))
+	assert.False(t, isResourceLimitExit(60, 0, "1", oomStderr))
+}
+
+func TestResourceLimitError(t *testing.T) {
+	err := errors.Annotatef(&ResourceLimitError{LStreamName: "web-01"}, "web-01")
+
+	assert.Equal(t, "web-01: query exceeded resource limit on host web-01", err.Error())
+	assert.True(t, errors.Is(err, ErrResourceLimit))
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DisplayPlaceholder is what SanitizeForDisplay replaces the non-printable
+// characters and invalid UTF-8 with.
+const DisplayPlaceholder = '\uFFFD'
+
+// SanitizeForDisplay returns the string with every non-printable character
+// (like NUL or an ANSI escape) and every byte of invalid UTF-8 replaced with
+// the DisplayPlaceholder, so that the binary noise in the logs doesn't break
+// the terminal UI. Tabs are kept as is.
+//
+// It's only meant for displaying the logs: the LogMsg-s always keep the raw
+// bytes, so that the exported logs are not modified.
+func SanitizeForDisplay(s string) string {
+	if isDisplayable(s) {
+		return s
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	// Ranging over the string yields utf8.RuneError for every invalid byte,
+	// and it's the same as the DisplayPlaceholder, so it's written as is.
+	for _, r := range s {
+		if !isDisplayableRune(r) {
+			r = DisplayPlaceholder
+		}
+
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+func isDisplayable(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || !isDisplayableRune(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isDisplayableRune(r rune) bool {
+	return r == '\t' || unicode.IsGraphic(r)
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeForDisplay(t *testing.T) {
+	type testCase struct {
+		in   string
+		want string
+	}
+
+	testCases := []testCase{
+		{in: "", want: ""},
+		{in: "plain ascii", want: "plain ascii"},
+		{in: "tab\tis kept", want: "tab\tis kept"},
+		{in: "unicode: привет, 日本,\u00a0nbsp", want: "unicode: привет, 日本,\u00a0nbsp"},
+		{in: "nul\x00byte", want: "nul�byte"},
+		{in: "escape \x1b[31mred\x1b[0m", want: "escape �[31mred�[0m"},
+		{in: "newline\nand cr\r", want: "newline�and cr�"},
+		{in: "del\x7f", want: "del�"},
+		{in: "invalid \xff\xfe utf8", want: "invalid �� utf8"},
+		{in: "truncated \xd0", want: "truncated �"},
+		{in: "actual � is kept", want: "actual � is kept"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, SanitizeForDisplay(tc.in), "%q", tc.in)
+	}
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package core
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// serialBaudRates maps the supported baud rates to the termios constants.
+var serialBaudRates = map[int]uint32{
+	1200:   unix.B1200,
+	2400:   unix.B2400,
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	921600: unix.B921600,
+}
+
+// openSerialPort opens the serial device, and puts it in the raw mode with
+// the given baud rate; if the baud rate is zero, it's left as is.
+func openSerialPort(device string, baud int) (io.ReadWriteCloser, error) {
+	var speed uint32
+	if baud != 0 {
+		var ok bool
+		speed, ok = serialBaudRates[baud]
+		if !ok {
+			return nil, errors.Errorf("unsupported baud rate %d", baud)
+		}
+	}
+
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Using SyscallConn instead of Fd, since the latter puts the file into
+	// the blocking mode, and then Close doesn't interrupt a pending Read.
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+
+	var termiosErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		termiosErr = setSerialRawMode(int(fd), speed)
+	}); err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+
+	if termiosErr != nil {
+		f.Close()
+		return nil, errors.Annotatef(termiosErr, "configuring %s", device)
+	}
+
+	return f, nil
+}
+
+// setSerialRawMode is like cfmakeraw(3), plus it sets the speed unless it's
+// zero.
+func setSerialRawMode(fd int, speed uint32) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	if speed != 0 {
+		t.Cflag &^= unix.CBAUD
+		t.Cflag |= speed
+		t.Ispeed = speed
+		t.Ospeed = speed
+	}
+
+	return errors.Trace(unix.IoctlSetTermios(fd, unix.TCSETS, t))
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"io"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// openSerialPort opens the serial device. Configuring the device is only
+// supported on Linux, so elsewhere it has to be configured beforehand (e.g.
+// with stty), and the baud rate must be zero.
+func openSerialPort(device string, baud int) (io.ReadWriteCloser, error) {
+	if baud != 0 {
+		return nil, errors.Errorf(
+			"setting the baud rate is only supported on Linux; configure %s with stty, and omit the baud rate", device,
+		)
+	}
+
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return f, nil
+}
@@ -1,6 +1,9 @@
 package core
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 // ShellTransport provides an abstraction for getting shell access to a host;
 // e.g. via SSH or just local shell. In the future, tsh (Teleport) might be
@@ -10,7 +13,11 @@ type ShellTransport interface {
 	// returns immediately, and later on the result (or maybe requests for
 	// additional data such as passphrases) will be delivered to the provided
 	// channel.
-	Connect(resCh chan<- ShellConnUpdate)
+	//
+	// If the context is cancelled before the connection is established, the
+	// attempt should be aborted as soon as possible; the result (normally an
+	// error) still has to be delivered to the channel.
+	Connect(ctx context.Context, resCh chan<- ShellConnUpdate)
 }
 
 // ShellConn provides an abstraction of a shell connection; can be implemented
@@ -24,6 +31,24 @@ type ShellConn interface {
 	Close()
 }
 
+// PausableShellConn is implemented by the ShellConns which can pause reading
+// the stdout, e.g. while the user is reading the logs and doesn't need any
+// more. While paused, nothing is read from the underlying connection, so the
+// data is left in the kernel socket buffers, and once they're full, the remote
+// is throttled naturally, instead of the data piling up on the client side.
+type PausableShellConn interface {
+	ShellConn
+
+	// Pause stops reading the stdout; it's a no-op if it's already paused.
+	// If a read is in progress, the data it returns (at most the size of the
+	// read buffer) is held until Resume.
+	Pause()
+
+	// Resume resumes reading the stdout paused by Pause; it's a no-op if it's
+	// not paused.
+	Resume()
+}
+
 // ShellConnUpdate contains the update from ssh connection. Exactly one
 // field must be non-nil.
 type ShellConnUpdate struct {
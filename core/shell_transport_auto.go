@@ -0,0 +1,201 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// ShellTransportAuto is an implementation of ShellTransport for the auto
+// transport mode (see TransportModeKindAuto): it connects using ssh-lib, and
+// if that fails for a reason which the external ssh binary might handle (see
+// sshLibFallbackReason), it falls back to ssh-bin.
+//
+// Once ssh-bin connects after the fallback, it's remembered for the host
+// (see ShellTransportAutoParams.Key) in the TransportAutoPicks, so the next
+// connections to it go straight to ssh-bin. The network errors don't cause
+// a fallback, since ssh-bin would fail the same way, and neither do the host
+// key mismatches, since falling back would silently work around the host key
+// verification.
+type ShellTransportAuto struct {
+	params ShellTransportAutoParams
+}
+
+type ShellTransportAutoParams struct {
+	// SSHLib is tried first, unless ssh-bin was already picked for the host.
+	SSHLib ShellTransport
+	// SSHBin is the fallback.
+	SSHBin ShellTransport
+
+	// Key identifies the host to remember the picked transport for; normally
+	// it's ConfigLogStreamShellTransportSSHLib.Identity().
+	Key string
+
+	// Picks, if not nil, remembers the transport picked for the host; if nil,
+	// ssh-lib is always tried first.
+	Picks *TransportAutoPicks
+
+	Logger *log.Logger
+}
+
+var _ ShellTransport = &ShellTransportAuto{}
+
+func NewShellTransportAuto(params ShellTransportAutoParams) *ShellTransportAuto {
+	return &ShellTransportAuto{
+		params: params,
+	}
+}
+
+// TransportAutoPicks contains the transports picked by ShellTransportAuto,
+// by the ShellTransportAutoParams.Key. Only ssh-bin is ever stored, since
+// ssh-lib is tried first anyway. It's safe for concurrent use; a nil
+// *TransportAutoPicks doesn't remember anything.
+type TransportAutoPicks struct {
+	mtx   sync.Mutex
+	picks map[string]TransportModeKind
+}
+
+func NewTransportAutoPicks() *TransportAutoPicks {
+	return &TransportAutoPicks{
+		picks: map[string]TransportModeKind{},
+	}
+}
+
+func (p *TransportAutoPicks) get(key string) TransportModeKind {
+	if p == nil {
+		return ""
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.picks[key]
+}
+
+func (p *TransportAutoPicks) set(key string, kind TransportModeKind) {
+	if p == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.picks[key] = kind
+}
+
+func (st *ShellTransportAuto) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go st.doConnect(ctx, resCh)
+}
+
+func (st *ShellTransportAuto) makeDebugInfo(message string) *ShellConnDebugInfo {
+	return &ShellConnDebugInfo{
+		Message: message,
+	}
+}
+
+func (st *ShellTransportAuto) doConnect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	logger := st.params.Logger
+	key := st.params.Key
+
+	if st.params.Picks.get(key) == TransportModeKindSSHBin {
+		resCh <- ShellConnUpdate{
+			DebugInfo: st.makeDebugInfo(fmt.Sprintf(
+				"Using ssh-bin for %s, since ssh-lib has failed for it before", key,
+			)),
+		}
+
+		st.params.SSHBin.Connect(ctx, resCh)
+		return
+	}
+
+	libRes := st.connectVia(ctx, st.params.SSHLib, resCh)
+	if libRes.Err == nil {
+		resCh <- ShellConnUpdate{Result: &libRes}
+		return
+	}
+
+	reason := sshLibFallbackReason(libRes.Err)
+	if reason == "" || ctx.Err() != nil {
+		logger.Infof("ssh-lib failed for %s, not falling back to ssh-bin: %s", key, libRes.Err)
+		resCh <- ShellConnUpdate{Result: &libRes}
+		return
+	}
+
+	logger.Infof("ssh-lib failed for %s (%s), falling back to ssh-bin: %s", key, reason, libRes.Err)
+	resCh <- ShellConnUpdate{
+		DebugInfo: st.makeDebugInfo(fmt.Sprintf(
+			"ssh-lib failed (%s), falling back to ssh-bin: %s", reason, libRes.Err,
+		)),
+	}
+
+	binRes := st.connectVia(ctx, st.params.SSHBin, resCh)
+	if binRes.Err != nil {
+		// Nothing is remembered, so the next time ssh-lib is tried again.
+		logger.Infof("ssh-bin failed for %s as well: %s", key, binRes.Err)
+		binRes.Err = errors.Annotatef(binRes.Err, "ssh-lib failed (%s), and then ssh-bin", libRes.Err)
+		resCh <- ShellConnUpdate{Result: &binRes}
+		return
+	}
+
+	logger.Infof("ssh-bin connected to %s, using it for this host from now on", key)
+	st.params.Picks.set(key, TransportModeKindSSHBin)
+
+	resCh <- ShellConnUpdate{Result: &binRes}
+}
+
+// connectVia connects using the given transport, forwarding all its updates
+// except the result to resCh, and returns the result.
+func (st *ShellTransportAuto) connectVia(
+	ctx context.Context, transport ShellTransport, resCh chan<- ShellConnUpdate,
+) ShellConnResult {
+	ch := make(chan ShellConnUpdate)
+	transport.Connect(ctx, ch)
+
+	for upd := range ch {
+		if upd.Result != nil {
+			return *upd.Result
+		}
+
+		resCh <- upd
+	}
+
+	panic("not reached")
+}
+
+// sshLibFallbackReason returns the human-readable reason why ssh-bin might
+// connect where ssh-lib has failed with the given error, or an empty string
+// if ssh-bin wouldn't do any better.
+func sshLibFallbackReason(err error) string {
+	msg := strings.ToLower(err.Error())
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ""
+
+	// It has to go before the handshake errors, since the host key mismatch
+	// is one of them.
+	case strings.Contains(msg, "host key"):
+		return ""
+
+	case errors.Is(err, ErrHostUnreachable), errors.Is(err, ErrConnectTimeout):
+		return ""
+
+	case errors.Is(err, ErrAuthFailed):
+		return "authentication failed, but ssh might have other keys or auth methods configured"
+
+	case strings.Contains(msg, "certificate"), strings.Contains(msg, "ssh: cert"):
+		return "certificate is not usable, but ssh might handle it"
+
+	case strings.Contains(msg, "getting ssh client for"):
+		return "no usable credentials, but ssh might have them configured"
+
+	case strings.Contains(msg, "handshake failed"), strings.Contains(msg, "no common algorithm"):
+		return "ssh handshake failed, but ssh might support other algorithms"
+	}
+
+	return ""
+}
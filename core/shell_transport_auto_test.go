@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConnectTransport fails to connect with the given error, or if it's nil,
+// connects to a fake shell; it counts the connection attempts.
+type fakeConnectTransport struct {
+	err error
+
+	mtx         sync.Mutex
+	numConnects int
+}
+
+func (t *fakeConnectTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	t.mtx.Lock()
+	t.numConnects++
+	t.mtx.Unlock()
+
+	go func() {
+		resCh <- ShellConnUpdate{
+			DebugInfo: &ShellConnDebugInfo{Message: "connecting"},
+		}
+
+		if t.err != nil {
+			resCh <- ShellConnUpdate{Result: &ShellConnResult{Err: t.err}}
+			return
+		}
+
+		resCh <- ShellConnUpdate{Result: &ShellConnResult{Conn: newFakeShellConn(&fakeLogs{})}}
+	}()
+}
+
+func (t *fakeConnectTransport) getNumConnects() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.numConnects
+}
+
+func TestShellTransportAutoFallback(t *testing.T) {
+	picks := NewTransportAutoPicks()
+
+	sshLib := &fakeConnectTransport{
+		err: classifyErr(ConnErrCategoryAuth, errors.New(
+			"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain",
+		)),
+	}
+	sshBin := &fakeConnectTransport{}
+
+	newTransport := func() ShellTransport {
+		return NewShellTransportAuto(ShellTransportAutoParams{
+			SSHLib: sshLib,
+			SSHBin: sshBin,
+			Key:    "nerdlog@myhost:22",
+			Picks:  picks,
+		})
+	}
+
+	res := connectTransport(newTransport())
+	if assert.NoError(t, res.Err) {
+		res.Conn.Close()
+	}
+	assert.Equal(t, 1, sshLib.getNumConnects())
+	assert.Equal(t, 1, sshBin.getNumConnects())
+	assert.Equal(t, TransportModeKind(TransportModeKindSSHBin), picks.get("nerdlog@myhost:22"))
+
+	// ssh-bin is remembered for the host, so ssh-lib isn't tried anymore, even
+	// by another transport instance.
+	res = connectTransport(newTransport())
+	if assert.NoError(t, res.Err) {
+		res.Conn.Close()
+	}
+	assert.Equal(t, 1, sshLib.getNumConnects())
+	assert.Equal(t, 2, sshBin.getNumConnects())
+
+	// But other hosts still try ssh-lib first.
+	assert.Equal(t, TransportModeKind(""), picks.get("nerdlog@otherhost:22"))
+
+	// And so does everyone with other picks, e.g. another LStreamsManager.
+	assert.Equal(t, TransportModeKind(""), NewTransportAutoPicks().get("nerdlog@myhost:22"))
+}
+
+func TestShellTransportAutoNoFallback(t *testing.T) {
+	picks := NewTransportAutoPicks()
+
+	for _, libErr := range []error{
+		classifyErr(ConnErrCategoryRefused, errors.New("dial tcp 10.0.0.1:22: connect: connection refused")),
+		classifyErr(ConnErrCategoryTimeout, errors.New("dial tcp 10.0.0.1:22: i/o timeout")),
+		errors.New("ssh: handshake failed: host key mismatch for myhost:22"),
+	} {
+		sshLib := &fakeConnectTransport{err: libErr}
+		sshBin := &fakeConnectTransport{}
+
+		res := connectTransport(NewShellTransportAuto(ShellTransportAutoParams{
+			SSHLib: sshLib,
+			SSHBin: sshBin,
+			Key:    "nerdlog@myhost:22",
+			Picks:  picks,
+		}))
+		assert.Equal(t, libErr, res.Err)
+		assert.Equal(t, 0, sshBin.getNumConnects(), "error %q", libErr)
+	}
+
+	assert.Equal(t, TransportModeKind(""), picks.get("nerdlog@myhost:22"))
+}
+
+func TestShellTransportAutoBothFail(t *testing.T) {
+	picks := NewTransportAutoPicks()
+
+	sshLib := &fakeConnectTransport{
+		err: errors.New("ssh: handshake failed: ssh: no common algorithm for key exchange"),
+	}
+	sshBin := &fakeConnectTransport{
+		err: classifyErr(ConnErrCategoryAuth, errors.New("Permission denied (publickey)")),
+	}
+
+	res := connectTransport(NewShellTransportAuto(ShellTransportAutoParams{
+		SSHLib: sshLib,
+		SSHBin: sshBin,
+		Key:    "nerdlog@myhost:22",
+		Picks:  picks,
+	}))
+	if assert.Error(t, res.Err) {
+		assert.Equal(t,
+			"ssh-lib failed (ssh: handshake failed: ssh: no common algorithm for key exchange), "+
+				"and then ssh-bin: Permission denied (publickey)",
+			res.Err.Error(),
+		)
+		assert.ErrorIs(t, res.Err, ErrAuthFailed)
+	}
+	assert.Equal(t, 1, sshBin.getNumConnects())
+
+	// Nothing is remembered, so ssh-lib is tried again next time.
+	assert.Equal(t, TransportModeKind(""), picks.get("nerdlog@myhost:22"))
+}
+
+func TestParseTransportModeAuto(t *testing.T) {
+	tm, err := ParseTransportMode("auto")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, TransportModeKind(TransportModeKindAuto), tm.Kind())
+	assert.Equal(t, "auto", tm.String())
+	assert.Equal(t, DefaultSSHShellCommand, tm.CustomShellCommand())
+}
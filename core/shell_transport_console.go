@@ -0,0 +1,521 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+const (
+	// consoleReadyMarkerPrefix, followed by a unique number and "__", is
+	// printed by the shell on the console once it's initialized; see
+	// persistentSessionReadyMarkerPrefix for why it's unique.
+	consoleReadyMarkerPrefix = "__NERDLOG_CONSOLE_READY_"
+
+	// consoleStderrFifoName is the name of the fifo which the stderr of the
+	// shell on the console is redirected through; see terminalShellInitCmd.
+	// The $$ is expanded by the shell to its PID, so that multiple consoles of
+	// the same host don't clash.
+	consoleStderrFifoName = "nerdlog_console_$$"
+
+	// consoleInitInterval is how often we poke the console while waiting for
+	// the shell to get ready: before anything is printed, a newline is sent to
+	// wake up the console (a serial console doesn't print anything until
+	// then), and after that, the init command is resent whenever the output
+	// is quiet for that long.
+	consoleInitInterval = 1 * time.Second
+
+	// consoleExitTimeout is how long Close waits for the session to end before
+	// closing the connection.
+	consoleExitTimeout = 1 * time.Second
+)
+
+// consoleLoginFailures are the messages (in lowercase) which mean that the
+// login has failed; once the init command is sent, they're not checked
+// anymore.
+var consoleLoginFailures = []string{
+	"login incorrect",
+	"authentication failure",
+	"access denied",
+	"permission denied",
+	"bad password",
+}
+
+// ShellTransportConsole is an implementation of ShellTransport which works
+// over a plain terminal stream, like a telnet connection or a local serial
+// console: that's what the network gear and the out-of-band management
+// typically expose instead of ssh.
+//
+// It logs in by answering the login and password prompts (the password is
+// requested from the user), and then initializes the shell the same way as
+// the persistent sessions do (see terminalShellInitCmd): turns off the echo
+// and the line editing, and demultiplexes stderr from the terminal output.
+type ShellTransportConsole struct {
+	params ShellTransportConsoleParams
+
+	// mtx protects password.
+	mtx sync.Mutex
+
+	// password is the password which the last successful login used, so that
+	// reconnects don't ask for it again.
+	password string
+}
+
+var _ ShellTransport = &ShellTransportConsole{}
+
+type ShellTransportConsoleParams struct {
+	// TelnetAddr is the host:port to connect to over telnet. Exactly one of
+	// TelnetAddr and SerialDevice must be set.
+	TelnetAddr string
+
+	// BindAddress, if not empty, is the local IP address to dial TelnetAddr
+	// from.
+	BindAddress string
+
+	// SerialDevice is the path of the serial device, like "/dev/ttyUSB0".
+	SerialDevice string
+
+	// SerialBaud is the baud rate of SerialDevice; if zero, the device is used
+	// as is.
+	SerialBaud int
+
+	// User is the username to answer the login prompt with.
+	User string
+
+	// Host is the human-readable name of the host, used in the password
+	// prompt.
+	Host string
+
+	Timeouts ShellConnTimeouts
+
+	Logger *log.Logger
+}
+
+func NewShellTransportConsole(params ShellTransportConsoleParams) *ShellTransportConsole {
+	params.Logger = params.Logger.WithNamespaceAppended("TransportConsole")
+
+	if params.Timeouts.ShellStart == 0 {
+		params.Timeouts.ShellStart = DefaultShellStartTimeout
+	}
+
+	if params.Timeouts.Marker == 0 {
+		params.Timeouts.Marker = DefaultMarkerTimeout
+	}
+
+	return &ShellTransportConsole{
+		params: params,
+	}
+}
+
+func (st *ShellTransportConsole) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		res := st.doConnect(ctx, resCh)
+		if res.Err != nil {
+			st.params.Logger.Errorf("Connection failed: %s", res.Err)
+		}
+
+		resCh <- ShellConnUpdate{Result: &res}
+	}()
+}
+
+func (st *ShellTransportConsole) doConnect(
+	ctx context.Context, resCh chan<- ShellConnUpdate,
+) ShellConnResult {
+	rwc, err := st.open(ctx, resCh)
+	if err != nil {
+		return ShellConnResult{Err: classifyConnErr(err)}
+	}
+
+	chunks := readConsoleChunks(rwc)
+
+	readyMarker := fmt.Sprintf("%s%d__", consoleReadyMarkerPrefix, time.Now().UnixNano())
+
+	rest, err := st.login(ctx, resCh, rwc, chunks, readyMarker)
+	if err != nil {
+		rwc.Close()
+		return ShellConnResult{Err: err}
+	}
+
+	return ShellConnResult{Conn: newConsoleConn(rwc, chunks, rest, readyMarker)}
+}
+
+func (st *ShellTransportConsole) open(
+	ctx context.Context, resCh chan<- ShellConnUpdate,
+) (io.ReadWriteCloser, error) {
+	if st.params.SerialDevice != "" {
+		resCh <- ShellConnUpdate{
+			DebugInfo: &ShellConnDebugInfo{
+				Message: fmt.Sprintf("Opening serial device %s", st.params.SerialDevice),
+			},
+		}
+
+		rwc, err := openSerialPort(st.params.SerialDevice, st.params.SerialBaud)
+		if err != nil {
+			return nil, errors.Annotatef(err, "opening serial device %s", st.params.SerialDevice)
+		}
+
+		return rwc, nil
+	}
+
+	resCh <- ShellConnUpdate{
+		DebugInfo: &ShellConnDebugInfo{
+			Message: fmt.Sprintf("Connecting to %s over telnet", st.params.TelnetAddr),
+		},
+	}
+
+	dialer, err := newDialer(connectionTimeout, st.params.BindAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", st.params.TelnetAddr)
+	if err != nil {
+		return nil, annotateDialErr(err, st.params.TelnetAddr, st.params.BindAddress)
+	}
+
+	return newTelnetConn(conn), nil
+}
+
+// login waits for the prompts on the console and answers them, until the
+// shell gets ready (prints the given ready marker). Returns the output which
+// came after the ready marker line.
+func (st *ShellTransportConsole) login(
+	ctx context.Context,
+	resCh chan<- ShellConnUpdate,
+	w io.Writer,
+	chunks <-chan consoleChunk,
+	readyMarker string,
+) (rest string, err error) {
+	initCmd := terminalShellInitCmd(consoleStderrFifoName, readyMarker) + "\n"
+
+	// Until anything is printed, the ShellStart timeout applies, and after
+	// that, the Marker one, restarted every time we answer a prompt.
+	timeoutTimer := time.NewTimer(st.params.Timeouts.ShellStart)
+	defer timeoutTimer.Stop()
+
+	resetTimeout := func() {
+		if !timeoutTimer.Stop() {
+			<-timeoutTimer.C
+		}
+		timeoutTimer.Reset(st.params.Timeouts.Marker)
+	}
+
+	pokeTicker := time.NewTicker(consoleInitInterval)
+	defer pokeTicker.Stop()
+
+	var (
+		gotOutput    bool
+		quiet        bool
+		initSent     bool
+		passwordSent bool
+		numLogins    int
+
+		// buf contains the output which isn't processed yet: zero or more full
+		// lines, and maybe an incomplete one, like a prompt.
+		buf string
+	)
+
+	write := func(s string) error {
+		if _, err := io.WriteString(w, s); err != nil {
+			return errors.Annotatef(err, "writing to the console")
+		}
+
+		return nil
+	}
+
+	for {
+		select {
+		case chunk := <-chunks:
+			if chunk.err != nil {
+				return "", classifyErr(ConnErrCategoryNoMarker, errors.Annotatef(
+					chunk.err, "the console output has ended before the shell got ready",
+				))
+			}
+
+			if !gotOutput {
+				gotOutput = true
+				resetTimeout()
+			}
+			quiet = false
+
+			buf += string(chunk.data)
+
+			// Process the full lines.
+			for {
+				idx := strings.IndexByte(buf, '\n')
+				if idx < 0 {
+					break
+				}
+
+				line := stripTerminalControls(buf[:idx])
+				buf = buf[idx+1:]
+
+				if strings.Contains(line, readyMarker) {
+					st.params.Logger.Verbose3f("The console is ready")
+					return buf, nil
+				}
+
+				st.params.Logger.Verbose3f("Got line while logging in: %q", line)
+
+				if passwordSent && !initSent && isConsoleLoginFailure(line) {
+					st.forgetPassword()
+					return "", classifyErr(ConnErrCategoryAuth, errors.Errorf("login failed: %s", line))
+				}
+			}
+
+			// Check whether the incomplete line is a prompt.
+			prompt := strings.ToLower(strings.TrimSpace(stripTerminalControls(buf)))
+
+			switch {
+			case strings.HasSuffix(prompt, "password:"):
+				buf = ""
+
+				password, err := st.getPassword(ctx, resCh)
+				if err != nil {
+					return "", errors.Trace(err)
+				}
+
+				if err := write(password + "\r"); err != nil {
+					return "", errors.Trace(err)
+				}
+				passwordSent = true
+				resetTimeout()
+
+			case strings.HasSuffix(prompt, "login:") || strings.HasSuffix(prompt, "username:"):
+				buf = ""
+
+				numLogins++
+				if numLogins > 1 {
+					st.forgetPassword()
+					return "", classifyErr(ConnErrCategoryAuth, errors.Errorf(
+						"login failed: got login prompt again",
+					))
+				}
+
+				if err := write(st.params.User + "\r"); err != nil {
+					return "", errors.Trace(err)
+				}
+				resetTimeout()
+			}
+
+		case <-pokeTicker.C:
+			switch {
+			case !gotOutput:
+				st.params.Logger.Verbose3f("No output yet, sending a newline")
+				if err := write("\r"); err != nil {
+					return "", errors.Trace(err)
+				}
+
+			case quiet:
+				// Nothing was printed for a while, and the last thing wasn't a
+				// login prompt, so presumably we're at the shell prompt.
+				st.params.Logger.Verbose3f("Sending the init command")
+				if err := write(initCmd); err != nil {
+					return "", errors.Trace(err)
+				}
+				initSent = true
+			}
+
+			quiet = true
+
+		case <-timeoutTimer.C:
+			if !gotOutput {
+				return "", classifyErr(ConnErrCategoryTimeout, errors.Errorf(
+					"timeout waiting for any output from the console after %s", st.params.Timeouts.ShellStart,
+				))
+			}
+
+			return "", classifyErr(ConnErrCategoryNoMarker, errors.Errorf(
+				"timeout waiting for the shell on the console to get ready after %s", st.params.Timeouts.Marker,
+			))
+
+		case <-ctx.Done():
+			return "", errors.Annotatef(ctx.Err(), "logging in to the console")
+		}
+	}
+}
+
+// getPassword returns the password from the last successful login, or if
+// there's none, requests it from the user.
+func (st *ShellTransportConsole) getPassword(
+	ctx context.Context, resCh chan<- ShellConnUpdate,
+) (string, error) {
+	st.mtx.Lock()
+	password := st.password
+	st.mtx.Unlock()
+
+	if password != "" {
+		return password, nil
+	}
+
+	passwordCh := make(chan string, 1)
+
+	resCh <- ShellConnUpdate{
+		DataRequest: &ShellConnDataRequest{
+			Title:      "Console login",
+			Message:    fmt.Sprintf("Please enter the password for %s on %s.", st.params.User, st.params.Host),
+			DataKind:   ShellConnDataKindPassword,
+			ResponseCh: passwordCh,
+		},
+	}
+
+	select {
+	case password = <-passwordCh:
+	case <-ctx.Done():
+		return "", errors.Trace(ctx.Err())
+	}
+
+	// If it's wrong, it's forgotten once the login fails; see forgetPassword.
+	st.mtx.Lock()
+	st.password = password
+	st.mtx.Unlock()
+
+	return password, nil
+}
+
+func (st *ShellTransportConsole) forgetPassword() {
+	st.mtx.Lock()
+	st.password = ""
+	st.mtx.Unlock()
+}
+
+func isConsoleLoginFailure(line string) bool {
+	line = strings.ToLower(line)
+	for _, msg := range consoleLoginFailures {
+		if strings.Contains(line, msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// consoleChunk is a chunk of the console output, or the error which has ended
+// it.
+type consoleChunk struct {
+	data []byte
+	err  error
+}
+
+// readConsoleChunks starts reading the console output, and returns the
+// channel which receives the chunks; the last chunk has a non-nil error. The
+// same channel is read first while logging in, and then by the consoleConn,
+// so that nothing which the shell prints right after the ready marker is
+// lost.
+func readConsoleChunks(r io.Reader) <-chan consoleChunk {
+	chunks := make(chan consoleChunk, 16)
+
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- consoleChunk{data: buf[:n]}
+			}
+
+			if err != nil {
+				chunks <- consoleChunk{err: err}
+				return
+			}
+		}
+	}()
+
+	return chunks
+}
+
+// consoleConn is the connection to the shell on the console. Its output is
+// the terminal output, so the control characters (including the \r-s, since
+// the terminal translates the newlines into \r\n) are stripped from it, and
+// the stderr lines are demultiplexed from it; see terminalShellInitCmd.
+type consoleConn struct {
+	rwc io.ReadWriteCloser
+
+	stdoutR *io.PipeReader
+	stderrR *io.PipeReader
+
+	// outputDoneCh is closed once the output has ended.
+	outputDoneCh chan struct{}
+}
+
+func newConsoleConn(
+	rwc io.ReadWriteCloser, chunks <-chan consoleChunk, rest, readyMarker string,
+) *consoleConn {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+
+	c := &consoleConn{
+		rwc: rwc,
+
+		stdoutR: stdoutR,
+		stderrR: stderrR,
+
+		outputDoneCh: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(c.outputDoneCh)
+		defer stdoutW.Close()
+		defer stderrW.Close()
+
+		buf := rest
+		for {
+			for {
+				idx := strings.IndexByte(buf, '\n')
+				if idx < 0 {
+					break
+				}
+
+				line := stripTerminalControls(buf[:idx])
+				buf = buf[idx+1:]
+
+				// If the console was slow, the init command might have been sent
+				// more than once, so skip the extra ready markers.
+				if strings.Contains(line, readyMarker) {
+					continue
+				}
+
+				w := stdoutW
+				if strings.HasPrefix(line, persistentSessionStderrPrefix) {
+					w = stderrW
+					line = strings.TrimPrefix(line, persistentSessionStderrPrefix)
+				}
+
+				if _, err := io.WriteString(w, line+"\n"); err != nil {
+					return
+				}
+			}
+
+			chunk := <-chunks
+			if chunk.err != nil {
+				return
+			}
+
+			buf += string(chunk.data)
+		}
+	}()
+
+	return c
+}
+
+func (c *consoleConn) Stdin() io.Writer  { return c.rwc }
+func (c *consoleConn) Stdout() io.Reader { return c.stdoutR }
+func (c *consoleConn) Stderr() io.Reader { return c.stderrR }
+
+// Close logs out, so that the console (especially a serial one, which
+// doesn't end the session on disconnect) isn't left logged in.
+func (c *consoleConn) Close() {
+	if _, err := io.WriteString(c.rwc, "\nexit\n"); err == nil {
+		select {
+		case <-c.outputDoneCh:
+		case <-time.After(consoleExitTimeout):
+		}
+	}
+
+	c.rwc.Close()
+}
@@ -0,0 +1,418 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTransportModeConsole(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		wantKind   TransportModeKind
+		wantAddr   string
+		wantDevice string
+		wantBaud   int
+		wantString string
+	}{
+		{spec: "telnet", wantKind: TransportModeKindTelnet, wantString: "telnet"},
+		{spec: "telnet:console-srv:7001", wantKind: TransportModeKindTelnet, wantAddr: "console-srv:7001", wantString: "telnet:console-srv:7001"},
+		{spec: "serial:/dev/ttyUSB0", wantKind: TransportModeKindSerial, wantDevice: "/dev/ttyUSB0", wantString: "serial:/dev/ttyUSB0"},
+		{spec: "serial:/dev/ttyUSB0:115200", wantKind: TransportModeKindSerial, wantDevice: "/dev/ttyUSB0", wantBaud: 115200, wantString: "serial:/dev/ttyUSB0:115200"},
+	} {
+		tm, err := ParseTransportMode(tc.spec)
+		if !assert.NoError(t, err, tc.spec) {
+			continue
+		}
+
+		device, baud := tm.SerialDevice()
+
+		assert.Equal(t, tc.wantKind, tm.Kind(), tc.spec)
+		assert.Equal(t, tc.wantAddr, tm.TelnetAddr(), tc.spec)
+		assert.Equal(t, tc.wantDevice, device, tc.spec)
+		assert.Equal(t, tc.wantBaud, baud, tc.spec)
+		assert.Equal(t, tc.wantString, tm.String(), tc.spec)
+		assert.Equal(t, "", tm.CustomShellCommand(), tc.spec)
+	}
+
+	for _, spec := range []string{"telnet:", "telnet:myhost", "telnet::23", "serial:", "serial::9600", "serial:/dev/ttyS0:0"} {
+		_, err := ParseTransportMode(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestTelnetConn(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+
+	c := newTelnetConn(clientConn)
+	defer c.Close()
+
+	serverErrCh := make(chan error, 1)
+	serverReadCh := make(chan []byte, 1)
+	go func() {
+		_, err := serverConn.Write([]byte{
+			telnetIAC, telnetWILL, telnetOptEcho,
+			telnetIAC, telnetDO, 31, // NAWS
+			telnetIAC, telnetSB, 24, 1, telnetIAC, telnetSE,
+			'a', telnetIAC, telnetIAC, 'b',
+			telnetIAC, telnetWILL, telnetOptEcho, // Repeated, so no reply.
+		})
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+
+		replies := make([]byte, 6)
+		if _, err := io.ReadFull(serverConn, replies); err != nil {
+			serverErrCh <- err
+			return
+		}
+		serverReadCh <- replies
+
+		data := make([]byte, 4)
+		if _, err := io.ReadFull(serverConn, data); err != nil {
+			serverErrCh <- err
+			return
+		}
+		serverReadCh <- data
+	}()
+
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{'a', telnetIAC, 'b'}, buf[:n])
+
+	expectServerRead := func(want []byte) {
+		select {
+		case got := <-serverReadCh:
+			assert.Equal(t, want, got)
+		case err := <-serverErrCh:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	expectServerRead([]byte{
+		telnetIAC, telnetDO, telnetOptEcho,
+		telnetIAC, telnetWONT, 31,
+	})
+
+	go func() {
+		if _, err := c.Write([]byte{'x', telnetIAC, 'y'}); err != nil {
+			serverErrCh <- err
+		}
+	}()
+
+	expectServerRead([]byte{'x', telnetIAC, telnetIAC, 'y'})
+}
+
+// fakeTelnetServer accepts telnet connections, and asks for the login and the
+// password like an appliance would, and then runs /bin/sh.
+type fakeTelnetServer struct {
+	l net.Listener
+
+	user     string
+	password string
+
+	numLogins int32
+}
+
+func startFakeTelnetServer(t *testing.T, user, password string) *fakeTelnetServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeTelnetServer{
+		l:        l,
+		user:     user,
+		password: password,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.handle(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeTelnetServer) addr() *net.TCPAddr {
+	return s.l.Addr().(*net.TCPAddr)
+}
+
+func (s *fakeTelnetServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// Some options to negotiate, and the login prompt after the banner, with
+	// the telnet-style newlines.
+	conn.Write([]byte{
+		telnetIAC, telnetDO, 24, // Terminal type
+		telnetIAC, telnetWILL, telnetOptEcho,
+		telnetIAC, telnetWILL, telnetOptSGA,
+	})
+	io.WriteString(conn, "\r\nWelcome to switch-01\r\n\r\nswitch-01 login: ")
+
+	r := &telnetServerReader{br: bufio.NewReader(conn)}
+
+	user, err := r.readLine()
+	if err != nil {
+		return
+	}
+
+	// The username is echoed, the password is not.
+	io.WriteString(conn, user+"\r\nPassword: ")
+
+	password, err := r.readLine()
+	if err != nil {
+		return
+	}
+
+	if user != s.user || password != s.password {
+		io.WriteString(conn, "\r\nLogin incorrect\r\n")
+		return
+	}
+
+	atomic.AddInt32(&s.numLogins, 1)
+
+	io.WriteString(conn, "\r\nLast login: Mon Mar 10 10:00:00 2025 from 10.0.0.1\r\n\x1b[1mswitch-01$\x1b[0m ")
+
+	cmd := exec.Command("/bin/sh")
+	cmd.Stdin = r
+	cmd.Stdout = conn
+	cmd.Stderr = conn
+	cmd.Run()
+}
+
+// telnetServerReader reads the data sent by the telnet client, skipping the
+// option negotiation replies.
+type telnetServerReader struct {
+	br *bufio.Reader
+}
+
+func (r *telnetServerReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && r.br.Buffered() == 0 {
+			break
+		}
+
+		b, err := r.br.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+
+			return 0, err
+		}
+
+		if b == telnetIAC {
+			cmd, err := r.br.ReadByte()
+			if err != nil {
+				return n, err
+			}
+
+			if cmd != telnetIAC {
+				// The negotiation reply: one more byte to skip.
+				if _, err := r.br.ReadByte(); err != nil {
+					return n, err
+				}
+
+				continue
+			}
+		}
+
+		p[n] = b
+		n++
+	}
+
+	return n, nil
+}
+
+// readLine reads a line terminated by \r or \n, skipping the empty lines.
+func (r *telnetServerReader) readLine() (string, error) {
+	var sb strings.Builder
+	buf := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+
+		if buf[0] == '\r' || buf[0] == '\n' {
+			if sb.Len() == 0 {
+				continue
+			}
+
+			return sb.String(), nil
+		}
+
+		sb.WriteByte(buf[0])
+	}
+}
+
+// connectConsole connects using the given transport, answering the password
+// request with the given password, and returns the result along with the
+// number of password requests.
+func connectConsole(t *testing.T, transport ShellTransport, password string) (*ShellConnResult, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	resCh := make(chan ShellConnUpdate, 8)
+	transport.Connect(ctx, resCh)
+
+	numRequests := 0
+	for upd := range resCh {
+		switch {
+		case upd.DataRequest != nil:
+			numRequests++
+			assert.Equal(t, ShellConnDataKindPassword, upd.DataRequest.DataKind)
+			upd.DataRequest.ResponseCh <- password
+
+		case upd.Result != nil:
+			return upd.Result, numRequests
+		}
+	}
+
+	return nil, numRequests
+}
+
+func TestShellTransportConsoleTelnet(t *testing.T) {
+	server := startFakeTelnetServer(t, "admin", "secret")
+
+	transport := NewShellTransportConsole(ShellTransportConsoleParams{
+		TelnetAddr: server.addr().String(),
+		User:       "admin",
+		Host:       "switch-01",
+		Logger:     log.NewLogger(log.Error),
+	})
+
+	for i := 0; i < 2; i++ {
+		res, numRequests := connectConsole(t, transport, "secret")
+		if !assert.NoError(t, res.Err) {
+			return
+		}
+
+		// The password is only requested once, and reused on reconnect.
+		if i == 0 {
+			assert.Equal(t, 1, numRequests)
+		} else {
+			assert.Equal(t, 0, numRequests)
+		}
+
+		conn := res.Conn
+
+		stdoutLineCh := readLineAsync(bufio.NewReader(conn.Stdout()))
+		stderrLineCh := readLineAsync(bufio.NewReader(conn.Stderr()))
+
+		fmt.Fprintf(conn.Stdin(), "echo 'hello   world'; echo oops >&2\n")
+
+		assert.Equal(t, "hello   world", readLineTimeout(t, stdoutLineCh))
+		assert.Equal(t, "oops", readLineTimeout(t, stderrLineCh))
+
+		conn.Close()
+	}
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server.numLogins))
+}
+
+func TestShellTransportConsoleWrongPassword(t *testing.T) {
+	server := startFakeTelnetServer(t, "admin", "secret")
+
+	transport := NewShellTransportConsole(ShellTransportConsoleParams{
+		TelnetAddr: server.addr().String(),
+		User:       "admin",
+		Host:       "switch-01",
+		Logger:     log.NewLogger(log.Error),
+	})
+
+	res, numRequests := connectConsole(t, transport, "wrong")
+	assert.Equal(t, 1, numRequests)
+	if assert.Error(t, res.Err) {
+		assert.True(t, errors.Is(res.Err, ErrAuthFailed), res.Err.Error())
+	}
+
+	// The wrong password is not reused.
+	res, numRequests = connectConsole(t, transport, "secret")
+	assert.Equal(t, 1, numRequests)
+	if assert.NoError(t, res.Err) {
+		res.Conn.Close()
+	}
+}
+
+func TestConsoleQuery(t *testing.T) {
+	server := startFakeTelnetServer(t, "admin", "secret")
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "messages")
+
+	now := time.Now().UTC()
+	ts := now.Add(-5 * time.Minute).Format("2006-01-02T15:04:05.000000-07:00")
+	logData := ts + " switch-01 ifmgr[42]: Interface ge-0/0/1 is up\n"
+	if err := ioutil.WriteFile(logPath, []byte(logData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var numRequests int32
+
+	n, err := New(Options{
+		LStreams: "switch-01",
+		ConfigLogStreams: ConfigLogStreams{
+			"switch-01": {
+				Hostname: "127.0.0.1",
+				Port:     fmt.Sprintf("%d", server.addr().Port),
+				User:     "admin",
+				LogFiles: []string{logPath},
+				Options: ConfigLogStreamOptions{
+					Transport: "telnet",
+					ShellInit: []string{"export TZ=UTC"},
+				},
+			},
+		},
+		OnDataRequest: func(req *ShellConnDataRequest) {
+			atomic.AddInt32(&numRequests, 1)
+			req.ResponseCh <- "secret"
+		},
+		ClientID: "console_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        now.Add(-time.Hour),
+		MaxNumLines: 10,
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, resp.Logs, 1) {
+		return
+	}
+
+	assert.Equal(t, "Interface ge-0/0/1 is up", resp.Logs[0].Msg)
+	assert.Equal(t, "ifmgr", resp.Logs[0].Context["program"])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&numRequests))
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dimonomid/nerdlog/log"
@@ -17,6 +18,28 @@ import (
 
 const echoMarkerConnected = "__CONNECTED__"
 
+const (
+	// DefaultShellStartTimeout is a default for ShellConnTimeouts.ShellStart.
+	DefaultShellStartTimeout = connectionTimeout
+	// DefaultMarkerTimeout is a default for ShellConnTimeouts.Marker.
+	DefaultMarkerTimeout = connectionTimeout
+)
+
+// ShellConnTimeouts are the timeouts of the two phases of connecting using an
+// external command; they're separate, so that e.g. a host with slow auth
+// doesn't require a large timeout which would also mask a stuck shell.
+type ShellConnTimeouts struct {
+	// ShellStart is how long to wait from starting the command until it
+	// outputs anything (to either stdout or stderr), which normally means that
+	// the authentication is done and the shell has started. If zero,
+	// DefaultShellStartTimeout is used.
+	ShellStart time.Duration
+
+	// Marker is how long to wait from the first output until the connection
+	// marker shows up in stdout. If zero, DefaultMarkerTimeout is used.
+	Marker time.Duration
+}
+
 // ShellTransportCustomCmd is an implementation of ShellTransport that opens an
 // shell session using external custom command (such as ssh).
 type ShellTransportCustomCmd struct {
@@ -44,8 +67,29 @@ type ShellTransportCustomCmdParams struct {
 	//   in nerdlog logstreams config.
 	// - "NLUSER": Username, only present if was specified explicitly or was
 	//   present in nerdlog logstreams config.
+	// - "NLJUMP": Comma-separated chain of jumphosts like
+	//   "user1@bastion1,user2@bastion2:2222", in the format of the ssh's -J
+	//   option; only present if jumphosts were specified.
+	// - "NLBIND": Local address to connect from, in the format of the ssh's
+	//   -b option; only present if the bind address was specified.
+	// - "NLPROXYCOMMAND": The command to connect through, in the format of the
+	//   ssh's ProxyCommand option; only present if it was specified.
+	// - "NLPROXYURL": The HTTP CONNECT proxy or WebSocket tunnel to connect
+	//   through, see ConfigLogStream.ProxyURL; only present if it was
+	//   specified. ssh-bin ignores it.
 	EnvOverride map[string]string
 
+	Timeouts ShellConnTimeouts
+
+	// StderrPatterns specifies which stderr lines printed before the
+	// connection marker are benign, and which are fatal; they're used in
+	// addition to DefaultConnStderrPatterns.
+	StderrPatterns ConnStderrPatterns
+
+	// PrintfMarker, if true, makes the connection marker printed with printf
+	// instead of echo; it's set for the busybox-based hosts, see markerCmd.
+	PrintfMarker bool
+
 	Logger *log.Logger
 }
 
@@ -53,23 +97,53 @@ type ShellTransportCustomCmdParams struct {
 func NewShellTransportCustomCmd(params ShellTransportCustomCmdParams) *ShellTransportCustomCmd {
 	params.Logger = params.Logger.WithNamespaceAppended("TransportCustomCmd")
 
+	if params.Timeouts.ShellStart == 0 {
+		params.Timeouts.ShellStart = DefaultShellStartTimeout
+	}
+
+	if params.Timeouts.Marker == 0 {
+		params.Timeouts.Marker = DefaultMarkerTimeout
+	}
+
 	return &ShellTransportCustomCmd{
 		params: params,
 	}
 }
 
+// cmdFields parses the shell command into separate fields, expanding the
+// env vars.
+func (s *ShellTransportCustomCmd) cmdFields() ([]string, error) {
+	cmdFields, err := shell.Fields(s.params.ShellCommand, func(varName string) string {
+		if value, ok := s.params.EnvOverride[varName]; ok {
+			return value
+		}
+
+		return os.Getenv(varName)
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing shell command %q", s.params.ShellCommand)
+	}
+
+	if len(cmdFields) == 0 {
+		return nil, errors.Errorf("command is empty")
+	}
+
+	return cmdFields, nil
+}
+
 // Connect starts the local shell and sends the result to the provided channel.
-func (s *ShellTransportCustomCmd) Connect(resCh chan<- ShellConnUpdate) {
-	go s.doConnect(resCh)
+func (s *ShellTransportCustomCmd) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go s.doConnect(ctx, resCh)
 }
 
 func (s *ShellTransportCustomCmd) doConnect(
-	resCh chan<- ShellConnUpdate,
+	ctx context.Context, resCh chan<- ShellConnUpdate,
 ) (res ShellConnResult) {
 	logger := s.params.Logger
 
 	defer func() {
 		if res.Err != nil {
+			res.Err = classifyConnErr(res.Err)
 			logger.Errorf("Connection failed: %s", res.Err)
 		}
 		resCh <- ShellConnUpdate{
@@ -77,21 +151,15 @@ func (s *ShellTransportCustomCmd) doConnect(
 		}
 	}()
 
-	// Parse shell commands into separate fields.
-	cmdFields, err := shell.Fields(s.params.ShellCommand, func(varName string) string {
-		if value, ok := s.params.EnvOverride[varName]; ok {
-			return value
-		}
-
-		return os.Getenv(varName)
-	})
+	cmdFields, err := s.cmdFields()
 	if err != nil {
-		res.Err = errors.Annotatef(err, "parsing shell command %q", s.params.ShellCommand)
+		res.Err = errors.Trace(err)
 		return res
 	}
 
-	if len(cmdFields) == 0 {
-		res.Err = errors.Errorf("command is empty")
+	stderrClassifier, err := newConnStderrClassifier(s.params.StderrPatterns)
+	if err != nil {
+		res.Err = errors.Trace(err)
 		return res
 	}
 
@@ -111,47 +179,156 @@ func (s *ShellTransportCustomCmd) doConnect(
 	}
 	logger.Infof("Executing external command: %q", sshCmdDebug)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, cmdFields[0], cmdFields[1:]...)
+	// The process context is separate from the ctx given to us, since the
+	// process needs to outlive the connection phase; but if we fail to
+	// connect, the process gets killed.
+	procCtx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(procCtx, cmdFields[0], cmdFields[1:]...)
+	defer func() {
+		if res.Conn == nil {
+			cancel()
+
+			// Reap the killed process, if it was started at all.
+			if cmd.Process != nil {
+				go cmd.Wait()
+			}
+		}
+	}()
+
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		res.Err = errors.Annotatef(err, "getting stdin pipe")
 		return res
 	}
-	rawStdout, err := cmd.StdoutPipe()
+	rawStdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		res.Err = errors.Annotatef(err, "getting stdout pipe")
 		return res
 	}
-	stderr, err := cmd.StderrPipe()
+	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
 		res.Err = errors.Annotatef(err, "getting stderr pipe")
 		return res
 	}
 
 	if err := cmd.Start(); err != nil {
-		res.Err = errors.Annotatef(err, "starting shell")
+		// Most likely the binary doesn't exist or isn't executable.
+		res.Err = classifyErr(ConnErrCategoryShellNotFound, errors.Annotatef(err, "starting shell"))
 		return res
 	}
 
+	// Any output from the command, to either stdout or stderr, means that the
+	// shell has started; after that, we switch to waiting for the marker.
+	startedCh := make(chan struct{})
+	var startedOnce sync.Once
+	onFirstOutput := func() {
+		startedOnce.Do(func() { close(startedCh) })
+	}
+
+	rawStdout := newFirstChunkReader(rawStdoutPipe, onFirstOutput)
+	stderr := newFirstChunkReader(stderrPipe, onFirstOutput)
+
+	// markerCh is closed once the marker is received.
+	markerCh := make(chan struct{})
+
+	// Until the marker is received, the stderr lines are classified: the
+	// benign ones are dropped, and a fatal one makes us fail right away. The
+	// rest are kept, to be either included in the error if we fail to
+	// connect, or given to the client otherwise.
+	clientStderrR, clientStderrW := io.Pipe()
+	// Buffered, so that the goroutine doesn't get stuck if we're not waiting
+	// for the stderr anymore.
+	fatalStderrCh := make(chan string, 1)
+	preMarkerStderrCh := make(chan []string, 1)
+	go func() {
+		defer clientStderrW.Close()
+
+		// Our own copy of markerCh, which we set to nil once it's closed.
+		markerCh := markerCh
+
+		linesCh := make(chan string)
+		go func() {
+			defer close(linesCh)
+
+			br := bufio.NewReader(stderr)
+			for {
+				line, err := br.ReadString('\n')
+				if line != "" {
+					linesCh <- line
+				}
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		var pending []string
+
+		for {
+			select {
+			case line, ok := <-linesCh:
+				if !ok {
+					if markerCh != nil {
+						preMarkerStderrCh <- pending
+					}
+
+					return
+				}
+
+				if markerCh == nil {
+					if _, err := io.WriteString(clientStderrW, line); err != nil {
+						return
+					}
+
+					continue
+				}
+
+				switch stderrClassifier.classify(strings.TrimRight(line, "\r\n")) {
+				case connStderrBenign:
+					logger.Infof("Ignoring benign stderr line while connecting: %q", line)
+					continue
+
+				case connStderrFatal:
+					select {
+					case fatalStderrCh <- line:
+					default:
+					}
+				}
+
+				pending = append(pending, line)
+
+			case <-markerCh:
+				markerCh = nil
+
+				for _, line := range pending {
+					if _, err := io.WriteString(clientStderrW, line); err != nil {
+						return
+					}
+				}
+				pending = nil
+			}
+		}
+	}()
+
 	// To make sure we were able to connect, we just write "echo __CONNECTED__"
 	// to stdin, and wait for it to show up in the stdout.
+	connMarkerCmd := markerCmd(echoMarkerConnected, s.params.PrintfMarker)
 
 	resCh <- ShellConnUpdate{
 		DebugInfo: s.makeDebugInfo(fmt.Sprintf(
-			"Command started, writing \"echo %s\", waiting for it in stdout", echoMarkerConnected,
+			"Command started, writing \"%s\", waiting for it in stdout", connMarkerCmd,
 		)),
 	}
 
-	_, err = fmt.Fprintf(stdin, "echo %s\n", echoMarkerConnected)
-	if err != nil {
-		res.Err = errors.Annotatef(err, "writing connection marker")
-		return res
-	}
-
 	clientStdoutR, clientStdoutW := io.Pipe()
 	scanner := bufio.NewScanner(rawStdout)
-	connErrCh := make(chan error)
+	// After the marker, the client reads the stdout through this one, so that
+	// it can be paused; see PausableShellConn.
+	postMarkerStdout := newPausableReader(rawStdout)
+	// Buffered, so that the goroutine doesn't get stuck if we stop waiting for
+	// the marker due to timeout or cancellation.
+	connErrCh := make(chan error, 1)
 	go func() {
 		defer clientStdoutW.Close()
 		for scanner.Scan() {
@@ -160,8 +337,9 @@ func (s *ShellTransportCustomCmd) doConnect(
 			if line == echoMarkerConnected {
 				logger.Verbose3f("Got the marker, switching to raw passthrough for stdout")
 				// Done waiting, switch to raw passthrough
+				close(markerCh)
 				connErrCh <- nil
-				io.Copy(clientStdoutW, rawStdout)
+				io.Copy(clientStdoutW, postMarkerStdout)
 				return
 			}
 		}
@@ -170,45 +348,195 @@ func (s *ShellTransportCustomCmd) doConnect(
 			connErrCh <- errors.Annotatef(err, "reading from stdout while waiting for connection marker")
 		} else {
 			// Got EOF while waiting for the marker; apparently ssh failed to connect,
-			// so just read up all stderr (which likely contains the actual error message),
-			// and return it as an error.
-			stderrBytes, _ := io.ReadAll(stderr)
+			// so wait for all the stderr (which likely contains the actual error
+			// message, unless it's all benign), and return it as an error.
+			preMarkerStderr := <-preMarkerStderrCh
 			connErrCh <- errors.Errorf(
 				"failed to connect using external command \"%s\": %s",
-				sshCmdDebug, string(stderrBytes),
+				sshCmdDebug, strings.Join(preMarkerStderr, ""),
 			)
 		}
 	}()
 
-	// Wait for the marker to show up in output.
-	select {
-	case err := <-connErrCh:
-		if err != nil {
-			res.Err = errors.Trace(err)
+	_, err = fmt.Fprintf(stdin, "%s\n", connMarkerCmd)
+	if err != nil {
+		// Most likely the command has already exited, e.g. ssh has failed to
+		// authenticate; then the goroutine above gets EOF and reports the
+		// actual error from stderr, so we keep waiting for it.
+		logger.Errorf("Failed to write connection marker: %s", err.Error())
+	}
+
+	// Wait for the marker to show up in output. Until the command outputs
+	// anything, the shell start timeout applies, and then the marker timeout.
+	timeouts := s.params.Timeouts
+	shellStartTimer := time.NewTimer(timeouts.ShellStart)
+	defer shellStartTimer.Stop()
+
+	var markerTimeoutCh <-chan time.Time
+
+	for {
+		select {
+		case err := <-connErrCh:
+			if err != nil {
+				res.Err = errors.Trace(err)
+				return res
+			}
+
+			resCh <- ShellConnUpdate{
+				DebugInfo: s.makeDebugInfo("Got the marker, connected successfully"),
+			}
+
+			// Got the marker, so we're done.
+			res.Conn = &ShellConnCustomCmd{
+				cmd:    cmd,
+				stdin:  stdin,
+				stdout: clientStdoutR,
+				stderr: clientStderrR,
+
+				postMarkerStdout: postMarkerStdout,
+
+				ctxCancel: cancel,
+			}
 			return res
-		}
 
-		resCh <- ShellConnUpdate{
-			DebugInfo: s.makeDebugInfo("Got the marker, connected successfully"),
+		case line := <-fatalStderrCh:
+			res.Err = errors.Errorf(
+				"failed to connect using external command \"%s\": %s",
+				sshCmdDebug, strings.TrimSpace(line),
+			)
+			return res
+
+		case <-startedCh:
+			startedCh = nil
+			shellStartTimer.Stop()
+
+			markerTimer := time.NewTimer(timeouts.Marker)
+			defer markerTimer.Stop()
+			markerTimeoutCh = markerTimer.C
+
+		case <-shellStartTimer.C:
+			res.Err = classifyErr(ConnErrCategoryTimeout, errors.Errorf(
+				"timeout waiting for the shell to start after %s (slow auth?)", timeouts.ShellStart,
+			))
+			return res
+
+		case <-markerTimeoutCh:
+			res.Err = classifyErr(ConnErrCategoryNoMarker, errors.Errorf(
+				"shell has started, but timeout waiting for the connection marker after %s (misconfigured shell?)",
+				timeouts.Marker,
+			))
+			return res
+
+		case <-ctx.Done():
+			res.Err = errors.Annotatef(ctx.Err(), "waiting for SSH connection marker")
+			return res
 		}
+	}
+}
 
-		// Got the marker, so we're done.
-		res.Conn = &ShellConnCustomCmd{
-			cmd:    cmd,
-			stdin:  stdin,
-			stdout: clientStdoutR,
-			stderr: stderr,
+// firstChunkReader reads the first chunk of data from the underlying reader
+// right away, in a separate goroutine, and calls onFirstData if it's not
+// empty; it's needed to find out when the external command outputs anything,
+// without consuming the data which the client will read later.
+type firstChunkReader struct {
+	r io.Reader
+
+	// readyCh is closed once the first chunk is read; after that, first and
+	// firstErr are populated.
+	readyCh  chan struct{}
+	first    []byte
+	firstErr error
+}
+
+func newFirstChunkReader(r io.Reader, onFirstData func()) *firstChunkReader {
+	fcr := &firstChunkReader{
+		r:       r,
+		readyCh: make(chan struct{}),
+	}
 
-			ctxCancel: cancel,
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		fcr.first = buf[:n]
+		fcr.firstErr = err
+		close(fcr.readyCh)
+
+		if n > 0 {
+			onFirstData()
 		}
-		return res
+	}()
 
-	case <-time.After(connectionTimeout):
-		res.Err = errors.New("timeout waiting for SSH connection marker")
-		return res
+	return fcr
+}
+
+func (fcr *firstChunkReader) Read(p []byte) (int, error) {
+	<-fcr.readyCh
+
+	if len(fcr.first) > 0 {
+		n := copy(p, fcr.first)
+		fcr.first = fcr.first[n:]
+		return n, nil
+	}
+
+	if fcr.firstErr != nil {
+		return 0, fcr.firstErr
+	}
+
+	return fcr.r.Read(p)
+}
+
+// pausableReader reads from the underlying reader, unless it's paused; see
+// PausableShellConn.
+type pausableReader struct {
+	r io.Reader
+
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newPausableReader(r io.Reader) *pausableReader {
+	pr := &pausableReader{r: r}
+	pr.cond = sync.NewCond(&pr.mtx)
+
+	return pr
+}
+
+func (pr *pausableReader) Read(p []byte) (int, error) {
+	pr.waitResumed()
+	n, err := pr.r.Read(p)
+
+	// If it was paused while we were reading, the consumer must not see the
+	// data until it's resumed.
+	pr.waitResumed()
+
+	return n, err
+}
+
+func (pr *pausableReader) waitResumed() {
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+
+	for pr.paused {
+		pr.cond.Wait()
 	}
 }
 
+func (pr *pausableReader) Pause() {
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+
+	pr.paused = true
+}
+
+func (pr *pausableReader) Resume() {
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+
+	pr.paused = false
+	pr.cond.Broadcast()
+}
+
 func (s *ShellTransportCustomCmd) makeDebugInfo(message string) *ShellConnDebugInfo {
 	return &ShellConnDebugInfo{
 		Message: message,
@@ -222,9 +550,17 @@ type ShellConnCustomCmd struct {
 	stdout io.Reader
 	stderr io.Reader
 
+	postMarkerStdout *pausableReader
+
 	ctxCancel context.CancelFunc
+
+	// reapOnce makes sure that the process is only waited for once, even if
+	// Close is called multiple times.
+	reapOnce sync.Once
 }
 
+var _ PausableShellConn = &ShellConnCustomCmd{}
+
 func (s *ShellConnCustomCmd) Stdin() io.Writer {
 	return s.stdin
 }
@@ -237,6 +573,14 @@ func (s *ShellConnCustomCmd) Stderr() io.Reader {
 	return s.stderr
 }
 
+func (s *ShellConnCustomCmd) Pause() {
+	s.postMarkerStdout.Pause()
+}
+
+func (s *ShellConnCustomCmd) Resume() {
+	s.postMarkerStdout.Resume()
+}
+
 func (s *ShellConnCustomCmd) Close() {
 	// Close stdin; normally this is enough for the external process to finish
 	// gracefully.
@@ -246,4 +590,15 @@ func (s *ShellConnCustomCmd) Close() {
 	// not always enough; e.g. after the OS gets suspended for long enough time,
 	// and resumed, the connection keeps hanging without it).
 	s.ctxCancel()
+
+	// If the stdout is paused, resume it, so that the reading goroutine gets
+	// the EOF and finishes.
+	s.postMarkerStdout.Resume()
+
+	// Reap the process once it exits; until then, the os/exec keeps a
+	// goroutine waiting for it. Nobody needs its output anymore, so it's fine
+	// that Wait closes the pipes.
+	s.reapOnce.Do(func() {
+		go s.cmd.Wait()
+	})
 }
@@ -0,0 +1,443 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellTransportCustomCmdFields(t *testing.T) {
+	type testCase struct {
+		envOverride map[string]string
+		want        []string
+	}
+
+	testCases := []testCase{
+		{
+			envOverride: map[string]string{
+				"NLHOST": "myhost",
+			},
+			want: []string{"ssh", "-o", "BatchMode=yes", "myhost", "/bin/sh"},
+		},
+		{
+			envOverride: map[string]string{
+				"NLHOST": "myhost",
+				"NLPORT": "2200",
+				"NLUSER": "me",
+				"NLJUMP": "user@bastion:2222",
+			},
+			want: []string{
+				"ssh", "-o", "BatchMode=yes",
+				"-J", "user@bastion:2222",
+				"-p", "2200",
+				"me@myhost", "/bin/sh",
+			},
+		},
+		{
+			envOverride: map[string]string{
+				"NLHOST": "myhost",
+				"NLJUMP": "user1@bastion1,user2@bastion2:2222",
+			},
+			want: []string{
+				"ssh", "-o", "BatchMode=yes",
+				"-J", "user1@bastion1,user2@bastion2:2222",
+				"myhost", "/bin/sh",
+			},
+		},
+		{
+			envOverride: map[string]string{
+				"NLHOST": "myhost",
+				"NLBIND": "10.0.0.5",
+			},
+			want: []string{
+				"ssh", "-o", "BatchMode=yes",
+				"-b", "10.0.0.5",
+				"myhost", "/bin/sh",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		st := NewShellTransportCustomCmd(ShellTransportCustomCmdParams{
+			ShellCommand: DefaultSSHShellCommand,
+			EnvOverride:  tc.envOverride,
+			Logger:       log.NewLogger(log.Error),
+		})
+
+		got, err := st.cmdFields()
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+}
+
+// connectCustomCmd connects using the given command, and returns the result.
+func connectCustomCmd(t *testing.T, shellCommand string, timeouts ShellConnTimeouts) ShellConnResult {
+	return connectCustomCmdParams(t, ShellTransportCustomCmdParams{
+		ShellCommand: shellCommand,
+		Timeouts:     timeouts,
+	})
+}
+
+// connectCustomCmdParams is like connectCustomCmd, but takes all the params
+// of the transport; the Logger is set by connectCustomCmdParams.
+func connectCustomCmdParams(t *testing.T, params ShellTransportCustomCmdParams) ShellConnResult {
+	params.Logger = log.NewLogger(log.Error)
+	st := NewShellTransportCustomCmd(params)
+
+	resCh := make(chan ShellConnUpdate, 16)
+	st.Connect(context.Background(), resCh)
+
+	for {
+		select {
+		case upd := <-resCh:
+			if upd.Result != nil {
+				return *upd.Result
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no connection result")
+		}
+	}
+}
+
+func TestShellTransportCustomCmdTimeouts(t *testing.T) {
+	timeouts := ShellConnTimeouts{
+		ShellStart: 300 * time.Millisecond,
+		Marker:     300 * time.Millisecond,
+	}
+
+	// The command doesn't output anything, like ssh stuck authenticating.
+	res := connectCustomCmd(t, "sh -c 'exec sleep 5'", timeouts)
+	if assert.Error(t, res.Err) {
+		assert.Contains(t, res.Err.Error(), "timeout waiting for the shell to start after 300ms")
+		assert.Equal(t, ConnErrCategoryTimeout, CategorizeConnErr(res.Err.Error()))
+	}
+
+	// The shell starts quickly, but never prints the marker. The shell start
+	// timeout is long enough, so it's the marker timeout which fires.
+	res = connectCustomCmd(t, "sh -c 'echo motd; exec sleep 5'", ShellConnTimeouts{
+		ShellStart: 5 * time.Second,
+		Marker:     300 * time.Millisecond,
+	})
+	if assert.Error(t, res.Err) {
+		assert.Contains(t, res.Err.Error(), "shell has started, but timeout waiting for the connection marker after 300ms")
+	}
+
+	// Same, but the shell outputs to stderr.
+	res = connectCustomCmd(t, "sh -c 'echo motd >&2; exec sleep 5'", timeouts)
+	if assert.Error(t, res.Err) {
+		assert.Contains(t, res.Err.Error(), "timeout waiting for the connection marker")
+	}
+
+	// The auth is slow, but the shell start timeout is long enough, and then
+	// the marker shows up instantly.
+	res = connectCustomCmd(t, "sh -c 'sleep 0.5; exec sh'", ShellConnTimeouts{
+		ShellStart: 5 * time.Second,
+		Marker:     300 * time.Millisecond,
+	})
+	if assert.NoError(t, res.Err) {
+		res.Conn.Close()
+	}
+}
+
+func TestShellTransportCustomCmdStderrPreserved(t *testing.T) {
+	// The stderr which was read to detect the shell start is still available
+	// to the client.
+	res := connectCustomCmd(t, "sh -c 'echo hello >&2; exec sh'", ShellConnTimeouts{})
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	buf := make([]byte, 6)
+	_, err := io.ReadFull(res.Conn.Stderr(), buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(buf))
+}
+
+func TestShellTransportCustomCmdStderrPatterns(t *testing.T) {
+	// The benign stderr is dropped, while the rest is still available to the
+	// client.
+	res := connectCustomCmd(t, `sh -c '
+		echo "Warning: Permanently added myhost (ED25519) to the list of known hosts." >&2
+		echo hello >&2
+		exec sh
+	'`, ShellConnTimeouts{})
+	if assert.NoError(t, res.Err) {
+		buf := make([]byte, 6)
+		_, err := io.ReadFull(res.Conn.Stderr(), buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", string(buf))
+
+		res.Conn.Close()
+	}
+
+	// If connecting fails, the benign stderr is not included in the error.
+	// The line is printed with printf, so that the command itself, which is
+	// a part of the error too, doesn't contain it.
+	res = connectCustomCmd(t, `sh -c '
+		printf "X%s forwarding request failed on channel 0\n" 11 >&2
+		echo "something went wrong" >&2
+		exit 1
+	'`, ShellConnTimeouts{})
+	if assert.Error(t, res.Err) {
+		assert.Contains(t, res.Err.Error(), "something went wrong")
+		assert.NotContains(t, res.Err.Error(), "X11 forwarding")
+	}
+
+	// The fatal stderr makes connecting fail right away, even though the
+	// command keeps running, and the timeouts are long.
+	started := time.Now()
+	res = connectCustomCmdParams(t, ShellTransportCustomCmdParams{
+		ShellCommand: `sh -c 'echo "access denied by policy" >&2; exec sleep 5'`,
+		Timeouts: ShellConnTimeouts{
+			ShellStart: 5 * time.Second,
+			Marker:     5 * time.Second,
+		},
+		StderrPatterns: ConnStderrPatterns{
+			Fatal: []string{`^access denied`},
+		},
+	})
+	if assert.Error(t, res.Err) {
+		assert.Contains(t, res.Err.Error(), "access denied by policy")
+		assert.Less(t, int64(time.Since(started)), int64(2*time.Second))
+	}
+
+	// Without the pattern, the same stderr is not fatal, so it's the marker
+	// timeout which fires.
+	res = connectCustomCmd(t, `sh -c 'echo "access denied by policy" >&2; exec sleep 5'`, ShellConnTimeouts{
+		ShellStart: 5 * time.Second,
+		Marker:     300 * time.Millisecond,
+	})
+	if assert.Error(t, res.Err) {
+		assert.True(t, errors.Is(res.Err, ErrMarkerNotReceived), res.Err.Error())
+	}
+}
+
+func TestShellTransportCustomCmdErrors(t *testing.T) {
+	type testCase struct {
+		descr        string
+		shellCommand string
+		timeouts     ShellConnTimeouts
+		wantErr      error
+	}
+
+	timeouts := ShellConnTimeouts{
+		ShellStart: 300 * time.Millisecond,
+		Marker:     300 * time.Millisecond,
+	}
+
+	testCases := []testCase{
+		{
+			descr:        "no such binary",
+			shellCommand: "/nonexistent/nerdlog-ssh myhost",
+			wantErr:      ErrShellNotFound,
+		},
+		{
+			descr:        "shell start timeout",
+			shellCommand: "sh -c 'exec sleep 5'",
+			timeouts:     timeouts,
+			wantErr:      ErrConnectTimeout,
+		},
+		{
+			descr:        "marker timeout",
+			shellCommand: "sh -c 'echo motd; exec sleep 5'",
+			timeouts:     timeouts,
+			wantErr:      ErrMarkerNotReceived,
+		},
+		{
+			descr:        "auth failed",
+			shellCommand: "sh -c 'echo \"me@myhost: Permission denied (publickey).\" >&2; exit 255'",
+			wantErr:      ErrAuthFailed,
+		},
+		{
+			descr:        "unknown host",
+			shellCommand: "sh -c 'echo \"ssh: Could not resolve hostname myhost: Name or service not known\" >&2; exit 255'",
+			wantErr:      ErrHostUnreachable,
+		},
+	}
+
+	allSentinels := []error{
+		ErrConnectTimeout, ErrAuthFailed, ErrHostUnreachable,
+		ErrShellNotFound, ErrMarkerNotReceived, ErrAgentMissing,
+	}
+
+	for _, tc := range testCases {
+		res := connectCustomCmd(t, tc.shellCommand, tc.timeouts)
+		if !assert.Error(t, res.Err, tc.descr) {
+			res.Conn.Close()
+			continue
+		}
+
+		for _, sentinel := range allSentinels {
+			assert.Equal(
+				t, sentinel == tc.wantErr, errors.Is(res.Err, sentinel),
+				"%s: %s, sentinel %q", tc.descr, res.Err, sentinel,
+			)
+		}
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+
+	mtx sync.Mutex
+	n   int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+
+	cr.mtx.Lock()
+	cr.n += n
+	cr.mtx.Unlock()
+
+	return n, err
+}
+
+func (cr *countingReader) getN() int {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+
+	return cr.n
+}
+
+func TestPausableReader(t *testing.T) {
+	pipeR, pipeW := io.Pipe()
+	defer pipeW.Close()
+
+	cr := &countingReader{r: pipeR}
+	pr := newPausableReader(cr)
+
+	readCh := make(chan string, 1)
+	readAsync := func(n int) {
+		go func() {
+			buf := make([]byte, n)
+			n, _ := io.ReadFull(pr, buf)
+			readCh <- string(buf[:n])
+		}()
+	}
+
+	writeCh := make(chan struct{})
+	writeAsync := func(s string) {
+		go func() {
+			io.WriteString(pipeW, s)
+			writeCh <- struct{}{}
+		}()
+	}
+
+	// While paused, nothing is consumed, so the writer is blocked (for a real
+	// connection, the socket buffers would be filling up).
+	pr.Pause()
+	readAsync(5)
+	writeAsync("hello")
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, cr.getN())
+	assert.Equal(t, 0, len(readCh))
+	assert.Equal(t, 0, len(writeCh))
+
+	pr.Resume()
+	assert.Equal(t, "hello", <-readCh)
+	<-writeCh
+	assert.Equal(t, 5, cr.getN())
+
+	// Pausing while the read is in progress: the data it gets is held until
+	// resumed.
+	readAsync(5)
+	time.Sleep(50 * time.Millisecond)
+	pr.Pause()
+	writeAsync("world")
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(readCh))
+
+	pr.Resume()
+	assert.Equal(t, "world", <-readCh)
+	<-writeCh
+
+	// Pause and Resume are no-ops if already paused or resumed.
+	pr.Resume()
+	pr.Pause()
+	pr.Pause()
+	pr.Resume()
+	readAsync(3)
+	writeAsync("foo")
+	assert.Equal(t, "foo", <-readCh)
+	<-writeCh
+}
+
+func TestShellTransportCustomCmdPause(t *testing.T) {
+	res := connectCustomCmd(t, "sh", ShellConnTimeouts{})
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+
+	conn := res.Conn.(PausableShellConn)
+
+	readCh := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 6)
+		n, _ := io.ReadFull(conn.Stdout(), buf)
+		readCh <- string(buf[:n])
+	}()
+
+	conn.Pause()
+	_, err := io.WriteString(conn.Stdin(), "echo hello\n")
+	assert.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, len(readCh))
+
+	conn.Resume()
+	select {
+	case got := <-readCh:
+		assert.Equal(t, "hello\n", got)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no output after resuming")
+	}
+
+	// Closing while paused doesn't leave anything stuck: the reader gets EOF.
+	conn.Pause()
+	conn.Close()
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(conn.Stdout())
+		readErrCh <- err
+	}()
+
+	select {
+	case err := <-readErrCh:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stdout is stuck after closing")
+	}
+}
+
+func TestShellTransportCustomCmdPrintfMarker(t *testing.T) {
+	res := connectCustomCmdParams(t, ShellTransportCustomCmdParams{
+		ShellCommand: "sh",
+		PrintfMarker: true,
+	})
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	// The marker itself doesn't end up in the stdout.
+	_, err := io.WriteString(res.Conn.Stdin(), "echo hello\n")
+	assert.NoError(t, err)
+
+	line, err := bufio.NewReader(res.Conn.Stdout()).ReadString('\n')
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello\n", line)
+	}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// httpNDJSONMaxRecordSize is the max size of a single NDJSON record.
+const httpNDJSONMaxRecordSize = 1024 * 1024
+
+// ShellTransportHTTPNDJSON is a read-only transport which doesn't provide any
+// actual shell; instead, it gets the logs from an HTTP endpoint returning
+// NDJSON, such as some log shipping API.
+//
+// To fit into the rest of nerdlog, the connection it creates emulates the
+// shell with the nerdlog_agent.sh (see emulatedAgentConn), and for every
+// query, issues an HTTP request. So the logs, the minute stats etc from the
+// HTTP endpoints are merged with the other logstreams as usual.
+//
+// Every line of the response must be a JSON object like this:
+//
+//	{"time": "2025-03-10T10:00:00.123Z", "msg": "Something happened", "host": "web-01", "program": "myapp", "pid": 123}
+//
+// Only "time" (in RFC3339 format) and "msg" are required.
+type ShellTransportHTTPNDJSON struct {
+	params ShellTransportHTTPNDJSONParams
+}
+
+type ShellTransportHTTPNDJSONParams struct {
+	// URLTemplate is the URL to query; see ConfigLogStreamShellTransportHTTPNDJSON.
+	URLTemplate string
+
+	// Host is used for the {host} placeholder in the URLTemplate, and for the
+	// records which don't have the "host" field.
+	Host string
+
+	// HTTPClient is used to make requests; if nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	Logger *log.Logger
+}
+
+func NewShellTransportHTTPNDJSON(params ShellTransportHTTPNDJSONParams) *ShellTransportHTTPNDJSON {
+	params.Logger = params.Logger.WithNamespaceAppended("TransportHTTPNDJSON")
+
+	if params.HTTPClient == nil {
+		params.HTTPClient = http.DefaultClient
+	}
+
+	return &ShellTransportHTTPNDJSON{
+		params: params,
+	}
+}
+
+func (s *ShellTransportHTTPNDJSON) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		// There is nothing to connect to in advance, so just make sure that the
+		// URL is valid.
+		u := expandHTTPNDJSONURL(s.params.URLTemplate, s.params.Host, emulatedAgentQuery{})
+		if _, err := url.ParseRequestURI(u); err != nil {
+			resCh <- ShellConnUpdate{
+				Result: &ShellConnResult{
+					Err: errors.Annotatef(err, "invalid URL template %q", s.params.URLTemplate),
+				},
+			}
+			return
+		}
+
+		resCh <- ShellConnUpdate{
+			Result: &ShellConnResult{
+				Conn: newEmulatedAgentConn(emulatedAgentConnParams{
+					TransportName: "http-ndjson",
+					Filename:      SpecialFilenameHTTPNDJSON,
+					Host:          s.params.Host,
+					Source:        &httpNDJSONSource{params: s.params},
+					Logger:        s.params.Logger,
+				}),
+			},
+		}
+	}()
+}
+
+// expandHTTPNDJSONURL replaces the placeholders in the URL template with the
+// URL-escaped query params.
+func expandHTTPNDJSONURL(urlTemplate, host string, q emulatedAgentQuery) string {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	limit := ""
+	if q.maxNumLines > 0 {
+		limit = strconv.Itoa(q.maxNumLines)
+	}
+
+	return strings.NewReplacer(
+		"{host}", url.QueryEscape(host),
+		"{query}", url.QueryEscape(q.query),
+		"{from}", url.QueryEscape(formatTime(q.from)),
+		"{to}", url.QueryEscape(formatTime(q.to)),
+		"{limit}", url.QueryEscape(limit),
+	).Replace(urlTemplate)
+}
+
+// httpNDJSONRecord is a single log record returned by the HTTP endpoint.
+type httpNDJSONRecord struct {
+	Time    time.Time   `json:"time"`
+	Msg     string      `json:"msg"`
+	Host    string      `json:"host"`
+	Program string      `json:"program"`
+	Pid     interface{} `json:"pid"`
+}
+
+// toEmulated converts the record into the emulatedLogRecord.
+func (r *httpNDJSONRecord) toEmulated() emulatedLogRecord {
+	pid := ""
+	if r.Pid != nil {
+		pid = fmt.Sprintf("%v", r.Pid)
+	}
+
+	return emulatedLogRecord{
+		Time:    r.Time,
+		Msg:     r.Msg,
+		Host:    r.Host,
+		Program: r.Program,
+		Pid:     pid,
+	}
+}
+
+// httpNDJSONSource is the emulatedAgentSource which makes the HTTP requests.
+type httpNDJSONSource struct {
+	params ShellTransportHTTPNDJSONParams
+}
+
+// getRecords makes the HTTP request, and returns the records from the
+// response.
+func (s *httpNDJSONSource) getRecords(
+	ctx context.Context, q emulatedAgentQuery,
+) ([]emulatedLogRecord, error) {
+	u := expandHTTPNDJSONURL(s.params.URLTemplate, s.params.Host, q)
+	s.params.Logger.Verbose1f("Querying %s", u)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp, err := s.params.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var records []emulatedLogRecord
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, httpNDJSONMaxRecordSize)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var r httpNDJSONRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, errors.Annotatef(err, "parsing record on line %d", lineNum)
+		}
+
+		if r.Time.IsZero() {
+			return nil, errors.Errorf("record on line %d has no time", lineNum)
+		}
+
+		records = append(records, r.toEmulated())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotatef(err, "reading response")
+	}
+
+	return records, nil
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNDJSONServer serves the NDJSON records for every host, filtered by the
+// "from" and "to" query params, and records all the requests.
+type fakeNDJSONServer struct {
+	records map[string][]httpNDJSONRecord
+
+	mtx  sync.Mutex
+	reqs []*http.Request
+}
+
+func (s *fakeNDJSONServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	s.reqs = append(s.reqs, r)
+	s.mtx.Unlock()
+
+	q := r.URL.Query()
+
+	parseTime := func(name string) time.Time {
+		v := q.Get(name)
+		if v == "" {
+			return time.Time{}
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+		return t
+	}
+
+	from, to := parseTime("from"), parseTime("to")
+
+	enc := json.NewEncoder(w)
+	for _, rec := range s.records[q.Get("host")] {
+		if (!from.IsZero() && rec.Time.Before(from)) || (!to.IsZero() && !rec.Time.Before(to)) {
+			continue
+		}
+
+		enc.Encode(rec)
+	}
+}
+
+func (s *fakeNDJSONServer) getReqs() []*http.Request {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]*http.Request(nil), s.reqs...)
+}
+
+func TestShellTransportHTTPNDJSON(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+
+	fakeSrv := &fakeNDJSONServer{
+		records: map[string][]httpNDJSONRecord{
+			"web-01": {
+				{Time: now.Add(-3 * time.Minute), Msg: "foo", Program: "myapp", Pid: 123},
+				{Time: now.Add(-2*time.Minute + 500*time.Millisecond), Msg: "bar\nbaz", Program: "myapp", Pid: 123},
+				// Out of order, and too old.
+				{Time: now.Add(-5 * time.Hour), Msg: "old"},
+			},
+			"web-02": {
+				{Time: now.Add(-3*time.Minute + time.Second), Msg: "hello", Host: "web-02.internal", Program: "other"},
+			},
+		},
+	}
+
+	srv := httptest.NewServer(fakeSrv)
+	defer srv.Close()
+
+	tm, err := ParseTransportMode(
+		"http-ndjson:" + srv.URL + "/logs?host={host}&q={query}&from={from}&to={to}&limit={limit}",
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := New(Options{
+		LStreams:             "web-01, web-02",
+		DefaultTransportMode: tm,
+		ClientID:             "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        now.Add(-time.Hour),
+		MaxNumLines: 10,
+		Query:       "/foo/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 0, len(resp.Errs))
+
+	// Logs from both hosts are merged and sorted.
+	if !assert.Equal(t, 3, len(resp.Logs)) {
+		return
+	}
+	assert.Equal(t, 3, resp.NumMsgsTotal)
+
+	assert.Equal(t, "foo", resp.Logs[0].Msg)
+	assert.True(t, resp.Logs[0].Time.Equal(now.Add(-3*time.Minute)))
+	assert.Equal(t, "web-01", resp.Logs[0].Context["lstream"])
+	assert.Equal(t, "web-01", resp.Logs[0].Context["hostname"])
+	assert.Equal(t, "myapp", resp.Logs[0].Context["program"])
+	assert.Equal(t, "123", resp.Logs[0].Context["pid"])
+	assert.Equal(t, SpecialFilenameHTTPNDJSON, resp.Logs[0].LogFilename)
+
+	assert.Equal(t, "hello", resp.Logs[1].Msg)
+	assert.Equal(t, "web-02", resp.Logs[1].Context["lstream"])
+	assert.Equal(t, "web-02.internal", resp.Logs[1].Context["hostname"])
+	assert.Equal(t, "other", resp.Logs[1].Context["program"])
+
+	assert.Equal(t, "bar baz", resp.Logs[2].Msg)
+	assert.True(t, resp.Logs[2].Time.Equal(now.Add(-2*time.Minute+500*time.Millisecond)))
+
+	assert.Equal(t, map[int64]MinuteStatsItem{
+		now.Add(-3 * time.Minute).Unix(): {NumMsgs: 2},
+		now.Add(-2 * time.Minute).Unix(): {NumMsgs: 1},
+	}, resp.MinuteStats)
+
+	reqs := fakeSrv.getReqs()
+	if !assert.Equal(t, 2, len(reqs)) {
+		return
+	}
+
+	hosts := map[string]struct{}{}
+	for _, req := range reqs {
+		q := req.URL.Query()
+		hosts[q.Get("host")] = struct{}{}
+
+		assert.Equal(t, "/logs", req.URL.Path)
+		assert.Equal(t, "/foo/", q.Get("q"))
+		assert.Equal(t, "10", q.Get("limit"))
+		assert.Equal(t, now.Add(-time.Hour).UTC().Format(time.RFC3339), q.Get("from"))
+		assert.Equal(t, "", q.Get("to"))
+	}
+	assert.Equal(t, map[string]struct{}{"web-01": {}, "web-02": {}}, hosts)
+
+	// Loading earlier logs: with 1 line, we get "bar baz" first, and then the
+	// earlier ones.
+	resp, err = n.Query(ctx, QueryLogsParams{
+		From:        now.Add(-time.Hour),
+		MaxNumLines: 1,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Equal(t, 1, len(resp.Logs)) {
+		return
+	}
+	assert.Equal(t, "bar baz", resp.Logs[0].Msg)
+
+	resp, err = n.Query(ctx, QueryLogsParams{
+		From:        now.Add(-time.Hour),
+		MaxNumLines: 1,
+		LoadEarlier: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, resp.LoadedEarlier)
+	if !assert.Equal(t, 3, len(resp.Logs)) {
+		return
+	}
+	assert.Equal(t, "foo", resp.Logs[0].Msg)
+	assert.Equal(t, "hello", resp.Logs[1].Msg)
+	assert.Equal(t, "bar baz", resp.Logs[2].Msg)
+
+	// For web-01, the earlier logs are requested until the last one we have,
+	// rounded up to the next second.
+	reqs = fakeSrv.getReqs()
+	var lastTo string
+	for _, req := range reqs {
+		if req.URL.Query().Get("host") == "web-01" {
+			lastTo = req.URL.Query().Get("to")
+		}
+	}
+	assert.Equal(t, now.Add(-time.Minute-59*time.Second).UTC().Format(time.RFC3339), lastTo)
+}
+
+func TestShellTransportHTTPNDJSONError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such index", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	tm, err := ParseTransportMode("http-ndjson:" + srv.URL + "/logs")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := New(Options{
+		LStreams:             "web-01",
+		DefaultTransportMode: tm,
+		ClientID:             "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = n.Query(ctx, QueryLogsParams{From: time.Now().Add(-time.Hour)})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "404 Not Found: no such index")
+	}
+}
+
+func TestParseEmulatedAgentQueryArgs(t *testing.T) {
+	q, err := parseEmulatedAgentQueryArgs([]string{
+		"--max-num-lines", "250",
+		"--from", "2025-03-10-10:00",
+		"--to", "2025-03-10-12:00",
+		"--timestamp-until-seconds", "2025-03-10 11:00:01",
+		"--timestamp-until-precise", "2025-03-10T11:00:00.500000",
+		"--skip-n-latest", "2",
+		"--refresh-index",
+		"/foo/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, emulatedAgentQuery{
+		from:         time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC),
+		to:           time.Date(2025, 3, 10, 11, 0, 1, 0, time.UTC),
+		maxNumLines:  250,
+		query:        "/foo/",
+		untilPrecise: time.Date(2025, 3, 10, 11, 0, 0, 500000000, time.UTC),
+		skipNLatest:  2,
+	}, q)
+
+	assert.Equal(
+		t,
+		"http://logs.local/q?host=web-01&q=%2Ffoo%2F+bar&from=2025-03-10T10%3A00%3A00Z&to=2025-03-10T11%3A00%3A01Z&limit=250",
+		expandHTTPNDJSONURL(
+			"http://logs.local/q?host={host}&q={query}&from={from}&to={to}&limit={limit}",
+			"web-01",
+			emulatedAgentQuery{from: q.from, to: q.to, maxNumLines: q.maxNumLines, query: "/foo/ bar"},
+		),
+	)
+
+	_, err = parseEmulatedAgentQueryArgs([]string{"--from", "yesterday"})
+	assert.Error(t, err)
+}
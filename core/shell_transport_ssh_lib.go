@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -35,13 +36,35 @@ type ShellTransportSSHLibParams struct {
 	// an existing key is found.
 	SSHKeys []string
 
+	// SSHCert, if not empty, is the path to the OpenSSH certificate for the
+	// key; otherwise, the certificate is looked up next to the key, like
+	// ~/.ssh/id_ed25519-cert.pub, and used if it exists.
+	SSHCert string
+
+	// PKCS11, if not nil, is the PKCS#11 token to authenticate with: then
+	// neither ssh-agent nor SSHKeys are used. The PIN is requested via the
+	// ShellConnDataRequest.
+	PKCS11 *SSHPKCS11
+
+	// CredentialProvider, if not nil, provides the credentials for every host
+	// (including jumphosts): then neither PKCS11, ssh-agent nor SSHKeys are
+	// used, but the logstream's own IdentityFile still takes precedence.
+	CredentialProvider CredentialProvider
+
 	ConnDetails ConfigLogStreamShellTransportSSHLib
 
+	// HostKeys verifies the host keys; if nil, host keys are not verified.
+	HostKeys *HostKeys
+
+	// ConnPool, if not nil, is used to share the ssh connection with other
+	// transports having the same connection identity.
+	ConnPool *SSHConnPool
+
 	Logger *log.Logger
 }
 
-func (st *ShellTransportSSHLib) Connect(resCh chan<- ShellConnUpdate) {
-	go st.doConnect(resCh)
+func (st *ShellTransportSSHLib) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go st.doConnect(ctx, resCh)
 }
 
 func (st *ShellTransportSSHLib) makeDebugInfo(message string) *ShellConnDebugInfo {
@@ -51,12 +74,13 @@ func (st *ShellTransportSSHLib) makeDebugInfo(message string) *ShellConnDebugInf
 }
 
 func (st *ShellTransportSSHLib) doConnect(
-	resCh chan<- ShellConnUpdate,
+	ctx context.Context, resCh chan<- ShellConnUpdate,
 ) (res ShellConnResult) {
 	logger := st.params.Logger
 
 	defer func() {
 		if res.Err != nil {
+			res.Err = classifyConnErr(res.Err)
 			logger.Errorf("Connection failed: %s", res.Err)
 		}
 
@@ -74,9 +98,7 @@ func (st *ShellTransportSSHLib) doConnect(
 		)),
 	}
 
-	var sshClient *ssh.Client
-
-	conf, err := st.getClientConfig(resCh, logger, connDetails.Host.User)
+	conf, err := st.getClientConfig(ctx, resCh, logger, connDetails.Host)
 	if err != nil {
 		res.Err = errors.Annotatef(err, "getting ssh client for %s", connDetails.Host.User)
 		return res
@@ -86,86 +108,260 @@ func (st *ShellTransportSSHLib) doConnect(
 		DebugInfo: st.makeDebugInfo(fmt.Sprintf("Got client config: %s", conf.Descr)),
 	}
 
-	if connDetails.Jumphost != nil {
-		logger.Infof("Connecting via jumphost")
-		// Use jumphost
-		jumphost, err := st.getJumphostClient(resCh, logger, connDetails.Jumphost)
-		if err != nil {
-			logger.Errorf("Jumphost connection failed: %s", err)
-			res.Err = errors.Annotatef(err, "getting jumphost client")
-			return res
+	dial := func() (*ssh.Client, error) {
+		if connDetails.ProxyURL != "" {
+			logger.Infof(
+				"Connecting to %s via proxy %s", connDetails.Host.Addr, redactProxyURL(connDetails.ProxyURL),
+			)
+			conn, err := dialProxyURL(
+				ctx, connDetails.ProxyURL, connDetails.Host, connDetails.BindAddress, connectionTimeout,
+			)
+			if err != nil {
+				return nil, errors.Annotatef(err, conf.Descr)
+			}
+
+			sshClient, err := newSSHClient(ctx, conn, connDetails.Host.Addr, conf.ClientConfig)
+			if err != nil {
+				return nil, errors.Annotatef(err, conf.Descr)
+			}
+
+			return sshClient, nil
 		}
 
-		conn, err := dialWithTimeout(jumphost, "tcp", connDetails.Host.Addr, connectionTimeout)
-		if err != nil {
-			res.Err = errors.Annotatef(err, conf.Descr)
-			return res
+		if connDetails.ProxyCommand != "" {
+			proxyCmd, err := expandProxyCommand(connDetails.ProxyCommand, connDetails.Host)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			logger.Infof("Connecting to %s via proxy command %q", connDetails.Host.Addr, proxyCmd)
+			conn, err := dialProxyCommand(ctx, proxyCmd)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			sshClient, err := newSSHClient(ctx, conn, connDetails.Host.Addr, conf.ClientConfig)
+			if err != nil {
+				// newSSHClient has closed the connection, so the proxy command has
+				// finished and its stderr is complete.
+				return nil, errors.Annotatef(conn.annotateErr(err), conf.Descr)
+			}
+
+			conn.detachCtx()
+
+			return sshClient, nil
 		}
 
-		authConn, chans, reqs, err := ssh.NewClientConn(conn, connDetails.Host.Addr, conf.ClientConfig)
-		if err != nil {
-			res.Err = errors.Annotatef(err, conf.Descr)
-			return res
+		if len(connDetails.Jumphosts) > 0 {
+			logger.Infof("Connecting via %d jumphost(s)", len(connDetails.Jumphosts))
+			// Use jumphost
+			jumphost, err := st.getJumphostClient(ctx, resCh, logger, connDetails.Jumphosts)
+			if err != nil {
+				logger.Errorf("Jumphost connection failed: %s", err)
+				return nil, errors.Annotatef(err, "getting jumphost client")
+			}
+
+			conn, err := dialWithTimeout(ctx, jumphost, "tcp", connDetails.Host.Addr, connectionTimeout)
+			if err != nil {
+				return nil, errors.Annotatef(err, conf.Descr)
+			}
+
+			sshClient, err := newSSHClient(ctx, conn, connDetails.Host.Addr, conf.ClientConfig)
+			if err != nil {
+				return nil, errors.Annotatef(err, conf.Descr)
+			}
+
+			return sshClient, nil
 		}
 
-		sshClient = ssh.NewClient(authConn, chans, reqs)
-	} else {
 		logger.Infof("Connecting to %s (%+v)", connDetails.Host.Addr, conf)
-		var err error
-		sshClient, err = ssh.Dial("tcp", connDetails.Host.Addr, conf.ClientConfig)
+		sshClient, err := dialSSH(ctx, connDetails.Host.Addr, connDetails.BindAddress, conf.ClientConfig)
 		if err != nil {
-			res.Err = errors.Annotatef(err, conf.Descr)
-			return res
+			return nil, errors.Annotatef(err, conf.Descr)
 		}
+
+		return sshClient, nil
 	}
 
 	shellBin := "/bin/sh"
 
+	if st.params.ConnPool != nil {
+		conn, err := st.startPooledShell(dial, shellBin)
+		if err != nil {
+			res.Err = errors.Trace(err)
+			return res
+		}
+
+		logger.Infof("Connected to %s (shared connection %s)", connDetails.Host.Addr, connDetails.Identity())
+
+		res.Conn = conn
+		return res
+	}
+
+	sshClient, err := dial()
+	if err != nil {
+		res.Err = errors.Trace(err)
+		return res
+	}
+
 	resCh <- ShellConnUpdate{
 		DebugInfo: st.makeDebugInfo(fmt.Sprintf("Connected, creating pipes and starting %s", shellBin)),
 	}
 	logger.Infof("Connected to %s", connDetails.Host.Addr)
 
-	sshSession, err := sshClient.NewSession()
+	conn, err := startSSHLibShell(sshClient, shellBin)
 	if err != nil {
-		res.Err = errors.Annotatef(err, conf.Descr)
+		sshClient.Close()
+		res.Err = classifyErr(ConnErrCategoryShellNotFound, errors.Annotatef(err, conf.Descr))
 		return res
 	}
 
+	res.Conn = conn
+
+	return res
+}
+
+// startPooledShell starts the shell over the connection from the
+// ConnPool, shared with other transports having the same connection
+// identity; the dial func is only called if there is no such connection yet.
+func (st *ShellTransportSSHLib) startPooledShell(
+	dial func() (*ssh.Client, error), shellBin string,
+) (*ShellConnSSHLib, error) {
+	pool := st.params.ConnPool
+	identity := st.params.ConnDetails.Identity()
+
+	// If the shared connection was dropped, the other transports might not
+	// have noticed it yet, so opening a session there fails; then we discard
+	// it and try once more with a fresh connection.
+	for i := 0; ; i++ {
+		sshClient, err := pool.acquire(identity, dial)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		conn, err := startSSHLibShell(sshClient, shellBin)
+		if err != nil {
+			pool.discard(identity, sshClient)
+			if i == 0 {
+				continue
+			}
+
+			return nil, classifyErr(
+				ConnErrCategoryShellNotFound,
+				errors.Annotatef(err, "starting shell over the shared connection %s", identity),
+			)
+		}
+
+		conn.release = func() {
+			pool.release(identity, sshClient)
+		}
+
+		return conn, nil
+	}
+}
+
+// startSSHLibShell opens a new session channel over the ssh client, and
+// starts the given shell binary there.
+func startSSHLibShell(sshClient *ssh.Client, shellBin string) (*ShellConnSSHLib, error) {
+	sshSession, err := sshClient.NewSession()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	stdinBuf, err := sshSession.StdinPipe()
 	if err != nil {
-		res.Err = errors.Annotatef(err, conf.Descr)
-		return res
+		sshSession.Close()
+		return nil, errors.Trace(err)
 	}
 
 	stdoutBuf, err := sshSession.StdoutPipe()
 	if err != nil {
-		res.Err = errors.Annotatef(err, conf.Descr)
-		return res
+		sshSession.Close()
+		return nil, errors.Trace(err)
 	}
 
 	stderrBuf, err := sshSession.StderrPipe()
 	if err != nil {
-		res.Err = errors.Annotatef(err, conf.Descr)
-		return res
+		sshSession.Close()
+		return nil, errors.Trace(err)
 	}
 
 	err = sshSession.Start(shellBin)
 	if err != nil {
-		res.Err = errors.Annotatef(err, conf.Descr)
-		return res
+		sshSession.Close()
+		return nil, errors.Trace(err)
 	}
 
-	res.Conn = &ShellConnSSHLib{
+	return &ShellConnSSHLib{
 		sshClient:  sshClient,
 		sshSession: sshSession,
+		shellBin:   shellBin,
 
 		stdinBuf:  stdinBuf,
 		stdoutBuf: stdoutBuf,
 		stderrBuf: stderrBuf,
+	}, nil
+}
+
+// dialSSH is like ssh.Dial, but it honors the context: if it's cancelled
+// while dialing or during the handshake, the connection is aborted right away.
+// If bindAddr is not empty, the connection is dialed from this local address.
+func dialSSH(ctx context.Context, addr, bindAddr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer, err := newDialer(config.Timeout, bindAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	return res
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, annotateDialErr(err, addr, bindAddr)
+	}
+
+	return newSSHClient(ctx, conn, addr, config)
+}
+
+// newSSHClient performs the ssh handshake over the given connection and
+// returns the client. If the context is cancelled before the handshake is
+// done, the connection is closed (which aborts the handshake), and the
+// context error is returned.
+func newSSHClient(
+	ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig,
+) (*ssh.Client, error) {
+	// Closing the connection is the only way to interrupt the handshake.
+	stopCh := make(chan struct{})
+	watcherDoneCh := make(chan struct{})
+	aborted := false
+	go func() {
+		defer close(watcherDoneCh)
+
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			aborted = true
+		case <-stopCh:
+		}
+	}()
+
+	authConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(stopCh)
+
+	// The watcher might still be closing the connection if the context was
+	// cancelled right after the handshake, so wait for it to decide.
+	<-watcherDoneCh
+
+	if aborted {
+		if err == nil {
+			authConn.Close()
+		}
+		return nil, errors.Trace(ctx.Err())
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return ssh.NewClient(authConn, chans, reqs), nil
 }
 
 // dialWithTimeout is a hack needed to get a timeout for the ssh client.
@@ -173,9 +369,13 @@ func (st *ShellTransportSSHLib) doConnect(
 //
 // It's possible we could accomplish the same thing by using NewClient() with Conn.SetDeadline(), but that requires
 // some refactoring.
-func dialWithTimeout(client *ssh.Client, protocol, hostAddr string, timeout time.Duration) (net.Conn, error) {
-	finishedChan := make(chan net.Conn)
-	errChan := make(chan error)
+//
+// It also returns early if the context is cancelled.
+func dialWithTimeout(ctx context.Context, client *ssh.Client, protocol, hostAddr string, timeout time.Duration) (net.Conn, error) {
+	// The channels are buffered, so that the goroutine doesn't leak in case
+	// we've already returned due to timeout or cancellation.
+	finishedChan := make(chan net.Conn, 1)
+	errChan := make(chan error, 1)
 	go func() {
 		conn, err := client.Dial(protocol, hostAddr)
 		if err != nil {
@@ -192,9 +392,25 @@ func dialWithTimeout(client *ssh.Client, protocol, hostAddr string, timeout time
 	case err := <-errChan:
 		return nil, errors.Trace(err)
 
-	case <-time.After(connectionTimeout):
-		// Don't close the connection here since it's reused
-		return nil, errors.New("ssh client dial timed out")
+	case <-time.After(timeout):
+		// Don't close the client here since it's reused
+		go closeLateDialedConn(finishedChan, errChan)
+		return nil, classifyErr(ConnErrCategoryTimeout, errors.New("ssh client dial timed out"))
+
+	case <-ctx.Done():
+		go closeLateDialedConn(finishedChan, errChan)
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+// closeLateDialedConn waits for the dial which we've given up on, and if it
+// succeeds after all, closes the connection; otherwise, e.g. on a jumphost,
+// every such dial would leak a forwarded channel.
+func closeLateDialedConn(finishedChan <-chan net.Conn, errChan <-chan error) {
+	select {
+	case conn := <-finishedChan:
+		conn.Close()
+	case <-errChan:
 	}
 }
 
@@ -215,45 +431,99 @@ type AuthMethodWMeta struct {
 	Descr string
 }
 
-func (st *ShellTransportSSHLib) getClientConfig(resCh chan<- ShellConnUpdate, logger *log.Logger, username string) (*ClientConfigWMeta, error) {
-	auth, err := st.getSSHAuthMethod(resCh, logger)
-	if err != nil {
-		return nil, errors.Trace(err)
+func (st *ShellTransportSSHLib) getClientConfig(ctx context.Context, resCh chan<- ShellConnUpdate, logger *log.Logger, host ConfigHost) (*ClientConfigWMeta, error) {
+	var authMethods []ssh.AuthMethod
+	var authDescr string
+
+	if st.params.CredentialProvider != nil && st.params.ConnDetails.IdentityFile == "" {
+		// The provider is consulted on every connection, and the credentials
+		// are not cached here, since they might be per-host or short-lived.
+		var err error
+		authMethods, err = getCredentialProviderAuthMethods(ctx, st.params.CredentialProvider, host)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		authDescr = credentialProviderDescr(st.params.CredentialProvider)
+	} else {
+		auth, err := st.getSSHAuthMethod(ctx, resCh, logger)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		authMethods = []ssh.AuthMethod{auth.AuthMethod}
+		authDescr = auth.Descr
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if st.params.HostKeys != nil {
+		hostKeyCallback = st.params.HostKeys.HostKeyCallback()
 	}
 
 	return &ClientConfigWMeta{
 		ClientConfig: &ssh.ClientConfig{
-			User: username,
-			Auth: []ssh.AuthMethod{auth.AuthMethod},
+			User: host.User,
+			Auth: authMethods,
 
-			// TODO: fix it
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: hostKeyCallback,
 
 			Timeout: connectionTimeout,
 		},
-		Descr: auth.Descr,
+		Descr: authDescr,
 	}, nil
 }
 
 var (
-	sshAuthMethodShared    *AuthMethodWMeta
+	sshAuthMethodShared *AuthMethodWMeta
+
+	// sshAuthMethodsByIdentityFile contains the auth methods of the
+	// logstreams having their own identity file (see
+	// ConfigLogStreamShellTransportSSHLib.IdentityFile), by the file path.
+	sshAuthMethodsByIdentityFile = map[string]*AuthMethodWMeta{}
+
 	sshAuthMethodSharedMtx sync.Mutex
 )
 
-func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, logger *log.Logger) (*AuthMethodWMeta, error) {
+func (st *ShellTransportSSHLib) getSSHAuthMethod(ctx context.Context, resCh chan<- ShellConnUpdate, logger *log.Logger) (*AuthMethodWMeta, error) {
 	sshAuthMethodSharedMtx.Lock()
 	defer sshAuthMethodSharedMtx.Unlock()
 
+	if identityFile := st.params.ConnDetails.IdentityFile; identityFile != "" {
+		if auth, ok := sshAuthMethodsByIdentityFile[identityFile]; ok {
+			return auth, nil
+		}
+
+		logger.Infof("Using identity file %s", identityFile)
+		auth, err := st.getKeyAuthMethod(ctx, resCh, logger, []string{identityFile}, "", nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		sshAuthMethodsByIdentityFile[identityFile] = auth
+		return auth, nil
+	}
+
 	if sshAuthMethodShared != nil {
 		return sshAuthMethodShared, nil
 	}
 
+	if st.params.PKCS11 != nil {
+		auth, err := getPKCS11AuthMethod(ctx, *st.params.PKCS11, resCh, logger)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		sshAuthMethodShared = auth
+		return sshAuthMethodShared, nil
+	}
+
 	// Try ssh-agent first
 	var sshAgentErr error
 	sshAuthSock := os.Getenv("SSH_AUTH_SOCK")
 	if sshAuthSock != "" {
 		logger.Infof("Trying ssh-agent via SSH_AUTH_SOCK=%s", sshAuthSock)
-		sshAgent, err := net.Dial("unix", sshAuthSock)
+		var dialer net.Dialer
+		sshAgent, err := dialer.DialContext(ctx, "unix", sshAuthSock)
 		if err != nil {
 			logger.Infof("Failed to connect to ssh-agent: %s", err.Error())
 			sshAgentErr = errors.Annotatef(err, "using SSH_AUTH_SOCK env var")
@@ -272,10 +542,28 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 	// Fall back to private key
 	logger.Infof("Fallback to parsing ssh key...")
 
+	auth, err := st.getKeyAuthMethod(ctx, resCh, logger, st.params.SSHKeys, st.params.SSHCert, sshAgentErr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sshAuthMethodShared = auth
+	return sshAuthMethodShared, nil
+}
+
+// getKeyAuthMethod returns the auth method using the first existing key out
+// of keyPaths; if the key is passphrase-protected, the passphrase is requested
+// via resCh. The certificate, if any, is looked up as described for
+// ShellTransportSSHLibParams.SSHCert. The sshAgentErr, if not nil, is why
+// ssh-agent wasn't used, to include in the passphrase request.
+func (st *ShellTransportSSHLib) getKeyAuthMethod(
+	ctx context.Context, resCh chan<- ShellConnUpdate, logger *log.Logger,
+	keyPaths []string, sshCert string, sshAgentErr error,
+) (*AuthMethodWMeta, error) {
 	var keyPath string
 	var keyData []byte
 	var errBuilder strings.Builder
-	for _, keyPath = range st.params.SSHKeys {
+	for _, keyPath = range keyPaths {
 		var err error
 		keyData, err = os.ReadFile(keyPath)
 		if err != nil {
@@ -293,7 +581,7 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 	if len(keyData) == 0 {
 		return nil, errors.Errorf(
 			"failed to read key data from any of the following: %s (%s)",
-			st.params.SSHKeys,
+			keyPaths,
 			errBuilder.String(),
 		)
 	}
@@ -305,21 +593,28 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 			// the client code.
 			passphraseCh := make(chan string, 1)
 
+			msg := fmt.Sprintf("Please enter passphrase for %s.", keyPath)
+			if sshAgentErr != nil {
+				msg = fmt.Sprintf("Unable to use ssh-agent: %s, falling back to ssh keys.\nPlease enter passphrase for %s.\nAlternatively, use ssh-agent, and make sure the SSH_AUTH_SOCK environment variable is set correctly.\nTo use a different ssh key, provide it with the --ssh-key flag.", sshAgentErr.Error(), keyPath)
+			}
+
 			resCh <- ShellConnUpdate{
 				DataRequest: &ShellConnDataRequest{
 					Title:      "SSH key is passphrase-protected",
-					Message:    fmt.Sprintf("Unable to use ssh-agent: %s, falling back to ssh keys.\nPlease enter passphrase for %s.\nAlternatively, use ssh-agent, and make sure the SSH_AUTH_SOCK environment variable is set correctly.\nTo use a different ssh key, provide it with the --ssh-key flag.", sshAgentErr.Error(), keyPath),
+					Message:    msg,
 					DataKind:   ShellConnDataKindPassword,
 					ResponseCh: passphraseCh,
 				},
 			}
 
-			// Now wait for the client code to provide the passphrase.
-			//
-			// TODO: support teardown; as of now, if the user tries to exit the app,
-			// it'll be stuck on the "Closing connections" stage, until the Ctrl+C is
-			// pressed.
-			passphrase := <-passphraseCh
+			// Now wait for the client code to provide the passphrase, or for the
+			// connection to be cancelled (e.g. the user is exiting the app).
+			var passphrase string
+			select {
+			case passphrase = <-passphraseCh:
+			case <-ctx.Done():
+				return nil, errors.Trace(ctx.Err())
+			}
 
 			var err error
 			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
@@ -335,12 +630,41 @@ func (st *ShellTransportSSHLib) getSSHAuthMethod(resCh chan<- ShellConnUpdate, l
 		}
 	}
 
+	// If there is an OpenSSH certificate for this key, present it as well.
+	certPath, certRequired := getSSHCertPath(keyPath, sshCert)
+	if certRequired {
+		// Check it right away, so that a broken certificate is reported
+		// clearly, instead of just failing the auth.
+		if _, err := loadSSHCertSigner(signer, certPath); err != nil {
+			return nil, errors.Annotatef(err, "loading ssh certificate")
+		}
+	}
+
+	if _, err := os.Stat(certPath); err == nil || certRequired {
+		logger.Infof("Using private key from %s with certificate %s", keyPath, certPath)
+		return &AuthMethodWMeta{
+			// The certificate is re-read on every connection, since the
+			// short-lived certificates are typically renewed while nerdlog keeps
+			// running. The plain key is offered as well, in case the server
+			// doesn't trust the CA, but has the key in authorized_keys.
+			AuthMethod: ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				certSigner, err := loadSSHCertSigner(signer, certPath)
+				if err != nil {
+					logger.Errorf("Failed to load ssh certificate, using just the key: %s", err)
+					return []ssh.Signer{signer}, nil
+				}
+
+				return []ssh.Signer{certSigner, signer}, nil
+			}),
+			Descr: fmt.Sprintf("using key %s with certificate %s", keyPath, certPath),
+		}, nil
+	}
+
 	logger.Infof("Using private key from %s", keyPath)
-	sshAuthMethodShared = &AuthMethodWMeta{
+	return &AuthMethodWMeta{
 		AuthMethod: ssh.PublicKeys(signer),
 		Descr:      fmt.Sprintf("using key %s", keyPath),
-	}
-	return sshAuthMethodShared, nil
+	}, nil
 }
 
 var (
@@ -348,42 +672,85 @@ var (
 	jumphostsSharedMtx sync.Mutex
 )
 
-func (st *ShellTransportSSHLib) getJumphostClient(resCh chan<- ShellConnUpdate, logger *log.Logger, jhConfig *ConfigHost) (*ssh.Client, error) {
+// getJumphostClient returns the client connected to the last jumphost in the
+// chain, through all the previous ones. Clients are shared, so if multiple
+// logstreams use the same jumphosts (or the same beginning of the chain), we
+// only connect once.
+func (st *ShellTransportSSHLib) getJumphostClient(ctx context.Context, resCh chan<- ShellConnUpdate, logger *log.Logger, jhChain []ConfigHost) (*ssh.Client, error) {
 	jumphostsSharedMtx.Lock()
 	defer jumphostsSharedMtx.Unlock()
 
-	key := jhConfig.Key()
-	jh := jumphostsShared[key]
-	if jh == nil {
-		logger.Infof("Connecting to jumphost... %+v", jhConfig)
+	var prev *ssh.Client
+	var keys []string
 
-		parts := strings.Split(jhConfig.Addr, ":")
-		if len(parts) != 2 {
-			return nil, errors.Errorf("malformed jumphost address %q", jhConfig.Addr)
-		}
+	for i := range jhChain {
+		jhConfig := &jhChain[i]
 
-		addrs, err := net.LookupHost(parts[0])
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
+		keys = append(keys, jhConfig.Key())
+		key := strings.Join(keys, ",")
 
-		if len(addrs) != 1 {
-			return nil, errors.New("Address not found")
+		jh := jumphostsShared[key]
+		if jh == nil {
+			logger.Infof("Connecting to jumphost #%d... %+v", i+1, jhConfig)
+
+			var err error
+			jh, err = st.dialJumphost(ctx, resCh, logger, prev, jhConfig)
+			if err != nil {
+				return nil, errors.Annotatef(err, "jumphost #%d (%s)", i+1, jhConfig.Addr)
+			}
+
+			jumphostsShared[key] = jh
+
+			logger.Infof("Jumphost #%d ok", i+1)
 		}
 
-		conf, err := st.getClientConfig(resCh, logger, jhConfig.User)
+		prev = jh
+	}
+
+	return prev, nil
+}
+
+// dialJumphost connects to the jumphost; if prev is nil, then directly,
+// otherwise through prev.
+func (st *ShellTransportSSHLib) dialJumphost(
+	ctx context.Context, resCh chan<- ShellConnUpdate, logger *log.Logger, prev *ssh.Client, jhConfig *ConfigHost,
+) (*ssh.Client, error) {
+	conf, err := st.getClientConfig(ctx, resCh, logger, *jhConfig)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if prev != nil {
+		conn, err := dialWithTimeout(ctx, prev, "tcp", jhConfig.Addr, connectionTimeout)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 
-		jh, err = ssh.Dial("tcp", jhConfig.Addr, conf.ClientConfig)
+		jh, err := newSSHClient(ctx, conn, jhConfig.Addr, conf.ClientConfig)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 
-		jumphostsShared[key] = jh
+		return jh, nil
+	}
 
-		logger.Infof("Jumphost ok")
+	parts := strings.Split(jhConfig.Addr, ":")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("malformed jumphost address %q", jhConfig.Addr)
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, parts[0])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(addrs) != 1 {
+		return nil, errors.New("Address not found")
+	}
+
+	jh, err := dialSSH(ctx, jhConfig.Addr, st.params.ConnDetails.BindAddress, conf.ClientConfig)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
 	return jh, nil
@@ -393,6 +760,15 @@ func (st *ShellTransportSSHLib) getJumphostClient(resCh chan<- ShellConnUpdate,
 type ShellConnSSHLib struct {
 	sshClient  *ssh.Client
 	sshSession *ssh.Session
+	shellBin   string
+
+	// isExtraSession is true for the sessions opened with NewSession; closing
+	// them shouldn't close the underlying ssh client.
+	isExtraSession bool
+
+	// release, if not nil, is called on Close instead of closing the ssh
+	// client, because it's shared via SSHConnPool.
+	release func()
 
 	stdinBuf  io.WriteCloser
 	stdoutBuf io.Reader
@@ -400,6 +776,7 @@ type ShellConnSSHLib struct {
 }
 
 var _ ShellConn = &ShellConnSSHLib{}
+var _ ShellConnMultiSession = &ShellConnSSHLib{}
 
 func (c *ShellConnSSHLib) Stdin() io.Writer {
 	return c.stdinBuf
@@ -413,9 +790,34 @@ func (c *ShellConnSSHLib) Stderr() io.Reader {
 	return c.stderrBuf
 }
 
-// Close closes underlying SSH connection.
+// NewSession opens a new session channel over the same SSH connection, and
+// starts a shell there.
+func (c *ShellConnSSHLib) NewSession() (ShellConn, error) {
+	conn, err := startSSHLibShell(c.sshClient, c.shellBin)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn.isExtraSession = true
+
+	return conn, nil
+}
+
+// Close closes underlying SSH connection; or, if it's an extra session
+// opened with NewSession, then only the session itself. If the connection is
+// shared via SSHConnPool, it's only closed once all its users are closed.
 func (c *ShellConnSSHLib) Close() {
 	c.stdinBuf.Close()
 	c.sshSession.Close()
+
+	if c.isExtraSession {
+		return
+	}
+
+	if c.release != nil {
+		c.release()
+		return
+	}
+
 	c.sshClient.Close()
 }
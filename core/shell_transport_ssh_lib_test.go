@@ -0,0 +1,665 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core/testutils"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// resetSSHAuthMethodShared makes sure that the next ssh-lib connection will
+// use the given keys: it forgets the cached auth method, and disables
+// ssh-agent for the duration of the test.
+func resetSSHAuthMethodShared(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	sshAuthMethodSharedMtx.Lock()
+	defer sshAuthMethodSharedMtx.Unlock()
+
+	sshAuthMethodShared = nil
+	sshAuthMethodsByIdentityFile = map[string]*AuthMethodWMeta{}
+}
+
+// newTestSSHServer starts a testutils.SSHServer accepting a newly generated
+// key, and returns the server and the path to the private key.
+func newTestSSHServer(t *testing.T, dir string) (*testutils.SSHServer, string) {
+	keyPath, signer, err := testutils.WriteSSHKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := testutils.NewSSHServer(testutils.SSHServerParams{
+		User:           "nerdlog",
+		AuthorizedKeys: []ssh.PublicKey{signer.PublicKey()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, keyPath
+}
+
+// connectSSHLib connects to the server using ShellTransportSSHLib, and returns
+// the result. If bindAddr is not empty, the connection is dialed from it.
+func connectSSHLib(srv *testutils.SSHServer, keyPath, bindAddr string) ShellConnResult {
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{keyPath},
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: srv.Addr(),
+				User: "nerdlog",
+			},
+			BindAddress: bindAddr,
+		},
+	})
+
+	return connectTransport(transport)
+}
+
+// connectSSHLibPooled is like connectSSHLib, but shares the connection via
+// the given pool.
+func connectSSHLibPooled(srv *testutils.SSHServer, keyPath string, pool *SSHConnPool) ShellConnResult {
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{keyPath},
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: srv.Addr(),
+				User: "nerdlog",
+			},
+		},
+		ConnPool: pool,
+	})
+
+	return connectTransport(transport)
+}
+
+// connectTransport connects using the given transport, and returns the
+// result.
+func connectTransport(transport ShellTransport) ShellConnResult {
+	resCh := make(chan ShellConnUpdate, 1)
+	transport.Connect(context.Background(), resCh)
+
+	for upd := range resCh {
+		if upd.Result != nil {
+			return *upd.Result
+		}
+	}
+
+	panic("not reached")
+}
+
+// runShellCmd writes the command to the shell's stdin, and returns the first
+// line printed to stdout.
+func runShellCmd(conn ShellConn, stdout *bufio.Scanner, cmd string) (string, error) {
+	if _, err := fmt.Fprintf(conn.Stdin(), "%s\n", cmd); err != nil {
+		return "", err
+	}
+
+	if !stdout.Scan() {
+		if err := stdout.Err(); err != nil {
+			return "", err
+		}
+
+		return "", io.EOF
+	}
+
+	return stdout.Text(), nil
+}
+
+func TestShellTransportSSHLibConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_sshlib")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	res := connectSSHLib(srv, keyPath, "")
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo hello $((1+2))")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello 3", line)
+
+	// Additional sessions work over the same connection.
+	multi, ok := res.Conn.(ShellConnMultiSession)
+	if !assert.True(t, ok) {
+		return
+	}
+
+	sess, err := multi.NewSession()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sessStdout := bufio.NewScanner(sess.Stdout())
+	line, err = runShellCmd(sess, sessStdout, "echo from session")
+	assert.NoError(t, err)
+	assert.Equal(t, "from session", line)
+
+	// Closing the session doesn't affect the main one.
+	sess.Close()
+
+	line, err = runShellCmd(res.Conn, stdout, "echo still here")
+	assert.NoError(t, err)
+	assert.Equal(t, "still here", line)
+
+	assert.Equal(t, 1, srv.NumConns())
+}
+
+func TestShellTransportSSHLibAuthRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_sshlib")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	srv.SetRejectAuth(true)
+
+	res := connectSSHLib(srv, keyPath, "")
+	if !assert.Error(t, res.Err) {
+		res.Conn.Close()
+		return
+	}
+
+	assert.Equal(t, ConnErrCategoryAuth, CategorizeConnErr(res.Err.Error()))
+	assert.True(t, errors.Is(res.Err, ErrAuthFailed))
+	assert.False(t, errors.Is(res.Err, ErrHostUnreachable))
+}
+
+func TestShellTransportSSHLibRefused(t *testing.T) {
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	keyPath, _, err := testutils.WriteSSHKey(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Get some free port, and close the listener, so that nobody listens
+	// there.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{keyPath},
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: addr,
+				User: "nerdlog",
+			},
+		},
+	})
+
+	res := connectTransport(transport)
+	if !assert.Error(t, res.Err) {
+		res.Conn.Close()
+		return
+	}
+
+	assert.True(t, errors.Is(res.Err, ErrHostUnreachable))
+	assert.True(t, errors.Is(res.Err, ErrRefused))
+	assert.False(t, errors.Is(res.Err, ErrAuthFailed))
+}
+
+// TestShellTransportSSHLibIdentityFile checks that the identity file from the
+// connection details is used instead of the default keys.
+func TestShellTransportSSHLibIdentityFile(t *testing.T) {
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	// The default key is not authorized on the server.
+	otherKeyPath, _, err := testutils.WriteSSHKey(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{otherKeyPath},
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: srv.Addr(),
+				User: "nerdlog",
+			},
+			IdentityFile: keyPath,
+		},
+	})
+
+	res := connectTransport(transport)
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", line)
+}
+
+func TestShellTransportSSHLibProxyCommand(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	_, port, err := net.SplitHostPort(srv.Addr())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The hostname doesn't resolve, so the only way to get to the server is
+	// through the proxy command, which forwards its stdin and stdout to the
+	// server's port.
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{keyPath},
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: "nerdlog-test.invalid:" + port,
+				User: "nerdlog",
+			},
+			ProxyCommand: `bash -c 'exec 3<>/dev/tcp/127.0.0.1/%p; cat <&3 2>/dev/null & exec cat >&3'`,
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resCh := make(chan ShellConnUpdate, 1)
+	transport.Connect(ctx, resCh)
+
+	var res ShellConnResult
+	for upd := range resCh {
+		if upd.Result != nil {
+			res = *upd.Result
+			break
+		}
+	}
+
+	// Just like LStreamClient does, cancel the dial context once connected;
+	// the proxy command must survive it.
+	cancel()
+
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo hello $((1+2))")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello 3", line)
+
+	assert.Equal(t, 1, srv.NumConns())
+}
+
+func TestShellTransportSSHLibProxyCommandFailed(t *testing.T) {
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	keyPath, _, err := testutils.WriteSSHKey(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{keyPath},
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: "myhost:2222",
+				User: "nerdlog",
+			},
+			ProxyCommand: `sh -c 'echo "no route to %h:%p" >&2; exit 1'`,
+		},
+	})
+
+	res := connectTransport(transport)
+	if !assert.Error(t, res.Err) {
+		res.Conn.Close()
+		return
+	}
+
+	// The stderr of the proxy command is included in the error.
+	assert.Contains(t, res.Err.Error(), "proxy command stderr: no route to myhost:2222")
+}
+
+func TestShellTransportSSHLibDropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_sshlib")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	res := connectSSHLib(srv, keyPath, "")
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", line)
+
+	srv.DropConnections()
+
+	// Stdout gets closed once the connection is dropped.
+	doneCh := make(chan bool)
+	go func() {
+		doneCh <- stdout.Scan()
+	}()
+
+	select {
+	case ok := <-doneCh:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stdout wasn't closed after dropping the connection")
+	}
+}
+
+func TestShellTransportSSHLibBindAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_sshlib")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	// On Linux, the whole 127.0.0.0/8 is local, so we can bind to 127.0.0.2
+	// and check that the server sees the connection coming from it.
+	res := connectSSHLib(srv, keyPath, "127.0.0.2")
+	if res.Err != nil {
+		t.Skipf("can't bind to 127.0.0.2 on this system: %s", res.Err)
+	}
+	defer res.Conn.Close()
+
+	if assert.Equal(t, 1, len(srv.RemoteAddrs())) {
+		host, _, err := net.SplitHostPort(srv.RemoteAddrs()[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.2", host)
+	}
+}
+
+func TestShellTransportSSHLibBindAddressFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_sshlib")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	// 192.0.2.1 is from the TEST-NET-1, so it's not assigned to any local
+	// interface, and the error should say that binding has failed (as opposed
+	// to connecting).
+	res := connectSSHLib(srv, keyPath, "192.0.2.1")
+	if !assert.Error(t, res.Err) {
+		res.Conn.Close()
+		return
+	}
+
+	assert.Contains(t, res.Err.Error(), "binding to local address 192.0.2.1")
+	assert.NotContains(t, res.Err.Error(), "connecting to")
+	assert.Equal(t, 0, srv.NumConns())
+}
+
+func TestShellTransportSSHLibConnPool(t *testing.T) {
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	pool := NewSSHConnPool()
+
+	// Two logstreams with the same connection identity share a single
+	// connection, but each of them has its own shell.
+	res1 := connectSSHLibPooled(srv, keyPath, pool)
+	if !assert.NoError(t, res1.Err) {
+		return
+	}
+
+	res2 := connectSSHLibPooled(srv, keyPath, pool)
+	if !assert.NoError(t, res2.Err) {
+		res1.Conn.Close()
+		return
+	}
+
+	assert.Equal(t, 1, srv.NumConns())
+
+	stdout1 := bufio.NewScanner(res1.Conn.Stdout())
+	stdout2 := bufio.NewScanner(res2.Conn.Stdout())
+
+	line, err := runShellCmd(res1.Conn, stdout1, "echo one")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", line)
+
+	line, err = runShellCmd(res2.Conn, stdout2, "echo two")
+	assert.NoError(t, err)
+	assert.Equal(t, "two", line)
+
+	// Closing one of them doesn't affect the other one.
+	res1.Conn.Close()
+
+	line, err = runShellCmd(res2.Conn, stdout2, "echo still here")
+	assert.NoError(t, err)
+	assert.Equal(t, "still here", line)
+
+	// Once both are closed, the connection is closed too.
+	res2.Conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return srv.NumConns() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Without the pool, every logstream connects separately.
+	res1 = connectSSHLib(srv, keyPath, "")
+	if !assert.NoError(t, res1.Err) {
+		return
+	}
+	defer res1.Conn.Close()
+
+	res2 = connectSSHLib(srv, keyPath, "")
+	if !assert.NoError(t, res2.Err) {
+		return
+	}
+	defer res2.Conn.Close()
+
+	assert.Equal(t, 2, srv.NumConns())
+}
+
+func TestShellTransportSSHLibConnPoolDropped(t *testing.T) {
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, dir)
+	defer srv.Close()
+
+	pool := NewSSHConnPool()
+
+	res1 := connectSSHLibPooled(srv, keyPath, pool)
+	if !assert.NoError(t, res1.Err) {
+		return
+	}
+	defer res1.Conn.Close()
+
+	srv.DropConnections()
+
+	assert.Eventually(t, func() bool {
+		return srv.NumConns() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The shared connection is broken, so the next logstream gets a new one.
+	res2 := connectSSHLibPooled(srv, keyPath, pool)
+	if !assert.NoError(t, res2.Err) {
+		return
+	}
+	defer res2.Conn.Close()
+
+	stdout2 := bufio.NewScanner(res2.Conn.Stdout())
+	line, err := runShellCmd(res2.Conn, stdout2, "echo reconnected")
+	assert.NoError(t, err)
+	assert.Equal(t, "reconnected", line)
+
+	assert.Equal(t, 1, srv.NumConns())
+}
+
+func TestShellTransportSSHLibCert(t *testing.T) {
+	dir := t.TempDir()
+
+	resetSSHAuthMethodShared(t)
+
+	ca, _, err := testutils.GenerateSSHKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	keyPath, signer, err := testutils.WriteSSHKey(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The server doesn't know the key itself, it only trusts the CA.
+	srv, err := testutils.NewSSHServer(testutils.SSHServerParams{
+		User:              "nerdlog",
+		TrustedUserCAKeys: []ssh.PublicKey{ca.PublicKey()},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+
+	// Without the certificate, auth fails.
+	res := connectSSHLib(srv, keyPath, "")
+	if !assert.Error(t, res.Err) {
+		res.Conn.Close()
+		return
+	}
+	assert.Equal(t, ConnErrCategoryAuth, CategorizeConnErr(res.Err.Error()))
+
+	// With the certificate next to the key, it succeeds.
+	resetSSHAuthMethodShared(t)
+
+	err = testutils.WriteSSHUserCert(keyPath+"-cert.pub", ca, signer.PublicKey(), "nerdlog")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res = connectSSHLib(srv, keyPath, "")
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo certified")
+	assert.NoError(t, err)
+	assert.Equal(t, "certified", line)
+}
+
+func TestLoadSSHCertSigner(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, _, err := testutils.GenerateSSHKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	signer, _, err := testutils.GenerateSSHKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	certPath := filepath.Join(dir, "cert.pub")
+	if !assert.NoError(t, testutils.WriteSSHUserCert(certPath, ca, signer.PublicKey(), "nerdlog")) {
+		return
+	}
+
+	certSigner, err := loadSSHCertSigner(signer, certPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cert, ok := certSigner.PublicKey().(*ssh.Certificate)
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{"nerdlog"}, cert.ValidPrincipals)
+	}
+
+	// The certificate for some other key can't be used.
+	otherSigner, _, err := testutils.GenerateSSHKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = loadSSHCertSigner(otherSigner, certPath)
+	assert.EqualError(t, err, certPath+" is issued for a different key")
+
+	// Not a certificate at all.
+	pubPath := filepath.Join(dir, "id.pub")
+	assert.NoError(t, ioutil.WriteFile(pubPath, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644))
+
+	_, err = loadSSHCertSigner(signer, pubPath)
+	assert.EqualError(t, err, pubPath+" is not an ssh certificate")
+
+	// Explicitly configured path is used as is, and is required to exist.
+	path, required := getSSHCertPath("/home/me/.ssh/id_ed25519", "")
+	assert.Equal(t, "/home/me/.ssh/id_ed25519-cert.pub", path)
+	assert.False(t, required)
+
+	path, required = getSSHCertPath("/home/me/.ssh/id_ed25519", "/etc/ssh/my-cert.pub")
+	assert.Equal(t, "/etc/ssh/my-cert.pub", path)
+	assert.True(t, required)
+}
@@ -0,0 +1,315 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+	"github.com/mvdan/sh/shell"
+)
+
+// DefaultWinEventShellCommand is the command which is used with the winevent
+// transport to run PowerShell on the Windows hosts; the Base64-encoded
+// PowerShell script is appended to it as the last argument.
+//
+// Just like DefaultSSHShellCommand, it's interpreted by
+// https://github.com/mvdan/sh, and can use the vars NLHOST, NLPORT, NLUSER,
+// NLJUMP and NLBIND.
+const DefaultWinEventShellCommand = "ssh -o 'BatchMode=yes' ${NLBIND:+-b ${NLBIND}} ${NLJUMP:+-J ${NLJUMP}} ${NLPORT:+-p ${NLPORT}} ${NLUSER:+${NLUSER}@}${NLHOST} powershell -NoProfile -NonInteractive -EncodedCommand"
+
+// SpecialFilenameWinEvent is the filename reported for the logs from the
+// winevent transport; see ShellTransportWinEvent.
+const SpecialFilenameWinEvent = "winevent"
+
+// winEventTimeLayout is the layout of the timestamps printed by the
+// winEventScript, in UTC.
+const winEventTimeLayout = "2006-01-02T15:04:05.000000Z"
+
+// winEventLevelTags maps the levels of the Windows events to the tags which
+// are prepended to the messages, so that ClassifyLogLevel recognizes them.
+// Level 0 is "LogAlways", used e.g. by the Security log.
+var winEventLevelTags = map[int]string{
+	0: "[I]",
+	1: "[F]",
+	2: "[E]",
+	3: "[W]",
+	4: "[I]",
+	5: "[D]",
+}
+
+// ShellTransportWinEvent is a read-only transport which gets the logs from
+// the Windows Event Log: for every query, it runs PowerShell on the host
+// (over ssh by default, see DefaultWinEventShellCommand), which gets the
+// events using Get-WinEvent for the query's time range.
+//
+// Just like ShellTransportHTTPNDJSON, the connection it creates emulates the
+// shell with the nerdlog_agent.sh (see emulatedAgentConn), so the events are
+// merged with the other logstreams as usual. Every event becomes a log line
+// with the provider name as the program and the event ID as the pid, and the
+// message is prefixed with the level tag like "[E]" (see
+// winEventLevelTags).
+//
+// The query itself is not sent to the hosts: all the events in the time range
+// are returned.
+type ShellTransportWinEvent struct {
+	params ShellTransportWinEventParams
+}
+
+type ShellTransportWinEventParams struct {
+	// LogNames are the names of the event logs to read, like "System".
+	LogNames []string
+
+	// ShellCommand is the command to run PowerShell, like
+	// DefaultWinEventShellCommand.
+	ShellCommand string
+
+	// EnvOverride overrides env vars; see
+	// ShellTransportCustomCmdParams.EnvOverride.
+	EnvOverride map[string]string
+
+	// Host is used as the hostname in the log lines.
+	Host string
+
+	Logger *log.Logger
+}
+
+func NewShellTransportWinEvent(params ShellTransportWinEventParams) *ShellTransportWinEvent {
+	params.Logger = params.Logger.WithNamespaceAppended("TransportWinEvent")
+
+	if params.ShellCommand == "" {
+		params.ShellCommand = DefaultWinEventShellCommand
+	}
+
+	return &ShellTransportWinEvent{
+		params: params,
+	}
+}
+
+func (s *ShellTransportWinEvent) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	go func() {
+		// There is nothing to connect to in advance, since every query runs the
+		// command anew; so just make sure that the command is valid.
+		if _, err := s.cmdFields(); err != nil {
+			resCh <- ShellConnUpdate{
+				Result: &ShellConnResult{
+					Err: errors.Trace(err),
+				},
+			}
+			return
+		}
+
+		resCh <- ShellConnUpdate{
+			Result: &ShellConnResult{
+				Conn: newEmulatedAgentConn(emulatedAgentConnParams{
+					TransportName: "winevent",
+					Filename:      SpecialFilenameWinEvent,
+					Host:          s.params.Host,
+					Source:        &winEventSource{transport: s},
+					Logger:        s.params.Logger,
+				}),
+			},
+		}
+	}()
+}
+
+// cmdFields parses the shell command into separate fields, expanding the
+// env vars.
+func (s *ShellTransportWinEvent) cmdFields() ([]string, error) {
+	cmdFields, err := shell.Fields(s.params.ShellCommand, func(varName string) string {
+		if value, ok := s.params.EnvOverride[varName]; ok {
+			return value
+		}
+
+		return os.Getenv(varName)
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing shell command %q", s.params.ShellCommand)
+	}
+
+	if len(cmdFields) == 0 {
+		return nil, errors.Errorf("command is empty")
+	}
+
+	return cmdFields, nil
+}
+
+// winEventSource is the emulatedAgentSource which runs Get-WinEvent on the
+// host.
+type winEventSource struct {
+	transport *ShellTransportWinEvent
+}
+
+func (s *winEventSource) getRecords(
+	ctx context.Context, q emulatedAgentQuery,
+) ([]emulatedLogRecord, error) {
+	params := s.transport.params
+
+	cmdFields, err := s.transport.cmdFields()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	script := winEventScript(params.LogNames, q)
+	params.Logger.Verbose2f("Running Get-WinEvent script: %s", script)
+
+	cmdFields = append(cmdFields, encodePowerShellCommand(script))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cmdFields[0], cmdFields[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Annotatef(err, "running Get-WinEvent: %s", msg)
+		}
+
+		return nil, errors.Annotatef(err, "running Get-WinEvent")
+	}
+
+	records, err := parseWinEventOutput(stdout.Bytes())
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing Get-WinEvent output")
+	}
+
+	return records, nil
+}
+
+// validateWinEventLogName checks the event log name like "System" or
+// "Microsoft-Windows-PowerShell/Operational".
+func validateWinEventLogName(name string) error {
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.Errorf("invalid event log name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// winEventScript returns the PowerShell script which prints the events from
+// the given logs in the query's time range, one per line, with tab-separated
+// fields: the time in UTC (winEventTimeLayout), the level, the provider name,
+// the event ID, and the message with all the whitespace collapsed.
+func winEventScript(logNames []string, q emulatedAgentQuery) string {
+	quotedNames := make([]string, 0, len(logNames))
+	for _, name := range logNames {
+		quotedNames = append(quotedNames, powerShellQuote(name))
+	}
+
+	lines := []string{
+		"$ErrorActionPreference = 'Stop'",
+		"[Console]::OutputEncoding = [System.Text.Encoding]::UTF8",
+		"$filter = @{ LogName = @(" + strings.Join(quotedNames, ", ") + ") }",
+	}
+
+	// The times are passed as unix milliseconds, so that they don't depend on
+	// the host's locale and timezone.
+	if !q.from.IsZero() {
+		lines = append(lines, "$filter.StartTime = "+powerShellUnixTime(q.from))
+	}
+
+	if !q.to.IsZero() {
+		lines = append(lines, "$filter.EndTime = "+powerShellUnixTime(q.to))
+	}
+
+	lines = append(lines,
+		"$tab = [char]9",
+		"try {",
+		"  Get-WinEvent -FilterHashtable $filter | ForEach-Object {",
+		"    $msg = [string]$_.Message",
+		"    $msg = ($msg -replace '\\s+', ' ').Trim()",
+		"    $t = $_.TimeCreated.ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ss.ffffffZ')",
+		"    @($t, [int]$_.Level, $_.ProviderName, $_.Id, $msg) -join $tab",
+		"  }",
+		"} catch {",
+		"  if ($_.FullyQualifiedErrorId -notlike 'NoMatchingEventsFound*') { throw }",
+		"}",
+	)
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// powerShellUnixTime returns the PowerShell expression for the given time as
+// a local DateTime, which is what the FilterHashtable expects.
+func powerShellUnixTime(t time.Time) string {
+	return "[DateTimeOffset]::FromUnixTimeMilliseconds(" +
+		strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) +
+		").LocalDateTime"
+}
+
+// powerShellQuote returns the single-quoted PowerShell string literal.
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// encodePowerShellCommand encodes the script for the PowerShell's
+// -EncodedCommand: Base64 of the UTF-16LE script. This way, the script goes
+// through ssh and the remote shell without any quoting issues.
+func encodePowerShellCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	data := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(data[i*2:], u)
+	}
+
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// parseWinEventOutput parses the output of the winEventScript into records.
+func parseWinEventOutput(data []byte) ([]emulatedLogRecord, error) {
+	var records []emulatedLogRecord
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, httpNDJSONMaxRecordSize)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) != 5 {
+			return nil, errors.Errorf("line %d: expected 5 fields, got %d", lineNum, len(fields))
+		}
+
+		t, err := time.Parse(winEventTimeLayout, fields[0])
+		if err != nil {
+			return nil, errors.Annotatef(err, "line %d: parsing time", lineNum)
+		}
+
+		level, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, errors.Annotatef(err, "line %d: parsing level", lineNum)
+		}
+
+		msg := fields[4]
+		if tag, ok := winEventLevelTags[level]; ok {
+			msg = tag + " " + msg
+		}
+
+		records = append(records, emulatedLogRecord{
+			Time:    t,
+			Msg:     msg,
+			Program: fields[2],
+			Pid:     fields[3],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodePowerShellCommand is the reverse of encodePowerShellCommand.
+func decodePowerShellCommand(t *testing.T, encoded string) string {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func TestParseTransportModeWinEvent(t *testing.T) {
+	tm, err := ParseTransportMode("winevent:System, Application,Microsoft-Windows-PowerShell/Operational")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"System", "Application", "Microsoft-Windows-PowerShell/Operational",
+		}, tm.WinEventLogNames())
+		assert.Equal(t, DefaultWinEventShellCommand, tm.CustomShellCommand())
+		assert.Equal(t, "winevent:System,Application,Microsoft-Windows-PowerShell/Operational", tm.String())
+	}
+
+	for _, spec := range []string{"winevent:", "winevent: , ", "winevent:Sys\ntem"} {
+		_, err := ParseTransportMode(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestWinEventScript(t *testing.T) {
+	script := winEventScript([]string{"System", "It's"}, emulatedAgentQuery{
+		from: time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC),
+		to:   time.Date(2025, 3, 10, 11, 0, 1, 0, time.UTC),
+	})
+
+	lines := strings.Split(script, "\n")
+	assert.Contains(t, lines, "$filter = @{ LogName = @('System', 'It''s') }")
+	assert.Contains(t, lines, "$filter.StartTime = [DateTimeOffset]::FromUnixTimeMilliseconds(1741600800000).LocalDateTime")
+	assert.Contains(t, lines, "$filter.EndTime = [DateTimeOffset]::FromUnixTimeMilliseconds(1741604401000).LocalDateTime")
+	assert.Contains(t, script, "Get-WinEvent -FilterHashtable $filter")
+
+	// Without the time range, the filter only has the log names.
+	script = winEventScript([]string{"System"}, emulatedAgentQuery{})
+	assert.NotContains(t, script, "StartTime")
+	assert.NotContains(t, script, "EndTime")
+
+	assert.Equal(t, script, decodePowerShellCommand(t, encodePowerShellCommand(script)))
+	assert.Equal(t, "SABpAA==", encodePowerShellCommand("Hi"))
+}
+
+func TestParseWinEventOutput(t *testing.T) {
+	output := strings.Join([]string{
+		"2025-03-10T10:00:01.123456Z\t2\tService Control Manager\t7000\tThe Foo service failed to start.",
+		"",
+		"2025-03-10T10:00:02.000000Z\t3\tDisk\t51\tAn error was detected on device \\Device\\Harddisk0.",
+		"2025-03-10T10:00:03.000000Z\t4\tEventLog\t6005\tThe Event log service was started.",
+		"2025-03-10T10:00:04.000000Z\t1\tKernel-Power\t41\tThe system has rebooted\twithout cleanly shutting down.",
+		"2025-03-10T10:00:05.000000Z\t5\tMyApp\t1\t",
+	}, "\r\n") + "\r\n"
+
+	records, err := parseWinEventOutput([]byte(output))
+	if !assert.NoError(t, err) || !assert.Len(t, records, 5) {
+		return
+	}
+
+	assert.Equal(t, emulatedLogRecord{
+		Time:    time.Date(2025, 3, 10, 10, 0, 1, 123456000, time.UTC),
+		Msg:     "[E] The Foo service failed to start.",
+		Program: "Service Control Manager",
+		Pid:     "7000",
+	}, records[0])
+
+	assert.Equal(t, "[F] The system has rebooted\twithout cleanly shutting down.", records[3].Msg)
+
+	var levels []LogLevel
+	for _, r := range records {
+		levels = append(levels, ClassifyLogLevel(r.Msg))
+	}
+	assert.Equal(t, []LogLevel{
+		LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelError, LogLevelDebug,
+	}, levels)
+
+	for _, output := range []string{
+		"2025-03-10T10:00:01.123456Z\t2\tfoo\n",
+		"2025-03-10 10:00:01\t2\tfoo\t1\tbar\n",
+		"2025-03-10T10:00:01.123456Z\terror\tfoo\t1\tbar\n",
+	} {
+		_, err := parseWinEventOutput([]byte(output))
+		assert.Error(t, err, output)
+	}
+}
+
+func TestShellTransportWinEvent(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	outputPath := filepath.Join(dir, "output.txt")
+	output := strings.Join([]string{
+		now.Add(-2*time.Minute).Format(winEventTimeLayout) + "\t2\tService Control Manager\t7000\tThe Foo service failed to start.",
+		now.Add(-3*time.Minute).Format(winEventTimeLayout) + "\t4\tEventLog\t6005\tThe Event log service was started.",
+		// Too old.
+		now.Add(-5*time.Hour).Format(winEventTimeLayout) + "\t4\tEventLog\t6005\tOld.",
+	}, "\r\n") + "\r\n"
+	if err := ioutil.WriteFile(outputPath, []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake ssh records its args, and prints the events.
+	argsPath := filepath.Join(dir, "args.txt")
+	sshScript := strings.Join([]string{
+		"#!/bin/sh",
+		`for arg in "$@"; do echo "$arg"; done > ` + shellQuote(argsPath),
+		"cat " + shellQuote(outputPath),
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(sshScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tm, err := ParseTransportMode("winevent:System,Application")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := New(Options{
+		LStreams:             "admin@win-01:2222",
+		DefaultTransportMode: tm,
+		ClientID:             "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        now.Add(-time.Hour),
+		MaxNumLines: 10,
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, resp.Logs, 2) {
+		return
+	}
+
+	assert.Equal(t, "[I] The Event log service was started.", resp.Logs[0].Msg)
+	assert.Equal(t, LogLevelInfo, resp.Logs[0].Level)
+	assert.Equal(t, "EventLog", resp.Logs[0].Context["program"])
+	assert.Equal(t, "6005", resp.Logs[0].Context["pid"])
+	assert.Equal(t, "win-01", resp.Logs[0].Context["hostname"])
+	assert.Equal(t, SpecialFilenameWinEvent, resp.Logs[0].LogFilename)
+
+	assert.Equal(t, "[E] The Foo service failed to start.", resp.Logs[1].Msg)
+	assert.Equal(t, LogLevelError, resp.Logs[1].Level)
+	assert.Equal(t, "Service_Control_Manager", resp.Logs[1].Context["program"])
+
+	argsData, err := ioutil.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := strings.Split(strings.TrimSpace(string(argsData)), "\n")
+	if !assert.True(t, len(args) > 6) {
+		return
+	}
+	assert.Equal(t, []string{
+		"-o", "BatchMode=yes", "-p", "2222", "admin@win-01",
+		"powershell", "-NoProfile", "-NonInteractive", "-EncodedCommand",
+	}, args[:len(args)-1])
+
+	script := decodePowerShellCommand(t, args[len(args)-1])
+	assert.Contains(t, script, "$filter = @{ LogName = @('System', 'Application') }")
+	assert.Contains(t, script, "$filter.StartTime = ")
+}
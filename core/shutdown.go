@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DefaultShutdownGracePeriod is a default for
+// LStreamsManagerParams.ShutdownGracePeriod.
+const DefaultShutdownGracePeriod = 3 * time.Second
+
+// ErrShuttingDown is returned for the queries made while the Shutdown is in
+// progress.
+var ErrShuttingDown = errors.Errorf("shutting down")
+
+// Shutdown tears the LStreamsManager down in an orderly way: the query in
+// progress (if any) is stopped on the hosts, which get up to the
+// ShutdownGracePeriod to do that, and then all the connections are closed,
+// and the connects in progress are cancelled. New queries made meanwhile
+// fail with ErrShuttingDown.
+//
+// It returns once the teardown is completed, or once the ctx is done, in
+// which case the connections are closed right away (like Close does, without
+// waiting for it) and the ctx's error is returned.
+//
+// It's safe to call Shutdown multiple times and concurrently, as well as
+// together with Close.
+func (lsman *LStreamsManager) Shutdown(ctx context.Context) error {
+	select {
+	case lsman.shutdownReqCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-lsman.torndownCh:
+		return nil
+	case <-ctx.Done():
+		lsman.Close()
+		return errors.Annotatef(ctx.Err(), "shutting down")
+	}
+}
+
+// startShutdown handles the Shutdown request, and returns true if the
+// teardown is completed right away, in which case the caller (the run loop)
+// must return.
+func (lsman *LStreamsManager) startShutdown() (done bool) {
+	if lsman.shuttingDown || lsman.tearingDown {
+		return false
+	}
+
+	lsman.params.Logger.Infof("LStreamsManager shutdown is started")
+	lsman.shuttingDown = true
+	lsman.shutdownLStreams = lsman.queryingLStreams()
+
+	// Stopping the query makes the busy LStreamClients interrupt it on the
+	// hosts, which is quick, and they become idle once it's done.
+	lsman.stopQuery()
+
+	return lsman.continueShutdown()
+}
+
+// continueShutdown is called while the Shutdown is in progress, after the
+// states of the logstreams change: once none of the logstreams which were
+// running the query is busy, or right away if none is busy already, it
+// starts the teardown. Otherwise, it starts the ShutdownGracePeriod
+// countdown, unless it's started already. The other busy logstreams (e.g.
+// the ones which are still bootstrapping) are not waited for.
+//
+// Returns true if the teardown is completed, in which case the caller (the
+// run loop) must return.
+func (lsman *LStreamsManager) continueShutdown() (done bool) {
+	if lsman.tearingDown {
+		return false
+	}
+
+	numBusy := 0
+	for name := range lsman.shutdownLStreams {
+		if lsman.lscStates[name] == LStreamClientStateConnectedBusy {
+			numBusy++
+		}
+	}
+
+	if numBusy == 0 {
+		lsman.shutdownGraceCh = nil
+		return lsman.teardown()
+	}
+
+	if lsman.shutdownGraceCh == nil {
+		lsman.params.Logger.Infof(
+			"Waiting up to %s for %d busy logstreams", lsman.params.ShutdownGracePeriod, numBusy,
+		)
+		lsman.shutdownGraceCh = lsman.params.Clock.After(lsman.params.ShutdownGracePeriod)
+	}
+
+	return false
+}
+
+// queryingLStreams returns the names of the logstreams which are running the
+// current query: it was sent to them, and they haven't responded yet.
+func (lsman *LStreamsManager) queryingLStreams() map[string]struct{} {
+	ret := map[string]struct{}{}
+
+	q := lsman.curQueryLogsCtx
+	if q == nil {
+		return ret
+	}
+
+	pending := make(map[*LStreamClient]struct{}, len(q.pending))
+	for _, p := range q.pending {
+		pending[p.lsc] = struct{}{}
+	}
+
+	skipped := make(map[string]struct{}, len(q.skipped))
+	for _, name := range q.skipped {
+		skipped[name] = struct{}{}
+	}
+
+	for name, lsc := range lsman.lscs {
+		if _, ok := pending[lsc]; ok {
+			continue
+		}
+
+		if _, ok := skipped[name]; ok {
+			continue
+		}
+
+		if _, ok := q.resps[name]; ok {
+			continue
+		}
+
+		ret[name] = struct{}{}
+	}
+
+	return ret
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNerdlogShutdown(t *testing.T) {
+	numGoroutinesBefore := runtime.NumGoroutine()
+
+	n, err := New(Options{
+		// The localhost is going to be busy with the slow query, and the other
+		// ones are never going to connect.
+		LStreams: "localhost,down-01,down-02",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					CustomAgent: `if [ -n "$NLENV_SLOW" ]; then sleep 30; fi
+echo "m:1:2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo"
+`,
+				},
+			},
+		},
+		NewTransport: func(ls LogStream) ShellTransport {
+			if ls.Name == "localhost" {
+				return nil
+			}
+
+			return &fakeUnreachableTransport{}
+		},
+		SkipNotConnected: true,
+		ConnectTimeout:   1 * time.Second,
+
+		// Way longer than the test takes, so that if the query isn't stopped,
+		// the test fails.
+		ShutdownGracePeriod: 30 * time.Second,
+
+		ClientID: "shutdown_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := n.QueryReader(context.Background(), QueryLogsParams{
+		From:        time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+		AgentEnv:    map[string]string{"SLOW": "1"},
+	}, ExportFormatRaw)
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(r)
+		readErrCh <- err
+	}()
+
+	// Give the query some time to start on the host, after the ConnectTimeout.
+	time.Sleep(2 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	startTime := time.Now()
+
+	// Shutdown is idempotent, and can be called concurrently.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = n.Shutdown(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Less(t, int64(time.Since(startTime)), int64(5*time.Second))
+
+	select {
+	case err := <-readErrCh:
+		assert.True(t, errors.Is(err, ErrQueryStopped), "%v", err)
+	default:
+		t.Error("reader is not done after Shutdown")
+	}
+	r.Close()
+
+	// Everything fails once it's shut down, without blocking.
+	_, err = n.Query(ctx, QueryLogsParams{})
+	assert.Error(t, err)
+
+	assert.NoError(t, n.Shutdown(ctx))
+	n.Close()
+
+	numGoroutines := waitNumGoroutines(numGoroutinesBefore, 5*time.Second)
+	assert.LessOrEqual(t, numGoroutines, numGoroutinesBefore, "goroutines leaked")
+}
+
+func TestLStreamsManagerShutdownDeadline(t *testing.T) {
+	// The query never gets the chance to be stopped, since the host hangs.
+	queryGate := make(chan struct{})
+	defer close(queryGate)
+
+	lstreams := []string{"fake-01"}
+	env := newThrottleTestEnv(t, lstreams, queryGate, LStreamsManagerParams{
+		ShutdownGracePeriod: 30 * time.Second,
+	})
+
+	env.query("q1")
+	env.waitQueries("fake-01", []string{"q1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := env.lsman.Shutdown(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	// Once the ctx is done, the connections are closed right away.
+	doneCh := make(chan struct{})
+	go func() {
+		env.lsman.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not torn down after the Shutdown deadline")
+	}
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// snapshotVersion is the version of the Snapshot file format; it's bumped on
+// incompatible changes, and ReadSnapshot refuses the other versions.
+const snapshotVersion = 1
+
+// ErrSnapshotOffline is returned by SnapshotSource.Query for the queries which
+// would need the data not present in the snapshot, since there's nothing to
+// connect to.
+var ErrSnapshotOffline = errors.New("the snapshot is offline, it only has the logs loaded when it was taken")
+
+// Snapshot is the view of the last query (see Nerdlog.SnapshotView): the
+// query, its time range, the logstreams, the loaded logs and the histogram,
+// serializable to a single file, so that it can be shared e.g. with a
+// teammate during an incident, who can then view the same data offline with
+// the SnapshotSource, without connecting to the hosts. See WriteSnapshot and
+// ReadSnapshot.
+type Snapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// LStreams is the logstreams spec, like Options.LStreams, and
+	// SelectedLStreams are the sorted names of the logstreams it was resolved
+	// to, after applying the Options.Selector.
+	LStreams         string   `json:"lstreams"`
+	SelectedLStreams []string `json:"selected_lstreams,omitempty"`
+
+	// Params are the params of the query. Only the ones which define the
+	// view are kept: e.g. LoadEarlier or ResumeToken are always reset.
+	Params QueryLogsParams `json:"params"`
+
+	// HasView is false if no query has been done when the snapshot was taken,
+	// so there are no logs and no histogram.
+	HasView bool `json:"has_view"`
+
+	// The rest is the same as in the LogRespTotal of the query.
+	MinuteStats          map[int64]MinuteStatsItem            `json:"minute_stats,omitempty"`
+	MinuteStatsByLStream map[string]map[int64]MinuteStatsItem `json:"minute_stats_by_lstream,omitempty"`
+	Logs                 []LogMsg                             `json:"logs,omitempty"`
+	NumMsgsTotal         int                                  `json:"num_msgs_total"`
+	Approximate          bool                                 `json:"approximate,omitempty"`
+	SampleRate           int                                  `json:"sample_rate,omitempty"`
+	Groups               []Group                              `json:"groups,omitempty"`
+	Warnings             []string                             `json:"warnings,omitempty"`
+	SkippedLStreams      []string                             `json:"skipped_lstreams,omitempty"`
+}
+
+// newSnapshot creates the snapshot of the view resulting from the query with
+// the given params; resp can be nil if there was no query yet.
+func newSnapshot(
+	lstreamsSpec string, lstreams []string, params QueryLogsParams, resp *LogRespTotal, now time.Time,
+) Snapshot {
+	params.LoadEarlier = false
+	params.LoadNewer = false
+	params.ResumeToken = nil
+	params.DontAddHistoryItem = false
+	params.RefreshIndex = false
+	params.SkipNotConnected = false
+	params.RetrySkipped = false
+
+	snap := Snapshot{
+		Version:          snapshotVersion,
+		CreatedAt:        now,
+		LStreams:         lstreamsSpec,
+		SelectedLStreams: lstreams,
+		Params:           params,
+	}
+
+	if resp != nil {
+		snap.HasView = true
+		snap.MinuteStats = resp.MinuteStats
+		snap.MinuteStatsByLStream = resp.MinuteStatsByLStream
+		snap.Logs = resp.Logs
+		snap.NumMsgsTotal = resp.NumMsgsTotal
+		snap.Approximate = resp.Approximate
+		snap.SampleRate = resp.SampleRate
+		snap.Groups = resp.Groups
+		snap.Warnings = resp.Warnings
+		snap.SkippedLStreams = resp.SkippedLStreams
+	}
+
+	return snap
+}
+
+// LogResp returns the view saved in the snapshot, in the same form as it was
+// returned by the query; nil if the snapshot has no view.
+func (snap *Snapshot) LogResp() *LogRespTotal {
+	if !snap.HasView {
+		return nil
+	}
+
+	return &LogRespTotal{
+		MinuteStats:          snap.MinuteStats,
+		MinuteStatsByLStream: snap.MinuteStatsByLStream,
+		Logs:                 snap.Logs,
+		NumMsgsTotal:         snap.NumMsgsTotal,
+		Approximate:          snap.Approximate,
+		SampleRate:           snap.SampleRate,
+		Groups:               snap.Groups,
+		Warnings:             snap.Warnings,
+		SkippedLStreams:      snap.SkippedLStreams,
+	}
+}
+
+// WriteSnapshot writes the snapshot as JSON.
+func WriteSnapshot(w io.Writer, snap Snapshot) error {
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return errors.Annotatef(err, "writing snapshot")
+	}
+
+	return nil
+}
+
+// ReadSnapshot reads the snapshot written by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, errors.Annotatef(err, "reading snapshot")
+	}
+
+	if snap.Version != snapshotVersion {
+		return nil, errors.Errorf(
+			"unsupported snapshot version %d, only %d is supported", snap.Version, snapshotVersion,
+		)
+	}
+
+	return &snap, nil
+}
+
+// SaveSnapshot writes the snapshot to the file, overwriting it if it exists.
+func SaveSnapshot(path string, snap Snapshot) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := WriteSnapshot(f, snap); err != nil {
+		f.Close()
+		return errors.Annotatef(err, "%s", path)
+	}
+
+	return errors.Trace(f.Close())
+}
+
+// LoadSnapshot reads the snapshot from the file written by SaveSnapshot.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	snap, err := ReadSnapshot(f)
+	if err != nil {
+		return nil, errors.Annotatef(err, "%s", path)
+	}
+
+	return snap, nil
+}
+
+// SnapshotSource serves the queries offline from a Snapshot, with the same
+// signature as Nerdlog.Query, so the snapshot can be viewed the same way as
+// the live logstreams. Since there's nothing to connect to, it can only
+// return the view saved in the snapshot, or a part of it: the query must be
+// the same, and the time range can only be narrowed down. Keep in mind that
+// the snapshot only has the logs which were loaded when it was taken, so a
+// narrower time range might have fewer logs than the histogram shows.
+type SnapshotSource struct {
+	snap *Snapshot
+}
+
+// NewSnapshotSource creates the SnapshotSource serving the given snapshot,
+// which must not be modified afterwards.
+func NewSnapshotSource(snap *Snapshot) *SnapshotSource {
+	return &SnapshotSource{snap: snap}
+}
+
+// Snapshot returns the snapshot being served, e.g. to show its query and time
+// range.
+func (s *SnapshotSource) Snapshot() *Snapshot {
+	return s.snap
+}
+
+// Query returns the view saved in the snapshot, limited to the time range of
+// the params, and to the latest params.MaxNumLines logs if it's not zero. If
+// the params.From or params.To is zero, the one from the snapshot is used.
+// The queries which need any other data fail with ErrSnapshotOffline.
+func (s *SnapshotSource) Query(ctx context.Context, params QueryLogsParams) (*LogRespTotal, error) {
+	snap := s.snap
+
+	if !snap.HasView {
+		return nil, errors.Annotatef(ErrSnapshotOffline, "the snapshot has no logs")
+	}
+
+	if params.LoadEarlier || params.LoadNewer || params.ResumeToken != nil || params.RetrySkipped {
+		return nil, errors.Trace(ErrSnapshotOffline)
+	}
+
+	if !sameSnapshotQuery(snap.Params, params) {
+		return nil, errors.Annotatef(ErrSnapshotOffline, "the query must be the same as in the snapshot, %q", snap.Params.Query)
+	}
+
+	from, to := params.From, params.To
+	if from.IsZero() {
+		from = snap.Params.From
+	}
+	if to.IsZero() {
+		to = snap.Params.To
+	}
+
+	if from.Before(snap.Params.From) || (!snap.Params.To.IsZero() && (to.IsZero() || to.After(snap.Params.To))) {
+		return nil, errors.Annotatef(ErrSnapshotOffline, "the time range must be within the one of the snapshot")
+	}
+
+	resp := snap.LogResp()
+
+	if !from.Equal(snap.Params.From) || !to.Equal(snap.Params.To) {
+		resp.MinuteStats = filterSnapshotMinuteStats(snap.MinuteStats, from, to)
+
+		resp.MinuteStatsByLStream = make(map[string]map[int64]MinuteStatsItem, len(snap.MinuteStatsByLStream))
+		for name, stats := range snap.MinuteStatsByLStream {
+			resp.MinuteStatsByLStream[name] = filterSnapshotMinuteStats(stats, from, to)
+		}
+
+		resp.NumMsgsTotal = 0
+		for _, item := range resp.MinuteStats {
+			resp.NumMsgsTotal += item.NumMsgs
+		}
+
+		resp.Logs = nil
+		for _, msg := range snap.Logs {
+			if msg.Time.Before(from) || (!to.IsZero() && !msg.Time.Before(to)) {
+				continue
+			}
+
+			resp.Logs = append(resp.Logs, msg)
+		}
+
+		// The groups were counted for the whole time range, so they can't be
+		// narrowed down.
+		resp.Groups = nil
+	}
+
+	if params.MaxNumLines > 0 && len(resp.Logs) > params.MaxNumLines {
+		resp.Logs = resp.Logs[len(resp.Logs)-params.MaxNumLines:]
+	}
+
+	return resp, nil
+}
+
+// sameSnapshotQuery returns whether the params are for the same query as the
+// ones of the snapshot, regardless of the time range and the number of lines.
+func sameSnapshotQuery(a, b QueryLogsParams) bool {
+	if a.Query != b.Query ||
+		a.QueryLang != b.QueryLang ||
+		a.FilterIgnoreCase != b.FilterIgnoreCase ||
+		a.FilterWholeWord != b.FilterWholeWord ||
+		a.Select != b.Select ||
+		a.GroupBy != b.GroupBy ||
+		a.SampleRate != b.SampleRate ||
+		len(a.AgentEnv) != len(b.AgentEnv) {
+		return false
+	}
+
+	for k, v := range a.AgentEnv {
+		if bv, ok := b.AgentEnv[k]; !ok || bv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterSnapshotMinuteStats returns the stats for the minutes within the
+// given time range; zero to means no upper limit.
+func filterSnapshotMinuteStats(stats map[int64]MinuteStatsItem, from, to time.Time) map[int64]MinuteStatsItem {
+	ret := make(map[int64]MinuteStatsItem, len(stats))
+	fromKey := from.Truncate(time.Minute).Unix()
+
+	for k, item := range stats {
+		if k < fromKey || (!to.IsZero() && k >= to.Unix()) {
+			continue
+		}
+
+		ret[k] = item
+	}
+
+	return ret
+}
+
+// SnapshotView returns the snapshot of the current view: the last successful
+// query with its logs and histogram, and the logstreams; see Snapshot. If no
+// query has succeeded yet, the snapshot only has the logstreams.
+func (n *Nerdlog) SnapshotView() Snapshot {
+	lstreams := n.lstreamNames()
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return newSnapshot(n.opts.LStreams, lstreams, n.viewParams, n.viewResp, n.opts.Clock.Now())
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotView(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	logs := &fakeLogs{}
+	logs.add(
+		fakeLogLine(now.Add(-2*time.Minute), "foo"),
+		fakeLogLine(now.Add(-1*time.Minute), "bar"),
+	)
+
+	n := newTestNerdlog(t, logs)
+	defer n.Close()
+
+	// Before any query, there's no view to restore.
+	snap := n.SnapshotView()
+	assert.False(t, snap.HasView)
+	_, err := NewSnapshotSource(&snap).Query(context.Background(), QueryLogsParams{})
+	assert.Equal(t, ErrSnapshotOffline, errors.Cause(err))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	params := QueryLogsParams{
+		From:  now.Add(-time.Hour),
+		Query: "/foo|bar/",
+	}
+
+	resp, err := n.Query(ctx, params)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	snap = n.SnapshotView()
+	assert.True(t, snap.HasView)
+	assert.Equal(t, "fake-01,fake-02", snap.LStreams)
+	assert.Equal(t, []string{"fake-01", "fake-02"}, snap.SelectedLStreams)
+
+	// Round-trip the snapshot through the file.
+	fname := filepath.Join(t.TempDir(), "snapshot.json")
+	if !assert.NoError(t, SaveSnapshot(fname, snap)) {
+		return
+	}
+
+	loaded, err := LoadSnapshot(fname)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, snap.LStreams, loaded.LStreams)
+	assert.Equal(t, snap.SelectedLStreams, loaded.SelectedLStreams)
+	assert.Equal(t, "/foo|bar/", loaded.Params.Query)
+	assert.True(t, loaded.Params.From.Equal(params.From))
+	assert.True(t, loaded.CreatedAt.Equal(snap.CreatedAt))
+
+	// The restored view is the same as the one returned by the query.
+	source := NewSnapshotSource(loaded)
+	restored, err := source.Query(ctx, loaded.Params)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, resp.MinuteStats, restored.MinuteStats)
+	assert.Equal(t, resp.MinuteStatsByLStream, restored.MinuteStatsByLStream)
+	assert.Equal(t, resp.NumMsgsTotal, restored.NumMsgsTotal)
+	if assert.Equal(t, len(resp.Logs), len(restored.Logs)) {
+		for i, msg := range resp.Logs {
+			got := restored.Logs[i]
+			assert.True(t, msg.Time.Equal(got.Time), "msg %d", i)
+
+			got.Time = msg.Time
+			assert.Equal(t, msg, got, "msg %d", i)
+		}
+	}
+}
+
+func TestSnapshotSourceQuery(t *testing.T) {
+	t0 := time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC)
+
+	msg := func(minutes int, lstream, text string) LogMsg {
+		return LogMsg{
+			Time:    t0.Add(time.Duration(minutes) * time.Minute),
+			Msg:     text,
+			Context: map[string]string{"lstream": lstream},
+		}
+	}
+
+	snap := Snapshot{
+		Version: snapshotVersion,
+		Params: QueryLogsParams{
+			From:        t0,
+			To:          t0.Add(10 * time.Minute),
+			Query:       "level:error",
+			QueryLang:   QueryLangFilter,
+			GroupBy:     "program",
+			MaxNumLines: 100,
+		},
+		HasView: true,
+		MinuteStats: map[int64]MinuteStatsItem{
+			t0.Unix():                      {NumMsgs: 5},
+			t0.Add(5 * time.Minute).Unix(): {NumMsgs: 2},
+			t0.Add(9 * time.Minute).Unix(): {NumMsgs: 1},
+		},
+		MinuteStatsByLStream: map[string]map[int64]MinuteStatsItem{
+			"web-01": {
+				t0.Unix():                      {NumMsgs: 5},
+				t0.Add(5 * time.Minute).Unix(): {NumMsgs: 2},
+			},
+			"web-02": {
+				t0.Add(9 * time.Minute).Unix(): {NumMsgs: 1},
+			},
+		},
+		Logs: []LogMsg{
+			msg(0, "web-01", "a"),
+			msg(5, "web-01", "b"),
+			msg(5, "web-01", "c"),
+			msg(9, "web-02", "d"),
+		},
+		NumMsgsTotal: 8,
+		Groups:       []Group{{Value: "myapp", Count: 8}},
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, WriteSnapshot(&buf, snap)) {
+		return
+	}
+
+	loaded, err := ReadSnapshot(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	source := NewSnapshotSource(loaded)
+	ctx := context.Background()
+
+	// The whole view.
+	resp, err := source.Query(ctx, QueryLogsParams{Query: "level:error", QueryLang: QueryLangFilter, GroupBy: "program"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 8, resp.NumMsgsTotal)
+		assert.Equal(t, 4, len(resp.Logs))
+		assert.Equal(t, snap.Groups, resp.Groups)
+	}
+
+	// The narrower time range and fewer lines.
+	resp, err = source.Query(ctx, QueryLogsParams{
+		From:        t0.Add(5 * time.Minute),
+		To:          t0.Add(9 * time.Minute),
+		Query:       "level:error",
+		QueryLang:   QueryLangFilter,
+		GroupBy:     "program",
+		MaxNumLines: 1,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[int64]MinuteStatsItem{
+			t0.Add(5 * time.Minute).Unix(): {NumMsgs: 2},
+		}, resp.MinuteStats)
+		assert.Equal(t, map[int64]MinuteStatsItem{}, resp.MinuteStatsByLStream["web-02"])
+		assert.Equal(t, 2, resp.NumMsgsTotal)
+		if assert.Equal(t, 1, len(resp.Logs)) {
+			assert.Equal(t, "c", resp.Logs[0].Msg)
+		}
+		assert.Nil(t, resp.Groups)
+	}
+
+	// Anything which needs more data than the snapshot has.
+	for _, params := range []QueryLogsParams{
+		{Query: "level:warn", QueryLang: QueryLangFilter, GroupBy: "program"},
+		{Query: "level:error", QueryLang: QueryLangFilter},
+		{Query: "level:error", QueryLang: QueryLangFilter, GroupBy: "program", From: t0.Add(-time.Minute)},
+		{Query: "level:error", QueryLang: QueryLangFilter, GroupBy: "program", To: t0.Add(11 * time.Minute)},
+		{Query: "level:error", QueryLang: QueryLangFilter, GroupBy: "program", LoadEarlier: true},
+	} {
+		_, err := source.Query(ctx, params)
+		assert.Equal(t, ErrSnapshotOffline, errors.Cause(err), "params %+v", params)
+	}
+
+	_, err = ReadSnapshot(bytes.NewReader([]byte(`{"version":2}`)))
+	assert.Error(t, err)
+}
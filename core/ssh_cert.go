@@ -0,0 +1,62 @@
+package core
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshCertSuffix is appended to the private key path to get the path of the
+// certificate for it, the same way OpenSSH does: e.g. for the key
+// ~/.ssh/id_ed25519, the certificate is ~/.ssh/id_ed25519-cert.pub.
+const sshCertSuffix = "-cert.pub"
+
+// getSSHCertPath returns the path to the certificate for the given private
+// key: if certPath is not empty, it's used as is, otherwise it's the sibling
+// file with the sshCertSuffix. The returned bool is true if the path was
+// configured explicitly, in which case the file must exist.
+func getSSHCertPath(keyPath, certPath string) (string, bool) {
+	if certPath != "" {
+		return certPath, true
+	}
+
+	return keyPath + sshCertSuffix, false
+}
+
+// loadSSHCertSigner reads the OpenSSH certificate from the given file, and
+// returns the signer which presents this certificate during auth, signing
+// with the given private key signer. The certificate must be issued for the
+// same key.
+func loadSSHCertSigner(signer ssh.Signer, certPath string) (ssh.Signer, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", certPath)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.Errorf("%s is not an ssh certificate", certPath)
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.Errorf("%s is not a user certificate", certPath)
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, errors.Errorf("%s is issued for a different key", certPath)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating signer for %s", certPath)
+	}
+
+	return certSigner, nil
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Identity returns the canonical identity of the ssh connection: after the
+// resolver has applied the ssh config, two logstreams with the same identity
+// (e.g. two different aliases of the same host) connect to the exact same
+// place, so they can share a single ssh connection; see SSHConnPool.
+func (c *ConfigLogStreamShellTransportSSHLib) Identity() string {
+	parts := []string{c.Host.User + "@" + c.Host.Addr}
+
+	for _, jh := range c.Jumphosts {
+		parts = append(parts, "via "+jh.User+"@"+jh.Addr)
+	}
+
+	if c.BindAddress != "" {
+		parts = append(parts, "from "+c.BindAddress)
+	}
+
+	if c.ProxyCommand != "" {
+		parts = append(parts, "via proxy command "+c.ProxyCommand)
+	}
+
+	if c.ProxyURL != "" {
+		parts = append(parts, "via proxy "+redactProxyURL(c.ProxyURL))
+	}
+
+	if c.IdentityFile != "" {
+		parts = append(parts, "with key "+c.IdentityFile)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// SSHConnPool shares ssh connections between the ssh-lib transports which
+// have the same connection identity (see
+// ConfigLogStreamShellTransportSSHLib.Identity): instead of connecting to the
+// same host multiple times, every logstream opens its own session over a
+// single connection. It's safe for concurrent use.
+type SSHConnPool struct {
+	mtx     sync.Mutex
+	entries map[string]*sshConnPoolEntry
+}
+
+type sshConnPoolEntry struct {
+	// mtx is held while dialing, so that concurrent transports with the same
+	// identity wait for the single connection instead of dialing their own.
+	mtx sync.Mutex
+
+	// client is nil if there is no connection yet, or it was closed.
+	client *ssh.Client
+	// refs is the number of the users of the client.
+	refs int
+}
+
+func NewSSHConnPool() *SSHConnPool {
+	return &SSHConnPool{
+		entries: map[string]*sshConnPoolEntry{},
+	}
+}
+
+func (p *SSHConnPool) getEntry(identity string) *sshConnPoolEntry {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	entry := p.entries[identity]
+	if entry == nil {
+		entry = &sshConnPoolEntry{}
+		p.entries[identity] = entry
+	}
+
+	return entry
+}
+
+// acquire returns the shared client for the given identity; if there is no
+// client yet, the dial func is used to create it. Every successful acquire
+// must be followed by either release or discard.
+func (p *SSHConnPool) acquire(
+	identity string, dial func() (*ssh.Client, error),
+) (*ssh.Client, error) {
+	entry := p.getEntry(identity)
+
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+
+	if entry.client == nil {
+		client, err := dial()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		entry.client = client
+		entry.refs = 0
+	}
+
+	entry.refs++
+
+	return entry.client, nil
+}
+
+// release is called when the user doesn't need the client anymore; once
+// there are no more users, the client is closed.
+func (p *SSHConnPool) release(identity string, client *ssh.Client) {
+	entry := p.getEntry(identity)
+
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+
+	if entry.client != client {
+		// This client was already discarded.
+		return
+	}
+
+	entry.refs--
+	if entry.refs <= 0 {
+		entry.client.Close()
+		entry.client = nil
+	}
+}
+
+// discard closes the client right away, and forgets about it, so that the
+// next acquire will dial a new one. It's used when the client turned out to
+// be broken (e.g. the connection was dropped).
+func (p *SSHConnPool) discard(identity string, client *ssh.Client) {
+	entry := p.getEntry(identity)
+
+	entry.mtx.Lock()
+	defer entry.mtx.Unlock()
+
+	client.Close()
+
+	if entry.client == client {
+		entry.client = nil
+		entry.refs = 0
+	}
+}
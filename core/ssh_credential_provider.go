@@ -0,0 +1,268 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ErrNoCredential is returned by a CredentialProvider which has no credential
+// of the requested kind for the host; then that kind of auth is just not
+// offered to the server.
+var ErrNoCredential = errors.New("no credential")
+
+// CredentialProvider provides the credentials for the ssh-lib transport, so
+// that the source of the credentials (like a secrets manager issuing a
+// short-lived key per host) is decoupled from the transport; see
+// ShellTransportSSHLibParams.CredentialProvider.
+//
+// Both methods are called on every connection to the host (or a jumphost),
+// before the ssh handshake, so the implementations are free to fetch the
+// credentials lazily and cache them as they see fit. They must be safe for
+// concurrent use.
+type CredentialProvider interface {
+	// PrivateKeys returns the keys to authenticate to the host with, or
+	// ErrNoCredential. It's a list since e.g. ssh-agent might hold multiple
+	// keys, and the server accepts any of them.
+	PrivateKeys(ctx context.Context, host ConfigHost) ([]ssh.Signer, error)
+
+	// Password returns the password to authenticate to the host with, or
+	// ErrNoCredential. It's only used if the keys are rejected.
+	Password(ctx context.Context, host ConfigHost) (string, error)
+}
+
+// getCredentialProviderAuthMethods returns the auth methods for the host
+// using the credentials from the provider: the keys first, then the password.
+func getCredentialProviderAuthMethods(
+	ctx context.Context, provider CredentialProvider, host ConfigHost,
+) ([]ssh.AuthMethod, error) {
+	var ret []ssh.AuthMethod
+
+	signers, err := provider.PrivateKeys(ctx, host)
+	if err != nil && !errors.Is(err, ErrNoCredential) {
+		return nil, errors.Annotatef(err, "getting private keys for %s@%s", host.User, host.Addr)
+	}
+
+	if len(signers) > 0 {
+		ret = append(ret, ssh.PublicKeys(signers...))
+	}
+
+	password, err := provider.Password(ctx, host)
+	if err != nil && !errors.Is(err, ErrNoCredential) {
+		return nil, errors.Annotatef(err, "getting password for %s@%s", host.User, host.Addr)
+	}
+
+	if err == nil {
+		ret = append(ret, ssh.Password(password))
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.Errorf("credential provider has no credentials for %s@%s", host.User, host.Addr)
+	}
+
+	return ret, nil
+}
+
+// ChainCredentialProvider consults the providers in order, and returns the
+// credentials from the first one which has them.
+type ChainCredentialProvider []CredentialProvider
+
+var _ CredentialProvider = ChainCredentialProvider{}
+
+func (c ChainCredentialProvider) PrivateKeys(ctx context.Context, host ConfigHost) ([]ssh.Signer, error) {
+	for _, p := range c {
+		signers, err := p.PrivateKeys(ctx, host)
+		if errors.Is(err, ErrNoCredential) {
+			continue
+		}
+
+		return signers, err
+	}
+
+	return nil, ErrNoCredential
+}
+
+func (c ChainCredentialProvider) Password(ctx context.Context, host ConfigHost) (string, error) {
+	for _, p := range c {
+		password, err := p.Password(ctx, host)
+		if errors.Is(err, ErrNoCredential) {
+			continue
+		}
+
+		return password, err
+	}
+
+	return "", ErrNoCredential
+}
+
+// AgentCredentialProvider provides all the keys held by the ssh-agent at the
+// SSH_AUTH_SOCK; it has no passwords. If SSH_AUTH_SOCK is not set, it has no
+// keys either.
+type AgentCredentialProvider struct{}
+
+var _ CredentialProvider = AgentCredentialProvider{}
+
+func (AgentCredentialProvider) PrivateKeys(ctx context.Context, host ConfigHost) ([]ssh.Signer, error) {
+	sshAuthSock := os.Getenv("SSH_AUTH_SOCK")
+	if sshAuthSock == "" {
+		return nil, ErrNoCredential
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", sshAuthSock)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connecting to ssh-agent via SSH_AUTH_SOCK")
+	}
+	defer conn.Close()
+
+	// The signers from the agent client need the connection to sign, so the
+	// keys are only listed here, and every one of them connects on its own
+	// when it's actually used.
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, errors.Annotatef(err, "listing ssh-agent keys")
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoCredential
+	}
+
+	signers := make([]ssh.Signer, 0, len(keys))
+	for _, key := range keys {
+		signers = append(signers, &agentKeySigner{sock: sshAuthSock, key: key})
+	}
+
+	return signers, nil
+}
+
+func (AgentCredentialProvider) Password(ctx context.Context, host ConfigHost) (string, error) {
+	return "", ErrNoCredential
+}
+
+// agentKeySigner signs with the key held by the ssh-agent, connecting to the
+// agent for every signature.
+type agentKeySigner struct {
+	sock string
+	key  *agent.Key
+}
+
+func (s *agentKeySigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	conn, err := net.Dial("unix", s.sock)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connecting to ssh-agent via SSH_AUTH_SOCK")
+	}
+	defer conn.Close()
+
+	return agent.NewClient(conn).Sign(s.key, data)
+}
+
+// FileCredentialProvider provides the private key from the file, the same
+// one for all hosts; it has no passwords. The key can't be
+// passphrase-protected, unless the Passphrase is given.
+type FileCredentialProvider struct {
+	Path       string
+	Passphrase string
+}
+
+var _ CredentialProvider = FileCredentialProvider{}
+
+func (p FileCredentialProvider) PrivateKeys(ctx context.Context, host ConfigHost) ([]ssh.Signer, error) {
+	keyData, err := os.ReadFile(expandHomeDir(p.Path))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	signer, err := parsePrivateKey(keyData, p.Passphrase)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing private key from %s", p.Path)
+	}
+
+	return []ssh.Signer{signer}, nil
+}
+
+func (p FileCredentialProvider) Password(ctx context.Context, host ConfigHost) (string, error) {
+	return "", ErrNoCredential
+}
+
+// EnvCredentialProvider provides the private key and the password from the
+// env vars, the same ones for all hosts, e.g. for CI jobs which get the
+// secrets as env vars. The key is in the PEM format, like the contents of the
+// ~/.ssh/id_ed25519 file. If some var is empty or not set, there is no such
+// credential.
+type EnvCredentialProvider struct {
+	// KeyVar is the name of the env var with the private key, and
+	// PassphraseVar (optional) is the one with its passphrase.
+	KeyVar        string
+	PassphraseVar string
+
+	// PasswordVar is the name of the env var with the password.
+	PasswordVar string
+}
+
+var _ CredentialProvider = EnvCredentialProvider{}
+
+func (p EnvCredentialProvider) PrivateKeys(ctx context.Context, host ConfigHost) ([]ssh.Signer, error) {
+	keyData := getEnvIfNamed(p.KeyVar)
+	if keyData == "" {
+		return nil, ErrNoCredential
+	}
+
+	signer, err := parsePrivateKey([]byte(keyData), getEnvIfNamed(p.PassphraseVar))
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing private key from the %s env var", p.KeyVar)
+	}
+
+	return []ssh.Signer{signer}, nil
+}
+
+func (p EnvCredentialProvider) Password(ctx context.Context, host ConfigHost) (string, error) {
+	password := getEnvIfNamed(p.PasswordVar)
+	if password == "" {
+		return "", ErrNoCredential
+	}
+
+	return password, nil
+}
+
+// getEnvIfNamed returns the value of the env var, or an empty string if the
+// name is empty.
+func getEnvIfNamed(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	return os.Getenv(name)
+}
+
+// parsePrivateKey parses the private key, decrypting it with the passphrase
+// if it's not empty.
+func parsePrivateKey(keyData []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+		return signer, errors.Trace(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, errors.Errorf("the key is passphrase-protected, but no passphrase is given")
+	}
+
+	return signer, errors.Trace(err)
+}
+
+// credentialProviderDescr returns the human-readable description of the
+// provider for the logs and the error messages.
+func credentialProviderDescr(provider CredentialProvider) string {
+	return fmt.Sprintf("using credential provider %s", strings.TrimPrefix(fmt.Sprintf("%T", provider), "*"))
+}
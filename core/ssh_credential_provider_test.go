@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core/testutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeCredentialProvider returns the given credentials, and records the hosts
+// it was asked about.
+type fakeCredentialProvider struct {
+	signers  []ssh.Signer
+	password string
+
+	mtx   sync.Mutex
+	hosts []ConfigHost
+}
+
+func (p *fakeCredentialProvider) PrivateKeys(ctx context.Context, host ConfigHost) ([]ssh.Signer, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.hosts = append(p.hosts, host)
+
+	if len(p.signers) == 0 {
+		return nil, ErrNoCredential
+	}
+
+	return p.signers, nil
+}
+
+func (p *fakeCredentialProvider) Password(ctx context.Context, host ConfigHost) (string, error) {
+	if p.password == "" {
+		return "", ErrNoCredential
+	}
+
+	return p.password, nil
+}
+
+func connectSSHLibWithProvider(srv *testutils.SSHServer, keyPath string, provider CredentialProvider) ShellConnResult {
+	return connectTransport(NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys:            []string{keyPath},
+		CredentialProvider: provider,
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: srv.Addr(),
+				User: "nerdlog",
+			},
+		},
+	}))
+}
+
+func assertShellWorks(t *testing.T, res ShellConnResult) {
+	t.Helper()
+
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", line)
+}
+
+func TestShellTransportSSHLibCredentialProviderKey(t *testing.T) {
+	resetSSHAuthMethodShared(t)
+
+	signer, _, err := testutils.GenerateSSHKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	srv, err := testutils.NewSSHServer(testutils.SSHServerParams{
+		User:           "nerdlog",
+		AuthorizedKeys: []ssh.PublicKey{signer.PublicKey()},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+
+	// The key from SSHKeys is not authorized on the server, so the connection
+	// only succeeds if the key from the provider is used.
+	otherKeyPath, _, err := testutils.WriteSSHKey(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	provider := &fakeCredentialProvider{signers: []ssh.Signer{signer}}
+	assertShellWorks(t, connectSSHLibWithProvider(srv, otherKeyPath, provider))
+
+	assert.Equal(t, []ConfigHost{{Addr: srv.Addr(), User: "nerdlog"}}, provider.hosts)
+}
+
+func TestShellTransportSSHLibCredentialProviderPassword(t *testing.T) {
+	resetSSHAuthMethodShared(t)
+
+	srv, err := testutils.NewSSHServer(testutils.SSHServerParams{
+		User:     "nerdlog",
+		Password: "secret",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+
+	otherKeyPath, _, err := testutils.WriteSSHKey(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res := connectSSHLibWithProvider(srv, otherKeyPath, &fakeCredentialProvider{password: "wrong"})
+	assert.ErrorIs(t, res.Err, ErrAuthFailed)
+
+	assertShellWorks(t, connectSSHLibWithProvider(srv, otherKeyPath, &fakeCredentialProvider{password: "secret"}))
+}
+
+func TestShellTransportSSHLibCredentialProviderNone(t *testing.T) {
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, t.TempDir())
+	defer srv.Close()
+
+	// Even though the key from SSHKeys would work, the provider takes over.
+	res := connectSSHLibWithProvider(srv, keyPath, ChainCredentialProvider{
+		AgentCredentialProvider{},
+		EnvCredentialProvider{KeyVar: "NERDLOG_TEST_UNSET_KEY"},
+	})
+	if assert.Error(t, res.Err) {
+		assert.Contains(t, res.Err.Error(), "credential provider has no credentials for nerdlog@")
+	}
+}
+
+func TestEnvCredentialProvider(t *testing.T) {
+	signer, keyData, err := testutils.GenerateSSHKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Setenv("NERDLOG_TEST_KEY", string(keyData))
+	t.Setenv("NERDLOG_TEST_PASSWORD", "secret")
+
+	p := EnvCredentialProvider{KeyVar: "NERDLOG_TEST_KEY", PasswordVar: "NERDLOG_TEST_PASSWORD"}
+	host := ConfigHost{Addr: "localhost:22", User: "nerdlog"}
+
+	signers, err := p.PrivateKeys(context.Background(), host)
+	if assert.NoError(t, err) && assert.Len(t, signers, 1) {
+		assert.Equal(t, signer.PublicKey().Marshal(), signers[0].PublicKey().Marshal())
+	}
+
+	password, err := p.Password(context.Background(), host)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", password)
+
+	t.Setenv("NERDLOG_TEST_PASSWORD", "")
+	_, err = p.Password(context.Background(), host)
+	assert.ErrorIs(t, err, ErrNoCredential)
+
+	_, err = EnvCredentialProvider{}.PrivateKeys(context.Background(), host)
+	assert.ErrorIs(t, err, ErrNoCredential)
+}
+
+func TestFileCredentialProvider(t *testing.T) {
+	keyPath, signer, err := testutils.WriteSSHKey(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	p := ChainCredentialProvider{
+		EnvCredentialProvider{KeyVar: "NERDLOG_TEST_UNSET_KEY"},
+		FileCredentialProvider{Path: keyPath},
+	}
+	host := ConfigHost{Addr: "localhost:22", User: "nerdlog"}
+
+	signers, err := p.PrivateKeys(context.Background(), host)
+	if assert.NoError(t, err) && assert.Len(t, signers, 1) {
+		assert.Equal(t, signer.PublicKey().Marshal(), signers[0].PublicKey().Marshal())
+	}
+
+	_, err = p.Password(context.Background(), host)
+	assert.ErrorIs(t, err, ErrNoCredential)
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy specifies how the ssh-lib transport verifies host keys.
+type HostKeyPolicy string
+
+const (
+	// HostKeyPolicyInsecure means that host keys are not verified at all.
+	HostKeyPolicyInsecure HostKeyPolicy = "insecure"
+
+	// HostKeyPolicyStrict means that the host key must be present in one of the
+	// known_hosts files, otherwise the connection fails.
+	HostKeyPolicyStrict HostKeyPolicy = "strict"
+
+	// HostKeyPolicyAcceptNew is like the accept-new in OpenSSH's
+	// StrictHostKeyChecking: keys of unknown hosts are accepted (and
+	// remembered), but if the host is known and the key doesn't match, the
+	// connection fails.
+	HostKeyPolicyAcceptNew HostKeyPolicy = "accept-new"
+)
+
+// ParseHostKeyPolicy parses a string like "accept-new" as a HostKeyPolicy.
+func ParseHostKeyPolicy(s string) (HostKeyPolicy, error) {
+	switch HostKeyPolicy(s) {
+	case HostKeyPolicyInsecure, HostKeyPolicyStrict, HostKeyPolicyAcceptNew:
+		return HostKeyPolicy(s), nil
+	}
+
+	return "", errors.Errorf(
+		"invalid host key policy %q; valid options are: %s, %s, %s",
+		s, HostKeyPolicyInsecure, HostKeyPolicyStrict, HostKeyPolicyAcceptNew,
+	)
+}
+
+// HostKeys verifies ssh host keys accordingly to the policy, and remembers
+// the keys of the new hosts accepted during the session. It's shared between
+// all the ssh-lib transports, and is safe for concurrent use.
+type HostKeys struct {
+	params HostKeysParams
+
+	mtx sync.Mutex
+
+	// accepted contains the keys accepted during the session, keyed by the
+	// normalized address (as returned by knownhosts.Normalize).
+	accepted map[string][]ssh.PublicKey
+}
+
+type HostKeysParams struct {
+	Policy HostKeyPolicy
+
+	// KnownHostsFiles are the files in the OpenSSH known_hosts format to check
+	// the host keys against, like ~/.ssh/known_hosts. Files which don't exist
+	// are ignored.
+	KnownHostsFiles []string
+
+	// AcceptedKeysFile is the file where the keys accepted with the accept-new
+	// policy are appended to, so that next time the check is strict. Normally
+	// it's one of the KnownHostsFiles. If empty, the accepted keys are only
+	// kept in memory until nerdlog exits.
+	AcceptedKeysFile string
+}
+
+func NewHostKeys(params HostKeysParams) *HostKeys {
+	return &HostKeys{
+		params:   params,
+		accepted: map[string][]ssh.PublicKey{},
+	}
+}
+
+// HostKeyCallback returns the callback to use in the ssh.ClientConfig.
+func (hk *HostKeys) HostKeyCallback() ssh.HostKeyCallback {
+	if hk.params.Policy == HostKeyPolicyInsecure {
+		return ssh.InsecureIgnoreHostKey()
+	}
+
+	return hk.checkHostKey
+}
+
+func (hk *HostKeys) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	// We hold the mutex during the whole check, so that if multiple
+	// logstreams on the same host are connecting concurrently, the key is only
+	// accepted once.
+	hk.mtx.Lock()
+	defer hk.mtx.Unlock()
+
+	address := knownhosts.Normalize(hostname)
+
+	if acceptedKeys, ok := hk.accepted[address]; ok {
+		for _, k := range acceptedKeys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+
+		return errors.Errorf(
+			"host key mismatch for %s: got %s %s, which differs from the one accepted earlier",
+			hostname, key.Type(), ssh.FingerprintSHA256(key),
+		)
+	}
+
+	err := hk.checkKnownHosts(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+		// Either the key is revoked, or it doesn't match the one in the
+		// known_hosts, or something else went wrong; never accept it.
+		return errors.Annotatef(err, "checking host key for %s", hostname)
+	}
+
+	// The host is unknown.
+	if hk.params.Policy != HostKeyPolicyAcceptNew {
+		return errors.Errorf(
+			"host key for %s (%s %s) is unknown; add it to the known_hosts, or use the %s host key policy",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), HostKeyPolicyAcceptNew,
+		)
+	}
+
+	if hk.params.AcceptedKeysFile != "" {
+		line := knownhosts.Line([]string{address}, key)
+		if err := appendLineToFile(hk.params.AcceptedKeysFile, line); err != nil {
+			return errors.Annotatef(err, "saving host key for %s", hostname)
+		}
+	}
+
+	hk.accepted[address] = append(hk.accepted[address], key)
+
+	return nil
+}
+
+// checkKnownHosts checks the key against the known_hosts files. The files are
+// read every time, so that the changes made by other nerdlog instances are
+// taken into account.
+func (hk *HostKeys) checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	var files []string
+	for _, f := range hk.params.KnownHostsFiles {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+
+	if len(files) == 0 {
+		// No files to check against, so the host is unknown.
+		return &knownhosts.KeyError{}
+	}
+
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return errors.Annotatef(err, "reading known hosts")
+	}
+
+	return cb(hostname, remote, key)
+}
+
+// appendLineToFile appends the line to the file with a single O_APPEND
+// write, under the file lock (see lockFile), so that the lines appended
+// concurrently by OpenSSH or other nerdlog instances are never lost; and
+// since the file is never replaced, a symlinked file stays a symlink.
+func appendLineToFile(path, line string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Annotatef(err, "creating dir %s", dir)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Annotatef(err, "opening %s", path)
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return errors.Annotatef(err, "locking %s", path)
+	}
+
+	data := []byte(line + "\n")
+
+	// If the file doesn't end with a newline, add one, so that the line
+	// doesn't get glued to the last one.
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Annotatef(err, "stat %s", path)
+	}
+
+	if size := fi.Size(); size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, size-1); err != nil {
+			return errors.Annotatef(err, "reading %s", path)
+		}
+
+		if last[0] != '\n' {
+			data = append([]byte("\n"), data...)
+		}
+	}
+
+	if _, err := f.Write(data); err != nil {
+		return errors.Annotatef(err, "writing %s", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+var testRemoteAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func TestHostKeysAcceptNewPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_host_keys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, ".ssh", "known_hosts")
+
+	key := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+
+	hk := NewHostKeys(HostKeysParams{
+		Policy:           HostKeyPolicyAcceptNew,
+		KnownHostsFiles:  []string{knownHostsPath},
+		AcceptedKeysFile: knownHostsPath,
+	})
+	cb := hk.HostKeyCallback()
+
+	// New host is accepted and written to the file.
+	assert.NoError(t, cb("web-01:22", testRemoteAddr, key))
+	assert.NoError(t, cb("web-01:22", testRemoteAddr, key))
+
+	data, err := ioutil.ReadFile(knownHostsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+	assert.Contains(t, string(data), "web-01 ssh-ed25519 ")
+
+	// Changed key for the known host is rejected.
+	assert.Error(t, cb("web-01:22", testRemoteAddr, otherKey))
+
+	// Next run, with the strict policy, is happy with the persisted key.
+	hk = NewHostKeys(HostKeysParams{
+		Policy:          HostKeyPolicyStrict,
+		KnownHostsFiles: []string{knownHostsPath},
+	})
+	cb = hk.HostKeyCallback()
+
+	assert.NoError(t, cb("web-01:22", testRemoteAddr, key))
+	assert.Error(t, cb("web-01:22", testRemoteAddr, otherKey))
+	assert.Error(t, cb("web-02:22", testRemoteAddr, key))
+
+	// Non-standard ports are recorded as [host]:port.
+	hk = NewHostKeys(HostKeysParams{
+		Policy:           HostKeyPolicyAcceptNew,
+		KnownHostsFiles:  []string{knownHostsPath},
+		AcceptedKeysFile: knownHostsPath,
+	})
+	assert.NoError(t, hk.HostKeyCallback()("web-02:2222", testRemoteAddr, otherKey))
+
+	data, err = ioutil.ReadFile(knownHostsPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "[web-02]:2222 ssh-ed25519 ")
+}
+
+func TestHostKeysAcceptNewInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_host_keys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+
+	key := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+
+	hk := NewHostKeys(HostKeysParams{
+		Policy:          HostKeyPolicyAcceptNew,
+		KnownHostsFiles: []string{knownHostsPath},
+	})
+	cb := hk.HostKeyCallback()
+
+	assert.NoError(t, cb("web-01:22", testRemoteAddr, key))
+	assert.NoError(t, cb("web-01:22", testRemoteAddr, key))
+	assert.Error(t, cb("web-01:22", testRemoteAddr, otherKey))
+
+	_, err = os.Stat(knownHostsPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHostKeysAcceptNewConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_host_keys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+
+	const numHosts = 20
+	keys := make([]ssh.PublicKey, numHosts)
+	for i := range keys {
+		keys[i] = newTestHostKey(t)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numHosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Every host is accepted by a separate instance, like if those were
+			// separate nerdlog processes, so the lines are only preserved thanks
+			// to the appending.
+			hk := NewHostKeys(HostKeysParams{
+				Policy:           HostKeyPolicyAcceptNew,
+				KnownHostsFiles:  []string{knownHostsPath},
+				AcceptedKeysFile: knownHostsPath,
+			})
+			assert.NoError(t, hk.HostKeyCallback()(fmt.Sprintf("host-%d:22", i), testRemoteAddr, keys[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	hk := NewHostKeys(HostKeysParams{
+		Policy:          HostKeyPolicyStrict,
+		KnownHostsFiles: []string{knownHostsPath},
+	})
+	cb := hk.HostKeyCallback()
+
+	for i := 0; i < numHosts; i++ {
+		assert.NoError(t, cb(fmt.Sprintf("host-%d:22", i), testRemoteAddr, keys[i]))
+	}
+}
+
+func TestHostKeysAcceptNewSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nerdlog_host_keys")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// The known_hosts is a symlink, e.g. to a dotfiles repo, and it doesn't
+	// end with a newline.
+	realPath := filepath.Join(dir, "dotfiles_known_hosts")
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+
+	existingLine := "other-host ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKqaGNOaN/1ahdpEmMmWCFsNa6AN3aJbjGbXp7dZRkpm"
+	if err := ioutil.WriteFile(realPath, []byte(existingLine), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realPath, knownHostsPath); err != nil {
+		t.Fatal(err)
+	}
+
+	hk := NewHostKeys(HostKeysParams{
+		Policy:           HostKeyPolicyAcceptNew,
+		KnownHostsFiles:  []string{knownHostsPath},
+		AcceptedKeysFile: knownHostsPath,
+	})
+	assert.NoError(t, hk.HostKeyCallback()("web-01:22", testRemoteAddr, newTestHostKey(t)))
+
+	fi, err := os.Lstat(knownHostsPath)
+	if assert.NoError(t, err) {
+		assert.True(t, fi.Mode()&os.ModeSymlink != 0, "known_hosts is not a symlink anymore")
+	}
+
+	data, err := ioutil.ReadFile(realPath)
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if assert.Len(t, lines, 2) {
+			assert.Equal(t, existingLine, lines[0])
+			assert.True(t, strings.HasPrefix(lines[1], "web-01 "), lines[1])
+		}
+	}
+}
+
+func TestParseHostKeyPolicy(t *testing.T) {
+	policy, err := ParseHostKeyPolicy("accept-new")
+	assert.NoError(t, err)
+	assert.Equal(t, HostKeyPolicyAcceptNew, policy)
+
+	_, err = ParseHostKeyPolicy("yes")
+	assert.Error(t, err)
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHPKCS11 specifies the PKCS#11 token (like a YubiKey, a smart card or an
+// HSM) to authenticate with when using the ssh-lib transport: the private keys
+// never leave the token, which signs the ssh auth challenge itself.
+type SSHPKCS11 struct {
+	// Provider is the path to the PKCS#11 module of the token, like
+	// /usr/lib/x86_64-linux-gnu/opensc-pkcs11.so.
+	Provider string
+
+	// Slot is the ID of the slot containing the token.
+	Slot uint
+}
+
+func (p SSHPKCS11) String() string {
+	return fmt.Sprintf("PKCS#11 token in slot %d of %s", p.Slot, p.Provider)
+}
+
+// getPKCS11AuthMethod opens the PKCS#11 token, asks the user for the PIN via
+// the ShellConnDataRequest, and returns the auth method which signs with all
+// the supported (RSA and ECDSA) keys found on the token.
+//
+// The token session stays open, since the auth method is shared by all the
+// connections.
+func getPKCS11AuthMethod(
+	ctx context.Context, cfg SSHPKCS11, resCh chan<- ShellConnUpdate, logger *log.Logger,
+) (*AuthMethodWMeta, error) {
+	logger.Infof("Using %s", cfg)
+
+	token, err := openPKCS11Token(cfg)
+	if err != nil {
+		return nil, errors.Annotatef(err, "opening %s", cfg)
+	}
+
+	pinCh := make(chan string, 1)
+
+	resCh <- ShellConnUpdate{
+		DataRequest: &ShellConnDataRequest{
+			Title:      "PKCS#11 token PIN",
+			Message:    fmt.Sprintf("Please enter the PIN for the %s.", cfg),
+			DataKind:   ShellConnDataKindPassword,
+			ResponseCh: pinCh,
+		},
+	}
+
+	// Wait for the client code to provide the PIN, or for the connection to be
+	// cancelled (e.g. the user is exiting the app). Like with the key
+	// passphrase, there are no retries here, since the whole connection is
+	// retried, and we'll ask for the PIN again.
+	var pin string
+	select {
+	case pin = <-pinCh:
+	case <-ctx.Done():
+		token.close()
+		return nil, errors.Trace(ctx.Err())
+	}
+
+	if err := token.login(pin); err != nil {
+		token.close()
+		return nil, errors.Annotatef(err, "logging in to %s", cfg)
+	}
+
+	signers, err := token.signers()
+	if err != nil {
+		token.close()
+		return nil, errors.Annotatef(err, "getting keys from %s", cfg)
+	}
+
+	return &AuthMethodWMeta{
+		AuthMethod: ssh.PublicKeys(signers...),
+		Descr:      fmt.Sprintf("using %s", cfg),
+	}, nil
+}
+
+// rsaDigestInfoPrefixes are the DER-encoded DigestInfo prefixes for the
+// hashes which ssh uses with RSA keys: the token only does the raw PKCS#1
+// v1.5 padding (CKM_RSA_PKCS), so the DigestInfo has to be prepended to the
+// digest before signing. See RFC 8017, section 9.2.
+var rsaDigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
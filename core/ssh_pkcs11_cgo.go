@@ -0,0 +1,318 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+// pkcs11Token is the open session with the PKCS#11 token.
+type pkcs11Token struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+
+	// mtx guards the session, since PKCS#11 doesn't allow concurrent
+	// operations in the same session, and the signing is a two-step one
+	// (SignInit, then Sign).
+	mtx sync.Mutex
+}
+
+// openPKCS11Token loads the provider module and opens a session with the
+// token in the configured slot.
+func openPKCS11Token(cfg SSHPKCS11) (*pkcs11Token, error) {
+	p := pkcs11.New(cfg.Provider)
+	if p == nil {
+		return nil, errors.Errorf("failed to load PKCS#11 provider %s", cfg.Provider)
+	}
+
+	if err := p.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		p.Destroy()
+		return nil, errors.Annotatef(err, "initializing PKCS#11 provider")
+	}
+
+	session, err := p.OpenSession(cfg.Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		p.Finalize()
+		p.Destroy()
+		return nil, errors.Annotatef(err, "opening session on slot %d", cfg.Slot)
+	}
+
+	return &pkcs11Token{
+		ctx:     p,
+		session: session,
+	}, nil
+}
+
+func (t *pkcs11Token) login(pin string) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	err := t.ctx.Login(t.session, pkcs11.CKU_USER, pin)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (t *pkcs11Token) close() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.ctx.CloseSession(t.session)
+	t.ctx.Finalize()
+	t.ctx.Destroy()
+}
+
+// signers returns the ssh signers for all the RSA and ECDSA private keys on
+// the token; other keys are ignored. It's an error if there are no such keys.
+func (t *pkcs11Token) signers() ([]ssh.Signer, error) {
+	var ret []ssh.Signer
+
+	rsaKeys, err := t.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "finding RSA keys")
+	}
+
+	for _, obj := range rsaKeys {
+		pub, err := t.rsaPublicKey(obj)
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting RSA public key")
+		}
+
+		signer, err := ssh.NewSignerFromSigner(&pkcs11Signer{token: t, obj: obj, pub: pub})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ret = append(ret, signer)
+	}
+
+	ecKeys, err := t.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "finding ECDSA keys")
+	}
+
+	for _, obj := range ecKeys {
+		pub, err := t.ecdsaPublicKey(obj)
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting ECDSA public key")
+		}
+
+		signer, err := ssh.NewSignerFromSigner(&pkcs11Signer{token: t, obj: obj, pub: pub})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ret = append(ret, signer)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.Errorf("no RSA or ECDSA private keys found")
+	}
+
+	return ret, nil
+}
+
+func (t *pkcs11Token) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if err := t.ctx.FindObjectsInit(t.session, template); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer t.ctx.FindObjectsFinal(t.session)
+
+	var ret []pkcs11.ObjectHandle
+	for {
+		objs, _, err := t.ctx.FindObjects(t.session, 16)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if len(objs) == 0 {
+			return ret, nil
+		}
+
+		ret = append(ret, objs...)
+	}
+}
+
+func (t *pkcs11Token) getAttributes(obj pkcs11.ObjectHandle, types ...uint) ([][]byte, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	template := make([]*pkcs11.Attribute, 0, len(types))
+	for _, typ := range types {
+		template = append(template, pkcs11.NewAttribute(typ, nil))
+	}
+
+	attrs, err := t.ctx.GetAttributeValue(t.session, obj, template)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := make([][]byte, 0, len(attrs))
+	for _, attr := range attrs {
+		ret = append(ret, attr.Value)
+	}
+
+	return ret, nil
+}
+
+// rsaPublicKey returns the public key of the given RSA private key: unlike
+// with EC keys, the private key object itself has the public parts.
+func (t *pkcs11Token) rsaPublicKey(obj pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	attrs, err := t.getAttributes(obj, pkcs11.CKA_MODULUS, pkcs11.CKA_PUBLIC_EXPONENT)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	exp := new(big.Int).SetBytes(attrs[1])
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, errors.Errorf("invalid public exponent")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0]),
+		E: int(exp.Int64()),
+	}, nil
+}
+
+// pkcs11ECCurves maps the DER-encoded curve OIDs, as found in CKA_EC_PARAMS,
+// to the curves.
+var pkcs11ECCurves = map[string]elliptic.Curve{
+	"\x06\x08\x2a\x86\x48\xce\x3d\x03\x01\x07": elliptic.P256(),
+	"\x06\x05\x2b\x81\x04\x00\x22":             elliptic.P384(),
+	"\x06\x05\x2b\x81\x04\x00\x23":             elliptic.P521(),
+}
+
+// ecdsaPublicKey returns the public key of the given EC private key, which
+// is taken from the public key object with the same CKA_ID.
+func (t *pkcs11Token) ecdsaPublicKey(obj pkcs11.ObjectHandle) (*ecdsa.PublicKey, error) {
+	attrs, err := t.getAttributes(obj, pkcs11.CKA_ID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	pubObjs, err := t.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[0]),
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(pubObjs) == 0 {
+		return nil, errors.Errorf("no public key object with the id %x", attrs[0])
+	}
+
+	attrs, err = t.getAttributes(pubObjs[0], pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	curve, ok := pkcs11ECCurves[string(attrs[0])]
+	if !ok {
+		return nil, errors.Errorf("unsupported curve %x", attrs[0])
+	}
+
+	// The point is supposed to be DER-encoded as an octet string, but some
+	// providers return it raw.
+	point := attrs[1]
+	var rawPoint []byte
+	if rest, err := asn1.Unmarshal(point, &rawPoint); err == nil && len(rest) == 0 {
+		point = rawPoint
+	}
+
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, errors.Errorf("invalid EC point")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (t *pkcs11Token) sign(obj pkcs11.ObjectHandle, mechanism uint, data []byte) ([]byte, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if err := t.ctx.SignInit(t.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, obj); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sig, err := t.ctx.Sign(t.session, data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return sig, nil
+}
+
+// pkcs11Signer is the crypto.Signer backed by the private key on the token.
+type pkcs11Signer struct {
+	token *pkcs11Token
+	obj   pkcs11.ObjectHandle
+	pub   crypto.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := rsaDigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, errors.Errorf("unsupported hash %s", opts.HashFunc())
+		}
+
+		data := make([]byte, 0, len(prefix)+len(digest))
+		data = append(data, prefix...)
+		data = append(data, digest...)
+
+		return s.token.sign(s.obj, pkcs11.CKM_RSA_PKCS, data)
+
+	case *ecdsa.PublicKey:
+		sig, err := s.token.sign(s.obj, pkcs11.CKM_ECDSA, digest)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// The token returns r and s concatenated, but crypto.Signer is expected
+		// to return them ASN.1-encoded.
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return nil, errors.Errorf("invalid ECDSA signature length %d", len(sig))
+		}
+
+		half := len(sig) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			R: new(big.Int).SetBytes(sig[:half]),
+			S: new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+
+	return nil, errors.Errorf("unsupported key type %T", s.pub)
+}
@@ -0,0 +1,27 @@
+//go:build !cgo
+// +build !cgo
+
+package core
+
+import (
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// pkcs11Token is not supported without cgo, since loading the PKCS#11
+// provider module requires it.
+type pkcs11Token struct{}
+
+func openPKCS11Token(cfg SSHPKCS11) (*pkcs11Token, error) {
+	return nil, errors.Errorf("PKCS#11 is not supported: nerdlog is built without cgo")
+}
+
+func (t *pkcs11Token) login(pin string) error {
+	return errors.Errorf("PKCS#11 is not supported")
+}
+
+func (t *pkcs11Token) close() {}
+
+func (t *pkcs11Token) signers() ([]ssh.Signer, error) {
+	return nil, errors.Errorf("PKCS#11 is not supported")
+}
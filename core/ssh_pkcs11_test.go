@@ -0,0 +1,323 @@
+//go:build cgo
+// +build cgo
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core/testutils"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	softHSMTokenLabel = "nerdlog"
+	softHSMPIN        = "1234"
+)
+
+// softHSMLibPaths are the usual locations of the SoftHSM library; the
+// SOFTHSM2_LIB env var, if set, takes precedence.
+var softHSMLibPaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// newSoftHSMToken initializes a fresh SoftHSM token in a temp dir, imports
+// the given keys into it, and returns the config to use it. If SoftHSM isn't
+// installed, the test is skipped.
+func newSoftHSMToken(t *testing.T, keys ...crypto.Signer) SSHPKCS11 {
+	lib := os.Getenv("SOFTHSM2_LIB")
+	if lib == "" {
+		for _, p := range softHSMLibPaths {
+			if _, err := os.Stat(p); err == nil {
+				lib = p
+				break
+			}
+		}
+	}
+
+	if lib == "" {
+		t.Skip("SoftHSM library not found; set SOFTHSM2_LIB")
+	}
+
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokenDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	confPath := filepath.Join(dir, "softhsm2.conf")
+	conf := fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokenDir)
+	if err := os.WriteFile(confPath, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", confPath)
+
+	runSoftHSMUtil(t, "--init-token", "--free", "--label", softHSMTokenLabel, "--pin", softHSMPIN, "--so-pin", "123456")
+
+	for i, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyPath := filepath.Join(dir, fmt.Sprintf("key%d.pem", i))
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		runSoftHSMUtil(t,
+			"--import", keyPath, "--token", softHSMTokenLabel, "--pin", softHSMPIN,
+			"--label", fmt.Sprintf("key%d", i), "--id", fmt.Sprintf("%02x", i+1),
+		)
+	}
+
+	// The token gets a new slot ID when initialized, so look it up.
+	p := pkcs11.New(lib)
+	if p == nil {
+		t.Fatalf("failed to load %s", lib)
+	}
+	defer p.Destroy()
+
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Finalize()
+
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err == nil && info.Label == softHSMTokenLabel {
+			return SSHPKCS11{Provider: lib, Slot: slot}
+		}
+	}
+
+	t.Fatalf("token %s not found", softHSMTokenLabel)
+	return SSHPKCS11{}
+}
+
+func runSoftHSMUtil(t *testing.T, args ...string) {
+	out, err := exec.Command("softhsm2-util", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("softhsm2-util %v: %s: %s", args, err, out)
+	}
+}
+
+// connectSSHLibPKCS11 connects to the server using ShellTransportSSHLib with
+// the PKCS#11 token, answering the PIN request with the given PIN.
+func connectSSHLibPKCS11(srv *testutils.SSHServer, cfg SSHPKCS11, pin string) (ShellConnResult, int) {
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		PKCS11: &cfg,
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: srv.Addr(),
+				User: "nerdlog",
+			},
+		},
+	})
+
+	resCh := make(chan ShellConnUpdate, 1)
+	transport.Connect(context.Background(), resCh)
+
+	numPINRequests := 0
+	for upd := range resCh {
+		if upd.DataRequest != nil {
+			numPINRequests++
+			upd.DataRequest.ResponseCh <- pin
+		}
+
+		if upd.Result != nil {
+			return *upd.Result, numPINRequests
+		}
+	}
+
+	panic("not reached")
+}
+
+func TestPKCS11SignChallenge(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newSoftHSMToken(t, ecKey, rsaKey)
+
+	token, err := openPKCS11Token(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.close()
+
+	// Without logging in, the private keys aren't visible.
+	_, err = token.signers()
+	assert.Error(t, err)
+
+	assert.Error(t, token.login("wrong"))
+	if !assert.NoError(t, token.login(softHSMPIN)) {
+		return
+	}
+
+	signers, err := token.signers()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	wantPubs := map[string]bool{}
+	for _, key := range []crypto.Signer{ecKey, rsaKey} {
+		pub, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPubs[string(pub.Marshal())] = true
+	}
+
+	assert.Equal(t, 2, len(signers))
+
+	challenge := []byte("nerdlog ssh challenge")
+	for _, signer := range signers {
+		pub := signer.PublicKey()
+		assert.True(t, wantPubs[string(pub.Marshal())], "unexpected key %s", pub.Type())
+
+		sig, err := signer.Sign(rand.Reader, challenge)
+		if !assert.NoError(t, err, pub.Type()) {
+			continue
+		}
+		assert.NoError(t, pub.Verify(challenge, sig), pub.Type())
+		assert.Error(t, pub.Verify(bytes.ToUpper(challenge), sig), pub.Type())
+
+		// The RSA keys are used with SHA-2 by the modern servers.
+		if algSigner, ok := signer.(ssh.AlgorithmSigner); ok && pub.Type() == ssh.KeyAlgoRSA {
+			sig, err := algSigner.SignWithAlgorithm(rand.Reader, challenge, ssh.SigAlgoRSASHA2256)
+			if assert.NoError(t, err) {
+				assert.NoError(t, pub.Verify(challenge, sig))
+			}
+		}
+	}
+}
+
+func TestShellTransportSSHLibPKCS11(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newSoftHSMToken(t, key)
+
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := testutils.NewSSHServer(testutils.SSHServerParams{
+		User:           "nerdlog",
+		AuthorizedKeys: []ssh.PublicKey{pub},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// With the wrong PIN, it fails before even connecting.
+	resetSSHAuthMethodShared(t)
+
+	res, numPINRequests := connectSSHLibPKCS11(srv, cfg, "wrong")
+	if !assert.Error(t, res.Err) {
+		res.Conn.Close()
+		return
+	}
+	assert.Equal(t, 1, numPINRequests)
+
+	resetSSHAuthMethodShared(t)
+
+	res, numPINRequests = connectSSHLibPKCS11(srv, cfg, softHSMPIN)
+	if !assert.NoError(t, res.Err) {
+		return
+	}
+	defer res.Conn.Close()
+	assert.Equal(t, 1, numPINRequests)
+
+	stdout := bufio.NewScanner(res.Conn.Stdout())
+	line, err := runShellCmd(res.Conn, stdout, "echo signed by token")
+	assert.NoError(t, err)
+	assert.Equal(t, "signed by token", line)
+
+	// The token is only unlocked once, and the next connections reuse it.
+	res2, numPINRequests := connectSSHLibPKCS11(srv, cfg, "")
+	if assert.NoError(t, res2.Err) {
+		res2.Conn.Close()
+	}
+	assert.Equal(t, 0, numPINRequests)
+}
+
+func TestShellTransportSSHLibPKCS11BadProvider(t *testing.T) {
+	resetSSHAuthMethodShared(t)
+
+	srv, keyPath := newTestSSHServer(t, t.TempDir())
+	defer srv.Close()
+
+	cfg := SSHPKCS11{Provider: filepath.Join(t.TempDir(), "nonexistent.so")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The PIN isn't requested, and the ssh keys aren't used as a fallback.
+	transport := NewShellTransportSSHLib(ShellTransportSSHLibParams{
+		SSHKeys: []string{keyPath},
+		PKCS11:  &cfg,
+		ConnDetails: ConfigLogStreamShellTransportSSHLib{
+			Host: ConfigHost{
+				Addr: srv.Addr(),
+				User: "nerdlog",
+			},
+		},
+	})
+
+	resCh := make(chan ShellConnUpdate, 1)
+	transport.Connect(ctx, resCh)
+
+	for upd := range resCh {
+		assert.Nil(t, upd.DataRequest)
+
+		if upd.Result != nil {
+			if assert.Error(t, upd.Result.Err) {
+				assert.Contains(t, upd.Result.Err.Error(), "failed to load PKCS#11 provider")
+			} else {
+				upd.Result.Conn.Close()
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// maxProxyCommandStderr is how much of the proxy command stderr we keep to
+// include in the error messages.
+const maxProxyCommandStderr = 4096
+
+// proxyCommandWaitTimeout is how long Close waits for the proxy command to
+// finish after killing it. The wait can take forever if the command has
+// spawned some children which keep its stderr open, so we don't wait for
+// them.
+const proxyCommandWaitTimeout = 1 * time.Second
+
+// expandProxyCommand replaces the tokens in the proxy command (see
+// ConfigLogStream.ProxyCommand) with the details of the given host.
+func expandProxyCommand(proxyCmd string, host ConfigHost) (string, error) {
+	return expandSSHTokens(proxyCmd, "proxy command", host)
+}
+
+// expandSSHTokens replaces the tokens like %h in s (which is a proxy command
+// or proxy url, as described by what) with the details of the given host:
+// %h is the hostname, %p is the port, %r is the user, and %% is a literal %.
+func expandSSHTokens(s, what string, host ConfigHost) (string, error) {
+	hostname, port, err := net.SplitHostPort(host.Addr)
+	if err != nil {
+		return "", errors.Annotatef(err, "parsing addr %s", host.Addr)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		if i+1 >= len(s) {
+			return "", errors.Errorf("%s %q ends with a lone %%", what, s)
+		}
+
+		i++
+
+		switch s[i] {
+		case 'h':
+			sb.WriteString(hostname)
+		case 'p':
+			sb.WriteString(port)
+		case 'r':
+			sb.WriteString(host.User)
+		case '%':
+			sb.WriteByte('%')
+		default:
+			return "", errors.Errorf("unknown token %%%c in %s %q", s[i], what, s)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// proxyCommandConn implements net.Conn over the stdin and stdout of the proxy
+// command, so that the ssh handshake can be done over it.
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+
+	stderr *limitedBuffer
+
+	// cmdCancel kills the proxy command; detachCh is closed once the command
+	// doesn't need to be killed on the dial context cancellation anymore.
+	cmdCancel  context.CancelFunc
+	detachCh   chan struct{}
+	detachOnce sync.Once
+
+	closeOnce sync.Once
+}
+
+var _ net.Conn = &proxyCommandConn{}
+
+// dialProxyCommand starts the given proxy command (with the tokens already
+// expanded) in the local shell, and returns the connection over its stdin
+// and stdout. If ctx is cancelled before detachCtx is called, the command is
+// killed.
+func dialProxyCommand(ctx context.Context, proxyCmd string) (*proxyCommandConn, error) {
+	// The dial context is cancelled once we're connected, so the command has
+	// its own context, which only follows the dial one until detachCtx.
+	cmdCtx, cmdCancel := context.WithCancel(context.Background())
+
+	// Just like ssh does, exec the command so that there's no extra shell
+	// process in between.
+	cmd := exec.CommandContext(cmdCtx, "/bin/sh", "-c", "exec "+proxyCmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cmdCancel()
+		return nil, errors.Trace(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cmdCancel()
+		return nil, errors.Trace(err)
+	}
+
+	stderr := &limitedBuffer{max: maxProxyCommandStderr}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		cmdCancel()
+		return nil, errors.Annotatef(err, "starting proxy command %q", proxyCmd)
+	}
+
+	c := &proxyCommandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+
+		cmdCancel: cmdCancel,
+		detachCh:  make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmdCancel()
+		case <-c.detachCh:
+		}
+	}()
+
+	return c, nil
+}
+
+// detachCtx makes the proxy command survive the cancellation of the context
+// given to dialProxyCommand; it should be called once the ssh handshake is
+// done.
+func (c *proxyCommandConn) detachCtx() {
+	c.detachOnce.Do(func() {
+		close(c.detachCh)
+	})
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close closes the stdin of the proxy command, kills it, and waits for it to
+// finish (but not longer than proxyCommandWaitTimeout).
+func (c *proxyCommandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.detachCtx()
+
+		c.stdin.Close()
+		c.cmdCancel()
+
+		waitCh := make(chan struct{})
+		go func() {
+			c.cmd.Wait()
+			close(waitCh)
+		}()
+
+		select {
+		case <-waitCh:
+		case <-time.After(proxyCommandWaitTimeout):
+		}
+	})
+
+	return nil
+}
+
+// annotateErr adds the stderr of the proxy command, if any, to the error;
+// it's useful for the errors which happen because the proxy command failed,
+// since otherwise the error would just be an EOF. It should be called after
+// Close, so that the stderr is complete.
+func (c *proxyCommandConn) annotateErr(err error) error {
+	stderr := strings.TrimSpace(c.stderr.String())
+	if stderr == "" {
+		return err
+	}
+
+	return errors.Annotatef(err, "proxy command stderr: %s", stderr)
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr{}
+}
+
+func (c *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr{}
+}
+
+// The deadlines are not supported by the pipes, and the ssh library doesn't
+// need them anyway: the handshake is aborted by closing the connection.
+
+func (c *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// proxyCommandAddr is a dummy net.Addr for the proxyCommandConn.
+type proxyCommandAddr struct{}
+
+func (proxyCommandAddr) Network() string { return "proxy-command" }
+func (proxyCommandAddr) String() string  { return "proxy-command" }
+
+// limitedBuffer is a bytes.Buffer which is safe for concurrent use, and which
+// only keeps the first max bytes written to it, discarding the rest.
+type limitedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.buf.String()
+}
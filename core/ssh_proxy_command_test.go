@@ -0,0 +1,20 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandProxyCommand(t *testing.T) {
+	host := ConfigHost{Addr: "myhost:2222", User: "me"}
+
+	got, err := expandProxyCommand("ssm-proxy --target %r@%h --port %p --rate 100%%", host)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssm-proxy --target me@myhost --port 2222 --rate 100%", got)
+
+	for _, cmd := range []string{"nc %h %x", "nc %h %p %"} {
+		_, err := expandProxyCommand(cmd, host)
+		assert.Error(t, err, cmd)
+	}
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// validateProxyURL checks that the proxy URL (see ConfigLogStream.ProxyURL)
+// has one of the supported schemes. The rest of it isn't checked, since for
+// the WebSocket tunnels it might contain the tokens like %h, which are only
+// expanded when connecting.
+func validateProxyURL(proxyURL string) error {
+	switch proxyURLScheme(proxyURL) {
+	case "http", "https", "ws", "wss":
+		return nil
+	}
+
+	return errors.Errorf(
+		"invalid proxy url %q: must start with http://, https://, ws:// or wss://",
+		redactProxyURL(proxyURL),
+	)
+}
+
+// proxyURLScheme returns the lowercased scheme of the proxy URL, or an empty
+// string if there's none.
+func proxyURLScheme(proxyURL string) string {
+	idx := strings.Index(proxyURL, "://")
+	if idx < 0 {
+		return ""
+	}
+
+	return strings.ToLower(proxyURL[:idx])
+}
+
+// redactProxyURL returns the proxy URL with the password (if any) replaced
+// with "xxxxx", for the logs and error messages. It doesn't use url.Parse,
+// since the URL might contain the tokens like %h, which aren't valid escapes.
+func redactProxyURL(proxyURL string) string {
+	idx := strings.Index(proxyURL, "://")
+	if idx < 0 {
+		return proxyURL
+	}
+
+	rest := proxyURL[idx+3:]
+	authority := rest
+	if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+		authority = rest[:end]
+	}
+
+	at := strings.LastIndexByte(authority, '@')
+	if at < 0 {
+		return proxyURL
+	}
+
+	colon := strings.IndexByte(authority[:at], ':')
+	if colon < 0 {
+		return proxyURL
+	}
+
+	return proxyURL[:idx+3] + authority[:colon+1] + "xxxxx" + rest[at:]
+}
+
+// dialProxyURL connects to the host through the proxy given as
+// ConfigLogStream.ProxyURL, and returns the connection ready for the ssh
+// handshake: with http(s), the HTTP CONNECT proxy opens the tunnel to the
+// host; with ws(s), the ssh stream is carried by the WebSocket connection,
+// and the tokens in the URL are expanded first. If bindAddr is not empty,
+// the proxy is dialed from this local address.
+func dialProxyURL(
+	ctx context.Context, proxyURL string, host ConfigHost, bindAddr string, timeout time.Duration,
+) (net.Conn, error) {
+	scheme := proxyURLScheme(proxyURL)
+
+	if scheme == "ws" || scheme == "wss" {
+		expanded, err := expandSSHTokens(proxyURL, "proxy url", host)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		proxyURL = expanded
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing proxy url %s", redactProxyURL(proxyURL))
+	}
+
+	conn, err := dialProxyServer(ctx, u, bindAddr, timeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch scheme {
+	case "http", "https":
+		return httpConnect(ctx, conn, u, host.Addr, timeout)
+	case "ws", "wss":
+		return dialWebSocket(ctx, conn, u, timeout)
+	}
+
+	conn.Close()
+	return nil, errors.Trace(validateProxyURL(proxyURL))
+}
+
+// dialProxyServer dials the proxy server itself, with TLS for the https and
+// wss schemes.
+func dialProxyServer(ctx context.Context, u *url.URL, bindAddr string, timeout time.Duration) (net.Conn, error) {
+	useTLS := u.Scheme == "https" || u.Scheme == "wss"
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if useTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer, err := newDialer(timeout, bindAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, annotateDialErr(err, addr, bindAddr)
+	}
+
+	if !useTLS {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, errors.Annotatef(err, "TLS handshake with %s", addr)
+	}
+
+	return tlsConn, nil
+}
+
+// httpConnect asks the HTTP proxy, which conn is connected to, to open the
+// tunnel to the given addr, and returns the connection to use for the tunnel.
+func httpConnect(
+	ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string, timeout time.Duration,
+) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	setProxyAuthHeader(req.Header, "Proxy-Authorization", proxyURL)
+
+	var resp *http.Response
+	br := bufio.NewReader(conn)
+
+	err := doProxyHandshake(ctx, conn, timeout, func() error {
+		if err := req.Write(conn); err != nil {
+			return errors.Trace(err)
+		}
+
+		var err error
+		resp, err = http.ReadResponse(br, req)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "HTTP CONNECT to %s via %s", addr, proxyURL.Redacted())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf(
+			"HTTP CONNECT to %s via %s: proxy responded with %s", addr, proxyURL.Redacted(), resp.Status,
+		)
+	}
+
+	return &bufferedConn{Conn: conn, br: br}, nil
+}
+
+// setProxyAuthHeader sets the basic auth header with the credentials from
+// the proxy URL, if there are any.
+func setProxyAuthHeader(header http.Header, name string, proxyURL *url.URL) {
+	if proxyURL.User == nil {
+		return
+	}
+
+	password, _ := proxyURL.User.Password()
+	creds := proxyURL.User.Username() + ":" + password
+	header.Set(name, "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+}
+
+// doProxyHandshake runs the handshake with the proxy, with the timeout; if
+// the context is cancelled in the meantime, the connection is closed (which
+// aborts the handshake). On error, the connection is closed as well.
+func doProxyHandshake(ctx context.Context, conn net.Conn, timeout time.Duration, handshake func() error) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	stopCh := make(chan struct{})
+	abortedCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			close(abortedCh)
+		case <-stopCh:
+		}
+	}()
+
+	err := handshake()
+	close(stopCh)
+
+	select {
+	case <-abortedCh:
+		return errors.Trace(ctx.Err())
+	default:
+	}
+
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return nil
+}
+
+// bufferedConn is the net.Conn which reads from the buffered reader first,
+// since it might have read more than the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
@@ -0,0 +1,308 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// webSocketGUID is the magic string from RFC 6455, used to compute the
+// Sec-WebSocket-Accept header from the Sec-WebSocket-Key.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketControlPayload is the max payload of a control frame, per
+// RFC 6455.
+const maxWebSocketControlPayload = 125
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// dialWebSocket does the WebSocket handshake with the server at the given url,
+// which conn is connected to, and returns the connection which carries the
+// data in the binary WebSocket messages.
+func dialWebSocket(ctx context.Context, conn net.Conn, u *url.URL, timeout time.Duration) (net.Conn, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, keyBytes); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	// The credentials go to the Authorization header, not to the url.
+	reqURL := *u
+	reqURL.User = nil
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &reqURL,
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	setProxyAuthHeader(req.Header, "Authorization", u)
+
+	var resp *http.Response
+	br := bufio.NewReader(conn)
+
+	err := doProxyHandshake(ctx, conn, timeout, func() error {
+		if err := req.Write(conn); err != nil {
+			return errors.Trace(err)
+		}
+
+		var err error
+		resp, err = http.ReadResponse(br, req)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "WebSocket handshake with %s", u.Redacted())
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		conn.Close()
+		return nil, errors.Errorf(
+			"WebSocket handshake with %s: server responded with %s", u.Redacted(), resp.Status,
+		)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, errors.Errorf(
+			"WebSocket handshake with %s: invalid Sec-WebSocket-Accept", u.Redacted(),
+		)
+	}
+
+	return newWSConn(conn, br, true), nil
+}
+
+// webSocketAccept returns the expected Sec-WebSocket-Accept for the given
+// Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn implements net.Conn over the WebSocket connection: every Write is
+// sent as a binary message, and Read returns the payloads of the received
+// data messages as a stream. It's a minimal implementation of RFC 6455, just
+// enough to tunnel the ssh connection: no extensions, and no subprotocols.
+type wsConn struct {
+	net.Conn
+
+	br *bufio.Reader
+
+	// isClient is true if we're the client side of the connection; the
+	// client has to mask its frames, and the server must not.
+	isClient bool
+
+	// readRemaining is how many bytes of the current frame's payload are
+	// yet to be read; readMask and readMaskPos are used to unmask them.
+	readRemaining uint64
+	readMask      [4]byte
+	readMasked    bool
+	readMaskPos   int
+	readEOF       bool
+
+	writeMtx sync.Mutex
+}
+
+var _ net.Conn = &wsConn{}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, isClient bool) *wsConn {
+	return &wsConn{
+		Conn:     conn,
+		br:       br,
+		isClient: isClient,
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for c.readRemaining == 0 {
+		if c.readEOF {
+			return 0, io.EOF
+		}
+
+		if err := c.readFrameHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > c.readRemaining {
+		b = b[:c.readRemaining]
+	}
+
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.readRemaining -= uint64(n)
+
+	return n, err
+}
+
+// readFrameHeader reads the frames until a data frame comes, and then
+// readRemaining is set to its payload length (which can be 0). The control
+// frames are handled right away.
+func (c *wsConn) readFrameHeader() error {
+	for {
+		opcode, length, err := c.readHeader()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.readRemaining = length
+			return nil
+		}
+
+		// It's a control frame.
+		if length > maxWebSocketControlPayload {
+			return errors.Errorf("websocket control frame is too long: %d", length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+
+		case wsOpClose:
+			// Echo the close frame and report EOF; the underlying connection
+			// is closed by Close.
+			c.writeFrame(wsOpClose, nil)
+			c.readEOF = true
+			return nil
+		}
+	}
+}
+
+// readHeader reads the header of the next frame, and returns its opcode and
+// payload length. The mask (if any) is stored in the wsConn.
+func (c *wsConn) readHeader() (opcode byte, length uint64, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+
+	opcode = hdr[0] & 0x0f
+	c.readMasked = hdr[1]&0x80 != 0
+	length = uint64(hdr[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	c.readMaskPos = 0
+	if c.readMasked {
+		if _, err := io.ReadFull(c.br, c.readMask[:]); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return opcode, length, nil
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if !c.readMasked {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= c.readMask[c.readMaskPos%4]
+		c.readMaskPos++
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writeFrame writes a single final frame with the given opcode and payload.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[len(frame)-2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(payload)))
+	}
+
+	if !c.isClient {
+		frame = append(frame, payload...)
+		_, err := c.Conn.Write(frame)
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return errors.Trace(err)
+	}
+
+	frame = append(frame, mask[:]...)
+	for i, v := range payload {
+		frame = append(frame, v^mask[i%4])
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/juju/errors"
+)
+
+// StdinPacing configures how the data is written to the stdin of the remote
+// shell, for the slow or restricted shells (like on console servers or
+// embedded devices), which choke on fast bulk input; see
+// ConfigLogStreamOptions.StdinChunkSize. The zero value means no pacing.
+type StdinPacing struct {
+	// ChunkSize, if positive, is the max size of a chunk which is written at
+	// once.
+	ChunkSize int
+
+	// LineChunks, if true, makes every line a separate chunk (on top of the
+	// ChunkSize, if any).
+	LineChunks bool
+
+	// Delay is the min delay between the chunks, including the chunks of the
+	// separate writes.
+	Delay time.Duration
+}
+
+// IsZero returns whether there's no pacing configured.
+func (p StdinPacing) IsZero() bool {
+	return p.ChunkSize <= 0 && !p.LineChunks && p.Delay <= 0
+}
+
+// splitChunks splits the data into the chunks which should be written
+// separately.
+func (p StdinPacing) splitChunks(data []byte) [][]byte {
+	var chunks [][]byte
+
+	for len(data) > 0 {
+		n := len(data)
+
+		if p.LineChunks {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				n = i + 1
+			}
+		}
+
+		if p.ChunkSize > 0 && n > p.ChunkSize {
+			n = p.ChunkSize
+		}
+
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+
+	return chunks
+}
+
+// pacedWriter writes the data to the underlying writer according to the
+// StdinPacing. The writes are synchronous: Write returns once the last chunk
+// is written.
+type pacedWriter struct {
+	w      io.Writer
+	pacing StdinPacing
+	clock  clock.Clock
+
+	mtx sync.Mutex
+	// lastWriteTime is when the last chunk was written.
+	lastWriteTime time.Time
+}
+
+func newPacedWriter(w io.Writer, pacing StdinPacing, clock clock.Clock) *pacedWriter {
+	return &pacedWriter{
+		w:      w,
+		pacing: pacing,
+		clock:  clock,
+	}
+}
+
+func (pw *pacedWriter) Write(data []byte) (int, error) {
+	pw.mtx.Lock()
+	defer pw.mtx.Unlock()
+
+	written := 0
+	for _, chunk := range pw.pacing.splitChunks(data) {
+		if pw.pacing.Delay > 0 && !pw.lastWriteTime.IsZero() {
+			if d := pw.pacing.Delay - pw.clock.Since(pw.lastWriteTime); d > 0 {
+				pw.clock.Sleep(d)
+			}
+		}
+
+		n, err := pw.w.Write(chunk)
+		written += n
+		pw.lastWriteTime = pw.clock.Now()
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// pacedTransport wraps another transport, pacing the writes to the stdin of
+// its connections (including the additional sessions, if the transport
+// supports them) according to the StdinPacing.
+type pacedTransport struct {
+	inner  ShellTransport
+	pacing StdinPacing
+	clock  clock.Clock
+}
+
+var _ ShellTransport = &pacedTransport{}
+
+func newPacedTransport(inner ShellTransport, pacing StdinPacing, clock clock.Clock) *pacedTransport {
+	return &pacedTransport{
+		inner:  inner,
+		pacing: pacing,
+		clock:  clock,
+	}
+}
+
+func (t *pacedTransport) Connect(ctx context.Context, resCh chan<- ShellConnUpdate) {
+	innerResCh := make(chan ShellConnUpdate, 1)
+	t.inner.Connect(ctx, innerResCh)
+
+	go func() {
+		for upd := range innerResCh {
+			if upd.Result != nil {
+				// The result still belongs to the inner transport, which might keep
+				// reading it, so wrap the conn in a copy.
+				res := *upd.Result
+				if res.Conn != nil {
+					res.Conn = t.wrapConn(res.Conn)
+				}
+				upd.Result = &res
+
+				resCh <- upd
+				return
+			}
+
+			resCh <- upd
+		}
+	}()
+}
+
+// wrapConn returns the paced version of the given connection; it only
+// implements ShellConnMultiSession if the given connection does.
+func (t *pacedTransport) wrapConn(conn ShellConn) ShellConn {
+	pc := &pacedConn{
+		ShellConn: conn,
+		stdin:     newPacedWriter(conn.Stdin(), t.pacing, t.clock),
+	}
+
+	if ms, ok := conn.(ShellConnMultiSession); ok {
+		return &pacedConnMultiSession{
+			pacedConn: pc,
+			ms:        ms,
+			transport: t,
+		}
+	}
+
+	return pc
+}
+
+type pacedConn struct {
+	ShellConn
+
+	stdin *pacedWriter
+}
+
+func (c *pacedConn) Stdin() io.Writer { return c.stdin }
+
+type pacedConnMultiSession struct {
+	*pacedConn
+
+	ms        ShellConnMultiSession
+	transport *pacedTransport
+}
+
+var _ ShellConnMultiSession = &pacedConnMultiSession{}
+
+func (c *pacedConnMultiSession) NewSession() (ShellConn, error) {
+	sess, err := c.ms.NewSession()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return c.transport.wrapConn(sess), nil
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dimonomid/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// sleepRecordingClock is the mock clock which records the sleeps, and
+// advances the time by the slept duration instead of blocking.
+type sleepRecordingClock struct {
+	*clock.Mock
+
+	sleeps []time.Duration
+}
+
+func (c *sleepRecordingClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.Mock.Add(d)
+}
+
+// chunksRecorder records every write as a separate chunk.
+type chunksRecorder struct {
+	chunks []string
+}
+
+func (r *chunksRecorder) Write(data []byte) (int, error) {
+	r.chunks = append(r.chunks, string(data))
+	return len(data), nil
+}
+
+func TestStdinPacingSplitChunks(t *testing.T) {
+	data := []byte("echo foo\nexport BAR=baz\n\nqux")
+
+	assert.Equal(t,
+		[][]byte{[]byte("echo "), []byte("foo\ne"), []byte("xport"), []byte(" BAR="), []byte("baz\n\n"), []byte("qux")},
+		StdinPacing{ChunkSize: 5}.splitChunks(data),
+	)
+
+	assert.Equal(t,
+		[][]byte{[]byte("echo foo\n"), []byte("export BAR=baz\n"), []byte("\n"), []byte("qux")},
+		StdinPacing{LineChunks: true}.splitChunks(data),
+	)
+
+	assert.Equal(t,
+		[][]byte{[]byte("echo foo\n"), []byte("export BA"), []byte("R=baz\n"), []byte("\n"), []byte("qux")},
+		StdinPacing{LineChunks: true, ChunkSize: 9}.splitChunks(data),
+	)
+
+	// Only the delay: the whole write is a single chunk.
+	assert.Equal(t, [][]byte{data}, StdinPacing{Delay: time.Millisecond}.splitChunks(data))
+
+	assert.True(t, StdinPacing{}.IsZero())
+	assert.True(t, StdinPacing{ChunkSize: -1}.IsZero())
+	assert.False(t, StdinPacing{LineChunks: true}.IsZero())
+}
+
+func TestPacedWriter(t *testing.T) {
+	clk := &sleepRecordingClock{Mock: clock.NewMock()}
+	rec := &chunksRecorder{}
+
+	pw := newPacedWriter(rec, StdinPacing{ChunkSize: 4, Delay: 10 * time.Millisecond}, clk)
+
+	n, err := pw.Write([]byte("abcdefghij"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, rec.chunks)
+
+	// The first chunk is written right away, and then there's a delay before
+	// every next one.
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}, clk.sleeps)
+
+	// The delay is kept between the separate writes too, counting from the
+	// last chunk.
+	clk.sleeps = nil
+	clk.Add(4 * time.Millisecond)
+
+	_, err = pw.Write([]byte("kl"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"abcd", "efgh", "ij", "kl"}, rec.chunks)
+	assert.Equal(t, []time.Duration{6 * time.Millisecond}, clk.sleeps)
+
+	// If enough time has passed, there's no delay.
+	clk.sleeps = nil
+	clk.Add(time.Second)
+
+	_, err = pw.Write([]byte("mn"))
+	assert.NoError(t, err)
+	assert.Empty(t, clk.sleeps)
+}
+
+func TestStdinPacingQuery(t *testing.T) {
+	n, err := New(Options{
+		LStreams: "localhost",
+		ConfigLogStreams: ConfigLogStreams{
+			"localhost": {
+				Options: ConfigLogStreamOptions{
+					ShellInit: []string{"export TZ=UTC"},
+					CustomAgent: `echo "m:1:2025-03-10T10:00:01.000000+00:00 myhost myapp[123]: foo"
+`,
+					StdinChunkSize:  64,
+					StdinLineChunks: true,
+					StdinChunkDelay: 100 * time.Microsecond,
+				},
+			},
+		},
+		ClientID: "stdin_pacing_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The agent upload and the commands are paced, but work the same way.
+	resp, err := n.Query(ctx, QueryLogsParams{
+		From:        time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+		MaxNumLines: 10,
+	})
+	if assert.NoError(t, err) && assert.Len(t, resp.Logs, 1) {
+		assert.Equal(t, "foo", resp.Logs[0].Msg)
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailN(t *testing.T) {
+	dir := t.TempDir()
+
+	// The logs of host-b are way older, so with a regular query, they'd be cut
+	// as not covered by host-a.
+	logs := map[string][]string{
+		"host-a": {
+			"2025-03-10T10:00:01.000000+00:00 myhost app[1]: a1",
+			"2025-03-10T10:00:02.000000+00:00 myhost app[1]: a2",
+			"2025-03-10T10:00:03.000000+00:00 myhost app[1]: a3",
+			"2025-03-10T10:00:05.000000+00:00 myhost app[1]: a4",
+		},
+		"host-b": {
+			"2025-03-09T10:00:01.000000+00:00 myhost app[2]: b1",
+			"2025-03-09T10:00:02.000000+00:00 myhost app[2]: b2",
+			"2025-03-09T10:00:04.000000+00:00 myhost app[2]: b3",
+			"2025-03-10T10:00:04.000000+00:00 myhost app[2]: b4",
+		},
+	}
+
+	configLogStreams := ConfigLogStreams{}
+	for name, lines := range logs {
+		logPath := filepath.Join(dir, name+".log")
+		if err := ioutil.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		configLogStreams[name] = ConfigLogStream{
+			Hostname: "localhost",
+			LogFiles: []string{logPath},
+			Options:  ConfigLogStreamOptions{ShellInit: []string{"export TZ=UTC"}},
+		}
+	}
+
+	n, err := New(Options{
+		LStreams:         "host-a,host-b",
+		ConfigLogStreams: configLogStreams,
+		ClientID:         "tail_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := n.TailN(ctx, 3)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var got []string
+	for _, msg := range resp.Logs {
+		got = append(got, fmt.Sprintf("%s %s", msg.Context["lstream"], msg.Msg))
+	}
+
+	// The last 3 lines of every logstream, merged by timestamp.
+	assert.Equal(t, []string{
+		"host-b b2",
+		"host-b b3",
+		"host-a a2",
+		"host-a a3",
+		"host-b b4",
+		"host-a a4",
+	}, got)
+
+	for name := range logs {
+		assert.Contains(
+			t, resp.DebugInfo[name].AgentStderr,
+			fmt.Sprintf("debug: bash -c 'tail -n 3 %s'", filepath.Join(dir, name+".log")),
+		)
+	}
+
+	_, err = n.TailN(ctx, 0)
+	assert.Error(t, err)
+}
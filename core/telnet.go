@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+// Telnet commands and options, see RFC 854 and RFC 857/858.
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptEcho = 1
+	telnetOptSGA  = 3
+)
+
+// telnetConn is a minimal telnet client on top of a TCP connection: Read
+// returns the data with the telnet commands filtered out, and Write escapes
+// the data as needed.
+//
+// All the option negotiations are refused, except for the server's echo and
+// suppress-go-ahead: that's what a plain character-at-a-time session needs.
+type telnetConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// writeMtx serializes the writes, since the negotiation replies are
+	// written by the reader.
+	writeMtx sync.Mutex
+
+	// replied contains the replies (the command and the option) which were
+	// already sent, so that we don't get into a negotiation loop with the
+	// server which keeps repeating the same requests.
+	replied map[[2]byte]bool
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{
+		conn:    conn,
+		br:      bufio.NewReader(conn),
+		replied: map[[2]byte]bool{},
+	}
+}
+
+// Read reads the data from the server. It doesn't block if some data was
+// read already and no more is buffered.
+func (c *telnetConn) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if n > 0 && c.br.Buffered() == 0 {
+			break
+		}
+
+		b, err := c.br.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+
+			return 0, err
+		}
+
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+
+		cmd, err := c.br.ReadByte()
+		if err != nil {
+			return n, err
+		}
+
+		switch cmd {
+		case telnetIAC:
+			// Escaped 255 data byte.
+			p[n] = telnetIAC
+			n++
+
+		case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+			opt, err := c.br.ReadByte()
+			if err != nil {
+				return n, err
+			}
+
+			if err := c.negotiate(cmd, opt); err != nil {
+				return n, err
+			}
+
+		case telnetSB:
+			// Skip the subnegotiation until IAC SE; we never agree to the options
+			// which use it, so it's not supposed to happen anyway.
+			if err := c.skipSubnegotiation(); err != nil {
+				return n, err
+			}
+
+		default:
+			// NOP, GA and the like: nothing to do.
+		}
+	}
+
+	return n, nil
+}
+
+func (c *telnetConn) skipSubnegotiation() error {
+	prevIAC := false
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if prevIAC && b == telnetSE {
+			return nil
+		}
+
+		prevIAC = !prevIAC && b == telnetIAC
+	}
+}
+
+// negotiate replies to the option negotiation command from the server.
+func (c *telnetConn) negotiate(cmd, opt byte) error {
+	var reply byte
+	switch cmd {
+	case telnetWILL:
+		reply = telnetDONT
+		if opt == telnetOptEcho || opt == telnetOptSGA {
+			reply = telnetDO
+		}
+
+	case telnetDO:
+		reply = telnetWONT
+		if opt == telnetOptSGA {
+			reply = telnetWILL
+		}
+
+	default:
+		// WONT and DONT: the options we agree to can be disabled by the server
+		// as it wishes, and the rest of them are disabled already.
+		return nil
+	}
+
+	key := [2]byte{reply, opt}
+	if c.replied[key] {
+		return nil
+	}
+	c.replied[key] = true
+
+	return c.writeRaw([]byte{telnetIAC, reply, opt})
+}
+
+// Write writes the data to the server, escaping the 255 bytes.
+func (c *telnetConn) Write(p []byte) (int, error) {
+	escaped := p
+	for i, b := range p {
+		if b != telnetIAC {
+			continue
+		}
+
+		escaped = make([]byte, 0, len(p)+1)
+		escaped = append(escaped, p[:i]...)
+		for _, b := range p[i:] {
+			escaped = append(escaped, b)
+			if b == telnetIAC {
+				escaped = append(escaped, telnetIAC)
+			}
+		}
+
+		break
+	}
+
+	if err := c.writeRaw(escaped); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *telnetConn) writeRaw(p []byte) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func (c *telnetConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,438 @@
+package testutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer is a minimal in-process ssh server for tests: it accepts the
+// configured keys and/or password, and runs shell sessions (as well as exec
+// requests) using the local shell. It also supports injecting failures, to
+// test how the clients handle those.
+type SSHServer struct {
+	params   SSHServerParams
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+
+	mtx        sync.Mutex
+	conns      map[net.Conn]struct{}
+	rejectAuth bool
+
+	wg sync.WaitGroup
+}
+
+type SSHServerParams struct {
+	// User, if not empty, is the only user which can log in.
+	User string
+
+	// AuthorizedKeys are the public keys which are accepted.
+	AuthorizedKeys []ssh.PublicKey
+
+	// TrustedUserCAKeys are the CA keys; user certificates signed by any of
+	// them are accepted (if they're valid for the User).
+	TrustedUserCAKeys []ssh.PublicKey
+
+	// Password, if not empty, is accepted for password auth.
+	Password string
+
+	// HostKey is the server's host key; if nil, a new one is generated.
+	HostKey ssh.Signer
+
+	// ShellBin is the shell to run for the shell and exec requests; by
+	// default, it's /bin/sh.
+	ShellBin string
+
+	// RejectAuth makes the server reject all authentication attempts; it can
+	// be changed later with SetRejectAuth.
+	RejectAuth bool
+}
+
+// NewSSHServer starts a new server listening on a random port on localhost.
+// It needs to be closed with Close once not needed anymore.
+func NewSSHServer(params SSHServerParams) (*SSHServer, error) {
+	if params.ShellBin == "" {
+		params.ShellBin = "/bin/sh"
+	}
+
+	hostKey := params.HostKey
+	if hostKey == nil {
+		var err error
+		hostKey, _, err = GenerateSSHKey()
+		if err != nil {
+			return nil, errors.Annotatef(err, "generating host key")
+		}
+	}
+
+	s := &SSHServer{
+		params:     params,
+		hostKey:    hostKey,
+		conns:      map[net.Conn]struct{}{},
+		rejectAuth: params.RejectAuth,
+	}
+
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	if params.Password != "" {
+		s.config.PasswordCallback = s.checkPassword
+	}
+	s.config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on, like "127.0.0.1:12345".
+func (s *SSHServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host returns the host part of Addr.
+func (s *SSHServer) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port returns the port part of Addr.
+func (s *SSHServer) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	return port
+}
+
+// HostKey returns the public host key of the server.
+func (s *SSHServer) HostKey() ssh.PublicKey {
+	return s.hostKey.PublicKey()
+}
+
+// SetRejectAuth makes the server reject (or stop rejecting) all further
+// authentication attempts.
+func (s *SSHServer) SetRejectAuth(reject bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.rejectAuth = reject
+}
+
+// NumConns returns the number of currently open connections.
+func (s *SSHServer) NumConns() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.conns)
+}
+
+// RemoteAddrs returns the remote addresses of the currently open
+// connections, sorted.
+func (s *SSHServer) RemoteAddrs() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	addrs := make([]string, 0, len(s.conns))
+	for conn := range s.conns {
+		addrs = append(addrs, conn.RemoteAddr().String())
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// DropConnections abruptly closes all the currently open connections, as if
+// the network went down; the server keeps accepting new ones.
+func (s *SSHServer) DropConnections() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server, drops all the connections, and waits for all the
+// goroutines to finish.
+func (s *SSHServer) Close() {
+	s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+func (s *SSHServer) checkUser(meta ssh.ConnMetadata) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.rejectAuth {
+		return errors.Errorf("auth rejected")
+	}
+
+	if s.params.User != "" && meta.User() != s.params.User {
+		return errors.Errorf("unknown user %q", meta.User())
+	}
+
+	return nil
+}
+
+func (s *SSHServer) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if err := s.checkUser(meta); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				for _, ca := range s.params.TrustedUserCAKeys {
+					if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+						return true
+					}
+				}
+
+				return false
+			},
+		}
+
+		perms, err := checker.Authenticate(meta, cert)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return perms, nil
+	}
+
+	for _, authorized := range s.params.AuthorizedKeys {
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{}, nil
+		}
+	}
+
+	return nil, errors.Errorf("unknown public key")
+}
+
+func (s *SSHServer) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if err := s.checkUser(meta); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if string(password) != s.params.Password {
+		return nil, errors.Errorf("wrong password")
+	}
+
+	return &ssh.Permissions{}, nil
+}
+
+func (s *SSHServer) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mtx.Lock()
+				delete(s.conns, conn)
+				s.mtx.Unlock()
+
+				conn.Close()
+			}()
+
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *SSHServer) handleConn(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(ch, chReqs)
+		}()
+	}
+}
+
+func (s *SSHServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		var cmd *exec.Cmd
+
+		switch req.Type {
+		case "shell":
+			cmd = exec.Command(s.params.ShellBin)
+
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			cmd = exec.Command(s.params.ShellBin, "-c", payload.Command)
+
+		case "env":
+			req.Reply(true, nil)
+			continue
+
+		default:
+			req.Reply(false, nil)
+			continue
+		}
+
+		req.Reply(true, nil)
+
+		exitCode := runSessionCmd(cmd, ch)
+
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, uint32(exitCode))
+		ch.SendRequest("exit-status", false, status)
+
+		return
+	}
+}
+
+// runSessionCmd runs the command with its stdin, stdout and stderr connected
+// to the channel, and returns the exit code.
+func runSessionCmd(cmd *exec.Cmd, ch ssh.Channel) int {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+
+	if err := cmd.Start(); err != nil {
+		return 127
+	}
+
+	// Not using cmd.Stdin = ch, because then cmd.Wait would wait for the
+	// client to close its stdin, even if the process is already done.
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+
+		return 255
+	}
+
+	return 0
+}
+
+// GenerateSSHKey generates a new ECDSA key, and returns it both as a signer
+// and as the PEM-encoded private key.
+func GenerateSSHKey() (ssh.Signer, []byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// WriteSSHKey generates a new key, writes the private key to the given dir,
+// and returns the file path and the signer.
+func WriteSSHKey(dir string) (string, ssh.Signer, error) {
+	signer, keyData, err := GenerateSSHKey()
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyPath, keyData, 0600); err != nil {
+		return "", nil, errors.Trace(err)
+	}
+
+	return keyPath, signer, nil
+}
+
+// WriteSSHUserCert signs a user certificate for the given public key with the
+// given CA, valid for the given principal for the next hour, and writes it to
+// the given path, in the same format as OpenSSH's id_*-cert.pub files.
+func WriteSSHUserCert(certPath string, ca ssh.Signer, pub ssh.PublicKey, principal string) error {
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "nerdlog-test",
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package core
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/juju/errors"
@@ -13,6 +15,30 @@ const (
 	TransportModeKindSSHLib = "ssh-lib"
 	TransportModeKindSSHBin = "ssh-bin"
 	TransportModeKindCustom = "custom"
+
+	// TransportModeKindAuto tries ssh-lib first, and falls back to ssh-bin if
+	// ssh-lib fails in a way which ssh-bin might handle, like an unsupported
+	// auth method; the decision is remembered per host. See
+	// ShellTransportAuto.
+	TransportModeKindAuto = "auto"
+
+	// TransportModeKindHTTPNDJSON is a read-only transport which doesn't run
+	// any commands on the host, and instead gets the logs from an HTTP
+	// endpoint returning NDJSON; see ShellTransportHTTPNDJSON.
+	TransportModeKindHTTPNDJSON = "http-ndjson"
+
+	// TransportModeKindWinEvent is a read-only transport which gets the logs
+	// from the Windows Event Log on the hosts, by running Get-WinEvent in
+	// PowerShell over ssh; see ShellTransportWinEvent.
+	TransportModeKindWinEvent = "winevent"
+
+	// TransportModeKindTelnet connects to the host over telnet, logging in
+	// by answering the login and password prompts; see ShellTransportConsole.
+	TransportModeKindTelnet = "telnet"
+
+	// TransportModeKindSerial is like TransportModeKindTelnet, but uses a
+	// local serial device instead, like "/dev/ttyUSB0".
+	TransportModeKindSerial = "serial"
 )
 
 type TransportMode struct {
@@ -21,6 +47,26 @@ type TransportMode struct {
 	// customCommand is only relevant when kind == TransportModeKindCustom;
 	// it's the external shell command.
 	customCommand string
+
+	// httpURLTemplate is only relevant when kind == TransportModeKindHTTPNDJSON;
+	// it's the URL template to query, see
+	// ConfigLogStreamShellTransportHTTPNDJSON.URLTemplate.
+	httpURLTemplate string
+
+	// winEventLogNames is only relevant when kind == TransportModeKindWinEvent;
+	// it's the names of the event logs to read, like "System" or
+	// "Application".
+	winEventLogNames []string
+
+	// telnetAddr is only relevant when kind == TransportModeKindTelnet; if not
+	// empty, it's the host:port to connect to instead of the logstream's
+	// address, e.g. a port of a console server.
+	telnetAddr string
+
+	// serialDevice and serialBaud are only relevant when kind ==
+	// TransportModeKindSerial; serialBaud is zero if not specified.
+	serialDevice string
+	serialBaud   int
 }
 
 func NewTransportModeSSHLib() *TransportMode {
@@ -44,6 +90,10 @@ func NewTransportModeCustom(customCommand string) *TransportMode {
 
 func ParseTransportMode(spec string) (*TransportMode, error) {
 	customPrefix := fmt.Sprintf("%s:", TransportModeKindCustom)
+	httpNDJSONPrefix := fmt.Sprintf("%s:", TransportModeKindHTTPNDJSON)
+	winEventPrefix := fmt.Sprintf("%s:", TransportModeKindWinEvent)
+	telnetPrefix := fmt.Sprintf("%s:", TransportModeKindTelnet)
+	serialPrefix := fmt.Sprintf("%s:", TransportModeKindSerial)
 
 	switch {
 	case spec == TransportModeKindSSHLib:
@@ -56,6 +106,11 @@ func ParseTransportMode(spec string) (*TransportMode, error) {
 			kind: TransportModeKindSSHBin,
 		}, nil
 
+	case spec == TransportModeKindAuto:
+		return &TransportMode{
+			kind: TransportModeKindAuto,
+		}, nil
+
 	case strings.HasPrefix(spec, customPrefix):
 		cmd := strings.TrimPrefix(spec, customPrefix)
 
@@ -64,6 +119,83 @@ func ParseTransportMode(spec string) (*TransportMode, error) {
 			customCommand: cmd,
 		}, nil
 
+	case strings.HasPrefix(spec, httpNDJSONPrefix):
+		urlTemplate := strings.TrimPrefix(spec, httpNDJSONPrefix)
+		if urlTemplate == "" {
+			return nil, errors.Errorf("no URL template in transport mode %q", spec)
+		}
+
+		return &TransportMode{
+			kind:            TransportModeKindHTTPNDJSON,
+			httpURLTemplate: urlTemplate,
+		}, nil
+
+	case strings.HasPrefix(spec, winEventPrefix):
+		var logNames []string
+		for _, name := range strings.Split(strings.TrimPrefix(spec, winEventPrefix), ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+
+			if err := validateWinEventLogName(name); err != nil {
+				return nil, errors.Annotatef(err, "transport mode %q", spec)
+			}
+
+			logNames = append(logNames, name)
+		}
+
+		if len(logNames) == 0 {
+			return nil, errors.Errorf("no event log names in transport mode %q", spec)
+		}
+
+		return &TransportMode{
+			kind:             TransportModeKindWinEvent,
+			winEventLogNames: logNames,
+		}, nil
+
+	case spec == TransportModeKindTelnet:
+		return &TransportMode{
+			kind: TransportModeKindTelnet,
+		}, nil
+
+	case strings.HasPrefix(spec, telnetPrefix):
+		addr := strings.TrimPrefix(spec, telnetPrefix)
+		if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+			return nil, errors.Errorf("invalid address in transport mode %q, expected telnet:host:port", spec)
+		}
+
+		return &TransportMode{
+			kind:       TransportModeKindTelnet,
+			telnetAddr: addr,
+		}, nil
+
+	case strings.HasPrefix(spec, serialPrefix):
+		device := strings.TrimPrefix(spec, serialPrefix)
+
+		// The baud rate is optional, so only treat the last part as one if
+		// it's a number.
+		var baud int
+		if idx := strings.LastIndex(device, ":"); idx >= 0 {
+			if n, err := strconv.Atoi(device[idx+1:]); err == nil {
+				if n <= 0 {
+					return nil, errors.Errorf("invalid baud rate in transport mode %q", spec)
+				}
+
+				device, baud = device[:idx], n
+			}
+		}
+
+		if device == "" {
+			return nil, errors.Errorf("no device in transport mode %q", spec)
+		}
+
+		return &TransportMode{
+			kind:         TransportModeKindSerial,
+			serialDevice: device,
+			serialBaud:   baud,
+		}, nil
+
 	default:
 		return nil, errors.Errorf("invalid transport mode %q", spec)
 	}
@@ -79,19 +211,68 @@ func (m *TransportMode) CustomShellCommand() string {
 		return ""
 	case TransportModeKindSSHBin:
 		return DefaultSSHShellCommand
+	case TransportModeKindAuto:
+		// The command of the ssh-bin fallback.
+		return DefaultSSHShellCommand
 	case TransportModeKindCustom:
 		return m.customCommand
+	case TransportModeKindHTTPNDJSON:
+		return ""
+	case TransportModeKindWinEvent:
+		return DefaultWinEventShellCommand
+	case TransportModeKindTelnet, TransportModeKindSerial:
+		return ""
 	}
 
 	panic("should never be here")
 }
 
+// HTTPURLTemplate returns the URL template for the http-ndjson transport, or
+// an empty string for the other transports.
+func (m *TransportMode) HTTPURLTemplate() string {
+	return m.httpURLTemplate
+}
+
+// WinEventLogNames returns the event log names for the winevent transport,
+// or nil for the other transports.
+func (m *TransportMode) WinEventLogNames() []string {
+	return m.winEventLogNames
+}
+
+// TelnetAddr returns the explicit host:port for the telnet transport, or an
+// empty string if the logstream's address is to be used, or for the other
+// transports.
+func (m *TransportMode) TelnetAddr() string {
+	return m.telnetAddr
+}
+
+// SerialDevice returns the device path and the baud rate (zero if not
+// specified) for the serial transport, or empty values for the other
+// transports.
+func (m *TransportMode) SerialDevice() (device string, baud int) {
+	return m.serialDevice, m.serialBaud
+}
+
 func (m *TransportMode) String() string {
 	switch m.kind {
-	case TransportModeKindSSHLib, TransportModeKindSSHBin:
+	case TransportModeKindSSHLib, TransportModeKindSSHBin, TransportModeKindAuto:
 		return string(m.kind)
 	case TransportModeKindCustom:
 		return fmt.Sprintf("%s:%s", m.kind, m.customCommand)
+	case TransportModeKindHTTPNDJSON:
+		return fmt.Sprintf("%s:%s", m.kind, m.httpURLTemplate)
+	case TransportModeKindWinEvent:
+		return fmt.Sprintf("%s:%s", m.kind, strings.Join(m.winEventLogNames, ","))
+	case TransportModeKindTelnet:
+		if m.telnetAddr == "" {
+			return string(m.kind)
+		}
+		return fmt.Sprintf("%s:%s", m.kind, m.telnetAddr)
+	case TransportModeKindSerial:
+		if m.serialBaud == 0 {
+			return fmt.Sprintf("%s:%s", m.kind, m.serialDevice)
+		}
+		return fmt.Sprintf("%s:%s:%d", m.kind, m.serialDevice, m.serialBaud)
 	}
 
 	// Should never be here
@@ -103,6 +284,10 @@ func (m *TransportMode) String() string {
 //
 // It's interpreted not by an external shell, but by https://github.com/mvdan/sh.
 //
-// Vars NLHOST, NLPORT and NLUSER are set by the nerdlog internally, but it can
-// also use arbitrary environment vars.
-const DefaultSSHShellCommand = "ssh -o 'BatchMode=yes' ${NLPORT:+-p ${NLPORT}} ${NLUSER:+${NLUSER}@}${NLHOST} /bin/sh"
+// Vars NLHOST, NLPORT, NLUSER, NLJUMP and NLBIND are set by the nerdlog
+// internally, but it can also use arbitrary environment vars.
+const DefaultSSHShellCommand = "ssh -o 'BatchMode=yes' " + sshBinDestArgs
+
+// sshBinDestArgs is the part of the ssh-bin command after the options,
+// specifying where to connect; see also sshBinShellCommand.
+const sshBinDestArgs = "${NLBIND:+-b ${NLBIND}} ${NLJUMP:+-J ${NLJUMP}} ${NLPORT:+-p ${NLPORT}} ${NLUSER:+${NLUSER}@}${NLHOST} /bin/sh"
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// WireCompression specifies how the output of the agent is compressed while
+// it's transferred from the host to nerdlog. See constants below for the
+// available options.
+type WireCompression string
+
+const (
+	// WireCompressionGzip pipes the output through "gzip -c" on the host. It's
+	// the default, since gzip is available pretty much everywhere.
+	WireCompressionGzip WireCompression = "gzip"
+
+	// WireCompressionZstd pipes the output through "zstd -c" on the host, which
+	// is faster and compresses better than gzip. The zstd binary must be
+	// available on both the host and the local machine.
+	WireCompressionZstd WireCompression = "zstd"
+
+	// WireCompressionNone means that the output is not compressed at all.
+	WireCompressionNone WireCompression = "none"
+)
+
+var ValidWireCompressions = map[WireCompression]struct{}{
+	WireCompressionGzip: {},
+	WireCompressionZstd: {},
+	WireCompressionNone: {},
+}
+
+const (
+	// compressedStartMarkerPrefix (followed by the WireCompression) and
+	// compressedEndMarker are echoed in the beginning and the end of the
+	// compressed output. Effectively we're doing this:
+	//
+	//   $ echo compressed_start:gzip ; whatever command we need to run | gzip -c ; echo compressed_end
+	//
+	// and the scanner func (returned by getScannerFunc) sees those markers and
+	// buffers compressed output until it's done, then decompresses it and
+	// sends to the clients, so it's totally opaque for them.
+	compressedStartMarkerPrefix = "compressed_start:"
+	compressedEndMarker         = "compressed_end"
+
+	// wireCompressionOKMarker is printed during bootstrap if the compressor
+	// command exists on the host.
+	wireCompressionOKMarker = "wire_compression_ok"
+)
+
+// compressCmd returns the command which compresses stdin to stdout on the
+// host. Must not be called for WireCompressionNone.
+func (wc WireCompression) compressCmd() []string {
+	switch wc {
+	case WireCompressionGzip:
+		return []string{"gzip", "-c"}
+	case WireCompressionZstd:
+		return []string{"zstd", "-q", "-c"}
+	}
+
+	panic("no compress command for wire compression " + string(wc))
+}
+
+// probeCmd returns the shell command which prints the
+// wireCompressionOKMarker if the compressor exists on the host.
+func (wc WireCompression) probeCmd() string {
+	return "command -v " + wc.compressCmd()[0] + " >/dev/null 2>&1 && echo '" + wireCompressionOKMarker + "'"
+}
+
+// checkLocalDecompressor returns an error if the data compressed with wc
+// can't be decompressed locally.
+func (wc WireCompression) checkLocalDecompressor() error {
+	switch wc {
+	case WireCompressionZstd:
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return errors.Annotatef(err, "zstd is not available locally")
+		}
+	}
+
+	return nil
+}
+
+// decompress returns the reader with the data compressed on the host with
+// the given compression.
+func decompress(wc WireCompression, data []byte) (io.Reader, error) {
+	switch wc {
+	case WireCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return r, nil
+
+	case WireCompressionZstd:
+		var stderr bytes.Buffer
+
+		cmd := exec.Command("zstd", "-d", "-q", "-c")
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = &stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, errors.Annotatef(err, "running zstd: %s", strings.TrimSpace(stderr.String()))
+		}
+
+		return bytes.NewReader(out), nil
+	}
+
+	return nil, errors.Errorf("unknown wire compression %q", wc)
+}
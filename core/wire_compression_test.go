@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// compressLocally compresses the data the same way as the host does with the
+// given compression.
+func compressLocally(t *testing.T, wc WireCompression, data []byte) []byte {
+	var buf bytes.Buffer
+
+	switch wc {
+	case WireCompressionGzip:
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+
+	case WireCompressionZstd:
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &buf
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+	default:
+		t.Fatalf("unexpected wire compression %q", wc)
+	}
+
+	return buf.Bytes()
+}
+
+func TestWireCompressionRoundTrip(t *testing.T) {
+	var lines []string
+	var data bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		line := fmt.Sprintf("m:%d:Mar 10 10:00:00 myhost myapp[123]: message %d", i, i)
+		lines = append(lines, line)
+		data.WriteString(line + "\n")
+	}
+
+	for _, wc := range []WireCompression{WireCompressionGzip, WireCompressionZstd} {
+		t.Run(string(wc), func(t *testing.T) {
+			if err := wc.checkLocalDecompressor(); err != nil {
+				t.Skipf("%s", err)
+			}
+
+			var stream bytes.Buffer
+			stream.WriteString("before\n")
+			stream.WriteString(compressedStartMarkerPrefix + string(wc) + "\n")
+			stream.Write(compressLocally(t, wc, data.Bytes()))
+			stream.WriteString(compressedEndMarker + "\n")
+			stream.WriteString("after\n")
+
+			linesCh := make(chan string, len(lines)+10)
+			getScannerFunc("stdout", &stream, linesCh)()
+
+			var got []string
+			for line := range linesCh {
+				got = append(got, line)
+			}
+
+			want := append([]string{"before"}, lines...)
+			want = append(want, "after")
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestWireCompressionBrokenData(t *testing.T) {
+	var stream bytes.Buffer
+	stream.WriteString(compressedStartMarkerPrefix + string(WireCompressionGzip) + "\n")
+	stream.WriteString("this is not gzip\n")
+	stream.WriteString(compressedEndMarker + "\n")
+
+	linesCh := make(chan string, 10)
+	getScannerFunc("stdout", &stream, linesCh)()
+
+	line := <-linesCh
+	assert.Contains(t, line, "error:failed to decompress data")
+}
+
+func TestWireCompressionCmd(t *testing.T) {
+	assert.Equal(t, []string{"gzip", "-c"}, WireCompressionGzip.compressCmd())
+	assert.Equal(
+		t,
+		"command -v zstd >/dev/null 2>&1 && echo 'wire_compression_ok'",
+		WireCompressionZstd.probeCmd(),
+	)
+}
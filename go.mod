@@ -9,6 +9,7 @@ require (
 	github.com/gobwas/glob v0.2.3
 	github.com/juju/errors v0.0.0-20220324005906-d8c5072c94ab
 	github.com/mattn/go-runewidth v0.0.14
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/mvdan/sh v2.6.4+incompatible
 	github.com/rivo/tview v0.0.0-20230530133550-8bd761dda819
 	github.com/rivo/uniseg v0.4.3
@@ -16,6 +17,7 @@ require (
 	github.com/stretchr/testify v1.7.1
 	golang.design/x/clipboard v0.7.0
 	golang.org/x/crypto v0.0.0-20220321153916-2c7772ba3064
+	golang.org/x/sys v0.5.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
@@ -28,7 +30,6 @@ require (
 	golang.org/x/image v0.6.0 // indirect
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/term v0.5.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
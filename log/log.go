@@ -1,10 +1,13 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,25 +24,81 @@ const (
 	Error
 )
 
+// Format is the format of the log messages.
+type Format string
+
+const (
+	// FormatText is the default human-readable format, like:
+	// "2025-03-10T10:00:00.123: [LSMan] Connected".
+	FormatText Format = "text"
+
+	// FormatJSON makes every message a single-line JSON object with the
+	// "time", "level", "namespace" and "msg" fields, plus the fields added with
+	// WithField; useful when the log is collected by a log collection system.
+	FormatJSON Format = "json"
+)
+
+// ParseFormat parses the format given as a string, like "json". An empty
+// string means FormatText.
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case "", FormatText:
+		return FormatText, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+
+	return "", fmt.Errorf("invalid log format %q, try text or json", s)
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case Verbose3:
+		return "verbose3"
+	case Verbose2:
+		return "verbose2"
+	case Verbose1:
+		return "verbose1"
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+
+	return fmt.Sprintf("level_%d", int(level))
+}
+
+// levelWriter is implemented by the outputs which need to know the level of
+// every message, like the syslog one.
+type levelWriter interface {
+	WriteLevel(level LogLevel, p []byte) error
+}
+
 var logFile *os.File
 var logFileMtx sync.Mutex
 
-// printf prints a formatted message to the log file ~/.nerdlog.log
-func printf(toStdout bool, format string, a ...interface{}) {
-	var w io.Writer
-	if toStdout {
-		w = os.Stdout
-	} else {
+// outputMtx makes sure that the messages written by concurrent goroutines
+// don't interleave.
+var outputMtx sync.Mutex
+
+// write writes a single formatted message (with the trailing newline) to the
+// given writer, or to the log file ~/.nerdlog.log if it's nil.
+func write(w io.Writer, level LogLevel, msg []byte) {
+	if w == nil {
 		w = writer()
 	}
 
-	fmt.Fprintf(w, "%s: ", time.Now().Format("2006-01-02T15:04:05.999"))
+	outputMtx.Lock()
+	defer outputMtx.Unlock()
 
-	if !strings.HasSuffix(format, "\n") {
-		format += "\n"
+	if lw, ok := w.(levelWriter); ok {
+		lw.WriteLevel(level, msg)
+		return
 	}
 
-	fmt.Fprintf(w, format, a...)
+	w.Write(msg)
 }
 
 func writer() io.Writer {
@@ -68,8 +127,17 @@ type Logger struct {
 
 	toStdout bool
 
+	format Format
+
+	// output is where the messages are written to; if nil, it's the log file
+	// ~/.nerdlog.log.
+	output io.Writer
+
 	namespace string
-	context   map[string]string
+
+	// context contains the fields added with WithField. It's never modified
+	// after being set, so it's safe to share between the loggers.
+	context map[string]string
 }
 
 func NewLogger(minLevel LogLevel) *Logger {
@@ -110,6 +178,43 @@ func (l *Logger) WithStdout(toStdout bool) *Logger {
 	return &newLogger
 }
 
+// WithFormat returns a copy of the logger which writes messages in the given
+// format.
+func (l *Logger) WithFormat(format Format) *Logger {
+	l = l.thisOrDefault()
+
+	newLogger := *l
+	newLogger.format = format
+	return &newLogger
+}
+
+// WithOutput returns a copy of the logger which writes messages to the given
+// writer (see also OpenOutput); nil means the log file ~/.nerdlog.log.
+func (l *Logger) WithOutput(w io.Writer) *Logger {
+	l = l.thisOrDefault()
+
+	newLogger := *l
+	newLogger.output = w
+	return &newLogger
+}
+
+// WithField returns a copy of the logger which adds the given field to every
+// message: in the JSON format, it's a separate field, and in the text format,
+// it's printed after the namespace, like "[LSMan host=myhost] Connected".
+func (l *Logger) WithField(key, value string) *Logger {
+	l = l.thisOrDefault()
+
+	context := make(map[string]string, len(l.context)+1)
+	for k, v := range l.context {
+		context[k] = v
+	}
+	context[key] = value
+
+	newLogger := *l
+	newLogger.context = context
+	return &newLogger
+}
+
 func (l *Logger) Verbose3f(format string, a ...interface{}) {
 	l.Printf(Verbose3, format, a...)
 }
@@ -141,9 +246,95 @@ func (l *Logger) Printf(level LogLevel, format string, a ...interface{}) {
 		return
 	}
 
-	if l.namespace != "" {
-		printf(l.toStdout, "[%s] %s", l.namespace, fmt.Sprintf(format, a...))
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+
+	var line []byte
+	if l.format == FormatJSON {
+		line = l.formatJSON(now, level, msg)
 	} else {
-		printf(l.toStdout, "%s", l.namespace, fmt.Sprintf(format, a...))
+		line = l.formatText(now, msg)
 	}
+
+	w := l.output
+	if w == nil && l.toStdout {
+		w = os.Stdout
+	}
+
+	write(w, level, line)
+}
+
+func (l *Logger) formatText(now time.Time, msg string) []byte {
+	var sb strings.Builder
+
+	sb.WriteString(now.Format("2006-01-02T15:04:05.999"))
+	sb.WriteString(": ")
+
+	var tags []string
+	if l.namespace != "" {
+		tags = append(tags, l.namespace)
+	}
+	for _, k := range l.contextKeys() {
+		tags = append(tags, k+"="+l.context[k])
+	}
+
+	if len(tags) > 0 {
+		sb.WriteString("[")
+		sb.WriteString(strings.Join(tags, " "))
+		sb.WriteString("] ")
+	}
+
+	sb.WriteString(msg)
+	sb.WriteString("\n")
+
+	return []byte(sb.String())
+}
+
+func (l *Logger) formatJSON(now time.Time, level LogLevel, msg string) []byte {
+	// The fixed fields go first, so build the object manually instead of
+	// marshaling a map (which would sort all the keys).
+	var buf bytes.Buffer
+
+	writeField := func(k, v string) {
+		if buf.Len() == 0 {
+			buf.WriteString("{")
+		} else {
+			buf.WriteString(",")
+		}
+
+		kj, _ := json.Marshal(k)
+		vj, _ := json.Marshal(v)
+		buf.Write(kj)
+		buf.WriteString(":")
+		buf.Write(vj)
+	}
+
+	writeField("time", now.Format(time.RFC3339Nano))
+	writeField("level", level.String())
+	if l.namespace != "" {
+		writeField("namespace", l.namespace)
+	}
+	for _, k := range l.contextKeys() {
+		switch k {
+		case "time", "level", "namespace", "msg":
+			// Don't let the fields override the fixed ones.
+			continue
+		}
+
+		writeField(k, l.context[k])
+	}
+	writeField("msg", msg)
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+func (l *Logger) contextKeys() []string {
+	keys := make([]string, 0, len(l.context))
+	for k := range l.context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
 }
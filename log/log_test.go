@@ -0,0 +1,136 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := NewLogger(Info).
+		WithFormat(FormatJSON).
+		WithOutput(&buf).
+		WithNamespaceAppended("LSMan").
+		WithNamespaceAppended("LSClient_myhost").
+		WithField("host", "myhost")
+
+	logger.Infof("Connected to %s", "myhost:22")
+	logger.Verbose1f("Not printed")
+	logger.WithField("msg", "ignored").Errorf("Failed:\n%q", "oops")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if !assert.Equal(t, 2, len(lines), buf.String()) {
+		return
+	}
+
+	var msgs []map[string]string
+	for _, line := range lines {
+		var msg map[string]string
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("invalid JSON %q: %s", line, err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	for _, msg := range msgs {
+		assert.NotEmpty(t, msg["time"])
+		delete(msg, "time")
+	}
+
+	assert.Equal(t, []map[string]string{
+		{
+			"level":     "info",
+			"namespace": "LSMan/LSClient_myhost",
+			"host":      "myhost",
+			"msg":       "Connected to myhost:22",
+		},
+		{
+			"level":     "error",
+			"namespace": "LSMan/LSClient_myhost",
+			"host":      "myhost",
+			"msg":       "Failed:\n\"oops\"",
+		},
+	}, msgs)
+
+	// The fixed fields go first.
+	assert.True(t, strings.HasPrefix(lines[0], `{"time":`), lines[0])
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := NewLogger(Info).WithOutput(&buf)
+
+	logger.Infof("No namespace")
+	logger.WithNamespaceAppended("LSMan").Infof("With namespace\n")
+	logger.WithNamespaceAppended("LSMan").WithField("host", "myhost").Warnf("With field")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if !assert.Equal(t, 3, len(lines), buf.String()) {
+		return
+	}
+
+	// Cut the timestamps.
+	for i, line := range lines {
+		parts := strings.SplitN(line, ": ", 2)
+		if !assert.Equal(t, 2, len(parts), line) {
+			return
+		}
+		lines[i] = parts[1]
+	}
+
+	assert.Equal(t, []string{
+		"No namespace",
+		"[LSMan] With namespace",
+		"[LSMan host=myhost] With field",
+	}, lines)
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    Format
+		wantErr bool
+	}{
+		{in: "", want: FormatText},
+		{in: "text", want: FormatText},
+		{in: "json", want: FormatJSON},
+		{in: "xml", wantErr: true},
+	} {
+		got, err := ParseFormat(tc.in)
+		if tc.wantErr {
+			assert.Error(t, err, tc.in)
+			continue
+		}
+
+		assert.NoError(t, err, tc.in)
+		assert.Equal(t, tc.want, got, tc.in)
+	}
+}
+
+func TestOpenOutputFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nerdlog.log")
+
+	w, err := OpenOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	NewLogger(Info).WithFormat(FormatJSON).WithOutput(w).Infof("hello")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg map[string]string
+	assert.NoError(t, json.Unmarshal(data, &msg))
+	assert.Equal(t, "hello", msg["msg"])
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// OutputStdout and OutputStderr are the special values for OpenOutput to
+	// write the log to the standard output or error.
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+
+	// OutputSyslog is the special value for OpenOutput to write the log to
+	// the local syslog daemon.
+	OutputSyslog = "syslog"
+)
+
+// OpenOutput opens the log output given as a string: either a path to the
+// file to append to, or one of the special values OutputStdout, OutputStderr
+// and OutputSyslog. An empty string means the default log file ~/.nerdlog.log,
+// and the returned writer is nil then; see Logger.WithOutput.
+func OpenOutput(spec string) (io.Writer, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case OutputStdout:
+		return os.Stdout, nil
+	case OutputStderr:
+		return os.Stderr, nil
+	case OutputSyslog:
+		w, err := newSyslogOutput()
+		if err != nil {
+			return nil, err
+		}
+
+		return w, nil
+	}
+
+	f, err := os.OpenFile(spec, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening log file: %w", err)
+	}
+
+	return f, nil
+}
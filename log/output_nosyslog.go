@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package log
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogOutput() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
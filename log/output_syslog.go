@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// syslogOutput writes every message to syslog with the priority according to
+// the message level.
+type syslogOutput struct {
+	w *syslog.Writer
+}
+
+var _ levelWriter = &syslogOutput{}
+
+func newSyslogOutput() (*syslogOutput, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "nerdlog")
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+
+	return &syslogOutput{w: w}, nil
+}
+
+func (o *syslogOutput) Write(p []byte) (int, error) {
+	return o.w.Write(p)
+}
+
+func (o *syslogOutput) WriteLevel(level LogLevel, p []byte) error {
+	msg := string(p)
+
+	switch {
+	case level >= Error:
+		return o.w.Err(msg)
+	case level >= Warning:
+		return o.w.Warning(msg)
+	case level >= Info:
+		return o.w.Info(msg)
+	default:
+		return o.w.Debug(msg)
+	}
+}
@@ -0,0 +1,268 @@
+// Package prommetrics implements core.Metrics by keeping all the metrics in
+// memory and exposing them in the Prometheus text format, so that they can be
+// scraped by Prometheus. It doesn't depend on the Prometheus client library.
+package prommetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dimonomid/nerdlog/core"
+)
+
+// DefaultBuckets are the default histogram buckets (upper bounds, in
+// seconds), the same as the Prometheus client library uses.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	metricTypeCounter   metricType = "counter"
+	metricTypeGauge     metricType = "gauge"
+	metricTypeHistogram metricType = "histogram"
+)
+
+// Registry is a core.Metrics which keeps all the metrics in memory; it's an
+// http.Handler serving them in the Prometheus text format.
+type Registry struct {
+	params RegistryParams
+
+	mtx     sync.Mutex
+	metrics map[string]*metric
+}
+
+var _ core.Metrics = &Registry{}
+
+type RegistryParams struct {
+	// Buckets are the upper bounds of the histogram buckets, in increasing
+	// order; the +Inf bucket is always added implicitly. If empty,
+	// DefaultBuckets are used.
+	Buckets []float64
+}
+
+// metric is a single metric with all its series.
+type metric struct {
+	typ metricType
+
+	// series is keyed by the rendered labels, like `{lstream="foo"}`.
+	series map[string]*series
+}
+
+type series struct {
+	labels core.MetricLabels
+
+	// value is the value of the counter or gauge.
+	value float64
+
+	// bucketCounts, sum and count are only used by histograms;
+	// bucketCounts[i] is the number of observations which are less or equal
+	// to the Buckets[i] (but not to the previous bucket).
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry(params RegistryParams) *Registry {
+	if len(params.Buckets) == 0 {
+		params.Buckets = DefaultBuckets
+	}
+
+	return &Registry{
+		params:  params,
+		metrics: map[string]*metric{},
+	}
+}
+
+// getSeries returns the series with the given name and labels, creating it if
+// needed. If the metric already exists but has a different type, returns nil.
+// Must be called with the mutex locked.
+func (r *Registry) getSeries(typ metricType, name string, labels core.MetricLabels) *series {
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &metric{
+			typ:    typ,
+			series: map[string]*series{},
+		}
+		r.metrics[name] = m
+	}
+
+	if m.typ != typ {
+		return nil
+	}
+
+	key := formatLabels(labels, "", "")
+	s, ok := m.series[key]
+	if !ok {
+		labelsCopy := make(core.MetricLabels, len(labels))
+		for k, v := range labels {
+			labelsCopy[k] = v
+		}
+
+		s = &series{labels: labelsCopy}
+		if typ == metricTypeHistogram {
+			s.bucketCounts = make([]uint64, len(r.params.Buckets))
+		}
+
+		m.series[key] = s
+	}
+
+	return s
+}
+
+func (r *Registry) AddCounter(name string, labels core.MetricLabels, delta float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if s := r.getSeries(metricTypeCounter, name, labels); s != nil {
+		s.value += delta
+	}
+}
+
+func (r *Registry) SetGauge(name string, labels core.MetricLabels, value float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if s := r.getSeries(metricTypeGauge, name, labels); s != nil {
+		s.value = value
+	}
+}
+
+func (r *Registry) ObserveHistogram(name string, labels core.MetricLabels, value float64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s := r.getSeries(metricTypeHistogram, name, labels)
+	if s == nil {
+		return
+	}
+
+	for i, upperBound := range r.params.Buckets {
+		if value <= upperBound {
+			s.bucketCounts[i]++
+			break
+		}
+	}
+
+	s.sum += value
+	s.count++
+}
+
+// WriteText writes all the metrics in the Prometheus text format, sorted by
+// the name and labels.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := r.metrics[name]
+
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, m.typ)
+
+		keys := make([]string, 0, len(m.series))
+		for key := range m.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := m.series[key]
+
+			if m.typ != metricTypeHistogram {
+				fmt.Fprintf(bw, "%s%s %s\n", name, key, formatValue(s.value))
+				continue
+			}
+
+			var cumulative uint64
+			for i, upperBound := range r.params.Buckets {
+				cumulative += s.bucketCounts[i]
+				fmt.Fprintf(
+					bw, "%s_bucket%s %d\n",
+					name, formatLabels(s.labels, "le", formatValue(upperBound)), cumulative,
+				)
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", name, formatLabels(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, key, formatValue(s.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, key, s.count)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves all the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// formatLabels renders the labels like `{a="1",b="2"}`, sorted by the label
+// name. If extraName is not empty, this extra label is added at the end (it's
+// used for the "le" label of the histogram buckets). If there are no labels
+// at all, returns an empty string.
+func formatLabels(labels core.MetricLabels, extraName, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("{")
+
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", name, escapeLabelValue(labels[name]))
+	}
+
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", extraName, escapeLabelValue(extraValue))
+	}
+
+	sb.WriteString("}")
+
+	return sb.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,66 @@
+package prommetrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry(RegistryParams{
+		Buckets: []float64{0.1, 1},
+	})
+
+	r.AddCounter(core.MetricQueries, core.MetricLabels{"lstream": "b", "result": "ok"}, 1)
+	r.AddCounter(core.MetricQueries, core.MetricLabels{"result": "ok", "lstream": "a"}, 1)
+	r.AddCounter(core.MetricQueries, core.MetricLabels{"lstream": "a", "result": "ok"}, 2)
+	r.AddCounter(core.MetricQueries, core.MetricLabels{"lstream": `we"ird\`, "result": "error"}, 1)
+
+	r.SetGauge(core.MetricLStreams, core.MetricLabels{"state": "connected_idle"}, 3)
+	r.SetGauge(core.MetricLStreams, core.MetricLabels{"state": "connected_idle"}, 2)
+	r.SetGauge("nerdlog_nolabels", nil, 1.5)
+
+	r.ObserveHistogram(core.MetricQueryDuration, core.MetricLabels{"lstream": "a"}, 0.05)
+	r.ObserveHistogram(core.MetricQueryDuration, core.MetricLabels{"lstream": "a"}, 0.5)
+	r.ObserveHistogram(core.MetricQueryDuration, core.MetricLabels{"lstream": "a"}, 5)
+
+	// The type is defined by the first use, so it's ignored.
+	r.SetGauge(core.MetricQueries, core.MetricLabels{"lstream": "a", "result": "ok"}, 100)
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WriteText(&buf))
+
+	assert.Equal(t, `# TYPE nerdlog_lstreams gauge
+nerdlog_lstreams{state="connected_idle"} 2
+# TYPE nerdlog_nolabels gauge
+nerdlog_nolabels 1.5
+# TYPE nerdlog_queries_total counter
+nerdlog_queries_total{lstream="a",result="ok"} 3
+nerdlog_queries_total{lstream="b",result="ok"} 1
+nerdlog_queries_total{lstream="we\"ird\\",result="error"} 1
+# TYPE nerdlog_query_duration_seconds histogram
+nerdlog_query_duration_seconds_bucket{lstream="a",le="0.1"} 1
+nerdlog_query_duration_seconds_bucket{lstream="a",le="1"} 2
+nerdlog_query_duration_seconds_bucket{lstream="a",le="+Inf"} 3
+nerdlog_query_duration_seconds_sum{lstream="a"} 5.55
+nerdlog_query_duration_seconds_count{lstream="a"} 3
+`, buf.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := NewRegistry(RegistryParams{})
+	r.AddCounter(core.MetricConnectionsOpened, core.MetricLabels{"lstream": "a"}, 1)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE nerdlog_connections_opened_total counter\n"+
+		"nerdlog_connections_opened_total{lstream=\"a\"} 1\n", string(body))
+}